@@ -0,0 +1,67 @@
+package arm_emulate
+
+// This file defines the architecture versions which may be emulated.
+
+import (
+	"fmt"
+)
+
+// Identifies a version of the ARM architecture. This determines which
+// instructions are decoded, and how some of them behave.
+type ARMArchitecture uint8
+
+const (
+	// The architecture of the ARM7TDMI and ARM920T.
+	ARMv4T ARMArchitecture = iota
+	// The architecture of the ARM946E-S and ARM926EJ-S, adding clz, blx,
+	// saturating arithmetic, halfword multiplies, ldrd and strd to ARMv4T.
+	ARMv5TE
+	// The architecture of the ARM11 cores, adding exclusive loads and stores,
+	// SIMD media instructions and new exception handling instructions.
+	ARMv6
+	// The architecture of the Cortex-A cores, adding the 32-bit Thumb-2
+	// instructions and IT blocks in THUMB state. ARM state instructions are
+	// decoded in the same way as in ARMv6.
+	ARMv7
+	// The microcontroller profile of ARMv7, used by the Cortex-M3 and
+	// Cortex-M4. It decodes THUMB instructions in the same way as ARMv7, but
+	// has no ARM state. Only processors created by NewARMv7MProcessor use it.
+	ARMv7M
+)
+
+// The architecture used by ParseInstruction, ParseTHUMBInstruction and new
+// processors. This was ARMv4T before ARMv5TE and ARMv6 were supported, so the
+// README lists what changed for existing callers.
+const defaultArchitecture = ARMv6
+
+var architectureStrings = [...]string{"ARMv4T", "ARMv5TE", "ARMv6",
+	"ARMv7", "ARMv7-M"}
+
+func (a ARMArchitecture) String() string {
+	if int(a) >= len(architectureStrings) {
+		return fmt.Sprintf("<invalid architecture %d>", uint8(a))
+	}
+	return architectureStrings[a]
+}
+
+func (a ARMArchitecture) isValid() bool {
+	return int(a) < len(architectureStrings)
+}
+
+// Returns the bits of a PSR which are written by msr when only the flags are
+// written, or when running in user mode. ARMv5TE adds the Q flag to these.
+func (a ARMArchitecture) flagsMask() uint32 {
+	if a >= ARMv5TE {
+		return 0xf8000000
+	}
+	return 0xf0000000
+}
+
+// Returns the bits of the CPSR which may be written in user mode. ARMv6 adds
+// the GE flags and the E bit to the flags.
+func (a ARMArchitecture) userMask() uint32 {
+	if a >= ARMv6 {
+		return a.flagsMask() | 0x000f0200
+	}
+	return a.flagsMask()
+}
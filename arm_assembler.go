@@ -0,0 +1,2094 @@
+package arm_emulate
+
+// This file contains the parts of the assembler which encode ARM instructions.
+
+import (
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var assemblerRegisterNames = map[string]ARMRegister{
+	"sp": 13, "lr": 14, "pc": 15, "ip": 12, "fp": 11, "sl": 10, "sb": 9,
+}
+
+// Returns the register named by the token, if it names one.
+func parseAssemblerRegister(t assemblerToken) (ARMRegister, bool) {
+	name := t.lower()
+	if r, ok := assemblerRegisterNames[name]; ok {
+		return r, true
+	}
+	if (len(name) < 2) || (len(name) > 3) || (name[0] != 'r') {
+		return 0, false
+	}
+	if (name[1] == '0') && (len(name) == 3) {
+		return 0, false
+	}
+	number := 0
+	for _, c := range name[1:] {
+		if (c < '0') || (c > '9') {
+			return 0, false
+		}
+		number = number*10 + int(c-'0')
+	}
+	if number > 15 {
+		return 0, false
+	}
+	return ARMRegister(number), true
+}
+
+func expectAssemblerRegister(t assemblerToken) (ARMRegister, error) {
+	r, ok := parseAssemblerRegister(t)
+	if !ok {
+		return 0, t.errorf("Expected a register, got %q", t.text)
+	}
+	return r, nil
+}
+
+// Returns the token without a leading '#', as used for immediate values.
+func stripAssemblerHash(t assemblerToken) assemblerToken {
+	if strings.HasPrefix(t.text, "#") {
+		return t.slice(1, len(t.text))
+	}
+	return t
+}
+
+// Parses a register list such as {r0-r3, lr}, returning a bitfield of the
+// registers.
+func parseAssemblerRegisterList(t assemblerToken) (uint16, error) {
+	if !strings.HasPrefix(t.text, "{") || !strings.HasSuffix(t.text, "}") {
+		return 0, t.errorf("Expected a register list, got %q", t.text)
+	}
+	list := t.slice(1, len(t.text)-1)
+	toReturn := uint16(0)
+	for _, item := range list.split() {
+		dash := strings.IndexByte(item.text, '-')
+		if dash < 0 {
+			r, e := expectAssemblerRegister(item)
+			if e != nil {
+				return 0, e
+			}
+			toReturn |= 1 << r
+			continue
+		}
+		first, e := expectAssemblerRegister(item.slice(0, dash))
+		if e != nil {
+			return 0, e
+		}
+		last, e := expectAssemblerRegister(item.slice(dash+1,
+			len(item.text)))
+		if e != nil {
+			return 0, e
+		}
+		if last < first {
+			return 0, item.errorf("Invalid register range %s", item.text)
+		}
+		for r := first; r <= last; r++ {
+			toReturn |= 1 << r
+		}
+	}
+	return toReturn, nil
+}
+
+var assemblerConditions = map[string]uint32{
+	"eq": 0, "ne": 1, "cs": 2, "hs": 2, "cc": 3, "lo": 3, "mi": 4, "pl": 5,
+	"vs": 6, "vc": 7, "hi": 8, "ls": 9, "ge": 10, "lt": 11, "gt": 12,
+	"le": 13, "al": 14, "": 14,
+}
+
+// Describes an ARM mnemonic, along with the suffixes which may appear before
+// or after its condition code.
+type armAssemblerMnemonic struct {
+	name     string
+	suffixes []string
+	// Set for instructions which can't be conditional.
+	unconditional bool
+	encode        func(s *armAssemblerStatement) (uint32, error)
+}
+
+// An ARM instruction being assembled.
+type armAssemblerStatement struct {
+	a         *assembler
+	item      *assemblerItem
+	mnemonic  assemblerToken
+	name      string
+	suffix    string
+	condition uint32
+	operands  []assemblerToken
+	// Set by ldr rX, =value if the value is placed in a literal pool.
+	literal *assemblerLiteral
+}
+
+func (s *armAssemblerStatement) errorf(format string,
+	args ...interface{}) error {
+	return s.mnemonic.errorf(format, args...)
+}
+
+// Returns an error at the first operand beyond the given number, if there are
+// too many of them.
+func (s *armAssemblerStatement) maximumOperands(count int) error {
+	if len(s.operands) > count {
+		return s.operands[count].errorf("Unexpected %q",
+			s.operands[count].text)
+	}
+	return nil
+}
+
+// Checks that the statement has the given number of operands.
+func (s *armAssemblerStatement) expectOperands(count int) error {
+	e := s.maximumOperands(count)
+	if e != nil {
+		return e
+	}
+	if len(s.operands) != count {
+		return s.errorf("%s requires %d operands, got %d", s.mnemonic.text,
+			count, len(s.operands))
+	}
+	return nil
+}
+
+// Parses each operand as a register, requiring the given number of them.
+func (s *armAssemblerStatement) registers(count int) ([]ARMRegister, error) {
+	e := s.expectOperands(count)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]ARMRegister, count)
+	for i, t := range s.operands {
+		toReturn[i], e = expectAssemblerRegister(t)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return toReturn, nil
+}
+
+func (s *armAssemblerStatement) evaluate(t assemblerToken) (uint32, error) {
+	return s.a.evaluate(t, s.item.index, s.item.address)
+}
+
+// Evaluates an immediate operand, which may start with '#', and checks that it
+// doesn't exceed the given maximum.
+func (s *armAssemblerStatement) immediate(t assemblerToken,
+	maximum uint32) (uint32, error) {
+	t = stripAssemblerHash(t)
+	value, e := s.evaluate(t)
+	if e != nil {
+		return 0, e
+	}
+	if value > maximum {
+		return 0, t.errorf("%d is out of range; the maximum is %d", value,
+			maximum)
+	}
+	return value, nil
+}
+
+// Returns the offset from the PC (the instruction's address + 8) to the
+// target of a branch or PC-relative operand. Operands which only contain
+// numbers are treated as offsets in the format printed by the disassembler,
+// which are relative to the PC + numericBase, rather than as addresses.
+func (a *assembler) relativeOffset(t assemblerToken, item *assemblerItem,
+	pc uint32, numericBase int32) (int32, error) {
+	t = stripAssemblerHash(t)
+	value, isAddress, e := a.evaluateAddress(t, item.index, item.address)
+	if e != nil {
+		return 0, e
+	}
+	if isAddress {
+		return int32(value - pc), nil
+	}
+	return int32(value) + numericBase, nil
+}
+
+// Returns the rotated 12-bit form of the value, and false if the value can't
+// be encoded as an 8-bit value rotated right by an even amount.
+func encodeARMImmediate(value uint32) (uint32, bool) {
+	for rotate := 0; rotate < 16; rotate++ {
+		v := bits.RotateLeft32(value, rotate*2)
+		if v <= 0xff {
+			return (uint32(rotate) << 8) | v, true
+		}
+	}
+	return 0, false
+}
+
+var assemblerShiftTypes = map[string]uint32{
+	"lsl": 0, "asl": 0, "lsr": 1, "asr": 2, "ror": 3,
+}
+
+// Returns true if the token starts with the name of a shift.
+func isAssemblerShift(t assemblerToken) bool {
+	name := t.lower()
+	if name == "rrx" {
+		return true
+	}
+	if len(name) < 4 {
+		return false
+	}
+	_, ok := assemblerShiftTypes[name[:3]]
+	return ok && ((name[3] == ' ') || (name[3] == '\t') || (name[3] == '#'))
+}
+
+// Parses a shift such as "lsl #2", "lsl 2", "asr r3" or "rrx", returning the
+// 8-bit shift field used in bits 4-11 of ARM instructions.
+func (s *armAssemblerStatement) parseShift(t assemblerToken,
+	allowRegister bool) (uint32, error) {
+	name := t.lower()
+	if name == "rrx" {
+		return 3 << 1, nil
+	}
+	if !isAssemblerShift(t) {
+		return 0, t.errorf("Expected a shift, got %q", t.text)
+	}
+	shiftType := assemblerShiftTypes[name[:3]]
+	amount := t.slice(3, len(t.text))
+	if r, ok := parseAssemblerRegister(amount); ok {
+		if !allowRegister {
+			return 0, amount.errorf("A register shift can't be used here")
+		}
+		return (uint32(r) << 4) | (shiftType << 1) | 1, nil
+	}
+	value, e := s.immediate(amount, 32)
+	if e != nil {
+		return 0, e
+	}
+	switch {
+	case value == 0:
+		// A shift by 0 is always encoded as lsl, since the other shifts use
+		// 0 to mean 32 or rrx.
+		shiftType = 0
+	case value == 32:
+		if (shiftType != 1) && (shiftType != 2) {
+			return 0, amount.errorf("Invalid shift amount: 32")
+		}
+		value = 0
+	}
+	return (value << 3) | (shiftType << 1), nil
+}
+
+// Parses a register, optionally followed by a shift, either as a separate
+// operand or after a space as printed by the disassembler. Returns the
+// register and shift field.
+func (s *armAssemblerStatement) parseShiftedRegister(
+	operands []assemblerToken, allowRegister bool) (ARMRegister, uint32,
+	error) {
+	if (len(operands) == 0) || (len(operands) > 2) {
+		return 0, 0, s.errorf("Expected a register and optional shift")
+	}
+	t := operands[0]
+	shift := assemblerToken{}
+	if len(operands) == 2 {
+		shift = operands[1]
+	} else if space := strings.IndexAny(t.text, " \t"); space >= 0 {
+		shift = t.slice(space, len(t.text))
+		t = t.slice(0, space)
+	}
+	r, e := expectAssemblerRegister(t)
+	if e != nil {
+		return 0, 0, e
+	}
+	if shift.text == "" {
+		return r, 0, nil
+	}
+	field, e := s.parseShift(shift, allowRegister)
+	return r, field, e
+}
+
+// Encodes the flexible second operand of a data processing instruction.
+// Returns the bits to combine with the instruction, including bit 25 for
+// immediates. If the operand is an immediate which can't be encoded, this
+// returns the value and false, so the caller can try another opcode.
+func (s *armAssemblerStatement) operand2(operands []assemblerToken) (uint32,
+	uint32, bool, error) {
+	if len(operands) == 1 {
+		t := operands[0]
+		first := t
+		if space := strings.IndexAny(t.text, " \t"); space >= 0 {
+			first = t.slice(0, space)
+		}
+		if _, ok := parseAssemblerRegister(first); !ok {
+			value, e := s.evaluate(stripAssemblerHash(t))
+			if e != nil {
+				return 0, 0, false, e
+			}
+			encoded, ok := encodeARMImmediate(value)
+			return encoded | 0x2000000, value, ok, nil
+		}
+	}
+	r, shift, e := s.parseShiftedRegister(operands, true)
+	if e != nil {
+		return 0, 0, false, e
+	}
+	return (shift << 4) | uint32(r), 0, true, nil
+}
+
+// Returns an equivalent opcode which uses the complement or negation of an
+// immediate operand, along with the adjusted immediate.
+func alternateARMOpcode(opcode ARMDataProcessingOpcode,
+	value uint32) (ARMDataProcessingOpcode, uint32, bool) {
+	switch opcode {
+	case movARMOpcode:
+		return mvnARMOpcode, ^value, true
+	case mvnARMOpcode:
+		return movARMOpcode, ^value, true
+	case andARMOpcode:
+		return bicARMOpcode, ^value, true
+	case bicARMOpcode:
+		return andARMOpcode, ^value, true
+	case adcARMOpcode:
+		return sbcARMOpcode, ^value, true
+	case sbcARMOpcode:
+		return adcARMOpcode, ^value, true
+	case addARMOpcode:
+		return subARMOpcode, -value, true
+	case subARMOpcode:
+		return addARMOpcode, -value, true
+	case cmpARMOpcode:
+		return cmnARMOpcode, -value, true
+	case cmnARMOpcode:
+		return cmpARMOpcode, -value, true
+	}
+	return 0, 0, false
+}
+
+// Encodes a data processing instruction with the given operands, following
+// Rd and Rn.
+func (s *armAssemblerStatement) dataProcessing(opcode ARMDataProcessingOpcode,
+	setConditions bool, rd, rn ARMRegister,
+	operands []assemblerToken) (uint32, error) {
+	if opcode >= tstARMOpcode && opcode <= cmnARMOpcode {
+		setConditions = true
+	}
+	bits, value, ok, e := s.operand2(operands)
+	if e != nil {
+		return 0, e
+	}
+	if !ok {
+		alternate, newValue, hasAlternate := alternateARMOpcode(opcode, value)
+		encoded, encodable := encodeARMImmediate(newValue)
+		if !hasAlternate || !encodable {
+			return 0, operands[0].errorf("0x%x can't be encoded as a "+
+				"rotated 8-bit immediate", value)
+		}
+		opcode = alternate
+		bits = encoded | 0x2000000
+	}
+	raw := (s.condition << 28) | (uint32(opcode) << 21) | (uint32(rn) << 16) |
+		(uint32(rd) << 12) | bits
+	if setConditions {
+		raw |= 0x100000
+	}
+	return raw, nil
+}
+
+func (s *armAssemblerStatement) encodeDataProcessing() (uint32, error) {
+	var opcode ARMDataProcessingOpcode
+	for i, name := range opcodeStrings {
+		if name == s.name {
+			opcode = ARMDataProcessingOpcode(i)
+		}
+	}
+	if len(s.operands) < 2 {
+		return 0, s.errorf("%s requires at least 2 operands", s.mnemonic.text)
+	}
+	first, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	setConditions := s.suffix == "s"
+	switch opcode {
+	case movARMOpcode, mvnARMOpcode:
+		return s.dataProcessing(opcode, setConditions, first, 0,
+			s.operands[1:])
+	case tstARMOpcode, teqARMOpcode, cmpARMOpcode, cmnARMOpcode:
+		return s.dataProcessing(opcode, setConditions, 0, first,
+			s.operands[1:])
+	}
+	// GNU as allows the first operand to be omitted if it's the same as
+	// the destination.
+	if (len(s.operands) == 2) || isAssemblerShift(s.operands[2]) {
+		return s.dataProcessing(opcode, setConditions, first, first,
+			s.operands[1:])
+	}
+	rn, e := expectAssemblerRegister(s.operands[1])
+	if e != nil {
+		return 0, e
+	}
+	return s.dataProcessing(opcode, setConditions, first, rn, s.operands[2:])
+}
+
+// Encodes lsl, lsr, asr, ror and rrx, which are aliases for mov.
+func (s *armAssemblerStatement) encodeShiftAlias() (uint32, error) {
+	e := s.maximumOperands(3)
+	if e != nil {
+		return 0, e
+	}
+	if len(s.operands) < 2 {
+		return 0, s.errorf("%s requires at least 2 operands", s.mnemonic.text)
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	setConditions := s.suffix == "s"
+	if s.name == "rrx" {
+		e = s.expectOperands(2)
+		if e != nil {
+			return 0, e
+		}
+		shift := assemblerToken{"rrx", s.mnemonic.line, s.mnemonic.column}
+		return s.dataProcessing(movARMOpcode, setConditions, rd, 0,
+			[]assemblerToken{s.operands[1], shift})
+	}
+	rm := s.operands[0]
+	amount := s.operands[1]
+	if len(s.operands) == 3 {
+		rm = s.operands[1]
+		amount = s.operands[2]
+	} else if len(s.operands) != 2 {
+		return 0, s.errorf("%s requires 2 or 3 operands", s.mnemonic.text)
+	}
+	shift := assemblerToken{s.name + " " + amount.text, amount.line,
+		amount.column}
+	return s.dataProcessing(movARMOpcode, setConditions, rd, 0,
+		[]assemblerToken{rm, shift})
+}
+
+// Parses a PSR name such as cpsr, spsr_fc or cpsr_flags, returning the R bit
+// and field mask.
+func parseAssemblerPSR(t assemblerToken) (uint32, uint32, bool) {
+	name := t.lower()
+	fields := "all"
+	if underscore := strings.IndexByte(name, '_'); underscore >= 0 {
+		fields = name[underscore+1:]
+		name = name[:underscore]
+	}
+	var r uint32
+	switch name {
+	case "cpsr", "apsr":
+	case "spsr":
+		r = 1
+	default:
+		return 0, 0, false
+	}
+	switch fields {
+	case "all":
+		return r, 9, true
+	case "flg", "flags", "nzcvq":
+		return r, 8, true
+	case "ctl":
+		return r, 1, true
+	case "g":
+		return r, 4, true
+	case "nzcvqg":
+		return r, 0xc, true
+	}
+	mask := uint32(0)
+	for _, c := range fields {
+		bit := strings.IndexRune("cxsf", c)
+		if (bit < 0) || ((mask & (1 << uint(bit))) != 0) {
+			return 0, 0, false
+		}
+		mask |= 1 << uint(bit)
+	}
+	return r, mask, mask != 0
+}
+
+func (s *armAssemblerStatement) encodePSRTransfer() (uint32, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	raw := s.condition << 28
+	if s.name == "mrs" {
+		rd, e := expectAssemblerRegister(s.operands[0])
+		if e != nil {
+			return 0, e
+		}
+		r, _, ok := parseAssemblerPSR(s.operands[1])
+		if !ok {
+			return 0, s.operands[1].errorf("Expected cpsr or spsr, got %q",
+				s.operands[1].text)
+		}
+		return raw | 0x010f0000 | (r << 22) | (uint32(rd) << 12), nil
+	}
+	psr, source := s.operands[0], s.operands[1]
+	// The disassembler prints the register first if it writes the whole
+	// PSR.
+	if _, ok := parseAssemblerRegister(psr); ok {
+		psr, source = source, psr
+	}
+	r, mask, ok := parseAssemblerPSR(psr)
+	if !ok {
+		return 0, psr.errorf("Expected a PSR, such as cpsr_fc, got %q",
+			psr.text)
+	}
+	raw |= 0x0120f000 | (r << 22) | (mask << 16)
+	if rm, ok := parseAssemblerRegister(source); ok {
+		return raw | uint32(rm), nil
+	}
+	value, e := s.evaluate(stripAssemblerHash(source))
+	if e != nil {
+		return 0, e
+	}
+	encoded, ok := encodeARMImmediate(value)
+	if !ok {
+		return 0, source.errorf("0x%x can't be encoded as a rotated 8-bit "+
+			"immediate", value)
+	}
+	return raw | 0x2000000 | encoded, nil
+}
+
+func (s *armAssemblerStatement) encodeMultiply() (uint32, error) {
+	raw := (s.condition << 28) | 0x90
+	if s.suffix == "s" {
+		raw |= 0x100000
+	}
+	switch s.name {
+	case "mul", "mla":
+		count := 3
+		if s.name == "mla" {
+			raw |= 0x200000
+			count = 4
+		}
+		r, e := s.registers(count)
+		if e != nil {
+			return 0, e
+		}
+		rd, rm, rs := r[0], r[1], r[2]
+		// Rd and Rm must differ, but the operands can be swapped.
+		if rd == rm {
+			rm, rs = rs, rm
+		}
+		raw |= (uint32(rd) << 16) | (uint32(rs) << 8) | uint32(rm)
+		if count == 4 {
+			raw |= uint32(r[3]) << 12
+		}
+		return raw, nil
+	}
+	r, e := s.registers(4)
+	if e != nil {
+		return 0, e
+	}
+	rdLow, rdHigh, rm, rs := r[0], r[1], r[2], r[3]
+	if (rm == rdLow) || (rm == rdHigh) {
+		rm, rs = rs, rm
+	}
+	raw |= 0x800000 | (uint32(rdHigh) << 16) | (uint32(rdLow) << 12) |
+		(uint32(rs) << 8) | uint32(rm)
+	if s.name[0] == 's' {
+		raw |= 0x400000
+	}
+	if strings.HasSuffix(s.name, "lal") {
+		raw |= 0x200000
+	}
+	return raw, nil
+}
+
+// Holds a parsed load or store address.
+type armAssemblerAddress struct {
+	rn        ARMRegister
+	preindex  bool
+	writeBack bool
+	up        bool
+	// Set if the offset is an immediate rather than a register.
+	immediate bool
+	offset    uint32
+	rm        ARMRegister
+	shift     uint32
+	token     assemblerToken
+}
+
+// Parses an offset operand, which is either an immediate or a register which
+// may be preceded by a sign and followed by a shift.
+func (s *armAssemblerStatement) parseOffset(address *armAssemblerAddress,
+	operands []assemblerToken) error {
+	t := stripAssemblerHash(operands[0])
+	unsigned := t
+	negative := false
+	if strings.HasPrefix(t.text, "-") || strings.HasPrefix(t.text, "+") {
+		negative = t.text[0] == '-'
+		unsigned = t.slice(1, len(t.text))
+	}
+	first := unsigned
+	if space := strings.IndexAny(unsigned.text, " \t"); space >= 0 {
+		first = unsigned.slice(0, space)
+	}
+	if _, ok := parseAssemblerRegister(first); ok {
+		if strings.HasPrefix(operands[0].text, "#") {
+			return operands[0].errorf("Expected an immediate, got %q",
+				operands[0].text)
+		}
+		rm, shift, e := s.parseShiftedRegister(append(
+			[]assemblerToken{unsigned}, operands[1:]...), false)
+		if e != nil {
+			return e
+		}
+		address.immediate = false
+		address.up = !negative
+		address.rm = rm
+		address.shift = shift
+		return nil
+	}
+	if len(operands) > 1 {
+		return operands[1].errorf("Unexpected %q", operands[1].text)
+	}
+	value, e := s.evaluate(t)
+	if e != nil {
+		return e
+	}
+	address.immediate = true
+	address.up = int32(value) >= 0
+	if (value == 0) && negative {
+		address.up = false
+	}
+	address.offset = value
+	if !address.up {
+		address.offset = -value
+	}
+	return nil
+}
+
+// Parses the address operands of a load or store. PC-relative addresses may
+// be given as an expression, with numbers being interpreted as offsets from
+// the instruction, as printed by the disassembler.
+func (s *armAssemblerStatement) parseAddress(
+	operands []assemblerToken) (*armAssemblerAddress, error) {
+	if len(operands) == 0 {
+		return nil, s.errorf("%s requires an address", s.mnemonic.text)
+	}
+	t := operands[0]
+	toReturn := &armAssemblerAddress{
+		immediate: true,
+		up:        true,
+		preindex:  true,
+		token:     t,
+	}
+	if !strings.HasPrefix(t.text, "[") {
+		if len(operands) != 1 {
+			return nil, operands[1].errorf("Unexpected %q", operands[1].text)
+		}
+		offset, e := s.a.relativeOffset(t, s.item, s.item.address+8, -8)
+		if e != nil {
+			return nil, e
+		}
+		toReturn.rn = 15
+		toReturn.up = offset >= 0
+		if offset < 0 {
+			offset = -offset
+		}
+		toReturn.offset = uint32(offset)
+		return toReturn, nil
+	}
+	end := strings.IndexByte(t.text, ']')
+	if end < 0 {
+		return nil, t.errorf("Missing ]")
+	}
+	inside := t.slice(1, end).split()
+	if len(inside) == 0 {
+		return nil, t.errorf("Missing base register")
+	}
+	rn, e := expectAssemblerRegister(inside[0])
+	if e != nil {
+		return nil, e
+	}
+	toReturn.rn = rn
+	after := t.slice(end+1, len(t.text))
+	switch after.text {
+	case "":
+	case "!":
+		toReturn.writeBack = true
+	default:
+		return nil, after.errorf("Unexpected %q", after.text)
+	}
+	if len(inside) > 1 {
+		if len(operands) > 1 {
+			return nil, operands[1].errorf("Unexpected %q", operands[1].text)
+		}
+		e = s.parseOffset(toReturn, inside[1:])
+		return toReturn, e
+	}
+	if len(operands) == 1 {
+		return toReturn, nil
+	}
+	if toReturn.writeBack {
+		return nil, operands[1].errorf("Unexpected %q", operands[1].text)
+	}
+	// This is a post-indexed address, which always writes back. The W bit
+	// is only set for the user-mode ldrt and strt forms.
+	toReturn.preindex = false
+	e = s.parseOffset(toReturn, operands[1:])
+	return toReturn, e
+}
+
+func (s *armAssemblerStatement) encodeSingleDataTransfer() (uint32, error) {
+	if len(s.operands) < 2 {
+		return 0, s.errorf("%s requires at least 2 operands", s.mnemonic.text)
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	raw := (s.condition << 28) | 0x04000000 | (uint32(rd) << 12)
+	if s.name == "ldr" {
+		raw |= 0x100000
+	}
+	if strings.HasPrefix(s.suffix, "b") {
+		raw |= 0x400000
+	}
+	if s.literal != nil {
+		offset := int64(s.literal.address) - int64(s.item.address+8)
+		if (offset < -4095) || (offset > 4095) {
+			return 0, s.operands[1].errorf("The literal pool is out of " +
+				"range; add a .ltorg directive closer to this instruction")
+		}
+		raw |= 0x1000000 | (15 << 16)
+		if offset >= 0 {
+			return raw | 0x800000 | uint32(offset), nil
+		}
+		return raw | uint32(-offset), nil
+	}
+	address, e := s.parseAddress(s.operands[1:])
+	if e != nil {
+		return 0, e
+	}
+	user := strings.HasSuffix(s.suffix, "t")
+	if user {
+		if address.preindex && (len(s.operands) > 2 ||
+			(address.offset != 0) || address.writeBack) {
+			return 0, address.token.errorf("%s requires a post-indexed "+
+				"address", s.mnemonic.text)
+		}
+		address.preindex = false
+		address.writeBack = true
+	}
+	raw |= uint32(address.rn) << 16
+	if address.preindex {
+		raw |= 0x1000000
+	}
+	if address.writeBack {
+		raw |= 0x200000
+	}
+	if address.up {
+		raw |= 0x800000
+	}
+	if !address.immediate {
+		return raw | 0x2000000 | (address.shift << 4) | uint32(address.rm),
+			nil
+	}
+	if address.offset > 4095 {
+		return 0, address.token.errorf("Offset %d is out of range",
+			address.offset)
+	}
+	return raw | address.offset, nil
+}
+
+// Encodes ldrh, strh, ldrsb, ldrsh, ldrd and strd.
+func (s *armAssemblerStatement) encodeHalfwordDataTransfer() (uint32,
+	error) {
+	operands := s.operands
+	if len(operands) < 2 {
+		return 0, s.errorf("%s requires at least 2 operands", s.mnemonic.text)
+	}
+	rd, e := expectAssemblerRegister(operands[0])
+	if e != nil {
+		return 0, e
+	}
+	raw := (s.condition << 28) | 0x90 | (uint32(rd) << 12)
+	load := s.name == "ldr"
+	switch s.suffix {
+	case "h":
+		raw |= 0x20
+	case "sb":
+		raw |= 0x40
+	case "sh":
+		raw |= 0x60
+	case "d":
+		// ldrd and strd may name the second register explicitly.
+		if r, ok := parseAssemblerRegister(operands[1]); ok {
+			if r != (rd + 1) {
+				return 0, operands[1].errorf("The second register must "+
+					"be %s", rd+1)
+			}
+			operands = operands[1:]
+		}
+		if load {
+			raw |= 0x40
+		} else {
+			raw |= 0x60
+		}
+		load = false
+	}
+	if load {
+		raw |= 0x100000
+	}
+	address, e := s.parseAddress(operands[1:])
+	if e != nil {
+		return 0, e
+	}
+	raw |= uint32(address.rn) << 16
+	if address.preindex {
+		raw |= 0x1000000
+	}
+	if address.writeBack {
+		raw |= 0x200000
+	}
+	if address.up {
+		raw |= 0x800000
+	}
+	if !address.immediate {
+		if address.shift != 0 {
+			return 0, address.token.errorf("%s can't use a shifted "+
+				"register", s.mnemonic.text)
+		}
+		return raw | uint32(address.rm), nil
+	}
+	if address.offset > 255 {
+		return 0, address.token.errorf("Offset %d is out of range",
+			address.offset)
+	}
+	return raw | 0x400000 | ((address.offset & 0xf0) << 4) |
+		(address.offset & 0xf), nil
+}
+
+func (s *armAssemblerStatement) encodePreload() (uint32, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	address, e := s.parseAddress(s.operands)
+	if e != nil {
+		return 0, e
+	}
+	if !address.preindex || address.writeBack {
+		return 0, address.token.errorf("pld can't write back")
+	}
+	raw := uint32(0xf550f000) | (uint32(address.rn) << 16)
+	if address.up {
+		raw |= 0x800000
+	}
+	if !address.immediate {
+		return raw | 0x2000000 | (address.shift << 4) | uint32(address.rm),
+			nil
+	}
+	if address.offset > 4095 {
+		return 0, address.token.errorf("Offset %d is out of range",
+			address.offset)
+	}
+	return raw | address.offset, nil
+}
+
+func (s *armAssemblerStatement) encodeSwap() (uint32, error) {
+	e := s.expectOperands(3)
+	if e != nil {
+		return 0, e
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	rm, e := expectAssemblerRegister(s.operands[1])
+	if e != nil {
+		return 0, e
+	}
+	t := s.operands[2]
+	if !strings.HasPrefix(t.text, "[") || !strings.HasSuffix(t.text, "]") {
+		return 0, t.errorf("Expected [register], got %q", t.text)
+	}
+	rn, e := expectAssemblerRegister(t.slice(1, len(t.text)-1))
+	if e != nil {
+		return 0, e
+	}
+	raw := (s.condition << 28) | 0x01000090 | (uint32(rn) << 16) |
+		(uint32(rd) << 12) | uint32(rm)
+	if s.suffix == "b" {
+		raw |= 0x400000
+	}
+	return raw, nil
+}
+
+func (s *armAssemblerStatement) encodeExclusive() (uint32, error) {
+	count := 2
+	if s.name == "strex" {
+		count = 3
+	}
+	e := s.expectOperands(count)
+	if e != nil {
+		return 0, e
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	address, e := s.parseAddress(s.operands[count-1:])
+	if e != nil {
+		return 0, e
+	}
+	if !address.immediate || (address.offset != 0) || address.writeBack {
+		return 0, address.token.errorf("%s only supports [register] "+
+			"addresses", s.name)
+	}
+	raw := (s.condition << 28) | (uint32(address.rn) << 16) |
+		(uint32(rd) << 12)
+	if s.name == "ldrex" {
+		return raw | 0x01900f9f, nil
+	}
+	rm, e := expectAssemblerRegister(s.operands[1])
+	if e != nil {
+		return 0, e
+	}
+	return raw | 0x01800f90 | uint32(rm), nil
+}
+
+// The P and U bits for each block data transfer addressing mode. The stack
+// modes differ for loads and stores.
+var blockTransferModes = map[string]uint32{
+	"": 1, "ia": 1, "ib": 3, "da": 0, "db": 2,
+}
+
+var loadStackModes = map[string]string{
+	"fd": "ia", "ed": "ib", "fa": "da", "ea": "db",
+}
+
+var storeStackModes = map[string]string{
+	"fd": "db", "ed": "da", "fa": "ib", "ea": "ia",
+}
+
+func (s *armAssemblerStatement) encodeBlockDataTransfer() (uint32, error) {
+	operands := s.operands
+	mode := s.suffix
+	load := s.name == "ldm"
+	switch s.name {
+	case "push", "pop":
+		if len(operands) == 0 {
+			return 0, s.errorf("%s requires a register list", s.name)
+		}
+		load = s.name == "pop"
+		mode = "db"
+		if load {
+			mode = "ia"
+		}
+		sp := assemblerToken{"sp!", s.mnemonic.line, s.mnemonic.column}
+		operands = append([]assemblerToken{sp}, operands...)
+	}
+	if load {
+		if m, ok := loadStackModes[mode]; ok {
+			mode = m
+		}
+	} else if m, ok := storeStackModes[mode]; ok {
+		mode = m
+	}
+	if len(operands) < 2 {
+		return 0, s.errorf("%s requires a base register and a register "+
+			"list", s.mnemonic.text)
+	}
+	raw := (s.condition << 28) | 0x08000000 |
+		(blockTransferModes[mode] << 23)
+	if load {
+		raw |= 0x100000
+	}
+	base := operands[0]
+	if strings.HasSuffix(base.text, "!") {
+		raw |= 0x200000
+		base = base.slice(0, len(base.text)-1)
+	}
+	rn, e := expectAssemblerRegister(base)
+	if e != nil {
+		return 0, e
+	}
+	raw |= uint32(rn) << 16
+	if len(operands) > 2 {
+		return 0, operands[2].errorf("Unexpected %q", operands[2].text)
+	}
+	list := operands[1]
+	if strings.HasSuffix(list.text, "^") {
+		raw |= 0x400000
+		list = list.slice(0, len(list.text)-1)
+	}
+	registers, e := parseAssemblerRegisterList(list)
+	if e != nil {
+		return 0, e
+	}
+	return raw | uint32(registers), nil
+}
+
+func (s *armAssemblerStatement) encodeBranch() (uint32, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	if s.name == "bx" || ((s.name == "blx") && isRegisterOperand(
+		s.operands[0])) {
+		rm, e := expectAssemblerRegister(s.operands[0])
+		if e != nil {
+			return 0, e
+		}
+		raw := (s.condition << 28) | 0x012fff10 | uint32(rm)
+		if s.name == "blx" {
+			raw |= 0x20
+		}
+		return raw, nil
+	}
+	offset, e := s.a.relativeOffset(s.operands[0], s.item,
+		s.item.address+8, 0)
+	if e != nil {
+		return 0, e
+	}
+	if (offset < -0x2000000) || (offset >= 0x2000000) {
+		return 0, s.operands[0].errorf("The branch target is out of range")
+	}
+	if s.name == "blx" {
+		if s.condition != 14 {
+			return 0, s.errorf("blx with an immediate target can't be " +
+				"conditional")
+		}
+		if (offset & 1) != 0 {
+			return 0, s.operands[0].errorf("The branch target must be " +
+				"halfword-aligned")
+		}
+		return 0xfa000000 | (uint32(offset&2) << 23) |
+			((uint32(offset) >> 2) & 0xffffff), nil
+	}
+	if (offset & 3) != 0 {
+		return 0, s.operands[0].errorf("The branch target must be " +
+			"word-aligned")
+	}
+	raw := (s.condition << 28) | 0x0a000000 | ((uint32(offset) >> 2) &
+		0xffffff)
+	if s.name == "bl" {
+		raw |= 0x1000000
+	}
+	return raw, nil
+}
+
+func isRegisterOperand(t assemblerToken) bool {
+	_, ok := parseAssemblerRegister(t)
+	return ok
+}
+
+// Parses the comment field of swi or bkpt. The disassembler prints these as
+// hexadecimal digits without a prefix, so a value with exactly the given
+// number of digits is read as hexadecimal.
+func (s *armAssemblerStatement) comment(digits int,
+	maximum uint32) (uint32, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	t := s.operands[0]
+	if len(t.text) == digits {
+		value, e := strconv.ParseUint(t.text, 16, 32)
+		if e == nil {
+			return uint32(value), nil
+		}
+	}
+	return s.immediate(t, maximum)
+}
+
+func (s *armAssemblerStatement) encodeSoftwareInterrupt() (uint32, error) {
+	value, e := s.comment(8, 0xffffff)
+	if e != nil {
+		return 0, e
+	}
+	return (s.condition << 28) | 0x0f000000 | value, nil
+}
+
+func (s *armAssemblerStatement) encodeBreakpoint() (uint32, error) {
+	value, e := s.comment(4, 0xffff)
+	if e != nil {
+		return 0, e
+	}
+	return 0xe1200070 | ((value & 0xfff0) << 4) | (value & 0xf), nil
+}
+
+// Parses a coprocessor number, such as p15.
+func parseAssemblerCoprocessor(t assemblerToken) (uint32, error) {
+	name := t.lower()
+	if strings.HasPrefix(name, "p") {
+		value, ok := parseDecimal(name[1:], 15)
+		if ok {
+			return value, nil
+		}
+	}
+	return 0, t.errorf("Expected a coprocessor, such as p15, got %q", t.text)
+}
+
+// Parses a coprocessor register, such as c1 or cr1.
+func parseAssemblerCoprocessorRegister(t assemblerToken) (uint32, error) {
+	name := t.lower()
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "c"), "r")
+	value, ok := parseDecimal(name, 15)
+	if !ok || !strings.HasPrefix(t.lower(), "c") {
+		return 0, t.errorf("Expected a coprocessor register, such as c1, "+
+			"got %q", t.text)
+	}
+	return value, nil
+}
+
+// Parses a one- or two-digit decimal number, as used in coprocessor names.
+func parseDecimal(s string, maximum uint32) (uint32, bool) {
+	if len(s) > 2 {
+		return 0, false
+	}
+	value, e := strconv.ParseUint(s, 10, 32)
+	if (e != nil) || (uint32(value) > maximum) {
+		return 0, false
+	}
+	return uint32(value), true
+}
+
+// Returns the condition field for a coprocessor instruction, which is 0xf
+// for the unconditional forms such as mcr2.
+func (s *armAssemblerStatement) coprocessorCondition() uint32 {
+	if strings.HasSuffix(s.name, "2") {
+		return 0xf0000000
+	}
+	return s.condition << 28
+}
+
+func (s *armAssemblerStatement) encodeCoprocDataOperation() (uint32, error) {
+	if (len(s.operands) != 5) && (len(s.operands) != 6) {
+		return 0, s.errorf("%s requires 5 or 6 operands", s.mnemonic.text)
+	}
+	cp, e := parseAssemblerCoprocessor(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	opcode, e := s.immediate(s.operands[1], 15)
+	if e != nil {
+		return 0, e
+	}
+	var registers [3]uint32
+	for i := range registers {
+		registers[i], e = parseAssemblerCoprocessorRegister(s.operands[i+2])
+		if e != nil {
+			return 0, e
+		}
+	}
+	info := uint32(0)
+	if len(s.operands) == 6 {
+		info, e = s.immediate(s.operands[5], 7)
+		if e != nil {
+			return 0, e
+		}
+	}
+	return s.coprocessorCondition() | 0x0e000000 | (opcode << 20) |
+		(registers[1] << 16) | (registers[0] << 12) | (cp << 8) |
+		(info << 5) | registers[2], nil
+}
+
+func (s *armAssemblerStatement) encodeCoprocRegisterTransfer() (uint32,
+	error) {
+	if (len(s.operands) != 5) && (len(s.operands) != 6) {
+		return 0, s.errorf("%s requires 5 or 6 operands", s.mnemonic.text)
+	}
+	cp, e := parseAssemblerCoprocessor(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	opcode, e := s.immediate(s.operands[1], 7)
+	if e != nil {
+		return 0, e
+	}
+	rd, e := expectAssemblerRegister(s.operands[2])
+	if e != nil {
+		return 0, e
+	}
+	crn, e := parseAssemblerCoprocessorRegister(s.operands[3])
+	if e != nil {
+		return 0, e
+	}
+	crm, e := parseAssemblerCoprocessorRegister(s.operands[4])
+	if e != nil {
+		return 0, e
+	}
+	operand := uint32(0)
+	if len(s.operands) == 6 {
+		operand, e = s.immediate(s.operands[5], 7)
+		if e != nil {
+			return 0, e
+		}
+	}
+	raw := s.coprocessorCondition() | 0x0e000010 | (opcode << 21) |
+		(crn << 16) | (uint32(rd) << 12) | (cp << 8) | (operand << 5) | crm
+	if strings.HasPrefix(s.name, "mrc") {
+		raw |= 0x100000
+	}
+	return raw, nil
+}
+
+func (s *armAssemblerStatement) encodeCoprocDoubleRegisterTransfer() (
+	uint32, error) {
+	e := s.expectOperands(5)
+	if e != nil {
+		return 0, e
+	}
+	cp, e := parseAssemblerCoprocessor(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	opcode, e := s.immediate(s.operands[1], 15)
+	if e != nil {
+		return 0, e
+	}
+	rd, e := expectAssemblerRegister(s.operands[2])
+	if e != nil {
+		return 0, e
+	}
+	rn, e := expectAssemblerRegister(s.operands[3])
+	if e != nil {
+		return 0, e
+	}
+	crm, e := parseAssemblerCoprocessorRegister(s.operands[4])
+	if e != nil {
+		return 0, e
+	}
+	raw := (s.condition << 28) | 0x0c400000 | (uint32(rn) << 16) |
+		(uint32(rd) << 12) | (cp << 8) | (opcode << 4) | crm
+	if s.name == "mrrc" {
+		raw |= 0x100000
+	}
+	return raw, nil
+}
+
+func (s *armAssemblerStatement) encodeCoprocDataTransfer() (uint32, error) {
+	if len(s.operands) < 3 {
+		return 0, s.errorf("%s requires at least 3 operands", s.mnemonic.text)
+	}
+	cp, e := parseAssemblerCoprocessor(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	cd, e := parseAssemblerCoprocessorRegister(s.operands[1])
+	if e != nil {
+		return 0, e
+	}
+	raw := s.coprocessorCondition() | 0x0c000000 | (cd << 12) | (cp << 8)
+	if strings.HasPrefix(s.name, "ldc") {
+		raw |= 0x100000
+	}
+	if s.suffix == "l" {
+		raw |= 0x400000
+	}
+	operands := s.operands[2:]
+	// The unindexed form, with an option in braces.
+	if (len(operands) == 2) && strings.HasPrefix(operands[1].text, "{") {
+		option := operands[1]
+		value, e := s.immediate(option.slice(1, len(option.text)-1), 255)
+		if e != nil {
+			return 0, e
+		}
+		address, e := s.parseAddress(operands[:1])
+		if e != nil {
+			return 0, e
+		}
+		return raw | 0x800000 | (uint32(address.rn) << 16) | value, nil
+	}
+	address, e := s.parseAddress(operands)
+	if e != nil {
+		return 0, e
+	}
+	if !address.immediate {
+		return 0, address.token.errorf("%s requires an immediate offset",
+			s.mnemonic.text)
+	}
+	if ((address.offset & 3) != 0) || (address.offset > 1020) {
+		return 0, address.token.errorf("Offset %d must be a multiple of 4 "+
+			"up to 1020", address.offset)
+	}
+	raw |= (uint32(address.rn) << 16) | (address.offset >> 2)
+	if address.preindex {
+		raw |= 0x1000000
+	}
+	if address.writeBack || !address.preindex {
+		raw |= 0x200000
+	}
+	if address.up {
+		raw |= 0x800000
+	}
+	return raw, nil
+}
+
+func (s *armAssemblerStatement) encodeCountLeadingZeros() (uint32, error) {
+	r, e := s.registers(2)
+	if e != nil {
+		return 0, e
+	}
+	return (s.condition << 28) | 0x016f0f10 | (uint32(r[0]) << 12) |
+		uint32(r[1]), nil
+}
+
+func (s *armAssemblerStatement) encodeSaturatingArithmetic() (uint32, error) {
+	r, e := s.registers(3)
+	if e != nil {
+		return 0, e
+	}
+	opcode := uint32(0)
+	for i, name := range saturatingOpcodeStrings {
+		if name == s.name {
+			opcode = uint32(i)
+		}
+	}
+	return (s.condition << 28) | 0x01000050 | (opcode << 21) |
+		(uint32(r[2]) << 16) | (uint32(r[0]) << 12) | uint32(r[1]), nil
+}
+
+// Encodes smul<x><y>, smla<x><y>, smulw<y>, smlaw<y> and smlal<x><y>.
+func (s *armAssemblerStatement) encodeSignedHalfwordMultiply() (uint32,
+	error) {
+	name := s.name
+	selectors := name[len(name)-2:]
+	raw := (s.condition << 28) | 0x01000080
+	if selectors[0] == 't' {
+		raw |= 0x20
+	}
+	if selectors[1] == 't' {
+		raw |= 0x40
+	}
+	switch {
+	case strings.HasPrefix(name, "smlal"):
+		r, e := s.registers(4)
+		if e != nil {
+			return 0, e
+		}
+		return raw | 0x400000 | (uint32(r[1]) << 16) | (uint32(r[0]) << 12) |
+			(uint32(r[3]) << 8) | uint32(r[2]), nil
+	case strings.HasPrefix(name, "smulw"):
+		r, e := s.registers(3)
+		if e != nil {
+			return 0, e
+		}
+		return (raw &^ 0x20) | 0x01200020 | (uint32(r[0]) << 16) |
+			(uint32(r[2]) << 8) | uint32(r[1]), nil
+	case strings.HasPrefix(name, "smlaw"):
+		r, e := s.registers(4)
+		if e != nil {
+			return 0, e
+		}
+		return (raw &^ 0x20) | 0x01200000 | (uint32(r[0]) << 16) |
+			(uint32(r[3]) << 12) | (uint32(r[2]) << 8) | uint32(r[1]), nil
+	case strings.HasPrefix(name, "smul"):
+		r, e := s.registers(3)
+		if e != nil {
+			return 0, e
+		}
+		return raw | 0x600000 | (uint32(r[0]) << 16) | (uint32(r[2]) << 8) |
+			uint32(r[1]), nil
+	}
+	r, e := s.registers(4)
+	if e != nil {
+		return 0, e
+	}
+	return raw | (uint32(r[0]) << 16) | (uint32(r[3]) << 12) |
+		(uint32(r[2]) << 8) | uint32(r[1]), nil
+}
+
+func (s *armAssemblerStatement) encodeReverseBytes() (uint32, error) {
+	r, e := s.registers(2)
+	if e != nil {
+		return 0, e
+	}
+	raw := (s.condition << 28) | (uint32(r[0]) << 12) | uint32(r[1])
+	switch s.name {
+	case "rev":
+		return raw | 0x06bf0f30, nil
+	case "rev16":
+		return raw | 0x06bf0fb0, nil
+	}
+	return raw | 0x06ff0fb0, nil
+}
+
+// Encodes the sign and zero extension instructions, such as sxtb and uxtab16.
+func (s *armAssemblerStatement) encodeExtend() (uint32, error) {
+	name := s.name
+	operands := s.operands
+	if len(operands) < 2 {
+		return 0, s.errorf("%s requires at least 2 operands", s.mnemonic.text)
+	}
+	rotate := uint32(0)
+	last := operands[len(operands)-1]
+	if isAssemblerShift(last) || strings.Contains(last.text, " ") {
+		// The rotation may be a separate operand, or follow the register
+		// after a space.
+		shift := last
+		if !isAssemblerShift(last) {
+			space := strings.IndexAny(last.text, " \t")
+			shift = last.slice(space, len(last.text))
+			operands = append(append([]assemblerToken{}, operands[:len(
+				operands)-1]...), last.slice(0, space))
+		} else {
+			operands = operands[:len(operands)-1]
+		}
+		if !strings.HasPrefix(shift.lower(), "ror") {
+			return 0, shift.errorf("Expected a rotation, got %q", shift.text)
+		}
+		amount, e := s.immediate(shift.slice(3, len(shift.text)), 24)
+		if e != nil {
+			return 0, e
+		}
+		if (amount % 8) != 0 {
+			return 0, shift.errorf("The rotation must be 0, 8, 16 or 24")
+		}
+		rotate = amount / 8
+	}
+	accumulate := name[3] == 'a'
+	count := 2
+	if accumulate {
+		count = 3
+	}
+	if len(operands) != count {
+		return 0, s.errorf("%s requires %d registers", s.mnemonic.text,
+			count)
+	}
+	registers := make([]ARMRegister, count)
+	for i, t := range operands {
+		r, e := expectAssemblerRegister(t)
+		if e != nil {
+			return 0, e
+		}
+		registers[i] = r
+	}
+	rn := ARMRegister(15)
+	rm := registers[1]
+	if accumulate {
+		rn = registers[1]
+		rm = registers[2]
+	}
+	raw := (s.condition << 28) | 0x06800070 | (uint32(rn) << 16) |
+		(uint32(registers[0]) << 12) | (rotate << 10) | uint32(rm)
+	if name[0] == 'u' {
+		raw |= 0x400000
+	}
+	if !strings.HasSuffix(name, "16") {
+		raw |= 0x200000
+	}
+	if strings.HasSuffix(name, "h") {
+		raw |= 0x100000
+	}
+	return raw, nil
+}
+
+var parallelOperationAliases = map[string]string{
+	"asx": "addsubx", "sax": "subaddx",
+}
+
+func (s *armAssemblerStatement) encodeParallelArithmetic() (uint32, error) {
+	r, e := s.registers(3)
+	if e != nil {
+		return 0, e
+	}
+	var prefix, operation uint32
+	for i, p := range parallelPrefixStrings {
+		if (p == "") || !strings.HasPrefix(s.name, p) {
+			continue
+		}
+		rest := s.name[len(p):]
+		if alias, ok := parallelOperationAliases[rest]; ok {
+			rest = alias
+		}
+		for j, o := range parallelOperationStrings {
+			if (o != "") && (o == rest) {
+				prefix = uint32(i)
+				operation = uint32(j)
+			}
+		}
+	}
+	return (s.condition << 28) | 0x06000f10 | (prefix << 20) |
+		(uint32(r[1]) << 16) | (uint32(r[0]) << 12) | (operation << 5) |
+		uint32(r[2]), nil
+}
+
+func (s *armAssemblerStatement) encodeSelectBytes() (uint32, error) {
+	r, e := s.registers(3)
+	if e != nil {
+		return 0, e
+	}
+	return (s.condition << 28) | 0x06800fb0 | (uint32(r[1]) << 16) |
+		(uint32(r[0]) << 12) | uint32(r[2]), nil
+}
+
+func (s *armAssemblerStatement) encodeSumAbsoluteDifferences() (uint32,
+	error) {
+	count := 3
+	if s.name == "usada8" {
+		count = 4
+	}
+	r, e := s.registers(count)
+	if e != nil {
+		return 0, e
+	}
+	rn := ARMRegister(15)
+	if count == 4 {
+		rn = r[3]
+	}
+	return (s.condition << 28) | 0x07800010 | (uint32(r[0]) << 16) |
+		(uint32(rn) << 12) | (uint32(r[2]) << 8) | uint32(r[1]), nil
+}
+
+func (s *armAssemblerStatement) encodeSaturate() (uint32, error) {
+	e := s.maximumOperands(4)
+	if e != nil {
+		return 0, e
+	}
+	if len(s.operands) < 3 {
+		return 0, s.errorf("%s requires 3 or 4 operands", s.mnemonic.text)
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	unsigned := s.name[0] == 'u'
+	dual := strings.HasSuffix(s.name, "16")
+	minimum, maximum := uint32(1), uint32(32)
+	if unsigned {
+		minimum, maximum = 0, 31
+	}
+	if dual {
+		maximum = 16
+		if unsigned {
+			maximum = 15
+		}
+	}
+	position, e := s.immediate(s.operands[1], maximum)
+	if e != nil {
+		return 0, e
+	}
+	if position < minimum {
+		return 0, s.operands[1].errorf("%d is out of range", position)
+	}
+	if !unsigned {
+		position--
+	}
+	operands := s.operands[2:]
+	raw := (s.condition << 28) | (uint32(rd) << 12)
+	if unsigned {
+		raw |= 0x400000
+	}
+	if dual {
+		if len(operands) != 1 {
+			return 0, operands[1].errorf("%s can't use a shift", s.name)
+		}
+		rn, e := expectAssemblerRegister(operands[0])
+		if e != nil {
+			return 0, e
+		}
+		return raw | 0x06a00f30 | (position << 16) | uint32(rn), nil
+	}
+	rn, shift, e := s.parseShiftedRegister(operands, false)
+	if e != nil {
+		return 0, e
+	}
+	shiftType := (shift >> 1) & 3
+	amount := shift >> 3
+	if (shiftType != 0) && (shiftType != 2) {
+		return 0, operands[len(operands)-1].errorf("%s only supports lsl "+
+			"and asr shifts", s.name)
+	}
+	if shiftType == 2 {
+		raw |= 0x40
+	}
+	return raw | 0x06a00010 | (position << 16) | (amount << 7) | uint32(rn),
+		nil
+}
+
+func (s *armAssemblerStatement) encodePackHalfword() (uint32, error) {
+	e := s.maximumOperands(4)
+	if e != nil {
+		return 0, e
+	}
+	if len(s.operands) < 3 {
+		return 0, s.errorf("%s requires 3 or 4 operands", s.mnemonic.text)
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	rn, e := expectAssemblerRegister(s.operands[1])
+	if e != nil {
+		return 0, e
+	}
+	rm, shift, e := s.parseShiftedRegister(s.operands[2:], false)
+	if e != nil {
+		return 0, e
+	}
+	shiftType := (shift >> 1) & 3
+	amount := shift >> 3
+	raw := (s.condition << 28) | 0x06800010 | (uint32(rd) << 12)
+	if s.name == "pkhtb" {
+		if shift == 0 {
+			// pkhtb without a shift is the same as pkhbt with the operands
+			// swapped.
+			return raw | (uint32(rm) << 16) | uint32(rn), nil
+		}
+		if shiftType != 2 {
+			return 0, s.operands[len(s.operands)-1].errorf("pkhtb " +
+				"requires an asr shift")
+		}
+		raw |= 0x40
+	} else if shiftType != 0 {
+		return 0, s.operands[len(s.operands)-1].errorf("pkhbt requires an " +
+			"lsl shift")
+	}
+	return raw | (uint32(rn) << 16) | (amount << 7) | uint32(rm), nil
+}
+
+func (s *armAssemblerStatement) encodeMultiplyAccumulateAccumulate() (uint32,
+	error) {
+	r, e := s.registers(4)
+	if e != nil {
+		return 0, e
+	}
+	return (s.condition << 28) | 0x00400090 | (uint32(r[1]) << 16) |
+		(uint32(r[0]) << 12) | (uint32(r[3]) << 8) | uint32(r[2]), nil
+}
+
+// Encodes smuad, smusd, smlad, smlsd, smlald and smlsld, with an optional x
+// suffix.
+func (s *armAssemblerStatement) encodeDualMultiply() (uint32, error) {
+	name := strings.TrimSuffix(s.name, "x")
+	raw := (s.condition << 28) | 0x07000010
+	if name != s.name {
+		raw |= 0x20
+	}
+	if name[3] == 's' {
+		raw |= 0x40
+	}
+	if strings.HasSuffix(name, "ld") {
+		r, e := s.registers(4)
+		if e != nil {
+			return 0, e
+		}
+		return raw | 0x400000 | (uint32(r[1]) << 16) | (uint32(r[0]) << 12) |
+			(uint32(r[3]) << 8) | uint32(r[2]), nil
+	}
+	count := 4
+	if strings.HasPrefix(name, "smu") {
+		count = 3
+	}
+	r, e := s.registers(count)
+	if e != nil {
+		return 0, e
+	}
+	rn := ARMRegister(15)
+	if count == 4 {
+		rn = r[3]
+	}
+	return raw | (uint32(r[0]) << 16) | (uint32(rn) << 12) |
+		(uint32(r[2]) << 8) | uint32(r[1]), nil
+}
+
+// Parses the interrupt flags used by cps, returning them in bits 6-8.
+func parseInterruptFlags(t assemblerToken) (uint32, error) {
+	flags := uint32(0)
+	for _, c := range t.lower() {
+		bit := strings.IndexRune("fia", c)
+		if (bit < 0) || ((flags & (0x40 << uint(bit))) != 0) {
+			return 0, t.errorf("Expected interrupt flags (a, i or f), got "+
+				"%q", t.text)
+		}
+		flags |= 0x40 << uint(bit)
+	}
+	return flags, nil
+}
+
+func (s *armAssemblerStatement) encodeChangeProcessorState() (uint32, error) {
+	raw := uint32(0xf1000000)
+	operands := s.operands
+	if s.name != "cps" {
+		if (len(operands) == 0) || (len(operands) > 2) {
+			return 0, s.errorf("%s requires flags and an optional mode",
+				s.name)
+		}
+		flags, e := parseInterruptFlags(operands[0])
+		if e != nil {
+			return 0, e
+		}
+		raw |= flags | 0x80000
+		if s.name == "cpsid" {
+			raw |= 0x40000
+		}
+		operands = operands[1:]
+	} else if len(operands) != 1 {
+		return 0, s.errorf("cps requires a mode")
+	}
+	if len(operands) == 0 {
+		return raw, nil
+	}
+	mode, e := s.immediate(operands[0], 31)
+	if e != nil {
+		return 0, e
+	}
+	return raw | 0x20000 | mode, nil
+}
+
+func (s *armAssemblerStatement) encodeSetEndianness() (uint32, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	switch s.operands[0].lower() {
+	case "le":
+		return 0xf1010000, nil
+	case "be":
+		return 0xf1010200, nil
+	}
+	return 0, s.operands[0].errorf("Expected be or le, got %q",
+		s.operands[0].text)
+}
+
+// Returns the P, U and W bits for srs and rfe.
+func (s *armAssemblerStatement) returnStateBits(writeBack bool) uint32 {
+	mode := s.suffix
+	if mode == "" {
+		mode = "ia"
+	}
+	raw := blockTransferModes[mode] << 23
+	if writeBack {
+		raw |= 0x200000
+	}
+	return raw
+}
+
+func (s *armAssemblerStatement) encodeStoreReturnState() (uint32, error) {
+	operands := s.operands
+	writeBack := false
+	if (len(operands) == 2) && strings.HasPrefix(operands[0].lower(), "sp") {
+		switch operands[0].lower() {
+		case "sp":
+		case "sp!":
+			writeBack = true
+		default:
+			return 0, operands[0].errorf("Expected sp, got %q",
+				operands[0].text)
+		}
+		operands = operands[1:]
+	}
+	if len(operands) != 1 {
+		return 0, s.errorf("srs requires a mode")
+	}
+	mode, e := s.immediate(operands[0], 31)
+	if e != nil {
+		return 0, e
+	}
+	return 0xf84d0500 | s.returnStateBits(writeBack) | mode, nil
+}
+
+func (s *armAssemblerStatement) encodeReturnFromException() (uint32, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	base := s.operands[0]
+	writeBack := strings.HasSuffix(base.text, "!")
+	if writeBack {
+		base = base.slice(0, len(base.text)-1)
+	}
+	rn, e := expectAssemblerRegister(base)
+	if e != nil {
+		return 0, e
+	}
+	return 0xf8100a00 | s.returnStateBits(writeBack) | (uint32(rn) << 16),
+		nil
+}
+
+// Encodes adr, which adds to or subtracts from the PC.
+func (s *armAssemblerStatement) encodeAddress() (uint32, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	offset, e := s.a.relativeOffset(s.operands[1], s.item, s.item.address+8,
+		-8)
+	if e != nil {
+		return 0, e
+	}
+	opcode := addARMOpcode
+	if offset < 0 {
+		opcode = subARMOpcode
+		offset = -offset
+	}
+	encoded, ok := encodeARMImmediate(uint32(offset))
+	if !ok {
+		return 0, s.operands[1].errorf("The offset %d can't be encoded as a "+
+			"rotated 8-bit immediate", offset)
+	}
+	return (s.condition << 28) | 0x2000000 | (uint32(opcode) << 21) |
+		(15 << 16) | (uint32(rd) << 12) | encoded, nil
+}
+
+func (s *armAssemblerStatement) encodeNop() (uint32, error) {
+	e := s.expectOperands(0)
+	if e != nil {
+		return 0, e
+	}
+	// mov r0, r0
+	return (s.condition << 28) | 0x01a00000, nil
+}
+
+func (s *armAssemblerStatement) encodeLoadStore() (uint32, error) {
+	switch s.suffix {
+	case "h", "sh", "sb", "d":
+		return s.encodeHalfwordDataTransfer()
+	}
+	return s.encodeSingleDataTransfer()
+}
+
+var armAssemblerMnemonics []armAssemblerMnemonic
+
+func init() {
+	add := func(name string, suffixes []string, unconditional bool,
+		encode func(s *armAssemblerStatement) (uint32, error)) {
+		armAssemblerMnemonics = append(armAssemblerMnemonics,
+			armAssemblerMnemonic{name, suffixes, unconditional, encode})
+	}
+	s := []string{"s"}
+	for _, name := range opcodeStrings {
+		add(name, s, false, (*armAssemblerStatement).encodeDataProcessing)
+	}
+	for _, name := range []string{"lsl", "lsr", "asr", "ror", "rrx"} {
+		add(name, s, false, (*armAssemblerStatement).encodeShiftAlias)
+	}
+	add("mrs", nil, false, (*armAssemblerStatement).encodePSRTransfer)
+	add("msr", nil, false, (*armAssemblerStatement).encodePSRTransfer)
+	for _, name := range []string{"mul", "mla", "umull", "umlal", "smull",
+		"smlal"} {
+		add(name, s, false, (*armAssemblerStatement).encodeMultiply)
+	}
+	transferSuffixes := []string{"b", "t", "bt", "h", "sh", "sb", "d"}
+	add("ldr", transferSuffixes, false,
+		(*armAssemblerStatement).encodeLoadStore)
+	add("str", transferSuffixes, false,
+		(*armAssemblerStatement).encodeLoadStore)
+	add("pld", nil, true, (*armAssemblerStatement).encodePreload)
+	add("swp", []string{"b"}, false, (*armAssemblerStatement).encodeSwap)
+	add("ldrex", nil, false, (*armAssemblerStatement).encodeExclusive)
+	add("strex", nil, false, (*armAssemblerStatement).encodeExclusive)
+	blockSuffixes := []string{"ia", "ib", "da", "db", "fd", "ed", "fa",
+		"ea"}
+	add("ldm", blockSuffixes, false,
+		(*armAssemblerStatement).encodeBlockDataTransfer)
+	add("stm", blockSuffixes, false,
+		(*armAssemblerStatement).encodeBlockDataTransfer)
+	add("push", nil, false, (*armAssemblerStatement).encodeBlockDataTransfer)
+	add("pop", nil, false, (*armAssemblerStatement).encodeBlockDataTransfer)
+	for _, name := range []string{"b", "bl", "bx", "blx"} {
+		add(name, nil, false, (*armAssemblerStatement).encodeBranch)
+	}
+	add("swi", nil, false, (*armAssemblerStatement).encodeSoftwareInterrupt)
+	add("svc", nil, false, (*armAssemblerStatement).encodeSoftwareInterrupt)
+	add("bkpt", nil, true, (*armAssemblerStatement).encodeBreakpoint)
+	add("cdp", nil, false, (*armAssemblerStatement).encodeCoprocDataOperation)
+	add("cdp2", nil, true,
+		(*armAssemblerStatement).encodeCoprocDataOperation)
+	for _, name := range []string{"mcr", "mrc"} {
+		add(name, nil, false,
+			(*armAssemblerStatement).encodeCoprocRegisterTransfer)
+		add(name+"2", nil, true,
+			(*armAssemblerStatement).encodeCoprocRegisterTransfer)
+	}
+	add("mcrr", nil, false,
+		(*armAssemblerStatement).encodeCoprocDoubleRegisterTransfer)
+	add("mrrc", nil, false,
+		(*armAssemblerStatement).encodeCoprocDoubleRegisterTransfer)
+	for _, name := range []string{"ldc", "stc"} {
+		add(name, []string{"l"}, false,
+			(*armAssemblerStatement).encodeCoprocDataTransfer)
+		add(name+"2", []string{"l"}, true,
+			(*armAssemblerStatement).encodeCoprocDataTransfer)
+	}
+	add("clz", nil, false, (*armAssemblerStatement).encodeCountLeadingZeros)
+	for _, name := range saturatingOpcodeStrings {
+		add(name, nil, false,
+			(*armAssemblerStatement).encodeSaturatingArithmetic)
+	}
+	for _, xy := range []string{"bb", "bt", "tb", "tt"} {
+		for _, name := range []string{"smul", "smla", "smlal"} {
+			add(name+xy, nil, false,
+				(*armAssemblerStatement).encodeSignedHalfwordMultiply)
+		}
+	}
+	for _, y := range []string{"b", "t"} {
+		for _, name := range []string{"smulw", "smlaw"} {
+			add(name+y, nil, false,
+				(*armAssemblerStatement).encodeSignedHalfwordMultiply)
+		}
+	}
+	for _, name := range []string{"rev", "rev16", "revsh"} {
+		add(name, nil, false, (*armAssemblerStatement).encodeReverseBytes)
+	}
+	for _, sign := range []string{"s", "u"} {
+		for _, form := range []string{"xtb", "xth", "xtb16", "xtab", "xtah",
+			"xtab16"} {
+			add(sign+form, nil, false, (*armAssemblerStatement).encodeExtend)
+		}
+	}
+	for _, prefix := range parallelPrefixStrings {
+		if prefix == "" {
+			continue
+		}
+		operations := append([]string{"asx", "sax"},
+			parallelOperationStrings[:]...)
+		for _, operation := range operations {
+			if operation == "" {
+				continue
+			}
+			add(prefix+operation, nil, false,
+				(*armAssemblerStatement).encodeParallelArithmetic)
+		}
+	}
+	add("sel", nil, false, (*armAssemblerStatement).encodeSelectBytes)
+	add("usad8", nil, false,
+		(*armAssemblerStatement).encodeSumAbsoluteDifferences)
+	add("usada8", nil, false,
+		(*armAssemblerStatement).encodeSumAbsoluteDifferences)
+	for _, name := range []string{"ssat", "usat", "ssat16", "usat16"} {
+		add(name, nil, false, (*armAssemblerStatement).encodeSaturate)
+	}
+	add("pkhbt", nil, false, (*armAssemblerStatement).encodePackHalfword)
+	add("pkhtb", nil, false, (*armAssemblerStatement).encodePackHalfword)
+	add("umaal", nil, false,
+		(*armAssemblerStatement).encodeMultiplyAccumulateAccumulate)
+	for _, name := range []string{"smuad", "smusd", "smlad", "smlsd",
+		"smlald", "smlsld"} {
+		add(name, nil, false, (*armAssemblerStatement).encodeDualMultiply)
+		add(name+"x", nil, false,
+			(*armAssemblerStatement).encodeDualMultiply)
+	}
+	for _, name := range []string{"cps", "cpsie", "cpsid"} {
+		add(name, nil, true,
+			(*armAssemblerStatement).encodeChangeProcessorState)
+	}
+	add("setend", nil, true, (*armAssemblerStatement).encodeSetEndianness)
+	returnStateSuffixes := []string{"ia", "ib", "da", "db"}
+	add("srs", returnStateSuffixes, true,
+		(*armAssemblerStatement).encodeStoreReturnState)
+	add("rfe", returnStateSuffixes, true,
+		(*armAssemblerStatement).encodeReturnFromException)
+	add("adr", nil, false, (*armAssemblerStatement).encodeAddress)
+	add("nop", nil, false, (*armAssemblerStatement).encodeNop)
+	addVFPAssemblerMnemonics(add)
+	// Longer names are matched first, so "bls" isn't read as "bl" with an
+	// "s" suffix when it means "b" with the "ls" condition.
+	sort.SliceStable(armAssemblerMnemonics, func(a, b int) bool {
+		return len(armAssemblerMnemonics[a].name) >
+			len(armAssemblerMnemonics[b].name)
+	})
+}
+
+// Splits the part of a mnemonic following its base name into a suffix and
+// condition code, which may appear in either order.
+func splitAssemblerSuffix(rest string, suffixes []string,
+	unconditional bool) (string, uint32, bool) {
+	for _, suffix := range append([]string{""}, suffixes...) {
+		var conditions []string
+		if strings.HasPrefix(rest, suffix) {
+			conditions = append(conditions, rest[len(suffix):])
+		}
+		if strings.HasSuffix(rest, suffix) {
+			conditions = append(conditions, rest[:len(rest)-len(suffix)])
+		}
+		for _, c := range conditions {
+			condition, ok := assemblerConditions[c]
+			if !ok || (unconditional && (c != "")) {
+				continue
+			}
+			return suffix, condition, true
+		}
+	}
+	return "", 0, false
+}
+
+// Finds the table entry for an ARM mnemonic.
+func findARMMnemonic(name string) (*armAssemblerMnemonic, string, uint32,
+	bool) {
+	for i := range armAssemblerMnemonics {
+		m := &(armAssemblerMnemonics[i])
+		if !strings.HasPrefix(name, m.name) {
+			continue
+		}
+		suffix, condition, ok := splitAssemblerSuffix(name[len(m.name):],
+			m.suffixes, m.unconditional)
+		if ok {
+			return m, suffix, condition, true
+		}
+	}
+	return nil, "", 0, false
+}
+
+// Handles ldr rX, =value during the first pass. If the value is a number
+// which mov or mvn can load, the instruction is replaced by one of them.
+// Otherwise the value is added to the literal pool.
+func (a *assembler) prepareARMLiteral(s *armAssemblerStatement) {
+	value := s.operands[1].slice(1, len(s.operands[1].text))
+	constant, usesSymbols, e := a.evaluateAddress(value, len(a.items),
+		a.address)
+	if (e == nil) && !usesSymbols {
+		if _, ok := encodeARMImmediate(constant); ok {
+			s.name = "mov"
+		} else if _, ok := encodeARMImmediate(^constant); ok {
+			s.name = "mov"
+		}
+		if s.name == "mov" {
+			s.suffix = ""
+			s.operands[1] = value
+			return
+		}
+	}
+	s.literal = a.addLiteral(value)
+}
+
+func (a *assembler) addARMInstruction(mnemonic,
+	operands assemblerToken) error {
+	m, suffix, condition, ok := findARMMnemonic(mnemonic.lower())
+	if !ok {
+		return mnemonic.errorf("Unknown ARM instruction %q", mnemonic.text)
+	}
+	operandList, e := operands.splitOperands()
+	if e != nil {
+		return e
+	}
+	s := &armAssemblerStatement{
+		a:         a,
+		mnemonic:  mnemonic,
+		name:      m.name,
+		suffix:    suffix,
+		condition: condition,
+		operands:  operandList,
+	}
+	encode := m.encode
+	if ((m.name == "ldr") && (suffix == "")) && (len(s.operands) == 2) &&
+		strings.HasPrefix(s.operands[1].text, "=") {
+		a.prepareARMLiteral(s)
+		if s.name == "mov" {
+			encode = (*armAssemblerStatement).encodeDataProcessing
+		}
+	}
+	item, e := a.addItem(mnemonic, 4, nil)
+	if e != nil {
+		return e
+	}
+	s.item = item
+	if s.literal != nil {
+		s.literal.item = item
+	}
+	item.encode = func() ([]byte, error) {
+		raw, e := encode(s)
+		if e != nil {
+			return nil, e
+		}
+		// Make sure the result is something the disassembler accepts, which
+		// catches invalid register combinations.
+		_, e = ParseInstruction(raw)
+		if e != nil {
+			return nil, mnemonic.errorf("Invalid instruction (0x%08x): %s",
+				raw, e)
+		}
+		return a.wordBytes(raw), nil
+	}
+	return nil
+}
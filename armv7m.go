@@ -0,0 +1,760 @@
+package arm_emulate
+
+// This file implements processors using the ARMv7-M profile, such as the
+// Cortex-M3 and Cortex-M4, which have a different exception model from the
+// other processors.
+
+import (
+	"fmt"
+)
+
+// Identifies one of the ARMv7-M special registers accessed by the mrs and msr
+// instructions, using the value of their SYSm field.
+type SpecialRegister uint8
+
+const (
+	APSR       SpecialRegister = 0
+	IAPSR      SpecialRegister = 1
+	EAPSR      SpecialRegister = 2
+	XPSR       SpecialRegister = 3
+	IPSR       SpecialRegister = 5
+	EPSR       SpecialRegister = 6
+	IEPSR      SpecialRegister = 7
+	MSP        SpecialRegister = 8
+	PSP        SpecialRegister = 9
+	PRIMASK    SpecialRegister = 16
+	BASEPRI    SpecialRegister = 17
+	BASEPRIMax SpecialRegister = 18
+	FAULTMASK  SpecialRegister = 19
+	CONTROL    SpecialRegister = 20
+)
+
+var specialRegisterStrings = map[SpecialRegister]string{
+	APSR:       "apsr",
+	IAPSR:      "iapsr",
+	EAPSR:      "eapsr",
+	XPSR:       "xpsr",
+	IPSR:       "ipsr",
+	EPSR:       "epsr",
+	IEPSR:      "iepsr",
+	MSP:        "msp",
+	PSP:        "psp",
+	PRIMASK:    "primask",
+	BASEPRI:    "basepri",
+	BASEPRIMax: "basepri_max",
+	FAULTMASK:  "faultmask",
+	CONTROL:    "control",
+}
+
+func (r SpecialRegister) String() string {
+	toReturn, ok := specialRegisterStrings[r]
+	if !ok {
+		return fmt.Sprintf("<invalid special register %d>", uint8(r))
+	}
+	return toReturn
+}
+
+func (r SpecialRegister) isValid() bool {
+	_, ok := specialRegisterStrings[r]
+	return ok
+}
+
+// Exception numbers used by ARMv7-M processors. External interrupt n uses
+// exception number 16 + n.
+const (
+	resetException        uint16 = 1
+	nmiException          uint16 = 2
+	hardFaultException    uint16 = 3
+	memManageException    uint16 = 4
+	busFaultException     uint16 = 5
+	usageFaultException   uint16 = 6
+	svcallException       uint16 = 11
+	debugMonitorException uint16 = 12
+	pendSVException       uint16 = 14
+	sysTickException      uint16 = 15
+	firstIRQException     uint16 = 16
+)
+
+// The number of external interrupts supported by the NVIC.
+const armv7MInterruptCount = 240
+
+// Bits in the configurable fault status register.
+const (
+	cfsrIBUSERR    uint32 = 0x100
+	cfsrPRECISERR  uint32 = 0x200
+	cfsrUNSTKERR   uint32 = 0x800
+	cfsrSTKERR     uint32 = 0x1000
+	cfsrUNDEFINSTR uint32 = 0x10000
+	cfsrINVSTATE   uint32 = 0x20000
+	cfsrINVPC      uint32 = 0x40000
+)
+
+// Bits in the HardFault status register.
+const (
+	hfsrVECTTBL  uint32 = 0x2
+	hfsrFORCED   uint32 = 0x40000000
+	hfsrDEBUGEVT uint32 = 0x80000000
+)
+
+// The interface to processors implementing the ARMv7-M profile, used by
+// Cortex-M microcontrollers. These always run THUMB code, including the
+// Thumb-2 instructions, and differ from other processors in a few ways:
+//
+//   - GetCPSR and SetCPSR access the xPSR. SetCPSR only changes the APSR and
+//     EPSR bits.
+//   - GetMode returns the user mode value in unprivileged thread mode, and the
+//     system mode value otherwise. SetMode only accepts these two modes, and
+//     sets the privilege level used in thread mode.
+//   - Reset loads the main stack pointer and PC from the vector table at
+//     address 0.
+//   - Exceptions, including interrupts, stack r0-r3, r12, lr, the return
+//     address and the xPSR, and are handled according to their priority.
+//     Exception handlers return by loading an EXC_RETURN value into the PC.
+//   - SendIRQ and SetIRQLine pend external interrupt 0, while SendFIQ and
+//     SetFIQLine pend the NMI.
+//   - The System Control Space, containing the NVIC, SysTick and the system
+//     control block registers, is mapped into memory at 0xe000e000.
+type ARMv7MProcessor interface {
+	ARMProcessor
+	// These access the special registers in the same way as the mrs and
+	// msr instructions in privileged code. The EPSR always reads as 0.
+	GetSpecialRegister(register SpecialRegister) (uint32, error)
+	SetSpecialRegister(register SpecialRegister, value uint32) error
+	// These access the pending bit of an external interrupt, numbered from
+	// 0. A pending interrupt is taken once it is enabled in the NVIC and its
+	// priority is high enough.
+	SetInterruptPending(irq uint16, pending bool) error
+	InterruptPending(irq uint16) bool
+	// Returns the number of the exception currently being handled, which is
+	// 0 in thread mode.
+	CurrentException() uint16
+	// Returns true if the processor locked up after a fault occurred at the
+	// priority of the HardFault handler or higher. A locked up processor
+	// can't run instructions until it is reset.
+	LockedUp() bool
+}
+
+type basicARMv7MProcessor struct {
+	basicARMProcessor
+	// r13 holds the active stack pointer, and this holds the other one.
+	inactiveStackPointer uint32
+	usingPSP             bool
+	unprivileged         bool
+	primask              bool
+	faultmask            bool
+	basepri              uint8
+	exceptionNumber      uint16
+	lockedUp             bool
+	resetRequested       bool
+	// The address and IT state of the instruction being emulated, used as
+	// the return state for faults.
+	instructionAddress uint32
+	instructionITState uint8
+	pending            [firstIRQException + armv7MInterruptCount]bool
+	active             [firstIRQException + armv7MInterruptCount]bool
+	enabled            [firstIRQException + armv7MInterruptCount]bool
+	priorities         [firstIRQException + armv7MInterruptCount]uint8
+	systemControl      systemControlRegisters
+}
+
+// Sets the mode bits to match the privilege level, so that the instruction
+// emulation can check for user mode in the usual way.
+func (p *basicARMv7MProcessor) updateMode() {
+	mode := systemMode
+	if (p.exceptionNumber == 0) && p.unprivileged {
+		mode = userMode
+	}
+	p.currentStatusRegister = (p.currentStatusRegister & 0xffffffe0) |
+		uint32(mode)
+}
+
+func (p *basicARMv7MProcessor) SetMode(mode uint8) error {
+	switch mode {
+	case userMode:
+		p.unprivileged = true
+	case systemMode:
+		p.unprivileged = false
+	default:
+		return fmt.Errorf("ARMv7-M processors don't support mode 0x%02x",
+			mode)
+	}
+	p.updateMode()
+	return nil
+}
+
+// Switches the stack pointer in r13 to the process stack pointer, or back to
+// the main stack pointer.
+func (p *basicARMv7MProcessor) selectStack(psp bool) {
+	if psp == p.usingPSP {
+		return
+	}
+	sp := p.currentRegisters[13]
+	p.currentRegisters[13] = p.inactiveStackPointer
+	p.inactiveStackPointer = sp
+	p.usingPSP = psp
+}
+
+func (p *basicARMv7MProcessor) xPSR() uint32 {
+	toReturn := p.currentStatusRegister & 0xfe0ffc00
+	if p.THUMBMode() {
+		toReturn |= 0x01000000
+	}
+	return toReturn | uint32(p.exceptionNumber)
+}
+
+func (p *basicARMv7MProcessor) GetCPSR() (uint32, error) {
+	return p.xPSR(), nil
+}
+
+func (p *basicARMv7MProcessor) SetCPSR(value uint32) error {
+	p.currentStatusRegister &= 0x01f003df
+	p.currentStatusRegister |= value & 0xfe0ffc00
+	if (value & 0x01000000) != 0 {
+		p.currentStatusRegister |= 0x20
+	}
+	return nil
+}
+
+// The I and F bits don't exist in ARMv7-M, so these report PRIMASK and
+// FAULTMASK instead.
+func (p *basicARMv7MProcessor) IRQDisabled() bool {
+	return p.primask
+}
+
+func (p *basicARMv7MProcessor) FIQDisabled() bool {
+	return p.faultmask
+}
+
+func (p *basicARMv7MProcessor) GetSpecialRegister(
+	register SpecialRegister) (uint32, error) {
+	switch register {
+	case MSP, PSP:
+		if (register == PSP) == p.usingPSP {
+			return p.currentRegisters[13], nil
+		}
+		return p.inactiveStackPointer, nil
+	case PRIMASK:
+		if p.primask {
+			return 1, nil
+		}
+		return 0, nil
+	case BASEPRI, BASEPRIMax:
+		return uint32(p.basepri), nil
+	case FAULTMASK:
+		if p.faultmask {
+			return 1, nil
+		}
+		return 0, nil
+	case CONTROL:
+		toReturn := uint32(0)
+		if p.unprivileged {
+			toReturn |= 1
+		}
+		if p.usingPSP {
+			toReturn |= 2
+		}
+		return toReturn, nil
+	}
+	if !register.isValid() {
+		return 0, fmt.Errorf("Invalid special register: %d", register)
+	}
+	// The remaining registers are combinations of the APSR, IPSR and EPSR,
+	// selected by the bits of the register number.
+	toReturn := uint32(0)
+	if (register & 1) != 0 {
+		toReturn |= uint32(p.exceptionNumber)
+	}
+	if (register & 4) == 0 {
+		toReturn |= p.currentStatusRegister & 0xf80f0000
+	}
+	return toReturn, nil
+}
+
+func (p *basicARMv7MProcessor) SetSpecialRegister(register SpecialRegister,
+	value uint32) error {
+	switch register {
+	case APSR, IAPSR, EAPSR, XPSR:
+		p.currentStatusRegister &= 0x07f0ffff
+		p.currentStatusRegister |= value & 0xf80f0000
+	case IPSR, EPSR, IEPSR:
+		// These can't be written.
+	case MSP, PSP:
+		if (register == PSP) == p.usingPSP {
+			p.currentRegisters[13] = value & 0xfffffffc
+		} else {
+			p.inactiveStackPointer = value & 0xfffffffc
+		}
+	case PRIMASK:
+		p.primask = (value & 1) != 0
+	case BASEPRI:
+		p.basepri = uint8(value)
+	case BASEPRIMax:
+		// This only raises the priority mask.
+		newValue := uint8(value)
+		if (newValue != 0) && ((p.basepri == 0) || (newValue < p.basepri)) {
+			p.basepri = newValue
+		}
+	case FAULTMASK:
+		// FAULTMASK can't be set by the NMI handler.
+		if p.exceptionNumber != nmiException {
+			p.faultmask = (value & 1) != 0
+		}
+	case CONTROL:
+		p.unprivileged = (value & 1) != 0
+		// Handler mode always uses the main stack.
+		if p.exceptionNumber == 0 {
+			p.selectStack((value & 2) != 0)
+		}
+		p.updateMode()
+	default:
+		return fmt.Errorf("Invalid special register: %d", register)
+	}
+	return nil
+}
+
+func (p *basicARMv7MProcessor) SetInterruptPending(irq uint16,
+	pending bool) error {
+	if irq >= armv7MInterruptCount {
+		return fmt.Errorf("Invalid interrupt number: %d", irq)
+	}
+	p.pending[firstIRQException+irq] = pending
+	return nil
+}
+
+func (p *basicARMv7MProcessor) InterruptPending(irq uint16) bool {
+	if irq >= armv7MInterruptCount {
+		return false
+	}
+	return p.pending[firstIRQException+irq]
+}
+
+func (p *basicARMv7MProcessor) CurrentException() uint16 {
+	return p.exceptionNumber
+}
+
+func (p *basicARMv7MProcessor) LockedUp() bool {
+	return p.lockedUp
+}
+
+// Returns the group priority of the given priority value, which is the part
+// of it that determines whether an exception can preempt another.
+func (p *basicARMv7MProcessor) groupPriority(priority uint8) int {
+	subpriorityBits := (uint32(2) << p.systemControl.priorityGroup) - 1
+	return int(uint32(priority) & ^subpriorityBits)
+}
+
+// Returns the priority of the given exception, where lower values are more
+// urgent. Reset, the NMI and HardFault have fixed negative priorities.
+func (p *basicARMv7MProcessor) exceptionPriority(number uint16) int {
+	switch number {
+	case resetException:
+		return -3
+	case nmiException:
+		return -2
+	case hardFaultException:
+		return -1
+	}
+	return int(p.priorities[number])
+}
+
+// Returns the priority below which exceptions may preempt the running code,
+// taking the active exceptions and the priority masks into account. Thread
+// mode with no masking runs at 256, below any exception.
+func (p *basicARMv7MProcessor) executionPriority() int {
+	toReturn := 256
+	for number, active := range p.active {
+		if !active {
+			continue
+		}
+		priority := p.exceptionPriority(uint16(number))
+		if priority >= 0 {
+			priority = p.groupPriority(uint8(priority))
+		}
+		if priority < toReturn {
+			toReturn = priority
+		}
+	}
+	if (p.basepri != 0) && (p.groupPriority(p.basepri) < toReturn) {
+		toReturn = p.groupPriority(p.basepri)
+	}
+	if p.primask && (toReturn > 0) {
+		toReturn = 0
+	}
+	if p.faultmask && (toReturn > -1) {
+		toReturn = -1
+	}
+	return toReturn
+}
+
+// Returns the pending exception with the highest priority, or 0 if none are
+// pending. Exceptions with equal priorities are ordered by their numbers.
+// Disabled interrupts are ignored.
+func (p *basicARMv7MProcessor) highestPendingException() uint16 {
+	toReturn := uint16(0)
+	bestPriority := 0
+	for i, pending := range p.pending {
+		number := uint16(i)
+		if !pending {
+			continue
+		}
+		if (number >= firstIRQException) && !p.enabled[number] {
+			continue
+		}
+		priority := p.exceptionPriority(number)
+		if (toReturn == 0) || (priority < bestPriority) {
+			toReturn = number
+			bestPriority = priority
+		}
+	}
+	return toReturn
+}
+
+// Takes the highest priority pending exception if it may preempt the running
+// code. Returns true if an exception was taken.
+func (p *basicARMv7MProcessor) takePendingException() (bool, error) {
+	number := p.highestPendingException()
+	if number == 0 {
+		return false, nil
+	}
+	priority := p.exceptionPriority(number)
+	if priority >= 0 {
+		priority = p.groupPriority(uint8(priority))
+	}
+	if priority >= p.executionPriority() {
+		return false, nil
+	}
+	returnAddress, _ := p.GetRegister(15)
+	return true, p.takeException(number, returnAddress)
+}
+
+// Returns true if the given fault is enabled in the SHCSR. Other exceptions
+// are always enabled.
+func (p *basicARMv7MProcessor) faultEnabled(number uint16) bool {
+	enables := p.systemControl.handlerEnables
+	switch number {
+	case memManageException:
+		return (enables & 1) != 0
+	case busFaultException:
+		return (enables & 2) != 0
+	case usageFaultException:
+		return (enables & 4) != 0
+	}
+	return true
+}
+
+// Returns the exception taken for the given fault. If the fault is disabled or
+// its priority is too low to be taken immediately, it's escalated to
+// HardFault. A fault which can't be escalated causes a lockup.
+func (p *basicARMv7MProcessor) escalateFault(number uint16) (uint16, error) {
+	executionPriority := p.executionPriority()
+	if number != hardFaultException {
+		priority := p.groupPriority(uint8(p.exceptionPriority(number)))
+		if !p.faultEnabled(number) || (priority >= executionPriority) {
+			p.systemControl.hardFaultStatus |= hfsrFORCED
+			number = hardFaultException
+		}
+	}
+	if executionPriority < 0 {
+		p.lockedUp = true
+		return 0, fmt.Errorf("Locked up after fault %d at 0x%08x", number,
+			p.instructionAddress)
+	}
+	return number, nil
+}
+
+// Takes a synchronous exception, such as a fault or SVCall, escalating it if
+// necessary.
+func (p *basicARMv7MProcessor) raiseFault(number uint16,
+	returnAddress uint32) error {
+	number, e := p.escalateFault(number)
+	if e != nil {
+		return e
+	}
+	return p.takeException(number, returnAddress)
+}
+
+// Raises the fault caused by an exception from the shared emulation code,
+// which uses the exception modes and vectors of the other processors.
+func (p *basicARMv7MProcessor) takeARMException(mode uint8, vector,
+	returnAddress uint32) error {
+	// Faults return to the instruction that caused them, in its IT block.
+	faultAddress := p.instructionAddress
+	p.SetITState(p.instructionITState)
+	switch vector {
+	case softwareInterruptVector:
+		p.SetITState(advanceITState(p.instructionITState))
+		return p.raiseFault(svcallException, returnAddress)
+	case undefinedVector:
+		p.systemControl.faultStatus |= cfsrUNDEFINSTR
+		return p.raiseFault(usageFaultException, faultAddress)
+	case dataAbortVector:
+		p.systemControl.faultStatus |= cfsrPRECISERR
+		return p.raiseFault(busFaultException, faultAddress)
+	case prefetchAbortVector:
+		// bkpt also uses the prefetch abort vector. Without a debugger, it
+		// escalates to HardFault.
+		raw, e := fetchInstructionHalfword(p.memory, faultAddress)
+		if (e == nil) && ((raw & 0xff00) == 0xbe00) {
+			p.systemControl.hardFaultStatus |= hfsrDEBUGEVT
+			return p.raiseFault(hardFaultException, faultAddress)
+		}
+		p.systemControl.faultStatus |= cfsrIBUSERR
+		return p.raiseFault(busFaultException, faultAddress)
+	}
+	return fmt.Errorf("Unsupported exception vector 0x%02x in mode 0x%02x",
+		vector, mode)
+}
+
+// Pushes r0-r3, r12, lr, the return address and the xPSR to the current
+// stack. If the stack needs to be realigned to 8 bytes, bit 9 of the stacked
+// xPSR is set.
+func (p *basicARMv7MProcessor) pushExceptionFrame(returnAddress uint32) error {
+	sp := p.currentRegisters[13]
+	xpsr := p.xPSR()
+	if ((p.systemControl.configuration & 0x200) != 0) && ((sp & 4) != 0) {
+		sp -= 4
+		xpsr |= 0x200
+	}
+	sp -= 32
+	frame := [...]uint32{p.currentRegisters[0], p.currentRegisters[1],
+		p.currentRegisters[2], p.currentRegisters[3], p.currentRegisters[12],
+		p.currentRegisters[14], returnAddress, xpsr}
+	for i, value := range frame {
+		e := p.memory.WriteMemoryWord(sp+uint32(i*4), value)
+		if e != nil {
+			return e
+		}
+	}
+	p.currentRegisters[13] = sp
+	return nil
+}
+
+// Stacks the current state and jumps to the handler for the given exception,
+// switching to handler mode. If stacking fails, the resulting BusFault is
+// taken instead, without stacking the registers again.
+func (p *basicARMv7MProcessor) takeException(number uint16,
+	returnAddress uint32) error {
+	e := p.pushExceptionFrame(returnAddress)
+	if e != nil {
+		p.systemControl.faultStatus |= cfsrSTKERR
+		derived, e := p.escalateFault(busFaultException)
+		if e != nil {
+			return e
+		}
+		// HardFault is still taken if stacking for it fails.
+		if number != hardFaultException {
+			number = derived
+		}
+	}
+	exceptionReturn := uint32(0xfffffff1)
+	if p.exceptionNumber == 0 {
+		exceptionReturn = 0xfffffff9
+		if p.usingPSP {
+			exceptionReturn = 0xfffffffd
+		}
+	}
+	vector, e := p.memory.ReadMemoryWord(p.systemControl.vectorTable +
+		uint32(number)*4)
+	if e != nil {
+		p.systemControl.hardFaultStatus |= hfsrVECTTBL
+		p.lockedUp = true
+		return fmt.Errorf("Failed reading the vector for exception %d: %s",
+			number, e)
+	}
+	p.selectStack(false)
+	p.pending[number] = false
+	p.active[number] = true
+	p.exceptionNumber = number
+	p.updateMode()
+	p.SetITState(0)
+	// A vector without bit 0 set causes an INVSTATE fault when the handler
+	// runs, as there is no ARM state.
+	p.SetTHUMBMode((vector & 1) != 0)
+	p.ClearExclusive()
+	p.currentRegisters[14] = exceptionReturn
+	p.currentRegisters[15] = vector & 0xfffffffe
+	return nil
+}
+
+// Returns from the current exception, given the EXC_RETURN value loaded into
+// the PC.
+func (p *basicARMv7MProcessor) returnFromException(
+	exceptionReturn uint32) error {
+	toThread := false
+	usePSP := false
+	switch exceptionReturn & 0xf {
+	case 1:
+	case 9:
+		toThread = true
+	case 0xd:
+		toThread = true
+		usePSP = true
+	default:
+		p.systemControl.faultStatus |= cfsrINVPC
+		return p.raiseFault(usageFaultException, exceptionReturn)
+	}
+	number := p.exceptionNumber
+	p.active[number] = false
+	if number != nmiException {
+		p.faultmask = false
+	}
+	p.selectStack(usePSP)
+	sp := p.currentRegisters[13]
+	var frame [8]uint32
+	for i := range frame {
+		value, e := p.memory.ReadMemoryWord(sp + uint32(i*4))
+		if e != nil {
+			p.systemControl.faultStatus |= cfsrUNSTKERR
+			p.lockedUp = true
+			return fmt.Errorf("Failed unstacking registers: %s", e)
+		}
+		frame[i] = value
+	}
+	xpsr := frame[7]
+	sp += 32
+	if ((p.systemControl.configuration & 0x200) != 0) &&
+		((xpsr & 0x200) != 0) {
+		sp += 4
+	}
+	p.currentRegisters[13] = sp
+	copy(p.currentRegisters[0:4], frame[0:4])
+	p.currentRegisters[12] = frame[4]
+	p.currentRegisters[14] = frame[5]
+	p.currentRegisters[15] = frame[6] & 0xfffffffe
+	p.SetCPSR(xpsr)
+	p.exceptionNumber = 0
+	if !toThread {
+		p.exceptionNumber = uint16(xpsr & 0x1ff)
+	}
+	p.updateMode()
+	p.ClearExclusive()
+	return nil
+}
+
+// In ARMv7-M, the interrupt lines pend external interrupt 0 and the NMI.
+func (p *basicARMv7MProcessor) SendIRQ() error {
+	p.pending[firstIRQException] = true
+	_, e := p.takePendingException()
+	if e != nil {
+		return fmt.Errorf("Couldn't send IRQ: %s", e)
+	}
+	return nil
+}
+
+func (p *basicARMv7MProcessor) SendFIQ() error {
+	p.pending[nmiException] = true
+	_, e := p.takePendingException()
+	if e != nil {
+		return fmt.Errorf("Couldn't send NMI: %s", e)
+	}
+	return nil
+}
+
+// Resets the exception state and system control registers, then loads the
+// main stack pointer and the PC from the vector table at address 0.
+func (p *basicARMv7MProcessor) Reset() error {
+	p.pending = [len(p.pending)]bool{}
+	p.active = [len(p.active)]bool{}
+	p.enabled = [len(p.enabled)]bool{}
+	p.priorities = [len(p.priorities)]uint8{}
+	p.systemControl.reset()
+	p.usingPSP = false
+	p.unprivileged = false
+	p.primask = false
+	p.faultmask = false
+	p.basepri = 0
+	p.exceptionNumber = 0
+	p.lockedUp = false
+	p.resetRequested = false
+	p.currentStatusRegister = uint32(systemMode)
+	p.ClearExclusive()
+	sp, e := p.memory.ReadMemoryWord(0)
+	if e != nil {
+		return fmt.Errorf("Failed reading the initial stack pointer: %s", e)
+	}
+	pc, e := p.memory.ReadMemoryWord(4)
+	if e != nil {
+		return fmt.Errorf("Failed reading the reset vector: %s", e)
+	}
+	p.currentRegisters[13] = sp & 0xfffffffc
+	p.currentRegisters[14] = 0xffffffff
+	p.currentRegisters[15] = pc & 0xfffffffe
+	p.SetTHUMBMode((pc & 1) != 0)
+	return nil
+}
+
+func (p *basicARMv7MProcessor) SetArchitecture(
+	architecture ARMArchitecture) error {
+	if architecture != ARMv7M {
+		return fmt.Errorf("ARMv7-M processors can't emulate %s",
+			architecture)
+	}
+	return nil
+}
+
+// Maps the System Control Space into the new memory, after removing it from
+// the old memory.
+func (p *basicARMv7MProcessor) SetMemoryInterface(m ARMMemory) {
+	if p.memory != nil {
+		p.memory.UnmapDevice(systemControlSpaceBase)
+	}
+	p.basicARMProcessor.SetMemoryInterface(m)
+	// This only fails if another device was already mapped in the System
+	// Control Space, in which case that device takes its place.
+	m.MapDevice(systemControlSpaceBase, systemControlSpaceSize,
+		&systemControlSpace{p})
+}
+
+func (p *basicARMv7MProcessor) RunNextInstruction() error {
+	if p.lockedUp {
+		return fmt.Errorf("The processor is locked up")
+	}
+	if p.resetRequested {
+		return p.Reset()
+	}
+	pc := p.currentRegisters[15]
+	// Loading an EXC_RETURN value into the PC returns from an exception.
+	if (p.exceptionNumber != 0) && ((pc & 0xfffffff0) == 0xfffffff0) {
+		return p.returnFromException(pc | 1)
+	}
+	if p.irqLine {
+		p.pending[firstIRQException] = true
+	}
+	if p.fiqLine {
+		p.pending[nmiException] = true
+	}
+	taken, e := p.takePendingException()
+	if taken || (e != nil) {
+		return e
+	}
+	p.instructionAddress = pc
+	p.instructionITState = p.ITState()
+	if !p.THUMBMode() {
+		if !p.architecturalExceptions {
+			return fmt.Errorf("Can't execute ARM code at 0x%08x", pc)
+		}
+		p.systemControl.faultStatus |= cfsrINVSTATE
+		return p.raiseFault(usageFaultException, pc)
+	}
+	e = p.runTHUMBInstruction(p, pc)
+	p.tickSysTick()
+	return e
+}
+
+func (p *basicARMv7MProcessor) Run(maxInstructions uint64) StopReason {
+	return p.run(p, maxInstructions)
+}
+
+// Returns a new ARMv7-M processor. Reset must be called to load the initial
+// stack pointer and PC after the vector table has been written to memory.
+func NewARMv7MProcessor() ARMv7MProcessor {
+	var toReturn basicARMv7MProcessor
+	toReturn.SetMemoryInterface(NewARMMemory())
+	toReturn.currentStatusRegister = uint32(systemMode) | 0x20
+	toReturn.coprocessors = make([]ARMCoprocessor, 0, 1)
+	toReturn.swiHandlers = make([]SoftwareInterruptHandler, 0, 1)
+	toReturn.cache = newInstructionCache()
+	toReturn.architecture = ARMv7M
+	toReturn.systemControl.reset()
+	return &toReturn
+}
@@ -0,0 +1,409 @@
+package arm_emulate
+
+// This file implements the ARMv7-M System Control Space, containing the NVIC,
+// SysTick timer and system control block registers.
+
+import (
+	"fmt"
+)
+
+// The location of the System Control Space in memory.
+const (
+	systemControlSpaceBase uint32 = 0xe000e000
+	systemControlSpaceSize uint32 = 0x1000
+)
+
+// The value of the CPUID register, identifying a Cortex-M4 r0p1.
+const armv7MCPUID uint32 = 0x410fc241
+
+// Holds the System Control Space registers that aren't part of the processor's
+// exception state.
+type systemControlRegisters struct {
+	vectorTable   uint32
+	priorityGroup uint8
+	// The SCR, which only holds the sleep settings.
+	systemControl uint32
+	// The CCR.
+	configuration uint32
+	// The MemManage, BusFault and UsageFault enable bits from the SHCSR.
+	handlerEnables    uint8
+	faultStatus       uint32
+	hardFaultStatus   uint32
+	memManageAddress  uint32
+	busFaultAddress   uint32
+	coprocessorAccess uint32
+	sysTickControl    uint32
+	sysTickReload     uint32
+	sysTickCurrent    uint32
+	sysTickCountFlag  bool
+}
+
+func (r *systemControlRegisters) reset() {
+	*r = systemControlRegisters{}
+	// Exception frames are 8-byte aligned by default.
+	r.configuration = 0x200
+}
+
+// Advances the SysTick timer by one clock, which is one instruction. When the
+// timer counts down to 0, it sets the COUNTFLAG bit and pends the SysTick
+// exception if TICKINT is set, then reloads on the following clock.
+func (p *basicARMv7MProcessor) tickSysTick() {
+	r := &p.systemControl
+	if (r.sysTickControl & 1) == 0 {
+		return
+	}
+	if r.sysTickCurrent == 0 {
+		r.sysTickCurrent = r.sysTickReload
+		return
+	}
+	r.sysTickCurrent--
+	if r.sysTickCurrent != 0 {
+		return
+	}
+	r.sysTickCountFlag = true
+	if (r.sysTickControl & 2) != 0 {
+		p.pending[sysTickException] = true
+	}
+}
+
+// Maps the active and pending bits in the SHCSR to their exceptions.
+var shcsrBits = [...]struct {
+	bit     uint8
+	number  uint16
+	pending bool
+}{
+	{0, memManageException, false},
+	{1, busFaultException, false},
+	{3, usageFaultException, false},
+	{7, svcallException, false},
+	{8, debugMonitorException, false},
+	{10, pendSVException, false},
+	{11, sysTickException, false},
+	{12, usageFaultException, true},
+	{13, memManageException, true},
+	{14, busFaultException, true},
+	{15, svcallException, true},
+}
+
+// The memory-mapped device through which an ARMv7-M processor's System
+// Control Space is accessed. Unimplemented registers read as zero and ignore
+// writes.
+type systemControlSpace struct {
+	p *basicARMv7MProcessor
+}
+
+// Returns the index in the processor's priorities of the byte at the given
+// offset, or false if the offset isn't in a priority register. Reserved
+// system handler priorities aren't included.
+func priorityIndex(offset uint32) (uint16, bool) {
+	if (offset >= 0x400) && (offset < (0x400 + armv7MInterruptCount)) {
+		return uint16(offset-0x400) + firstIRQException, true
+	}
+	if (offset < 0xd18) || (offset >= 0xd24) {
+		return 0, false
+	}
+	number := uint16(offset-0xd18) + memManageException
+	switch number {
+	case memManageException, busFaultException, usageFaultException,
+		svcallException, debugMonitorException, pendSVException,
+		sysTickException:
+		return number, true
+	}
+	return 0, false
+}
+
+// Returns a word of the given interrupt bits, as read from an NVIC register at
+// the given offset from the start of the register array.
+func readInterruptBits(bits []bool, offset uint32) uint32 {
+	toReturn := uint32(0)
+	first := firstIRQException + uint16(offset/4)*32
+	for i := uint16(0); i < 32; i++ {
+		if (int(first+i) < len(bits)) && bits[first+i] {
+			toReturn |= 1 << i
+		}
+	}
+	return toReturn
+}
+
+// Sets the interrupt bits corresponding to the 1 bits in value to the given
+// state.
+func writeInterruptBits(bits []bool, offset, value uint32, state bool) {
+	first := firstIRQException + uint16(offset/4)*32
+	for i := uint16(0); i < 32; i++ {
+		if (int(first+i) < len(bits)) && ((value & (1 << i)) != 0) {
+			bits[first+i] = state
+		}
+	}
+}
+
+func (s *systemControlSpace) interruptControlState() uint32 {
+	p := s.p
+	toReturn := uint32(p.exceptionNumber)
+	toReturn |= uint32(p.highestPendingException()) << 12
+	activeCount := 0
+	for _, active := range p.active {
+		if active {
+			activeCount++
+		}
+	}
+	if activeCount == 1 {
+		toReturn |= 0x800
+	}
+	for _, pending := range p.pending[firstIRQException:] {
+		if pending {
+			toReturn |= 0x400000
+			break
+		}
+	}
+	if p.pending[sysTickException] {
+		toReturn |= 0x4000000
+	}
+	if p.pending[pendSVException] {
+		toReturn |= 0x10000000
+	}
+	if p.pending[nmiException] {
+		toReturn |= 0x80000000
+	}
+	return toReturn
+}
+
+func (s *systemControlSpace) writeInterruptControlState(value uint32) {
+	p := s.p
+	if (value & 0x80000000) != 0 {
+		p.pending[nmiException] = true
+	}
+	if (value & 0x10000000) != 0 {
+		p.pending[pendSVException] = true
+	}
+	if (value & 0x8000000) != 0 {
+		p.pending[pendSVException] = false
+	}
+	if (value & 0x4000000) != 0 {
+		p.pending[sysTickException] = true
+	}
+	if (value & 0x2000000) != 0 {
+		p.pending[sysTickException] = false
+	}
+}
+
+func (s *systemControlSpace) handlerControlState() uint32 {
+	p := s.p
+	toReturn := uint32(p.systemControl.handlerEnables) << 16
+	for _, b := range shcsrBits {
+		set := p.active[b.number]
+		if b.pending {
+			set = p.pending[b.number]
+		}
+		if set {
+			toReturn |= 1 << b.bit
+		}
+	}
+	return toReturn
+}
+
+func (s *systemControlSpace) writeHandlerControlState(value uint32) {
+	p := s.p
+	p.systemControl.handlerEnables = uint8(value>>16) & 7
+	for _, b := range shcsrBits {
+		set := (value & (1 << b.bit)) != 0
+		if b.pending {
+			p.pending[b.number] = set
+		} else {
+			p.active[b.number] = set
+		}
+	}
+}
+
+// Reads the word-aligned register at the given offset.
+func (s *systemControlSpace) readRegister(offset uint32) uint32 {
+	p := s.p
+	r := &p.systemControl
+	switch {
+	case (offset >= 0x100) && (offset < 0x120):
+		return readInterruptBits(p.enabled[:], offset-0x100)
+	case (offset >= 0x180) && (offset < 0x1a0):
+		return readInterruptBits(p.enabled[:], offset-0x180)
+	case (offset >= 0x200) && (offset < 0x220):
+		return readInterruptBits(p.pending[:], offset-0x200)
+	case (offset >= 0x280) && (offset < 0x2a0):
+		return readInterruptBits(p.pending[:], offset-0x280)
+	case (offset >= 0x300) && (offset < 0x320):
+		return readInterruptBits(p.active[:], offset-0x300)
+	}
+	switch offset {
+	case 0x004:
+		// The number of 32-bit words of interrupt bits, minus 1.
+		return (armv7MInterruptCount+31)/32 - 1
+	case 0x010:
+		// SysTick always uses the processor clock.
+		toReturn := r.sysTickControl | 4
+		if r.sysTickCountFlag {
+			toReturn |= 0x10000
+			r.sysTickCountFlag = false
+		}
+		return toReturn
+	case 0x014:
+		return r.sysTickReload
+	case 0x018:
+		return r.sysTickCurrent
+	case 0x01c:
+		// There's no reference clock or calibration value.
+		return 0xc0000000
+	case 0xd00:
+		return armv7MCPUID
+	case 0xd04:
+		return s.interruptControlState()
+	case 0xd08:
+		return r.vectorTable
+	case 0xd0c:
+		return 0xfa050000 | (uint32(r.priorityGroup) << 8)
+	case 0xd10:
+		return r.systemControl
+	case 0xd14:
+		return r.configuration
+	case 0xd24:
+		return s.handlerControlState()
+	case 0xd28:
+		return r.faultStatus
+	case 0xd2c:
+		return r.hardFaultStatus
+	case 0xd34:
+		return r.memManageAddress
+	case 0xd38:
+		return r.busFaultAddress
+	case 0xd88:
+		return r.coprocessorAccess
+	}
+	return 0
+}
+
+// Writes the word-aligned register at the given offset.
+func (s *systemControlSpace) writeRegister(offset, value uint32) {
+	p := s.p
+	r := &p.systemControl
+	switch {
+	case (offset >= 0x100) && (offset < 0x120):
+		writeInterruptBits(p.enabled[:], offset-0x100, value, true)
+		return
+	case (offset >= 0x180) && (offset < 0x1a0):
+		writeInterruptBits(p.enabled[:], offset-0x180, value, false)
+		return
+	case (offset >= 0x200) && (offset < 0x220):
+		writeInterruptBits(p.pending[:], offset-0x200, value, true)
+		return
+	case (offset >= 0x280) && (offset < 0x2a0):
+		writeInterruptBits(p.pending[:], offset-0x280, value, false)
+		return
+	}
+	switch offset {
+	case 0x010:
+		r.sysTickControl = value & 3
+	case 0x014:
+		r.sysTickReload = value & 0xffffff
+	case 0x018:
+		// Any write clears the current value.
+		r.sysTickCurrent = 0
+		r.sysTickCountFlag = false
+	case 0xd04:
+		s.writeInterruptControlState(value)
+	case 0xd08:
+		r.vectorTable = value & 0xffffff80
+	case 0xd0c:
+		// Writes without the correct key are ignored.
+		if (value >> 16) != 0x05fa {
+			return
+		}
+		r.priorityGroup = uint8(value>>8) & 7
+		if (value & 4) != 0 {
+			p.resetRequested = true
+		}
+	case 0xd10:
+		r.systemControl = value & 0x16
+	case 0xd14:
+		r.configuration = value & 0x31b
+	case 0xd24:
+		s.writeHandlerControlState(value)
+	case 0xd28:
+		r.faultStatus &= ^value
+	case 0xd2c:
+		r.hardFaultStatus &= ^value
+	case 0xd34:
+		r.memManageAddress = value
+	case 0xd38:
+		r.busFaultAddress = value
+	case 0xd88:
+		r.coprocessorAccess = value
+	case 0xf00:
+		irq := value & 0x1ff
+		if irq < armv7MInterruptCount {
+			p.pending[firstIRQException+uint16(irq)] = true
+		}
+	}
+}
+
+// Returns an error if unprivileged code is accessing the given offset. Only
+// the STIR may be written by unprivileged code, if the CCR allows it.
+func (s *systemControlSpace) checkPrivilege(offset uint32, write bool) error {
+	p := s.p
+	if !p.watching || (p.GetMode() != userMode) {
+		return nil
+	}
+	if write && (offset == 0xf00) &&
+		((p.systemControl.configuration & 2) != 0) {
+		return nil
+	}
+	return fmt.Errorf("Unprivileged access to the System Control Space")
+}
+
+func (s *systemControlSpace) ReadDevice(offset uint32, width uint8) (uint32,
+	error) {
+	e := s.checkPrivilege(offset, false)
+	if e != nil {
+		return 0, e
+	}
+	if _, ok := priorityIndex(offset); ok {
+		toReturn := uint32(0)
+		for i := uint32(0); i < uint32(width); i++ {
+			number, ok := priorityIndex(offset + i)
+			if ok {
+				toReturn |= uint32(s.p.priorities[number]) << (i * 8)
+			}
+		}
+		return toReturn, nil
+	}
+	// Smaller reads return part of the word, as firmware often reads the
+	// parts of the CFSR separately.
+	value := s.readRegister(offset & 0xffc)
+	shift := (offset & 3) * 8
+	mask := uint32(0xffffffff) >> (32 - uint32(width)*8)
+	return (value >> shift) & mask, nil
+}
+
+func (s *systemControlSpace) WriteDevice(offset uint32, width uint8,
+	value uint32) error {
+	e := s.checkPrivilege(offset, true)
+	if e != nil {
+		return e
+	}
+	if _, ok := priorityIndex(offset); ok {
+		for i := uint32(0); i < uint32(width); i++ {
+			number, ok := priorityIndex(offset + i)
+			if ok {
+				s.p.priorities[number] = uint8(value >> (i * 8))
+			}
+		}
+		return nil
+	}
+	if width != 4 {
+		// The fault status registers are cleared by writing 1 bits, so
+		// they can be written in parts.
+		if (offset & 0xffc) != 0xd28 {
+			return fmt.Errorf("Unsupported %d-byte write to system "+
+				"control register 0x%03x", width, offset)
+		}
+		value <<= (offset & 3) * 8
+		offset &= 0xffc
+	}
+	s.writeRegister(offset, value)
+	return nil
+}
@@ -0,0 +1,517 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+// Returns an ARMv7-M processor with flash at address 0 and RAM at 0x20000000,
+// after resetting it. The reset handler is at 0x100, and every other
+// exception uses the handler at 0x200, which is bx lr.
+func setupTestARMv7MProcessor() (ARMv7MProcessor, error) {
+	p := NewARMv7MProcessor()
+	m := p.GetMemoryInterface()
+	e := m.SetMemoryRegion(0, make([]byte, 0x1000))
+	if e != nil {
+		return nil, e
+	}
+	e = m.SetMemoryRegion(0x20000000, make([]byte, 0x1000))
+	if e != nil {
+		return nil, e
+	}
+	m.WriteMemoryWord(0, 0x20001000)
+	m.WriteMemoryWord(4, 0x101)
+	for i := uint32(2); i < 32; i++ {
+		m.WriteMemoryWord(i*4, 0x201)
+	}
+	m.WriteMemoryHalfword(0x200, 0x4770)
+	p.SetArchitecturalExceptions(true)
+	e = p.Reset()
+	if e != nil {
+		return nil, e
+	}
+	return p, nil
+}
+
+// Writes the halfwords of a THUMB program to memory at the reset handler.
+func writeARMv7MProgram(p ARMv7MProcessor, program []uint16) error {
+	m := p.GetMemoryInterface()
+	for i, raw := range program {
+		e := m.WriteMemoryHalfword(0x100+uint32(i*2), raw)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func TestARMv7MReset(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.Logf("Failed setting up the processor: %s\n", e)
+		t.FailNow()
+	}
+	sp, _ := p.GetRegister(13)
+	pc, _ := p.GetRegister(15)
+	if (sp != 0x20001000) || (pc != 0x100) || !p.THUMBMode() {
+		t.Logf("Incorrect state after reset: sp = 0x%08x, pc = 0x%08x\n",
+			sp, pc)
+		t.Fail()
+	}
+	xpsr, _ := p.GetCPSR()
+	if (xpsr != 0x01000000) || (p.GetMode() != systemMode) {
+		t.Logf("Incorrect xPSR after reset: 0x%08x\n", xpsr)
+		t.Fail()
+	}
+	if p.SetArchitecture(ARMv7) == nil {
+		t.Logf("Didn't get an error when changing the architecture.\n")
+		t.Fail()
+	}
+}
+
+func TestARMv7MExceptionStacking(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	// The stack will need to be realigned to 8 bytes.
+	p.SetRegister(13, 0x20000ffc)
+	p.SetRegister(0, 1337)
+	p.SetRegister(12, 12)
+	p.SetRegister(14, 0x1235)
+	p.SetCarry(true)
+	// Pend PendSV using the ICSR.
+	m.WriteMemoryWord(0xe000ed04, 0x10000000)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Failed taking PendSV: %s\n", e)
+		t.FailNow()
+	}
+	sp, _ := p.GetRegister(13)
+	pc, _ := p.GetRegister(15)
+	lr, _ := p.GetRegister(14)
+	if (p.CurrentException() != 14) || (pc != 0x200) || (lr != 0xfffffff9) ||
+		(sp != 0x20000fd8) {
+		t.Logf("Incorrect exception entry: exception %d, pc = 0x%08x, "+
+			"lr = 0x%08x, sp = 0x%08x\n", p.CurrentException(), pc, lr, sp)
+		t.FailNow()
+	}
+	expected := []uint32{1337, 0, 0, 0, 12, 0x1235, 0x100, 0x21000200}
+	for i, value := range expected {
+		stacked, _ := m.ReadMemoryWord(sp + uint32(i*4))
+		if stacked != value {
+			t.Logf("Stacked word %d was 0x%08x, expected 0x%08x\n", i,
+				stacked, value)
+			t.Fail()
+		}
+	}
+	// The handler changes r0 and the flags, then returns using bx lr.
+	p.SetRegister(0, 0)
+	p.SetCarry(false)
+	e = runMultipleInstructions(2, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	sp, _ = p.GetRegister(13)
+	pc, _ = p.GetRegister(15)
+	r0, _ := p.GetRegister(0)
+	if (p.CurrentException() != 0) || (pc != 0x100) || (sp != 0x20000ffc) ||
+		(r0 != 1337) || !p.Carry() {
+		t.Logf("Incorrect state after returning: pc = 0x%08x, sp = "+
+			"0x%08x, r0 = %d\n", pc, sp, r0)
+		t.Fail()
+	}
+}
+
+func TestARMv7MProcessStack(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint16{
+		// msr psp, r0
+		0xf380, 0x8809,
+		// movs r0, 2
+		0x2002,
+		// msr control, r0
+		0xf380, 0x8814,
+		// nop
+		0xbf00,
+	}
+	e = writeARMv7MProgram(p, program)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(0, 0x20000800)
+	e = runMultipleInstructions(3, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	sp, _ := p.GetRegister(13)
+	msp, _ := p.GetSpecialRegister(MSP)
+	if (sp != 0x20000800) || (msp != 0x20001000) {
+		t.Logf("Incorrect stack pointers: sp = 0x%08x, msp = 0x%08x\n", sp,
+			msp)
+		t.FailNow()
+	}
+	// Take SysTick, which should stack the registers on the process stack.
+	p.GetMemoryInterface().WriteMemoryWord(0xe000ed04, 0x04000000)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.FailNow()
+	}
+	sp, _ = p.GetRegister(13)
+	psp, _ := p.GetSpecialRegister(PSP)
+	lr, _ := p.GetRegister(14)
+	control, _ := p.GetSpecialRegister(CONTROL)
+	if (sp != 0x20001000) || (psp != 0x200007e0) || (lr != 0xfffffffd) ||
+		(control != 0) {
+		t.Logf("Incorrect exception entry: sp = 0x%08x, psp = 0x%08x, "+
+			"lr = 0x%08x, control = %d\n", sp, psp, lr, control)
+		t.Fail()
+	}
+	e = runMultipleInstructions(2, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	sp, _ = p.GetRegister(13)
+	control, _ = p.GetSpecialRegister(CONTROL)
+	if (sp != 0x20000800) || (control != 2) {
+		t.Logf("Incorrect state after return: sp = 0x%08x, control = %d\n",
+			sp, control)
+		t.Fail()
+	}
+}
+
+func TestARMv7MInterruptPriorities(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint16{
+		// cpsid i
+		0xb672,
+		// nop
+		0xbf00,
+		// cpsie i
+		0xb662,
+		// nop
+		0xbf00,
+	}
+	e = writeARMv7MProgram(p, program)
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	// IRQ 3 has priority 0x40 and IRQ 4 has priority 0x20.
+	m.WriteMemoryByte(0xe000e403, 0x40)
+	m.WriteMemoryByte(0xe000e404, 0x20)
+	p.SetInterruptPending(3, true)
+	// IRQ 3 isn't taken until it's enabled, and interrupts are unmasked.
+	e = runMultipleInstructions(1, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	m.WriteMemoryWord(0xe000e100, 0x18)
+	e = runMultipleInstructions(2, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ := p.GetRegister(15)
+	if (p.CurrentException() != 0) || (pc != 0x106) {
+		t.Logf("IRQ 3 was taken with PRIMASK set.\n")
+		t.FailNow()
+	}
+	icsr, _ := m.ReadMemoryWord(0xe000ed04)
+	if ((icsr >> 12) & 0x1ff) != 19 {
+		t.Logf("Incorrect ICSR: 0x%08x\n", icsr)
+		t.Fail()
+	}
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 19) {
+		t.Logf("IRQ 3 wasn't taken after cpsie i: %v\n", e)
+		t.FailNow()
+	}
+	// IRQ 4 preempts IRQ 3, but IRQ 3 doesn't preempt itself.
+	p.SetInterruptPending(3, true)
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 19) {
+		t.Logf("IRQ 3 preempted itself: %v\n", e)
+		t.FailNow()
+	}
+	p.SetRegister(15, 0x200)
+	p.SetInterruptPending(4, true)
+	e = p.RunNextInstruction()
+	lr, _ := p.GetRegister(14)
+	if (e != nil) || (p.CurrentException() != 20) || (lr != 0xfffffff1) {
+		t.Logf("IRQ 4 didn't preempt IRQ 3: %v\n", e)
+		t.FailNow()
+	}
+	// After returning from IRQ 4 to IRQ 3, returning from IRQ 3 takes the
+	// pending IRQ 3 again.
+	e = runMultipleInstructions(2, p, t)
+	if (e != nil) || (p.CurrentException() != 19) {
+		t.Logf("Didn't return to IRQ 3: %v\n", e)
+		t.FailNow()
+	}
+	e = runMultipleInstructions(3, p, t)
+	if (e != nil) || (p.CurrentException() != 19) || p.InterruptPending(3) {
+		t.Logf("Didn't take the pending IRQ 3: %v\n", e)
+		t.FailNow()
+	}
+	e = runMultipleInstructions(2, p, t)
+	if (e != nil) || (p.CurrentException() != 0) {
+		t.Logf("Didn't return to thread mode: %v\n", e)
+		t.FailNow()
+	}
+	// BASEPRI masks IRQ 3, but not IRQ 4.
+	p.SetSpecialRegister(BASEPRI, 0x40)
+	p.SetInterruptPending(3, true)
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 0) {
+		t.Logf("BASEPRI didn't mask IRQ 3: %v\n", e)
+		t.Fail()
+	}
+	p.SetInterruptPending(4, true)
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 20) {
+		t.Logf("BASEPRI masked IRQ 4: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestSysTick(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := make([]uint16, 16)
+	for i := range program {
+		// nop
+		program[i] = 0xbf00
+	}
+	e = writeARMv7MProgram(p, program)
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	m.WriteMemoryWord(0xe000e014, 5)
+	m.WriteMemoryWord(0xe000e018, 0)
+	m.WriteMemoryWord(0xe000e010, 3)
+	// The first tick loads the reload value, and the timer fires after
+	// counting down from it.
+	e = runMultipleInstructions(6, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	if p.CurrentException() != 0 {
+		t.Logf("SysTick was taken too early.\n")
+		t.FailNow()
+	}
+	control, _ := m.ReadMemoryWord(0xe000e010)
+	if (control & 0x10000) == 0 {
+		t.Logf("COUNTFLAG wasn't set: 0x%08x\n", control)
+		t.Fail()
+	}
+	control, _ = m.ReadMemoryWord(0xe000e010)
+	if (control & 0x10000) != 0 {
+		t.Logf("COUNTFLAG wasn't cleared by reading it.\n")
+		t.Fail()
+	}
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 15) {
+		t.Logf("SysTick wasn't taken: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestARMv7MFaults(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	// An undefined instruction escalates to HardFault, since UsageFault is
+	// disabled.
+	m.WriteMemoryHalfword(0x100, 0xde00)
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 3) {
+		t.Logf("Didn't take HardFault: %v\n", e)
+		t.FailNow()
+	}
+	cfsr, _ := m.ReadMemoryWord(0xe000ed28)
+	hfsr, _ := m.ReadMemoryWord(0xe000ed2c)
+	sp, _ := p.GetRegister(13)
+	stackedPC, _ := m.ReadMemoryWord(sp + 24)
+	if (cfsr != 0x10000) || (hfsr != 0x40000000) || (stackedPC != 0x100) {
+		t.Logf("Incorrect HardFault state: CFSR 0x%08x, HFSR 0x%08x, "+
+			"stacked PC 0x%08x\n", cfsr, hfsr, stackedPC)
+		t.Fail()
+	}
+	// Clearing the UFSR a halfword at a time.
+	m.WriteMemoryHalfword(0xe000ed2a, 1)
+	cfsr, _ = m.ReadMemoryWord(0xe000ed28)
+	if cfsr != 0 {
+		t.Logf("CFSR wasn't cleared: 0x%08x\n", cfsr)
+		t.Fail()
+	}
+	// A fault in the HardFault handler locks up the processor.
+	p.SetRegister(15, 0x100)
+	e = p.RunNextInstruction()
+	if (e == nil) || !p.LockedUp() {
+		t.Logf("The processor didn't lock up.\n")
+		t.Fail()
+	}
+	if p.RunNextInstruction() == nil {
+		t.Logf("Didn't get an error running a locked up processor.\n")
+		t.Fail()
+	}
+	// Once it's enabled, UsageFault is taken instead.
+	e = p.Reset()
+	if e != nil {
+		t.FailNow()
+	}
+	m.WriteMemoryWord(0xe000ed24, 0x40000)
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 6) {
+		t.Logf("Didn't take UsageFault: %v\n", e)
+		t.Fail()
+	}
+	shcsr, _ := m.ReadMemoryWord(0xe000ed24)
+	if shcsr != 0x40008 {
+		t.Logf("Incorrect SHCSR: 0x%08x\n", shcsr)
+		t.Fail()
+	}
+}
+
+func TestARMv7MStackingFaults(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	// Failing to stack the registers for SysTick causes a BusFault, which
+	// escalates to HardFault since it's disabled.
+	p.SetRegister(13, 0x30000000)
+	m.WriteMemoryWord(0xe000ed04, 0x04000000)
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 3) || p.LockedUp() {
+		t.Logf("Didn't take HardFault after a stacking error: %v\n", e)
+		t.Fail()
+	}
+	cfsr, _ := m.ReadMemoryWord(0xe000ed28)
+	hfsr, _ := m.ReadMemoryWord(0xe000ed2c)
+	if (cfsr != 0x1000) || (hfsr != 0x40000000) {
+		t.Logf("Incorrect fault status: CFSR 0x%08x, HFSR 0x%08x\n", cfsr,
+			hfsr)
+		t.Fail()
+	}
+	// Once it's enabled, the BusFault is taken instead.
+	e = p.Reset()
+	if e != nil {
+		t.FailNow()
+	}
+	m.WriteMemoryWord(0xe000ed24, 0x20000)
+	p.SetRegister(13, 0x30000000)
+	m.WriteMemoryWord(0xe000ed04, 0x04000000)
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 5) || p.LockedUp() {
+		t.Logf("Didn't take BusFault after a stacking error: %v\n", e)
+		t.Fail()
+	}
+	// Stacking errors only lock up the processor if it's already running at
+	// a negative priority, as FAULTMASK causes here.
+	e = p.Reset()
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetSpecialRegister(FAULTMASK, 1)
+	p.SetRegister(13, 0x30000000)
+	m.WriteMemoryWord(0xe000ed04, 0x80000000)
+	e = p.RunNextInstruction()
+	if (e == nil) || !p.LockedUp() {
+		t.Logf("The processor didn't lock up after a stacking error.\n")
+		t.Fail()
+	}
+}
+
+func TestARMv7MSupervisorCall(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint16{
+		// svc 5
+		0xdf05,
+		// mrs r0, ipsr
+		0xf3ef, 0x8005,
+	}
+	e = writeARMv7MProgram(p, program)
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	// Handle SVCall using mrs r0, ipsr, followed by bx lr.
+	m.WriteMemoryWord(11*4, 0x103)
+	m.WriteMemoryHalfword(0x106, 0x4770)
+	e = runMultipleInstructions(2, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	r0, _ := p.GetRegister(0)
+	lr, _ := p.GetRegister(14)
+	if (r0 != 11) || (lr != 0xfffffff9) {
+		t.Logf("Incorrect SVCall state: r0 = %d, lr = 0x%08x\n", r0, lr)
+		t.FailNow()
+	}
+	e = runMultipleInstructions(3, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	r0, _ = p.GetRegister(0)
+	if (p.CurrentException() != 0) || (r0 != 0) {
+		t.Logf("Incorrect state after returning from SVCall: r0 = %d\n", r0)
+		t.Fail()
+	}
+}
+
+func TestARMv7MUnprivileged(t *testing.T) {
+	p, e := setupTestARMv7MProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint16{
+		// msr basepri, r0
+		0xf380, 0x8811,
+		// mrs r1, msp
+		0xf3ef, 0x8108,
+		// ldr r2, [r3]
+		0x681a,
+	}
+	e = writeARMv7MProgram(p, program)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetMode(userMode)
+	p.SetRegister(0, 0x40)
+	p.SetRegister(1, 1)
+	p.SetRegister(3, 0xe000ed00)
+	e = runMultipleInstructions(2, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	basepri, _ := p.GetSpecialRegister(BASEPRI)
+	r1, _ := p.GetRegister(1)
+	if (basepri != 0) || (r1 != 0) {
+		t.Logf("Unprivileged code accessed special registers.\n")
+		t.Fail()
+	}
+	// Unprivileged accesses to the System Control Space cause a BusFault,
+	// which escalates to HardFault. HardFault runs in privileged mode.
+	e = p.RunNextInstruction()
+	if (e != nil) || (p.CurrentException() != 3) ||
+		(p.GetMode() != systemMode) {
+		t.Logf("Didn't take HardFault: %v\n", e)
+		t.Fail()
+	}
+}
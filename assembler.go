@@ -0,0 +1,1004 @@
+package arm_emulate
+
+// This file contains a two-pass assembler for ARM and THUMB code. It accepts
+// the syntax printed by the instructions' String() methods, along with the
+// common GNU as forms of the same instructions.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returned when assembly fails. Line and Column are 1-based, and refer to the
+// start of the part of the line which caused the error.
+type AssemblerError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *AssemblerError) Error() string {
+	return fmt.Sprintf("Line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// Settings used when assembling a program.
+type AssemblerOptions struct {
+	// The address of the first byte of the program.
+	BaseAddress uint32
+	// If set, instructions and data are emitted in big-endian byte order, as
+	// expected by an ARMMemory after SetBigEndian(true).
+	BigEndian bool
+	// If set, the program starts in THUMB state rather than ARM state.
+	THUMB bool
+}
+
+// The output of Assemble.
+type AssembledProgram struct {
+	BaseAddress uint32
+	Data        []byte
+	// The address of each label in the program. Unlike ELF symbols, labels in
+	// THUMB code don't have bit 0 set.
+	Labels map[string]uint32
+	// Set if the program starts in THUMB state.
+	THUMB bool
+}
+
+// Returns a firmware image containing the program, with an entry point at
+// its base address. Bit 0 of the entry point is set if the program starts in
+// THUMB state.
+func (p *AssembledProgram) Image() *FirmwareImage {
+	var toReturn FirmwareImage
+	toReturn.addData(p.BaseAddress, p.Data)
+	toReturn.HasEntryPoint = true
+	toReturn.EntryPoint = p.BaseAddress
+	if p.THUMB {
+		toReturn.EntryPoint |= 1
+	}
+	return &toReturn
+}
+
+// A piece of a source line, along with its position for error messages.
+type assemblerToken struct {
+	text   string
+	line   int
+	column int
+}
+
+func (t assemblerToken) errorf(format string, args ...interface{}) error {
+	return &AssemblerError{
+		Line:    t.line,
+		Column:  t.column,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Returns the part of the token between the given byte offsets, with
+// surrounding whitespace removed.
+func (t assemblerToken) slice(start, end int) assemblerToken {
+	text := t.text[start:end]
+	trimmed := strings.TrimLeft(text, " \t")
+	column := t.column + start + len(text) - len(trimmed)
+	return assemblerToken{strings.TrimRight(trimmed, " \t"), t.line, column}
+}
+
+func (t assemblerToken) lower() string {
+	return strings.ToLower(t.text)
+}
+
+// Splits the token at every comma which isn't inside brackets, braces,
+// parentheses or quotes.
+func (t assemblerToken) split() []assemblerToken {
+	var toReturn []assemblerToken
+	depth := 0
+	start := 0
+	var quote byte
+	for i := 0; i < len(t.text); i++ {
+		c := t.text[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			quote = c
+		case '[', '{', '(':
+			depth++
+		case ']', '}', ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				toReturn = append(toReturn, t.slice(start, i))
+				start = i + 1
+			}
+		}
+	}
+	last := t.slice(start, len(t.text))
+	if (last.text != "") || (len(toReturn) != 0) {
+		toReturn = append(toReturn, last)
+	}
+	return toReturn
+}
+
+// Splits an instruction's operands, rejecting empty ones such as those left by
+// a trailing comma.
+func (t assemblerToken) splitOperands() ([]assemblerToken, error) {
+	toReturn := t.split()
+	for _, operand := range toReturn {
+		if operand.text == "" {
+			return nil, operand.errorf("Expected an operand")
+		}
+	}
+	return toReturn, nil
+}
+
+// A value in a literal pool, loaded by ldr rX, =value.
+type assemblerLiteral struct {
+	value   assemblerToken
+	item    *assemblerItem
+	address uint32
+	placed  bool
+}
+
+// A single instruction, directive or piece of data occupying a fixed amount of
+// space in the program.
+type assemblerItem struct {
+	token   assemblerToken
+	address uint32
+	size    uint32
+	thumb   bool
+	// The position of the item in the program, used when resolving local
+	// labels such as "1b".
+	index int
+	// Produces the item's bytes during the second pass.
+	encode func() ([]byte, error)
+}
+
+// A symbol defined by a label or .equ directive.
+type assemblerSymbol struct {
+	token assemblerToken
+	value uint32
+	// Set for symbols defined by .equ or .set, which are evaluated when
+	// they're used.
+	expression *assemblerToken
+	item       *assemblerItem
+	evaluating bool
+}
+
+// A numeric local label, such as "1:".
+type assemblerLocalLabel struct {
+	index   int
+	address uint32
+}
+
+type assembler struct {
+	options     AssemblerOptions
+	address     uint32
+	thumb       bool
+	symbols     map[string]*assemblerSymbol
+	localLabels map[string][]assemblerLocalLabel
+	items       []*assemblerItem
+	// Literals which haven't been placed in a pool yet.
+	pendingLiterals []*assemblerLiteral
+	// The conditions of the THUMB instructions left in the current IT block.
+	itConditions []uint32
+	// Set during the second pass, when every symbol must be defined.
+	finalPass bool
+}
+
+// Returned by the expression evaluator when a symbol isn't defined yet during
+// the first pass.
+type assemblerUndefinedSymbolError struct {
+	name string
+}
+
+func (e *assemblerUndefinedSymbolError) Error() string {
+	return fmt.Sprintf("Undefined symbol %q", e.name)
+}
+
+func (a *assembler) write32(b []byte, value uint32) {
+	if a.options.BigEndian {
+		binary.BigEndian.PutUint32(b, value)
+		return
+	}
+	binary.LittleEndian.PutUint32(b, value)
+}
+
+func (a *assembler) write16(b []byte, value uint16) {
+	if a.options.BigEndian {
+		binary.BigEndian.PutUint16(b, value)
+		return
+	}
+	binary.LittleEndian.PutUint16(b, value)
+}
+
+func (a *assembler) wordBytes(value uint32) []byte {
+	toReturn := make([]byte, 4)
+	a.write32(toReturn, value)
+	return toReturn
+}
+
+func (a *assembler) halfwordBytes(value uint16) []byte {
+	toReturn := make([]byte, 2)
+	a.write16(toReturn, value)
+	return toReturn
+}
+
+// The largest program the assembler will produce, which prevents directives
+// such as .space from allocating huge amounts of memory by mistake.
+const maxAssembledProgramSize = 0x4000000
+
+// Adds an item of the given size at the current address.
+func (a *assembler) addItem(t assemblerToken, size uint32,
+	encode func() ([]byte, error)) (*assemblerItem, error) {
+	if (uint64(a.address) + uint64(size)) > 0x100000000 {
+		return nil, t.errorf("The program doesn't fit in memory")
+	}
+	if (uint64(a.address-a.options.BaseAddress) + uint64(size)) >
+		maxAssembledProgramSize {
+		return nil, t.errorf("The program is larger than %d bytes",
+			maxAssembledProgramSize)
+	}
+	item := &assemblerItem{
+		token:   t,
+		address: a.address,
+		size:    size,
+		thumb:   a.thumb,
+		index:   len(a.items),
+		encode:  encode,
+	}
+	a.items = append(a.items, item)
+	a.address += size
+	return item, nil
+}
+
+// Adds an item containing the given number of zero bytes.
+func (a *assembler) addPadding(t assemblerToken, size uint32,
+	fill byte) error {
+	if size == 0 {
+		return nil
+	}
+	_, e := a.addItem(t, size, func() ([]byte, error) {
+		toReturn := make([]byte, size)
+		for i := range toReturn {
+			toReturn[i] = fill
+		}
+		return toReturn, nil
+	})
+	return e
+}
+
+func isIdentifierCharacter(c byte, first bool) bool {
+	if ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) ||
+		(c == '_') || (c == '.') || (c == '$') {
+		return true
+	}
+	return !first && (c >= '0') && (c <= '9')
+}
+
+func isLocalLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if (name[i] < '0') || (name[i] > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *assembler) defineLabel(t assemblerToken) error {
+	if isLocalLabelName(t.text) {
+		a.localLabels[t.text] = append(a.localLabels[t.text],
+			assemblerLocalLabel{len(a.items), a.address})
+		return nil
+	}
+	if existing := a.symbols[t.text]; existing != nil {
+		return t.errorf("%q was already defined on line %d", t.text,
+			existing.token.line)
+	}
+	a.symbols[t.text] = &assemblerSymbol{token: t, value: a.address}
+	return nil
+}
+
+// Removes a comment from the line, if it has one. Comments start with @ or
+// //, outside of quotes.
+func stripAssemblerComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' {
+			quote = c
+			continue
+		}
+		if (c == '@') || strings.HasPrefix(line[i:], "//") {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Splits a line into statements separated by semicolons.
+func splitAssemblerStatements(t assemblerToken) []assemblerToken {
+	var toReturn []assemblerToken
+	var quote byte
+	start := 0
+	for i := 0; i < len(t.text); i++ {
+		c := t.text[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' {
+			quote = c
+		} else if c == ';' {
+			toReturn = append(toReturn, t.slice(start, i))
+			start = i + 1
+		}
+	}
+	return append(toReturn, t.slice(start, len(t.text)))
+}
+
+// Processes a single statement during the first pass.
+func (a *assembler) processStatement(t assemblerToken) error {
+	// Handle any labels at the start of the statement.
+	for {
+		end := 0
+		for (end < len(t.text)) && isIdentifierCharacter(t.text[end],
+			false) {
+			end++
+		}
+		if (end == 0) || (end >= len(t.text)) || (t.text[end] != ':') {
+			break
+		}
+		e := a.defineLabel(t.slice(0, end))
+		if e != nil {
+			return e
+		}
+		t = t.slice(end+1, len(t.text))
+	}
+	if t.text == "" {
+		return nil
+	}
+	end := strings.IndexAny(t.text, " \t")
+	if end < 0 {
+		end = len(t.text)
+	}
+	mnemonic := t.slice(0, end)
+	operands := t.slice(end, len(t.text))
+	if strings.HasPrefix(mnemonic.text, ".") {
+		return a.processDirective(mnemonic, operands)
+	}
+	// name = value is equivalent to .set name, value
+	if strings.HasPrefix(operands.text, "=") {
+		value := operands.slice(1, len(operands.text))
+		return a.defineSymbol(mnemonic, value)
+	}
+	return a.addInstruction(mnemonic, operands)
+}
+
+func (a *assembler) addInstruction(mnemonic,
+	operands assemblerToken) error {
+	alignment := uint32(4)
+	if a.thumb {
+		alignment = 2
+	}
+	if (a.address % alignment) != 0 {
+		return mnemonic.errorf("Instruction at 0x%08x isn't aligned; use "+
+			".align", a.address)
+	}
+	if a.thumb {
+		return a.addTHUMBInstruction(mnemonic, operands)
+	}
+	return a.addARMInstruction(mnemonic, operands)
+}
+
+// Evaluates an expression which must be constant during the first pass.
+func (a *assembler) evaluateConstant(t assemblerToken) (uint32, error) {
+	value, e := a.evaluate(t, len(a.items), a.address)
+	if e != nil {
+		if _, ok := e.(*assemblerUndefinedSymbolError); ok {
+			return 0, t.errorf("%q must be a constant or use symbols "+
+				"defined earlier", t.text)
+		}
+		return 0, e
+	}
+	return value, nil
+}
+
+func (a *assembler) defineSymbol(name, value assemblerToken) error {
+	if !isIdentifierCharacter(name.text[0], true) {
+		return name.errorf("Invalid symbol name %q", name.text)
+	}
+	for i := 1; i < len(name.text); i++ {
+		if !isIdentifierCharacter(name.text[i], false) {
+			return name.errorf("Invalid symbol name %q", name.text)
+		}
+	}
+	if existing := a.symbols[name.text]; existing != nil {
+		return name.errorf("%q was already defined on line %d", name.text,
+			existing.token.line)
+	}
+	if value.text == "" {
+		return name.errorf("Missing value for %q", name.text)
+	}
+	// The item is only used for its address and position, so it takes no
+	// space.
+	item := &assemblerItem{
+		token:   value,
+		address: a.address,
+		index:   len(a.items),
+		thumb:   a.thumb,
+	}
+	a.symbols[name.text] = &assemblerSymbol{
+		token:      name,
+		expression: &value,
+		item:       item,
+	}
+	return nil
+}
+
+// Returns the contents of a quoted string, interpreting escape sequences.
+func parseAssemblerString(t assemblerToken) ([]byte, error) {
+	if (len(t.text) < 2) || (t.text[0] != '"') ||
+		(t.text[len(t.text)-1] != '"') {
+		return nil, t.errorf("Expected a quoted string")
+	}
+	s, e := strconv.Unquote(t.text)
+	if e != nil {
+		return nil, t.errorf("Invalid string %s", t.text)
+	}
+	return []byte(s), nil
+}
+
+// Adds an item holding one value per operand, each of the given size in
+// bytes.
+func (a *assembler) addData(directive assemblerToken, values []assemblerToken,
+	size uint32) error {
+	if len(values) == 0 {
+		return directive.errorf("%s requires at least one value",
+			directive.text)
+	}
+	item, e := a.addItem(directive, size*uint32(len(values)), nil)
+	if e != nil {
+		return e
+	}
+	item.encode = func() ([]byte, error) {
+		toReturn := make([]byte, 0, item.size)
+		for i, t := range values {
+			address := item.address + uint32(i)*size
+			value, e := a.evaluate(t, item.index, address)
+			if e != nil {
+				return nil, e
+			}
+			switch size {
+			case 1:
+				if (int32(value) < -0x80) ||
+					((value > 0xff) && (int32(value) >= 0)) {
+					return nil, t.errorf("%d doesn't fit in a byte",
+						int32(value))
+				}
+				toReturn = append(toReturn, byte(value))
+			case 2:
+				if (int32(value) < -0x8000) ||
+					((value > 0xffff) && (int32(value) >= 0)) {
+					return nil, t.errorf("%d doesn't fit in a halfword",
+						int32(value))
+				}
+				toReturn = append(toReturn, a.halfwordBytes(uint16(value))...)
+			default:
+				toReturn = append(toReturn, a.wordBytes(value)...)
+			}
+		}
+		return toReturn, nil
+	}
+	return nil
+}
+
+// Pads the program to a multiple of the given alignment.
+func (a *assembler) align(t assemblerToken, alignment uint32) error {
+	if (alignment == 0) || ((alignment & (alignment - 1)) != 0) {
+		return t.errorf("The alignment must be a power of 2, got %d",
+			alignment)
+	}
+	padding := (alignment - (a.address % alignment)) % alignment
+	return a.addPadding(t, padding, 0)
+}
+
+func (a *assembler) processDirective(directive,
+	operands assemblerToken) error {
+	name := directive.lower()
+	values := operands.split()
+	switch name {
+	case ".arm", ".code32":
+		a.thumb = false
+		return nil
+	case ".thumb", ".code16":
+		a.thumb = true
+		return nil
+	case ".code":
+		if len(values) == 1 {
+			switch values[0].text {
+			case "16":
+				a.thumb = true
+				return nil
+			case "32":
+				a.thumb = false
+				return nil
+			}
+		}
+		return operands.errorf(".code must be followed by 16 or 32")
+	case ".word", ".long", ".4byte", ".int":
+		return a.addData(directive, values, 4)
+	case ".short", ".hword", ".half", ".2byte":
+		return a.addData(directive, values, 2)
+	case ".byte":
+		return a.addData(directive, values, 1)
+	case ".ascii", ".asciz", ".string":
+		if len(values) == 0 {
+			return directive.errorf("%s requires a string", directive.text)
+		}
+		var data []byte
+		for _, v := range values {
+			s, e := parseAssemblerString(v)
+			if e != nil {
+				return e
+			}
+			data = append(data, s...)
+			if name != ".ascii" {
+				data = append(data, 0)
+			}
+		}
+		_, e := a.addItem(directive, uint32(len(data)),
+			func() ([]byte, error) {
+				return data, nil
+			})
+		return e
+	case ".align", ".p2align", ".balign":
+		if len(values) == 0 {
+			if name == ".balign" {
+				return directive.errorf(".balign requires an alignment")
+			}
+			return a.align(directive, 4)
+		}
+		if len(values) > 1 {
+			return values[1].errorf("Fill values aren't supported")
+		}
+		value, e := a.evaluateConstant(values[0])
+		if e != nil {
+			return e
+		}
+		if name == ".balign" {
+			return a.align(values[0], value)
+		}
+		if value > 16 {
+			return values[0].errorf("Alignment 2^%d is too large", value)
+		}
+		return a.align(values[0], 1<<value)
+	case ".space", ".skip", ".zero":
+		if (len(values) == 0) || (len(values) > 2) {
+			return directive.errorf("%s requires a size and optional fill",
+				directive.text)
+		}
+		size, e := a.evaluateConstant(values[0])
+		if e != nil {
+			return e
+		}
+		fill := uint32(0)
+		if len(values) == 2 {
+			fill, e = a.evaluateConstant(values[1])
+			if e != nil {
+				return e
+			}
+		}
+		return a.addPadding(directive, size, byte(fill))
+	case ".org":
+		if len(values) != 1 {
+			return directive.errorf(".org requires an address")
+		}
+		value, e := a.evaluateConstant(values[0])
+		if e != nil {
+			return e
+		}
+		if value < a.address {
+			return values[0].errorf(".org can't move backwards from "+
+				"0x%08x to 0x%08x", a.address, value)
+		}
+		return a.addPadding(directive, value-a.address, 0)
+	case ".ltorg", ".pool":
+		return a.placeLiterals(directive)
+	case ".equ", ".set":
+		if len(values) != 2 {
+			return directive.errorf("%s requires a name and a value",
+				directive.text)
+		}
+		return a.defineSymbol(values[0], values[1])
+	case ".global", ".globl", ".type", ".size", ".text", ".data",
+		".section", ".syntax", ".cpu", ".arch", ".fpu", ".func", ".endfunc",
+		".thumb_func", ".file", ".ident", ".end":
+		// These directives don't affect the assembled bytes.
+		return nil
+	}
+	return directive.errorf("Unknown directive %s", directive.text)
+}
+
+// Adds a value to the pending literal pool, reusing an existing entry with
+// the same text.
+func (a *assembler) addLiteral(value assemblerToken) *assemblerLiteral {
+	for _, l := range a.pendingLiterals {
+		if l.value.text == value.text {
+			return l
+		}
+	}
+	toReturn := &assemblerLiteral{value: value}
+	a.pendingLiterals = append(a.pendingLiterals, toReturn)
+	return toReturn
+}
+
+// Places any pending literals at the current address, after aligning it to a
+// word boundary.
+func (a *assembler) placeLiterals(t assemblerToken) error {
+	if len(a.pendingLiterals) == 0 {
+		return nil
+	}
+	e := a.align(t, 4)
+	if e != nil {
+		return e
+	}
+	literals := a.pendingLiterals
+	a.pendingLiterals = nil
+	item, e := a.addItem(t, 4*uint32(len(literals)), nil)
+	if e != nil {
+		return e
+	}
+	for i, l := range literals {
+		l.address = item.address + uint32(i)*4
+		l.placed = true
+	}
+	item.encode = func() ([]byte, error) {
+		toReturn := make([]byte, 0, item.size)
+		for _, l := range literals {
+			value, e := a.evaluate(l.value, l.item.index, l.item.address)
+			if e != nil {
+				return nil, e
+			}
+			toReturn = append(toReturn, a.wordBytes(value)...)
+		}
+		return toReturn, nil
+	}
+	return nil
+}
+
+// Looks up a symbol's value. The index and address are those of the item
+// containing the expression.
+func (a *assembler) lookupSymbol(t assemblerToken, index int) (uint32,
+	error) {
+	name := t.text
+	if (len(name) > 1) && isLocalLabelName(name[:len(name)-1]) {
+		definitions := a.localLabels[name[:len(name)-1]]
+		switch name[len(name)-1] {
+		case 'b', 'B':
+			for i := len(definitions) - 1; i >= 0; i-- {
+				if definitions[i].index <= index {
+					return definitions[i].address, nil
+				}
+			}
+			return 0, t.errorf("No local label %s before this line",
+				name[:len(name)-1])
+		case 'f', 'F':
+			for _, d := range definitions {
+				if d.index > index {
+					return d.address, nil
+				}
+			}
+			if a.finalPass {
+				return 0, t.errorf("No local label %s after this line",
+					name[:len(name)-1])
+			}
+			return 0, &assemblerUndefinedSymbolError{name}
+		}
+	}
+	symbol := a.symbols[name]
+	if symbol == nil {
+		if a.finalPass {
+			return 0, t.errorf("Undefined symbol %q", name)
+		}
+		return 0, &assemblerUndefinedSymbolError{name}
+	}
+	if symbol.expression == nil {
+		return symbol.value, nil
+	}
+	if symbol.evaluating {
+		return 0, t.errorf("The definition of %q refers to itself", name)
+	}
+	symbol.evaluating = true
+	value, e := a.evaluate(*symbol.expression, symbol.item.index,
+		symbol.item.address)
+	symbol.evaluating = false
+	return value, e
+}
+
+// Parses and evaluates expressions for the assembler.
+type assemblerExpressionParser struct {
+	a       *assembler
+	t       assemblerToken
+	offset  int
+	index   int
+	address uint32
+	// Set if the expression refers to a symbol or the current address.
+	usesSymbols bool
+}
+
+func (p *assemblerExpressionParser) skipSpaces() {
+	for (p.offset < len(p.t.text)) && ((p.t.text[p.offset] == ' ') ||
+		(p.t.text[p.offset] == '\t')) {
+		p.offset++
+	}
+}
+
+// Returns a token for the rest of the expression, for error messages.
+func (p *assemblerExpressionParser) here() assemblerToken {
+	return p.t.slice(p.offset, len(p.t.text))
+}
+
+// Consumes the given operator, if it's next.
+func (p *assemblerExpressionParser) accept(operator string) bool {
+	p.skipSpaces()
+	if strings.HasPrefix(p.t.text[p.offset:], operator) {
+		p.offset += len(operator)
+		return true
+	}
+	return false
+}
+
+// The binary operators, from lowest to highest precedence.
+var assemblerBinaryOperators = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *assemblerExpressionParser) parseBinary(level int) (uint32, error) {
+	if level >= len(assemblerBinaryOperators) {
+		return p.parseUnary()
+	}
+	value, e := p.parseBinary(level + 1)
+	if e != nil {
+		return 0, e
+	}
+	for {
+		operator := ""
+		for _, o := range assemblerBinaryOperators[level] {
+			if p.accept(o) {
+				operator = o
+				break
+			}
+		}
+		if operator == "" {
+			return value, nil
+		}
+		position := p.here()
+		right, e := p.parseBinary(level + 1)
+		if e != nil {
+			return 0, e
+		}
+		switch operator {
+		case "|":
+			value |= right
+		case "^":
+			value ^= right
+		case "&":
+			value &= right
+		case "<<":
+			value <<= right
+		case ">>":
+			value >>= right
+		case "+":
+			value += right
+		case "-":
+			value -= right
+		case "*":
+			value *= right
+		case "/", "%":
+			if right == 0 {
+				return 0, position.errorf("Division by zero")
+			}
+			if operator == "/" {
+				value = uint32(int32(value) / int32(right))
+			} else {
+				value = uint32(int32(value) % int32(right))
+			}
+		}
+	}
+}
+
+func (p *assemblerExpressionParser) parseUnary() (uint32, error) {
+	if p.accept("-") {
+		value, e := p.parseUnary()
+		return -value, e
+	}
+	if p.accept("+") {
+		return p.parseUnary()
+	}
+	if p.accept("~") {
+		value, e := p.parseUnary()
+		return ^value, e
+	}
+	return p.parsePrimary()
+}
+
+func (p *assemblerExpressionParser) parsePrimary() (uint32, error) {
+	p.skipSpaces()
+	if p.offset >= len(p.t.text) {
+		return 0, p.t.errorf("Incomplete expression %q", p.t.text)
+	}
+	if p.accept("(") {
+		value, e := p.parseBinary(0)
+		if e != nil {
+			return 0, e
+		}
+		if !p.accept(")") {
+			return 0, p.here().errorf("Expected )")
+		}
+		return value, nil
+	}
+	text := p.t.text
+	start := p.offset
+	c := text[start]
+	// Character constants, such as 'a'
+	if c == '\'' {
+		end := strings.IndexByte(text[start+1:], '\'')
+		if end >= 0 {
+			s, e := strconv.Unquote(text[start : start+end+2])
+			if (e == nil) && (len(s) == 1) {
+				p.offset = start + end + 2
+				return uint32(s[0]), nil
+			}
+		}
+		return 0, p.here().errorf("Invalid character constant")
+	}
+	end := start
+	for (end < len(text)) && isIdentifierCharacter(text[end], false) {
+		end++
+	}
+	if end == start {
+		return 0, p.here().errorf("Unexpected %q in expression", c)
+	}
+	p.offset = end
+	word := p.t.slice(start, end)
+	if (c >= '0') && (c <= '9') {
+		if !isLocalLabelName(word.text[:len(word.text)-1]) ||
+			!strings.ContainsAny(word.text[len(word.text)-1:], "bfBF") {
+			value, e := strconv.ParseUint(word.text, 0, 32)
+			if e != nil {
+				return 0, word.errorf("Invalid number %q", word.text)
+			}
+			return uint32(value), nil
+		}
+	}
+	p.usesSymbols = true
+	if word.text == "." {
+		return p.address, nil
+	}
+	return p.a.lookupSymbol(word, p.index)
+}
+
+// Evaluates an expression. The index and address are those of the item which
+// contains the expression.
+func (a *assembler) evaluate(t assemblerToken, index int,
+	address uint32) (uint32, error) {
+	value, _, e := a.evaluateAddress(t, index, address)
+	return value, e
+}
+
+// Like evaluate, but also returns true if the expression refers to a symbol,
+// in which case it's treated as an address rather than an offset in branches.
+func (a *assembler) evaluateAddress(t assemblerToken, index int,
+	address uint32) (uint32, bool, error) {
+	if t.text == "" {
+		return 0, false, t.errorf("Missing expression")
+	}
+	p := assemblerExpressionParser{
+		a:       a,
+		t:       t,
+		index:   index,
+		address: address,
+	}
+	value, e := p.parseBinary(0)
+	if e != nil {
+		return 0, false, e
+	}
+	p.skipSpaces()
+	if p.offset != len(t.text) {
+		return 0, false, p.here().errorf("Unexpected %q in expression",
+			t.text[p.offset:])
+	}
+	return value, p.usesSymbols, nil
+}
+
+// Assembles the given ARM or THUMB source code. Branch targets and PC-relative
+// addresses which are plain numbers are read as offsets, in the same form the
+// disassembler prints them, while expressions using labels or "." are
+// absolute addresses.
+func Assemble(source string, options AssemblerOptions) (*AssembledProgram,
+	error) {
+	a := assembler{
+		options:     options,
+		address:     options.BaseAddress,
+		thumb:       options.THUMB,
+		symbols:     make(map[string]*assemblerSymbol),
+		localLabels: make(map[string][]assemblerLocalLabel),
+	}
+	lines := strings.Split(source, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(stripAssemblerComment(line), "\r")
+		t := assemblerToken{line, i + 1, 1}
+		for _, statement := range splitAssemblerStatements(t) {
+			e := a.processStatement(statement)
+			if e != nil {
+				return nil, e
+			}
+		}
+	}
+	end := assemblerToken{"", len(lines), 1}
+	e := a.placeLiterals(end)
+	if e != nil {
+		return nil, e
+	}
+
+	// The second pass produces the bytes for each item.
+	a.finalPass = true
+	data := make([]byte, 0, a.address-options.BaseAddress)
+	for _, item := range a.items {
+		b, e := item.encode()
+		if e != nil {
+			return nil, e
+		}
+		if uint32(len(b)) != item.size {
+			return nil, item.token.errorf("Internal error: expected %d "+
+				"bytes, got %d", item.size, len(b))
+		}
+		data = append(data, b...)
+	}
+	labels := make(map[string]uint32)
+	names := make([]string, 0, len(a.symbols))
+	for name := range a.symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, e := a.lookupSymbol(a.symbols[name].token, len(a.items))
+		if e != nil {
+			return nil, e
+		}
+		labels[name] = value
+	}
+	return &AssembledProgram{
+		BaseAddress: options.BaseAddress,
+		Data:        data,
+		Labels:      labels,
+		THUMB:       options.THUMB,
+	}, nil
+}
@@ -0,0 +1,651 @@
+package arm_emulate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Assembles a single instruction, failing the test on errors.
+func assembleTestInstruction(t *testing.T, source string, thumb bool) []byte {
+	p, e := Assemble(source, AssemblerOptions{THUMB: thumb})
+	if e != nil {
+		t.Logf("Failed assembling %q: %s\n", source, e)
+		t.Fail()
+		return nil
+	}
+	return p.Data
+}
+
+func TestAssembleARMInstructions(t *testing.T) {
+	// These encodings match the output of GNU as and llvm-mc.
+	expected := map[string]uint32{
+		"mov r0, #1":                 0xe3a00001,
+		"movs r1, r2, lsl #3":        0xe1b01182,
+		"mov r0, #0xff000000":        0xe3a004ff,
+		"mvn r0, #0":                 0xe3e00000,
+		"add r0, r1, r2":             0xe0810002,
+		"addeq r0, r1, r2, lsl r3":   0x00810312,
+		"sub sp, sp, #16":            0xe24dd010,
+		"cmp r0, #1":                 0xe3500001,
+		"cmn r0, #1":                 0xe3700001,
+		"tst r1, r2":                 0xe1110002,
+		"teq r1, #4":                 0xe3310004,
+		"and r0, r1, #0xff":          0xe20100ff,
+		"bic r0, r0, #3":             0xe3c00003,
+		"orr r0, r0, r1, ror #8":     0xe1800461,
+		"eor r0, r0, r1, asr #32":    0xe0200041,
+		"rsb r0, r1, #0":             0xe2610000,
+		"rsc r0, r1, r2":             0xe0e10002,
+		"adc r0, r1, r2":             0xe0a10002,
+		"sbc r0, r1, r2, rrx":        0xe0c10062,
+		"lsl r0, r1, #2":             0xe1a00101,
+		"lsr r0, r1, r2":             0xe1a00231,
+		"asr r0, r1, #1":             0xe1a000c1,
+		"ror r0, r1, #31":            0xe1a00fe1,
+		"rrx r0, r1":                 0xe1a00061,
+		"mrs r0, cpsr":               0xe10f0000,
+		"mrs r1, spsr":               0xe14f1000,
+		"msr cpsr_fc, r0":            0xe129f000,
+		"msr cpsr_f, #0xf0000000":    0xe328f20f,
+		"msr spsr_fsxc, r2":          0xe16ff002,
+		"mul r0, r1, r2":             0xe0000291,
+		"mla r0, r1, r2, r3":         0xe0203291,
+		"muls r0, r1, r2":            0xe0100291,
+		"umull r0, r1, r2, r3":       0xe0810392,
+		"umlal r0, r1, r2, r3":       0xe0a10392,
+		"smull r0, r1, r2, r3":       0xe0c10392,
+		"smlals r0, r1, r2, r3":      0xe0f10392,
+		"ldr r0, [r1]":               0xe5910000,
+		"ldr r0, [r1, #4]":           0xe5910004,
+		"ldr r0, [r1, #-4]!":         0xe5310004,
+		"ldr r0, [r1], #4":           0xe4910004,
+		"ldrb r0, [r1, r2]":          0xe7d10002,
+		"ldr r0, [r1, -r2, lsl #2]":  0xe7110102,
+		"str r0, [r1], -r2, asr #3":  0xe60101c2,
+		"strb r0, [r1, #4095]":       0xe5c10fff,
+		"ldrbt r0, [r1], #1":         0xe4f10001,
+		"strt r0, [r1]":              0xe4a10000,
+		"ldrh r0, [r1, #2]":          0xe1d100b2,
+		"strh r0, [r1], #-2":         0xe04100b2,
+		"ldrsb r0, [r1, r2]":         0xe19100d2,
+		"ldrsh r0, [r1, #-255]!":     0xe1710fff,
+		"ldrd r0, r1, [r2]":          0xe1c200d0,
+		"strd r2, r3, [r4, #8]":      0xe1c420f8,
+		"pld [r0, #4]":               0xf5d0f004,
+		"pld [r0, r1]":               0xf7d0f001,
+		"swp r0, r1, [r2]":           0xe1020091,
+		"swpb r0, r1, [r2]":          0xe1420091,
+		"ldrex r0, [r1]":             0xe1910f9f,
+		"strex r0, r1, [r2]":         0xe1820f91,
+		"ldmia r0!, {r1-r3}":         0xe8b0000e,
+		"ldmfd sp!, {r4-r11, pc}":    0xe8bd8ff0,
+		"stmfd sp!, {r4-r11, lr}":    0xe92d4ff0,
+		"stmdb r0, {r1}":             0xe9000002,
+		"ldmib r0, {r1, r2}":         0xe9900006,
+		"stmda r0!, {r1}":            0xe8200002,
+		"ldm r0, {r1}^":              0xe8d00002,
+		"push {r0, lr}":              0xe92d4001,
+		"pop {r0, pc}":               0xe8bd8001,
+		"bx lr":                      0xe12fff1e,
+		"blx r3":                     0xe12fff33,
+		"swi 0x123456":               0xef123456,
+		"svc #0":                     0xef000000,
+		"bkpt 0x1234":                0xe1212374,
+		"cdp p15, 1, c2, c3, c4, 5":  0xee132fa4,
+		"mcr p15, 0, r0, c1, c0, 0":  0xee010f10,
+		"mrc p15, 0, r0, c1, c0, 0":  0xee110f10,
+		"mcr2 p14, 1, r2, c3, c4, 5": 0xfe232eb4,
+		"mcrr p15, 0, r0, r1, c2":    0xec410f02,
+		"mrrc p15, 1, r0, r1, c2":    0xec510f12,
+		"ldc p14, c5, [r1, #4]":      0xed915e01,
+		"stcl p14, c5, [r1, #-8]!":   0xed615e02,
+		"ldc2 p14, c5, [r1], #16":    0xfcb15e04,
+		"stc p14, c5, [r1], {4}":     0xec815e04,
+		"clz r0, r1":                 0xe16f0f11,
+		"qadd r0, r1, r2":            0xe1020051,
+		"qdsub r0, r1, r2":           0xe1620051,
+		"smulbb r0, r1, r2":          0xe1600281,
+		"smultb r0, r1, r2":          0xe16002a1,
+		"smlabt r0, r1, r2, r3":      0xe10032c1,
+		"smlawt r0, r1, r2, r3":      0xe12032c1,
+		"smulwb r0, r1, r2":          0xe12002a1,
+		"smlalbb r0, r1, r2, r3":     0xe1410382,
+		"rev r0, r1":                 0xe6bf0f31,
+		"rev16 r0, r1":               0xe6bf0fb1,
+		"revsh r0, r1":               0xe6ff0fb1,
+		"sxtb r0, r1":                0xe6af0071,
+		"uxth r0, r1, ror #8":        0xe6ff0471,
+		"sxtab r0, r1, r2, ror #16":  0xe6a10872,
+		"uxtab16 r0, r1, r2":         0xe6c10072,
+		"sxtb16 r0, r1, ror #24":     0xe68f0c71,
+		"sadd16 r0, r1, r2":          0xe6110f12,
+		"uqsub8 r0, r1, r2":          0xe6610ff2,
+		"shasx r0, r1, r2":           0xe6310f32,
+		"usax r0, r1, r2":            0xe6510f52,
+		"sel r0, r1, r2":             0xe6810fb2,
+		"usad8 r0, r1, r2":           0xe780f211,
+		"usada8 r0, r1, r2, r3":      0xe7803211,
+		"ssat r0, #8, r1":            0xe6a70011,
+		"ssat r0, #32, r1, lsl #31":  0xe6bf0f91,
+		"usat r0, #31, r1, asr #2":   0xe6ff0151,
+		"ssat16 r0, #16, r1":         0xe6af0f31,
+		"usat16 r0, #15, r1":         0xe6ef0f31,
+		"pkhbt r0, r1, r2, lsl #8":   0xe6810412,
+		"pkhtb r0, r1, r2, asr #16":  0xe6810852,
+		"umaal r0, r1, r2, r3":       0xe0410392,
+		"smuad r0, r1, r2":           0xe700f211,
+		"smusdx r0, r1, r2":          0xe700f271,
+		"smlad r0, r1, r2, r3":       0xe7003211,
+		"smlsld r0, r1, r2, r3":      0xe7410352,
+		"smlaldx r0, r1, r2, r3":     0xe7410332,
+		"cpsie aif":                  0xf10801c0,
+		"cpsid i, #19":               0xf10e0093,
+		"cps #16":                    0xf1020010,
+		"setend be":                  0xf1010200,
+		"setend le":                  0xf1010000,
+		"srsdb sp!, #19":             0xf96d0513,
+		"srsia sp, #16":              0xf8cd0510,
+		"rfeia r0!":                  0xf8b00a00,
+		"rfedb r1":                   0xf9110a00,
+		"nop":                        0xe1a00000,
+		"movne r0, r1":               0x11a00001,
+		"ldrbne r0, [r1]":            0x15d10000,
+		"ldrneb r0, [r1]":            0x15d10000,
+		"addeqs r0, r1, r2":          0x00910002,
+		"ldmfd sp!, {r0}":            0xe8bd0001,
+		"stmfd sp!, {r0}":            0xe92d0001,
+		"swi 00123456":               0xef123456,
+		"msr cpsr_flags, r0":         0xe128f000,
+		"msr r0, cpsr":               0xe129f000,
+		"ldr r0, -8":                 0xe51f0010,
+		"mov r0, r1 lsl 2":           0xe1a00101,
+		"ldr r0, [r1, r2, lsl 2]":    0xe7910102,
+	}
+	for source, raw := range expected {
+		data := assembleTestInstruction(t, source, false)
+		if data == nil {
+			continue
+		}
+		value := binary.LittleEndian.Uint32(data)
+		if (len(data) != 4) || (value != raw) {
+			t.Logf("Expected %q to be 0x%08x, got % x\n", source, raw, data)
+			t.Fail()
+		}
+	}
+}
+
+func TestAssembleTHUMBInstructions(t *testing.T) {
+	expected := map[string]uint16{
+		"lsls r0, r1, #2":                   0x0088,
+		"lsrs r0, r1, #32":                  0x0808,
+		"asrs r2, r3, #1":                   0x105a,
+		"adds r0, r1, r2":                   0x1888,
+		"subs r0, r1, r2":                   0x1a88,
+		"adds r0, r1, #7":                   0x1dc8,
+		"subs r0, r1, #1":                   0x1e48,
+		"movs r0, #255":                     0x20ff,
+		"cmp r1, #4":                        0x2904,
+		"adds r2, #200":                     0x32c8,
+		"subs r3, #1":                       0x3b01,
+		"ands r0, r1":                       0x4008,
+		"eors r0, r1":                       0x4048,
+		"lsls r0, r1":                       0x4088,
+		"lsrs r0, r1":                       0x40c8,
+		"asrs r0, r1":                       0x4108,
+		"adcs r0, r1":                       0x4148,
+		"sbcs r0, r1":                       0x4188,
+		"rors r0, r1":                       0x41c8,
+		"tst r0, r1":                        0x4208,
+		"rsbs r0, r1, #0":                   0x4248,
+		"cmp r0, r1":                        0x4288,
+		"cmn r0, r1":                        0x42c8,
+		"orrs r0, r1":                       0x4308,
+		"muls r0, r1, r0":                   0x4348,
+		"bics r0, r1":                       0x4388,
+		"mvns r0, r1":                       0x43c8,
+		"add r0, r8":                        0x4440,
+		"add r8, r0":                        0x4480,
+		"cmp r8, r9":                        0x45c8,
+		"mov r0, r8":                        0x4640,
+		"mov r8, r0":                        0x4680,
+		"mov r0, r1":                        0x4608,
+		"movs r0, r1":                       0x0008,
+		"bx lr":                             0x4770,
+		"blx r2":                            0x4790,
+		"ldr r0, [pc, #8]":                  0x4802,
+		"str r0, [r1, r2]":                  0x5088,
+		"strb r0, [r1, r2]":                 0x5488,
+		"ldr r0, [r1, r2]":                  0x5888,
+		"ldrb r0, [r1, r2]":                 0x5c88,
+		"strh r0, [r1, r2]":                 0x5288,
+		"ldrsb r0, [r1, r2]":                0x5688,
+		"ldrh r0, [r1, r2]":                 0x5a88,
+		"ldrsh r0, [r1, r2]":                0x5e88,
+		"str r0, [r1, #124]":                0x67c8,
+		"ldr r0, [r1]":                      0x6808,
+		"strb r0, [r1, #31]":                0x77c8,
+		"ldrb r0, [r1, #1]":                 0x7848,
+		"strh r0, [r1, #62]":                0x87c8,
+		"ldrh r0, [r1, #2]":                 0x8848,
+		"str r0, [sp, #1020]":               0x90ff,
+		"ldr r0, [sp, #4]":                  0x9801,
+		"add r0, sp, #8":                    0xa802,
+		"add sp, #508":                      0xb07f,
+		"sub sp, #4":                        0xb081,
+		"push {r0-r7, lr}":                  0xb5ff,
+		"pop {r4, pc}":                      0xbd10,
+		"stmia r0!, {r1, r2}":               0xc006,
+		"ldmia r7!, {r0}":                   0xcf01,
+		"svc #255":                          0xdfff,
+		"bkpt #1":                           0xbe01,
+		"nop":                               0x46c0,
+		"add r0, pc, #1020":                 0xa0ff,
+		"ldsb r0, [r1, r2]":                 0x5688,
+		"add r0, r1":                        0x4408,
+		"svc 0x12":                          0xdf12,
+		"beq -4":                            0xd0fe,
+		"add sp, -8":                        0xb082,
+		"blx lr + 8 (long branch and link)": 0xe804,
+		"sxth r0, r1":                       0xb208,
+		"uxtb r7, r6":                       0xb2f7,
+		"rev16 r0, r1":                      0xba48,
+		"revsh r2, r3":                      0xbada,
+		"setend be":                         0xb658,
+		"cpsid if":                          0xb673,
+		"it eq":                             0xbf08,
+		"ite ne":                            0xbf14,
+		"cbz r0, 0":                         0xb100,
+		"cbnz r1, 2":                        0xb909,
+		"push {}":                           0xb400,
+		"stmia r0!, {}":                     0xc000,
+		"adds.n r0, r1, #7":                 0x1dc8,
+	}
+	for source, raw := range expected {
+		data := assembleTestInstruction(t, source, true)
+		if data == nil {
+			continue
+		}
+		value := binary.LittleEndian.Uint16(data)
+		if (len(data) != 2) || (value != raw) {
+			t.Logf("Expected %q to be 0x%04x, got % x\n", source, raw, data)
+			t.Fail()
+		}
+	}
+}
+
+func TestAssembleTHUMB2Instructions(t *testing.T) {
+	// The first halfword is in the top 16 bits.
+	expected := map[string]uint32{
+		"add.w r0, r1, r2":         0xeb010002,
+		"adds.w r0, r1, #1":        0xf1110001,
+		"add r0, r1, r2, lsl #3":   0xeb0100c2,
+		"add r8, r9, #0x10001":     0xf1091801,
+		"sub r0, r1, #4095":        0xf6a170ff,
+		"orn r0, r1, r2":           0xea610002,
+		"mov.w r0, r1":             0xea4f0001,
+		"movw r0, #0x1234":         0xf2412034,
+		"movt r0, #0x5678":         0xf2c56078,
+		"bfc r0, #4, #8":           0xf36f100b,
+		"udiv r0, r1, r2":          0xfbb1f0f2,
+		"sdiv r0, r1, r2":          0xfb91f0f2,
+		"ldr.w r0, [r1, #4]":       0xf8d10004,
+		"ldr r8, [r1, #4]":         0xf8d18004,
+		"ldrh r5, [r8, #2126]":     0xf8b8584e,
+		"ldrd r3, r8, [r5, #220]!": 0xe9f53837,
+		"strd r0, r1, [r2, #8]":    0xe9c20102,
+		"ldmdb r0, {r1, r2}":       0xe9100006,
+		"ldmia r0, {r0, r1}":       0xe8900003,
+		"tbb [r1, r0]":             0xe8d1f000,
+		"tbh [r1, r0, lsl #1]":     0xe8d1f010,
+		"dmb sy":                   0xf3bf8f5f,
+		"bl -4":                    0xf7fffffe,
+		"sxtah r0, r1, r2, ror #8": 0xfa01f092,
+		"mls r0, r1, r2, r3":       0xfb013012,
+		"ldrex r0, [r1, #4]":       0xe8510f01,
+		"strex r0, r1, [r2]":       0xe8421000,
+		"mrs r0, apsr":             0xf3ef8000,
+		"msr apsr_nzcvq, r0":       0xf3808800,
+		"pld [r1, #8]":             0xf891f008,
+		"lsl.w r0, r1, #2":         0xea4f0081,
+		"beq.w -4":                 0xf43faffe,
+	}
+	for source, raw := range expected {
+		data := assembleTestInstruction(t, source, true)
+		if data == nil {
+			continue
+		}
+		value := (uint32(binary.LittleEndian.Uint16(data)) << 16) |
+			uint32(binary.LittleEndian.Uint16(data[2:]))
+		if (len(data) != 4) || (value != raw) {
+			t.Logf("Expected %q to be 0x%08x, got % x\n", source, raw, data)
+			t.Fail()
+		}
+	}
+	// Instructions in IT blocks take the block's conditions, and 16-bit
+	// instructions in them don't set the flags.
+	source := `
+	ite eq
+	addeq r0, r1, r2
+	subne r0, r1, r2
+	itt cs
+	bicscs r0, r1
+	bcs 0
+	add r0, r1, r2`
+	expectedData := []byte{0x0c, 0xbf, 0x88, 0x18, 0x88, 0x1a, 0x24, 0xbf,
+		0x30, 0xea, 0x01, 0x00, 0x00, 0xe0, 0x88, 0x18}
+	data := assembleTestInstruction(t, source, true)
+	if !bytes.Equal(data, expectedData) {
+		t.Logf("Expected IT blocks to be % x, got % x\n", expectedData, data)
+		t.Fail()
+	}
+}
+
+// Makes sure the assembler accepts the syntax printed by the disassembler.
+func TestAssembleDisassembly(t *testing.T) {
+	rng := rand.New(rand.NewSource(1337))
+	for i := 0; i < 50000; i++ {
+		raw := rng.Uint32()
+		n, e := ParseInstruction(raw)
+		if e != nil {
+			continue
+		}
+		s := n.String()
+		data := assembleTestInstruction(t, s, false)
+		if data == nil {
+			t.FailNow()
+		}
+		n2, e := ParseInstruction(binary.LittleEndian.Uint32(data))
+		if (e != nil) || (n2.String() != s) {
+			t.Logf("Assembling %q (0x%08x) produced % x\n", s, raw, data)
+			t.FailNow()
+		}
+	}
+	for i := 0; i < 0x10000; i++ {
+		n, e := ParseTHUMBInstructionForArchitecture(uint16(i), ARMv7)
+		if e != nil {
+			continue
+		}
+		s := n.String()
+		// nop is assembled as mov r8, r8, which older processors support.
+		if s == "nop" {
+			continue
+		}
+		data := assembleTestInstruction(t, s, true)
+		if data == nil {
+			t.FailNow()
+		}
+		n2, e := ParseTHUMBInstructionForArchitecture(
+			binary.LittleEndian.Uint16(data), ARMv7)
+		if (e != nil) || (n2.String() != s) {
+			t.Logf("Assembling %q (0x%04x) produced % x\n", s, i, data)
+			t.FailNow()
+		}
+	}
+}
+
+// Runs the assembled THUMB instruction with the given registers and flags,
+// returning the registers and CPSR afterwards.
+func runTHUMBTestInstruction(data []byte, registers []uint32,
+	flags uint32) ([]uint32, error) {
+	p, e := setupTestTHUMB2Processor()
+	if e != nil {
+		return nil, e
+	}
+	halfwords := make([]uint16, len(data)/2)
+	for i := range halfwords {
+		halfwords[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	e = writeTHUMBInstructionsToMemory(halfwords, p)
+	if e != nil {
+		return nil, e
+	}
+	for i, value := range registers {
+		p.SetRegister(ARMRegister(i), value)
+	}
+	p.SetRegister(15, 4096)
+	cpsr, _ := p.GetCPSR()
+	p.SetCPSR((cpsr & 0x0fffffff) | flags)
+	e = p.RunNextInstruction()
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]uint32, 17)
+	for i := range toReturn[:16] {
+		toReturn[i], _ = p.GetRegister(ARMRegister(i))
+	}
+	toReturn[16], _ = p.GetCPSR()
+	return toReturn, nil
+}
+
+// Makes sure the assembler accepts the syntax printed for Thumb-2
+// instructions. Some strings assemble to 16-bit instructions, which must have
+// the same effect.
+func TestAssembleTHUMB2Disassembly(t *testing.T) {
+	rng := rand.New(rand.NewSource(1337))
+	for i := 0; i < 200000; i++ {
+		raw := rng.Uint32() | 0xe0000000
+		n, e := ParseTHUMB2Instruction(raw)
+		if e != nil {
+			continue
+		}
+		s := n.String()
+		data := assembleTestInstruction(t, s, true)
+		if data == nil {
+			t.FailNow()
+		}
+		var s2 string
+		if len(data) == 4 {
+			n2, e := ParseTHUMB2Instruction(
+				(uint32(binary.LittleEndian.Uint16(data)) << 16) |
+					uint32(binary.LittleEndian.Uint16(data[2:])))
+			if e == nil {
+				s2 = n2.String()
+			}
+		} else {
+			n2, e := ParseTHUMBInstructionForArchitecture(
+				binary.LittleEndian.Uint16(data), ARMv7)
+			if e == nil {
+				s2 = n2.String()
+			}
+		}
+		if s2 == s {
+			continue
+		}
+		if len(data) == 4 {
+			t.Logf("Assembling %q (0x%08x) produced % x\n", s, raw, data)
+			t.FailNow()
+		}
+		// Compare the 16-bit instruction with the original, using registers
+		// which usually point at mapped memory.
+		registers := make([]uint32, 15)
+		for j := range registers {
+			registers[j] = 5120 + (rng.Uint32() & 0x7fc)
+		}
+		flags := rng.Uint32() & 0xf0000000
+		original := []byte{byte(raw >> 16), byte(raw >> 24), byte(raw),
+			byte(raw >> 8)}
+		expected, e1 := runTHUMBTestInstruction(original, registers, flags)
+		result, e2 := runTHUMBTestInstruction(data, registers, flags)
+		if (e1 != nil) != (e2 != nil) {
+			t.Logf("Assembling %q (0x%08x) as %q changed the error from "+
+				"%v to %v\n", s, raw, s2, e1, e2)
+			t.FailNow()
+		}
+		// The PC is expected to differ, since the 16-bit instruction is
+		// shorter.
+		for j := range expected {
+			if (j != 15) && (expected[j] != result[j]) {
+				t.Logf("Assembling %q (0x%08x) as %q changed the result\n",
+					s, raw, s2)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestAssembleProgram(t *testing.T) {
+	source := `
+	.arm
+start:
+	ldr r0, =0x12345678
+	ldr r1, =start
+	ldr r2, =0xffffffff  @ This becomes mvn r2, #0
+	bl func
+	blx thumb_func
+	b .
+func:
+	bx lr
+	.ltorg
+	.thumb
+thumb_func:
+	ldr r0, =0xcafe
+	bl 1f
+	b thumb_func
+1:	bx lr
+`
+	p, e := Assemble(source, AssemblerOptions{BaseAddress: 0x8000})
+	if e != nil {
+		t.Logf("Failed assembling the program: %s\n", e)
+		t.FailNow()
+	}
+	expectedWords := []uint32{0xe59f0014, 0xe59f1014, 0xe3e02000, 0xeb000001,
+		0xfa000003, 0xeafffffe, 0xe12fff1e, 0x12345678, 0x00008000}
+	// The literal pool at the end is word-aligned.
+	expectedHalfwords := []uint16{0x4802, 0xf000, 0xf801, 0xe7fb, 0x4770,
+		0x0000, 0xcafe, 0x0000}
+	if len(p.Data) != (4*len(expectedWords) + 2*len(expectedHalfwords)) {
+		t.Logf("Got %d bytes of data\n", len(p.Data))
+		t.FailNow()
+	}
+	for i, expected := range expectedWords {
+		value := binary.LittleEndian.Uint32(p.Data[i*4:])
+		if value != expected {
+			t.Logf("Expected word %d to be 0x%08x, got 0x%08x\n", i,
+				expected, value)
+			t.Fail()
+		}
+	}
+	thumbData := p.Data[4*len(expectedWords):]
+	for i, expected := range expectedHalfwords {
+		value := binary.LittleEndian.Uint16(thumbData[i*2:])
+		if value != expected {
+			t.Logf("Expected halfword %d to be 0x%04x, got 0x%04x\n", i,
+				expected, value)
+			t.Fail()
+		}
+	}
+	labels := map[string]uint32{"start": 0x8000, "func": 0x8018,
+		"thumb_func": 0x8024}
+	for name, address := range labels {
+		if p.Labels[name] != address {
+			t.Logf("Expected %s to be at 0x%08x, got 0x%08x\n", name,
+				address, p.Labels[name])
+			t.Fail()
+		}
+	}
+	image := p.Image()
+	if !image.HasEntryPoint || (image.EntryPoint != 0x8000) {
+		t.Logf("Got incorrect image entry point 0x%08x\n", image.EntryPoint)
+		t.Fail()
+	}
+}
+
+func TestAssembleDirectives(t *testing.T) {
+	source := `
+	.equ COUNT, 3
+	.set MASK, (1 << COUNT) - 1
+	.byte 1, 2, COUNT, 'A'
+	.hword 0x1234
+	.align
+	.ascii "ab"
+	.asciz "c\n"
+	.balign 8
+	.word end - ., MASK
+	.space 2, 0xff
+end:
+`
+	p, e := Assemble(source, AssemblerOptions{})
+	if e != nil {
+		t.Logf("Failed assembling directives: %s\n", e)
+		t.FailNow()
+	}
+	expected := []byte{1, 2, 3, 'A', 0x34, 0x12, 0, 0, 'a', 'b', 'c', '\n',
+		0, 0, 0, 0, 10, 0, 0, 0, 7, 0, 0, 0, 0xff, 0xff}
+	if !bytes.Equal(p.Data, expected) {
+		t.Logf("Expected % x, got % x\n", expected, p.Data)
+		t.Fail()
+	}
+}
+
+func TestAssembleBigEndian(t *testing.T) {
+	source := "mov r0, #1\n.word 0x11223344\n.short 0x5566\n.thumb\n" +
+		"movs r0, #1\n"
+	p, e := Assemble(source, AssemblerOptions{BigEndian: true})
+	if e != nil {
+		t.Logf("Failed assembling big-endian data: %s\n", e)
+		t.FailNow()
+	}
+	expected := []byte{0xe3, 0xa0, 0x00, 0x01, 0x11, 0x22, 0x33, 0x44, 0x55,
+		0x66, 0x20, 0x01}
+	if !bytes.Equal(p.Data, expected) {
+		t.Logf("Expected % x, got % x\n", expected, p.Data)
+		t.Fail()
+	}
+}
+
+func TestAssemblerErrors(t *testing.T) {
+	type errorLocation struct {
+		line   int
+		column int
+	}
+	expected := map[string]errorLocation{
+		"mov r0, #0x101":                         {1, 9},
+		"nop\n  add r0, r1, r16":                 {2, 15},
+		"ldr r0, [r1, #4096]":                    {1, 9},
+		"b missing":                              {1, 3},
+		"nop\nnop\n\tfoo r0":                     {3, 2},
+		"\tbx lr @ comment\n  .word 1 +":         {2, 9},
+		".thumb\nadds.n r0, r1, #8":              {2, 17},
+		".thumb\nlsls.n r8, r1, #2":              {2, 8},
+		"x: nop\nx: nop":                         {2, 1},
+		".byte 256":                              {1, 7},
+		".thumb\nnop\n.arm\nnop":                 {4, 1},
+		"ldr r0, =0x12345678\n.space 5000":       {1, 9},
+		"mul r0, r0, r0":                         {1, 1},
+		"  ldr r0, [r1, #4]\n  .unknown":         {2, 3},
+		".thumb\nb far\n.space 4096\nfar: bx lr": {2, 3},
+		"mov r0, r1,":                            {1, 12},
+		"add r0, r1, r2,":                        {1, 16},
+		"mov r0,, r1":                            {1, 8},
+		"bx lr, r0":                              {1, 8},
+		"ssat r0, #8, r1, lsl #2, r3":            {1, 26},
+		".thumb\nmov r0, r1,":                    {2, 12},
+		".thumb\nmov r0, r1, r2":                 {2, 13},
+		".thumb\nadd r0, r1, r2, r3":             {2, 17},
+		".thumb\nlsls r0, r1, #2, r3":            {2, 18},
+		".thumb\nmuls r0, r1, r0, r2":            {2, 18},
+	}
+	for source, location := range expected {
+		_, e := Assemble(source, AssemblerOptions{})
+		if e == nil {
+			t.Logf("Didn't get an error assembling %q\n", source)
+			t.Fail()
+			continue
+		}
+		var assemblerError *AssemblerError
+		if !errors.As(e, &assemblerError) {
+			t.Logf("Got a %T error assembling %q: %s\n", e, source, e)
+			t.Fail()
+			continue
+		}
+		if (assemblerError.Line != location.line) ||
+			(assemblerError.Column != location.column) {
+			t.Logf("Expected an error at %d:%d assembling %q, got %s\n",
+				location.line, location.column, source, e)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// The armdis command disassembles the ARM and THUMB code in an ELF file or raw
+// binary, printing a listing in the same format as GNU objdump -d.
+//
+// Usage:
+//
+//	armdis [-mode arm|thumb|auto] [-arch armv4t|armv5te|armv6|armv7]
+//		[-start address] [-base address] [-endian little|big] <file>
+//
+// In auto mode, the $a, $t and $d mapping symbols in ELF files select between
+// ARM code, THUMB code and data, which is printed using .word. Code before the
+// first mapping symbol is disassembled as THUMB if it's in a THUMB function,
+// and raw binaries are disassembled as ARM. The -base and -endian options only
+// apply to raw binaries, which are loaded at the base address. Instructions
+// which the selected architecture doesn't have, or which can't be decoded, are
+// printed as data.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yalue/arm_emulate"
+)
+
+// The kinds of contents which mapping symbols can mark.
+type contentType uint8
+
+const (
+	armCode contentType = iota
+	thumbCode
+	data
+)
+
+// Returns the type marked by a mapping symbol.
+func mappingSymbolType(s *arm_emulate.ELFSymbol) contentType {
+	switch s.Name[1] {
+	case 'a':
+		return armCode
+	case 't':
+		return thumbCode
+	}
+	return data
+}
+
+// Holds the contents of a single section to be disassembled.
+type section struct {
+	name    string
+	address uint32
+	data    []byte
+	// The symbols defined in this section, sorted by address.
+	symbols *arm_emulate.ELFSymbolTable
+	// Used to print branch targets, which may be in other sections.
+	resolver arm_emulate.SymbolResolver
+}
+
+// Holds the options which apply to every section.
+type options struct {
+	// One of "arm", "thumb" or "auto".
+	mode string
+	// Instructions before this address aren't printed.
+	start        uint32
+	byteOrder    binary.ByteOrder
+	architecture arm_emulate.ARMArchitecture
+}
+
+// The architectures which may be selected using -arch.
+var architectures = []arm_emulate.ARMArchitecture{arm_emulate.ARMv4T,
+	arm_emulate.ARMv5TE, arm_emulate.ARMv6, arm_emulate.ARMv7}
+
+// Returns the architecture with the given name, ignoring case.
+func parseArchitecture(name string) (arm_emulate.ARMArchitecture, error) {
+	for _, a := range architectures {
+		if strings.EqualFold(name, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid architecture: %s", name)
+}
+
+// Returns the type of code at the given address when no mapping symbol
+// precedes it.
+func (s *section) defaultType(address uint32, o *options) contentType {
+	switch o.mode {
+	case "arm":
+		return armCode
+	case "thumb":
+		return thumbCode
+	}
+	symbol, found := s.symbols.ContainingSymbol(address)
+	if found && symbol.IsFunction && symbol.IsTHUMB {
+		return thumbCode
+	}
+	return armCode
+}
+
+// Returns the number of bytes to print in a single line of data, and the
+// directive used to print them. The data is split at the next symbol.
+func dataSize(offset, limit int) (int, string) {
+	switch {
+	case limit-offset >= 4:
+		return 4, ".word"
+	case limit-offset >= 2:
+		return 2, ".short"
+	}
+	return 1, ".byte"
+}
+
+// Writes the disassembly of the section.
+func (s *section) disassemble(w io.Writer, o *options) {
+	d := arm_emulate.Disassembler{Symbols: s.resolver,
+		Syntax: arm_emulate.UALSyntax}
+	symbols := s.symbols.Symbols
+	next := 0
+	mapped := false
+	// Set after printing the first line, which is always labeled.
+	started := false
+	var current contentType
+	offset := 0
+	for offset < len(s.data) {
+		address := s.address + uint32(offset)
+		label := ""
+		for (next < len(symbols)) && (symbols[next].Address <= address) {
+			symbol := &(symbols[next])
+			next++
+			if symbol.IsMappingSymbol() {
+				mapped = true
+				current = mappingSymbolType(symbol)
+				continue
+			}
+			if (symbol.Address == address) && (symbol.Name != "") &&
+				(label == "") {
+				label = symbol.Name
+			}
+		}
+		limit := len(s.data)
+		if (next < len(symbols)) &&
+			((symbols[next].Address - s.address) < uint32(limit)) {
+			limit = int(symbols[next].Address - s.address)
+		}
+		contents := current
+		if !mapped {
+			contents = s.defaultType(address, o)
+		}
+		if (contents != data) && (o.mode != "auto") {
+			contents = s.defaultType(address, o)
+		}
+		var size int
+		var raw, text string
+		switch contents {
+		case armCode:
+			size, raw, text = s.armLine(&d, offset, o)
+		case thumbCode:
+			size, raw, text = s.thumbLine(&d, offset, o)
+		default:
+			size, raw, text = s.dataLine(offset, limit, o)
+		}
+		offset += size
+		if address < o.start {
+			continue
+		}
+		if (label == "") && !started {
+			label = s.name
+			name, symbolOffset, found := s.symbols.ResolveSymbol(address)
+			if found {
+				label = fmt.Sprintf("%s+0x%x", name, symbolOffset)
+			}
+		}
+		started = true
+		if label != "" {
+			fmt.Fprintf(w, "\n%08x <%s>:\n", address, label)
+		}
+		fmt.Fprintf(w, "%8x:\t%s\t%s\n", address, raw, text)
+	}
+}
+
+// Formats a single line of data at the offset, returning its size in bytes,
+// the raw bytes and the directive.
+func (s *section) dataLine(offset, limit int, o *options) (int, string,
+	string) {
+	size, directive := dataSize(offset, limit)
+	var value uint32
+	var raw string
+	switch size {
+	case 4:
+		value = o.byteOrder.Uint32(s.data[offset:])
+		raw = fmt.Sprintf("%08x ", value)
+	case 2:
+		value = uint32(o.byteOrder.Uint16(s.data[offset:]))
+		raw = fmt.Sprintf("%04x     ", value)
+	default:
+		value = uint32(s.data[offset])
+		raw = fmt.Sprintf("%02x       ", value)
+	}
+	return size, raw, fmt.Sprintf("%s\t0x%0*x", directive, size*2, value)
+}
+
+// Formats the ARM instruction at the offset. Incomplete or undefined
+// instructions are printed as data.
+func (s *section) armLine(d *arm_emulate.Disassembler, offset int,
+	o *options) (int, string, string) {
+	if (len(s.data) - offset) < 4 {
+		return s.dataLine(offset, len(s.data), o)
+	}
+	raw := o.byteOrder.Uint32(s.data[offset:])
+	instruction, e := arm_emulate.ParseInstructionForArchitecture(raw,
+		o.architecture)
+	if e != nil {
+		return s.dataLine(offset, len(s.data), o)
+	}
+	address := s.address + uint32(offset)
+	return 4, fmt.Sprintf("%08x ", raw), d.ARMString(instruction, address)
+}
+
+// Formats the THUMB or Thumb-2 instruction at the offset. Incomplete or
+// undefined instructions are printed as data.
+func (s *section) thumbLine(d *arm_emulate.Disassembler, offset int,
+	o *options) (int, string, string) {
+	if (len(s.data) - offset) < 2 {
+		return s.dataLine(offset, len(s.data), o)
+	}
+	address := s.address + uint32(offset)
+	high := o.byteOrder.Uint16(s.data[offset:])
+	// Before ARMv7, the halves of bl and blx are separate instructions.
+	if (o.architecture < arm_emulate.ARMv7) ||
+		!arm_emulate.IsTHUMB2Prefix(high) {
+		instruction, e := arm_emulate.ParseTHUMBInstructionForArchitecture(
+			high, o.architecture)
+		if e != nil {
+			return s.dataLine(offset, offset+2, o)
+		}
+		return 2, fmt.Sprintf("%04x      ", high), d.THUMBString(instruction,
+			address)
+	}
+	if (len(s.data) - offset) < 4 {
+		return s.dataLine(offset, offset+2, o)
+	}
+	low := o.byteOrder.Uint16(s.data[offset+2:])
+	instruction, e := arm_emulate.ParseTHUMB2Instruction((uint32(high) << 16) |
+		uint32(low))
+	if e != nil {
+		return s.dataLine(offset, offset+4, o)
+	}
+	return 4, fmt.Sprintf("%04x %04x ", high, low), d.THUMB2String(instruction,
+		address)
+}
+
+// Returns the executable sections in an ELF32 ARM file, along with the
+// byte order of the file.
+func readELFSections(r io.ReaderAt) ([]*section, binary.ByteOrder, error) {
+	code, e := arm_emulate.ReadELFCode(r)
+	if e != nil {
+		return nil, nil, e
+	}
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if code.BigEndian {
+		byteOrder = binary.BigEndian
+	}
+	toReturn := make([]*section, 0, len(code.Sections))
+	for _, s := range code.Sections {
+		toAdd := &section{
+			name:     s.Name,
+			address:  s.Address,
+			data:     s.Data,
+			symbols:  s.Symbols,
+			resolver: s.Symbols,
+		}
+		// Branch targets in relocatable files can only be resolved within
+		// the same section.
+		if code.Symbols != nil {
+			toAdd.resolver = code.Symbols
+		}
+		toReturn = append(toReturn, toAdd)
+	}
+	return toReturn, byteOrder, nil
+}
+
+// Parses an address given on the command line, in decimal or, with a 0x
+// prefix, hexadecimal.
+func parseAddress(s string) (uint32, error) {
+	value, e := strconv.ParseUint(s, 0, 32)
+	if e != nil {
+		return 0, fmt.Errorf("Invalid address %q: %s", s, e)
+	}
+	return uint32(value), nil
+}
+
+// Runs the command with the given arguments, not including the program name,
+// and returns its exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("armdis", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var mode, architecture, start, base, endian string
+	flags.StringVar(&mode, "mode", "auto", "The instruction set: arm, "+
+		"thumb or auto to use the ELF mapping symbols.")
+	flags.StringVar(&architecture, "arch", "armv7", "The architecture "+
+		"version: armv4t, armv5te, armv6 or armv7.")
+	flags.StringVar(&start, "start", "0", "The address to start printing "+
+		"instructions at.")
+	flags.StringVar(&base, "base", "0", "The address to load a raw binary "+
+		"at.")
+	flags.StringVar(&endian, "endian", "little", "The byte order of a raw "+
+		"binary: little or big.")
+	e := flags.Parse(args)
+	if e != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(stderr, "Usage: armdis [options] <file>\n")
+		flags.PrintDefaults()
+		return 2
+	}
+	o := options{mode: mode}
+	if (mode != "arm") && (mode != "thumb") && (mode != "auto") {
+		fmt.Fprintf(stderr, "Invalid mode: %s\n", mode)
+		return 2
+	}
+	o.architecture, e = parseArchitecture(architecture)
+	if e != nil {
+		fmt.Fprintf(stderr, "%s\n", e)
+		return 2
+	}
+	o.start, e = parseAddress(start)
+	if e != nil {
+		fmt.Fprintf(stderr, "%s\n", e)
+		return 2
+	}
+	baseAddress, e := parseAddress(base)
+	if e != nil {
+		fmt.Fprintf(stderr, "%s\n", e)
+		return 2
+	}
+	switch endian {
+	case "little":
+		o.byteOrder = binary.LittleEndian
+	case "big":
+		o.byteOrder = binary.BigEndian
+	default:
+		fmt.Fprintf(stderr, "Invalid endianness: %s\n", endian)
+		return 2
+	}
+	path := flags.Arg(0)
+	content, e := os.ReadFile(path)
+	if e != nil {
+		fmt.Fprintf(stderr, "Failed reading %s: %s\n", path, e)
+		return 1
+	}
+	var sections []*section
+	format := "binary"
+	if bytes.HasPrefix(content, []byte(elf.ELFMAG)) {
+		sections, o.byteOrder, e = readELFSections(bytes.NewReader(content))
+		if e != nil {
+			fmt.Fprintf(stderr, "Failed loading %s: %s\n", path, e)
+			return 1
+		}
+		format = "elf32-littlearm"
+		if o.byteOrder == binary.BigEndian {
+			format = "elf32-bigarm"
+		}
+	} else {
+		symbols := &arm_emulate.ELFSymbolTable{
+			Symbols: make([]arm_emulate.ELFSymbol, 0),
+		}
+		sections = []*section{{
+			name:     ".data",
+			address:  baseAddress,
+			data:     content,
+			symbols:  symbols,
+			resolver: symbols,
+		}}
+	}
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+	fmt.Fprintf(w, "\n%s:     file format %s\n\n", path, format)
+	for _, s := range sections {
+		end := uint64(s.address) + uint64(len(s.data))
+		if (len(s.data) == 0) || (end <= uint64(o.start)) {
+			continue
+		}
+		fmt.Fprintf(w, "\nDisassembly of section %s:\n", s.name)
+		s.disassemble(w, &o)
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
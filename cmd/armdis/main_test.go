@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yalue/arm_emulate"
+)
+
+// Returns a section at 0x8000 containing an ARM function, a literal, and a
+// THUMB function followed by data.
+func getTestSection() *section {
+	content := []byte{
+		// push {r4, lr}; bl 0x8014; ldr r0, [pc]; pop {r4, pc}
+		0x10, 0x40, 0x2d, 0xe9, 0x02, 0x00, 0x00, 0xeb,
+		0x00, 0x00, 0x9f, 0xe5, 0x10, 0x80, 0xbd, 0xe8,
+		// .word 0x12345678
+		0x78, 0x56, 0x34, 0x12,
+		// movs r0, #1; it eq; addeq r0, r0, r1; bx lr
+		0x01, 0x20, 0x08, 0xbf, 0x40, 0x18, 0x70, 0x47,
+		// .word 0xdeadbeef; .short 0x1234
+		0xef, 0xbe, 0xad, 0xde, 0x34, 0x12,
+	}
+	symbols := &arm_emulate.ELFSymbolTable{Symbols: []arm_emulate.ELFSymbol{
+		{Name: "main", Address: 0x8000, Size: 0x14, IsFunction: true},
+		{Name: "$a", Address: 0x8000},
+		{Name: "$d", Address: 0x8010},
+		{Name: "lit", Address: 0x8010, Size: 4, IsObject: true},
+		{Name: "thumb_func", Address: 0x8014, Size: 8, IsFunction: true,
+			IsTHUMB: true},
+		{Name: "$t", Address: 0x8014},
+		{Name: "$d", Address: 0x801c},
+	}}
+	return &section{
+		name:     ".text",
+		address:  0x8000,
+		data:     content,
+		symbols:  symbols,
+		resolver: symbols,
+	}
+}
+
+func TestDisassembleSection(t *testing.T) {
+	s := getTestSection()
+	o := options{mode: "auto", byteOrder: binary.LittleEndian,
+		architecture: arm_emulate.ARMv7}
+	var output bytes.Buffer
+	s.disassemble(&output, &o)
+	expected := "\n00008000 <main>:\n" +
+		"    8000:\te92d4010 \tpush\t{r4, lr}\n" +
+		"    8004:\teb000002 \tbl\t8014 <thumb_func>\n" +
+		"    8008:\te59f0000 \tldr\tr0, [pc]\t; 8010 <lit>\n" +
+		"    800c:\te8bd8010 \tpop\t{r4, pc}\n" +
+		"\n00008010 <lit>:\n" +
+		"    8010:\t12345678 \t.word\t0x12345678\n" +
+		"\n00008014 <thumb_func>:\n" +
+		"    8014:\t2001      \tmovs\tr0, #1\n" +
+		"    8016:\tbf08      \tit\teq\n" +
+		"    8018:\t1840      \taddeq\tr0, r0, r1\n" +
+		"    801a:\t4770      \tbx\tlr\n" +
+		"    801c:\tdeadbeef \t.word\t0xdeadbeef\n" +
+		"    8020:\t1234     \t.short\t0x1234\n"
+	if output.String() != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output.String())
+		t.Fail()
+	}
+	// A start address inside a function is labeled with an offset, and
+	// forcing ARM mode should still print the $d data as data.
+	o = options{mode: "arm", start: 0x800c, byteOrder: binary.LittleEndian,
+		architecture: arm_emulate.ARMv7}
+	output.Reset()
+	s.disassemble(&output, &o)
+	expected = "\n0000800c <main+0xc>:\n" +
+		"    800c:\te8bd8010 \tpop\t{r4, pc}\n" +
+		"\n00008010 <lit>:\n" +
+		"    8010:\t12345678 \t.word\t0x12345678\n" +
+		"\n00008014 <thumb_func>:\n" +
+		"    8014:\tbf082001 \tsvclt\t0x00082001\n" +
+		"    8018:\t47701840 \tldrbmi\tr1, [r0, -r0, asr #16]!\n" +
+		"    801c:\tdeadbeef \t.word\t0xdeadbeef\n" +
+		"    8020:\t1234     \t.short\t0x1234\n"
+	if output.String() != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output.String())
+		t.Fail()
+	}
+}
+
+func TestDisassembleRawBigEndian(t *testing.T) {
+	symbols := &arm_emulate.ELFSymbolTable{
+		Symbols: make([]arm_emulate.ELFSymbol, 0),
+	}
+	s := &section{
+		name:     ".data",
+		address:  0x1000,
+		data:     []byte{0xe1, 0xa0, 0x00, 0x01, 0xea, 0xff, 0xff, 0xfe, 0x00},
+		symbols:  symbols,
+		resolver: symbols,
+	}
+	o := options{mode: "auto", byteOrder: binary.BigEndian,
+		architecture: arm_emulate.ARMv7}
+	var output bytes.Buffer
+	s.disassemble(&output, &o)
+	expected := "\n00001000 <.data>:\n" +
+		"    1000:\te1a00001 \tmov\tr0, r1\n" +
+		"    1004:\teafffffe \tb\t0x1004\n" +
+		"    1008:\t00       \t.byte\t0x00\n"
+	if output.String() != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output.String())
+		t.Fail()
+	}
+}
+
+// Runs the command, failing the test if it doesn't succeed, and returns its
+// output.
+func runTestCommand(t *testing.T, args ...string) string {
+	var stdout, stderr bytes.Buffer
+	status := run(args, &stdout, &stderr)
+	if status != 0 {
+		t.Logf("armdis %v exited with status %d: %s\n", args, status,
+			stderr.String())
+		t.FailNow()
+	}
+	return stdout.String()
+}
+
+func TestRunELF(t *testing.T) {
+	// mapping.o contains the same code as getTestSection, but at address 0
+	// and with an unrelocated bl.
+	header := "\ntestdata/mapping.o:     file format elf32-littlearm\n\n" +
+		"\nDisassembly of section .text:\n"
+	thumb := "\n00000014 <thumb_func>:\n" +
+		"      14:\t2001      \tmovs\tr0, #1\n" +
+		"      16:\tbf08      \tit\teq\n" +
+		"      18:\t1840      \taddeq\tr0, r0, r1\n" +
+		"      1a:\t4770      \tbx\tlr\n" +
+		"      1c:\tdeadbeef \t.word\t0xdeadbeef\n"
+	expected := header + "\n00000000 <main>:\n" +
+		"       0:\te92d4010 \tpush\t{r4, lr}\n" +
+		"       4:\tebfffffe \tbl\t4 <main+0x4>\n" +
+		"       8:\te59f0000 \tldr\tr0, [pc]\t; 10 <lit>\n" +
+		"       c:\te8bd8010 \tpop\t{r4, pc}\n" +
+		"\n00000010 <lit>:\n" +
+		"      10:\t12345678 \t.word\t0x12345678\n" + thumb
+	output := runTestCommand(t, "testdata/mapping.o")
+	if output != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output)
+		t.Fail()
+	}
+	// The ELF's own byte order is used, regardless of -endian.
+	expected = header + thumb
+	output = runTestCommand(t, "-start", "0x14", "-endian", "big",
+		"testdata/mapping.o")
+	if output != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output)
+		t.Fail()
+	}
+}
+
+func TestRunRawBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "code.bin")
+	// mov r0, r1; b .
+	e := os.WriteFile(path, []byte{0xe1, 0xa0, 0x00, 0x01, 0xea, 0xff, 0xff,
+		0xfe}, 0644)
+	if e != nil {
+		t.Logf("Failed writing %s: %s\n", path, e)
+		t.FailNow()
+	}
+	expected := "\n" + path + ":     file format binary\n\n" +
+		"\nDisassembly of section .data:\n" +
+		"\n00001004 <.data>:\n" +
+		"    1004:\teafffffe \tb\t0x1004\n"
+	output := runTestCommand(t, "-endian", "big", "-base", "0x1000",
+		"-start", "0x1004", path)
+	if output != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output)
+		t.Fail()
+	}
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"-endian", "middle", path}, &stdout, &stderr)
+	if status != 2 {
+		t.Logf("Expected status 2 for an invalid -endian, got %d\n", status)
+		t.Fail()
+	}
+}
+
+func TestRunARMv7Code(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "code.bin")
+	// movw r1, 0x1234; dmb sy; clz r0, r1; bx lr. The decoder has no
+	// ARM-state movw or dmb, so they must be printed as data.
+	e := os.WriteFile(path, []byte{0x34, 0x12, 0x00, 0xe3, 0x5f, 0xf0, 0x7f,
+		0xf5, 0x11, 0x0f, 0x6f, 0xe1, 0x1e, 0xff, 0x2f, 0xe1}, 0644)
+	if e != nil {
+		t.Logf("Failed writing %s: %s\n", path, e)
+		t.FailNow()
+	}
+	header := "\n" + path + ":     file format binary\n\n" +
+		"\nDisassembly of section .data:\n" +
+		"\n00000000 <.data>:\n"
+	expected := header +
+		"       0:\te3001234 \t.word\t0xe3001234\n" +
+		"       4:\tf57ff05f \t.word\t0xf57ff05f\n" +
+		"       8:\te16f0f11 \tclz\tr0, r1\n" +
+		"       c:\te12fff1e \tbx\tlr\n"
+	output := runTestCommand(t, "-mode", "arm", path)
+	if output != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output)
+		t.Fail()
+	}
+	// clz was added in ARMv5TE, so it's data on ARMv4T.
+	expected = "\n" + path + ":     file format binary\n\n" +
+		"\nDisassembly of section .data:\n" +
+		"\n00000008 <.data>:\n" +
+		"       8:\te16f0f11 \t.word\t0xe16f0f11\n" +
+		"       c:\te12fff1e \tbx\tlr\n"
+	output = runTestCommand(t, "-mode", "arm", "-arch", "ARMv4T",
+		"-start", "8", path)
+	if output != expected {
+		t.Logf("Expected:\n%s\nGot:\n%s\n", expected, output)
+		t.Fail()
+	}
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"-arch", "armv8", path}, &stdout, &stderr)
+	if status != 2 {
+		t.Logf("Expected status 2 for an invalid -arch, got %d\n", status)
+		t.Fail()
+	}
+}
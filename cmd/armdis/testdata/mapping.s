@@ -0,0 +1,28 @@
+@ Assembled into mapping.o with:
+@     llvm-mc -triple=armv7a-none-eabi -filetype=obj mapping.s -o mapping.o
+.syntax unified
+.text
+.arm
+.global main
+.type main, %function
+main:
+	push {r4, lr}
+	bl thumb_func
+	ldr r0, lit
+	pop {r4, pc}
+.size main, . - main
+.type lit, %object
+lit:
+	.word 0x12345678
+.size lit, 4
+.thumb
+.global thumb_func
+.type thumb_func, %function
+.thumb_func
+thumb_func:
+	movs r0, #1
+	it eq
+	addeq r0, r0, r1
+	bx lr
+.size thumb_func, . - thumb_func
+	.word 0xdeadbeef
@@ -16,6 +16,14 @@ type ARMCoprocessor interface {
 	Number() uint8
 }
 
+// Coprocessors may also implement this interface to support the ARMv5TE mcrr
+// and mrrc instructions, which transfer two ARM registers at once. These
+// instructions are undefined for coprocessors that don't implement it.
+type ARMDoubleRegisterCoprocessor interface {
+	DoubleRegisterTransfer(p ARMProcessor, raw uint32, rd, rn ARMRegister,
+		load bool) error
+}
+
 // A simple coprocessor for testing. It's single register holds the last data
 // transferred to it, and its single operation increments its register.
 type simpleCounterCoprocessor struct {
@@ -71,6 +79,20 @@ func (c *simpleCounterCoprocessor) RegisterTransfer(p ARMProcessor, raw uint32,
 	return nil
 }
 
+// The mcrr instruction stores rd in the register, ignoring rn. The mrrc
+// instruction loads the register into rd and clears rn.
+func (c *simpleCounterCoprocessor) DoubleRegisterTransfer(p ARMProcessor,
+	raw uint32, rd, rn ARMRegister, load bool) error {
+	if load {
+		p.SetRegister(rd, c.register)
+		p.SetRegister(rn, 0)
+	} else {
+		value, _ := p.GetRegister(rd)
+		c.register = value
+	}
+	return nil
+}
+
 func NewTestStorageCoprocessor(number uint8) ARMCoprocessor {
 	var c simpleCounterCoprocessor
 	c.coprocNumber = number
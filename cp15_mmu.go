@@ -0,0 +1,466 @@
+package arm_emulate
+
+// This file implements the CP15 system control coprocessor of an ARM920T,
+// including its MMU, which translates addresses using ARMv4/v5 section,
+// coarse and fine page tables.
+
+import (
+	"fmt"
+)
+
+// Bits in the CP15 control register (c1).
+const (
+	cp15ControlMMU         uint32 = 1 << 0
+	cp15ControlAlignment   uint32 = 1 << 1
+	cp15ControlBigEndian   uint32 = 1 << 7
+	cp15ControlSystem      uint32 = 1 << 8
+	cp15ControlROM         uint32 = 1 << 9
+	cp15ControlHighVectors uint32 = 1 << 13
+)
+
+// Bits 6:3 of the ARM920T control register always read as one. The other
+// bits which can be written are M, A, C, B, S, R, I, V, RR, nF and iA.
+const (
+	cp15ControlFixedBits    uint32 = 0x00000078
+	cp15ControlWritableBits uint32 = 0xc0007387
+)
+
+// Fault status codes, as recorded in the fault status registers.
+const (
+	faultAlignment           uint8 = 0x1
+	faultTranslationSection  uint8 = 0x5
+	faultTranslationPage     uint8 = 0x7
+	faultExternal            uint8 = 0x8
+	faultDomainSection       uint8 = 0x9
+	faultDomainPage          uint8 = 0xb
+	faultExternalFirstLevel  uint8 = 0xc
+	faultPermissionSection   uint8 = 0xd
+	faultExternalSecondLevel uint8 = 0xe
+	faultPermissionPage      uint8 = 0xf
+)
+
+var faultReasons = map[uint8]string{
+	faultAlignment:           "Alignment fault",
+	faultTranslationSection:  "Section translation fault",
+	faultTranslationPage:     "Page translation fault",
+	faultExternal:            "External abort",
+	faultDomainSection:       "Section domain fault",
+	faultDomainPage:          "Page domain fault",
+	faultExternalFirstLevel:  "External abort on first-level translation",
+	faultPermissionSection:   "Section permission fault",
+	faultExternalSecondLevel: "External abort on second-level translation",
+	faultPermissionPage:      "Page permission fault",
+}
+
+// The number of entries in the software TLB. Each entry translates a 1KB
+// block, which is the smallest (tiny) page size.
+const tlbEntries = 256
+
+// A cached translation of a single 1KB block of modified virtual addresses.
+type tlbEntry struct {
+	valid bool
+	// The modified virtual address of the block, shifted right 10 bits.
+	tag uint32
+	// The virtual base address and size of the page or section the block
+	// belongs to. These are used when invalidating single entries.
+	pageBase uint32
+	pageSize uint32
+	// The physical address of the start of the block.
+	physical uint32
+	domain   uint8
+	// The access permission bits which apply to the block.
+	accessPermissions uint8
+	section           bool
+}
+
+// Implements the CP15 system control coprocessor of an ARM920T, and the
+// address translation carried out by its MMU. Create this using AddCP15MMU.
+// Only a single, unified TLB is emulated, and caches aren't emulated at all,
+// so cache maintenance operations are ignored.
+type CP15MMU struct {
+	// The values returned by the main ID and cache type registers. These
+	// default to the values of an ARM920T.
+	ID        uint32
+	CacheType uint32
+	processor ARMProcessor
+	physical  ARMMemory
+	// The CP15 registers.
+	control                uint32
+	translationBase        uint32
+	domainAccess           uint32
+	dataFaultStatus        uint32
+	instructionFaultStatus uint32
+	faultAddress           uint32
+	processID              uint32
+	cacheLockdown          [2]uint32
+	tlbLockdown            [2]uint32
+	tlb                    [tlbEntries]tlbEntry
+}
+
+func (c *CP15MMU) Number() uint8 {
+	return 15
+}
+
+// Returns the memory that translated addresses refer to. This is the memory
+// interface the processor was using when the MMU was added to it.
+func (c *CP15MMU) PhysicalMemory() ARMMemory {
+	return c.physical
+}
+
+// Returns the value of the control register.
+func (c *CP15MMU) Control() uint32 {
+	return c.control
+}
+
+// Invalidates every entry in the TLB.
+func (c *CP15MMU) FlushTLB() {
+	for i := range c.tlb {
+		c.tlb[i].valid = false
+	}
+}
+
+// Invalidates any TLB entry for the page or section containing the given
+// virtual address.
+func (c *CP15MMU) invalidateTLBEntry(address uint32) {
+	mva := c.modifiedAddress(address)
+	for i := range c.tlb {
+		entry := &(c.tlb[i])
+		if entry.valid && ((mva - entry.pageBase) < entry.pageSize) {
+			entry.valid = false
+		}
+	}
+}
+
+func (c *CP15MMU) setControl(value uint32) error {
+	c.control = (value & cp15ControlWritableBits) | cp15ControlFixedBits
+	c.processor.SetHighVectors((c.control & cp15ControlHighVectors) != 0)
+	return c.physical.SetBigEndian((c.control & cp15ControlBigEndian) != 0)
+}
+
+// CP15 has no data operations or data transfers.
+func (c *CP15MMU) Operation(p ARMProcessor, raw uint32) error {
+	return fmt.Errorf("CP15 has no data operations: %w",
+		errUndefinedInstruction)
+}
+
+func (c *CP15MMU) DataTransfer(p ARMProcessor, raw, address uint32) error {
+	return fmt.Errorf("CP15 has no data transfers: %w",
+		errUndefinedInstruction)
+}
+
+// Splits a coprocessor register transfer into its crn, crm, opcode_1 and
+// opcode_2 fields.
+func decodeCP15Transfer(raw uint32) (uint8, uint8, uint8, uint8) {
+	return uint8((raw >> 16) & 0xf), uint8(raw & 0xf),
+		uint8((raw >> 21) & 0x7), uint8((raw >> 5) & 0x7)
+}
+
+// Returns the value of the given CP15 register.
+func (c *CP15MMU) readRegister(crn, crm, opcode2 uint8) (uint32, error) {
+	switch crn {
+	case 0:
+		if opcode2 == 1 {
+			return c.CacheType, nil
+		}
+		return c.ID, nil
+	case 1:
+		return c.control, nil
+	case 2:
+		return c.translationBase, nil
+	case 3:
+		return c.domainAccess, nil
+	case 5:
+		if opcode2 == 1 {
+			return c.instructionFaultStatus, nil
+		}
+		return c.dataFaultStatus, nil
+	case 6:
+		return c.faultAddress, nil
+	case 9:
+		return c.cacheLockdown[opcode2&1], nil
+	case 10:
+		return c.tlbLockdown[opcode2&1], nil
+	case 13:
+		return c.processID, nil
+	case 15:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("Can't read CP15 register c%d, c%d, %d: %w", crn, crm,
+		opcode2, errUndefinedInstruction)
+}
+
+// Writes the given CP15 register, or carries out a cache or TLB operation.
+func (c *CP15MMU) writeRegister(crn, crm, opcode2 uint8, value uint32) error {
+	switch crn {
+	case 1:
+		return c.setControl(value)
+	case 2:
+		c.translationBase = value & 0xffffc000
+	case 3:
+		c.domainAccess = value
+	case 5:
+		if opcode2 == 1 {
+			c.instructionFaultStatus = value & 0xff
+		} else {
+			c.dataFaultStatus = value & 0xff
+		}
+	case 6:
+		c.faultAddress = value
+	case 7, 15:
+		// Cache operations and test registers.
+	case 8:
+		if opcode2 == 1 {
+			c.invalidateTLBEntry(value)
+		} else {
+			c.FlushTLB()
+		}
+	case 9:
+		c.cacheLockdown[opcode2&1] = value
+	case 10:
+		c.tlbLockdown[opcode2&1] = value
+	case 13:
+		c.processID = value & 0xfe000000
+	default:
+		return fmt.Errorf("Can't write CP15 register c%d, c%d, %d: %w", crn,
+			crm, opcode2, errUndefinedInstruction)
+	}
+	return nil
+}
+
+func (c *CP15MMU) RegisterTransfer(p ARMProcessor, raw uint32,
+	rd ARMRegister, load bool) error {
+	crn, crm, opcode1, opcode2 := decodeCP15Transfer(raw)
+	if (opcode1 != 0) || (p.GetMode() == userMode) {
+		return fmt.Errorf("Invalid CP15 access: %w", errUndefinedInstruction)
+	}
+	if load {
+		value, e := c.readRegister(crn, crm, opcode2)
+		if e != nil {
+			return e
+		}
+		return p.SetRegister(rd, value)
+	}
+	value, e := p.GetRegister(rd)
+	if e != nil {
+		return e
+	}
+	return c.writeRegister(crn, crm, opcode2, value)
+}
+
+// Applies the fast context switch extension's process ID to the address.
+func (c *CP15MMU) modifiedAddress(address uint32) uint32 {
+	if (address & 0xfe000000) == 0 {
+		return address | c.processID
+	}
+	return address
+}
+
+// Records a fault in the fault status registers and returns the error to use
+// for it. Faults caused by instruction fetches don't update the FAR.
+func (c *CP15MMU) fault(address uint32, status, domain uint8,
+	fetch bool) error {
+	value := (uint32(domain) << 4) | uint32(status)
+	if fetch {
+		c.instructionFaultStatus = value
+	} else {
+		c.dataFaultStatus = value
+		c.faultAddress = address
+	}
+	return &MemoryAccessError{address, faultReasons[status]}
+}
+
+// Reads a page table descriptor from physical memory.
+func (c *CP15MMU) readDescriptor(address uint32) (uint32, error) {
+	return c.physical.ReadMemoryWord(address)
+}
+
+// Walks the page tables to translate the given modified virtual address.
+// Returns false and the fault status if the translation fails, in which case
+// the entry only holds the domain to report.
+func (c *CP15MMU) lookup(mva uint32) (tlbEntry, uint8, bool) {
+	var entry tlbEntry
+	firstLevel, e := c.readDescriptor(c.translationBase | ((mva >> 20) << 2))
+	if e != nil {
+		return entry, faultExternalFirstLevel, false
+	}
+	entry.domain = uint8((firstLevel >> 5) & 0xf)
+	var secondAddress uint32
+	coarse := false
+	switch firstLevel & 3 {
+	case 0:
+		return tlbEntry{}, faultTranslationSection, false
+	case 1:
+		coarse = true
+		secondAddress = (firstLevel & 0xfffffc00) | ((mva >> 10) & 0x3fc)
+	case 2:
+		entry.section = true
+		entry.pageBase = mva & 0xfff00000
+		entry.pageSize = 0x100000
+		entry.physical = (firstLevel & 0xfff00000) | (mva & 0x000ffc00)
+		entry.accessPermissions = uint8((firstLevel >> 10) & 3)
+	case 3:
+		secondAddress = (firstLevel & 0xfffff000) | ((mva >> 8) & 0xffc)
+	}
+	if !entry.section {
+		secondLevel, e := c.readDescriptor(secondAddress)
+		if e != nil {
+			return entry, faultExternalSecondLevel, false
+		}
+		var subpage uint32
+		switch secondLevel & 3 {
+		case 0:
+			return entry, faultTranslationPage, false
+		case 1:
+			entry.pageSize = 0x10000
+			entry.physical = (secondLevel & 0xffff0000) | (mva & 0xfc00)
+			subpage = (mva >> 14) & 3
+		case 2:
+			entry.pageSize = 0x1000
+			entry.physical = (secondLevel & 0xfffff000) | (mva & 0xc00)
+			subpage = (mva >> 10) & 3
+		case 3:
+			// Tiny pages can only be used in fine page tables.
+			if coarse {
+				return entry, faultTranslationPage, false
+			}
+			entry.pageSize = 0x400
+			entry.physical = secondLevel & 0xfffffc00
+		}
+		entry.pageBase = mva & ^(entry.pageSize - 1)
+		entry.accessPermissions = uint8((secondLevel >> (4 + subpage*2)) & 3)
+	}
+	entry.valid = true
+	entry.tag = mva >> 10
+	return entry, 0, true
+}
+
+// Walks the page tables to translate the given modified virtual address,
+// and stores the result in the TLB.
+func (c *CP15MMU) walk(mva uint32, fetch bool) (*tlbEntry, error) {
+	entry, status, ok := c.lookup(mva)
+	if !ok {
+		return nil, c.fault(mva, status, entry.domain, fetch)
+	}
+	slot := &(c.tlb[entry.tag%tlbEntries])
+	*slot = entry
+	return slot, nil
+}
+
+// Returns true if the given access permission bits allow the access.
+func (c *CP15MMU) permitted(accessPermissions uint8, write,
+	privileged bool) bool {
+	switch accessPermissions {
+	case 0:
+		if write {
+			return false
+		}
+		system := (c.control & cp15ControlSystem) != 0
+		rom := (c.control & cp15ControlROM) != 0
+		if system && !rom {
+			return privileged
+		}
+		return rom && !system
+	}
+	return accessPermitted(accessPermissions, write, privileged)
+}
+
+// Translates a virtual address to a physical address, checking the domain
+// and access permissions for the processor's current mode. The size is the
+// size of the access, which is used for alignment checking.
+func (c *CP15MMU) translate(address uint32, size uint8, write,
+	fetch bool) (uint32, error) {
+	if !fetch && ((c.control & cp15ControlAlignment) != 0) &&
+		((address & uint32(size-1)) != 0) {
+		return 0, c.fault(address, faultAlignment, 0, false)
+	}
+	if (c.control & cp15ControlMMU) == 0 {
+		return address, nil
+	}
+	mva := c.modifiedAddress(address)
+	entry := &(c.tlb[(mva>>10)%tlbEntries])
+	if !entry.valid || (entry.tag != (mva >> 10)) {
+		var e error
+		entry, e = c.walk(mva, fetch)
+		if e != nil {
+			return 0, e
+		}
+	}
+	switch (c.domainAccess >> (entry.domain * 2)) & 3 {
+	case 1:
+		privileged := c.processor.GetMode() != userMode
+		if c.permitted(entry.accessPermissions, write, privileged) {
+			break
+		}
+		if entry.section {
+			return 0, c.fault(mva, faultPermissionSection, entry.domain, fetch)
+		}
+		return 0, c.fault(mva, faultPermissionPage, entry.domain, fetch)
+	case 3:
+		// Manager domains aren't checked.
+	default:
+		if entry.section {
+			return 0, c.fault(mva, faultDomainSection, entry.domain, fetch)
+		}
+		return 0, c.fault(mva, faultDomainPage, entry.domain, fetch)
+	}
+	return entry.physical | (mva & 0x3ff), nil
+}
+
+// Translates an address for a debugging tool. Permissions aren't checked, and
+// failed translations are neither recorded in the fault status registers nor
+// stored in the TLB.
+func (c *CP15MMU) debugTranslate(address uint32) (uint32, error) {
+	if (c.control & cp15ControlMMU) == 0 {
+		return address, nil
+	}
+	mva := c.modifiedAddress(address)
+	entry := c.tlb[(mva>>10)%tlbEntries]
+	if !entry.valid || (entry.tag != (mva >> 10)) {
+		var status uint8
+		var ok bool
+		entry, status, ok = c.lookup(mva)
+		if !ok {
+			return 0, &MemoryAccessError{address, faultReasons[status]}
+		}
+	}
+	return entry.physical | (mva & 0x3ff), nil
+}
+
+// Records an external abort caused by failing to access physical memory.
+func (c *CP15MMU) externalAbort(address uint32, fetch bool) error {
+	return c.fault(address, faultExternal, 0, fetch)
+}
+
+func (c *CP15MMU) setBigEndianBit(bigEndian bool) {
+	if bigEndian {
+		c.control |= cp15ControlBigEndian
+	} else {
+		c.control &= ^cp15ControlBigEndian
+	}
+}
+
+// Creates a CP15 coprocessor with an ARM920T-style MMU and adds it to the
+// processor. The processor's memory interface is replaced with one which
+// translates addresses using the MMU, and the previous memory interface is
+// used as physical memory. The MMU starts out disabled. Architectural
+// exceptions must be enabled for translation faults to cause aborts.
+func AddCP15MMU(p ARMProcessor) (*CP15MMU, error) {
+	var c CP15MMU
+	c.ID = 0x41129200
+	c.CacheType = 0x0d172172
+	c.processor = p
+	c.physical = p.GetMemoryInterface()
+	c.control = cp15ControlFixedBits
+	if c.physical.IsBigEndian() {
+		c.control |= cp15ControlBigEndian
+	}
+	if p.HighVectors() {
+		c.control |= cp15ControlHighVectors
+	}
+	installTranslatingMemory(p, &c)
+	e := p.AddCoprocessor(&c)
+	if e != nil {
+		return nil, fmt.Errorf("Failed adding CP15: %s", e)
+	}
+	return &c, nil
+}
@@ -0,0 +1,325 @@
+package arm_emulate
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns a processor with an MMU and 64KB of physical memory at address 0.
+// The MMU isn't enabled, but page tables are set up at 0x4000 which map:
+//   - The first 1MB section to itself (read/write for all modes, domain 0)
+//   - 0x00100000 to physical address 0 (privileged access only, domain 1)
+//   - 0x00201000 to 0x3000 using a coarse table (read-only for user mode)
+//   - 0x00400400 to 0x2400 using a fine table (a 1KB tiny page)
+func setupMMUTestProcessor() (ARMProcessor, *CP15MMU, error) {
+	p := NewARMProcessor()
+	memory := p.GetMemoryInterface()
+	e := memory.SetMemoryRegion(0, make([]byte, 0x10000))
+	if e != nil {
+		return nil, nil, e
+	}
+	descriptors := map[uint32]uint32{
+		0x4000: 0x00000c02,
+		0x4004: 0x00000422,
+		0x4008: 0x00008001,
+		0x4010: 0x00009003,
+		0x8004: 0x00003aa2,
+		0x9004: 0x00002433,
+	}
+	for address, value := range descriptors {
+		memory.WriteMemoryWord(address, value)
+	}
+	mmu, e := AddCP15MMU(p)
+	if e != nil {
+		return nil, nil, e
+	}
+	p.SetMode(supervisorMode)
+	p.SetArchitecturalExceptions(true)
+	return p, mmu, nil
+}
+
+func TestCP15Registers(t *testing.T) {
+	p, mmu, e := setupMMUTestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up the MMU: %s\n", e)
+		t.FailNow()
+	}
+	p.SetRegister(0, 0x4000)
+	p.SetRegister(1, 0x5)
+	p.SetRegister(2, 0x2001)
+	program := []uint32{
+		// mcr p15, 0, r0, c2, c0, 0 (TTBR)
+		0xee020f10,
+		// mcr p15, 0, r1, c3, c0, 0 (DACR)
+		0xee031f10,
+		// mcr p15, 0, r2, c1, c0, 0 (control, setting M and V)
+		0xee012f10,
+		// mrc p15, 0, r3, c0, c0, 0 (ID)
+		0xee103f10,
+		// mrc p15, 0, r4, c1, c0, 0 (control)
+		0xee114f10,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(3)
+	if value != 0x41129200 {
+		t.Logf("Got incorrect ID: 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(4)
+	if (value != 0x2079) || (mmu.Control() != 0x2079) {
+		t.Logf("Got incorrect control register value: 0x%08x\n", value)
+		t.Fail()
+	}
+	if !p.HighVectors() {
+		t.Logf("Setting the V bit didn't enable high vectors.\n")
+		t.Fail()
+	}
+	// CP15 can't be accessed from user mode.
+	p.SetCPSR(uint32(userMode))
+	e = testSingleInstruction(0xee114f10, p)
+	if (e != nil) || (p.GetMode() != undefinedMode) {
+		t.Logf("User-mode CP15 access didn't cause an undefined instruction "+
+			"exception (%v)\n", e)
+		t.Fail()
+	}
+}
+
+func TestMMUTranslation(t *testing.T) {
+	p, mmu, e := setupMMUTestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up the MMU: %s\n", e)
+		t.FailNow()
+	}
+	mmu.writeRegister(2, 0, 0, 0x4000)
+	mmu.writeRegister(3, 0, 0, 0x5)
+	mmu.writeRegister(1, 0, 0, 0x1)
+	memory := p.GetMemoryInterface()
+	physical := mmu.PhysicalMemory()
+	physical.WriteMemoryWord(0x1000, 0x11111111)
+	physical.WriteMemoryWord(0x3000, 0x33333333)
+	physical.WriteMemoryWord(0x2400, 0x24242424)
+	expected := map[uint32]uint32{
+		0x00001000: 0x11111111,
+		0x00101000: 0x11111111,
+		0x00201000: 0x33333333,
+		0x00400400: 0x24242424,
+	}
+	for address, value := range expected {
+		read, e := memory.ReadMemoryWord(address)
+		if (e != nil) || (read != value) {
+			t.Logf("Read 0x%08x from 0x%08x, expected 0x%08x (%v)\n", read,
+				address, value, e)
+			t.Fail()
+		}
+	}
+	e = memory.WriteMemoryWord(0x00201000, 0x12345678)
+	value, _ := physical.ReadMemoryWord(0x3000)
+	if (e != nil) || (value != 0x12345678) {
+		t.Logf("Privileged write to a page failed: %v\n", e)
+		t.Fail()
+	}
+	// Check the faults and the recorded fault status.
+	p.SetCPSR(uint32(userMode))
+	faults := []struct {
+		address uint32
+		write   bool
+		status  uint32
+	}{
+		{0x00101000, false, 0x1d},
+		{0x00201000, true, 0x0f},
+		{0x00300000, false, 0x05},
+		{0x00202000, false, 0x07},
+	}
+	for _, f := range faults {
+		if f.write {
+			e = memory.WriteMemoryWord(f.address, 0)
+		} else {
+			_, e = memory.ReadMemoryWord(f.address)
+		}
+		if e == nil {
+			t.Logf("Access to 0x%08x didn't fault\n", f.address)
+			t.Fail()
+		}
+		status, _ := mmu.readRegister(5, 0, 0)
+		address, _ := mmu.readRegister(6, 0, 0)
+		if (status != f.status) || (address != f.address) {
+			t.Logf("Access to 0x%08x: expected FSR 0x%02x, got 0x%02x, FAR "+
+				"0x%08x\n", f.address, f.status, status, address)
+			t.Fail()
+		}
+	}
+	_, e = memory.ReadMemoryWord(0x00201000)
+	if e != nil {
+		t.Logf("User-mode read from a read-only page failed: %s\n", e)
+		t.Fail()
+	}
+	// Domain 1 becomes a manager domain, but the stale TLB entry for domain
+	// 0 doesn't matter since the domain is checked on every access.
+	mmu.writeRegister(3, 0, 0, 0xd)
+	_, e = memory.ReadMemoryWord(0x00101000)
+	if e != nil {
+		t.Logf("Access to a manager domain failed: %s\n", e)
+		t.Fail()
+	}
+	mmu.writeRegister(3, 0, 0, 0x1)
+	_, e = memory.ReadMemoryWord(0x00101000)
+	status, _ := mmu.readRegister(5, 0, 0)
+	if (e == nil) || (status != 0x19) {
+		t.Logf("Expected a domain fault, got FSR 0x%02x (%v)\n", status, e)
+		t.Fail()
+	}
+}
+
+func TestMMUAborts(t *testing.T) {
+	p, mmu, e := setupMMUTestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up the MMU: %s\n", e)
+		t.FailNow()
+	}
+	mmu.writeRegister(2, 0, 0, 0x4000)
+	mmu.writeRegister(3, 0, 0, 0x5)
+	mmu.writeRegister(1, 0, 0, 0x1)
+	// ldr r0, [r1], from an unmapped section
+	p.SetRegister(1, 0x00300010)
+	e = testSingleInstruction(0xe5910000, p)
+	if e != nil {
+		t.Logf("Got an error for a data abort: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0x10, 4104, t)
+	// Jumping to the unmapped section causes a prefetch abort, which updates
+	// the instruction FSR but not the FAR.
+	p.SetRegister(15, 0x00300000)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Got an error for a prefetch abort: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0xc, 0x00300004, t)
+	status, _ := mmu.readRegister(5, 0, 1)
+	address, _ := mmu.readRegister(6, 0, 0)
+	if (status != 0x5) || (address != 0x00300010) {
+		t.Logf("Got IFSR 0x%02x and FAR 0x%08x after a prefetch abort\n",
+			status, address)
+		t.Fail()
+	}
+	// Changing a page table entry has no effect until the TLB is flushed.
+	physical := mmu.PhysicalMemory()
+	physical.WriteMemoryWord(0x400c, 0x00000c02)
+	memory := p.GetMemoryInterface()
+	_, e = memory.ReadMemoryWord(0x00300010)
+	if e != nil {
+		t.Logf("Translation faults shouldn't be cached: %s\n", e)
+		t.Fail()
+	}
+	physical.WriteMemoryWord(0x400c, 0)
+	_, e = memory.ReadMemoryWord(0x00300010)
+	if e != nil {
+		t.Logf("A stale TLB entry wasn't used: %s\n", e)
+		t.Fail()
+	}
+	// mcr p15, 0, r0, c8, c7, 1 (invalidate TLB entry by address)
+	p.SetRegister(0, 0x00300000)
+	p.SetRegister(15, 4096)
+	memory.WriteMemoryWord(4096, 0xee080f37)
+	e = p.RunNextInstruction()
+	_, e2 := memory.ReadMemoryWord(0x00300010)
+	if (e != nil) || (e2 == nil) {
+		t.Logf("Invalidating the TLB entry failed: %v, %v\n", e, e2)
+		t.Fail()
+	}
+}
+
+func TestMMUDebugReads(t *testing.T) {
+	p, mmu, e := setupMMUTestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up the MMU: %s\n", e)
+		t.FailNow()
+	}
+	mmu.writeRegister(2, 0, 0, 0x4000)
+	mmu.writeRegister(3, 0, 0, 0x5)
+	mmu.writeRegister(1, 0, 0, 0x1)
+	mmu.writeRegister(5, 0, 0, 0x34)
+	mmu.writeRegister(5, 0, 1, 0x78)
+	mmu.writeRegister(6, 0, 0, 0x9abc)
+	// Showing an instruction at an unmapped address, or one loading from an
+	// unmapped address, mustn't look like an abort to the emulated program.
+	p.SetRegister(15, 0x00300000)
+	s := p.PendingInstructionString()
+	if !strings.Contains(s, "Error") {
+		t.Logf("Expected an error fetching from 0x00300000, got %q\n", s)
+		t.Fail()
+	}
+	// ldr r0, [pc, -8] loads the word at its own address.
+	n, _ := ParseInstruction(0xe51f0008)
+	d := Disassembler{Memory: p.GetMemoryInterface()}
+	s = d.ARMString(n, 0x00300000)
+	if strings.Contains(s, "=") {
+		t.Logf("Unexpected literal for an unmapped address: %q\n", s)
+		t.Fail()
+	}
+	// Privileged pages can still be read while in user mode.
+	mmu.PhysicalMemory().WriteMemoryWord(0x1000, 0xc0ffee)
+	p.SetCPSR(uint32(userMode))
+	s = d.ARMString(n, 0x00101000)
+	if !strings.Contains(s, "=0x00c0ffee") {
+		t.Logf("Expected to read a privileged literal, got %q\n", s)
+		t.Fail()
+	}
+	registers := map[uint8]uint32{0: 0x34, 1: 0x78}
+	for opcode2, expected := range registers {
+		value, _ := mmu.readRegister(5, 0, opcode2)
+		if value != expected {
+			t.Logf("FSR %d changed to 0x%08x\n", opcode2, value)
+			t.Fail()
+		}
+	}
+	value, _ := mmu.readRegister(6, 0, 0)
+	if value != 0x9abc {
+		t.Logf("The FAR changed to 0x%08x\n", value)
+		t.Fail()
+	}
+}
+
+func TestMMUGDBReads(t *testing.T) {
+	p, mmu, e := setupMMUTestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up the MMU: %s\n", e)
+		t.FailNow()
+	}
+	mmu.writeRegister(2, 0, 0, 0x4000)
+	mmu.writeRegister(3, 0, 0, 0x5)
+	mmu.writeRegister(1, 0, 0, 0x1)
+	mmu.writeRegister(5, 0, 0, 0x34)
+	mmu.writeRegister(6, 0, 0, 0x9abc)
+	stub := NewGDBStub(p)
+	reply := stub.readMemory("80000000,4")
+	if reply != "E01" {
+		t.Logf("Expected E01 reading an unmapped address, got %q\n", reply)
+		t.Fail()
+	}
+	mmu.PhysicalMemory().WriteMemoryWord(0x1000, 0xc0ffee)
+	reply = stub.readMemory("101000,4")
+	if reply != "eeffc000" {
+		t.Logf("Incorrect reply reading a mapped address: %q\n", reply)
+		t.Fail()
+	}
+	value, _ := mmu.readRegister(5, 0, 0)
+	if value != 0x34 {
+		t.Logf("The FSR changed to 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = mmu.readRegister(6, 0, 0)
+	if value != 0x9abc {
+		t.Logf("The FAR changed to 0x%08x\n", value)
+		t.Fail()
+	}
+}
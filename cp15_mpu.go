@@ -0,0 +1,233 @@
+package arm_emulate
+
+// This file implements the CP15 system control coprocessor of an ARM940T,
+// which contains a memory protection unit (MPU) rather than an MMU.
+
+import (
+	"fmt"
+)
+
+// The protection unit enable bit in the CP15 control register. The other bits
+// used by the ARM940T are shared with the MMU's control register.
+const cp15ControlProtectionUnit uint32 = 1 << 0
+
+// The bits which can be written in the ARM940T control register: P, D, B, I,
+// V, nF and iA.
+const cp15MPUControlWritableBits uint32 = 0xc0003085
+
+// The number of protection regions on each side (instruction and data).
+const mpuRegionCount = 8
+
+// Indices into the MPU's per-side register arrays. These match opcode_2 in
+// the instructions accessing the registers.
+const (
+	mpuData        = 0
+	mpuInstruction = 1
+)
+
+// Implements the CP15 system control coprocessor of an ARM940T, including its
+// protection unit, which has separate sets of 8 regions for instruction and
+// data accesses. Create this using AddCP15MPU. Where regions overlap, the one
+// with the higher number takes priority, and accesses outside of every
+// enabled region abort. The ARM940T has no fault status registers. Caches
+// aren't emulated, so the cacheable and bufferable bits have no effect.
+type CP15MPU struct {
+	// The value returned by the ID register. This defaults to the value of an
+	// ARM940T.
+	ID        uint32
+	processor ARMProcessor
+	physical  ARMMemory
+	// The CP15 registers. Arrays with 2 elements are indexed by mpuData or
+	// mpuInstruction.
+	control           uint32
+	cacheable         [2]uint32
+	bufferable        uint32
+	accessPermissions [2]uint32
+	regions           [2][mpuRegionCount]uint32
+	cacheLockdown     [2]uint32
+}
+
+func (c *CP15MPU) Number() uint8 {
+	return 15
+}
+
+// Returns the memory the MPU passes permitted accesses to. This is the memory
+// interface the processor was using when the MPU was added to it.
+func (c *CP15MPU) PhysicalMemory() ARMMemory {
+	return c.physical
+}
+
+// Returns the value of the control register.
+func (c *CP15MPU) Control() uint32 {
+	return c.control
+}
+
+// Returns the base address and size of a protection region, and whether it's
+// enabled. If instruction is set, this returns an instruction region rather
+// than a data region.
+func (c *CP15MPU) Region(number uint8, instruction bool) (uint32, uint64,
+	bool) {
+	side := mpuData
+	if instruction {
+		side = mpuInstruction
+	}
+	value := c.regions[side][number%mpuRegionCount]
+	size := uint64(2) << ((value >> 1) & 0x1f)
+	base := value & 0xfffff000 & ^uint32(size-1)
+	return base, size, (value & 1) != 0
+}
+
+func (c *CP15MPU) setControl(value uint32) error {
+	c.control = (value & cp15MPUControlWritableBits) | cp15ControlFixedBits
+	c.processor.SetHighVectors((c.control & cp15ControlHighVectors) != 0)
+	return c.physical.SetBigEndian((c.control & cp15ControlBigEndian) != 0)
+}
+
+// CP15 has no data operations or data transfers.
+func (c *CP15MPU) Operation(p ARMProcessor, raw uint32) error {
+	return fmt.Errorf("CP15 has no data operations: %w",
+		errUndefinedInstruction)
+}
+
+func (c *CP15MPU) DataTransfer(p ARMProcessor, raw, address uint32) error {
+	return fmt.Errorf("CP15 has no data transfers: %w",
+		errUndefinedInstruction)
+}
+
+// Returns a pointer to the given CP15 register, or nil if it doesn't exist.
+// The control register and operations aren't handled here.
+func (c *CP15MPU) getRegister(crn, crm, opcode2 uint8) *uint32 {
+	side := opcode2 & 1
+	if opcode2 > 1 {
+		return nil
+	}
+	switch crn {
+	case 2:
+		return &(c.cacheable[side])
+	case 3:
+		if side == mpuData {
+			return &(c.bufferable)
+		}
+	case 5:
+		return &(c.accessPermissions[side])
+	case 6:
+		if crm < mpuRegionCount {
+			return &(c.regions[side][crm])
+		}
+	case 9:
+		return &(c.cacheLockdown[side])
+	}
+	return nil
+}
+
+func (c *CP15MPU) RegisterTransfer(p ARMProcessor, raw uint32,
+	rd ARMRegister, load bool) error {
+	crn, crm, opcode1, opcode2 := decodeCP15Transfer(raw)
+	if (opcode1 != 0) || (p.GetMode() == userMode) {
+		return fmt.Errorf("Invalid CP15 access: %w", errUndefinedInstruction)
+	}
+	var value uint32
+	var e error
+	if !load {
+		value, e = p.GetRegister(rd)
+		if e != nil {
+			return e
+		}
+	}
+	switch crn {
+	case 0:
+		if load {
+			return p.SetRegister(rd, c.ID)
+		}
+	case 1:
+		if load {
+			return p.SetRegister(rd, c.control)
+		}
+		return c.setControl(value)
+	case 7, 15:
+		// Cache operations and test registers.
+		if load {
+			return p.SetRegister(rd, 0)
+		}
+		return nil
+	}
+	register := c.getRegister(crn, crm, opcode2)
+	if register == nil {
+		return fmt.Errorf("Invalid CP15 register c%d, c%d, %d: %w", crn, crm,
+			opcode2, errUndefinedInstruction)
+	}
+	if load {
+		return p.SetRegister(rd, *register)
+	}
+	*register = value
+	return nil
+}
+
+// Checks the access against the protection regions. Addresses are never
+// changed.
+func (c *CP15MPU) translate(address uint32, size uint8, write,
+	fetch bool) (uint32, error) {
+	if (c.control & cp15ControlProtectionUnit) == 0 {
+		return address, nil
+	}
+	side := mpuData
+	if fetch {
+		side = mpuInstruction
+	}
+	for i := mpuRegionCount - 1; i >= 0; i-- {
+		base, regionSize, enabled := c.Region(uint8(i), fetch)
+		if !enabled || (uint64(address-base) >= regionSize) {
+			continue
+		}
+		permissions := uint8((c.accessPermissions[side] >> (uint(i) * 2)) & 3)
+		privileged := c.processor.GetMode() != userMode
+		if !accessPermitted(permissions, write, privileged) {
+			return 0, &MemoryAccessError{address,
+				fmt.Sprintf("MPU region %d permission fault", i)}
+		}
+		return address, nil
+	}
+	return 0, &MemoryAccessError{address, "Address outside of MPU regions"}
+}
+
+// Debugging tools may read any address, so nothing is checked.
+func (c *CP15MPU) debugTranslate(address uint32) (uint32, error) {
+	return address, nil
+}
+
+func (c *CP15MPU) externalAbort(address uint32, fetch bool) error {
+	return &MemoryAccessError{address, "External abort"}
+}
+
+func (c *CP15MPU) setBigEndianBit(bigEndian bool) {
+	if bigEndian {
+		c.control |= cp15ControlBigEndian
+	} else {
+		c.control &= ^cp15ControlBigEndian
+	}
+}
+
+// Creates a CP15 coprocessor with an ARM940T-style protection unit and adds
+// it to the processor. The processor's memory interface is replaced with one
+// which checks accesses using the protection unit before passing them on to
+// the previous memory interface. The protection unit starts out disabled.
+// Architectural exceptions must be enabled for failed checks to cause aborts.
+func AddCP15MPU(p ARMProcessor) (*CP15MPU, error) {
+	var c CP15MPU
+	c.ID = 0x41129400
+	c.processor = p
+	c.physical = p.GetMemoryInterface()
+	c.control = cp15ControlFixedBits
+	if c.physical.IsBigEndian() {
+		c.control |= cp15ControlBigEndian
+	}
+	if p.HighVectors() {
+		c.control |= cp15ControlHighVectors
+	}
+	installTranslatingMemory(p, &c)
+	e := p.AddCoprocessor(&c)
+	if e != nil {
+		return nil, fmt.Errorf("Failed adding CP15: %s", e)
+	}
+	return &c, nil
+}
@@ -0,0 +1,139 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func TestMPURegisters(t *testing.T) {
+	p := NewARMProcessor()
+	p.GetMemoryInterface().SetMemoryRegion(0, make([]byte, 0x10000))
+	mpu, e := AddCP15MPU(p)
+	if e != nil {
+		t.Logf("Failed adding the MPU: %s\n", e)
+		t.FailNow()
+	}
+	p.SetMode(supervisorMode)
+	// Region 0 covers 64KB at address 0, region 1 covers 4KB at 0x8000.
+	p.SetRegister(0, 0x0000001f)
+	p.SetRegister(1, 0x00008017)
+	p.SetRegister(2, 0x00000007)
+	p.SetRegister(3, 0x00000003)
+	p.SetRegister(4, 0x00000001)
+	program := []uint32{
+		// mcr p15, 0, r0, c6, c0, 0 (data region 0)
+		0xee060f10,
+		// mcr p15, 0, r1, c6, c1, 0 (data region 1)
+		0xee061f11,
+		// mcr p15, 0, r0, c6, c0, 1 (instruction region 0)
+		0xee060f30,
+		// mcr p15, 0, r1, c6, c1, 1 (instruction region 1)
+		0xee061f31,
+		// mcr p15, 0, r2, c5, c0, 0 (data access permissions)
+		0xee052f10,
+		// mcr p15, 0, r3, c5, c0, 1 (instruction access permissions)
+		0xee053f30,
+		// mcr p15, 0, r4, c1, c0, 0 (control, enabling the MPU)
+		0xee014f10,
+		// mrc p15, 0, r5, c6, c1, 1
+		0xee165f31,
+		// mrc p15, 0, r6, c0, c0, 0
+		0xee106f10,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(5)
+	if value != 0x00008017 {
+		t.Logf("Read incorrect region register: 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(6)
+	if value != 0x41129400 {
+		t.Logf("Read incorrect ID register: 0x%08x\n", value)
+		t.Fail()
+	}
+	base, size, enabled := mpu.Region(1, false)
+	if (base != 0x8000) || (size != 0x1000) || !enabled {
+		t.Logf("Got incorrect region 1: 0x%08x, 0x%x, %v\n", base, size,
+			enabled)
+		t.Fail()
+	}
+	if mpu.Control() != 0x79 {
+		t.Logf("Got incorrect control register: 0x%08x\n", mpu.Control())
+		t.Fail()
+	}
+}
+
+func TestMPUPermissions(t *testing.T) {
+	p := NewARMProcessor()
+	p.GetMemoryInterface().SetMemoryRegion(0, make([]byte, 0x10000))
+	mpu, e := AddCP15MPU(p)
+	if e != nil {
+		t.Logf("Failed adding the MPU: %s\n", e)
+		t.FailNow()
+	}
+	p.SetArchitecturalExceptions(true)
+	// Region 0 is accessible by all modes, region 1 is only accessible in
+	// privileged modes and can't be executed. Region 2 (at 0xa000) is
+	// read-only in user mode.
+	mpu.regions[mpuData][0] = 0x0000001f
+	mpu.regions[mpuData][1] = 0x00008017
+	mpu.regions[mpuData][2] = 0x0000a017
+	mpu.regions[mpuInstruction][0] = 0x0000001f
+	mpu.regions[mpuInstruction][1] = 0x00008017
+	mpu.accessPermissions[mpuData] = 0x27
+	mpu.accessPermissions[mpuInstruction] = 0x03
+	mpu.setControl(cp15ControlProtectionUnit)
+	memory := p.GetMemoryInterface()
+	tests := []struct {
+		address uint32
+		write   bool
+		mode    uint8
+		allowed bool
+	}{
+		{0x1000, true, userMode, true},
+		{0x8000, false, userMode, false},
+		{0x8000, true, supervisorMode, true},
+		{0xa000, false, userMode, true},
+		{0xa000, true, userMode, false},
+		{0xa000, true, systemMode, true},
+		{0x10000, false, supervisorMode, false},
+	}
+	for _, test := range tests {
+		p.SetMode(test.mode)
+		if test.write {
+			e = memory.WriteMemoryWord(test.address, 1)
+		} else {
+			_, e = memory.ReadMemoryWord(test.address)
+		}
+		if (e == nil) != test.allowed {
+			t.Logf("Access to 0x%08x (write = %v) in mode 0x%02x: %v\n",
+				test.address, test.write, test.mode, e)
+			t.Fail()
+		}
+	}
+	// ldr r0, [r1] in user mode, from a privileged region
+	p.SetCPSR(uint32(userMode))
+	p.SetRegister(1, 0x8000)
+	e = testSingleInstruction(0xe5910000, p)
+	if e != nil {
+		t.Logf("Got an error for a data abort: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0x10, 4104, t)
+	// Executing code in region 1 causes a prefetch abort, even though it can
+	// be read.
+	p.SetRegister(15, 0x8000)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Got an error for a prefetch abort: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0xc, 0x8004, t)
+}
@@ -0,0 +1,248 @@
+package arm_emulate
+
+// This file implements execution breakpoints, data watchpoints and a run loop
+// which stops when they're hit.
+
+import (
+	"fmt"
+)
+
+// If a breakpoint has a condition, it only stops execution if the condition
+// returns true. It's called before the instruction at the breakpoint runs.
+type BreakpointCondition func(p ARMProcessor) bool
+
+type Breakpoint struct {
+	Address uint32
+	// This may be nil if the breakpoint is unconditional.
+	Condition BreakpointCondition
+}
+
+type WatchpointType uint8
+
+const (
+	WatchRead   WatchpointType = 1
+	WatchWrite  WatchpointType = 2
+	WatchAccess WatchpointType = WatchRead | WatchWrite
+)
+
+func (t WatchpointType) String() string {
+	switch t {
+	case WatchRead:
+		return "read"
+	case WatchWrite:
+		return "write"
+	case WatchAccess:
+		return "access"
+	}
+	return fmt.Sprintf("<invalid watchpoint type %d>", uint8(t))
+}
+
+// Watches the Size bytes starting at Address for the given type of access.
+type Watchpoint struct {
+	Type    WatchpointType
+	Address uint32
+	Size    uint32
+}
+
+// Returns true if the watchpoint covers any part of the given access.
+func (w *Watchpoint) matches(address uint32, size uint8, write bool) bool {
+	if write && ((w.Type & WatchWrite) == 0) {
+		return false
+	}
+	if !write && ((w.Type & WatchRead) == 0) {
+		return false
+	}
+	start := uint64(w.Address)
+	end := start + uint64(w.Size)
+	return (uint64(address) < end) && ((uint64(address) + uint64(size)) > start)
+}
+
+// Indicates why the Run function returned. This will be one of the *Stop
+// types defined below.
+type StopReason interface {
+	String() string
+}
+
+// Execution stopped before running the instruction at a breakpoint.
+type BreakpointStop struct {
+	Address uint32
+}
+
+func (s *BreakpointStop) String() string {
+	return fmt.Sprintf("Breakpoint at 0x%08x", s.Address)
+}
+
+// Execution stopped after an instruction accessed a watched location.
+type WatchpointStop struct {
+	Watchpoint Watchpoint
+	// The address and size of the access, and the value read or written.
+	Address uint32
+	Size    uint8
+	Value   uint32
+	Write   bool
+}
+
+func (s *WatchpointStop) String() string {
+	access := "Read"
+	if s.Write {
+		access = "Write"
+	}
+	return fmt.Sprintf("%s of 0x%x at 0x%08x (%s watchpoint at 0x%08x)",
+		access, s.Value, s.Address, s.Watchpoint.Type, s.Watchpoint.Address)
+}
+
+// Execution stopped because RunNextInstruction returned an error.
+type ErrorStop struct {
+	Error error
+}
+
+func (s *ErrorStop) String() string {
+	return fmt.Sprintf("Error: %s", s.Error)
+}
+
+// The maximum number of instructions passed to Run have been executed.
+type BudgetExhaustedStop struct {
+	InstructionsRun uint64
+}
+
+func (s *BudgetExhaustedStop) String() string {
+	return fmt.Sprintf("Stopped after %d instructions", s.InstructionsRun)
+}
+
+// Holds breakpoints and watchpoints, and implements the related parts of the
+// ARMProcessor interface. This is embedded in processor implementations.
+type debugEngine struct {
+	breakpoints []Breakpoint
+	watchpoints []Watchpoint
+	// Memory accesses are only checked against watchpoints while this is set,
+	// so that instruction fetches and accesses by the debugger are ignored.
+	watching bool
+	watchHit *WatchpointStop
+	// Set if the last call to Run stopped at a breakpoint at this address, so
+	// that the next call can resume past it.
+	stoppedAtBreakpoint bool
+	stopAddress         uint32
+}
+
+func (d *debugEngine) AddBreakpoint(address uint32,
+	condition BreakpointCondition) error {
+	for i := range d.breakpoints {
+		if d.breakpoints[i].Address == address {
+			d.breakpoints[i].Condition = condition
+			return nil
+		}
+	}
+	d.breakpoints = append(d.breakpoints, Breakpoint{address, condition})
+	return nil
+}
+
+func (d *debugEngine) RemoveBreakpoint(address uint32) error {
+	for i := range d.breakpoints {
+		if d.breakpoints[i].Address == address {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No breakpoint at 0x%08x", address)
+}
+
+func (d *debugEngine) GetBreakpoints() []Breakpoint {
+	toReturn := make([]Breakpoint, len(d.breakpoints))
+	copy(toReturn, d.breakpoints)
+	return toReturn
+}
+
+func (d *debugEngine) AddWatchpoint(w Watchpoint) error {
+	if (w.Type & WatchAccess) == 0 {
+		return fmt.Errorf("Invalid watchpoint type: %d", w.Type)
+	}
+	if w.Size == 0 {
+		return fmt.Errorf("Watchpoints must cover at least one byte")
+	}
+	for _, existing := range d.watchpoints {
+		if existing == w {
+			return nil
+		}
+	}
+	d.watchpoints = append(d.watchpoints, w)
+	return nil
+}
+
+func (d *debugEngine) RemoveWatchpoint(w Watchpoint) error {
+	for i := range d.watchpoints {
+		if d.watchpoints[i] == w {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No %s watchpoint at 0x%08x", w.Type, w.Address)
+}
+
+func (d *debugEngine) GetWatchpoints() []Watchpoint {
+	toReturn := make([]Watchpoint, len(d.watchpoints))
+	copy(toReturn, d.watchpoints)
+	return toReturn
+}
+
+// This is the MemoryAccessHook installed in the processor's memory. Only the
+// first matching access during an instruction is recorded.
+func (d *debugEngine) checkMemoryAccess(address uint32, size uint8,
+	value uint32, write bool) {
+	if !d.watching || (d.watchHit != nil) {
+		return
+	}
+	for _, w := range d.watchpoints {
+		if !w.matches(address, size, write) {
+			continue
+		}
+		d.watchHit = &WatchpointStop{
+			Watchpoint: w,
+			Address:    address,
+			Size:       size,
+			Value:      value,
+			Write:      write,
+		}
+		return
+	}
+}
+
+// Returns true if execution should stop at a breakpoint at the given address.
+func (d *debugEngine) breakpointHit(p ARMProcessor, address uint32) bool {
+	for _, b := range d.breakpoints {
+		if b.Address != address {
+			continue
+		}
+		return (b.Condition == nil) || b.Condition(p)
+	}
+	return false
+}
+
+// Implements the Run function for the given processor, which must embed d.
+func (d *debugEngine) run(p ARMProcessor, maxInstructions uint64) StopReason {
+	resuming := d.stoppedAtBreakpoint
+	d.stoppedAtBreakpoint = false
+	count := uint64(0)
+	for (maxInstructions == 0) || (count < maxInstructions) {
+		pc, e := p.GetRegister(15)
+		if e != nil {
+			return &ErrorStop{e}
+		}
+		// Don't stop at the same breakpoint again when resuming from it.
+		skipBreakpoint := resuming && (count == 0) && (pc == d.stopAddress)
+		if !skipBreakpoint && d.breakpointHit(p, pc) {
+			d.stoppedAtBreakpoint = true
+			d.stopAddress = pc
+			return &BreakpointStop{pc}
+		}
+		d.watchHit = nil
+		e = p.RunNextInstruction()
+		count++
+		if e != nil {
+			return &ErrorStop{e}
+		}
+		if d.watchHit != nil {
+			return d.watchHit
+		}
+	}
+	return &BudgetExhaustedStop{count}
+}
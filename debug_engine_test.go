@@ -0,0 +1,139 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func TestBreakpoints(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint32{
+		// mov r0, 0
+		0xe3a00000,
+		// loop: add r0, r0, 1; b loop
+		0xe2800001, 0xeafffffd,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	reason := p.Run(10)
+	budgetStop, ok := reason.(*BudgetExhaustedStop)
+	if !ok || (budgetStop.InstructionsRun != 10) {
+		t.Logf("Expected to run out of instructions, got %s\n", reason)
+		t.Fail()
+	}
+	// Only stop at the add once r0 reaches 20.
+	p.AddBreakpoint(4100, func(p ARMProcessor) bool {
+		value, _ := p.GetRegister(0)
+		return value == 20
+	})
+	reason = p.Run(0)
+	breakpointStop, ok := reason.(*BreakpointStop)
+	if !ok || (breakpointStop.Address != 4100) {
+		t.Logf("Expected to stop at the breakpoint, got %s\n", reason)
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(0)
+	if value != 20 {
+		t.Logf("Stopped at the breakpoint with r0 = %d, not 20\n", value)
+		t.Fail()
+	}
+	// Replace the condition, and make sure we resume past the breakpoint.
+	p.AddBreakpoint(4100, nil)
+	if len(p.GetBreakpoints()) != 1 {
+		t.Logf("Expected 1 breakpoint, got %v\n", p.GetBreakpoints())
+		t.Fail()
+	}
+	reason = p.Run(0)
+	if _, ok = reason.(*BreakpointStop); !ok {
+		t.Logf("Expected to stop at the breakpoint again, got %s\n", reason)
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(0)
+	if value != 21 {
+		t.Logf("Expected r0 to be 21 after resuming, got %d\n", value)
+		t.Fail()
+	}
+	e = p.RemoveBreakpoint(4100)
+	if e != nil {
+		t.Logf("Failed removing breakpoint: %s\n", e)
+		t.Fail()
+	}
+	e = p.RemoveBreakpoint(4100)
+	if e == nil {
+		t.Logf("Didn't get an error removing a missing breakpoint.\n")
+		t.Fail()
+	}
+	// Running into unmapped memory should produce an error.
+	p.SetRegister(15, 0x10000)
+	reason = p.Run(0)
+	if _, ok = reason.(*ErrorStop); !ok {
+		t.Logf("Expected an error stop, got %s\n", reason)
+		t.Fail()
+	}
+}
+
+func TestWatchpoints(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint32{
+		// mov r0, 0x1800; mov r1, 0x55
+		0xe3a00b06, 0xe3a01055,
+		// ldr r2, [r0]; strb r1, [r0, 2]; ldrh r3, [r0, 2]
+		0xe5902000, 0xe5c01002, 0xe1d030b2,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	m.WriteMemoryWord(0x1800, 0x12345678)
+	p.AddWatchpoint(Watchpoint{WatchWrite, 0x1802, 1})
+	p.AddWatchpoint(Watchpoint{WatchRead, 0x1803, 1})
+	if len(p.GetWatchpoints()) != 2 {
+		t.Logf("Expected 2 watchpoints, got %v\n", p.GetWatchpoints())
+		t.Fail()
+	}
+	// Accesses outside of emulation shouldn't hit watchpoints.
+	m.ReadMemoryWord(0x1800)
+	p.SetRegister(15, 4096)
+	reason := p.Run(0)
+	watchStop, ok := reason.(*WatchpointStop)
+	if !ok {
+		t.Logf("Expected to stop at a watchpoint, got %s\n", reason)
+		t.FailNow()
+	}
+	if watchStop.Write || (watchStop.Address != 0x1800) ||
+		(watchStop.Size != 4) || (watchStop.Value != 0x12345678) {
+		t.Logf("Incorrect word read watchpoint stop: %s\n", reason)
+		t.Fail()
+	}
+	reason = p.Run(0)
+	watchStop, ok = reason.(*WatchpointStop)
+	if !ok || !watchStop.Write || (watchStop.Address != 0x1802) ||
+		(watchStop.Value != 0x55) {
+		t.Logf("Incorrect byte write watchpoint stop: %s\n", reason)
+		t.Fail()
+	}
+	e = p.RemoveWatchpoint(Watchpoint{WatchRead, 0x1803, 1})
+	if e != nil {
+		t.Logf("Failed removing watchpoint: %s\n", e)
+		t.Fail()
+	}
+	reason = p.Run(1)
+	if _, ok = reason.(*BudgetExhaustedStop); !ok {
+		t.Logf("Removed watchpoint still stopped execution: %s\n", reason)
+		t.Fail()
+	}
+	e = p.AddWatchpoint(Watchpoint{WatchAccess, 0x1800, 0})
+	if e == nil {
+		t.Logf("Didn't get an error for an empty watchpoint.\n")
+		t.Fail()
+	}
+}
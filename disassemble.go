@@ -0,0 +1,266 @@
+package arm_emulate
+
+// This file contains the Disassembler, which formats instructions at known
+// addresses, so that branch targets and PC-relative loads can be printed as
+// absolute addresses or symbols.
+
+import (
+	"fmt"
+)
+
+// Maps addresses to symbols when disassembling. This returns the name of the
+// symbol containing the address, or the closest one before it, along with the
+// address's offset from the start of the symbol. The boolean is false if no
+// symbol was found. ELFSymbolTable implements this interface.
+type SymbolResolver interface {
+	ResolveSymbol(address uint32) (string, uint32, bool)
+}
+
+// Implemented by instructions with an operand relative to the PC, such as
+// branches and literal loads.
+type pcRelativeInstruction interface {
+	// Returns the address the instruction refers to, given the value read
+	// from the PC. The boolean is false if this instance doesn't use the PC.
+	pcRelativeTarget(pc uint32) (uint32, bool)
+	// Formats the instruction using the given string in place of the offset.
+	pcRelativeString(target string) string
+}
+
+// Selects the syntax used by a Disassembler.
+type DisassemblySyntax uint8
+
+const (
+	// The syntax printed by the instructions' String methods.
+	LegacySyntax DisassemblySyntax = iota
+	// ARM's Unified Assembler Language, formatted like the output of GNU
+	// objdump.
+	UALSyntax
+)
+
+// Formats instructions along with their addresses. The zero value prints
+// targets as hexadecimal addresses.
+type Disassembler struct {
+	// If this is set, targets are printed as a symbol and an offset.
+	Symbols SymbolResolver
+	// If this is set, words loaded relative to the PC are read from it and
+	// printed in a comment. The other halves of THUMB bl instructions are
+	// also read from it. Reading the processor's memory this way doesn't
+	// record faults in CP15.
+	Memory ARMMemory
+	// In UALSyntax, instructions in IT blocks are printed with the block's
+	// conditions, so THUMB code should be disassembled in order.
+	Syntax DisassemblySyntax
+	// The state of the IT block containing the instruction at itAddress.
+	itState   uint8
+	itAddress uint32
+}
+
+// Returns the address as "symbol+offset", or in hexadecimal if it doesn't
+// belong to a symbol.
+func (d *Disassembler) AddressString(address uint32) string {
+	if d.Symbols != nil {
+		name, offset, found := d.Symbols.ResolveSymbol(address)
+		if found && (offset == 0) {
+			return name
+		}
+		if found {
+			return fmt.Sprintf("%s+0x%x", name, offset)
+		}
+	}
+	return fmt.Sprintf("0x%08x", address)
+}
+
+// Returns the disassembly of the ARM instruction at the given address.
+func (d *Disassembler) ARMString(n ARMInstruction, address uint32) string {
+	if d.Syntax == UALSyntax {
+		return ualInstructionString(n, &ualFormatter{d: d, pc: address + 8})
+	}
+	return d.instructionString(n, address+8)
+}
+
+// Returns the disassembly of the 16-bit THUMB instruction at the given
+// address.
+func (d *Disassembler) THUMBString(n THUMBInstruction,
+	address uint32) string {
+	if d.Syntax == UALSyntax {
+		return d.thumbUALString(n, address, 2)
+	}
+	branch, ok := n.(*LongBranchAndLinkInstruction)
+	if ok {
+		return d.longBranchString(branch, address)
+	}
+	return d.instructionString(n, address+4)
+}
+
+// Returns the disassembly of the 32-bit Thumb-2 instruction at the given
+// address.
+func (d *Disassembler) THUMB2String(n THUMB2Instruction,
+	address uint32) string {
+	if d.Syntax == UALSyntax {
+		return d.thumbUALString(n, address, 4)
+	}
+	return d.instructionString(n, address+4)
+}
+
+// Returns the instruction's UAL disassembly, or its String if it doesn't
+// support UAL.
+func ualInstructionString(n fmt.Stringer, f *ualFormatter) string {
+	u, ok := n.(ualInstruction)
+	if !ok {
+		return n.String()
+	}
+	return u.ualString(f)
+}
+
+// Formats a THUMB or Thumb-2 instruction of the given size using UAL, taking
+// the condition from the IT block if the instruction follows the previous
+// instruction in the block.
+func (d *Disassembler) thumbUALString(n fmt.Stringer, address,
+	size uint32) string {
+	f := ualFormatter{d: d, pc: address + 4, thumb: true}
+	if ((d.itState & 0xf) != 0) && (address == d.itAddress) {
+		f.itState = d.itState
+		d.itState = advanceITState(d.itState)
+		d.itAddress = address + size
+	} else {
+		d.itState = 0
+	}
+	switch n := n.(type) {
+	case *IfThenTHUMBInstruction:
+		d.itState = (uint8(n.FirstCondition) << 4) | (n.Mask & 0xf)
+		d.itAddress = address + 2
+	case *LongBranchAndLinkInstruction:
+		return d.longBranchUALString(n, address, &f)
+	}
+	return ualInstructionString(n, &f)
+}
+
+func (d *Disassembler) instructionString(n fmt.Stringer, pc uint32) string {
+	relative, ok := n.(pcRelativeInstruction)
+	if !ok {
+		return n.String()
+	}
+	target, ok := relative.pcRelativeTarget(pc)
+	if !ok {
+		return n.String()
+	}
+	text := relative.pcRelativeString(d.AddressString(target))
+	if isLiteralWordLoad(n) {
+		text += d.literalComment(target)
+	}
+	return text
+}
+
+// Returns true if the instruction loads a word relative to the PC.
+func isLiteralWordLoad(n fmt.Stringer) bool {
+	switch n := n.(type) {
+	case *SingleDataTransferInstruction:
+		return n.Load && !n.ByteQuantity
+	case *PcRelativeLoadInstruction:
+		return true
+	case *LoadStoreTHUMB2Instruction:
+		return n.Load && (n.Size == 2)
+	}
+	return false
+}
+
+// Returns a comment containing the word at the given address, which is also
+// named if it's the address of a symbol. Returns an empty string if the word
+// can't be read.
+func (d *Disassembler) literalComment(address uint32) string {
+	if d.Memory == nil {
+		return ""
+	}
+	value, e := debugMemory(d.Memory).ReadMemoryWord(address)
+	if e != nil {
+		return ""
+	}
+	comment := fmt.Sprintf(" ; =0x%08x", value)
+	if d.Symbols == nil {
+		return comment
+	}
+	name, offset, found := d.Symbols.ResolveSymbol(value)
+	if (!found || (offset != 0)) && ((value & 1) != 0) {
+		// Pointers to THUMB functions have bit 0 set.
+		name, offset, found = d.Symbols.ResolveSymbol(value &^ 1)
+	}
+	if found && (offset == 0) {
+		comment += " (" + name + ")"
+	}
+	return comment
+}
+
+// Returns the target of the bl or blx made up of the two halfwords, the first
+// of which is at the given address.
+func longBranchTarget(address uint32, high, low uint16) uint32 {
+	target := address + 4 + uint32(int32(uint32(high&0x7ff)<<21)>>9) +
+		(uint32(low&0x7ff) << 1)
+	if (low & 0xf800) == 0xe800 {
+		// blx switches to ARM state, so its target is word-aligned.
+		target &^= 3
+	}
+	return target
+}
+
+// THUMB bl and blx instructions are made up of two halfwords, so the other
+// half is read from memory. Returns the mnemonic and target of the complete
+// instruction, or false if the halves don't form a bl or blx.
+func (d *Disassembler) longBranch(n *LongBranchAndLinkInstruction,
+	address uint32) (string, uint32, bool) {
+	if d.Memory == nil {
+		return "", 0, false
+	}
+	var first uint32
+	var high, low uint16
+	var e error
+	if n.OffsetLow {
+		first = address - 2
+		low = 0xf800 | n.Offset
+		if n.Exchange {
+			low = 0xe800 | n.Offset
+		}
+		high, e = fetchInstructionHalfword(debugMemory(d.Memory), first)
+	} else {
+		first = address
+		high = 0xf000 | n.Offset
+		low, e = fetchInstructionHalfword(debugMemory(d.Memory), address+2)
+	}
+	if (e != nil) || ((high & 0xf800) != 0xf000) ||
+		(((low & 0xf800) != 0xf800) && ((low & 0xf800) != 0xe800)) {
+		return "", 0, false
+	}
+	mnemonic := "bl"
+	if (low & 0xf800) == 0xe800 {
+		mnemonic = "blx"
+	}
+	return mnemonic, longBranchTarget(first, high, low), true
+}
+
+func (d *Disassembler) longBranchString(n *LongBranchAndLinkInstruction,
+	address uint32) string {
+	mnemonic, target, ok := d.longBranch(n, address)
+	if !ok {
+		return n.String()
+	}
+	half := "first"
+	if n.OffsetLow {
+		half = "second"
+	}
+	return fmt.Sprintf("%s %s (%s half)", mnemonic, d.AddressString(target),
+		half)
+}
+
+// Like objdump, the complete bl is printed at its first half, while the
+// second half is marked with a comment.
+func (d *Disassembler) longBranchUALString(n *LongBranchAndLinkInstruction,
+	address uint32, f *ualFormatter) string {
+	mnemonic, target, ok := d.longBranch(n, address)
+	if !ok {
+		return n.String()
+	}
+	s := mnemonic + f.condition(14) + "\t" + f.address(target)
+	if n.OffsetLow {
+		s += "\t; (second half)"
+	}
+	return s
+}
@@ -0,0 +1,211 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+// Returns memory and symbols containing a short ARM function at 0x8000, a
+// THUMB function at 0x9000 and a data object at 0xa000.
+func getDisassemblerTestData(t *testing.T) (ARMMemory, *ELFSymbolTable) {
+	m := NewARMMemory()
+	e := m.SetMemoryRegion(0x8000, make([]byte, 0x2000))
+	if e != nil {
+		t.Logf("Failed mapping memory: %s\n", e)
+		t.FailNow()
+	}
+	arm := []uint32{
+		// bl main+0x10; b main+0x4; ldr r0, [pc, 8]; ldr r1, [pc, -4]
+		0xeb000002, 0xeafffffe, 0xe59f0008, 0xe51f1004,
+		// bx lr; nop; .word table
+		0xe12fff1e, 0xe1a00000, 0x0000a000,
+	}
+	for i, word := range arm {
+		e = m.WriteMemoryWord(0x8000+uint32(i)*4, word)
+		if e != nil {
+			t.Logf("Failed writing ARM code: %s\n", e)
+			t.FailNow()
+		}
+	}
+	thumb := []uint16{
+		// bl (2 halfwords); ldr r0, [pc, 4]; b .; cbz r0, 2; add r1, pc, 4
+		0xf000, 0xf810, 0x4801, 0xe7fe, 0xb108, 0xa101,
+	}
+	for i, halfword := range thumb {
+		e = m.WriteMemoryHalfword(0x9000+uint32(i)*2, halfword)
+		if e != nil {
+			t.Logf("Failed writing THUMB code: %s\n", e)
+			t.FailNow()
+		}
+	}
+	// A pointer to thumb_func, with bit 0 set.
+	m.WriteMemoryWord(0x900c, 0x9001)
+	symbols := &ELFSymbolTable{Symbols: []ELFSymbol{
+		{Name: "main", Address: 0x8000, Size: 0x1c, IsFunction: true},
+		{Name: "$a", Address: 0x8000},
+		{Name: "$d", Address: 0x8018},
+		{Name: "thumb_func", Address: 0x9000, Size: 0x10, IsFunction: true,
+			IsTHUMB: true},
+		{Name: "$t", Address: 0x9000},
+		{Name: "table", Address: 0xa000, Size: 0x10, IsObject: true},
+	}}
+	return m, symbols
+}
+
+func TestResolveSymbol(t *testing.T) {
+	_, symbols := getDisassemblerTestData(t)
+	name, offset, found := symbols.ResolveSymbol(0x8018)
+	if !found || (name != "main") || (offset != 0x18) {
+		t.Logf("Expected main+0x18 for 0x8018, got %s+0x%x (%v)\n", name,
+			offset, found)
+		t.Fail()
+	}
+	name, offset, found = symbols.ResolveSymbol(0x9000)
+	if !found || (name != "thumb_func") || (offset != 0) {
+		t.Logf("Expected thumb_func for 0x9000, got %s+0x%x (%v)\n", name,
+			offset, found)
+		t.Fail()
+	}
+	_, _, found = symbols.ResolveSymbol(0x7ffc)
+	if found {
+		t.Logf("Resolved an address before any symbol.\n")
+		t.Fail()
+	}
+	mappingSymbols := map[string]bool{"$a": true, "$t": true, "$d": true,
+		"$d.realdata": true, "$x": false, "$a0": false, "$": false,
+		"main": false}
+	for name, expected := range mappingSymbols {
+		s := ELFSymbol{Name: name}
+		if s.IsMappingSymbol() != expected {
+			t.Logf("Wrong mapping symbol status for %q.\n", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestDisassembleARM(t *testing.T) {
+	m, symbols := getDisassemblerTestData(t)
+	d := Disassembler{Symbols: symbols, Memory: m}
+	plain := Disassembler{}
+	expected := map[uint32][2]string{
+		0x8000: {"bl main+0x10", "bl 0x00008010"},
+		0x8004: {"b main+0x4", "b 0x00008004"},
+		0x8008: {"ldr r0, main+0x18 ; =0x0000a000 (table)",
+			"ldr r0, 0x00008018"},
+		0x800c: {"ldr r1, main+0x10 ; =0xe12fff1e", "ldr r1, 0x00008010"},
+		0x8010: {"bx lr", "bx lr"},
+	}
+	for address, strings := range expected {
+		raw, _ := m.ReadMemoryWord(address)
+		instruction, e := ParseInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.FailNow()
+		}
+		s := d.ARMString(instruction, address)
+		if s != strings[0] {
+			t.Logf("Expected \"%s\" at 0x%08x, got \"%s\"\n", strings[0],
+				address, s)
+			t.Fail()
+		}
+		s = plain.ARMString(instruction, address)
+		if s != strings[1] {
+			t.Logf("Expected \"%s\" without symbols at 0x%08x, got \"%s\"\n",
+				strings[1], address, s)
+			t.Fail()
+		}
+	}
+	// Target addresses should wrap around at the ends of memory.
+	instruction, _ := ParseInstruction(0xebfffffc)
+	s := plain.ARMString(instruction, 0)
+	if s != "bl 0xfffffff8" {
+		t.Logf("Expected a branch to 0xfffffff8, got \"%s\"\n", s)
+		t.Fail()
+	}
+}
+
+func TestDisassembleTHUMB(t *testing.T) {
+	m, symbols := getDisassemblerTestData(t)
+	d := Disassembler{Symbols: symbols, Memory: m}
+	expected := map[uint32]string{
+		0x9000: "bl thumb_func+0x24 (first half)",
+		0x9002: "bl thumb_func+0x24 (second half)",
+		0x9004: "ldr r0, thumb_func+0xc ; =0x00009001 (thumb_func)",
+		0x9006: "b thumb_func+0x6",
+		0x9008: "cbz r0, thumb_func+0xe",
+		0x900a: "adr r1, thumb_func+0x10",
+	}
+	for address, expectedString := range expected {
+		raw, _ := m.ReadMemoryHalfword(address)
+		// cbz requires ARMv7, where the halves of bl are parsed together.
+		architecture := ARMv7
+		if IsTHUMB2Prefix(raw) {
+			architecture = ARMv6
+		}
+		instruction, e := ParseTHUMBInstructionForArchitecture(raw,
+			architecture)
+		if e != nil {
+			t.Logf("Failed parsing 0x%04x: %s\n", raw, e)
+			t.FailNow()
+		}
+		s := d.THUMBString(instruction, address)
+		if s != expectedString {
+			t.Logf("Expected \"%s\" at 0x%08x, got \"%s\"\n", expectedString,
+				address, s)
+			t.Fail()
+		}
+	}
+	// Without memory, the halves of bl can't be combined.
+	instruction, _ := ParseTHUMBInstruction(0xf000)
+	s := (&Disassembler{}).THUMBString(instruction, 0x9000)
+	if s != instruction.String() {
+		t.Logf("Expected \"%s\" without memory, got \"%s\"\n", instruction, s)
+		t.Fail()
+	}
+	thumb2 := map[uint32]string{
+		0xf000f810: "bl thumb_func+0x24",
+		0xf000e810: "blx thumb_func+0x24",
+		0xf43faffe: "beq thumb_func",
+		0xf8df0008: "ldr r0, thumb_func+0xc ; =0x00009001 (thumb_func)",
+	}
+	for raw, expectedString := range thumb2 {
+		instruction, e := ParseTHUMB2Instruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.FailNow()
+		}
+		s := d.THUMB2String(instruction, 0x9000)
+		if s != expectedString {
+			t.Logf("Expected \"%s\" for 0x%08x, got \"%s\"\n", expectedString,
+				raw, s)
+			t.Fail()
+		}
+	}
+}
+
+func TestPendingInstructionSymbols(t *testing.T) {
+	p := NewARMProcessor()
+	m, symbols := getDisassemblerTestData(t)
+	p.SetMemoryInterface(m)
+	p.SetRegister(15, 0x8008)
+	expected := "00008008: e59f0008 ldr r0, 0x00008018 ; =0x0000a000"
+	s := p.PendingInstructionString()
+	if s != expected {
+		t.Logf("Expected \"%s\", got \"%s\"\n", expected, s)
+		t.Fail()
+	}
+	p.SetSymbolResolver(symbols)
+	expected = "00008008: e59f0008 ldr r0, main+0x18 ; =0x0000a000 (table)"
+	s = p.PendingInstructionString()
+	if s != expected {
+		t.Logf("Expected \"%s\", got \"%s\"\n", expected, s)
+		t.Fail()
+	}
+	p.SetTHUMBMode(true)
+	p.SetRegister(15, 0x9002)
+	expected = "00009002: f810 bl thumb_func+0x24 (second half)"
+	s = p.PendingInstructionString()
+	if s != expected {
+		t.Logf("Expected \"%s\", got \"%s\"\n", expected, s)
+		t.Fail()
+	}
+}
@@ -0,0 +1,422 @@
+package arm_emulate
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// This flag in an ARM ELF header's e_flags indicates a BE8 image, where code
+// is little endian and data is big endian.
+const elfARMFlagBE8 = 0x00800000
+
+// Holds information about a single entry in an ELF file's symbol table.
+type ELFSymbol struct {
+	Name string
+	// The symbol's address. For THUMB functions, bit 0 has been cleared.
+	Address uint32
+	Size    uint32
+	// These are set based on the symbol's type and binding.
+	IsFunction bool
+	IsObject   bool
+	IsGlobal   bool
+	// This will be true for function symbols with bit 0 of their value set.
+	IsTHUMB bool
+}
+
+// Contains the symbols loaded from an ELF file, sorted by address.
+type ELFSymbolTable struct {
+	Symbols []ELFSymbol
+}
+
+// Returns the first symbol with the given name. The boolean will be false if
+// no such symbol exists.
+func (t *ELFSymbolTable) Lookup(name string) (ELFSymbol, bool) {
+	for _, s := range t.Symbols {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return ELFSymbol{}, false
+}
+
+// Returns true if the symbol is one of the $a, $t or $d mapping symbols, which
+// mark the start of ARM code, THUMB code or data rather than naming anything.
+func (s *ELFSymbol) IsMappingSymbol() bool {
+	if (len(s.Name) < 2) || (s.Name[0] != '$') {
+		return false
+	}
+	switch s.Name[1] {
+	case 'a', 't', 'd':
+		return (len(s.Name) == 2) || (s.Name[2] == '.')
+	}
+	return false
+}
+
+// Returns the named symbol whose address range contains the given address. If
+// no symbol contains it, this returns the closest symbol at a lower address.
+// The boolean will be false if no symbol at or before the address exists.
+// Mapping symbols are ignored.
+func (t *ELFSymbolTable) ContainingSymbol(address uint32) (ELFSymbol, bool) {
+	// Find the first symbol with an address strictly greater than the target
+	i := sort.Search(len(t.Symbols), func(i int) bool {
+		return t.Symbols[i].Address > address
+	})
+	var closest *ELFSymbol
+	for i--; i >= 0; i-- {
+		s := &(t.Symbols[i])
+		if (s.Name == "") || s.IsMappingSymbol() {
+			continue
+		}
+		if (address - s.Address) < s.Size {
+			return *s, true
+		}
+		if closest == nil {
+			closest = s
+		}
+	}
+	if closest == nil {
+		return ELFSymbol{}, false
+	}
+	return *closest, true
+}
+
+// Implements the SymbolResolver interface using ContainingSymbol.
+func (t *ELFSymbolTable) ResolveSymbol(address uint32) (string, uint32,
+	bool) {
+	s, found := t.ContainingSymbol(address)
+	if !found {
+		return "", 0, false
+	}
+	return s.Name, address - s.Address, true
+}
+
+func convertELFSymbol(s elf.Symbol) ELFSymbol {
+	var toReturn ELFSymbol
+	symbolType := elf.ST_TYPE(s.Info)
+	toReturn.Name = s.Name
+	toReturn.Address = uint32(s.Value)
+	toReturn.Size = uint32(s.Size)
+	toReturn.IsFunction = symbolType == elf.STT_FUNC
+	toReturn.IsObject = symbolType == elf.STT_OBJECT
+	toReturn.IsGlobal = elf.ST_BIND(s.Info) != elf.STB_LOCAL
+	if toReturn.IsFunction && ((toReturn.Address & 1) != 0) {
+		toReturn.IsTHUMB = true
+		toReturn.Address &= 0xfffffffe
+	}
+	return toReturn
+}
+
+// Converts the given symbols, skipping file and section symbols, which don't
+// refer to any address, and any for which keep returns false. The table is
+// sorted by address.
+func newELFSymbolTable(symbols []elf.Symbol,
+	keep func(s *elf.Symbol) bool) *ELFSymbolTable {
+	toReturn := &ELFSymbolTable{
+		Symbols: make([]ELFSymbol, 0, len(symbols)),
+	}
+	for i := range symbols {
+		s := &(symbols[i])
+		symbolType := elf.ST_TYPE(s.Info)
+		if (symbolType == elf.STT_FILE) || (symbolType == elf.STT_SECTION) {
+			continue
+		}
+		if (keep != nil) && !keep(s) {
+			continue
+		}
+		toReturn.Symbols = append(toReturn.Symbols, convertELFSymbol(*s))
+	}
+	sort.SliceStable(toReturn.Symbols, func(a, b int) bool {
+		return toReturn.Symbols[a].Address < toReturn.Symbols[b].Address
+	})
+	return toReturn
+}
+
+// Returns the raw symbols from the given file. An ELF without a symbol table
+// results in an empty list rather than an error.
+func readRawELFSymbols(f *elf.File) ([]elf.Symbol, error) {
+	symbols, e := f.Symbols()
+	if e == elf.ErrNoSymbols {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading ELF symbols: %s", e)
+	}
+	return symbols, nil
+}
+
+// Reads the symbol table from the given file. An ELF without a symbol table
+// results in an empty table rather than an error.
+func readELFSymbols(f *elf.File) (*ELFSymbolTable, error) {
+	symbols, e := readRawELFSymbols(f)
+	if e != nil {
+		return nil, e
+	}
+	return newELFSymbolTable(symbols, nil), nil
+}
+
+// Copies a single PT_LOAD segment into memory, filling any space past the end
+// of the file data (i.e. .bss) with zeros.
+func loadELFSegment(m ARMMemory, segment *elf.Prog) error {
+	if segment.Memsz < segment.Filesz {
+		return fmt.Errorf("Segment at 0x%08x is smaller in memory than in "+
+			"the file", segment.Vaddr)
+	}
+	if (segment.Vaddr + segment.Memsz) > 0x100000000 {
+		return fmt.Errorf("Segment at 0x%08x with size 0x%x doesn't fit in "+
+			"memory", segment.Vaddr, segment.Memsz)
+	}
+	if segment.Memsz == 0 {
+		return nil
+	}
+	data := make([]byte, segment.Memsz)
+	_, e := io.ReadFull(segment.Open(), data[:segment.Filesz])
+	if e != nil {
+		return fmt.Errorf("Failed reading segment at 0x%08x: %s",
+			segment.Vaddr, e)
+	}
+	e = m.SetMemoryRegion(uint32(segment.Vaddr), data)
+	if e != nil {
+		return fmt.Errorf("Failed mapping segment at 0x%08x: %s",
+			segment.Vaddr, e)
+	}
+	return nil
+}
+
+// The debug/elf package doesn't expose every header field (e.g. e_flags or
+// e_phoff), so this reads a 32-bit field from the ELF32 header directly.
+func readELFHeaderWord(f *elf.File, r io.ReaderAt, offset int64) (uint32,
+	error) {
+	var raw [4]byte
+	_, e := r.ReadAt(raw[:], offset)
+	if e != nil {
+		return 0, fmt.Errorf("Failed reading ELF header: %s", e)
+	}
+	return f.ByteOrder.Uint32(raw[:]), nil
+}
+
+// Like readELFHeaderWord, but reads a 64-bit field from an ELF64 header.
+func readELFHeaderDoubleword(f *elf.File, r io.ReaderAt,
+	offset int64) (uint64, error) {
+	var raw [8]byte
+	_, e := r.ReadAt(raw[:], offset)
+	if e != nil {
+		return 0, fmt.Errorf("Failed reading ELF header: %s", e)
+	}
+	return f.ByteOrder.Uint64(raw[:]), nil
+}
+
+// Parses an ELF32 ARM file, returning an error if it's a BE8 image, which
+// isn't supported.
+func openARMELF(r io.ReaderAt) (*elf.File, error) {
+	f, e := elf.NewFile(r)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing ELF: %s", e)
+	}
+	if f.Class != elf.ELFCLASS32 {
+		f.Close()
+		return nil, fmt.Errorf("Not a 32-bit ELF file")
+	}
+	if f.Machine != elf.EM_ARM {
+		f.Close()
+		return nil, fmt.Errorf("Not an ARM ELF file (machine %s)", f.Machine)
+	}
+	// e_flags is at offset 36 in the header.
+	flags, e := readELFHeaderWord(f, r, 36)
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	if (f.Data == elf.ELFDATA2MSB) && ((flags & elfARMFlagBE8) != 0) {
+		f.Close()
+		return nil, fmt.Errorf("BE8 images aren't supported")
+	}
+	return f, nil
+}
+
+// Holds the contents of an executable section in an ELF file.
+type ELFCodeSection struct {
+	Name    string
+	Address uint32
+	Data    []byte
+	// The symbols defined in this section.
+	Symbols *ELFSymbolTable
+}
+
+// Holds the code read from an ELF file by ReadELFCode.
+type ELFCode struct {
+	BigEndian bool
+	// Addresses in relocatable files are relative to each section, so this
+	// will be nil for them. Otherwise it contains the symbols defined in
+	// every section.
+	Symbols  *ELFSymbolTable
+	Sections []ELFCodeSection
+}
+
+// Reads the executable sections and their symbols from an ELF32 ARM file of
+// any type, without loading it into memory.
+func ReadELFCode(r io.ReaderAt) (*ELFCode, error) {
+	f, e := openARMELF(r)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	symbols, e := readRawELFSymbols(f)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := &ELFCode{BigEndian: f.Data == elf.ELFDATA2MSB}
+	if f.Type != elf.ET_REL {
+		toReturn.Symbols = newELFSymbolTable(symbols,
+			func(symbol *elf.Symbol) bool {
+				return (symbol.Section != elf.SHN_UNDEF) &&
+					(symbol.Section < elf.SHN_LORESERVE)
+			})
+	}
+	for i, s := range f.Sections {
+		if (s.Type != elf.SHT_PROGBITS) || ((s.Flags & elf.SHF_ALLOC) == 0) ||
+			((s.Flags & elf.SHF_EXECINSTR) == 0) {
+			continue
+		}
+		content, e := s.Data()
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading section %s: %s", s.Name, e)
+		}
+		index := elf.SectionIndex(i)
+		toReturn.Sections = append(toReturn.Sections, ELFCodeSection{
+			Name:    s.Name,
+			Address: uint32(s.Addr),
+			Data:    content,
+			Symbols: newELFSymbolTable(symbols,
+				func(symbol *elf.Symbol) bool {
+					return symbol.Section == index
+				}),
+		})
+	}
+	return toReturn, nil
+}
+
+// Maps every PT_LOAD segment from the given ELF32 ARM executable into the
+// processor's memory, sets the memory's endianness to match the file, and
+// sets the PC to the ELF's entry point. If bit 0 of the entry point is set,
+// the processor is switched to THUMB mode. Returns the ELF's symbol table.
+func LoadELF(p ARMProcessor, r io.ReaderAt) (*ELFSymbolTable, error) {
+	f, e := openARMELF(r)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	if (f.Type != elf.ET_EXEC) && (f.Type != elf.ET_DYN) {
+		return nil, fmt.Errorf("Can't load ELF file of type %s", f.Type)
+	}
+	bigEndian := f.Data == elf.ELFDATA2MSB
+	symbols, e := readELFSymbols(f)
+	if e != nil {
+		return nil, e
+	}
+	m := p.GetMemoryInterface()
+	e = m.SetBigEndian(bigEndian)
+	if e != nil {
+		return nil, fmt.Errorf("Failed setting memory endianness: %s", e)
+	}
+	for _, segment := range f.Progs {
+		if segment.Type != elf.PT_LOAD {
+			continue
+		}
+		e = loadELFSegment(m, segment)
+		if e != nil {
+			return nil, e
+		}
+	}
+	entry := uint32(f.Entry)
+	e = p.SetTHUMBMode((entry & 1) != 0)
+	if e != nil {
+		return nil, fmt.Errorf("Failed setting THUMB mode for entry: %s", e)
+	}
+	e = p.SetRegister(15, entry&0xfffffffe)
+	if e != nil {
+		return nil, fmt.Errorf("Failed setting PC to the entry point: %s", e)
+	}
+	return symbols, nil
+}
+
+// Like loadELFSegment, but for the 64-bit address space used by A64
+// processors.
+func loadA64ELFSegment(m A64Memory, segment *elf.Prog) error {
+	if segment.Memsz < segment.Filesz {
+		return fmt.Errorf("Segment at 0x%016x is smaller in memory than in "+
+			"the file", segment.Vaddr)
+	}
+	if segment.Memsz == 0 {
+		return nil
+	}
+	data := make([]byte, segment.Memsz)
+	_, e := io.ReadFull(segment.Open(), data[:segment.Filesz])
+	if e != nil {
+		return fmt.Errorf("Failed reading segment at 0x%016x: %s",
+			segment.Vaddr, e)
+	}
+	e = m.SetMemoryRegion(segment.Vaddr, data)
+	if e != nil {
+		return fmt.Errorf("Failed mapping segment at 0x%016x: %s",
+			segment.Vaddr, e)
+	}
+	return nil
+}
+
+// Maps every PT_LOAD segment from the given little-endian ELF64 AArch64
+// executable into the processor's memory, and sets the PC to the ELF's entry
+// point.
+func LoadA64ELF(p A64Processor, r io.ReaderAt) error {
+	f, e := elf.NewFile(r)
+	if e != nil {
+		return fmt.Errorf("Failed parsing ELF: %s", e)
+	}
+	defer f.Close()
+	if f.Class != elf.ELFCLASS64 {
+		return fmt.Errorf("Not a 64-bit ELF file")
+	}
+	if f.Machine != elf.EM_AARCH64 {
+		return fmt.Errorf("Not an AArch64 ELF file (machine %s)", f.Machine)
+	}
+	if f.Data != elf.ELFDATA2LSB {
+		return fmt.Errorf("Big-endian AArch64 images aren't supported")
+	}
+	if (f.Type != elf.ET_EXEC) && (f.Type != elf.ET_DYN) {
+		return fmt.Errorf("Can't load ELF file of type %s", f.Type)
+	}
+	m := p.GetMemoryInterface()
+	for _, segment := range f.Progs {
+		if segment.Type != elf.PT_LOAD {
+			continue
+		}
+		e = loadA64ELFSegment(m, segment)
+		if e != nil {
+			return e
+		}
+	}
+	p.SetPC(f.Entry)
+	return nil
+}
+
+// Like LoadA64ELF, but takes the path to an ELF file.
+func LoadA64ELFFile(p A64Processor, path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	return LoadA64ELF(p, f)
+}
+
+// Like LoadELF, but takes the path to an ELF file.
+func LoadELFFile(p ARMProcessor, path string) (*ELFSymbolTable, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return LoadELF(p, f)
+}
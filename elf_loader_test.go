@@ -0,0 +1,347 @@
+package arm_emulate
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+type testELFSegment struct {
+	address    uint32
+	data       []byte
+	memorySize uint32
+}
+
+type testELFSymbol struct {
+	name  string
+	value uint32
+	size  uint32
+	info  uint8
+}
+
+// Builds a minimal ELF32 ARM executable containing the given segments and a
+// symbol table holding the given symbols.
+func buildTestELF(bigEndian bool, flags, entry uint32,
+	segments []testELFSegment, symbols []testELFSymbol) []byte {
+	var order binary.ByteOrder
+	order = binary.LittleEndian
+	dataEncoding := elf.ELFDATA2LSB
+	if bigEndian {
+		order = binary.BigEndian
+		dataEncoding = elf.ELFDATA2MSB
+	}
+	headerSize := uint32(binary.Size(elf.Header32{}))
+	programHeaderSize := uint32(binary.Size(elf.Prog32{}))
+	sectionHeaderSize := uint32(binary.Size(elf.Section32{}))
+	symbolSize := uint32(binary.Size(elf.Sym32{}))
+
+	// Lay out the segment contents after the program headers.
+	offset := headerSize + uint32(len(segments))*programHeaderSize
+	programHeaders := make([]elf.Prog32, len(segments))
+	for i, s := range segments {
+		programHeaders[i] = elf.Prog32{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    offset,
+			Vaddr:  s.address,
+			Paddr:  s.address,
+			Filesz: uint32(len(s.data)),
+			Memsz:  s.memorySize,
+			Flags:  uint32(elf.PF_R | elf.PF_W | elf.PF_X),
+			Align:  4,
+		}
+		offset += uint32(len(s.data))
+	}
+
+	// Build the symbol and string tables. Both start with a null entry.
+	stringTable := []byte{0}
+	symbolTable := make([]elf.Sym32, 1, len(symbols)+1)
+	for _, s := range symbols {
+		symbolTable = append(symbolTable, elf.Sym32{
+			Name:  uint32(len(stringTable)),
+			Value: s.value,
+			Size:  s.size,
+			Info:  s.info,
+			Shndx: 1,
+		})
+		stringTable = append(stringTable, []byte(s.name)...)
+		stringTable = append(stringTable, 0)
+	}
+	sectionNames := []byte("\x00.symtab\x00.strtab\x00.shstrtab\x00")
+	symbolTableOffset := offset
+	stringTableOffset := symbolTableOffset +
+		uint32(len(symbolTable))*symbolSize
+	sectionNamesOffset := stringTableOffset + uint32(len(stringTable))
+	sectionHeadersOffset := sectionNamesOffset + uint32(len(sectionNames))
+	sectionHeaders := []elf.Section32{
+		elf.Section32{},
+		elf.Section32{
+			Name:    1,
+			Type:    uint32(elf.SHT_SYMTAB),
+			Off:     symbolTableOffset,
+			Size:    uint32(len(symbolTable)) * symbolSize,
+			Link:    2,
+			Info:    1,
+			Entsize: symbolSize,
+		},
+		elf.Section32{
+			Name: 9,
+			Type: uint32(elf.SHT_STRTAB),
+			Off:  stringTableOffset,
+			Size: uint32(len(stringTable)),
+		},
+		elf.Section32{
+			Name: 17,
+			Type: uint32(elf.SHT_STRTAB),
+			Off:  sectionNamesOffset,
+			Size: uint32(len(sectionNames)),
+		},
+	}
+
+	var header elf.Header32
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(dataEncoding)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	header.Type = uint16(elf.ET_EXEC)
+	header.Machine = uint16(elf.EM_ARM)
+	header.Version = uint32(elf.EV_CURRENT)
+	header.Entry = entry
+	header.Phoff = headerSize
+	header.Shoff = sectionHeadersOffset
+	header.Flags = flags
+	header.Ehsize = uint16(headerSize)
+	header.Phentsize = uint16(programHeaderSize)
+	header.Phnum = uint16(len(programHeaders))
+	header.Shentsize = uint16(sectionHeaderSize)
+	header.Shnum = uint16(len(sectionHeaders))
+	header.Shstrndx = 3
+
+	var b bytes.Buffer
+	binary.Write(&b, order, &header)
+	binary.Write(&b, order, programHeaders)
+	for _, s := range segments {
+		b.Write(s.data)
+	}
+	binary.Write(&b, order, symbolTable)
+	b.Write(stringTable)
+	b.Write(sectionNames)
+	binary.Write(&b, order, sectionHeaders)
+	return b.Bytes()
+}
+
+func TestLoadELF(t *testing.T) {
+	segments := []testELFSegment{
+		// add r0, r1, r2
+		testELFSegment{0x8000, []byte{0x02, 0x00, 0x81, 0xe0}, 4},
+		// A .data segment with 4 bytes of .bss following it.
+		testELFSegment{0x10000, []byte{1, 2, 3, 4}, 8},
+	}
+	symbols := []testELFSymbol{
+		testELFSymbol{"counter", 0x10004, 4, byte(elf.STB_GLOBAL)<<4 |
+			byte(elf.STT_OBJECT)},
+		testELFSymbol{"_start", 0x8000, 4, byte(elf.STB_GLOBAL)<<4 |
+			byte(elf.STT_FUNC)},
+	}
+	data := buildTestELF(false, 0x05000000, 0x8000, segments, symbols)
+	p := NewARMProcessor()
+	table, e := LoadELF(p, bytes.NewReader(data))
+	if e != nil {
+		t.Logf("Failed loading ELF: %s\n", e)
+		t.FailNow()
+	}
+	pc, _ := p.GetRegister(15)
+	if pc != 0x8000 {
+		t.Logf("Expected the PC to be 0x8000, got 0x%08x.\n", pc)
+		t.Fail()
+	}
+	if p.THUMBMode() {
+		t.Logf("Processor shouldn't be in THUMB mode.\n")
+		t.Fail()
+	}
+	m := p.GetMemoryInterface()
+	if m.IsBigEndian() {
+		t.Logf("Memory shouldn't be big endian.\n")
+		t.Fail()
+	}
+	value, e := m.ReadMemoryWord(0x10000)
+	if (e != nil) || (value != 0x04030201) {
+		t.Logf("Incorrect .data contents: 0x%08x (%v).\n", value, e)
+		t.Fail()
+	}
+	value, e = m.ReadMemoryWord(0x10004)
+	if (e != nil) || (value != 0) {
+		t.Logf(".bss wasn't zero-filled: 0x%08x (%v).\n", value, e)
+		t.Fail()
+	}
+	p.SetRegister(1, 1000)
+	p.SetRegister(2, 337)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Failed running the loaded code: %s\n", e)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(0)
+	if value != 1337 {
+		t.Logf("Expected 1337 in r0, got %d.\n", value)
+		t.Fail()
+	}
+	if len(table.Symbols) != 2 {
+		t.Logf("Expected 2 symbols, got %d.\n", len(table.Symbols))
+		t.FailNow()
+	}
+	if table.Symbols[0].Name != "_start" {
+		t.Logf("Symbols weren't sorted by address.\n")
+		t.Fail()
+	}
+	symbol, found := table.Lookup("counter")
+	if !found || !symbol.IsObject || !symbol.IsGlobal {
+		t.Logf("Failed looking up the counter symbol: %+v\n", symbol)
+		t.Fail()
+	}
+	symbol, found = table.ContainingSymbol(0x10006)
+	if !found || (symbol.Name != "counter") {
+		t.Logf("Wrong symbol containing 0x10006: %+v\n", symbol)
+		t.Fail()
+	}
+	_, found = table.ContainingSymbol(0x7000)
+	if found {
+		t.Logf("Found a symbol before any symbol's address.\n")
+		t.Fail()
+	}
+}
+
+func TestLoadBigEndianTHUMBELF(t *testing.T) {
+	segments := []testELFSegment{
+		// add r0, r1, r2
+		testELFSegment{0x8000, []byte{0x18, 0x88}, 2},
+	}
+	symbols := []testELFSymbol{
+		testELFSymbol{"_start", 0x8001, 2, byte(elf.STB_GLOBAL)<<4 |
+			byte(elf.STT_FUNC)},
+	}
+	data := buildTestELF(true, 0x05000000, 0x8001, segments, symbols)
+	p := NewARMProcessor()
+	table, e := LoadELF(p, bytes.NewReader(data))
+	if e != nil {
+		t.Logf("Failed loading big endian ELF: %s\n", e)
+		t.FailNow()
+	}
+	if !p.GetMemoryInterface().IsBigEndian() {
+		t.Logf("Memory wasn't set to big endian.\n")
+		t.Fail()
+	}
+	if !p.THUMBMode() {
+		t.Logf("Processor wasn't switched to THUMB mode.\n")
+		t.Fail()
+	}
+	pc, _ := p.GetRegister(15)
+	if pc != 0x8000 {
+		t.Logf("Expected the PC to be 0x8000, got 0x%08x.\n", pc)
+		t.Fail()
+	}
+	p.SetRegister(1, 1000)
+	p.SetRegister(2, 337)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Failed running the loaded THUMB code: %s\n", e)
+		t.Fail()
+	}
+	value, _ := p.GetRegister(0)
+	if value != 1337 {
+		t.Logf("Expected 1337 in r0, got %d.\n", value)
+		t.Fail()
+	}
+	symbol, found := table.Lookup("_start")
+	if !found || !symbol.IsTHUMB || (symbol.Address != 0x8000) {
+		t.Logf("Incorrect THUMB symbol: %+v\n", symbol)
+		t.Fail()
+	}
+	// BE8 images should be rejected.
+	data = buildTestELF(true, 0x05800000, 0x8001, segments, symbols)
+	_, e = LoadELF(NewARMProcessor(), bytes.NewReader(data))
+	if e == nil {
+		t.Logf("Didn't get an error loading a BE8 image.\n")
+		t.Fail()
+	}
+	_, e = ReadELFCode(bytes.NewReader(data))
+	if e == nil {
+		t.Logf("Didn't get an error reading code from a BE8 image.\n")
+		t.Fail()
+	}
+}
+
+// Builds a minimal little-endian ELF64 AArch64 executable with a single
+// PT_LOAD segment containing the given data.
+func buildTestA64ELF(address, entry uint64, data []byte,
+	memorySize uint64) []byte {
+	headerSize := uint64(binary.Size(elf.Header64{}))
+	programHeaderSize := uint64(binary.Size(elf.Prog64{}))
+	programHeader := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_W | elf.PF_X),
+		Off:    headerSize + programHeaderSize,
+		Vaddr:  address,
+		Paddr:  address,
+		Filesz: uint64(len(data)),
+		Memsz:  memorySize,
+		Align:  4096,
+	}
+	var header elf.Header64
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	header.Type = uint16(elf.ET_EXEC)
+	header.Machine = uint16(elf.EM_AARCH64)
+	header.Version = uint32(elf.EV_CURRENT)
+	header.Entry = entry
+	header.Phoff = headerSize
+	header.Ehsize = uint16(headerSize)
+	header.Phentsize = uint16(programHeaderSize)
+	header.Phnum = 1
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &header)
+	binary.Write(&b, binary.LittleEndian, &programHeader)
+	b.Write(data)
+	return b.Bytes()
+}
+
+func TestLoadA64ELF(t *testing.T) {
+	// add x0, x1, x2, followed by 4 bytes of .bss
+	data := buildTestA64ELF(0x400000, 0x400000, []byte{0x20, 0x00, 0x02,
+		0x8b}, 8)
+	p := NewA64Processor()
+	e := LoadA64ELF(p, bytes.NewReader(data))
+	if e != nil {
+		t.Logf("Failed loading ELF: %s\n", e)
+		t.FailNow()
+	}
+	if p.GetPC() != 0x400000 {
+		t.Logf("Expected the PC to be 0x400000, got 0x%x.\n", p.GetPC())
+		t.Fail()
+	}
+	value, e := p.GetMemoryInterface().ReadMemoryWord(0x400004)
+	if (e != nil) || (value != 0) {
+		t.Logf("Incorrect .bss contents: 0x%08x (%v)\n", value, e)
+		t.Fail()
+	}
+	p.SetRegister(1, 1000)
+	p.SetRegister(2, 337)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Failed running the loaded code: %s\n", e)
+		t.Fail()
+	}
+	if p.GetRegister(0) != 1337 {
+		t.Logf("Expected 1337 in x0, got %d.\n", p.GetRegister(0))
+		t.Fail()
+	}
+	// 32-bit ARM images should be rejected.
+	data = buildTestELF(false, 0x05000000, 0x8000, nil, nil)
+	e = LoadA64ELF(NewA64Processor(), bytes.NewReader(data))
+	if e == nil {
+		t.Logf("Didn't get an error loading an ELF32 image.\n")
+		t.Fail()
+	}
+}
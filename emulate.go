@@ -102,19 +102,19 @@ func (n *PSRTransferInstruction) Emulate(p ARMProcessor) error {
 		}
 		value, _ = p.GetRegister(n.Rm)
 	}
-	// Prevent user-mode from changing anything except flags.
-	if n.FlagsOnly || (p.GetMode() == userMode) {
-		var currentPSR uint32
-		if n.UseCPSR {
-			currentPSR, e = p.GetCPSR()
-		} else {
-			currentPSR, e = p.GetSPSR()
-		}
-		if e != nil {
-			return e
-		}
-		value = (value & 0xf0000000) | (currentPSR & 0x0fffffff)
+	var currentPSR uint32
+	if n.UseCPSR {
+		currentPSR, e = p.GetCPSR()
+	} else {
+		currentPSR, e = p.GetSPSR()
+	}
+	if e != nil {
+		return e
 	}
+	// Only the condition flags may be written in the top byte. SetCPSR
+	// prevents user mode from changing anything except the flags.
+	mask := psrFieldMask(n.fields()) & (p.Architecture().flagsMask() | 0xffffff)
+	value = (value & mask) | (currentPSR & ^mask)
 	if n.UseCPSR {
 		e = p.SetCPSR(value)
 	} else {
@@ -131,7 +131,10 @@ func (n *MultiplyInstruction) Emulate(p ARMProcessor) error {
 	b, _ := p.GetRegister(n.Rs)
 	if !n.IsLongMultiply {
 		result := uint32(a * b)
-		if n.Accumulate {
+		if n.Subtract {
+			c, _ := p.GetRegister(n.Rn)
+			result = c - result
+		} else if n.Accumulate {
 			c, _ := p.GetRegister(n.Rn)
 			result += c
 		}
@@ -200,6 +203,11 @@ func (n *BranchExchangeInstruction) Emulate(p ARMProcessor) error {
 		return nil
 	}
 	destination, _ := p.GetRegister(n.Rn)
+	if n.Link {
+		// The PC already contains the address of the next instruction.
+		returnAddress, _ := p.GetRegister(15)
+		p.SetRegister(14, returnAddress)
+	}
 	if (destination & 1) == 1 {
 		e = p.SetTHUMBMode(true)
 		if e != nil {
@@ -234,7 +242,12 @@ func (n *HalfwordDataTransferInstruction) Emulate(p ARMProcessor) error {
 		}
 	}
 	var data uint32
-	if n.Load {
+	if n.Doubleword {
+		e = n.transferDoubleword(p, base)
+		if e != nil {
+			return e
+		}
+	} else if n.Load {
 		if n.Halfword {
 			h, e := memory.ReadMemoryHalfword(base)
 			if e != nil {
@@ -279,6 +292,32 @@ func (n *HalfwordDataTransferInstruction) Emulate(p ARMProcessor) error {
 	return nil
 }
 
+// Emulates ldrd and strd, which transfer Rd to or from the given address and
+// the following register to or from the address + 4.
+func (n *HalfwordDataTransferInstruction) transferDoubleword(p ARMProcessor,
+	address uint32) error {
+	memory := p.GetMemoryInterface()
+	if n.Load {
+		low, e := memory.ReadMemoryWord(address)
+		if e != nil {
+			return e
+		}
+		high, e := memory.ReadMemoryWord(address + 4)
+		if e != nil {
+			return e
+		}
+		p.SetRegister(n.Rd, low)
+		return p.SetRegister(n.Rd+1, high)
+	}
+	low, _ := p.GetRegister(n.Rd)
+	high, _ := p.GetRegister(n.Rd + 1)
+	e := memory.WriteMemoryWord(address, low)
+	if e != nil {
+		return e
+	}
+	return memory.WriteMemoryWord(address+4, high)
+}
+
 func (n *SingleDataTransferInstruction) Emulate(p ARMProcessor) error {
 	var e error
 	if !n.Condition().IsMet(p) {
@@ -356,6 +395,11 @@ func (n *SingleDataTransferInstruction) Emulate(p ARMProcessor) error {
 		}
 		p.SetRegister(n.Rn, base)
 	}
+	if n.Load && (n.Rd == 15) {
+		// Loading the PC may also change to THUMB mode.
+		pc, _ := p.GetRegister(15)
+		return writePCInterworking(p, pc)
+	}
 	return nil
 }
 
@@ -447,6 +491,8 @@ func (n *BlockDataTransferInstruction) blockDataLoad(p ARMProcessor) error {
 		}
 		if useUserBank {
 			e = p.SetUserRegister(ARMRegister(registerNumber), value)
+		} else if (registerNumber == 15) && !n.ForceUser {
+			e = writePCInterworking(p, value)
 		} else {
 			e = p.SetRegister(ARMRegister(registerNumber), value)
 		}
@@ -502,10 +548,13 @@ func (n *BranchInstruction) Emulate(p ARMProcessor) error {
 	if n.Link {
 		p.SetRegister(14, uint32(pc))
 	}
-	// Sign-extend the offset and shift it left 2 bits.
-	offset := n.Offset << 8
-	offset = offset >> 6
-	pc += 4 + offset
+	pc += 4 + n.offset()
+	if n.Exchange {
+		e := p.SetTHUMBMode(true)
+		if e != nil {
+			return e
+		}
+	}
 	p.SetRegister(15, uint32(pc))
 	return nil
 }
@@ -516,6 +565,9 @@ func (n *CoprocDataTransferInstruction) Emulate(p ARMProcessor) error {
 		return nil
 	}
 	address, _ := p.GetRegister(n.Rn)
+	if n.Rn == 15 {
+		address += 4
+	}
 	offset := uint32(n.Offset) << 2
 	if n.Preindex {
 		if n.Up {
@@ -524,16 +576,21 @@ func (n *CoprocDataTransferInstruction) Emulate(p ARMProcessor) error {
 			address -= offset
 		}
 	}
+	found := false
 	for _, c := range p.GetCoprocessors() {
 		if c.Number() != n.CoprocNumber {
 			continue
 		}
+		found = true
 		e = c.DataTransfer(p, n.raw, address)
 		if e != nil {
-			return fmt.Errorf("Coprocessor data transfer error: %s", e)
+			return fmt.Errorf("Coprocessor data transfer error: %w", e)
 		}
 		break
 	}
+	if !found && p.ArchitecturalExceptions() {
+		return errUndefinedInstruction
+	}
 	if n.WriteBack {
 		if !n.Preindex {
 			if n.Up {
@@ -558,9 +615,12 @@ func (n *CoprocDataOperationInstruction) Emulate(p ARMProcessor) error {
 		}
 		e = c.Operation(p, n.raw)
 		if e != nil {
-			return fmt.Errorf("Coprocessor operation error: %s", e)
+			return fmt.Errorf("Coprocessor operation error: %w", e)
 		}
-		break
+		return nil
+	}
+	if p.ArchitecturalExceptions() {
+		return errUndefinedInstruction
 	}
 	return nil
 }
@@ -576,24 +636,41 @@ func (n *CoprocRegisterTransferInstruction) Emulate(p ARMProcessor) error {
 		}
 		e = c.RegisterTransfer(p, n.raw, n.Rd, n.Load)
 		if e != nil {
-			return fmt.Errorf("Coprocessor register transfer error: %s", e)
+			return fmt.Errorf("Coprocessor register transfer error: %w", e)
 		}
-		break
+		return nil
+	}
+	if p.ArchitecturalExceptions() {
+		return errUndefinedInstruction
 	}
 	return nil
 }
 
+// Passes the software interrupt to the processor's handlers. Returns true if
+// one of them handled it, in which case the exception shouldn't be taken.
+func handleSoftwareInterrupt(p ARMProcessor, comment uint32) (bool, error) {
+	for _, h := range p.GetSoftwareInterruptHandlers() {
+		handled, e := h.HandleSoftwareInterrupt(p, comment)
+		if e != nil {
+			return true, e
+		}
+		if handled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (n *SoftwareInterruptInstruction) Emulate(p ARMProcessor) error {
 	var e error
 	if !n.Condition().IsMet(p) {
 		return nil
 	}
-	currentPC, _ := p.GetRegister(15)
-	e = p.SetMode(0x13)
-	if e != nil {
+	handled, e := handleSoftwareInterrupt(p, n.Comment)
+	if handled || (e != nil) {
 		return e
 	}
-	p.SetRegister(14, currentPC)
-	p.SetRegister(15, 0x8)
-	return nil
+	currentPC, _ := p.GetRegister(15)
+	return enterException(p, supervisorMode, softwareInterruptVector,
+		currentPC, false)
 }
@@ -0,0 +1,709 @@
+package arm_emulate
+
+// This file contains the emulation functions for the A64 integer data
+// processing, branch and system instructions.
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"time"
+)
+
+// The system registers which can be accessed at EL0.
+const (
+	a64RegisterMIDR    A64SystemRegister = 0xc000
+	a64RegisterCTR     A64SystemRegister = 0xd801
+	a64RegisterDCZID   A64SystemRegister = 0xd807
+	a64RegisterNZCV    A64SystemRegister = 0xda10
+	a64RegisterFPCR    A64SystemRegister = 0xda20
+	a64RegisterFPSR    A64SystemRegister = 0xda21
+	a64RegisterTPIDR   A64SystemRegister = 0xde82
+	a64RegisterTPIDRRO A64SystemRegister = 0xde83
+	a64RegisterCNTFRQ  A64SystemRegister = 0xdf00
+	a64RegisterCNTVCT  A64SystemRegister = 0xdf02
+)
+
+// The values of the read-only ID registers, which match a Cortex-A53.
+const (
+	a64MIDRValue = 0x410fd034
+	// 64-byte instruction and data cache lines.
+	a64CTRValue = 0x8444c004
+	// The generic timer counts nanoseconds of host time.
+	a64CounterFrequency = 1000000000
+)
+
+var a64CRC32Table = crc32.MakeTable(crc32.IEEE)
+var a64CRC32CTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Returns the value of a general-purpose register, truncated to 32 bits if
+// is64 isn't set. If sp is set, register 31 is the stack pointer rather than
+// the zero register.
+func a64ReadRegister(p A64Processor, r A64Register, is64, sp bool) uint64 {
+	var value uint64
+	if (r == 31) && sp {
+		value = p.GetSP()
+	} else {
+		value = p.GetRegister(r)
+	}
+	if !is64 {
+		value &= 0xffffffff
+	}
+	return value
+}
+
+// Writes a general-purpose register. As with reads, sp selects whether
+// register 31 is the stack pointer. 32-bit values are zero-extended.
+func a64WriteRegister(p A64Processor, r A64Register, value uint64, is64,
+	sp bool) {
+	if !is64 {
+		value &= 0xffffffff
+	}
+	if (r == 31) && sp {
+		p.SetSP(value)
+		return
+	}
+	p.SetRegister(r, value)
+}
+
+// Returns the address of the instruction being emulated. The PC has already
+// been incremented past it.
+func a64InstructionAddress(p A64Processor) uint64 {
+	return p.GetPC() - 4
+}
+
+// Returns true if the condition passes. Unlike in ARM state, condition 15 (nv)
+// always passes.
+func a64ConditionPassed(p A64Processor, c ARMCondition) bool {
+	var result bool
+	switch (c & 0xf) >> 1 {
+	case 0:
+		result = p.Zero()
+	case 1:
+		result = p.Carry()
+	case 2:
+		result = p.Negative()
+	case 3:
+		result = p.Overflow()
+	case 4:
+		result = p.Carry() && !p.Zero()
+	case 5:
+		result = p.Negative() == p.Overflow()
+	case 6:
+		result = !p.Zero() && (p.Negative() == p.Overflow())
+	default:
+		return true
+	}
+	if (c & 1) != 0 {
+		return !result
+	}
+	return result
+}
+
+// Returns the N and Z flags for a result, in the format used by SetNZCV.
+func a64ResultFlags(result uint64, is64 bool) uint32 {
+	var nzcv uint32
+	if !is64 {
+		result = uint64(uint32(result)) << 32
+	}
+	if (result & (1 << 63)) != 0 {
+		nzcv |= 0x80000000
+	}
+	if result == 0 {
+		nzcv |= 0x40000000
+	}
+	return nzcv
+}
+
+// Returns x + y + carry, along with the NZCV flags set by the addition.
+func a64AddWithCarry(x, y uint64, carry, is64 bool) (uint64, uint32) {
+	carryIn := uint64(0)
+	if carry {
+		carryIn = 1
+	}
+	var result, carryOut, signBit uint64
+	if is64 {
+		result, carryOut = bits.Add64(x, y, carryIn)
+		signBit = 1 << 63
+	} else {
+		x &= 0xffffffff
+		y &= 0xffffffff
+		result = x + y + carryIn
+		carryOut = result >> 32
+		result &= 0xffffffff
+		signBit = 1 << 31
+	}
+	nzcv := a64ResultFlags(result, is64)
+	if carryOut != 0 {
+		nzcv |= 0x20000000
+	}
+	if (^(x ^ y) & (x ^ result) & signBit) != 0 {
+		nzcv |= 0x10000000
+	}
+	return result, nzcv
+}
+
+// Shifts a register's value using the shift types used by the data processing
+// instructions: 0 = lsl, 1 = lsr, 2 = asr, 3 = ror. The amount must be less
+// than the size of the register.
+func a64ShiftValue(value uint64, shiftType, amount uint8, is64 bool) uint64 {
+	if !is64 {
+		v := uint32(value)
+		switch shiftType & 3 {
+		case 0:
+			v <<= amount
+		case 1:
+			v >>= amount
+		case 2:
+			v = uint32(int32(v) >> amount)
+		case 3:
+			v = bits.RotateLeft32(v, -int(amount))
+		}
+		return uint64(v)
+	}
+	switch shiftType & 3 {
+	case 0:
+		return value << amount
+	case 1:
+		return value >> amount
+	case 2:
+		return uint64(int64(value) >> amount)
+	}
+	return bits.RotateLeft64(value, -int(amount))
+}
+
+// Applies one of the extensions used by the extended register operands, where
+// bit 2 of extend selects sign extension and the low bits select the size,
+// then shifts the result left by the given amount.
+func a64ExtendValue(value uint64, extend, shift uint8, is64 bool) uint64 {
+	size := uint(8) << (extend & 3)
+	if size < 64 {
+		value &= (uint64(1) << size) - 1
+		if ((extend & 4) != 0) && ((value >> (size - 1)) != 0) {
+			value |= ^uint64(0) << size
+		}
+	}
+	value <<= shift
+	if !is64 {
+		value &= 0xffffffff
+	}
+	return value
+}
+
+// Sign-extends the low bits of a value, where bits is the size of the value.
+func a64SignExtend(value uint64, bits uint8) uint64 {
+	shift := 64 - bits
+	return uint64(int64(value<<shift) >> shift)
+}
+
+// Returns a mask of the given number of low bits.
+func a64Mask(bits uint8) uint64 {
+	if bits >= 64 {
+		return 0xffffffffffffffff
+	}
+	return (uint64(1) << bits) - 1
+}
+
+func (n *PCRelativeA64Instruction) Emulate(p A64Processor) error {
+	base := a64InstructionAddress(p)
+	if n.Page {
+		base &^= 0xfff
+	}
+	p.SetRegister(n.Rd, base+uint64(n.offset()))
+	return nil
+}
+
+func (n *AddSubtractImmediateA64Instruction) Emulate(p A64Processor) error {
+	x := a64ReadRegister(p, n.Rn, n.Is64, true)
+	y := uint64(n.Immediate)
+	if n.Shift {
+		y <<= 12
+	}
+	carry := false
+	if n.Subtract {
+		y = ^y
+		carry = true
+	}
+	result, nzcv := a64AddWithCarry(x, y, carry, n.Is64)
+	if n.SetFlags {
+		p.SetNZCV(nzcv)
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, !n.SetFlags)
+	return nil
+}
+
+// Carries out one of the and, orr, eor or ands operations, given by opcode.
+// Sets the flags for ands.
+func a64LogicalOperation(p A64Processor, opcode uint8, x, y uint64,
+	is64 bool) uint64 {
+	var result uint64
+	switch opcode & 3 {
+	case 0, 3:
+		result = x & y
+	case 1:
+		result = x | y
+	case 2:
+		result = x ^ y
+	}
+	if !is64 {
+		result &= 0xffffffff
+	}
+	if opcode == 3 {
+		p.SetNZCV(a64ResultFlags(result, is64))
+	}
+	return result
+}
+
+func (n *LogicalImmediateA64Instruction) Emulate(p A64Processor) error {
+	x := a64ReadRegister(p, n.Rn, n.Is64, false)
+	result := a64LogicalOperation(p, n.Opcode, x, n.Value(), n.Is64)
+	a64WriteRegister(p, n.Rd, result, n.Is64, n.Opcode != 3)
+	return nil
+}
+
+func (n *MoveWideA64Instruction) Emulate(p A64Processor) error {
+	shift := n.Halfword * 16
+	value := uint64(n.Immediate) << shift
+	switch n.Opcode {
+	case 0:
+		value = ^value
+	case 3:
+		value |= p.GetRegister(n.Rd) &^ (uint64(0xffff) << shift)
+	}
+	a64WriteRegister(p, n.Rd, value, n.Is64, false)
+	return nil
+}
+
+func (n *BitfieldA64Instruction) Emulate(p A64Processor) error {
+	size := uint8(32)
+	if n.Is64 {
+		size = 64
+	}
+	source := a64ReadRegister(p, n.Rn, n.Is64, false)
+	destination := a64ReadRegister(p, n.Rd, n.Is64, false)
+	r, s := n.Immr, n.Imms
+	var field, fieldMask uint64
+	var width uint8
+	var lsb uint8
+	if s >= r {
+		// Extract bits r to s of the source into the bottom of the result.
+		width = s - r + 1
+		field = (source >> r) & a64Mask(width)
+	} else {
+		// Insert the bottom s + 1 bits of the source at bit size - r.
+		width = s + 1
+		lsb = size - r
+		field = source & a64Mask(width)
+	}
+	fieldMask = a64Mask(width) << lsb
+	var result uint64
+	switch n.Opcode {
+	case 0:
+		result = a64SignExtend(field, width) << lsb
+	case 1:
+		result = (destination &^ fieldMask) | (field << lsb)
+	default:
+		result = field << lsb
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+func (n *ExtractA64Instruction) Emulate(p A64Processor) error {
+	high := a64ReadRegister(p, n.Rn, n.Is64, false)
+	low := a64ReadRegister(p, n.Rm, n.Is64, false)
+	result := low
+	if n.LSB != 0 {
+		size := uint8(32)
+		if n.Is64 {
+			size = 64
+		}
+		result = (low >> n.LSB) | (high << (size - n.LSB))
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+func (n *BranchA64Instruction) Emulate(p A64Processor) error {
+	address := a64InstructionAddress(p)
+	if n.Link {
+		p.SetRegister(30, p.GetPC())
+	}
+	p.SetPC(address + uint64(n.offset()))
+	return nil
+}
+
+func (n *ConditionalBranchA64Instruction) Emulate(p A64Processor) error {
+	if a64ConditionPassed(p, n.Condition) {
+		p.SetPC(a64InstructionAddress(p) + uint64(n.offset()))
+	}
+	return nil
+}
+
+func (n *CompareBranchA64Instruction) Emulate(p A64Processor) error {
+	isZero := a64ReadRegister(p, n.Rt, n.Is64, false) == 0
+	if isZero != n.NonZero {
+		p.SetPC(a64InstructionAddress(p) + uint64(n.offset()))
+	}
+	return nil
+}
+
+func (n *TestBranchA64Instruction) Emulate(p A64Processor) error {
+	isZero := ((p.GetRegister(n.Rt) >> n.Bit) & 1) == 0
+	if isZero != n.NonZero {
+		p.SetPC(a64InstructionAddress(p) + uint64(n.offset()))
+	}
+	return nil
+}
+
+func (n *BranchRegisterA64Instruction) Emulate(p A64Processor) error {
+	target := p.GetRegister(n.Rn)
+	switch n.Opcode {
+	case 0, 2:
+	case 1:
+		p.SetRegister(30, p.GetPC())
+	default:
+		// eret and drps are undefined at EL0.
+		return a64UndefinedError(n.raw)
+	}
+	p.SetPC(target)
+	return nil
+}
+
+func (n *ExceptionA64Instruction) Emulate(p A64Processor) error {
+	switch n.Opcode {
+	case 0:
+		if n.Level != 1 {
+			break
+		}
+		for _, h := range p.GetSupervisorCallHandlers() {
+			handled, e := h.HandleSupervisorCall(p, n.Immediate)
+			if e != nil {
+				return e
+			}
+			if handled {
+				return nil
+			}
+		}
+		return fmt.Errorf("Unhandled supervisor call: %s", n)
+	case 1:
+		return fmt.Errorf("Breakpoint: %s", n)
+	case 2:
+		return fmt.Errorf("Halted: %s", n)
+	}
+	// hvc, smc and dcps are undefined at EL0.
+	return a64UndefinedError(n.raw)
+}
+
+func (n *HintA64Instruction) Emulate(p A64Processor) error {
+	return nil
+}
+
+func (n *BarrierA64Instruction) Emulate(p A64Processor) error {
+	if n.Opcode == 2 {
+		p.ClearExclusive()
+	}
+	return nil
+}
+
+func (n *ProcessorStateA64Instruction) Emulate(p A64Processor) error {
+	// None of the PSTATE fields may be written at EL0.
+	return a64UndefinedError(n.raw)
+}
+
+func (n *SystemRegisterA64Instruction) Emulate(p A64Processor) error {
+	if !n.Read {
+		value := p.GetRegister(n.Rt)
+		switch n.Register {
+		case a64RegisterNZCV:
+			p.SetNZCV(uint32(value))
+		case a64RegisterFPCR:
+			p.SetFPCR(uint32(value))
+		case a64RegisterFPSR:
+			p.SetFPSR(uint32(value))
+		case a64RegisterTPIDR:
+			p.SetTPIDR(value)
+		default:
+			return a64UndefinedError(n.raw)
+		}
+		return nil
+	}
+	var value uint64
+	switch n.Register {
+	case a64RegisterMIDR:
+		value = a64MIDRValue
+	case a64RegisterCTR:
+		value = a64CTRValue
+	case a64RegisterDCZID:
+		value = a64ZeroBlockSize
+	case a64RegisterNZCV:
+		value = uint64(p.GetNZCV())
+	case a64RegisterFPCR:
+		value = uint64(p.GetFPCR())
+	case a64RegisterFPSR:
+		value = uint64(p.GetFPSR())
+	case a64RegisterTPIDR:
+		value = p.GetTPIDR()
+	case a64RegisterTPIDRRO:
+		value = 0
+	case a64RegisterCNTFRQ:
+		value = a64CounterFrequency
+	case a64RegisterCNTVCT:
+		value = uint64(time.Now().UnixNano())
+	default:
+		return a64UndefinedError(n.raw)
+	}
+	p.SetRegister(n.Rt, value)
+	return nil
+}
+
+func (n *SystemA64Instruction) Emulate(p A64Processor) error {
+	if n.Read {
+		return a64UndefinedError(n.raw)
+	}
+	index := (uint16(n.Op1) << 11) | (uint16(n.CRn) << 7) |
+		(uint16(n.CRm) << 3) | uint16(n.Op2)
+	switch index {
+	case 0x1ba1:
+		// dc zva, which zeroes a block of memory.
+		blockSize := uint64(4) << a64ZeroBlockSize
+		address := p.GetRegister(n.Rt) &^ (blockSize - 1)
+		m := p.GetMemoryInterface()
+		for i := uint64(0); i < blockSize; i += 8 {
+			e := m.WriteMemoryDoubleword(address+i, 0)
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	case 0x1ba9, 0x1bd1, 0x1bd9, 0x1bf1:
+		// There are no caches to maintain.
+		return nil
+	}
+	return a64UndefinedError(n.raw)
+}
+
+func (n *LogicalRegisterA64Instruction) Emulate(p A64Processor) error {
+	x := a64ReadRegister(p, n.Rn, n.Is64, false)
+	y := a64ShiftValue(a64ReadRegister(p, n.Rm, n.Is64, false), n.ShiftType,
+		n.ShiftAmount, n.Is64)
+	if n.Invert {
+		y = ^y
+	}
+	result := a64LogicalOperation(p, n.Opcode, x, y, n.Is64)
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+// Carries out an addition or subtraction, setting the flags if requested.
+func a64AddSubtract(p A64Processor, x, y uint64, subtract, setFlags,
+	is64 bool) uint64 {
+	if subtract {
+		y = ^y
+	}
+	result, nzcv := a64AddWithCarry(x, y, subtract, is64)
+	if setFlags {
+		p.SetNZCV(nzcv)
+	}
+	return result
+}
+
+func (n *AddSubtractRegisterA64Instruction) Emulate(p A64Processor) error {
+	x := a64ReadRegister(p, n.Rn, n.Is64, false)
+	y := a64ShiftValue(a64ReadRegister(p, n.Rm, n.Is64, false), n.ShiftType,
+		n.ShiftAmount, n.Is64)
+	result := a64AddSubtract(p, x, y, n.Subtract, n.SetFlags, n.Is64)
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+func (n *AddSubtractExtendedA64Instruction) Emulate(p A64Processor) error {
+	x := a64ReadRegister(p, n.Rn, n.Is64, true)
+	y := a64ExtendValue(p.GetRegister(n.Rm), n.Extend, n.Shift, n.Is64)
+	result := a64AddSubtract(p, x, y, n.Subtract, n.SetFlags, n.Is64)
+	a64WriteRegister(p, n.Rd, result, n.Is64, !n.SetFlags)
+	return nil
+}
+
+func (n *AddSubtractCarryA64Instruction) Emulate(p A64Processor) error {
+	x := a64ReadRegister(p, n.Rn, n.Is64, false)
+	y := a64ReadRegister(p, n.Rm, n.Is64, false)
+	if n.Subtract {
+		y = ^y
+	}
+	result, nzcv := a64AddWithCarry(x, y, p.Carry(), n.Is64)
+	if n.SetFlags {
+		p.SetNZCV(nzcv)
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+func (n *ConditionalCompareA64Instruction) Emulate(p A64Processor) error {
+	if !a64ConditionPassed(p, n.Condition) {
+		p.SetNZCV(uint32(n.Flags) << 28)
+		return nil
+	}
+	x := a64ReadRegister(p, n.Rn, n.Is64, false)
+	y := uint64(n.Operand)
+	if !n.IsImmediate {
+		y = a64ReadRegister(p, A64Register(n.Operand), n.Is64, false)
+	}
+	a64AddSubtract(p, x, y, !n.Negative, true, n.Is64)
+	return nil
+}
+
+func (n *ConditionalSelectA64Instruction) Emulate(p A64Processor) error {
+	var result uint64
+	if a64ConditionPassed(p, n.Condition) {
+		result = p.GetRegister(n.Rn)
+	} else {
+		result = p.GetRegister(n.Rm)
+		switch n.Opcode {
+		case 1:
+			result++
+		case 2:
+			result = ^result
+		case 3:
+			result = -result
+		}
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+func (n *DataProcessing1SourceA64Instruction) Emulate(p A64Processor) error {
+	value := a64ReadRegister(p, n.Rn, n.Is64, false)
+	var result uint64
+	switch n.Opcode {
+	case 0:
+		if n.Is64 {
+			result = bits.Reverse64(value)
+		} else {
+			result = uint64(bits.Reverse32(uint32(value)))
+		}
+	case 1:
+		result = ((value & 0x00ff00ff00ff00ff) << 8) |
+			((value >> 8) & 0x00ff00ff00ff00ff)
+	case 2:
+		if n.Is64 {
+			result = bits.RotateLeft64(bits.ReverseBytes64(value), 32)
+		} else {
+			result = uint64(bits.ReverseBytes32(uint32(value)))
+		}
+	case 3:
+		result = bits.ReverseBytes64(value)
+	case 4:
+		if n.Is64 {
+			result = uint64(bits.LeadingZeros64(value))
+		} else {
+			result = uint64(bits.LeadingZeros32(uint32(value)))
+		}
+	case 5:
+		// Count the bits following the sign bit which are equal to it.
+		if n.Is64 {
+			result = uint64(bits.LeadingZeros64((value^(value>>1))&
+				0x7fffffffffffffff) - 1)
+		} else {
+			v := uint32(value)
+			result = uint64(bits.LeadingZeros32((v^(v>>1))&0x7fffffff) - 1)
+		}
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+// Returns the result of the crc32 and crc32c instructions. Unlike the usual
+// CRC functions, these don't invert the accumulator's bits.
+func a64CRC32(accumulator uint32, value uint64, size uint8,
+	castagnoli bool) uint32 {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(value >> (uint(i) * 8))
+	}
+	table := a64CRC32Table
+	if castagnoli {
+		table = a64CRC32CTable
+	}
+	return ^crc32.Update(^accumulator, table, data)
+}
+
+func (n *DataProcessing2SourceA64Instruction) Emulate(p A64Processor) error {
+	if n.Opcode >= 16 {
+		accumulator := uint32(p.GetRegister(n.Rn))
+		size := uint8(1) << (n.Opcode & 3)
+		result := a64CRC32(accumulator, p.GetRegister(n.Rm), size,
+			(n.Opcode&4) != 0)
+		a64WriteRegister(p, n.Rd, uint64(result), false, false)
+		return nil
+	}
+	x := a64ReadRegister(p, n.Rn, n.Is64, false)
+	y := a64ReadRegister(p, n.Rm, n.Is64, false)
+	size := uint64(32)
+	if n.Is64 {
+		size = 64
+	}
+	var result uint64
+	switch n.Opcode {
+	case 2:
+		// Division by zero returns zero rather than causing an exception.
+		if y != 0 {
+			result = x / y
+		}
+	case 3:
+		if y == 0 {
+			break
+		}
+		if n.Is64 {
+			if (int64(x) == -0x8000000000000000) && (int64(y) == -1) {
+				result = x
+			} else {
+				result = uint64(int64(x) / int64(y))
+			}
+		} else {
+			result = uint64(int64(int32(x)) / int64(int32(y)))
+		}
+	default:
+		result = a64ShiftValue(x, n.Opcode&3, uint8(y%size), n.Is64)
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
+
+func (n *DataProcessing3SourceA64Instruction) Emulate(p A64Processor) error {
+	x := p.GetRegister(n.Rn)
+	y := p.GetRegister(n.Rm)
+	var result uint64
+	switch n.Opcode {
+	case 2:
+		hi, _ := bits.Mul64(x, y)
+		// Adjust the unsigned product to get the signed upper bits.
+		if int64(x) < 0 {
+			hi -= y
+		}
+		if int64(y) < 0 {
+			hi -= x
+		}
+		p.SetRegister(n.Rd, hi)
+		return nil
+	case 6:
+		hi, _ := bits.Mul64(x, y)
+		p.SetRegister(n.Rd, hi)
+		return nil
+	case 1:
+		x = a64SignExtend(x, 32)
+		y = a64SignExtend(y, 32)
+	case 5:
+		x &= 0xffffffff
+		y &= 0xffffffff
+	}
+	product := x * y
+	accumulator := p.GetRegister(n.Ra)
+	if n.Subtract {
+		result = accumulator - product
+	} else {
+		result = accumulator + product
+	}
+	a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	return nil
+}
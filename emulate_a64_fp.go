@@ -0,0 +1,420 @@
+package arm_emulate
+
+// This file contains the emulation functions for the A64 scalar floating-point
+// instructions. These reuse the arithmetic implemented for the VFP, which
+// follows the same rules for rounding, NaNs and exceptions.
+
+import (
+	"math"
+	"math/big"
+)
+
+// The precision used to hold the exact result of a fused multiply-add, which
+// must cover the full exponent range of the product and the addend.
+const a64FMAPrecision = 4096
+
+// Returns a VFP whose FPSCR holds the processor's rounding mode, flush-to-zero
+// and default NaN settings, and cumulative exception flags. Operations carried
+// out using the VFP must be followed by a call to a64UpdateFPSR.
+func a64NewVFP(p A64Processor) *VFP {
+	return &VFP{
+		fpscr: (p.GetFPCR() & 0x07c00000) |
+			(p.GetFPSR() & a64FPSRExceptionBits),
+	}
+}
+
+// Copies the cumulative exception flags from the VFP back into the FPSR.
+func a64UpdateFPSR(p A64Processor, v *VFP) {
+	p.SetFPSR((p.GetFPSR() &^ a64FPSRExceptionBits) |
+		(v.fpscr & a64FPSRExceptionBits))
+}
+
+// Returns the bits of a single or double-precision register.
+func a64ReadFP(p A64Processor, r A64Register, double bool) uint64 {
+	low, _ := p.GetVectorRegister(r)
+	if !double {
+		low &= 0xffffffff
+	}
+	return low
+}
+
+// Writes a single or double-precision register. As with all scalar writes,
+// the rest of the 128-bit vector register is cleared.
+func a64WriteFP(p A64Processor, r A64Register, value uint64, double bool) {
+	if !double {
+		value &= 0xffffffff
+	}
+	p.SetVectorRegister(r, value, 0)
+}
+
+// Returns the bits of an infinity with the given sign.
+func a64FPInfinity(negative, double bool) uint64 {
+	var result uint64
+	if double {
+		result = 0x7ff0000000000000
+	} else {
+		result = 0x7f800000
+	}
+	if negative {
+		result |= vfpSignBit(double)
+	}
+	return result
+}
+
+// Rounds an exact value to single or double precision using the current
+// rounding mode.
+func a64RoundExact(v *VFP, exact *big.Float, double bool) uint64 {
+	var x float64
+	var accuracy big.Accuracy
+	if double {
+		x, accuracy = exact.Float64()
+	} else {
+		var f float32
+		f, accuracy = exact.Float32()
+		x = float64(f)
+	}
+	errorSign := 0
+	if accuracy == big.Below {
+		errorSign = 1
+	} else if accuracy == big.Above {
+		errorSign = -1
+	}
+	return v.round(x, errorSign, double)
+}
+
+// Rounds a value to an integral value. The rounding argument uses the same
+// values as the frint instructions: 0-3 are the usual rounding modes, 4 rounds
+// to the nearest with ties away from zero, 6 uses the current rounding mode
+// and signals inexact results, and 7 uses the current rounding mode.
+func a64RoundToIntegral(v *VFP, a uint64, double bool,
+	rounding uint8) uint64 {
+	result, isNaN := v.processNaNs(double, a)
+	if isNaN {
+		return result
+	}
+	x := v.operandValue(a, double)
+	var rounded float64
+	switch rounding {
+	case 4:
+		rounded = math.Round(x)
+	case 6, 7:
+		rounded = roundToInteger(x, v.roundingMode())
+	default:
+		rounded = roundToInteger(x, rounding)
+	}
+	if (rounding == 6) && (rounded != x) {
+		v.fpscr |= fpscrInexact
+	}
+	if double {
+		return math.Float64bits(rounded)
+	}
+	return uint64(math.Float32bits(float32(rounded)))
+}
+
+// Carries out fmax, fmin, fmaxnm or fminnm. If numeric is set, a quiet NaN is
+// ignored if the other operand is a number.
+func a64FPMinMax(v *VFP, a, b uint64, double, maximum, numeric bool) uint64 {
+	if numeric {
+		aQuiet := vfpIsNaN(a, double) && !vfpIsSignalingNaN(a, double)
+		bQuiet := vfpIsNaN(b, double) && !vfpIsSignalingNaN(b, double)
+		if aQuiet && !vfpIsNaN(b, double) {
+			a = a64FPInfinity(maximum, double)
+		} else if bQuiet && !vfpIsNaN(a, double) {
+			b = a64FPInfinity(maximum, double)
+		}
+	}
+	result, isNaN := v.processNaNs(double, a, b)
+	if isNaN {
+		return result
+	}
+	x := v.operandValue(a, double)
+	y := v.operandValue(b, double)
+	if maximum {
+		return v.round(math.Max(x, y), 0, double)
+	}
+	return v.round(math.Min(x, y), 0, double)
+}
+
+// Returns addend + (a * b), rounded only once.
+func a64FPMultiplyAdd(v *VFP, addend, a, b uint64, double bool) uint64 {
+	result, isNaN := v.processNaNs(double, addend, a, b)
+	x := v.operandValue(a, double)
+	y := v.operandValue(b, double)
+	infinityTimesZero := (math.IsInf(x, 0) && (y == 0)) ||
+		((x == 0) && math.IsInf(y, 0))
+	if isNaN {
+		if infinityTimesZero && vfpIsNaN(addend, double) &&
+			!vfpIsSignalingNaN(addend, double) {
+			v.fpscr |= fpscrInvalidOperation
+			return vfpDefaultNaN(double)
+		}
+		return result
+	}
+	z := v.operandValue(addend, double)
+	productNegative := math.Signbit(x) != math.Signbit(y)
+	productInfinite := math.IsInf(x, 0) || math.IsInf(y, 0)
+	if infinityTimesZero || (math.IsInf(z, 0) && productInfinite &&
+		(math.Signbit(z) != productNegative)) {
+		v.fpscr |= fpscrInvalidOperation
+		return vfpDefaultNaN(double)
+	}
+	if math.IsInf(z, 0) {
+		return a64FPInfinity(math.Signbit(z), double)
+	}
+	if productInfinite {
+		return a64FPInfinity(productNegative, double)
+	}
+	productZero := (x == 0) || (y == 0)
+	if (z == 0) && productZero && (math.Signbit(z) == productNegative) {
+		return v.round(z, 0, double)
+	}
+	exact := new(big.Float).SetPrec(a64FMAPrecision).SetFloat64(x)
+	exact.Mul(exact, new(big.Float).SetFloat64(y))
+	exact.Add(exact, new(big.Float).SetFloat64(z))
+	if exact.Sign() == 0 {
+		// Exact zero results are only negative when rounding towards minus
+		// infinity.
+		return a64NegativeZeroSign(v.roundingMode(), double)
+	}
+	return a64RoundExact(v, exact, double)
+}
+
+// Returns the sign bit of an exact zero sum for the given rounding mode.
+func a64NegativeZeroSign(mode uint8, double bool) uint64 {
+	if mode == roundTowardsMinusInfinity {
+		return vfpSignBit(double)
+	}
+	return 0
+}
+
+// Converts a floating-point value to a fixed-point integer with the given
+// number of fractional bits, saturating values which are out of range. The
+// rounding argument is as for a64RoundToIntegral, but may not be 6 or 7.
+func a64FPToInteger(v *VFP, a uint64, double, signed, is64 bool,
+	rounding, fractionBits uint8) uint64 {
+	size := uint8(32)
+	if is64 {
+		size = 64
+	}
+	if vfpIsNaN(a, double) {
+		v.fpscr |= fpscrInvalidOperation
+		return 0
+	}
+	x := math.Ldexp(v.operandValue(a, double), int(fractionBits))
+	var rounded float64
+	if rounding == 4 {
+		rounded = math.Round(x)
+	} else {
+		rounded = roundToInteger(x, rounding)
+	}
+	minimum, limit := 0.0, math.Ldexp(1, int(size))
+	minimumBits, maximumBits := uint64(0), a64Mask(size)
+	if signed {
+		minimum, limit = -math.Ldexp(1, int(size-1)), math.Ldexp(1,
+			int(size-1))
+		minimumBits = a64Mask(size) &^ (a64Mask(size) >> 1)
+		maximumBits = a64Mask(size) >> 1
+	}
+	if rounded < minimum {
+		v.fpscr |= fpscrInvalidOperation
+		return minimumBits
+	}
+	if rounded >= limit {
+		v.fpscr |= fpscrInvalidOperation
+		return maximumBits
+	}
+	if rounded != x {
+		v.fpscr |= fpscrInexact
+	}
+	if signed {
+		return uint64(int64(rounded)) & a64Mask(size)
+	}
+	return uint64(rounded)
+}
+
+// Converts a fixed-point integer with the given number of fractional bits to
+// a floating-point value.
+func a64IntegerToFP(v *VFP, value uint64, double, signed, is64 bool,
+	fractionBits uint8) uint64 {
+	exact := new(big.Float)
+	if !is64 {
+		if signed {
+			value = a64SignExtend(value, 32)
+		} else {
+			value &= 0xffffffff
+		}
+	}
+	if signed {
+		exact.SetInt64(int64(value))
+	} else {
+		exact.SetUint64(value)
+	}
+	exact.SetMantExp(exact, -int(fractionBits))
+	return a64RoundExact(v, exact, double)
+}
+
+func (n *FPDataProcessing1SourceA64Instruction) Emulate(p A64Processor) error {
+	a := a64ReadFP(p, n.Rn, n.Double)
+	v := a64NewVFP(p)
+	var result uint64
+	switch n.Opcode {
+	case 0:
+		result = a
+	case 1:
+		result = a &^ vfpSignBit(n.Double)
+	case 2:
+		result = a ^ vfpSignBit(n.Double)
+	case 3:
+		result = v.squareRoot(a, n.Double)
+	case 4, 5:
+		result = v.convertPrecision(a, n.Opcode == 5)
+		a64WriteFP(p, n.Rd, result, n.Opcode == 5)
+		a64UpdateFPSR(p, v)
+		return nil
+	default:
+		result = a64RoundToIntegral(v, a, n.Double, n.Opcode&7)
+	}
+	a64WriteFP(p, n.Rd, result, n.Double)
+	a64UpdateFPSR(p, v)
+	return nil
+}
+
+func (n *FPDataProcessing2SourceA64Instruction) Emulate(p A64Processor) error {
+	a := a64ReadFP(p, n.Rn, n.Double)
+	b := a64ReadFP(p, n.Rm, n.Double)
+	v := a64NewVFP(p)
+	var result uint64
+	switch n.Opcode {
+	case 0:
+		result = v.arithmetic(fmulVFPOpcode, a, b, n.Double)
+	case 1:
+		result = v.arithmetic(fdivVFPOpcode, a, b, n.Double)
+	case 2:
+		result = v.arithmetic(faddVFPOpcode, a, b, n.Double)
+	case 3:
+		result = v.arithmetic(fsubVFPOpcode, a, b, n.Double)
+	case 4, 5, 6, 7:
+		result = a64FPMinMax(v, a, b, n.Double, (n.Opcode&1) == 0,
+			n.Opcode >= 6)
+	case 8:
+		result = v.arithmetic(fmulVFPOpcode, a, b, n.Double) ^
+			vfpSignBit(n.Double)
+	}
+	a64WriteFP(p, n.Rd, result, n.Double)
+	a64UpdateFPSR(p, v)
+	return nil
+}
+
+func (n *FPDataProcessing3SourceA64Instruction) Emulate(p A64Processor) error {
+	a := a64ReadFP(p, n.Rn, n.Double)
+	b := a64ReadFP(p, n.Rm, n.Double)
+	addend := a64ReadFP(p, n.Ra, n.Double)
+	if n.Negate {
+		addend ^= vfpSignBit(n.Double)
+	}
+	if n.Subtract != n.Negate {
+		a ^= vfpSignBit(n.Double)
+	}
+	v := a64NewVFP(p)
+	result := a64FPMultiplyAdd(v, addend, a, b, n.Double)
+	a64WriteFP(p, n.Rd, result, n.Double)
+	a64UpdateFPSR(p, v)
+	return nil
+}
+
+func (n *FPCompareA64Instruction) Emulate(p A64Processor) error {
+	a := a64ReadFP(p, n.Rn, n.Double)
+	b := uint64(0)
+	if !n.Zero {
+		b = a64ReadFP(p, n.Rm, n.Double)
+	}
+	v := a64NewVFP(p)
+	v.compare(a, b, n.Double, n.Signaling)
+	p.SetNZCV(v.fpscr & 0xf0000000)
+	a64UpdateFPSR(p, v)
+	return nil
+}
+
+func (n *FPConditionalCompareA64Instruction) Emulate(p A64Processor) error {
+	if !a64ConditionPassed(p, n.Condition) {
+		p.SetNZCV(uint32(n.Flags) << 28)
+		return nil
+	}
+	v := a64NewVFP(p)
+	v.compare(a64ReadFP(p, n.Rn, n.Double), a64ReadFP(p, n.Rm, n.Double),
+		n.Double, n.Signaling)
+	p.SetNZCV(v.fpscr & 0xf0000000)
+	a64UpdateFPSR(p, v)
+	return nil
+}
+
+func (n *FPConditionalSelectA64Instruction) Emulate(p A64Processor) error {
+	r := n.Rm
+	if a64ConditionPassed(p, n.Condition) {
+		r = n.Rn
+	}
+	a64WriteFP(p, n.Rd, a64ReadFP(p, r, n.Double), n.Double)
+	return nil
+}
+
+func (n *FPImmediateA64Instruction) Emulate(p A64Processor) error {
+	a64WriteFP(p, n.Rd, n.Value(), n.Double)
+	return nil
+}
+
+func (n *FPIntegerConversionA64Instruction) Emulate(p A64Processor) error {
+	switch n.Opcode {
+	case 6:
+		var value uint64
+		if n.Upper {
+			_, value = p.GetVectorRegister(n.Rn)
+		} else {
+			value = a64ReadFP(p, n.Rn, n.Double)
+		}
+		a64WriteRegister(p, n.Rd, value, n.Is64, false)
+		return nil
+	case 7:
+		value := a64ReadRegister(p, n.Rn, n.Is64, false)
+		if n.Upper {
+			low, _ := p.GetVectorRegister(n.Rd)
+			p.SetVectorRegister(n.Rd, low, value)
+		} else {
+			a64WriteFP(p, n.Rd, value, n.Double)
+		}
+		return nil
+	}
+	v := a64NewVFP(p)
+	signed := (n.Opcode & 1) == 0
+	switch n.Opcode {
+	case 2, 3:
+		result := a64IntegerToFP(v, p.GetRegister(n.Rn), n.Double, signed,
+			n.Is64, 0)
+		a64WriteFP(p, n.Rd, result, n.Double)
+	default:
+		rounding := n.RoundingMode
+		if n.Opcode >= 4 {
+			rounding = 4
+		}
+		result := a64FPToInteger(v, a64ReadFP(p, n.Rn, n.Double), n.Double,
+			signed, n.Is64, rounding, 0)
+		a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	}
+	a64UpdateFPSR(p, v)
+	return nil
+}
+
+func (n *FPFixedPointConversionA64Instruction) Emulate(p A64Processor) error {
+	v := a64NewVFP(p)
+	signed := (n.Opcode & 1) == 0
+	if n.Opcode >= 2 {
+		result := a64IntegerToFP(v, p.GetRegister(n.Rn), n.Double, signed,
+			n.Is64, n.fractionBits())
+		a64WriteFP(p, n.Rd, result, n.Double)
+	} else {
+		result := a64FPToInteger(v, a64ReadFP(p, n.Rn, n.Double), n.Double,
+			signed, n.Is64, roundTowardsZero, n.fractionBits())
+		a64WriteRegister(p, n.Rd, result, n.Is64, false)
+	}
+	a64UpdateFPSR(p, v)
+	return nil
+}
@@ -0,0 +1,402 @@
+package arm_emulate
+
+// This file contains the emulation functions for the A64 load and store
+// instructions.
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Reads a little-endian value of the given size, in bytes, from memory.
+func a64Load(m A64Memory, address uint64, size uint8) (uint64, error) {
+	switch size {
+	case 1:
+		v, e := m.ReadMemoryByte(address)
+		return uint64(v), e
+	case 2:
+		v, e := m.ReadMemoryHalfword(address)
+		return uint64(v), e
+	case 4:
+		v, e := m.ReadMemoryWord(address)
+		return uint64(v), e
+	}
+	return m.ReadMemoryDoubleword(address)
+}
+
+// Writes the low size bytes of value to memory.
+func a64Store(m A64Memory, address, value uint64, size uint8) error {
+	switch size {
+	case 1:
+		return m.WriteMemoryByte(address, uint8(value))
+	case 2:
+		return m.WriteMemoryHalfword(address, uint16(value))
+	case 4:
+		return m.WriteMemoryWord(address, uint32(value))
+	}
+	return m.WriteMemoryDoubleword(address, value)
+}
+
+// Reads a SIMD and floating-point register's value of the given size from
+// memory, returning the lower and upper 64 bits of the register. Bits beyond
+// the size of the value are zero.
+func a64LoadVector(m A64Memory, address uint64, size uint8) (uint64, uint64,
+	error) {
+	if size != 16 {
+		low, e := a64Load(m, address, size)
+		return low, 0, e
+	}
+	low, e := m.ReadMemoryDoubleword(address)
+	if e != nil {
+		return 0, 0, e
+	}
+	high, e := m.ReadMemoryDoubleword(address + 8)
+	return low, high, e
+}
+
+// Writes the low size bytes of a SIMD and floating-point register to memory.
+func a64StoreVector(m A64Memory, address, low, high uint64, size uint8) error {
+	if size != 16 {
+		return a64Store(m, address, low, size)
+	}
+	e := m.WriteMemoryDoubleword(address, low)
+	if e != nil {
+		return e
+	}
+	return m.WriteMemoryDoubleword(address+8, high)
+}
+
+// Returns the element at the given index of a vector register, where size is
+// the log2 of the element's size in bytes.
+func a64GetElement(v [2]uint64, index, size uint8) uint64 {
+	offset := uint(index) << (size + 3)
+	return (v[(offset/64)&1] >> (offset % 64)) & a64Mask(8<<size)
+}
+
+// Sets the element at the given index of a vector register.
+func a64SetElement(v *[2]uint64, index, size uint8, value uint64) {
+	offset := uint(index) << (size + 3)
+	mask := a64Mask(8 << size)
+	word := &(v[(offset/64)&1])
+	*word &^= mask << (offset % 64)
+	*word |= (value & mask) << (offset % 64)
+}
+
+func (n *LoadStoreExclusiveA64Instruction) Emulate(p A64Processor) error {
+	m := p.GetMemoryInterface()
+	address := a64ReadRegister(p, n.Rn, true, true)
+	size := uint8(1) << n.Size
+	is64 := n.Size == 3
+	total := uint64(size)
+	if n.Pair {
+		total *= 2
+	}
+	if (address % total) != 0 {
+		return fmt.Errorf("Misaligned exclusive or ordered access at "+
+			"0x%016x", address)
+	}
+	if n.Load {
+		if !n.Ordered {
+			p.MarkExclusive(address)
+		}
+		value, e := a64Load(m, address, size)
+		if e != nil {
+			return e
+		}
+		if n.Pair {
+			value2, e := a64Load(m, address+uint64(size), size)
+			if e != nil {
+				return e
+			}
+			a64WriteRegister(p, n.Rt2, value2, is64, false)
+		}
+		a64WriteRegister(p, n.Rt, value, is64, false)
+		return nil
+	}
+	if !n.Ordered {
+		exclusive := p.IsExclusive(address)
+		p.ClearExclusive()
+		if !exclusive {
+			a64WriteRegister(p, n.Rs, 1, false, false)
+			return nil
+		}
+	}
+	e := a64Store(m, address, p.GetRegister(n.Rt), size)
+	if e != nil {
+		return e
+	}
+	if n.Pair {
+		e = a64Store(m, address+uint64(size), p.GetRegister(n.Rt2), size)
+		if e != nil {
+			return e
+		}
+	}
+	if !n.Ordered {
+		a64WriteRegister(p, n.Rs, 0, false, false)
+	}
+	return nil
+}
+
+func (n *LoadLiteralA64Instruction) Emulate(p A64Processor) error {
+	m := p.GetMemoryInterface()
+	address := a64InstructionAddress(p) + uint64(n.offset())
+	if n.Vector {
+		low, high, e := a64LoadVector(m, address, 4<<n.Opcode)
+		if e != nil {
+			return e
+		}
+		p.SetVectorRegister(n.Rt, low, high)
+		return nil
+	}
+	var value uint64
+	var e error
+	switch n.Opcode {
+	case 0:
+		value, e = a64Load(m, address, 4)
+	case 1:
+		value, e = a64Load(m, address, 8)
+	case 2:
+		value, e = a64Load(m, address, 4)
+		value = a64SignExtend(value, 32)
+	case 3:
+		// prfm has no effect.
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	p.SetRegister(n.Rt, value)
+	return nil
+}
+
+func (n *LoadStorePairA64Instruction) Emulate(p A64Processor) error {
+	m := p.GetMemoryInterface()
+	base := a64ReadRegister(p, n.Rn, true, true)
+	offset := uint64(n.offset())
+	address := base
+	if n.Addressing != a64PostIndexAddressing {
+		address += offset
+	}
+	size := n.size()
+	address2 := address + uint64(size)
+	var e error
+	if n.Vector {
+		if n.Load {
+			var low, high, low2, high2 uint64
+			low, high, e = a64LoadVector(m, address, size)
+			if e != nil {
+				return e
+			}
+			low2, high2, e = a64LoadVector(m, address2, size)
+			if e != nil {
+				return e
+			}
+			p.SetVectorRegister(n.Rt, low, high)
+			p.SetVectorRegister(n.Rt2, low2, high2)
+		} else {
+			low, high := p.GetVectorRegister(n.Rt)
+			e = a64StoreVector(m, address, low, high, size)
+			if e != nil {
+				return e
+			}
+			low, high = p.GetVectorRegister(n.Rt2)
+			e = a64StoreVector(m, address2, low, high, size)
+		}
+	} else if n.Load {
+		var value, value2 uint64
+		value, e = a64Load(m, address, size)
+		if e != nil {
+			return e
+		}
+		value2, e = a64Load(m, address2, size)
+		if e != nil {
+			return e
+		}
+		// ldpsw sign-extends the words it loads.
+		if n.Opcode == 1 {
+			value = a64SignExtend(value, 32)
+			value2 = a64SignExtend(value2, 32)
+		}
+		p.SetRegister(n.Rt, value)
+		p.SetRegister(n.Rt2, value2)
+	} else {
+		e = a64Store(m, address, p.GetRegister(n.Rt), size)
+		if e != nil {
+			return e
+		}
+		e = a64Store(m, address2, p.GetRegister(n.Rt2), size)
+	}
+	if e != nil {
+		return e
+	}
+	if (n.Addressing == a64PostIndexAddressing) ||
+		(n.Addressing == a64PreIndexAddressing) {
+		a64WriteRegister(p, n.Rn, base+offset, true, true)
+	}
+	return nil
+}
+
+func (n *LoadStoreRegisterA64Instruction) Emulate(p A64Processor) error {
+	if n.isPrefetch() {
+		return nil
+	}
+	m := p.GetMemoryInterface()
+	base := a64ReadRegister(p, n.Rn, true, true)
+	size := n.size()
+	var address uint64
+	switch n.Addressing {
+	case a64RegisterAddressing:
+		shift := uint8(0)
+		if n.Shift {
+			shift = uint8(bits.TrailingZeros8(size))
+		}
+		address = base + a64ExtendValue(p.GetRegister(n.Rm), n.Extend, shift,
+			true)
+	case a64PostIndexAddressing:
+		address = base
+	default:
+		address = base + uint64(n.offset())
+	}
+	var e error
+	if n.Vector {
+		if (n.Opcode & 1) != 0 {
+			var low, high uint64
+			low, high, e = a64LoadVector(m, address, size)
+			if e != nil {
+				return e
+			}
+			p.SetVectorRegister(n.Rt, low, high)
+		} else {
+			low, high := p.GetVectorRegister(n.Rt)
+			e = a64StoreVector(m, address, low, high, size)
+		}
+	} else if n.Opcode == 0 {
+		e = a64Store(m, address, p.GetRegister(n.Rt), size)
+	} else {
+		var value uint64
+		value, e = a64Load(m, address, size)
+		if e != nil {
+			return e
+		}
+		if n.Opcode >= 2 {
+			value = a64SignExtend(value, size*8)
+			// Opcode 3 sign-extends to 32 bits.
+			if n.Opcode == 3 {
+				value &= 0xffffffff
+			}
+		}
+		p.SetRegister(n.Rt, value)
+	}
+	if e != nil {
+		return e
+	}
+	if (n.Addressing == a64PostIndexAddressing) ||
+		(n.Addressing == a64PreIndexAddressing) {
+		a64WriteRegister(p, n.Rn, base+uint64(n.offset()), true, true)
+	}
+	return nil
+}
+
+// Updates the base register of a post-indexed structure load or store, using
+// either Rm or the number of bytes transferred if Rm is 31.
+func a64PostIndexStructure(p A64Processor, rn, rm A64Register, base,
+	bytes uint64) {
+	if rm == 31 {
+		a64WriteRegister(p, rn, base+bytes, true, true)
+		return
+	}
+	a64WriteRegister(p, rn, base+p.GetRegister(rm), true, true)
+}
+
+func (n *LoadStoreMultipleA64Instruction) Emulate(p A64Processor) error {
+	m := p.GetMemoryInterface()
+	base := a64ReadRegister(p, n.Rn, true, true)
+	structureElements, count := n.layout()
+	repeats := count / structureElements
+	elementBytes := uint8(1) << n.Size
+	elements := 8 / elementBytes
+	if n.Q {
+		elements *= 2
+	}
+	offset := uint64(0)
+	for r := uint8(0); r < repeats; r++ {
+		for i := uint8(0); i < elements; i++ {
+			t := (n.Rt + A64Register(r)) & 31
+			for s := uint8(0); s < structureElements; s++ {
+				var v [2]uint64
+				v[0], v[1] = p.GetVectorRegister(t)
+				address := base + offset
+				if n.Load {
+					value, e := a64Load(m, address, elementBytes)
+					if e != nil {
+						return e
+					}
+					if !n.Q {
+						v[1] = 0
+					}
+					a64SetElement(&v, i, n.Size, value)
+					p.SetVectorRegister(t, v[0], v[1])
+				} else {
+					e := a64Store(m, address, a64GetElement(v, i, n.Size),
+						elementBytes)
+					if e != nil {
+						return e
+					}
+				}
+				offset += uint64(elementBytes)
+				t = (t + 1) & 31
+			}
+		}
+	}
+	if n.PostIndex {
+		a64PostIndexStructure(p, n.Rn, n.Rm, base, offset)
+	}
+	return nil
+}
+
+func (n *LoadStoreSingleA64Instruction) Emulate(p A64Processor) error {
+	m := p.GetMemoryInterface()
+	base := a64ReadRegister(p, n.Rn, true, true)
+	elementBytes := uint8(1) << n.Size
+	offset := uint64(0)
+	t := n.Rt
+	for s := uint8(0); s < n.Count; s++ {
+		address := base + offset
+		var v [2]uint64
+		v[0], v[1] = p.GetVectorRegister(t)
+		if n.Replicate {
+			value, e := a64Load(m, address, elementBytes)
+			if e != nil {
+				return e
+			}
+			for width := uint(8) << n.Size; width < 64; width *= 2 {
+				value |= value << width
+			}
+			v[0] = value
+			v[1] = 0
+			if n.Q {
+				v[1] = value
+			}
+			p.SetVectorRegister(t, v[0], v[1])
+		} else if n.Load {
+			value, e := a64Load(m, address, elementBytes)
+			if e != nil {
+				return e
+			}
+			a64SetElement(&v, n.Index, n.Size, value)
+			p.SetVectorRegister(t, v[0], v[1])
+		} else {
+			e := a64Store(m, address, a64GetElement(v, n.Index, n.Size),
+				elementBytes)
+			if e != nil {
+				return e
+			}
+		}
+		offset += uint64(elementBytes)
+		t = (t + 1) & 31
+	}
+	if n.PostIndex {
+		a64PostIndexStructure(p, n.Rn, n.Rm, base, offset)
+	}
+	return nil
+}
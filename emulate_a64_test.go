@@ -0,0 +1,505 @@
+package arm_emulate
+
+import (
+	"errors"
+	"testing"
+)
+
+// The address at which single test instructions are placed. This is near the
+// end of a page, so adrp results differ from the instruction's address.
+const a64TestCodeAddress = 0x10ff0
+
+// Returns an A64 processor with a page of memory for code at 0x10000, and
+// 8KB of data at 0x20000. SP points to the end of the data.
+func setupA64TestProcessor() (A64Processor, error) {
+	p := NewA64Processor()
+	m := p.GetMemoryInterface()
+	e := m.SetMemoryRegion(0x10000, make([]byte, 4096))
+	if e != nil {
+		return nil, e
+	}
+	e = m.SetMemoryRegion(0x20000, make([]byte, 8192))
+	if e != nil {
+		return nil, e
+	}
+	p.SetSP(0x21000)
+	return p, nil
+}
+
+// Writes a single instruction to a64TestCodeAddress, then runs it.
+func runA64TestInstruction(p A64Processor, raw uint32) error {
+	e := p.GetMemoryInterface().WriteMemoryWord(a64TestCodeAddress, raw)
+	if e != nil {
+		return e
+	}
+	p.SetPC(a64TestCodeAddress)
+	return p.RunNextInstruction()
+}
+
+func TestA64IntegerInstructions(t *testing.T) {
+	p, e := setupA64TestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up processor: %s\n", e)
+		t.FailNow()
+	}
+	type integerTest struct {
+		raw        uint32
+		x1, x2, x3 uint64
+		flagsIn    uint32
+		expected   uint64
+		flagsOut   uint32
+	}
+	tests := []integerTest{
+		// adds w0, w1, #1
+		{0x31000420, 0xffffffff, 0, 0, 0, 0, 0x60000000},
+		// subs x0, x1, x2
+		{0xeb020020, 5, 7, 0, 0, 0xfffffffffffffffe, 0x80000000},
+		// sub x0, x1, x2, lsl #4
+		{0xcb021020, 0x100, 1, 0, 0, 0xf0, 0},
+		// add x0, sp, w1, uxtw #2
+		{0x8b214be0, 0xffffffff00000010, 0, 0, 0, 0x21040, 0},
+		// adc x0, x1, x2
+		{0x9a020020, 1, 2, 0, 0x20000000, 4, 0x20000000},
+		// sbcs w0, w1, w2
+		{0x7a020020, 5, 5, 0, 0, 0xffffffff, 0x80000000},
+		// and x0, x1, #0xff00ff00ff00ff00
+		{0x92089c20, 0xffffffffffffffff, 0, 0, 0, 0xff00ff00ff00ff00, 0},
+		// ands w0, w1, w2, lsr #4
+		{0x6a421020, 0xf0, 0xf00, 0, 0x30000000, 0xf0, 0},
+		// eon x0, x1, x2
+		{0xca220020, 0, 0xff, 0, 0, 0xffffffffffffff00, 0},
+		// movk x0, #0x5678, lsl #16
+		{0xf2aacf00, 0, 0, 0, 0, 0x1111111156781111, 0},
+		// mov w0, #-2
+		{0x12800020, 0, 0, 0, 0, 0xfffffffe, 0},
+		// ubfx x0, x1, #8, #8
+		{0xd3483c20, 0x12345678, 0, 0, 0, 0x56, 0},
+		// sbfx x0, x1, #4, #8
+		{0x93442c20, 0xf80, 0, 0, 0, 0xfffffffffffffff8, 0},
+		// sbfiz w0, w1, #8, #4
+		{0x13180c20, 0xa, 0, 0, 0, 0xfffffa00, 0},
+		// bfi x0, x1, #16, #8
+		{0xb3701c20, 0xab, 0, 0, 0, 0x1111111111ab1111, 0},
+		// bfxil w0, w1, #4, #8
+		{0x33042c20, 0xabc0, 0, 0, 0, 0x111111bc, 0},
+		// extr x0, x1, x2, #32
+		{0x93c28020, 0x12345678, 0xffffffff00000000, 0, 0,
+			0x12345678ffffffff, 0},
+		// lsl w0, w1, #4
+		{0x531c6c20, 0x12345678, 0, 0, 0, 0x23456780, 0},
+		// asr x0, x1, #3
+		{0x9343fc20, 0x8000000000000000, 0, 0, 0, 0xf000000000000000, 0},
+		// ror w0, w1, #8
+		{0x13812020, 0x12345678, 0, 0, 0, 0x78123456, 0},
+		// mul x0, x1, x2
+		{0x9b027c20, 3, 0xfffffffffffffffb, 0, 0, 0xfffffffffffffff1, 0},
+		// msub x0, x1, x2, x3
+		{0x9b028c20, 3, 4, 100, 0, 88, 0},
+		// smull x0, w1, w2
+		{0x9b227c20, 0xffffffff, 7, 0, 0, 0xfffffffffffffff9, 0},
+		// umulh x0, x1, x2
+		{0x9bc27c20, 0xffffffffffffffff, 0xffffffffffffffff, 0, 0,
+			0xfffffffffffffffe, 0},
+		// smulh x0, x1, x2
+		{0x9b427c20, 0x8000000000000000, 2, 0, 0, 0xffffffffffffffff, 0},
+		// udiv w0, w1, w2
+		{0x1ac20820, 100, 0, 0, 0, 0, 0},
+		// sdiv x0, x1, x2
+		{0x9ac20c20, 0x8000000000000000, 0xffffffffffffffff, 0, 0,
+			0x8000000000000000, 0},
+		{0x9ac20c20, 0xfffffffffffffff9, 2, 0, 0, 0xfffffffffffffffd, 0},
+		// lsr x0, x1, x2
+		{0x9ac22420, 0x100, 68, 0, 0, 0x10, 0},
+		// asr w0, w1, w2
+		{0x1ac22820, 0x80000000, 31, 0, 0, 0xffffffff, 0},
+		// ror x0, x1, x2
+		{0x9ac22c20, 1, 1, 0, 0, 0x8000000000000000, 0},
+		// clz x0, x1
+		{0xdac01020, 0x12345678, 0, 0, 0, 35, 0},
+		// cls w0, w1
+		{0x5ac01420, 0xfffffff0, 0, 0, 0, 27, 0},
+		// rbit w0, w1
+		{0x5ac00020, 1, 0, 0, 0, 0x80000000, 0},
+		// rev16 x0, x1, rev32 x0, x1 and rev x0, x1
+		{0xdac00420, 0x0102030405060708, 0, 0, 0, 0x0201040306050807, 0},
+		{0xdac00820, 0x0102030405060708, 0, 0, 0, 0x0403020108070605, 0},
+		{0xdac00c20, 0x0102030405060708, 0, 0, 0, 0x0807060504030201, 0},
+		// crc32b w0, w1, w2
+		{0x1ac24020, 0xffffffff, 0x61, 0, 0, 0x174841bc, 0},
+		// crc32cx w0, w1, x2
+		{0x9ac25c20, 0x12345678, 0x0123456789abcdef, 0, 0, 0xa3d207be, 0},
+		// csel x0, x1, x2, eq
+		{0x9a820020, 1, 2, 0, 0x40000000, 1, 0x40000000},
+		// csinc x0, x1, x2, eq
+		{0x9a820420, 1, 2, 0, 0, 3, 0},
+		// csinv w0, w1, w2, eq
+		{0x5a820020, 1, 2, 0, 0, 0xfffffffd, 0},
+		// csneg x0, x1, x2, eq
+		{0xda820420, 1, 2, 0, 0, 0xfffffffffffffffe, 0},
+		// ccmp x1, #5, #2, ne
+		{0xfa451822, 5, 0, 0, 0x40000000, 0x1111111111111111, 0x20000000},
+		{0xfa451822, 5, 0, 0, 0, 0x1111111111111111, 0x60000000},
+		// ccmn w1, w2, #8, eq
+		{0x3a420028, 1, 2, 0, 0, 0x1111111111111111, 0x80000000},
+		// adr x0, #-8 and adrp x0, #8192
+		{0x10ffffc0, 0, 0, 0, 0, a64TestCodeAddress - 8, 0},
+		{0xd0000000, 0, 0, 0, 0, 0x12000, 0},
+		// mrs x0, nzcv and msr nzcv, x1
+		{0xd53b4200, 0, 0, 0, 0x90000000, 0x90000000, 0x90000000},
+		{0xd51b4201, 0xffffffffffffffff, 0, 0, 0, 0x1111111111111111,
+			0xf0000000},
+		// mrs x0, dczid_el0
+		{0xd53b00e0, 0, 0, 0, 0, 4, 0},
+	}
+	for _, test := range tests {
+		p.SetRegister(0, 0x1111111111111111)
+		p.SetRegister(1, test.x1)
+		p.SetRegister(2, test.x2)
+		p.SetRegister(3, test.x3)
+		p.SetNZCV(test.flagsIn)
+		e = runA64TestInstruction(p, test.raw)
+		if e != nil {
+			t.Logf("Failed running 0x%08x: %s\n", test.raw, e)
+			t.Fail()
+			continue
+		}
+		value := p.GetRegister(0)
+		if value != test.expected {
+			t.Logf("Expected 0x%08x to produce 0x%x, got 0x%x\n", test.raw,
+				test.expected, value)
+			t.Fail()
+		}
+		if p.GetNZCV() != test.flagsOut {
+			t.Logf("Expected 0x%08x to set flags 0x%08x, got 0x%08x\n",
+				test.raw, test.flagsOut, p.GetNZCV())
+			t.Fail()
+		}
+	}
+}
+
+func TestA64FPInstructions(t *testing.T) {
+	p, e := setupA64TestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up processor: %s\n", e)
+		t.FailNow()
+	}
+	type fpTest struct {
+		raw     uint32
+		a, b, c uint64
+		fpcr    uint32
+		// The expected low and high 64 bits of v0. If general is set, low is
+		// the expected value of x0 instead.
+		low, high uint64
+		general   bool
+		fpsr      uint32
+		nzcv      uint32
+	}
+	const unchanged = 0x5555555555555555
+	tests := []fpTest{
+		// fadd d0, d1, d2
+		{0x1e622820, 0x3ff8000000000000, 0x4002000000000000, 0, 0,
+			0x400e000000000000, 0, false, 0, 0},
+		// fsub s0, s1, s2, which is inexact
+		{0x1e223820, 0x3f800000, 0x30800000, 0, 0, 0x3f800000, 0, false,
+			0x10, 0},
+		// fmul d0, d1, d2, which overflows
+		{0x1e620820, 0x7fe1ccf385ebc8a0, 0x4024000000000000, 0, 0,
+			0x7ff0000000000000, 0, false, 0x14, 0},
+		// fdiv d0, d1, d2, dividing by zero
+		{0x1e621820, 0x3ff0000000000000, 0, 0, 0, 0x7ff0000000000000, 0,
+			false, 0x2, 0},
+		// fnmul s0, s1, s2
+		{0x1e228820, 0x40000000, 0x40400000, 0, 0, 0xc0c00000, 0, false, 0,
+			0},
+		// fmax d0, d1, d2 with -0.0 and 0.0
+		{0x1e624820, 0x8000000000000000, 0, 0, 0, 0, 0, false, 0, 0},
+		// fminnm d0, d1, d2 with a quiet NaN
+		{0x1e627820, 0x7ff8000000000000, 0x3ff0000000000000, 0, 0,
+			0x3ff0000000000000, 0, false, 0, 0},
+		// fmaxnm d0, d1, d2 with a signaling NaN
+		{0x1e626820, 0x7ff0000000000001, 0x3ff0000000000000, 0, 0,
+			0x7ff8000000000001, 0, false, 0x1, 0},
+		// fmin d0, d1, d2 with a quiet NaN
+		{0x1e625820, 0x7ff8000000000000, 0x3ff0000000000000, 0, 0,
+			0x7ff8000000000000, 0, false, 0, 0},
+		// fmadd d0, d1, d2, d3, where the exact result is -2^-60 but an
+		// unfused multiply and add gives 0.
+		{0x1f420c20, 0x3ff0000000400000, 0x3fefffffff800000,
+			0xbff0000000000000, 0, 0xbc30000000000000, 0, false, 0, 0},
+		// fnmsub s0, s1, s2, s3
+		{0x1f228c20, 0x40000000, 0x40400000, 0x3f800000, 0, 0x40a00000, 0,
+			false, 0, 0},
+		// fsqrt d0, d1
+		{0x1e61c020, 0x4000000000000000, 0, 0, 0, 0x3ff6a09e667f3bcd, 0,
+			false, 0x10, 0},
+		{0x1e61c020, 0xbff0000000000000, 0, 0, 0, 0x7ff8000000000000, 0,
+			false, 0x1, 0},
+		// fabs s0, s1 and fneg d0, d1
+		{0x1e20c020, 0xc0200000, 0, 0, 0, 0x40200000, 0, false, 0, 0},
+		{0x1e614020, 0x3ff0000000000000, 0, 0, 0, 0xbff0000000000000, 0,
+			false, 0, 0},
+		// fcvt s0, d1 and fcvt d0, s1
+		{0x1e624020, 0x3fb999999999999a, 0, 0, 0, 0x3dcccccd, 0, false,
+			0x10, 0},
+		{0x1e22c020, 0x3f000000, 0, 0, 0, 0x3fe0000000000000, 0, false, 0,
+			0},
+		// frinta d0, d1 and frintn d0, d1 with 2.5
+		{0x1e664020, 0x4004000000000000, 0, 0, 0, 0x4008000000000000, 0,
+			false, 0, 0},
+		{0x1e644020, 0x4004000000000000, 0, 0, 0, 0x4000000000000000, 0,
+			false, 0, 0},
+		// frintm s0, s1
+		{0x1e254020, 0xbfc00000, 0, 0, 0, 0xc0000000, 0, false, 0, 0},
+		// frintx d0, d1, rounding towards plus infinity
+		{0x1e674020, 0x3ff4000000000000, 0, 0, 0x00400000,
+			0x4000000000000000, 0, false, 0x10, 0},
+		// fcvtzs x0, d1
+		{0x9e780020, 0xc00e000000000000, 0, 0, 0, 0xfffffffffffffffd, 0,
+			true, 0x10, 0},
+		// fcvtzu w0, d1, which saturates
+		{0x1e790020, 0xbff0000000000000, 0, 0, 0, 0, 0, true, 0x1, 0},
+		// fcvtas w0, s1
+		{0x1e240020, 0xc0200000, 0, 0, 0, 0xfffffffd, 0, true, 0x10, 0},
+		// fcvtms x0, d1, which saturates
+		{0x9e700020, 0x43e158e460913d00, 0, 0, 0, 0x7fffffffffffffff, 0,
+			true, 0x1, 0},
+		// fcvtzs w0, d1, #4
+		{0x1e58f020, 0x3ff8000000000000, 0, 0, 0, 24, 0, true, 0, 0},
+		// scvtf d0, x1 with 2^53 + 1
+		{0x9e620020, 0x20000000000001, 0, 0, 0, 0x4340000000000000, 0,
+			false, 0x10, 0},
+		// ucvtf s0, x1
+		{0x9e230020, 0xffffffffffffffff, 0, 0, 0, 0x5f800000, 0, false, 0x10,
+			0},
+		// scvtf s0, w1, #8
+		{0x1e02e020, 0xffffff00, 0, 0, 0, 0xbf800000, 0, false, 0, 0},
+		// fmov d0, x1, fmov x0, d1 and fmov v0.d[1], x1
+		{0x9e670020, 0x123456789abcdef0, 0, 0, 0, 0x123456789abcdef0, 0,
+			false, 0, 0},
+		{0x9e660020, 0x123456789abcdef0, 0, 0, 0, 0x123456789abcdef0, 0,
+			true, 0, 0},
+		{0x9eaf0020, 0x42, 0, 0, 0, unchanged, 0x42, false, 0, 0},
+		// fmov d0, #-1.25
+		{0x1e7e9000, 0, 0, 0, 0, 0xbff4000000000000, 0, false, 0, 0},
+		// fcmp d1, d2
+		{0x1e622020, 0x3ff0000000000000, 0x4000000000000000, 0, 0, unchanged,
+			unchanged, false, 0, 0x80000000},
+		// fcmpe s1, #0.0 with a quiet NaN
+		{0x1e202038, 0x7fc00000, 0, 0, 0, unchanged, unchanged, false, 0x1,
+			0x30000000},
+		// fccmp d1, d2, #4, ne
+		{0x1e621424, 0x3ff0000000000000, 0x3ff0000000000000, 0, 0,
+			unchanged, unchanged, false, 0, 0x60000000},
+		// fcsel d0, d1, d2, eq
+		{0x1e620c20, 1, 2, 0, 0, 2, 0, false, 0, 0},
+	}
+	for _, test := range tests {
+		p.SetRegister(0, unchanged)
+		p.SetVectorRegister(0, unchanged, unchanged)
+		inputs := []uint64{test.a, test.b, test.c}
+		for i, value := range inputs {
+			p.SetRegister(A64Register(i+1), value)
+			p.SetVectorRegister(A64Register(i+1), value, 0)
+		}
+		p.SetFPCR(test.fpcr)
+		p.SetFPSR(0)
+		p.SetNZCV(0)
+		e = runA64TestInstruction(p, test.raw)
+		if e != nil {
+			t.Logf("Failed running 0x%08x: %s\n", test.raw, e)
+			t.Fail()
+			continue
+		}
+		if test.general {
+			value := p.GetRegister(0)
+			if value != test.low {
+				t.Logf("Expected 0x%08x to produce 0x%x, got 0x%x\n",
+					test.raw, test.low, value)
+				t.Fail()
+			}
+		} else {
+			low, high := p.GetVectorRegister(0)
+			if (low != test.low) || (high != test.high) {
+				t.Logf("Expected 0x%08x to produce 0x%x:%x, got 0x%x:%x\n",
+					test.raw, test.high, test.low, high, low)
+				t.Fail()
+			}
+		}
+		if p.GetFPSR() != test.fpsr {
+			t.Logf("Expected 0x%08x to set FPSR to 0x%x, got 0x%x\n",
+				test.raw, test.fpsr, p.GetFPSR())
+			t.Fail()
+		}
+		if p.GetNZCV() != test.nzcv {
+			t.Logf("Expected 0x%08x to set flags 0x%08x, got 0x%08x\n",
+				test.raw, test.nzcv, p.GetNZCV())
+			t.Fail()
+		}
+	}
+}
+
+func TestA64Program(t *testing.T) {
+	p, e := setupA64TestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up processor: %s\n", e)
+		t.FailNow()
+	}
+	program := []uint32{
+		// mov x0, #0x20000; mov x1, #0; mov x2, #4
+		0xd2a00040, 0xd2800001, 0xd2800082,
+		// loop: ldr w3, [x0], #4; add x1, x1, x3; subs x2, x2, #1;
+		// b.ne loop
+		0xb8404403, 0x8b030021, 0xf1000442, 0x54ffffa1,
+		// bl func; ldr x4, literal; stp x1, x4, [sp, #-16]!
+		0x94000013, 0x58000284, 0xa9bf13e1,
+		// ldrsb x5, [sp, #15]; ldpsw x6, x7, [sp, #8]; mov x8, #2;
+		// ldrh w9, [sp, x8, lsl #1]
+		0x39803fe5, 0x69411fe6, 0xd2800048, 0x78687be9,
+		// ldxr x10, [x0]; stxr w11, x1, [x0]; stxr w12, x1, [x0]
+		0xc85f7c0a, 0xc80b7c01, 0xc80c7c01,
+		// fmov d0, x4; str q0, [x0, #16]; ld1 { v1.2d }, [x0];
+		// ld1r { v2.4s }, [x0]
+		0x9e670080, 0x3d800400, 0x4c407c01, 0x4d40c802,
+		// msr tpidr_el0, x4; mrs x14, tpidr_el0; cbz x12, end; mov x13, #1;
+		// b end
+		0xd51bd044, 0xd53bd04e, 0xb40000ec, 0xd280002d, 0x14000005,
+		// func: add x1, x1, #100; ret
+		0x91019021, 0xd65f03c0,
+		// literal: .quad 0x8877665544332211
+		0x44332211, 0x88776655,
+		// end: nop
+		0xd503201f,
+	}
+	m := p.GetMemoryInterface()
+	for i, word := range program {
+		m.WriteMemoryWord(0x10000+uint64(i)*4, word)
+	}
+	data := []uint32{1, 2, 3, 0xfffffffe, 0xcafef00d, 0xdeadbeef}
+	for i, word := range data {
+		m.WriteMemoryWord(0x20000+uint64(i)*4, word)
+	}
+	p.SetPC(0x10000)
+	end := 0x10000 + uint64(len(program))*4
+	for i := 0; p.GetPC() != end; i++ {
+		if i >= 100 {
+			t.Logf("The program didn't finish. PC = 0x%x\n", p.GetPC())
+			t.FailNow()
+		}
+		e = p.RunNextInstruction()
+		if e != nil {
+			t.Logf("Failed running program: %s\n", e)
+			t.FailNow()
+		}
+	}
+	expected := map[A64Register]uint64{
+		0:  0x20010,
+		1:  0x100000068,
+		4:  0x8877665544332211,
+		5:  0xffffffffffffff88,
+		6:  0x44332211,
+		7:  0xffffffff88776655,
+		9:  1,
+		10: 0xdeadbeefcafef00d,
+		11: 0,
+		12: 1,
+		13: 1,
+		14: 0x8877665544332211,
+		30: 0x10020,
+	}
+	for r, value := range expected {
+		if p.GetRegister(r) != value {
+			t.Logf("Expected %s to be 0x%x, got 0x%x\n", r.x(), value,
+				p.GetRegister(r))
+			t.Fail()
+		}
+	}
+	if p.GetSP() != 0x20ff0 {
+		t.Logf("Expected SP to be 0x20ff0, got 0x%x\n", p.GetSP())
+		t.Fail()
+	}
+	low, high := p.GetVectorRegister(1)
+	if (low != 0x100000068) || (high != 0) {
+		t.Logf("Incorrect v1 after ld1: 0x%x:%x\n", high, low)
+		t.Fail()
+	}
+	low, high = p.GetVectorRegister(2)
+	if (low != 0x0000006800000068) || (high != low) {
+		t.Logf("Incorrect v2 after ld1r: 0x%x:%x\n", high, low)
+		t.Fail()
+	}
+	value, _ := m.ReadMemoryDoubleword(0x20020)
+	if value != 0x8877665544332211 {
+		t.Logf("Incorrect value stored by str q0: 0x%x\n", value)
+		t.Fail()
+	}
+}
+
+type testA64SupervisorCallHandler struct {
+	immediates []uint16
+}
+
+func (h *testA64SupervisorCallHandler) HandleSupervisorCall(p A64Processor,
+	immediate uint16) (bool, error) {
+	if immediate == 0 {
+		return false, nil
+	}
+	h.immediates = append(h.immediates, immediate)
+	p.SetRegister(0, p.GetPC())
+	return true, nil
+}
+
+func TestA64Exceptions(t *testing.T) {
+	p, e := setupA64TestProcessor()
+	if e != nil {
+		t.Logf("Failed setting up processor: %s\n", e)
+		t.FailNow()
+	}
+	var handler testA64SupervisorCallHandler
+	p.AddSupervisorCallHandler(&handler)
+	// svc #0x1234
+	e = runA64TestInstruction(p, 0xd4024681)
+	if e != nil {
+		t.Logf("Failed running svc: %s\n", e)
+		t.FailNow()
+	}
+	if (len(handler.immediates) != 1) || (handler.immediates[0] != 0x1234) {
+		t.Logf("The handler got incorrect immediates: %v\n",
+			handler.immediates)
+		t.Fail()
+	}
+	if p.GetRegister(0) != (a64TestCodeAddress + 4) {
+		t.Logf("Expected the PC to be 0x%x in the handler, got 0x%x\n",
+			a64TestCodeAddress+4, p.GetRegister(0))
+		t.Fail()
+	}
+	// svc #0, which the handler ignores
+	e = runA64TestInstruction(p, 0xd4000001)
+	if e == nil {
+		t.Logf("Didn't get an error for an unhandled svc\n")
+		t.Fail()
+	}
+	// ldr x0, [x1] with x1 unmapped
+	p.SetRegister(1, 0x123456789000)
+	e = runA64TestInstruction(p, 0xf9400020)
+	var accessError *A64MemoryAccessError
+	if !errors.As(e, &accessError) {
+		t.Logf("Expected a memory access error, got %v\n", e)
+		t.Fail()
+	} else if accessError.Address != 0x123456789000 {
+		t.Logf("Got an incorrect fault address: 0x%x\n",
+			accessError.Address)
+		t.Fail()
+	}
+	// mrs x0, sctlr_el1, which isn't accessible at EL0
+	e = runA64TestInstruction(p, 0xd5381000)
+	if !errors.Is(e, errUndefinedInstruction) {
+		t.Logf("Expected an undefined instruction error, got %v\n", e)
+		t.Fail()
+	}
+	p.SetPC(0x10002)
+	e = p.RunNextInstruction()
+	if e == nil {
+		t.Logf("Didn't get an error for a misaligned PC\n")
+		t.Fail()
+	}
+}
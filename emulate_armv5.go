@@ -0,0 +1,148 @@
+package arm_emulate
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Writes a value loaded from memory to the PC. In ARMv5TE, bit 0 of the value
+// selects THUMB or ARM mode, as with bx. Earlier versions ignore it.
+func writePCInterworking(p ARMProcessor, value uint32) error {
+	if p.Architecture() < ARMv5TE {
+		return p.SetRegister(15, value)
+	}
+	e := p.SetTHUMBMode((value & 1) != 0)
+	if e != nil {
+		return e
+	}
+	if (value & 1) != 0 {
+		return p.SetRegister(15, value&0xfffffffe)
+	}
+	return p.SetRegister(15, value&0xfffffffc)
+}
+
+// Clamps a value to the range of a signed 32-bit integer, returning true if
+// it was out of range.
+func saturate32(value int64) (uint32, bool) {
+	if value > math.MaxInt32 {
+		return math.MaxInt32, true
+	}
+	if value < math.MinInt32 {
+		return 0x80000000, true
+	}
+	return uint32(int32(value)), false
+}
+
+func (n *CountLeadingZerosInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	value, _ := p.GetRegister(n.Rm)
+	return p.SetRegister(n.Rd, uint32(bits.LeadingZeros32(value)))
+}
+
+func (n *BreakpointInstruction) Emulate(p ARMProcessor) error {
+	if !p.ArchitecturalExceptions() {
+		return fmt.Errorf("Reached breakpoint %04x", n.Comment)
+	}
+	// The PC already points to the following instruction, and the prefetch
+	// abort handler returns to the breakpoint using subs pc, lr, 4.
+	currentPC, _ := p.GetRegister(15)
+	return enterException(p, abortMode, prefetchAbortVector, currentPC,
+		false)
+}
+
+func (n *SaturatingArithmeticInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rm)
+	b, _ := p.GetRegister(n.Rn)
+	saturated := false
+	operand := int64(int32(b))
+	if n.Double {
+		var doubled uint32
+		doubled, saturated = saturate32(operand * 2)
+		operand = int64(int32(doubled))
+	}
+	var result int64
+	if n.Subtract {
+		result = int64(int32(a)) - operand
+	} else {
+		result = int64(int32(a)) + operand
+	}
+	value, overflowed := saturate32(result)
+	if saturated || overflowed {
+		p.SetStickyOverflow(true)
+	}
+	return p.SetRegister(n.Rd, value)
+}
+
+// Returns the top or bottom halfword of a value, sign extended.
+func signedHalfword(value uint32, top bool) int64 {
+	if top {
+		return int64(int16(value >> 16))
+	}
+	return int64(int16(value))
+}
+
+func (n *SignedHalfwordMultiplyInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rm)
+	b, _ := p.GetRegister(n.Rs)
+	var product int64
+	if n.Word {
+		product = (int64(int32(a)) * signedHalfword(b, n.RsTop)) >> 16
+	} else {
+		product = signedHalfword(a, n.RmTop) * signedHalfword(b, n.RsTop)
+	}
+	if n.IsLongMultiply {
+		low, _ := p.GetRegister(n.RdLow)
+		high, _ := p.GetRegister(n.RdHigh)
+		result := uint64(product) + ((uint64(high) << 32) | uint64(low))
+		p.SetRegister(n.RdLow, uint32(result))
+		return p.SetRegister(n.RdHigh, uint32(result>>32))
+	}
+	if !n.Accumulate {
+		return p.SetRegister(n.Rd, uint32(product))
+	}
+	c, _ := p.GetRegister(n.Rn)
+	result := product + int64(int32(c))
+	if (result > math.MaxInt32) || (result < math.MinInt32) {
+		p.SetStickyOverflow(true)
+	}
+	return p.SetRegister(n.Rd, uint32(result))
+}
+
+// The pld instruction is only a hint, so it doesn't need to do anything.
+func (n *PreloadInstruction) Emulate(p ARMProcessor) error {
+	return nil
+}
+
+func (n *CoprocDoubleRegisterTransferInstruction) Emulate(
+	p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	for _, c := range p.GetCoprocessors() {
+		if c.Number() != n.CoprocNumber {
+			continue
+		}
+		d, ok := c.(ARMDoubleRegisterCoprocessor)
+		if !ok {
+			break
+		}
+		e := d.DoubleRegisterTransfer(p, n.raw, n.Rd, n.Rn, n.Load)
+		if e != nil {
+			return fmt.Errorf("Coprocessor register transfer error: %w", e)
+		}
+		return nil
+	}
+	if p.ArchitecturalExceptions() {
+		return errUndefinedInstruction
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func TestARMv5TEArithmetic(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	type arithmeticTest struct {
+		raw            uint32
+		r1, r2, r3     uint32
+		expected       uint32
+		stickyOverflow bool
+	}
+	tests := []arithmeticTest{
+		// clz r0, r1
+		{0xe16f0f11, 0x00010000, 0, 0, 15, false},
+		{0xe16f0f11, 0, 0, 0, 32, false},
+		// qadd r0, r1, r2
+		{0xe1020051, 1, 2, 0, 3, false},
+		{0xe1020051, 0x7fffffff, 1, 0, 0x7fffffff, true},
+		// qsub r0, r1, r2
+		{0xe1220051, 0x80000000, 1, 0, 0x80000000, true},
+		// qdadd r0, r1, r2 saturates when doubling r2.
+		{0xe1420051, 0xffffffff, 0x40000000, 0, 0x7ffffffe, true},
+		// smlabb r0, r1, r2, r3
+		{0xe1003281, 0xffff0003, 0x0005fffe, 10, 4, false},
+		{0xe1003281, 0x7fff, 0x7fff, 0x7fffffff, 0xbfff0000, true},
+		// smlatb r0, r1, r2, r3
+		{0xe10032a1, 0xfffe0000, 3, 1, 0xfffffffb, false},
+		// smulwt r0, r1, r2
+		{0xe12002e1, 0x00020000, 0x00030000, 0, 6, false},
+		// smultt r0, r1, r2
+		{0xe16002e1, 0xfffd0000, 0x00040000, 0, 0xfffffff4, false},
+	}
+	for i, test := range tests {
+		p.SetStickyOverflow(false)
+		p.SetRegister(1, test.r1)
+		p.SetRegister(2, test.r2)
+		p.SetRegister(3, test.r3)
+		e = testSingleInstruction(test.raw, p)
+		if e != nil {
+			t.Logf("Test %d failed: %s\n", i, e)
+			t.FailNow()
+		}
+		value, _ := p.GetRegister(0)
+		if value != test.expected {
+			t.Logf("Test %d: expected 0x%08x, got 0x%08x\n", i, test.expected,
+				value)
+			t.Fail()
+		}
+		if p.StickyOverflow() != test.stickyOverflow {
+			t.Logf("Test %d: incorrect Q flag\n", i)
+			t.Fail()
+		}
+	}
+	// smlalbb r4, r5, r1, r2
+	p.SetRegister(1, 2)
+	p.SetRegister(2, 3)
+	p.SetRegister(4, 0xffffffff)
+	p.SetRegister(5, 0)
+	e = testSingleInstruction(0xe1454281, p)
+	if e != nil {
+		t.Logf("Failed running smlalbb: %s\n", e)
+		t.FailNow()
+	}
+	low, _ := p.GetRegister(4)
+	high, _ := p.GetRegister(5)
+	if (low != 5) || (high != 1) {
+		t.Logf("Incorrect smlalbb result: 0x%08x%08x\n", high, low)
+		t.Fail()
+	}
+	// Only writing the flags can clear the Q flag, including in user mode.
+	p.SetStickyOverflow(true)
+	// msr cpsr_f, 0
+	e = testSingleInstruction(0xe328f000, p)
+	if (e != nil) || p.StickyOverflow() {
+		t.Logf("msr didn't clear the Q flag: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestARMv5TEDataTransfers(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(0, 0x1800)
+	p.SetRegister(2, 0x11111111)
+	p.SetRegister(3, 0x22222222)
+	// strd r2, [r0, -8]!
+	e = testSingleInstruction(0xe16020f8, p)
+	if e != nil {
+		t.Logf("Failed running strd: %s\n", e)
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(0)
+	if value != 0x17f8 {
+		t.Logf("Incorrect strd writeback: 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetMemoryInterface().ReadMemoryWord(0x17fc)
+	if value != 0x22222222 {
+		t.Logf("strd didn't store the second register: 0x%08x\n", value)
+		t.Fail()
+	}
+	p.SetRegister(2, 0)
+	p.SetRegister(3, 0)
+	// ldrd r2, [r0]
+	e = testSingleInstruction(0xe1c020d0, p)
+	if e != nil {
+		t.Logf("Failed running ldrd: %s\n", e)
+		t.FailNow()
+	}
+	low, _ := p.GetRegister(2)
+	high, _ := p.GetRegister(3)
+	if (low != 0x11111111) || (high != 0x22222222) {
+		t.Logf("Incorrect ldrd result: 0x%08x, 0x%08x\n", low, high)
+		t.Fail()
+	}
+	// pld [r1, 4] shouldn't do anything, even for an unmapped address.
+	p.SetRegister(1, 0x80000000)
+	e = testSingleInstruction(0xf5d1f004, p)
+	if e != nil {
+		t.Logf("Failed running pld: %s\n", e)
+		t.Fail()
+	}
+	// ldr pc, [r1] switches to THUMB mode if bit 0 is set.
+	p.GetMemoryInterface().WriteMemoryWord(0x1900, 0x1201)
+	p.SetRegister(1, 0x1900)
+	e = testSingleInstruction(0xe591f000, p)
+	if e != nil {
+		t.Logf("Failed running ldr pc: %s\n", e)
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(15)
+	if !p.THUMBMode() || (value != 0x1200) {
+		t.Logf("ldr pc didn't switch to THUMB mode: 0x%08x\n", value)
+		t.Fail()
+	}
+	// ARMv4T ignores bit 0.
+	p.SetTHUMBMode(false)
+	e = p.SetArchitecture(ARMv4T)
+	if e != nil {
+		t.Logf("Failed setting the architecture: %s\n", e)
+		t.FailNow()
+	}
+	e = testSingleInstruction(0xe591f000, p)
+	if (e != nil) || p.THUMBMode() {
+		t.Logf("ARMv4T ldr pc switched to THUMB mode: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestCoprocDoubleRegisterTransfer(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	e = p.AddCoprocessor(NewTestStorageCoprocessor(5))
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(0, 1337)
+	p.SetRegister(3, 1)
+	program := []uint32{
+		// mcrr p5, 0, r0, r1, c0
+		0xec410500,
+		// mrrc p5, 0, r2, r3, c0
+		0xec532500,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	low, _ := p.GetRegister(2)
+	high, _ := p.GetRegister(3)
+	if (low != 1337) || (high != 0) {
+		t.Logf("Incorrect mrrc result: %d, %d\n", low, high)
+		t.Fail()
+	}
+	// mcrr p6, 0, r0, r1, c0 is undefined without a coprocessor 6.
+	p.SetArchitecturalExceptions(true)
+	e = testSingleInstruction(0xec410600, p)
+	if e != nil {
+		t.Logf("Got an error for a missing coprocessor: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4100, t)
+}
+
+func TestARMv5TEBranches(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	// blx r3
+	p.SetRegister(3, 0x1101)
+	e = testSingleInstruction(0xe12fff33, p)
+	if e != nil {
+		t.Logf("Failed running blx r3: %s\n", e)
+		t.FailNow()
+	}
+	pc, _ := p.GetRegister(15)
+	lr, _ := p.GetRegister(14)
+	// Like bx, this leaves bit 0 of the PC set.
+	if !p.THUMBMode() || ((pc & 0xfffffffe) != 0x1100) || (lr != 4100) {
+		t.Logf("Incorrect blx r3 result: 0x%08x, 0x%08x\n", pc, lr)
+		t.Fail()
+	}
+	// blx 6
+	p.SetTHUMBMode(false)
+	e = testSingleInstruction(0xfb000001, p)
+	if e != nil {
+		t.Logf("Failed running blx 6: %s\n", e)
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	lr, _ = p.GetRegister(14)
+	if !p.THUMBMode() || (pc != 4110) || (lr != 4100) {
+		t.Logf("Incorrect blx 6 result: 0x%08x, 0x%08x\n", pc, lr)
+		t.Fail()
+	}
+	// The THUMB blx pair, which returns to ARM mode at the next word.
+	e = writeTHUMBInstructionsToMemory([]uint16{0xf000, 0xe802}, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(2, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	lr, _ = p.GetRegister(14)
+	if p.THUMBMode() || (pc != 4104) || (lr != 4101) {
+		t.Logf("Incorrect THUMB blx result: 0x%08x, 0x%08x\n", pc, lr)
+		t.Fail()
+	}
+	// THUMB blx r2
+	p.SetTHUMBMode(true)
+	p.SetRegister(2, 0x1000)
+	e = testSingleTHUMBInstruction(0x4790, p)
+	if e != nil {
+		t.Logf("Failed running blx r2: %s\n", e)
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	lr, _ = p.GetRegister(14)
+	if p.THUMBMode() || (pc != 0x1000) || (lr != 4099) {
+		t.Logf("Incorrect blx r2 result: 0x%08x, 0x%08x\n", pc, lr)
+		t.Fail()
+	}
+	// pop {pc} switches to ARM mode if bit 0 is clear.
+	p.SetTHUMBMode(true)
+	p.SetRegister(13, 0x1a00)
+	p.GetMemoryInterface().WriteMemoryWord(0x1a00, 0x1204)
+	e = testSingleTHUMBInstruction(0xbd00, p)
+	if e != nil {
+		t.Logf("Failed running pop {pc}: %s\n", e)
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	if p.THUMBMode() || (pc != 0x1204) {
+		t.Logf("pop {pc} didn't switch to ARM mode: 0x%08x\n", pc)
+		t.Fail()
+	}
+}
+
+func TestBreakpointInstructions(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	e = testSingleInstruction(0xe1200070, p)
+	if e == nil {
+		t.Logf("Didn't get an error for bkpt without exceptions.\n")
+		t.Fail()
+	}
+	p.SetArchitecturalExceptions(true)
+	e = testSingleInstruction(0xe1200070, p)
+	if e != nil {
+		t.Logf("Failed running bkpt: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0xc, 4100, t)
+	p.SetTHUMBMode(true)
+	e = testSingleTHUMBInstruction(0xbe00, p)
+	if e != nil {
+		t.Logf("Failed running THUMB bkpt: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0xc, 4100, t)
+}
+
+func TestSetArchitecture(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	if p.Architecture() != ARMv6 {
+		t.Logf("Expected ARMv6 by default, got %s\n", p.Architecture())
+		t.Fail()
+	}
+	e = p.SetArchitecture(ARMArchitecture(100))
+	if e == nil {
+		t.Logf("Didn't get an error setting an invalid architecture.\n")
+		t.Fail()
+	}
+	// The instruction cache mustn't keep decodings from another version.
+	p.SetRegister(1, 1)
+	e = testSingleInstruction(0xe16f0f11, p)
+	if e != nil {
+		t.FailNow()
+	}
+	e = p.SetArchitecture(ARMv4T)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(0, 1234)
+	testSingleInstruction(0xe16f0f11, p)
+	value, _ := p.GetRegister(0)
+	if value == 31 {
+		t.Logf("ARMv4T emulated clz\n")
+		t.Fail()
+	}
+	// The Q flag can't be set in ARMv4T.
+	e = testSingleInstruction(0xe328f302, p)
+	if (e != nil) || p.StickyOverflow() {
+		t.Logf("Set the Q flag in ARMv4T user mode: %v\n", e)
+		t.Fail()
+	}
+}
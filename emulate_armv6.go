@@ -0,0 +1,467 @@
+package arm_emulate
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+func (n *ExclusiveLoadStoreInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	address, _ := p.GetRegister(n.Rn)
+	address += uint32(n.Offset) << 2
+	memory := p.GetMemoryInterface()
+	if n.Load {
+		value, e := memory.ReadMemoryWord(address)
+		if e != nil {
+			return e
+		}
+		p.MarkExclusive(address)
+		return p.SetRegister(n.Rd, value)
+	}
+	if !p.IsExclusive(address) {
+		p.ClearExclusive()
+		return p.SetRegister(n.Rd, 1)
+	}
+	value, _ := p.GetRegister(n.Rm)
+	e := memory.WriteMemoryWord(address, value)
+	if e != nil {
+		return e
+	}
+	p.ClearExclusive()
+	return p.SetRegister(n.Rd, 0)
+}
+
+// Returns the result of rev, rev16 or revsh. This is shared with the THUMB
+// versions of the instructions.
+func reverseBytes(value uint32, halfwords, signed bool) uint32 {
+	if !halfwords {
+		return bits.ReverseBytes32(value)
+	}
+	if signed {
+		return uint32(int32(int16(bits.ReverseBytes16(uint16(value)))))
+	}
+	return ((value & 0xff00ff00) >> 8) | ((value & 0x00ff00ff) << 8)
+}
+
+func (n *ReverseBytesInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	value, _ := p.GetRegister(n.Rm)
+	return p.SetRegister(n.Rd, reverseBytes(value, n.Halfwords, n.Signed))
+}
+
+// Zero- or sign-extends the low byte or halfword of the value.
+func extendValue(value uint32, unsigned, halfword bool) uint32 {
+	if halfword {
+		if unsigned {
+			return value & 0xffff
+		}
+		return uint32(int32(int16(value)))
+	}
+	if unsigned {
+		return value & 0xff
+	}
+	return uint32(int32(int8(value)))
+}
+
+func (n *ExtendInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	value, _ := p.GetRegister(n.Rm)
+	value = bits.RotateLeft32(value, -8*int(n.Rotate))
+	var toAdd uint32
+	if n.Rn != 15 {
+		toAdd, _ = p.GetRegister(n.Rn)
+	}
+	if n.Dual {
+		low := value & 0xff
+		high := (value >> 16) & 0xff
+		if !n.Unsigned {
+			low = uint32(int32(int8(low))) & 0xffff
+			high = uint32(int32(int8(high))) & 0xffff
+		}
+		low = (low + toAdd) & 0xffff
+		high = (high + (toAdd >> 16)) & 0xffff
+		return p.SetRegister(n.Rd, (high<<16)|low)
+	}
+	return p.SetRegister(n.Rd, extendValue(value, n.Unsigned, n.Halfword)+
+		toAdd)
+}
+
+// Saturates a value to the given number of bits, from 1 to 32. Returns true if
+// saturation occurred.
+func saturateSigned(value int64, width uint8) (int64, bool) {
+	maximum := (int64(1) << (width - 1)) - 1
+	minimum := -(int64(1) << (width - 1))
+	if value > maximum {
+		return maximum, true
+	}
+	if value < minimum {
+		return minimum, true
+	}
+	return value, false
+}
+
+// Like saturateSigned, but for a range from 0 to 2^width - 1. The width may be
+// from 0 to 31.
+func saturateUnsigned(value int64, width uint8) (int64, bool) {
+	maximum := (int64(1) << width) - 1
+	if value > maximum {
+		return maximum, true
+	}
+	if value < 0 {
+		return 0, true
+	}
+	return value, false
+}
+
+// Returns the bit width of the lanes used by a parallel operation, and
+// whether the given lane is subtracted and which lane of Rm it uses.
+func parallelLane(operation, lane uint8) (uint8, bool, uint8) {
+	switch operation {
+	case 0:
+		return 16, false, lane
+	case 1:
+		// addsubx subtracts the top of Rm from the bottom of Rn, and adds the
+		// bottom of Rm to the top of Rn.
+		return 16, lane == 0, 1 - lane
+	case 2:
+		return 16, lane == 1, 1 - lane
+	case 3:
+		return 16, true, lane
+	case 4:
+		return 8, false, lane
+	}
+	return 8, true, lane
+}
+
+// Returns the given lane of a value, sign extended if signed is set.
+func getLane(value uint32, width, lane uint8, signed bool) int64 {
+	value = (value >> (width * lane)) & ((1 << width) - 1)
+	if !signed {
+		return int64(value)
+	}
+	shift := 32 - width
+	return int64(int32(value<<shift) >> shift)
+}
+
+func (n *ParallelArithmeticInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rn)
+	b, _ := p.GetRegister(n.Rm)
+	signed := n.Prefix < 4
+	// 1 and 5 are modular, 2 and 6 saturating and 3 and 7 halving.
+	kind := n.Prefix & 3
+	width, _, _ := parallelLane(n.Operation, 0)
+	lanes := 32 / width
+	var result uint32
+	var geFlags uint8
+	for i := uint8(0); i < lanes; i++ {
+		_, subtract, otherLane := parallelLane(n.Operation, i)
+		x := getLane(a, width, i, signed)
+		y := getLane(b, width, otherLane, signed)
+		var laneResult int64
+		if subtract {
+			laneResult = x - y
+		} else {
+			laneResult = x + y
+		}
+		ge := laneResult >= 0
+		if !signed && !subtract {
+			ge = laneResult >= (int64(1) << width)
+		}
+		if ge {
+			if width == 16 {
+				geFlags |= 3 << (i * 2)
+			} else {
+				geFlags |= 1 << i
+			}
+		}
+		switch kind {
+		case 2:
+			if signed {
+				laneResult, _ = saturateSigned(laneResult, width)
+			} else {
+				laneResult, _ = saturateUnsigned(laneResult, width)
+			}
+		case 3:
+			laneResult >>= 1
+		}
+		mask := uint32((1 << width) - 1)
+		result |= (uint32(laneResult) & mask) << (width * i)
+	}
+	if kind == 1 {
+		p.SetGEFlags(geFlags)
+	}
+	return p.SetRegister(n.Rd, result)
+}
+
+func (n *SelectBytesInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rn)
+	b, _ := p.GetRegister(n.Rm)
+	geFlags := p.GEFlags()
+	var result uint32
+	for i := uint8(0); i < 4; i++ {
+		mask := uint32(0xff) << (i * 8)
+		if (geFlags & (1 << i)) != 0 {
+			result |= a & mask
+		} else {
+			result |= b & mask
+		}
+	}
+	return p.SetRegister(n.Rd, result)
+}
+
+func (n *SumAbsoluteDifferencesInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rm)
+	b, _ := p.GetRegister(n.Rs)
+	var result uint32
+	if n.Accumulate {
+		result, _ = p.GetRegister(n.Rn)
+	}
+	for i := uint8(0); i < 4; i++ {
+		difference := getLane(a, 8, i, false) - getLane(b, 8, i, false)
+		if difference < 0 {
+			difference = -difference
+		}
+		result += uint32(difference)
+	}
+	return p.SetRegister(n.Rd, result)
+}
+
+func (n *SaturateInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	value, _ := p.GetRegister(n.Rn)
+	width := n.saturateBits()
+	saturate := saturateSigned
+	if n.Unsigned {
+		saturate = saturateUnsigned
+	}
+	var saturated bool
+	if n.Dual {
+		var result uint32
+		for i := uint8(0); i < 2; i++ {
+			lane, laneSaturated := saturate(getLane(value, 16, i, true),
+				width)
+			saturated = saturated || laneSaturated
+			result |= (uint32(lane) & 0xffff) << (16 * i)
+		}
+		value = result
+	} else {
+		operand := int64(int32(value))
+		if n.ShiftRight {
+			amount := n.ShiftAmount
+			if amount == 0 {
+				amount = 32
+			}
+			operand >>= amount
+		} else {
+			operand = int64(int32(value << n.ShiftAmount))
+		}
+		operand, saturated = saturate(operand, width)
+		value = uint32(operand)
+	}
+	if saturated {
+		p.SetStickyOverflow(true)
+	}
+	return p.SetRegister(n.Rd, value)
+}
+
+func (n *PackHalfwordInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rn)
+	b, _ := p.GetRegister(n.Rm)
+	if n.TopBottom {
+		amount := n.ShiftAmount
+		if amount == 0 {
+			amount = 32
+		}
+		b = uint32(int64(int32(b)) >> amount)
+		return p.SetRegister(n.Rd, (a&0xffff0000)|(b&0xffff))
+	}
+	b = b << n.ShiftAmount
+	return p.SetRegister(n.Rd, (a&0xffff)|(b&0xffff0000))
+}
+
+func (n *MultiplyAccumulateAccumulateInstruction) Emulate(
+	p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rm)
+	b, _ := p.GetRegister(n.Rs)
+	low, _ := p.GetRegister(n.RdLow)
+	high, _ := p.GetRegister(n.RdHigh)
+	result := uint64(a)*uint64(b) + uint64(low) + uint64(high)
+	p.SetRegister(n.RdLow, uint32(result))
+	return p.SetRegister(n.RdHigh, uint32(result>>32))
+}
+
+func (n *DualMultiplyInstruction) Emulate(p ARMProcessor) error {
+	if !n.Condition().IsMet(p) {
+		return nil
+	}
+	a, _ := p.GetRegister(n.Rm)
+	b, _ := p.GetRegister(n.Rs)
+	if n.Exchange {
+		b = bits.RotateLeft32(b, 16)
+	}
+	bottom := getLane(a, 16, 0, true) * getLane(b, 16, 0, true)
+	top := getLane(a, 16, 1, true) * getLane(b, 16, 1, true)
+	result := bottom + top
+	if n.Subtract {
+		result = bottom - top
+	}
+	if n.IsLongMultiply {
+		low, _ := p.GetRegister(n.RdLow)
+		high, _ := p.GetRegister(n.RdHigh)
+		total := uint64(result) + ((uint64(high) << 32) | uint64(low))
+		p.SetRegister(n.RdLow, uint32(total))
+		return p.SetRegister(n.RdHigh, uint32(total>>32))
+	}
+	if n.Accumulate {
+		c, _ := p.GetRegister(n.Rn)
+		result += int64(int32(c))
+	}
+	if _, overflowed := saturateSigned(result, 32); overflowed {
+		p.SetStickyOverflow(true)
+	}
+	return p.SetRegister(n.Rd, uint32(result))
+}
+
+func (n *ChangeProcessorStateInstruction) Emulate(p ARMProcessor) error {
+	// cps has no effect in user mode.
+	if p.GetMode() == userMode {
+		return nil
+	}
+	status, e := p.GetCPSR()
+	if e != nil {
+		return e
+	}
+	var mask uint32
+	if n.AbortFlag {
+		mask |= 0x100
+	}
+	if n.IRQFlag {
+		mask |= 0x80
+	}
+	if n.FIQFlag {
+		mask |= 0x40
+	}
+	if n.InterruptMode == 2 {
+		status &= ^mask
+	} else if n.InterruptMode == 3 {
+		status |= mask
+	}
+	if n.ChangeMode {
+		if !isValidMode(n.Mode) {
+			return fmt.Errorf("Invalid cps mode: 0x%02x", n.Mode)
+		}
+		status = (status & 0xffffffe0) | uint32(n.Mode)
+	}
+	return p.SetCPSR(status)
+}
+
+// Sets or clears the E bit in the CPSR, for the ARM and THUMB setend
+// instructions.
+func setEndianness(p ARMProcessor, bigEndian bool) error {
+	status, e := p.GetCPSR()
+	if e != nil {
+		return e
+	}
+	if bigEndian {
+		status |= 0x200
+	} else {
+		status &= 0xfffffdff
+	}
+	return p.SetCPSR(status)
+}
+
+func (n *SetEndiannessInstruction) Emulate(p ARMProcessor) error {
+	return setEndianness(p, n.BigEndian)
+}
+
+// Returns the address of the lowest of the two words transferred by srs or
+// rfe, and the value of the base register after writeback.
+func returnStateAddresses(base uint32, preindex, up bool) (uint32, uint32) {
+	if up {
+		if preindex {
+			return base + 4, base + 8
+		}
+		return base, base + 8
+	}
+	if preindex {
+		return base - 8, base - 8
+	}
+	return base - 4, base - 8
+}
+
+func (n *StoreReturnStateInstruction) Emulate(p ARMProcessor) error {
+	if p.GetMode() == userMode {
+		return fmt.Errorf("srs can't be used in user mode")
+	}
+	lr, _ := p.GetRegister(14)
+	spsr, e := p.GetSPSR()
+	if e != nil {
+		return fmt.Errorf("Failed getting SPSR for srs: %s", e)
+	}
+	base, e := p.GetBankedRegister(n.Mode, 13)
+	if e != nil {
+		return e
+	}
+	address, newBase := returnStateAddresses(base, n.Preindex, n.Up)
+	memory := p.GetMemoryInterface()
+	e = memory.WriteMemoryWord(address, lr)
+	if e != nil {
+		return e
+	}
+	e = memory.WriteMemoryWord(address+4, spsr)
+	if e != nil {
+		return e
+	}
+	if n.WriteBack {
+		return p.SetBankedRegister(n.Mode, 13, newBase)
+	}
+	return nil
+}
+
+func (n *ReturnFromExceptionInstruction) Emulate(p ARMProcessor) error {
+	if p.GetMode() == userMode {
+		return fmt.Errorf("rfe can't be used in user mode")
+	}
+	base, _ := p.GetRegister(n.Rn)
+	address, newBase := returnStateAddresses(base, n.Preindex, n.Up)
+	memory := p.GetMemoryInterface()
+	pc, e := memory.ReadMemoryWord(address)
+	if e != nil {
+		return e
+	}
+	status, e := memory.ReadMemoryWord(address + 4)
+	if e != nil {
+		return e
+	}
+	if n.WriteBack {
+		p.SetRegister(n.Rn, newBase)
+	}
+	e = p.SetCPSR(status)
+	if e != nil {
+		return fmt.Errorf("Failed restoring CPSR in rfe: %s", e)
+	}
+	return p.SetRegister(15, pc)
+}
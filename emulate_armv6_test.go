@@ -0,0 +1,321 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func TestARMv6MediaInstructions(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	type mediaTest struct {
+		raw            uint32
+		r1, r2, r3     uint32
+		expected       uint32
+		stickyOverflow bool
+	}
+	tests := []mediaTest{
+		// rev, rev16 and revsh r0, r1
+		{0xe6bf0f31, 0x12345678, 0, 0, 0x78563412, false},
+		{0xe6bf0fb1, 0x12345678, 0, 0, 0x34127856, false},
+		{0xe6ff0fb1, 0x000080ff, 0, 0, 0xffffff80, false},
+		// sxtb r0, r1 and sxtab r0, r2, r1, ror 8
+		{0xe6af0071, 0x80, 0, 0, 0xffffff80, false},
+		{0xe6a20471, 0xfe00, 10, 0, 8, false},
+		// uxth r0, r1
+		{0xe6ff0071, 0xabcd1234, 0, 0, 0x1234, false},
+		// sxtb16 r0, r1 and uxtab16 r0, r2, r1
+		{0xe68f0071, 0x00800001, 0, 0, 0xff800001, false},
+		{0xe6c20071, 0x00ff00ff, 0x00010001, 0, 0x01000100, false},
+		// uqsub8 r0, r1, r2
+		{0xe6610ff2, 0x10ff0520, 0x20010510, 0, 0x00fe0010, false},
+		// shaddsubx r0, r1, r2
+		{0xe6310f32, 0x00040010, 0x00060002, 0, 0x00030005, false},
+		// usad8 r0, r1, r2 and usada8 r0, r1, r2, r3
+		{0xe780f211, 0x01020304, 0x04030201, 0, 8, false},
+		{0xe7803211, 0x01020304, 0x04030201, 100, 108, false},
+		// ssat r0, 16, r1, lsl 4
+		{0xe6af0211, 0x1000, 0, 0, 0x7fff, true},
+		{0xe6af0211, 0x100, 0, 0, 0x1000, false},
+		// usat r0, 8, r1, asr 2
+		{0xe6e80151, 0xfffffff0, 0, 0, 0, true},
+		{0xe6e80151, 0x100, 0, 0, 0x40, false},
+		// ssat16 r0, 8, r1
+		{0xe6a70f31, 0x0100ff00, 0, 0, 0x007fff80, true},
+		// pkhbt r0, r1, r2, lsl 8 and pkhtb r0, r1, r2, asr 16
+		{0xe6810412, 0x1111aaaa, 0x00bbcc00, 0, 0xbbccaaaa, false},
+		{0xe6810852, 0x1111aaaa, 0xbbbb0000, 0, 0x1111bbbb, false},
+		// smuadx r0, r1, r2
+		{0xe700f231, 0x00020003, 0x00040005, 0, 22, false},
+		// smlad r0, r1, r2, r3
+		{0xe7003211, 0x80008000, 0x80008000, 0, 0x80000000, true},
+		{0xe7003211, 0x00020003, 0x00040005, 1, 24, false},
+		// smusd r0, r1, r2
+		{0xe700f251, 0x00020003, 0x00040005, 0, 7, false},
+	}
+	for i, test := range tests {
+		p.SetStickyOverflow(false)
+		p.SetRegister(1, test.r1)
+		p.SetRegister(2, test.r2)
+		p.SetRegister(3, test.r3)
+		e = testSingleInstruction(test.raw, p)
+		if e != nil {
+			t.Logf("Test %d failed: %s\n", i, e)
+			t.FailNow()
+		}
+		value, _ := p.GetRegister(0)
+		if value != test.expected {
+			t.Logf("Test %d: expected 0x%08x, got 0x%08x\n", i, test.expected,
+				value)
+			t.Fail()
+		}
+		if p.StickyOverflow() != test.stickyOverflow {
+			t.Logf("Test %d: incorrect Q flag\n", i)
+			t.Fail()
+		}
+	}
+}
+
+func TestParallelArithmeticFlags(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	// sadd16 r0, r1, r2
+	p.SetRegister(1, 0xffff0001)
+	p.SetRegister(2, 0xfffe0002)
+	e = testSingleInstruction(0xe6110f12, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(0)
+	if (value != 0xfffd0003) || (p.GEFlags() != 0x3) {
+		t.Logf("Incorrect sadd16 result: 0x%08x, GE 0x%x\n", value,
+			p.GEFlags())
+		t.Fail()
+	}
+	// uadd8 r0, r1, r2
+	p.SetRegister(1, 0x01ff80ff)
+	p.SetRegister(2, 0x01018001)
+	e = testSingleInstruction(0xe6510f92, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(0)
+	if (value != 0x02000000) || (p.GEFlags() != 0x7) {
+		t.Logf("Incorrect uadd8 result: 0x%08x, GE 0x%x\n", value,
+			p.GEFlags())
+		t.Fail()
+	}
+	// sel r0, r1, r2 uses the GE flags set by uadd8.
+	p.SetRegister(1, 0x11223344)
+	p.SetRegister(2, 0xaabbccdd)
+	e = testSingleInstruction(0xe6810fb2, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(0)
+	if value != 0xaa223344 {
+		t.Logf("Incorrect sel result: 0x%08x\n", value)
+		t.Fail()
+	}
+}
+
+func TestARMv6LongMultiplies(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	for i := ARMRegister(0); i < 4; i++ {
+		p.SetRegister(i, 0xffffffff)
+	}
+	// umaal r0, r1, r2, r3
+	e = testSingleInstruction(0xe0410392, p)
+	if e != nil {
+		t.FailNow()
+	}
+	low, _ := p.GetRegister(0)
+	high, _ := p.GetRegister(1)
+	if (low != 0xffffffff) || (high != 0xffffffff) {
+		t.Logf("Incorrect umaal result: 0x%08x%08x\n", high, low)
+		t.Fail()
+	}
+	// smlald r0, r1, r2, r3
+	p.SetRegister(1, 0)
+	p.SetRegister(2, 0x00020003)
+	p.SetRegister(3, 0x00040005)
+	e = testSingleInstruction(0xe7410312, p)
+	if e != nil {
+		t.FailNow()
+	}
+	low, _ = p.GetRegister(0)
+	high, _ = p.GetRegister(1)
+	if (low != 0x16) || (high != 1) {
+		t.Logf("Incorrect smlald result: 0x%08x%08x\n", high, low)
+		t.Fail()
+	}
+}
+
+func TestExclusiveLoadStore(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	m.WriteMemoryWord(0x1800, 5)
+	p.SetRegister(1, 0x1800)
+	program := []uint32{
+		// ldrex r0, [r1]
+		0xe1910f9f,
+		// add r0, r0, 1
+		0xe2800001,
+		// strex r2, r0, [r1]
+		0xe1812f90,
+		// strex r3, r0, [r1] fails, since the monitor was cleared.
+		0xe1813f90,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(3, 0)
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := m.ReadMemoryWord(0x1800)
+	if value != 6 {
+		t.Logf("Expected strex to store 6, got %d\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(2)
+	if value != 0 {
+		t.Logf("Expected the first strex to succeed.\n")
+		t.Fail()
+	}
+	value, _ = p.GetRegister(3)
+	if value != 1 {
+		t.Logf("Expected the second strex to fail.\n")
+		t.Fail()
+	}
+}
+
+func TestChangeProcessorState(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	// cps has no effect in user mode.
+	e = testSingleInstruction(0xf10e01d3, p)
+	if (e != nil) || (p.GetMode() != userMode) || p.IRQDisabled() {
+		t.Logf("cps changed the state in user mode: %v\n", e)
+		t.Fail()
+	}
+	p.SetMode(systemMode)
+	// cpsid aif, 19
+	e = testSingleInstruction(0xf10e01d3, p)
+	if e != nil {
+		t.FailNow()
+	}
+	status, _ := p.GetCPSR()
+	if (p.GetMode() != supervisorMode) || ((status & 0x1c0) != 0x1c0) {
+		t.Logf("Incorrect CPSR after cpsid: 0x%08x\n", status)
+		t.Fail()
+	}
+	// cpsie if
+	e = testSingleInstruction(0xf10800c0, p)
+	if e != nil {
+		t.FailNow()
+	}
+	status, _ = p.GetCPSR()
+	if (p.GetMode() != supervisorMode) || ((status & 0x1c0) != 0x100) {
+		t.Logf("Incorrect CPSR after cpsie: 0x%08x\n", status)
+		t.Fail()
+	}
+}
+
+func TestSetEndianness(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(0, 0x11223344)
+	p.SetRegister(1, 0x1800)
+	program := []uint32{
+		// setend be
+		0xf1010200,
+		// str r0, [r1]
+		0xe5810000,
+		// setend le
+		0xf1010000,
+		// ldr r2, [r1]
+		0xe5912000,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(2)
+	if value != 0x44332211 {
+		t.Logf("Expected a big endian store, got 0x%08x\n", value)
+		t.Fail()
+	}
+	b, _ := p.GetMemoryInterface().ReadMemoryByte(0x1800)
+	if b != 0x11 {
+		t.Logf("Expected the first byte to be 0x11, got 0x%02x\n", b)
+		t.Fail()
+	}
+}
+
+func TestReturnState(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetMode(supervisorMode)
+	p.SetSPSR(uint32(userMode))
+	p.SetRegister(14, 0x1234)
+	p.SetBankedRegister(irqMode, 13, 0x1900)
+	// srsdb sp!, 18
+	e = testSingleInstruction(0xf96d0512, p)
+	if e != nil {
+		t.Logf("Failed running srs: %s\n", e)
+		t.FailNow()
+	}
+	value, _ := p.GetBankedRegister(irqMode, 13)
+	if value != 0x18f8 {
+		t.Logf("Incorrect IRQ stack pointer after srs: 0x%08x\n", value)
+		t.Fail()
+	}
+	m := p.GetMemoryInterface()
+	value, _ = m.ReadMemoryWord(0x18f8)
+	if value != 0x1234 {
+		t.Logf("srs didn't store lr: 0x%08x\n", value)
+		t.Fail()
+	}
+	// rfeia r0!
+	p.SetRegister(0, 0x18f8)
+	e = testSingleInstruction(0xf8b00a00, p)
+	if e != nil {
+		t.Logf("Failed running rfe: %s\n", e)
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(15)
+	if (value != 0x1234) || (p.GetMode() != userMode) {
+		t.Logf("Incorrect state after rfe: pc = 0x%08x, mode 0x%02x\n",
+			value, p.GetMode())
+		t.Fail()
+	}
+	value, _ = p.GetRegister(0)
+	if value != 0x1900 {
+		t.Logf("Incorrect rfe writeback: 0x%08x\n", value)
+		t.Fail()
+	}
+}
@@ -143,6 +143,11 @@ func (n *HighRegisterOperationInstruction) Emulate(p ARMProcessor) error {
 	case 2:
 		p.SetRegister(n.Rd, b)
 	case 3:
+		if n.Link {
+			// The PC already contains the address of the next instruction.
+			returnAddress, _ := p.GetRegister(15)
+			p.SetRegister(14, returnAddress|1)
+		}
 		if (b & 1) == 0 {
 			e := p.SetTHUMBMode(false)
 			if e != nil {
@@ -379,7 +384,11 @@ func (n *PushPopRegistersInstruction) popRegisters(p ARMProcessor) error {
 		if e != nil {
 			return e
 		}
-		e = p.SetRegister(ARMRegister(registerNumber), value)
+		if registerNumber == 15 {
+			e = writePCInterworking(p, value)
+		} else {
+			e = p.SetRegister(ARMRegister(registerNumber), value)
+		}
 		if e != nil {
 			return e
 		}
@@ -466,14 +475,13 @@ func (n *ConditionalBranchInstruction) Emulate(p ARMProcessor) error {
 }
 
 func (n *SoftwareInterruptTHUMBInstruction) Emulate(p ARMProcessor) error {
-	currentPC, _ := p.GetRegister(15)
-	e := p.SetMode(0x13)
-	if e != nil {
+	handled, e := handleSoftwareInterrupt(p, uint32(n.Comment))
+	if handled || (e != nil) {
 		return e
 	}
-	p.SetRegister(14, currentPC)
-	p.SetRegister(15, 0x8)
-	return p.SetTHUMBMode(false)
+	currentPC, _ := p.GetRegister(15)
+	return enterException(p, supervisorMode, softwareInterruptVector,
+		currentPC, false)
 }
 
 func (n *UnconditionalBranchInstruction) Emulate(p ARMProcessor) error {
@@ -490,6 +498,13 @@ func (n *LongBranchAndLinkInstruction) Emulate(p ARMProcessor) error {
 		currentLR, _ := p.GetRegister(14)
 		currentLR += uint32(n.Offset) << 1
 		p.SetRegister(14, currentPC|1)
+		if n.Exchange {
+			e := p.SetTHUMBMode(false)
+			if e != nil {
+				return e
+			}
+			currentLR &= 0xfffffffc
+		}
 		p.SetRegister(15, currentLR)
 		return nil
 	}
@@ -498,3 +513,28 @@ func (n *LongBranchAndLinkInstruction) Emulate(p ARMProcessor) error {
 	p.SetRegister(14, currentPC)
 	return nil
 }
+
+func (n *BreakpointTHUMBInstruction) Emulate(p ARMProcessor) error {
+	if !p.ArchitecturalExceptions() {
+		return fmt.Errorf("Reached breakpoint %d", n.Comment)
+	}
+	// The prefetch abort handler returns to the breakpoint using
+	// subs pc, lr, 4, so the return address is 4 bytes past it.
+	currentPC, _ := p.GetRegister(15)
+	return enterException(p, abortMode, prefetchAbortVector, currentPC+2,
+		false)
+}
+
+func (n *ExtendTHUMBInstruction) Emulate(p ARMProcessor) error {
+	value, _ := p.GetRegister(n.Rm)
+	return p.SetRegister(n.Rd, extendValue(value, n.Unsigned, n.Halfword))
+}
+
+func (n *ReverseBytesTHUMBInstruction) Emulate(p ARMProcessor) error {
+	value, _ := p.GetRegister(n.Rm)
+	return p.SetRegister(n.Rd, reverseBytes(value, n.Halfwords, n.Signed))
+}
+
+func (n *SetEndiannessTHUMBInstruction) Emulate(p ARMProcessor) error {
+	return setEndianness(p, n.BigEndian)
+}
@@ -0,0 +1,437 @@
+package arm_emulate
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Expands the 12-bit modified immediate used by Thumb-2 data processing
+// instructions. Also returns the carry out, which is the given carry unless
+// the value was rotated.
+func expandTHUMB2Immediate(immediate uint16, carry bool) (uint32, bool) {
+	value := uint32(immediate & 0xff)
+	if (immediate & 0xc00) == 0 {
+		switch (immediate >> 8) & 3 {
+		case 0:
+			return value, carry
+		case 1:
+			return value | (value << 16), carry
+		case 2:
+			return (value << 8) | (value << 24), carry
+		}
+		return value * 0x01010101, carry
+	}
+	value = bits.RotateLeft32(0x80|(value&0x7f), -int(immediate>>7))
+	return value, (value & 0x80000000) != 0
+}
+
+func (n *DataProcessingTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	// As in ARM mode, the flags are always set and then restored if the S
+	// bit is clear.
+	previousConditions, e := p.GetCPSR()
+	if e != nil {
+		return e
+	}
+	var operand2 uint32
+	if n.IsImmediate {
+		var carry bool
+		operand2, carry = expandTHUMB2Immediate(n.Immediate, p.Carry())
+		p.SetCarry(carry)
+	} else {
+		value, _ := p.GetRegister(n.Rm)
+		operand2, e = n.Shift.Apply(value, p)
+		if e != nil {
+			return e
+		}
+	}
+	if (n.Opcode == 3) && (n.Rn != 15) {
+		// orn
+		operand2 = ^operand2
+	}
+	operand1, _ := p.GetRegister(n.Rn)
+	result, writeResult, e := n.armOpcode().Evaluate(operand1, operand2, p)
+	if e != nil {
+		return e
+	}
+	if writeResult {
+		p.SetRegister(n.Rd, result)
+	}
+	if !n.SetConditions {
+		return p.SetCPSR(previousConditions)
+	}
+	return nil
+}
+
+func (n *WideImmediateTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	if n.Top {
+		value, _ := p.GetRegister(n.Rd)
+		value = (value & 0xffff) | (uint32(n.Immediate) << 16)
+		return p.SetRegister(n.Rd, value)
+	}
+	if n.Move {
+		return p.SetRegister(n.Rd, uint32(n.Immediate))
+	}
+	base, _ := p.GetRegister(n.Rn)
+	if n.Rn == 15 {
+		base &= 0xfffffffc
+	}
+	if n.Subtract {
+		return p.SetRegister(n.Rd, base-uint32(n.Immediate))
+	}
+	return p.SetRegister(n.Rd, base+uint32(n.Immediate))
+}
+
+func (n *BitfieldTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	width := n.width()
+	mask := uint32((uint64(1) << width) - 1)
+	var source uint32
+	if n.Rn != 15 {
+		source, _ = p.GetRegister(n.Rn)
+	}
+	if n.Insert {
+		value, _ := p.GetRegister(n.Rd)
+		value &^= mask << n.LSB
+		value |= (source & mask) << n.LSB
+		return p.SetRegister(n.Rd, value)
+	}
+	value := (source >> n.LSB) & mask
+	if !n.Unsigned {
+		value = uint32(int32(value<<(32-width)) >> (32 - width))
+	}
+	return p.SetRegister(n.Rd, value)
+}
+
+func (n *LoadStoreTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	var e error
+	if n.isPreload() {
+		return nil
+	}
+	memory := p.GetMemoryInterface()
+	// The PC already holds the instruction's address + 4.
+	base, _ := p.GetRegister(n.Rn)
+	if n.Rn == 15 {
+		base &= 0xfffffffc
+	}
+	var offset uint32
+	if n.RegisterOffset {
+		offset, _ = p.GetRegister(n.Rm)
+		offset <<= n.Shift
+	} else {
+		offset = uint32(n.Offset)
+	}
+	if !n.Up {
+		offset = -offset
+	}
+	address := base
+	if n.Preindex {
+		address += offset
+	}
+	if !n.Load {
+		value, _ := p.GetRegister(n.Rt)
+		switch n.Size {
+		case 0:
+			e = memory.WriteMemoryByte(address, uint8(value))
+		case 1:
+			e = memory.WriteMemoryHalfword(address, uint16(value))
+		default:
+			e = memory.WriteMemoryWord(address, value)
+		}
+		if e != nil {
+			return e
+		}
+		if n.WriteBack {
+			p.SetRegister(n.Rn, base+offset)
+		}
+		return nil
+	}
+	var value uint32
+	switch n.Size {
+	case 0:
+		b, e := memory.ReadMemoryByte(address)
+		if e != nil {
+			return e
+		}
+		value = uint32(b)
+		if n.Signed {
+			value = uint32(int32(int8(b)))
+		}
+	case 1:
+		h, e := memory.ReadMemoryHalfword(address)
+		if e != nil {
+			return e
+		}
+		value = uint32(h)
+		if n.Signed {
+			value = uint32(int32(int16(h)))
+		}
+	default:
+		value, e = memory.ReadMemoryWord(address)
+		if e != nil {
+			return e
+		}
+	}
+	if n.WriteBack {
+		p.SetRegister(n.Rn, base+offset)
+	}
+	if n.Rt == 15 {
+		return writePCInterworking(p, value)
+	}
+	return p.SetRegister(n.Rt, value)
+}
+
+func (n *LoadStoreDoubleTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	memory := p.GetMemoryInterface()
+	base, _ := p.GetRegister(n.Rn)
+	if n.Rn == 15 {
+		base &= 0xfffffffc
+	}
+	offset := uint32(n.Offset) << 2
+	if !n.Up {
+		offset = -offset
+	}
+	address := base
+	if n.Preindex {
+		address += offset
+	}
+	if n.Load {
+		low, e := memory.ReadMemoryWord(address)
+		if e != nil {
+			return e
+		}
+		high, e := memory.ReadMemoryWord(address + 4)
+		if e != nil {
+			return e
+		}
+		if n.WriteBack {
+			p.SetRegister(n.Rn, base+offset)
+		}
+		p.SetRegister(n.Rt, low)
+		return p.SetRegister(n.Rt2, high)
+	}
+	low, _ := p.GetRegister(n.Rt)
+	high, _ := p.GetRegister(n.Rt2)
+	e := memory.WriteMemoryWord(address, low)
+	if e != nil {
+		return e
+	}
+	e = memory.WriteMemoryWord(address+4, high)
+	if e != nil {
+		return e
+	}
+	if n.WriteBack {
+		p.SetRegister(n.Rn, base+offset)
+	}
+	return nil
+}
+
+func (n *TableBranchTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	base, _ := p.GetRegister(n.Rn)
+	index, _ := p.GetRegister(n.Rm)
+	memory := p.GetMemoryInterface()
+	var entry uint32
+	if n.Halfword {
+		h, e := memory.ReadMemoryHalfword(base + (index << 1))
+		if e != nil {
+			return e
+		}
+		entry = uint32(h)
+	} else {
+		b, e := memory.ReadMemoryByte(base + index)
+		if e != nil {
+			return e
+		}
+		entry = uint32(b)
+	}
+	pc, _ := p.GetRegister(15)
+	return p.SetRegister(15, pc+(entry<<1))
+}
+
+func (n *DivideTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	a, _ := p.GetRegister(n.Rn)
+	b, _ := p.GetRegister(n.Rm)
+	// Dividing by zero produces 0 rather than an exception.
+	if b == 0 {
+		return p.SetRegister(n.Rd, 0)
+	}
+	if n.Unsigned {
+		return p.SetRegister(n.Rd, a/b)
+	}
+	return p.SetRegister(n.Rd, uint32(int32(a)/int32(b)))
+}
+
+func (n *BranchTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	if !n.Condition.IsMet(p) {
+		return nil
+	}
+	pc, _ := p.GetRegister(15)
+	if n.Link {
+		p.SetRegister(14, pc|1)
+	}
+	if n.Exchange {
+		e := p.SetTHUMBMode(false)
+		if e != nil {
+			return e
+		}
+		pc &= 0xfffffffc
+	}
+	return p.SetRegister(15, uint32(int32(pc)+n.offset()))
+}
+
+func (n *BarrierTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	return nil
+}
+
+// Returns a mask of the PSR bits in the fields selected by the given msr field
+// mask.
+func psrFieldMask(fields uint8) uint32 {
+	toReturn := uint32(0)
+	for i := uint(0); i < 4; i++ {
+		if (fields & (1 << i)) != 0 {
+			toReturn |= 0xff << (i * 8)
+		}
+	}
+	return toReturn
+}
+
+func (n *StatusRegisterTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	var e error
+	if m, ok := p.(ARMv7MProcessor); ok {
+		return n.emulateARMv7M(m)
+	}
+	if n.SYSm != 0 {
+		return fmt.Errorf("%s is only available in ARMv7-M: %w", n.SYSm,
+			errUndefinedInstruction)
+	}
+	var current uint32
+	if n.UseSPSR {
+		current, e = p.GetSPSR()
+	} else {
+		current, e = p.GetCPSR()
+	}
+	if e != nil {
+		return e
+	}
+	if !n.WritePSR {
+		return p.SetRegister(n.Rd, current)
+	}
+	// SetCPSR takes care of preventing user mode from changing anything
+	// except the flags.
+	mask := psrFieldMask(n.Mask)
+	value, _ := p.GetRegister(n.Rd)
+	value = (value & mask) | (current & ^mask)
+	if n.UseSPSR {
+		return p.SetSPSR(value)
+	}
+	return p.SetCPSR(value)
+}
+
+func (n *StatusRegisterTHUMB2Instruction) emulateARMv7M(
+	p ARMv7MProcessor) error {
+	privileged := p.GetMode() != userMode
+	if !n.WritePSR {
+		// Unprivileged code reads the stack pointers and masks as 0.
+		value := uint32(0)
+		if privileged || (n.SYSm <= IEPSR) || (n.SYSm == CONTROL) {
+			var e error
+			value, e = p.GetSpecialRegister(n.SYSm)
+			if e != nil {
+				return e
+			}
+		}
+		return p.SetRegister(n.Rd, value)
+	}
+	value, _ := p.GetRegister(n.Rd)
+	if n.SYSm <= IEPSR {
+		// Only the APSR's bits may be written.
+		mask := uint32(0)
+		if (n.Mask & 8) != 0 {
+			mask |= 0xf8000000
+		}
+		if (n.Mask & 4) != 0 {
+			mask |= 0x000f0000
+		}
+		current, _ := p.GetSpecialRegister(APSR)
+		return p.SetSpecialRegister(APSR, (value&mask)|(current & ^mask))
+	}
+	if !privileged {
+		return nil
+	}
+	return p.SetSpecialRegister(n.SYSm, value)
+}
+
+func (n *ChangeProcessorStateTHUMBInstruction) Emulate(p ARMProcessor) error {
+	// Like the ARM cps instruction, this has no effect in user mode.
+	if p.GetMode() == userMode {
+		return nil
+	}
+	if m, ok := p.(ARMv7MProcessor); ok {
+		value := uint32(0)
+		if n.Disable {
+			value = 1
+		}
+		if (n.Flags & 2) != 0 {
+			e := m.SetSpecialRegister(PRIMASK, value)
+			if e != nil {
+				return e
+			}
+		}
+		if (n.Flags & 1) != 0 {
+			return m.SetSpecialRegister(FAULTMASK, value)
+		}
+		return nil
+	}
+	status, e := p.GetCPSR()
+	if e != nil {
+		return e
+	}
+	mask := uint32(n.Flags) << 6
+	if n.Disable {
+		status |= mask
+	} else {
+		status &= ^mask
+	}
+	return p.SetCPSR(status)
+}
+
+func (n *CompareBranchTHUMBInstruction) Emulate(p ARMProcessor) error {
+	value, _ := p.GetRegister(n.Rn)
+	if (value == 0) == n.NonZero {
+		return nil
+	}
+	pc, _ := p.GetRegister(15)
+	return p.SetRegister(15, pc+2+(uint32(n.Offset)<<1))
+}
+
+func (n *IfThenTHUMBInstruction) Emulate(p ARMProcessor) error {
+	p.SetITState(uint8(n.raw))
+	return nil
+}
+
+func (n *HintTHUMBInstruction) Emulate(p ARMProcessor) error {
+	return nil
+}
+
+// Returns the IT state for the instruction following the one which uses the
+// given state.
+func advanceITState(state uint8) uint8 {
+	if (state & 7) == 0 {
+		return 0
+	}
+	return (state & 0xe0) | ((state << 1) & 0x1f)
+}
+
+// Returns true if the 16-bit instruction only compares values. These are the
+// only 16-bit instructions which still set the flags inside IT blocks.
+func isTHUMBCompare(n THUMBInstruction) bool {
+	switch v := n.(type) {
+	case *MoveCompareAddSubtractImmediateInstruction:
+		return v.Operation == 1
+	case *HighRegisterOperationInstruction:
+		return v.Operation == 1
+	case *ALUOperationInstruction:
+		// tst, cmp and cmn
+		opcode := v.Opcode.Value()
+		return (opcode == 8) || (opcode == 10) || (opcode == 11)
+	}
+	return false
+}
@@ -0,0 +1,357 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func setupTestTHUMB2Processor() (ARMProcessor, error) {
+	p, e := setupTestTHUMBProcessor()
+	if e != nil {
+		return nil, e
+	}
+	e = p.SetArchitecture(ARMv7)
+	if e != nil {
+		return nil, e
+	}
+	return p, nil
+}
+
+func testSingleTHUMB2Instruction(raw uint32, p ARMProcessor) error {
+	e := writeTHUMBInstructionsToMemory([]uint16{uint16(raw >> 16),
+		uint16(raw)}, p)
+	if e != nil {
+		return e
+	}
+	e = p.SetRegister(15, 4096)
+	if e != nil {
+		return e
+	}
+	return p.RunNextInstruction()
+}
+
+func TestTHUMB2DataProcessing(t *testing.T) {
+	p, e := setupTestTHUMB2Processor()
+	if e != nil {
+		t.FailNow()
+	}
+	type dataProcessingTest struct {
+		raw        uint32
+		r1, r2, r3 uint32
+		expected   uint32
+	}
+	tests := []dataProcessingTest{
+		// add r0, r1, 1
+		{0xf1010001, 5, 0, 0, 6},
+		// mov r0, 0x00ff00ff
+		{0xf04f10ff, 0, 0, 0, 0x00ff00ff},
+		// bic r0, r1, 0x80000000
+		{0xf0214000, 0xffffffff, 0, 0, 0x7fffffff},
+		// orn r0, r1, 255
+		{0xf06100ff, 0, 0, 0, 0xffffff00},
+		// adds r0, r1, r2 lsl 2
+		{0xeb110082, 1, 3, 0, 13},
+		// mov r0, r1 lsl r2
+		{0xfa01f002, 3, 4, 0, 48},
+		// movw r0, 0x1234
+		{0xf2412034, 0, 0, 0, 0x1234},
+		// ubfx r0, r1, 4, 8 and sbfx r0, r1, 4, 8
+		{0xf3c11007, 0x12345678, 0, 0, 0x67},
+		{0xf3411007, 0xf80, 0, 0, 0xfffffff8},
+		// bfi r0, r1, 4, 8 and bfc r0, 4, 8, with r0 = 0xffffffff
+		{0xf361100b, 0xab, 0, 0, 0xfffffabf},
+		{0xf36f100b, 0, 0, 0, 0xfffff00f},
+		// sdiv r0, r1, r2 and udiv r0, r1, r2
+		{0xfb91f0f2, 0xfffffff9, 2, 0, 0xfffffffd},
+		{0xfbb1f0f2, 7, 0, 0, 0},
+		// mls r0, r1, r2, r3
+		{0xfb013012, 3, 4, 20, 8},
+		// uxtb r0, r1, rev r0, r1 and clz r0, r1
+		{0xfa5ff081, 0x1234, 0, 0, 0x34},
+		{0xfa91f081, 0x12345678, 0, 0, 0x78563412},
+		{0xfab1f081, 1, 0, 0, 31},
+	}
+	for i, test := range tests {
+		p.SetRegister(0, 0xffffffff)
+		p.SetRegister(1, test.r1)
+		p.SetRegister(2, test.r2)
+		p.SetRegister(3, test.r3)
+		e = testSingleTHUMB2Instruction(test.raw, p)
+		if e != nil {
+			t.Logf("Test %d failed: %s\n", i, e)
+			t.FailNow()
+		}
+		value, _ := p.GetRegister(0)
+		if value != test.expected {
+			t.Logf("Test %d: expected 0x%08x, got 0x%08x\n", i, test.expected,
+				value)
+			t.Fail()
+		}
+	}
+	// movs r0, 0x80000000 sets the carry flag from the rotated immediate.
+	p.SetCarry(false)
+	e = testSingleTHUMB2Instruction(0xf05f4000, p)
+	if e != nil {
+		t.FailNow()
+	}
+	if !p.Carry() || !p.Negative() {
+		t.Logf("movs didn't set the carry and negative flags.\n")
+		t.Fail()
+	}
+	// movt r0, 0x5678 keeps the bottom halfword.
+	p.SetRegister(0, 0x1234)
+	e = testSingleTHUMB2Instruction(0xf2c56078, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(0)
+	if value != 0x56781234 {
+		t.Logf("Incorrect movt result: 0x%08x\n", value)
+		t.Fail()
+	}
+}
+
+func TestTHUMB2LoadStore(t *testing.T) {
+	p, e := setupTestTHUMB2Processor()
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	m.WriteMemoryWord(0x1804, 0xaabbccdd)
+	p.SetRegister(1, 0x1800)
+	// ldr r0, [r1, 4]
+	e = testSingleTHUMB2Instruction(0xf8d10004, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(0)
+	if value != 0xaabbccdd {
+		t.Logf("Incorrect ldr result: 0x%08x\n", value)
+		t.Fail()
+	}
+	// ldrsh r0, [r1, 6]
+	e = testSingleTHUMB2Instruction(0xf9b10006, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(0)
+	if value != 0xffffaabb {
+		t.Logf("Incorrect ldrsh result: 0x%08x\n", value)
+		t.Fail()
+	}
+	// ldr r0, [r1], 4
+	e = testSingleTHUMB2Instruction(0xf8510b04, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(1)
+	if value != 0x1804 {
+		t.Logf("Incorrect post-indexed writeback: 0x%08x\n", value)
+		t.Fail()
+	}
+	// strd r0, r1, [r2, 8], then ldrd r4, r5, [r2, 8]!
+	p.SetRegister(2, 0x1900)
+	e = testSingleTHUMB2Instruction(0xe9c20102, p)
+	if e != nil {
+		t.FailNow()
+	}
+	e = testSingleTHUMB2Instruction(0xe9f24502, p)
+	if e != nil {
+		t.FailNow()
+	}
+	low, _ := p.GetRegister(4)
+	high, _ := p.GetRegister(5)
+	base, _ := p.GetRegister(2)
+	if (low != 0) || (high != 0x1804) || (base != 0x1908) {
+		t.Logf("Incorrect ldrd: 0x%08x, 0x%08x, base 0x%08x\n", low, high,
+			base)
+		t.Fail()
+	}
+	// ldr r0, [pc, 8] loads from the word-aligned PC + 4.
+	m.WriteMemoryWord(4096+12, 1337)
+	e = testSingleTHUMB2Instruction(0xf8df0008, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(0)
+	if value != 1337 {
+		t.Logf("Incorrect literal load: %d\n", value)
+		t.Fail()
+	}
+}
+
+func TestTableBranch(t *testing.T) {
+	p, e := setupTestTHUMB2Processor()
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	m.WriteMemoryHalfword(0x1800, 0x0402)
+	m.WriteMemoryHalfword(0x1802, 0x0020)
+	p.SetRegister(0, 1)
+	p.SetRegister(1, 0x1800)
+	// tbb [r1, r0]
+	e = testSingleTHUMB2Instruction(0xe8d1f000, p)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ := p.GetRegister(15)
+	if pc != 0x100c {
+		t.Logf("Incorrect PC after tbb: 0x%08x\n", pc)
+		t.Fail()
+	}
+	// tbh [r1, r0, lsl 1]
+	e = testSingleTHUMB2Instruction(0xe8d1f010, p)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	if pc != 0x1044 {
+		t.Logf("Incorrect PC after tbh: 0x%08x\n", pc)
+		t.Fail()
+	}
+}
+
+func TestTHUMB2Branches(t *testing.T) {
+	p, e := setupTestTHUMB2Processor()
+	if e != nil {
+		t.FailNow()
+	}
+	// bl 256
+	e = testSingleTHUMB2Instruction(0xf000f880, p)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ := p.GetRegister(15)
+	lr, _ := p.GetRegister(14)
+	if (pc != 0x1104) || (lr != 0x1005) {
+		t.Logf("Incorrect bl: pc = 0x%08x, lr = 0x%08x\n", pc, lr)
+		t.Fail()
+	}
+	// b -4
+	e = testSingleTHUMB2Instruction(0xf7ffbffe, p)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	if pc != 0x1000 {
+		t.Logf("Incorrect PC after b: 0x%08x\n", pc)
+		t.Fail()
+	}
+	// beq 8 isn't taken if the Z flag is clear.
+	p.SetZero(false)
+	e = testSingleTHUMB2Instruction(0xf0008004, p)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	if pc != 0x1004 {
+		t.Logf("Incorrect PC after beq: 0x%08x\n", pc)
+		t.Fail()
+	}
+	// cbz r0, 4
+	p.SetRegister(0, 0)
+	e = testSingleTHUMBInstruction(0xb110, p)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	if pc != 0x1008 {
+		t.Logf("Incorrect PC after cbz: 0x%08x\n", pc)
+		t.Fail()
+	}
+	// blx 256
+	e = testSingleTHUMB2Instruction(0xf000e880, p)
+	if e != nil {
+		t.FailNow()
+	}
+	pc, _ = p.GetRegister(15)
+	if (pc != 0x1104) || p.THUMBMode() {
+		t.Logf("Incorrect blx: pc = 0x%08x\n", pc)
+		t.Fail()
+	}
+}
+
+func TestIfThenBlock(t *testing.T) {
+	p, e := setupTestTHUMB2Processor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint16{
+		// cmp r0, 0
+		0x2800,
+		// ite eq
+		0xbf0c,
+		// movs r1, 1
+		0x2101,
+		// movs r1, 2
+		0x2102,
+		// add r2, r1, 1
+		0xf101, 0x0201,
+	}
+	e = writeTHUMBInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	for _, r0 := range []uint32{0, 5} {
+		p.SetRegister(0, r0)
+		p.SetRegister(15, 4096)
+		e = runMultipleInstructions(5, p, t)
+		if e != nil {
+			t.FailNow()
+		}
+		r1, _ := p.GetRegister(1)
+		r2, _ := p.GetRegister(2)
+		expected := uint32(1)
+		if r0 != 0 {
+			expected = 2
+		}
+		if (r1 != expected) || (r2 != (expected + 1)) {
+			t.Logf("Incorrect IT block results for r0 = %d: %d, %d\n", r0,
+				r1, r2)
+			t.Fail()
+		}
+		// movs doesn't set the flags inside an IT block.
+		if p.Zero() != (r0 == 0) {
+			t.Logf("The Z flag was modified in the IT block.\n")
+			t.Fail()
+		}
+		if p.ITState() != 0 {
+			t.Logf("IT state wasn't cleared: 0x%02x\n", p.ITState())
+			t.Fail()
+		}
+	}
+}
+
+func TestTHUMB2StatusRegisterTransfer(t *testing.T) {
+	p, e := setupTestTHUMB2Processor()
+	if e != nil {
+		t.FailNow()
+	}
+	// msr cpsr_fsxc, r0 only changes the flags in user mode.
+	p.SetRegister(0, 0x600000d3)
+	e = testSingleTHUMB2Instruction(0xf3808f00, p)
+	if e != nil {
+		t.FailNow()
+	}
+	if !p.Zero() || !p.Carry() || (p.GetMode() != userMode) {
+		t.Logf("Incorrect state after msr.\n")
+		t.Fail()
+	}
+	// mrs r1, apsr
+	e = testSingleTHUMB2Instruction(0xf3ef8100, p)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(1)
+	status, _ := p.GetCPSR()
+	if value != status {
+		t.Logf("mrs returned 0x%08x rather than 0x%08x\n", value, status)
+		t.Fail()
+	}
+	// mrs r0, primask is only supported in ARMv7-M.
+	e = testSingleTHUMB2Instruction(0xf3ef8010, p)
+	if e == nil {
+		t.Logf("Didn't get an error reading primask.\n")
+		t.Fail()
+	}
+}
@@ -918,3 +918,60 @@ func TestLongBranchAndLinkInstruction(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestARMv6THUMBEmulation(t *testing.T) {
+	p, e := setupTestTHUMBProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	expected := map[uint16]uint32{
+		// sxth r0, r1
+		0xb208: 0xffff8685,
+		// sxtb r0, r1
+		0xb248: 0xffffff85,
+		// uxth r0, r1
+		0xb288: 0x00008685,
+		// uxtb r0, r1
+		0xb2c8: 0x00000085,
+		// rev r0, r1
+		0xba08: 0x85863412,
+		// rev16 r0, r1
+		0xba48: 0x34128586,
+		// revsh r0, r1
+		0xbac8: 0xffff8586,
+	}
+	for raw, value := range expected {
+		p.SetRegister(0, 0)
+		p.SetRegister(1, 0x12348685)
+		e = testSingleTHUMBInstruction(raw, p)
+		if e != nil {
+			t.Logf("Failed running 0x%04x: %s\n", raw, e)
+			t.FailNow()
+		}
+		result, _ := p.GetRegister(0)
+		if result != value {
+			t.Logf("0x%04x produced 0x%08x, expected 0x%08x\n", raw, result,
+				value)
+			t.Fail()
+		}
+	}
+	// setend be, then setend le. Both are written first, since writing
+	// instructions while the E bit is set would swap their bytes.
+	e = writeTHUMBInstructionsToMemory([]uint16{0xb658, 0xb650}, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = p.RunNextInstruction()
+	status, _ := p.GetCPSR()
+	if (e != nil) || ((status & 0x200) == 0) {
+		t.Logf("setend be didn't set the E bit: 0x%08x (%v)\n", status, e)
+		t.Fail()
+	}
+	e = p.RunNextInstruction()
+	status, _ = p.GetCPSR()
+	if (e != nil) || ((status & 0x200) != 0) {
+		t.Logf("setend le didn't clear the E bit: 0x%08x (%v)\n", status, e)
+		t.Fail()
+	}
+}
@@ -0,0 +1,94 @@
+package arm_emulate
+
+// This file contains the code for entering the processor's exception handlers.
+
+import (
+	"fmt"
+)
+
+// Offsets of the exception vectors.
+const (
+	resetVector             uint32 = 0x00
+	undefinedVector         uint32 = 0x04
+	softwareInterruptVector uint32 = 0x08
+	prefetchAbortVector     uint32 = 0x0c
+	dataAbortVector         uint32 = 0x10
+	irqVector               uint32 = 0x18
+	fiqVector               uint32 = 0x1c
+)
+
+// The base address of the exception vectors when high vectors are enabled.
+const highVectorBase uint32 = 0xffff0000
+
+// Returns the address of the given exception vector, taking the processor's
+// vector base into account.
+func vectorAddress(p ARMProcessor, vector uint32) uint32 {
+	if p.HighVectors() {
+		return highVectorBase + vector
+	}
+	return vector
+}
+
+// This is returned by ARMMemory implementations when an address can't be
+// accessed. If architectural exceptions are enabled, this causes an abort
+// rather than an emulation error.
+type MemoryAccessError struct {
+	Address uint32
+	// Describes why the access failed.
+	Reason string
+}
+
+func (e *MemoryAccessError) Error() string {
+	return fmt.Sprintf("%s: 0x%08x", e.Reason, e.Address)
+}
+
+// This is returned when emulating an instruction that the processor (or its
+// coprocessors) doesn't implement, if architectural exceptions are enabled.
+var errUndefinedInstruction = fmt.Errorf("Undefined instruction")
+
+// Processors with a different exception model, such as ARMv7-M processors,
+// implement this to take the exceptions raised by enterException instead.
+type exceptionEntryHandler interface {
+	takeARMException(mode uint8, vector, returnAddress uint32) error
+}
+
+// Switches to the given mode, saving the CPSR in the new mode's SPSR, sets lr
+// to the return address and jumps to the given exception vector (an offset
+// from the processor's vector base). IRQs are disabled, FIQs are also disabled
+// if disableFIQ is set, and the processor is switched to ARM mode.
+func enterException(p ARMProcessor, mode uint8, vector, returnAddress uint32,
+	disableFIQ bool) error {
+	if h, ok := p.(exceptionEntryHandler); ok {
+		return h.takeARMException(mode, vector, returnAddress)
+	}
+	e := p.SetMode(mode)
+	if e != nil {
+		return fmt.Errorf("Failed entering exception mode: %s", e)
+	}
+	status, e := p.GetCPSR()
+	if e != nil {
+		return e
+	}
+	status |= 0x80
+	if disableFIQ {
+		status |= 0x40
+	}
+	status &= 0xffffffdf
+	// ARMv6 also clears the E bit, selecting little endian data accesses.
+	if p.Architecture() >= ARMv6 {
+		status &= 0xfffffdff
+	}
+	// Exceptions also leave any Thumb-2 IT block.
+	if p.Architecture() >= ARMv7 {
+		status &= 0xf9ff03ff
+	}
+	e = p.SetCPSR(status)
+	if e != nil {
+		return fmt.Errorf("Failed setting CPSR for exception: %s", e)
+	}
+	e = p.SetRegister(14, returnAddress)
+	if e != nil {
+		return e
+	}
+	return p.SetRegister(15, vectorAddress(p, vector))
+}
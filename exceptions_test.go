@@ -0,0 +1,195 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+// Checks that the processor has entered an exception in the given mode at the
+// given vector, with the given return address and the IRQ bit set.
+func checkException(p ARMProcessor, mode uint8, vector, returnAddress uint32,
+	t *testing.T) {
+	if p.GetMode() != mode {
+		t.Logf("Expected to be in mode 0x%02x, got 0x%02x\n", mode,
+			p.GetMode())
+		t.Fail()
+	}
+	value, _ := p.GetRegister(15)
+	if value != vector {
+		t.Logf("Expected the PC to be 0x%08x, got 0x%08x\n", vector, value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(14)
+	if value != returnAddress {
+		t.Logf("Expected lr to be 0x%08x, got 0x%08x\n", returnAddress, value)
+		t.Fail()
+	}
+	if !p.IRQDisabled() || p.THUMBMode() {
+		t.Logf("IRQs weren't disabled or THUMB mode wasn't cleared.\n")
+		t.Fail()
+	}
+}
+
+func TestUndefinedInstructionException(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	// An undefined instruction with a failing condition (eq) is skipped.
+	p.SetArchitecturalExceptions(true)
+	p.SetZero(false)
+	e = testSingleInstruction(0x07f000f0, p)
+	value, _ := p.GetRegister(15)
+	if (e != nil) || (value != 4100) || (p.GetMode() != userMode) {
+		t.Logf("Undefined instruction with a false condition wasn't "+
+			"skipped: %v, pc = 0x%08x\n", e, value)
+		t.Fail()
+	}
+	p.SetCarry(true)
+	e = testSingleInstruction(0xe7f000f0, p)
+	if e != nil {
+		t.Logf("Got an error for an undefined instruction: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4100, t)
+	spsr, _ := p.GetSPSR()
+	if spsr != 0x20000010 {
+		t.Logf("Expected SPSR 0x20000010, got 0x%08x\n", spsr)
+		t.Fail()
+	}
+	// Undefined instructions in the unconditional space are always taken.
+	p.SetMode(userMode)
+	e = testSingleInstruction(0xf7ffffff, p)
+	if e != nil {
+		t.Logf("Got an error for an undefined unconditional instruction: "+
+			"%s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4100, t)
+	// mcr p5, 0, r0, c1, c2, 3, with no coprocessor 5
+	p.SetMode(userMode)
+	e = testSingleInstruction(0xee010572, p)
+	if e != nil {
+		t.Logf("Got an error for a missing coprocessor: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4100, t)
+	// An undefined THUMB instruction.
+	p.SetMode(userMode)
+	p.SetTHUMBMode(true)
+	e = testSingleTHUMBInstruction(0xde00, p)
+	if e != nil {
+		t.Logf("Got an error for an undefined THUMB instruction: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4098, t)
+	// Without architectural exceptions, these are errors again.
+	p.SetArchitecturalExceptions(false)
+	e = testSingleInstruction(0xe7f000f0, p)
+	if e == nil {
+		t.Logf("Didn't get an error for an undefined instruction.\n")
+		t.Fail()
+	}
+}
+
+func TestAbortExceptions(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetArchitecturalExceptions(true)
+	// ldr r0, [r1], with r1 unmapped
+	p.SetRegister(1, 0x20000)
+	e = testSingleInstruction(0xe5910000, p)
+	if e != nil {
+		t.Logf("Got an error for a data abort: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0x10, 4104, t)
+	// ldr r0, [r1] (THUMB)
+	p.SetMode(userMode)
+	p.SetTHUMBMode(true)
+	e = testSingleTHUMBInstruction(0x6808, p)
+	if e != nil {
+		t.Logf("Got an error for a THUMB data abort: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0x10, 4104, t)
+	// Fetching from unmapped memory in THUMB mode
+	p.SetMode(userMode)
+	p.SetTHUMBMode(true)
+	p.SetRegister(15, 0x30000)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Got an error for a prefetch abort: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, abortMode, 0xc, 0x30004, t)
+	spsr, _ := p.GetSPSR()
+	if (spsr & 0x20) == 0 {
+		t.Logf("SPSR didn't save THUMB mode: 0x%08x\n", spsr)
+		t.Fail()
+	}
+}
+
+func TestReset(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetTHUMBMode(true)
+	e = p.Reset()
+	if e != nil {
+		t.Logf("Got an error resetting the processor: %s\n", e)
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(15)
+	status, _ := p.GetCPSR()
+	if (value != 0) || (status != 0xd3) {
+		t.Logf("Expected pc = 0 and CPSR = 0xd3, got 0x%08x and 0x%08x\n",
+			value, status)
+		t.Fail()
+	}
+	p.SetHighVectors(true)
+	e = p.Reset()
+	value, _ = p.GetRegister(15)
+	if (e != nil) || (value != 0xffff0000) {
+		t.Logf("Expected the high reset vector, got 0x%08x (%v)\n", value, e)
+		t.Fail()
+	}
+}
+
+func TestHighVectors(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetHighVectors(true)
+	p.SetArchitecturalExceptions(true)
+	e = testSingleInstruction(0xe7f000f0, p)
+	if e != nil {
+		t.Logf("Got an error for an undefined instruction: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0xffff0004, 4100, t)
+	// swi 0x12
+	p.SetMode(userMode)
+	e = testSingleInstruction(0xef000012, p)
+	if e != nil {
+		t.Logf("Got an error for a software interrupt: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, supervisorMode, 0xffff0008, 4100, t)
+	p.SetCPSR(uint32(userMode))
+	p.SetRegister(15, 4096)
+	e = p.SendIRQ()
+	if e != nil {
+		t.Logf("Got an error sending an IRQ: %s\n", e)
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(15)
+	if (p.GetMode() != irqMode) || (value != 0xffff0018) {
+		t.Logf("Expected an IRQ at 0xffff0018, got mode 0x%02x, pc = "+
+			"0x%08x\n", p.GetMode(), value)
+		t.Fail()
+	}
+}
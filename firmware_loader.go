@@ -0,0 +1,393 @@
+package arm_emulate
+
+// This file contains loaders for firmware images which aren't ELF files: raw
+// binary images, Intel HEX files and Motorola S-record files.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A contiguous range of addresses populated by a firmware image.
+type FirmwareRange struct {
+	Start uint32
+	Size  uint32
+}
+
+func (r FirmwareRange) String() string {
+	return fmt.Sprintf("0x%08x-0x%08x", r.Start, uint64(r.Start)+
+		uint64(r.Size)-1)
+}
+
+// A block of bytes to be copied to a specific address.
+type FirmwareSegment struct {
+	Address uint32
+	Data    []byte
+}
+
+// Holds the contents of a parsed firmware image, before it's copied into
+// memory.
+type FirmwareImage struct {
+	// The segments in the order they appeared in the image. Segments
+	// appearing later overwrite earlier ones if they overlap.
+	Segments []FirmwareSegment
+	// This will be true if the image specified an entry point.
+	HasEntryPoint bool
+	EntryPoint    uint32
+}
+
+// Adds data to the image at the given address, extending the previous
+// segment if the data immediately follows it.
+func (f *FirmwareImage) addData(address uint32, data []byte) error {
+	if (uint64(address) + uint64(len(data))) > 0x100000000 {
+		return fmt.Errorf("%d bytes at 0x%08x don't fit in memory",
+			len(data), address)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	count := len(f.Segments)
+	if count != 0 {
+		last := &(f.Segments[count-1])
+		end := uint64(last.Address) + uint64(len(last.Data))
+		if end == uint64(address) {
+			last.Data = append(last.Data, data...)
+			return nil
+		}
+	}
+	var segment FirmwareSegment
+	segment.Address = address
+	segment.Data = make([]byte, len(data))
+	copy(segment.Data, data)
+	f.Segments = append(f.Segments, segment)
+	return nil
+}
+
+// Returns the address ranges covered by the image, sorted by address, with
+// adjacent or overlapping segments combined.
+func (f *FirmwareImage) Ranges() []FirmwareRange {
+	toReturn := make([]FirmwareRange, 0, len(f.Segments))
+	for _, s := range f.Segments {
+		toReturn = append(toReturn, FirmwareRange{s.Address,
+			uint32(len(s.Data))})
+	}
+	sort.Slice(toReturn, func(a, b int) bool {
+		return toReturn[a].Start < toReturn[b].Start
+	})
+	if len(toReturn) == 0 {
+		return toReturn
+	}
+	merged := toReturn[:1]
+	for _, r := range toReturn[1:] {
+		last := &(merged[len(merged)-1])
+		lastEnd := uint64(last.Start) + uint64(last.Size)
+		if uint64(r.Start) > lastEnd {
+			merged = append(merged, r)
+			continue
+		}
+		end := uint64(r.Start) + uint64(r.Size)
+		if end > lastEnd {
+			last.Size = uint32(end - uint64(last.Start))
+		}
+	}
+	return merged
+}
+
+// Copies every segment of the image into the given memory.
+func (f *FirmwareImage) Load(m ARMMemory) error {
+	for _, s := range f.Segments {
+		e := m.SetMemoryRegion(s.Address, s.Data)
+		if e != nil {
+			return fmt.Errorf("Failed mapping %d bytes at 0x%08x: %s",
+				len(s.Data), s.Address, e)
+		}
+	}
+	return nil
+}
+
+// Sets the processor's PC to the image's entry point, if the image has one.
+// As with ELF files, the processor is switched to THUMB mode if bit 0 of the
+// entry point is set. Does nothing if the image has no entry point.
+func (f *FirmwareImage) ApplyEntryPoint(p ARMProcessor) error {
+	if !f.HasEntryPoint {
+		return nil
+	}
+	e := p.SetTHUMBMode((f.EntryPoint & 1) != 0)
+	if e != nil {
+		return fmt.Errorf("Failed setting THUMB mode for entry: %s", e)
+	}
+	return p.SetRegister(15, f.EntryPoint&0xfffffffe)
+}
+
+// Returns a firmware image placing the given data at the base address.
+func ParseRawImage(data []byte, baseAddress uint32) (*FirmwareImage, error) {
+	var toReturn FirmwareImage
+	e := toReturn.addData(baseAddress, data)
+	if e != nil {
+		return nil, e
+	}
+	return &toReturn, nil
+}
+
+// Decodes a hexadecimal string from a HEX or S-record line.
+func decodeFirmwareRecord(line int, s string) ([]byte, error) {
+	data, e := hex.DecodeString(s)
+	if e != nil {
+		return nil, fmt.Errorf("Line %d: Invalid hex data: %s", line, e)
+	}
+	return data, nil
+}
+
+// Parses the records in an Intel HEX file. Supports both segment (types 2 and
+// 3) and linear (types 4 and 5) addressing.
+func ParseIntelHex(r io.Reader) (*FirmwareImage, error) {
+	var toReturn FirmwareImage
+	scanner := bufio.NewScanner(r)
+	baseAddress := uint32(0)
+	line := 0
+	sawEnd := false
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 {
+			continue
+		}
+		if sawEnd {
+			return nil, fmt.Errorf("Line %d: Data after end-of-file record",
+				line)
+		}
+		if text[0] != ':' {
+			return nil, fmt.Errorf("Line %d: Record doesn't start with ':'",
+				line)
+		}
+		record, e := decodeFirmwareRecord(line, text[1:])
+		if e != nil {
+			return nil, e
+		}
+		if len(record) < 5 {
+			return nil, fmt.Errorf("Line %d: Record is too short", line)
+		}
+		length := int(record[0])
+		if len(record) != (length + 5) {
+			return nil, fmt.Errorf("Line %d: Expected %d data bytes, got %d",
+				line, length, len(record)-5)
+		}
+		sum := uint8(0)
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("Line %d: Bad checksum", line)
+		}
+		offset := (uint32(record[1]) << 8) | uint32(record[2])
+		recordType := record[3]
+		data := record[4 : 4+length]
+		switch recordType {
+		case 0:
+			e = toReturn.addData(baseAddress+offset, data)
+			if e != nil {
+				return nil, fmt.Errorf("Line %d: %s", line, e)
+			}
+		case 1:
+			sawEnd = true
+		case 2, 4:
+			if length != 2 {
+				return nil, fmt.Errorf("Line %d: Bad address record length",
+					line)
+			}
+			baseAddress = (uint32(data[0]) << 8) | uint32(data[1])
+			if recordType == 2 {
+				baseAddress <<= 4
+			} else {
+				baseAddress <<= 16
+			}
+		case 3, 5:
+			if length != 4 {
+				return nil, fmt.Errorf("Line %d: Bad start address length",
+					line)
+			}
+			toReturn.HasEntryPoint = true
+			if recordType == 3 {
+				// CS:IP
+				segment := (uint32(data[0]) << 8) | uint32(data[1])
+				pointer := (uint32(data[2]) << 8) | uint32(data[3])
+				toReturn.EntryPoint = (segment << 4) + pointer
+			} else {
+				toReturn.EntryPoint = (uint32(data[0]) << 24) |
+					(uint32(data[1]) << 16) | (uint32(data[2]) << 8) |
+					uint32(data[3])
+			}
+		default:
+			return nil, fmt.Errorf("Line %d: Unknown record type %d", line,
+				recordType)
+		}
+	}
+	if e := scanner.Err(); e != nil {
+		return nil, fmt.Errorf("Failed reading HEX file: %s", e)
+	}
+	if !sawEnd {
+		return nil, fmt.Errorf("Missing end-of-file record")
+	}
+	return &toReturn, nil
+}
+
+// Parses the records in a Motorola S-record file.
+func ParseSRecord(r io.Reader) (*FirmwareImage, error) {
+	var toReturn FirmwareImage
+	scanner := bufio.NewScanner(r)
+	line := 0
+	dataRecords := uint32(0)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 {
+			continue
+		}
+		if (len(text) < 2) || (text[0] != 'S') {
+			return nil, fmt.Errorf("Line %d: Record doesn't start with 'S'",
+				line)
+		}
+		recordType := text[1]
+		record, e := decodeFirmwareRecord(line, text[2:])
+		if e != nil {
+			return nil, e
+		}
+		if len(record) < 1 {
+			return nil, fmt.Errorf("Line %d: Record is too short", line)
+		}
+		count := int(record[0])
+		if len(record) != (count + 1) {
+			return nil, fmt.Errorf("Line %d: Expected %d bytes, got %d", line,
+				count, len(record)-1)
+		}
+		sum := uint8(0)
+		for _, b := range record[:count] {
+			sum += b
+		}
+		if (^sum) != record[count] {
+			return nil, fmt.Errorf("Line %d: Bad checksum", line)
+		}
+		var addressSize int
+		switch recordType {
+		case '0', '1', '5', '9':
+			addressSize = 2
+		case '2', '6', '8':
+			addressSize = 3
+		case '3', '7':
+			addressSize = 4
+		default:
+			return nil, fmt.Errorf("Line %d: Unknown record type S%c", line,
+				recordType)
+		}
+		// The count includes the address and checksum.
+		if count < (addressSize + 1) {
+			return nil, fmt.Errorf("Line %d: Record is too short", line)
+		}
+		address := uint32(0)
+		for _, b := range record[1 : 1+addressSize] {
+			address = (address << 8) | uint32(b)
+		}
+		data := record[1+addressSize : count]
+		switch recordType {
+		case '0':
+			// Header record, its contents are ignored.
+		case '1', '2', '3':
+			e = toReturn.addData(address, data)
+			if e != nil {
+				return nil, fmt.Errorf("Line %d: %s", line, e)
+			}
+			dataRecords++
+		case '5', '6':
+			if address != dataRecords {
+				return nil, fmt.Errorf("Line %d: Record count is %d, but "+
+					"read %d data records", line, address, dataRecords)
+			}
+		case '7', '8', '9':
+			toReturn.HasEntryPoint = true
+			toReturn.EntryPoint = address
+		}
+	}
+	if e := scanner.Err(); e != nil {
+		return nil, fmt.Errorf("Failed reading S-record file: %s", e)
+	}
+	return &toReturn, nil
+}
+
+// Copies the image into the processor's memory and applies its entry point, if
+// any. Returns the address ranges that were populated.
+func LoadFirmwareImage(p ARMProcessor, f *FirmwareImage) ([]FirmwareRange,
+	error) {
+	e := f.Load(p.GetMemoryInterface())
+	if e != nil {
+		return nil, e
+	}
+	e = f.ApplyEntryPoint(p)
+	if e != nil {
+		return nil, e
+	}
+	return f.Ranges(), nil
+}
+
+// Reads a raw binary image from r and copies it into the processor's memory at
+// the base address. The PC isn't modified.
+func LoadRawImage(p ARMProcessor, r io.Reader, baseAddress uint32) (
+	[]FirmwareRange, error) {
+	data, e := ioutil.ReadAll(r)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading raw image: %s", e)
+	}
+	f, e := ParseRawImage(data, baseAddress)
+	if e != nil {
+		return nil, e
+	}
+	return LoadFirmwareImage(p, f)
+}
+
+// Parses an Intel HEX file from r and loads it into the processor.
+func LoadIntelHex(p ARMProcessor, r io.Reader) ([]FirmwareRange, error) {
+	f, e := ParseIntelHex(r)
+	if e != nil {
+		return nil, e
+	}
+	return LoadFirmwareImage(p, f)
+}
+
+// Parses a Motorola S-record file from r and loads it into the processor.
+func LoadSRecord(p ARMProcessor, r io.Reader) ([]FirmwareRange, error) {
+	f, e := ParseSRecord(r)
+	if e != nil {
+		return nil, e
+	}
+	return LoadFirmwareImage(p, f)
+}
+
+// Loads a firmware file into the processor, choosing the format based on the
+// file's extension: .hex or .ihex for Intel HEX, .srec, .s19, .s28, .s37 or
+// .mot for S-records, and a raw binary image at baseAddress otherwise.
+func LoadFirmwareFile(p ARMProcessor, path string, baseAddress uint32) (
+	[]FirmwareRange, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	lower := strings.ToLower(path)
+	dot := strings.LastIndex(lower, ".")
+	extension := ""
+	if dot >= 0 {
+		extension = lower[dot:]
+	}
+	switch extension {
+	case ".hex", ".ihex":
+		return LoadIntelHex(p, f)
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return LoadSRecord(p, f)
+	}
+	return LoadRawImage(p, f, baseAddress)
+}
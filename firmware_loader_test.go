@@ -0,0 +1,165 @@
+package arm_emulate
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoadRawImage(t *testing.T) {
+	p := NewARMProcessor()
+	// add r0, r1, r2
+	data := []byte{0x02, 0x00, 0x81, 0xe0}
+	ranges, e := LoadRawImage(p, bytes.NewReader(data), 0x2000)
+	if e != nil {
+		t.Logf("Failed loading raw image: %s\n", e)
+		t.FailNow()
+	}
+	if (len(ranges) != 1) || (ranges[0].Start != 0x2000) ||
+		(ranges[0].Size != 4) {
+		t.Logf("Incorrect raw image ranges: %v\n", ranges)
+		t.Fail()
+	}
+	value, e := p.GetMemoryInterface().ReadMemoryWord(0x2000)
+	if (e != nil) || (value != 0xe0810002) {
+		t.Logf("Incorrect raw image contents: 0x%08x (%v)\n", value, e)
+		t.Fail()
+	}
+	_, e = ParseRawImage(data, 0xfffffffe)
+	if e == nil {
+		t.Logf("Didn't get an error for a raw image past 4GB.\n")
+		t.Fail()
+	}
+}
+
+func TestLoadIntelHex(t *testing.T) {
+	hexFile := strings.Join([]string{
+		// Extended linear address 0x0800xxxx
+		":020000040800F2",
+		// add r0, r1, r2; add r0, r1, r1
+		":04000000020081E099",
+		":04000400010081E096",
+		":02100000AABB89",
+		// Start linear address 0x08000000
+		":0400000508000000EF",
+		":00000001FF",
+	}, "\n")
+	p := NewARMProcessor()
+	ranges, e := LoadIntelHex(p, strings.NewReader(hexFile))
+	if e != nil {
+		t.Logf("Failed loading HEX file: %s\n", e)
+		t.FailNow()
+	}
+	if len(ranges) != 2 {
+		t.Logf("Expected 2 ranges, got %v\n", ranges)
+		t.FailNow()
+	}
+	if (ranges[0].Start != 0x08000000) || (ranges[0].Size != 8) {
+		t.Logf("Incorrect first range: %s\n", ranges[0])
+		t.Fail()
+	}
+	if (ranges[1].Start != 0x08001000) || (ranges[1].Size != 2) {
+		t.Logf("Incorrect second range: %s\n", ranges[1])
+		t.Fail()
+	}
+	pc, _ := p.GetRegister(15)
+	if pc != 0x08000000 {
+		t.Logf("Entry point wasn't applied, PC = 0x%08x\n", pc)
+		t.Fail()
+	}
+	p.SetRegister(1, 1000)
+	p.SetRegister(2, 337)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Failed running loaded code: %s\n", e)
+		t.Fail()
+	}
+	value, _ := p.GetRegister(0)
+	if value != 1337 {
+		t.Logf("Expected 1337 in r0, got %d\n", value)
+		t.Fail()
+	}
+	b, e := p.GetMemoryInterface().ReadMemoryByte(0x08001001)
+	if (e != nil) || (b != 0xbb) {
+		t.Logf("Incorrect byte at 0x08001001: 0x%02x (%v)\n", b, e)
+		t.Fail()
+	}
+	// Corrupt the checksum of a data record.
+	badFile := strings.Replace(hexFile, "E099", "E098", 1)
+	_, e = ParseIntelHex(strings.NewReader(badFile))
+	if e == nil {
+		t.Logf("Didn't get an error for a bad HEX checksum.\n")
+		t.Fail()
+	} else {
+		t.Logf("Got expected error for a bad checksum: %s\n", e)
+	}
+	// Remove the end-of-file record.
+	badFile = strings.Replace(hexFile, ":00000001FF", "", 1)
+	_, e = ParseIntelHex(strings.NewReader(badFile))
+	if e == nil {
+		t.Logf("Didn't get an error for a missing end-of-file record.\n")
+		t.Fail()
+	}
+}
+
+func TestLoadSRecord(t *testing.T) {
+	srecFile := strings.Join([]string{
+		"S00700007465737438",
+		"S30908000000020081E08B",
+		"S30908000004010081E088",
+		// add r0, r1, r2 (THUMB)
+		"S105200088183A",
+		"S5030003F9",
+		// Entry at 0x2001 (THUMB)
+		"S9032001DB",
+	}, "\r\n")
+	image, e := ParseSRecord(strings.NewReader(srecFile))
+	if e != nil {
+		t.Logf("Failed parsing S-record file: %s\n", e)
+		t.FailNow()
+	}
+	if !image.HasEntryPoint || (image.EntryPoint != 0x2001) {
+		t.Logf("Incorrect entry point: 0x%08x\n", image.EntryPoint)
+		t.Fail()
+	}
+	p := NewARMProcessor()
+	ranges, e := LoadFirmwareImage(p, image)
+	if e != nil {
+		t.Logf("Failed loading S-record image: %s\n", e)
+		t.FailNow()
+	}
+	if (len(ranges) != 2) || (ranges[0].Start != 0x2000) ||
+		(ranges[1].Start != 0x08000000) || (ranges[1].Size != 8) {
+		t.Logf("Incorrect S-record ranges: %v\n", ranges)
+		t.Fail()
+	}
+	if !p.THUMBMode() {
+		t.Logf("Processor wasn't switched to THUMB mode.\n")
+		t.Fail()
+	}
+	p.SetRegister(1, 1000)
+	p.SetRegister(2, 337)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Failed running loaded THUMB code: %s\n", e)
+		t.Fail()
+	}
+	value, _ := p.GetRegister(0)
+	if value != 1337 {
+		t.Logf("Expected 1337 in r0, got %d\n", value)
+		t.Fail()
+	}
+	badFile := strings.Replace(srecFile, "E08B", "E08C", 1)
+	_, e = ParseSRecord(strings.NewReader(badFile))
+	if e == nil {
+		t.Logf("Didn't get an error for a bad S-record checksum.\n")
+		t.Fail()
+	}
+	// The S5 record says there are 3 data records.
+	badFile = strings.Replace(srecFile, "S105200088183A\r\n", "", 1)
+	_, e = ParseSRecord(strings.NewReader(badFile))
+	if e == nil {
+		t.Logf("Didn't get an error for an incorrect record count.\n")
+		t.Fail()
+	}
+}
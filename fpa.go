@@ -0,0 +1,581 @@
+package arm_emulate
+
+// This file implements the FPA floating-point coprocessor used by older ARM
+// systems, which carries out instructions for coprocessors 1 and 2.
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Bits in the FPSR. The system ID is in the top byte, and isn't writable.
+const (
+	fpsrInvalidOperation uint32 = 1 << 0
+	fpsrDivideByZero     uint32 = 1 << 1
+	fpsrOverflow         uint32 = 1 << 2
+	fpsrUnderflow        uint32 = 1 << 3
+	fpsrInexact          uint32 = 1 << 4
+	fpsrAlternativeCarry uint32 = 1 << 12
+	fpsrWritableBits     uint32 = 0x001f1f1f
+)
+
+// The precisions, given by bits 19 and 7 of data operations, and bits 22 and
+// 15 of loads and stores.
+const (
+	fpaSingle   uint8 = 0
+	fpaDouble   uint8 = 1
+	fpaExtended uint8 = 2
+	fpaPacked   uint8 = 3
+)
+
+// The dyadic data operation opcodes.
+const (
+	adfFPAOpcode uint8 = iota
+	mufFPAOpcode
+	sufFPAOpcode
+	rsfFPAOpcode
+	dvfFPAOpcode
+	rdfFPAOpcode
+	powFPAOpcode
+	rpwFPAOpcode
+	rmfFPAOpcode
+	fmlFPAOpcode
+	fdvFPAOpcode
+	frdFPAOpcode
+	polFPAOpcode
+)
+
+// The monadic data operation opcodes.
+const (
+	mvfFPAOpcode uint8 = iota
+	mnfFPAOpcode
+	absFPAOpcode
+	rndFPAOpcode
+	sqtFPAOpcode
+	logFPAOpcode
+	lgnFPAOpcode
+	expFPAOpcode
+	sinFPAOpcode
+	cosFPAOpcode
+	tanFPAOpcode
+	asnFPAOpcode
+	acsFPAOpcode
+	atnFPAOpcode
+	urdFPAOpcode
+	nrmFPAOpcode
+)
+
+// The register transfer opcodes, including the load bit.
+const (
+	fltFPAOpcode  uint8 = 0x0
+	fixFPAOpcode  uint8 = 0x1
+	wfsFPAOpcode  uint8 = 0x2
+	rfsFPAOpcode  uint8 = 0x3
+	wfcFPAOpcode  uint8 = 0x4
+	rfcFPAOpcode  uint8 = 0x5
+	cmfFPAOpcode  uint8 = 0x9
+	cnfFPAOpcode  uint8 = 0xb
+	cmfeFPAOpcode uint8 = 0xd
+	cnfeFPAOpcode uint8 = 0xf
+)
+
+// The values of the constant operands which may be used in place of Fm.
+var fpaConstants = [8]float64{0.0, 1.0, 2.0, 3.0, 4.0, 5.0, 0.5, 10.0}
+
+// Implements an FPA coprocessor, such as the FPA11, with eight registers.
+// Create this using AddFPA. The registers' extended precision is approximated
+// using double precision, and, as with the VFP, exception traps aren't
+// supported, so exceptions only set the cumulative flags in the FPSR. Packed
+// decimal loads and stores aren't supported.
+type FPA struct {
+	// The system ID in the top byte of the FPSR. This defaults to 0x81, for
+	// an FPA11.
+	SystemID  uint8
+	registers [8]float64
+	fpsr      uint32
+	fpcr      uint32
+}
+
+func (f *FPA) Register(register uint8) float64 {
+	return f.registers[register&7]
+}
+
+func (f *FPA) SetRegister(register uint8, value float64) {
+	f.registers[register&7] = value
+}
+
+func (f *FPA) FPSR() uint32 {
+	return (uint32(f.SystemID) << 24) | f.fpsr
+}
+
+func (f *FPA) SetFPSR(value uint32) {
+	f.fpsr = value & fpsrWritableBits
+}
+
+// Returns the FPCR. Its contents are implementation defined, so this
+// emulator only stores the value written to it.
+func (f *FPA) FPCR() uint32 {
+	return f.fpcr
+}
+
+func (f *FPA) SetFPCR(value uint32) {
+	f.fpcr = value
+}
+
+// Converts a value to the 3-word extended precision format used in memory.
+func float64ToExtended(x float64) [3]uint32 {
+	raw := math.Float64bits(x)
+	sign := uint32(raw>>63) << 31
+	exponent := uint32((raw >> 52) & 0x7ff)
+	fraction := raw & 0x000fffffffffffff
+	var mantissa uint64
+	switch {
+	case exponent == 0x7ff:
+		exponent = 0x7fff
+		mantissa = fraction << 11
+	case (exponent == 0) && (fraction == 0):
+		mantissa = 0
+	case exponent == 0:
+		// Denormal doubles are normal in extended precision.
+		shift := bits.LeadingZeros64(fraction)
+		mantissa = fraction << shift
+		exponent = uint32(15372 - shift)
+	default:
+		mantissa = (1 << 63) | (fraction << 11)
+		exponent = exponent - 1023 + 16383
+	}
+	return [3]uint32{sign | exponent, uint32(mantissa >> 32),
+		uint32(mantissa)}
+}
+
+// Converts a value from the 3-word extended precision format, rounding it to
+// the nearest double.
+func extendedToFloat64(words [3]uint32) float64 {
+	sign := uint64(words[0]>>31) << 63
+	exponent := int(words[0] & 0x7fff)
+	mantissa := (uint64(words[1]) << 32) | uint64(words[2])
+	if exponent == 0x7fff {
+		fraction := (mantissa >> 11) & 0x000fffffffffffff
+		if ((mantissa << 1) != 0) && (fraction == 0) {
+			fraction = 0x0008000000000000
+		}
+		return math.Float64frombits(sign | 0x7ff0000000000000 | fraction)
+	}
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if sign != 0 {
+		value = math.Copysign(value, -1)
+	}
+	return value
+}
+
+// Rounds a result to the given precision. Values of x must already be
+// correctly rounded to double precision, with errorSign giving the sign of
+// the difference between the exact value and x. Extended precision results
+// are kept in double precision. Records the inexact, overflow and underflow
+// exceptions.
+func (f *FPA) round(x float64, errorSign int, precision, mode uint8) float64 {
+	if math.IsNaN(x) {
+		return x
+	}
+	double := precision != fpaSingle
+	result, difference := roundFloat(x, errorSign, double, mode)
+	if difference == 0 {
+		return result
+	}
+	f.fpsr |= fpsrInexact
+	if roundingOverflowed(x, difference, double) {
+		f.fpsr |= fpsrOverflow
+	}
+	minNormal := math.Float64frombits(0x0010000000000000)
+	if !double {
+		minNormal = float64(math.Float32frombits(0x00800000))
+	}
+	if math.Abs(result) < minNormal {
+		f.fpsr |= fpsrUnderflow
+	}
+	return result
+}
+
+// Returns the value of the Fm operand, which may be a constant.
+func (f *FPA) operandM(raw uint32) float64 {
+	if (raw & 8) != 0 {
+		return fpaConstants[raw&7]
+	}
+	return f.registers[raw&7]
+}
+
+// Checks the result of an operation for invalid operations, when it's a NaN
+// despite none of the operands being NaNs.
+func (f *FPA) checkInvalid(result float64, operands ...float64) {
+	if !math.IsNaN(result) {
+		return
+	}
+	for _, operand := range operands {
+		if math.IsNaN(operand) {
+			return
+		}
+	}
+	f.fpsr |= fpsrInvalidOperation
+}
+
+// Carries out a dyadic operation, returning the result and the sign of its
+// rounding error.
+func (f *FPA) dyadic(opcode uint8, a, b float64) (float64, int, error) {
+	var result float64
+	errorSign := 0
+	divideByZero := false
+	switch opcode {
+	case adfFPAOpcode, sufFPAOpcode, rsfFPAOpcode:
+		if opcode == sufFPAOpcode {
+			b = -b
+		} else if opcode == rsfFPAOpcode {
+			a = -a
+		}
+		result = a + b
+		errorSign = additionErrorSign(a, b, result)
+	case mufFPAOpcode, fmlFPAOpcode:
+		result = a * b
+		if !math.IsInf(result, 0) {
+			errorSign = floatSign(math.FMA(a, b, -result))
+		}
+	case dvfFPAOpcode, fdvFPAOpcode, rdfFPAOpcode, frdFPAOpcode:
+		if (opcode == rdfFPAOpcode) || (opcode == frdFPAOpcode) {
+			a, b = b, a
+		}
+		divideByZero = (b == 0) && (a != 0) && !math.IsInf(a, 0) &&
+			!math.IsNaN(a)
+		result = a / b
+		if !math.IsInf(result, 0) && (result != 0) {
+			errorSign = floatSign(math.FMA(-result, b, a)) * floatSign(b)
+		}
+	case powFPAOpcode:
+		result = math.Pow(a, b)
+	case rpwFPAOpcode:
+		result = math.Pow(b, a)
+	case rmfFPAOpcode:
+		result = math.Remainder(a, b)
+	case polFPAOpcode:
+		result = math.Atan2(a, b)
+	default:
+		return 0, 0, fmt.Errorf("Invalid FPA dyadic opcode %d", opcode)
+	}
+	if divideByZero {
+		f.fpsr |= fpsrDivideByZero
+	} else if math.IsInf(result, 0) && !math.IsInf(a, 0) &&
+		!math.IsInf(b, 0) {
+		// The result overflowed.
+		errorSign = -floatSign(result)
+	}
+	f.checkInvalid(result, a, b)
+	return result, errorSign, nil
+}
+
+// Carries out a monadic operation, returning the result and the sign of its
+// rounding error.
+func (f *FPA) monadic(opcode, mode uint8, b float64) (float64, int) {
+	var result float64
+	errorSign := 0
+	switch opcode {
+	case mvfFPAOpcode, nrmFPAOpcode:
+		result = b
+	case mnfFPAOpcode:
+		result = -b
+	case absFPAOpcode:
+		result = math.Abs(b)
+	case rndFPAOpcode, urdFPAOpcode:
+		result = roundToInteger(b, mode)
+		if (result != b) && !math.IsNaN(b) {
+			f.fpsr |= fpsrInexact
+		}
+	case sqtFPAOpcode:
+		result = math.Sqrt(b)
+		if !math.IsInf(result, 0) && !math.IsNaN(result) {
+			errorSign = floatSign(math.FMA(-result, result, b))
+		}
+	case logFPAOpcode:
+		result = math.Log10(b)
+	case lgnFPAOpcode:
+		result = math.Log(b)
+	case expFPAOpcode:
+		result = math.Exp(b)
+	case sinFPAOpcode:
+		result = math.Sin(b)
+	case cosFPAOpcode:
+		result = math.Cos(b)
+	case tanFPAOpcode:
+		result = math.Tan(b)
+	case asnFPAOpcode:
+		result = math.Asin(b)
+	case acsFPAOpcode:
+		result = math.Acos(b)
+	case atnFPAOpcode:
+		result = math.Atan(b)
+	}
+	if ((opcode == logFPAOpcode) || (opcode == lgnFPAOpcode)) && (b == 0) {
+		f.fpsr |= fpsrDivideByZero
+	}
+	f.checkInvalid(result, b)
+	return result, errorSign
+}
+
+// Carries out a data operation, on coprocessor 1.
+func (f *FPA) operation(p ARMProcessor, raw uint32) error {
+	if ((raw >> 8) & 0xf) != 1 {
+		return fmt.Errorf("Invalid FPA data operation: %w",
+			errUndefinedInstruction)
+	}
+	precision := uint8(((raw >> 18) & 2) | ((raw >> 7) & 1))
+	if precision == fpaPacked {
+		return fmt.Errorf("Invalid FPA precision: %w",
+			errUndefinedInstruction)
+	}
+	opcode := uint8((raw >> 20) & 0xf)
+	mode := uint8((raw >> 5) & 3)
+	b := f.operandM(raw)
+	var result float64
+	var errorSign int
+	if (raw & 0x8000) != 0 {
+		result, errorSign = f.monadic(opcode, mode, b)
+	} else {
+		var e error
+		result, errorSign, e = f.dyadic(opcode, f.registers[(raw>>16)&7], b)
+		if e != nil {
+			return fmt.Errorf("%s: %w", e, errUndefinedInstruction)
+		}
+		// The "fast" operations always produce single precision results.
+		if (opcode == fmlFPAOpcode) || (opcode == fdvFPAOpcode) ||
+			(opcode == frdFPAOpcode) {
+			precision = fpaSingle
+		}
+	}
+	f.registers[(raw>>12)&7] = f.round(result, errorSign, precision, mode)
+	return nil
+}
+
+// Converts a value to a 32-bit signed integer for fix, saturating and
+// setting the invalid operation flag if it's out of range.
+func (f *FPA) toInteger(x float64, mode uint8) uint32 {
+	if math.IsNaN(x) {
+		f.fpsr |= fpsrInvalidOperation
+		return 0
+	}
+	rounded := roundToInteger(x, mode)
+	if rounded < math.MinInt32 {
+		f.fpsr |= fpsrInvalidOperation
+		rounded = math.MinInt32
+	} else if rounded > math.MaxInt32 {
+		f.fpsr |= fpsrInvalidOperation
+		rounded = math.MaxInt32
+	} else if rounded != x {
+		f.fpsr |= fpsrInexact
+	}
+	return uint32(int32(rounded))
+}
+
+// Compares a and b, returning the CPSR's new NZCV flags.
+func (f *FPA) compare(a, b float64, signalNaNs bool) uint32 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		if signalNaNs || isSignalingNaN64(a) || isSignalingNaN64(b) {
+			f.fpsr |= fpsrInvalidOperation
+		}
+		if (f.fpsr & fpsrAlternativeCarry) != 0 {
+			return 0x3
+		}
+		return 0x1
+	}
+	if a == b {
+		return 0x6
+	}
+	if a < b {
+		return 0x8
+	}
+	return 0x2
+}
+
+func isSignalingNaN64(x float64) bool {
+	return vfpIsSignalingNaN(math.Float64bits(x), true)
+}
+
+// Carries out flt, fix, wfs, rfs, wfc, rfc and the comparisons, on
+// coprocessor 1.
+func (f *FPA) registerTransfer(p ARMProcessor, raw uint32, rd ARMRegister,
+	load bool) error {
+	if ((raw >> 8) & 0xf) != 1 {
+		return fmt.Errorf("Invalid FPA register transfer: %w",
+			errUndefinedInstruction)
+	}
+	opcode := uint8((raw >> 20) & 0xf)
+	mode := uint8((raw >> 5) & 3)
+	if (opcode == wfcFPAOpcode) || (opcode == rfcFPAOpcode) {
+		if p.GetMode() == userMode {
+			return fmt.Errorf("Can't access the FPCR in user mode: %w",
+				errUndefinedInstruction)
+		}
+	}
+	var value uint32
+	switch opcode {
+	case fltFPAOpcode:
+		precision := uint8(((raw >> 18) & 2) | ((raw >> 7) & 1))
+		if precision == fpaPacked {
+			return fmt.Errorf("Invalid FPA precision: %w",
+				errUndefinedInstruction)
+		}
+		value, _ = p.GetRegister(rd)
+		f.registers[(raw>>16)&7] = f.round(float64(int32(value)), 0,
+			precision, mode)
+		return nil
+	case fixFPAOpcode:
+		return p.SetRegister(rd, f.toInteger(f.operandM(raw), mode))
+	case wfsFPAOpcode:
+		value, _ = p.GetRegister(rd)
+		f.SetFPSR(value)
+		return nil
+	case rfsFPAOpcode:
+		return p.SetRegister(rd, f.FPSR())
+	case wfcFPAOpcode:
+		value, _ = p.GetRegister(rd)
+		f.SetFPCR(value)
+		return nil
+	case rfcFPAOpcode:
+		return p.SetRegister(rd, f.FPCR())
+	case cmfFPAOpcode, cnfFPAOpcode, cmfeFPAOpcode, cnfeFPAOpcode:
+		if rd != 15 {
+			break
+		}
+		b := f.operandM(raw)
+		if (opcode == cnfFPAOpcode) || (opcode == cnfeFPAOpcode) {
+			b = -b
+		}
+		flags := f.compare(f.registers[(raw>>16)&7], b,
+			(opcode == cmfeFPAOpcode) || (opcode == cnfeFPAOpcode))
+		cpsr, e := p.GetCPSR()
+		if e != nil {
+			return e
+		}
+		return p.SetCPSR((cpsr & 0x0fffffff) | (flags << 28))
+	}
+	return fmt.Errorf("Invalid FPA register transfer: %w",
+		errUndefinedInstruction)
+}
+
+// Loads or stores a single register in the given precision.
+func (f *FPA) transferRegister(m ARMMemory, address uint32, register,
+	precision uint8, load bool) error {
+	var words []uint32
+	if !load {
+		value := f.registers[register]
+		switch precision {
+		case fpaSingle:
+			value = f.round(value, 0, fpaSingle, roundToNearest)
+			words = []uint32{math.Float32bits(float32(value))}
+		case fpaDouble:
+			raw := math.Float64bits(value)
+			words = []uint32{uint32(raw >> 32), uint32(raw)}
+		default:
+			extended := float64ToExtended(value)
+			words = extended[:]
+		}
+		for i, word := range words {
+			e := m.WriteMemoryWord(address+uint32(i)*4, word)
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+	count := 3
+	if precision == fpaSingle {
+		count = 1
+	} else if precision == fpaDouble {
+		count = 2
+	}
+	words = make([]uint32, count)
+	var e error
+	for i := range words {
+		words[i], e = m.ReadMemoryWord(address + uint32(i)*4)
+		if e != nil {
+			return e
+		}
+	}
+	switch precision {
+	case fpaSingle:
+		f.registers[register] = float64(math.Float32frombits(words[0]))
+	case fpaDouble:
+		f.registers[register] = math.Float64frombits((uint64(words[0]) <<
+			32) | uint64(words[1]))
+	default:
+		f.registers[register] = extendedToFloat64([3]uint32{words[0],
+			words[1], words[2]})
+	}
+	return nil
+}
+
+// Carries out ldf and stf on coprocessor 1, and lfm and sfm on coprocessor
+// 2. The address has already had the offset applied for pre-indexed
+// transfers. Double precision values are stored with their most significant
+// word first, regardless of endianness.
+func (f *FPA) dataTransfer(p ARMProcessor, raw, address uint32) error {
+	fd := uint8((raw >> 12) & 7)
+	field := uint8(((raw >> 21) & 2) | ((raw >> 15) & 1))
+	load := (raw & 0x100000) != 0
+	m := p.GetMemoryInterface()
+	if ((raw >> 8) & 0xf) == 1 {
+		if field == fpaPacked {
+			return fmt.Errorf("Packed decimal isn't supported: %w",
+				errUndefinedInstruction)
+		}
+		return f.transferRegister(m, address, fd, field, load)
+	}
+	// For lfm and sfm, the same bits hold the number of registers.
+	count := field
+	if count == 0 {
+		count = 4
+	}
+	for i := uint8(0); i < count; i++ {
+		e := f.transferRegister(m, address, (fd+i)&7, fpaExtended, load)
+		if e != nil {
+			return e
+		}
+		address += 12
+	}
+	return nil
+}
+
+// The ARMCoprocessor interface for one of the FPA's two coprocessor numbers.
+type fpaCoprocessor struct {
+	fpa    *FPA
+	number uint8
+}
+
+func (c *fpaCoprocessor) Number() uint8 {
+	return c.number
+}
+
+func (c *fpaCoprocessor) Operation(p ARMProcessor, raw uint32) error {
+	return c.fpa.operation(p, raw)
+}
+
+func (c *fpaCoprocessor) DataTransfer(p ARMProcessor, raw,
+	address uint32) error {
+	return c.fpa.dataTransfer(p, raw, address)
+}
+
+func (c *fpaCoprocessor) RegisterTransfer(p ARMProcessor, raw uint32,
+	rd ARMRegister, load bool) error {
+	return c.fpa.registerTransfer(p, raw, rd, load)
+}
+
+// Creates an FPA and adds it to the processor as coprocessors 1 and 2.
+func AddFPA(p ARMProcessor) (*FPA, error) {
+	var f FPA
+	f.SystemID = 0x81
+	for _, number := range []uint8{1, 2} {
+		e := p.AddCoprocessor(&fpaCoprocessor{&f, number})
+		if e != nil {
+			return nil, fmt.Errorf("Failed adding FPA coprocessor %d: %s",
+				number, e)
+		}
+	}
+	return &f, nil
+}
@@ -0,0 +1,250 @@
+package arm_emulate
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFPAArithmetic(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	f, e := AddFPA(p)
+	if e != nil {
+		t.Logf("Failed adding the FPA: %s\n", e)
+		t.FailNow()
+	}
+	type arithmeticTest struct {
+		raw      uint32
+		a, b     float64
+		expected float64
+		flags    uint32
+	}
+	tests := []arithmeticTest{
+		// adfd f0, f1, f2
+		{0xee010182, 1.5, 2.25, 3.75, 0},
+		// sufd f0, f1, f2 and rsfd f0, f1, f2
+		{0xee210182, 1.0, 3.0, -2.0, 0},
+		{0xee310182, 1.0, 3.0, 2.0, 0},
+		// dvfd f0, f1, f2 and rdfd f0, f1, f2
+		{0xee410182, 1.0, 4.0, 0.25, 0},
+		{0xee510182, 1.0, 4.0, 4.0, 0},
+		{0xee410182, 1.0, 0.0, math.Inf(1), fpsrDivideByZero},
+		// dvfs f0, f1, f2, rounding to nearest and towards zero
+		{0xee410102, 1.0, 3.0, float64(float32(1.0 / 3.0)), fpsrInexact},
+		{0xee410162, 1.0, 3.0, float64(math.Float32frombits(0x3eaaaaaa)),
+			fpsrInexact},
+		// fdvd f0, f1, f2 produces a single precision result.
+		{0xeea10182, 1.0, 3.0, float64(float32(1.0 / 3.0)), fpsrInexact},
+		// mufd f0, f1, f2 overflowing
+		{0xee110182, math.MaxFloat64, 2.0, math.Inf(1),
+			fpsrOverflow | fpsrInexact},
+		// mvfd f0, #1.0
+		{0xee008189, 0, 0, 1.0, 0},
+		// mnfs f0, f1
+		{0xee108101, 2.0, 0, -2.0, 0},
+		// sqtd f0, f1
+		{0xee408181, 9.0, 0, 3.0, 0},
+		{0xee408181, -1.0, 0, math.NaN(), fpsrInvalidOperation},
+		// lgnd f0, f2
+		{0xee608182, 0, math.E, 1.0, 0},
+		// rndd f0, f1, rounding to nearest and towards minus infinity
+		{0xee308181, 2.5, 0, 2.0, fpsrInexact},
+		{0xee3081c1, -2.5, 0, -3.0, fpsrInexact},
+	}
+	for i, test := range tests {
+		f.SetFPSR(0)
+		f.SetRegister(1, test.a)
+		f.SetRegister(2, test.b)
+		e = testSingleInstruction(test.raw, p)
+		if e != nil {
+			t.Logf("Test %d failed: %s\n", i, e)
+			t.FailNow()
+		}
+		result := f.Register(0)
+		if (result != test.expected) && !(math.IsNaN(result) &&
+			math.IsNaN(test.expected)) {
+			t.Logf("Test %d: expected %g, got %g\n", i, test.expected, result)
+			t.Fail()
+		}
+		if (f.FPSR() & 0x1f) != test.flags {
+			t.Logf("Test %d: expected flags 0x%02x, got 0x%02x\n", i,
+				test.flags, f.FPSR()&0x1f)
+			t.Fail()
+		}
+	}
+	// mufs f3, f1, #10
+	f.SetRegister(1, 1.5)
+	e = testSingleInstruction(0xee11310f, p)
+	if (e != nil) || (f.Register(3) != 15.0) {
+		t.Logf("Incorrect mufs result: %v, %g\n", e, f.Register(3))
+		t.Fail()
+	}
+}
+
+func TestFPARegisterTransfers(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	f, e := AddFPA(p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetMode(supervisorMode)
+	p.SetRegister(0, 0xfffffff9)
+	p.SetRegister(2, 0x00001f1f)
+	program := []uint32{
+		// fltd f1, r0
+		0xee010190,
+		// dvfd f1, f1, #2
+		0xee41118a,
+		// fixz r3, f1
+		0xee103171,
+		// fixm r4, f1
+		0xee104151,
+		// wfs r2
+		0xee202110,
+		// rfs r5
+		0xee305110,
+		// cmf f1, #1
+		0xee91f119,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	if f.Register(1) != -3.5 {
+		t.Logf("Incorrect fltd or dvfd result: %g\n", f.Register(1))
+		t.Fail()
+	}
+	value, _ := p.GetRegister(3)
+	if value != 0xfffffffd {
+		t.Logf("Incorrect fixz result: 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(4)
+	if value != 0xfffffffc {
+		t.Logf("Incorrect fixm result: 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(5)
+	if value != 0x81001f1f {
+		t.Logf("Incorrect FPSR: 0x%08x\n", value)
+		t.Fail()
+	}
+	if !p.Negative() || p.Zero() || p.Carry() || p.Overflow() {
+		t.Logf("cmf didn't set the flags to less than.\n")
+		t.Fail()
+	}
+	// cnf f0, #1 with f0 = -1 is equal.
+	f.SetRegister(0, -1.0)
+	e = testSingleInstruction(0xeeb0f119, p)
+	if (e != nil) || !p.Zero() || !p.Carry() || p.Negative() {
+		t.Logf("Incorrect cnf result: %v\n", e)
+		t.Fail()
+	}
+	// cmfe f0, f1 with a NaN is unordered and invalid. The AC bit is set,
+	// so the carry flag is set too.
+	f.SetRegister(1, math.NaN())
+	e = testSingleInstruction(0xeed0f111, p)
+	if (e != nil) || !p.Overflow() || !p.Carry() ||
+		((f.FPSR() & fpsrInvalidOperation) == 0) {
+		t.Logf("Incorrect cmfe result: %v, 0x%08x\n", e, f.FPSR())
+		t.Fail()
+	}
+	// wfc r0 is undefined in user mode.
+	p.SetArchitecturalExceptions(true)
+	p.SetMode(userMode)
+	e = testSingleInstruction(0xee400110, p)
+	if e != nil {
+		t.Logf("Got an error running wfc in user mode: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4100, t)
+}
+
+func TestFPADataTransfers(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	f, e := AddFPA(p)
+	if e != nil {
+		t.FailNow()
+	}
+	f.SetRegister(0, 1.0/3.0)
+	f.SetRegister(1, -2.5)
+	f.SetRegister(2, math.Inf(-1))
+	f.SetRegister(3, math.SmallestNonzeroFloat64)
+	p.SetRegister(1, 0x1800)
+	program := []uint32{
+		// stfd f0, [r1]
+		0xed818100,
+		// stfs f1, [r1, 8]
+		0xed811102,
+		// stfe f0, [r1, 16]
+		0xedc10104,
+		// ldfd f4, [r1]
+		0xed91c100,
+		// ldfs f5, [r1, 8]
+		0xed915102,
+		// ldfe f6, [r1, 16]
+		0xedd16104,
+		// sfm f0, 4, [r1, 48]!
+		0xeda1020c,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	m := p.GetMemoryInterface()
+	value, _ := m.ReadMemoryWord(0x1800)
+	if value != 0x3fd55555 {
+		t.Logf("stfd didn't store the high word first: 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = m.ReadMemoryWord(0x1810)
+	if value != 0x00003ffd {
+		t.Logf("Incorrect extended sign and exponent: 0x%08x\n", value)
+		t.Fail()
+	}
+	if (f.Register(4) != (1.0 / 3.0)) || (f.Register(5) != -2.5) ||
+		(f.Register(6) != (1.0 / 3.0)) {
+		t.Logf("Incorrect loaded values: %g, %g, %g\n", f.Register(4),
+			f.Register(5), f.Register(6))
+		t.Fail()
+	}
+	value, _ = p.GetRegister(1)
+	if value != 0x1830 {
+		t.Logf("Incorrect base register after sfm: 0x%08x\n", value)
+		t.FailNow()
+	}
+	for i := uint8(4); i < 8; i++ {
+		f.SetRegister(i, 0)
+	}
+	// lfm f4, 4, [r1]
+	e = testSingleInstruction(0xed914200, p)
+	if e != nil {
+		t.Logf("Failed running lfm: %s\n", e)
+		t.FailNow()
+	}
+	for i := uint8(0); i < 4; i++ {
+		if f.Register(4+i) != f.Register(i) {
+			t.Logf("Expected f%d to be %g, got %g\n", 4+i, f.Register(i),
+				f.Register(4+i))
+			t.Fail()
+		}
+	}
+}
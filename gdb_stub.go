@@ -0,0 +1,671 @@
+package arm_emulate
+
+// This file implements a stub for the GDB remote serial protocol, so that GDB
+// can attach to an emulated processor using "target remote".
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The register layout reported to GDB. Registers 0 to 15 are r0-r15, and the
+// CPSR uses register number 25, as in GDB's own ARM target descriptions.
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <architecture>arm</architecture>
+  <feature name="org.gnu.gdb.arm.core">
+    <reg name="r0" bitsize="32" type="uint32"/>
+    <reg name="r1" bitsize="32" type="uint32"/>
+    <reg name="r2" bitsize="32" type="uint32"/>
+    <reg name="r3" bitsize="32" type="uint32"/>
+    <reg name="r4" bitsize="32" type="uint32"/>
+    <reg name="r5" bitsize="32" type="uint32"/>
+    <reg name="r6" bitsize="32" type="uint32"/>
+    <reg name="r7" bitsize="32" type="uint32"/>
+    <reg name="r8" bitsize="32" type="uint32"/>
+    <reg name="r9" bitsize="32" type="uint32"/>
+    <reg name="r10" bitsize="32" type="uint32"/>
+    <reg name="r11" bitsize="32" type="uint32"/>
+    <reg name="r12" bitsize="32" type="uint32"/>
+    <reg name="sp" bitsize="32" type="data_ptr"/>
+    <reg name="lr" bitsize="32"/>
+    <reg name="pc" bitsize="32" type="code_ptr"/>
+    <reg name="cpsr" bitsize="32" regnum="25"/>
+  </feature>
+</target>
+`
+
+const gdbCPSRRegister = 25
+
+// Signal numbers used in stop replies.
+const (
+	gdbSignalInterrupt uint8 = 2
+	gdbSignalIllegal   uint8 = 4
+	gdbSignalTrap      uint8 = 5
+)
+
+// The number of instructions to run between checks for an interrupt request
+// from GDB while continuing.
+const gdbInterruptCheckInterval = 1024
+
+// The largest packet GDB may send, as reported in the qSupported reply. Memory
+// reads are limited so that their hex-encoded replies fit in a packet too.
+const gdbPacketSize = 0x4000
+
+// The type numbers used by GDB's Z and z packets.
+const (
+	gdbSoftwareBreakpoint uint8 = 0
+	gdbHardwareBreakpoint uint8 = 1
+	gdbWriteWatchpoint    uint8 = 2
+	gdbReadWatchpoint     uint8 = 3
+	gdbAccessWatchpoint   uint8 = 4
+)
+
+// Holds a packet or other request received from GDB, or an error if the
+// connection failed.
+type gdbInput struct {
+	packet string
+	// Set if GDB sent a ^C to interrupt the target.
+	interrupt bool
+	// Set if GDB asked for the last packet to be sent again.
+	retransmit bool
+	// Set if a packet was received with an incorrect checksum.
+	badChecksum bool
+	e           error
+}
+
+// Serves a single processor to GDB using the remote serial protocol.
+type GDBStub struct {
+	processor  ARMProcessor
+	connection io.Writer
+	input      chan gdbInput
+	noAck      bool
+	lastPacket string
+	// The error, if any, that stopped emulation most recently. GDB only sees
+	// a SIGILL in this case.
+	LastError error
+}
+
+// Returns a new stub for the given processor. The processor shouldn't be
+// modified by anything else while the stub is serving it.
+func NewGDBStub(p ARMProcessor) *GDBStub {
+	var toReturn GDBStub
+	toReturn.processor = p
+	return &toReturn
+}
+
+// Reads packets and interrupt requests from GDB, and sends them to the given
+// channel. Returns after a read fails, or once the done channel is closed.
+func readGDBInput(r *bufio.Reader, output chan<- gdbInput,
+	done <-chan struct{}) {
+	// Returns false if nothing is receiving the input any more.
+	send := func(input gdbInput) bool {
+		select {
+		case output <- input:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	for {
+		c, e := r.ReadByte()
+		if e != nil {
+			send(gdbInput{e: e})
+			return
+		}
+		if c == 0x03 {
+			if !send(gdbInput{interrupt: true}) {
+				return
+			}
+			continue
+		}
+		if c == '-' {
+			if !send(gdbInput{retransmit: true}) {
+				return
+			}
+			continue
+		}
+		// Ignore acknowledgements and anything else between packets.
+		if c != '$' {
+			continue
+		}
+		data, e := r.ReadString('#')
+		if e != nil {
+			send(gdbInput{e: e})
+			return
+		}
+		data = data[:len(data)-1]
+		checksumBytes := make([]byte, 2)
+		_, e = io.ReadFull(r, checksumBytes)
+		if e != nil {
+			send(gdbInput{e: e})
+			return
+		}
+		checksum, e := strconv.ParseUint(string(checksumBytes), 16, 8)
+		if (e != nil) || (uint8(checksum) != gdbChecksum(data)) {
+			if !send(gdbInput{badChecksum: true}) {
+				return
+			}
+			continue
+		}
+		if !send(gdbInput{packet: data}) {
+			return
+		}
+	}
+}
+
+func gdbChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func (s *GDBStub) sendPacket(data string) error {
+	s.lastPacket = data
+	_, e := fmt.Fprintf(s.connection, "$%s#%02x", data, gdbChecksum(data))
+	return e
+}
+
+// Returns true if the target is big endian. The CPSR's E bit is ignored, since
+// it only reverses data accesses, and GDB expects registers to use the same
+// byte order throughout a session.
+func (s *GDBStub) bigEndian() bool {
+	m := s.processor.GetMemoryInterface()
+	if swapped, ok := m.(*byteSwappingMemory); ok {
+		return swapped.ARMMemory.IsBigEndian()
+	}
+	return m.IsBigEndian()
+}
+
+// Encodes a register value in the target's byte order.
+func (s *GDBStub) encodeRegister(value uint32) string {
+	if s.bigEndian() {
+		return fmt.Sprintf("%08x", value)
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", value&0xff, (value>>8)&0xff,
+		(value>>16)&0xff, value>>24)
+}
+
+func (s *GDBStub) decodeRegister(text string) (uint32, error) {
+	data, e := hex.DecodeString(text)
+	if e != nil {
+		return 0, e
+	}
+	if len(data) != 4 {
+		return 0, fmt.Errorf("Invalid register value length: %d", len(data))
+	}
+	if s.bigEndian() {
+		return uint32(data[0])<<24 | uint32(data[1])<<16 |
+			uint32(data[2])<<8 | uint32(data[3]), nil
+	}
+	return uint32(data[3])<<24 | uint32(data[2])<<16 | uint32(data[1])<<8 |
+		uint32(data[0]), nil
+}
+
+func (s *GDBStub) readRegister(number uint64) (uint32, error) {
+	if number < 16 {
+		return s.processor.GetRegister(ARMRegister(number))
+	}
+	if number == gdbCPSRRegister {
+		return s.processor.GetCPSR()
+	}
+	return 0, fmt.Errorf("Invalid register number: %d", number)
+}
+
+func (s *GDBStub) writeRegister(number uint64, value uint32) error {
+	if number < 16 {
+		return s.processor.SetRegister(ARMRegister(number), value)
+	}
+	if number != gdbCPSRRegister {
+		return fmt.Errorf("Invalid register number: %d", number)
+	}
+	p := s.processor
+	// SetCPSR only changes the flags in user mode, but the debugger may change
+	// anything.
+	mode := uint8(value & 0x1f)
+	if isValidMode(mode) && (mode != p.GetMode()) {
+		e := p.SetMode(mode)
+		if e != nil {
+			return e
+		}
+	}
+	e := p.SetCPSR(value)
+	if e != nil {
+		return e
+	}
+	return p.SetTHUMBMode((value & 0x20) != 0)
+}
+
+// Parses the "address,length" format used by several packets.
+func parseGDBAddressLength(text string) (uint32, uint32, error) {
+	fields := strings.Split(text, ",")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("Invalid address and length: %s", text)
+	}
+	address, e := strconv.ParseUint(fields[0], 16, 32)
+	if e != nil {
+		return 0, 0, fmt.Errorf("Invalid address: %s", e)
+	}
+	length, e := strconv.ParseUint(fields[1], 16, 32)
+	if e != nil {
+		return 0, 0, fmt.Errorf("Invalid length: %s", e)
+	}
+	return uint32(address), uint32(length), nil
+}
+
+// Removes the escaping used for binary data in X packets.
+func unescapeGDBBinary(data string) []byte {
+	toReturn := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if (data[i] == '}') && ((i + 1) < len(data)) {
+			i++
+			toReturn = append(toReturn, data[i]^0x20)
+			continue
+		}
+		toReturn = append(toReturn, data[i])
+	}
+	return toReturn
+}
+
+func (s *GDBStub) readAllRegisters() string {
+	var b strings.Builder
+	for i := uint64(0); i < 16; i++ {
+		value, _ := s.readRegister(i)
+		b.WriteString(s.encodeRegister(value))
+	}
+	value, _ := s.readRegister(gdbCPSRRegister)
+	b.WriteString(s.encodeRegister(value))
+	return b.String()
+}
+
+func (s *GDBStub) writeAllRegisters(data string) string {
+	if len(data) < (17 * 8) {
+		return "E01"
+	}
+	for i := 0; i < 17; i++ {
+		value, e := s.decodeRegister(data[i*8 : (i+1)*8])
+		if e != nil {
+			return "E01"
+		}
+		number := uint64(i)
+		if i == 16 {
+			number = gdbCPSRRegister
+		}
+		e = s.writeRegister(number, value)
+		if e != nil {
+			return "E01"
+		}
+	}
+	return "OK"
+}
+
+func (s *GDBStub) readMemory(args string) string {
+	address, length, e := parseGDBAddressLength(args)
+	if e != nil {
+		return "E01"
+	}
+	if length > (gdbPacketSize / 2) {
+		length = gdbPacketSize / 2
+	}
+	// Reads by the debugger mustn't record faults in the emulated system.
+	m := debugMemory(s.processor.GetMemoryInterface())
+	data := make([]byte, 0, length)
+	for i := uint32(0); i < length; i++ {
+		b, e := m.ReadMemoryByte(address + i)
+		if e != nil {
+			break
+		}
+		data = append(data, b)
+	}
+	if (len(data) == 0) && (length != 0) {
+		return "E01"
+	}
+	return hex.EncodeToString(data)
+}
+
+func (s *GDBStub) writeMemory(args string, binary bool) string {
+	separator := strings.Index(args, ":")
+	if separator < 0 {
+		return "E01"
+	}
+	address, length, e := parseGDBAddressLength(args[:separator])
+	if e != nil {
+		return "E01"
+	}
+	var data []byte
+	if binary {
+		data = unescapeGDBBinary(args[separator+1:])
+	} else {
+		data, e = hex.DecodeString(args[separator+1:])
+		if e != nil {
+			return "E01"
+		}
+	}
+	if uint32(len(data)) != length {
+		return "E01"
+	}
+	e = writeMemoryBytes(s.processor.GetMemoryInterface(), address, data)
+	if e != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+// Handles the Z and z packets.
+func (s *GDBStub) changeBreakpoint(args string, insert bool) string {
+	fields := strings.Split(args, ",")
+	if len(fields) < 3 {
+		return "E01"
+	}
+	kind, e := strconv.ParseUint(fields[0], 10, 8)
+	if e != nil {
+		return "E01"
+	}
+	address, length, e := parseGDBAddressLength(fields[1] + "," + fields[2])
+	if e != nil {
+		return "E01"
+	}
+	var w Watchpoint
+	switch uint8(kind) {
+	case gdbSoftwareBreakpoint, gdbHardwareBreakpoint:
+		if insert {
+			e = s.processor.AddBreakpoint(address, nil)
+		} else {
+			e = s.processor.RemoveBreakpoint(address)
+		}
+		if e != nil {
+			return "E01"
+		}
+		return "OK"
+	case gdbWriteWatchpoint:
+		w.Type = WatchWrite
+	case gdbReadWatchpoint:
+		w.Type = WatchRead
+	case gdbAccessWatchpoint:
+		w.Type = WatchAccess
+	default:
+		// An empty reply indicates an unsupported breakpoint type.
+		return ""
+	}
+	w.Address = address
+	w.Size = length
+	if insert {
+		e = s.processor.AddWatchpoint(w)
+	} else {
+		e = s.processor.RemoveWatchpoint(w)
+	}
+	if e != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+func (s *GDBStub) handleXfer(args string) string {
+	prefix := "features:read:target.xml:"
+	if !strings.HasPrefix(args, prefix) {
+		return ""
+	}
+	offset, length, e := parseGDBAddressLength(args[len(prefix):])
+	if e != nil {
+		return "E01"
+	}
+	if offset >= uint32(len(gdbTargetXML)) {
+		return "l"
+	}
+	end := offset + length
+	if end >= uint32(len(gdbTargetXML)) {
+		return "l" + gdbTargetXML[offset:]
+	}
+	return "m" + gdbTargetXML[offset:end]
+}
+
+func (s *GDBStub) handleQuery(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return fmt.Sprintf("PacketSize=%x;qXfer:features:read+;"+
+			"QStartNoAckMode+", gdbPacketSize)
+	case strings.HasPrefix(packet, "qXfer:"):
+		return s.handleXfer(packet[len("qXfer:"):])
+	case packet == "qAttached":
+		return "1"
+	case packet == "qC":
+		return "QC1"
+	case packet == "qfThreadInfo":
+		return "m1"
+	case packet == "qsThreadInfo":
+		return "l"
+	case packet == "QStartNoAckMode":
+		s.noAck = true
+		return "OK"
+	}
+	return ""
+}
+
+// Checks whether GDB has asked to interrupt a continue request, without
+// blocking.
+func (s *GDBStub) interruptRequested() (bool, error) {
+	for {
+		select {
+		case input := <-s.input:
+			if input.e != nil {
+				return false, input.e
+			}
+			if input.interrupt {
+				return true, nil
+			}
+			// Other packets shouldn't arrive while running, so drop them.
+		default:
+			return false, nil
+		}
+	}
+}
+
+// Runs the processor until it reaches a breakpoint or watchpoint, or after a
+// single instruction if step is true. Returns the stop reply to send.
+func (s *GDBStub) resume(step bool) (string, error) {
+	s.LastError = nil
+	budget := uint64(gdbInterruptCheckInterval)
+	if step {
+		budget = 1
+	}
+	for {
+		switch r := s.processor.Run(budget).(type) {
+		case *BreakpointStop:
+			return fmt.Sprintf("S%02x", gdbSignalTrap), nil
+		case *WatchpointStop:
+			kind := "awatch"
+			if r.Watchpoint.Type == WatchWrite {
+				kind = "watch"
+			} else if r.Watchpoint.Type == WatchRead {
+				kind = "rwatch"
+			}
+			return fmt.Sprintf("T%02x%s:%x;", gdbSignalTrap, kind,
+				r.Address), nil
+		case *ErrorStop:
+			var exitError *ProcessExitError
+			if errors.As(r.Error, &exitError) {
+				return fmt.Sprintf("W%02x", uint8(exitError.Status)), nil
+			}
+			s.LastError = r.Error
+			return fmt.Sprintf("S%02x", gdbSignalIllegal), nil
+		}
+		if step {
+			return fmt.Sprintf("S%02x", gdbSignalTrap), nil
+		}
+		interrupted, e := s.interruptRequested()
+		if e != nil {
+			return "", e
+		}
+		if interrupted {
+			return fmt.Sprintf("S%02x", gdbSignalInterrupt), nil
+		}
+	}
+}
+
+// Handles a single packet, returning the reply. Returns true if the session
+// should end after sending the reply.
+func (s *GDBStub) handlePacket(packet string) (string, bool, error) {
+	if len(packet) == 0 {
+		return "", false, nil
+	}
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", gdbSignalTrap), false, nil
+	case 'g':
+		return s.readAllRegisters(), false, nil
+	case 'G':
+		return s.writeAllRegisters(args), false, nil
+	case 'p':
+		number, e := strconv.ParseUint(args, 16, 32)
+		if e != nil {
+			return "E01", false, nil
+		}
+		value, e := s.readRegister(number)
+		if e != nil {
+			return "E01", false, nil
+		}
+		return s.encodeRegister(value), false, nil
+	case 'P':
+		fields := strings.Split(args, "=")
+		if len(fields) != 2 {
+			return "E01", false, nil
+		}
+		number, e := strconv.ParseUint(fields[0], 16, 32)
+		if e != nil {
+			return "E01", false, nil
+		}
+		value, e := s.decodeRegister(fields[1])
+		if e != nil {
+			return "E01", false, nil
+		}
+		if s.writeRegister(number, value) != nil {
+			return "E01", false, nil
+		}
+		return "OK", false, nil
+	case 'm':
+		return s.readMemory(args), false, nil
+	case 'M':
+		return s.writeMemory(args, false), false, nil
+	case 'X':
+		return s.writeMemory(args, true), false, nil
+	case 'c', 's':
+		if len(args) != 0 {
+			address, e := strconv.ParseUint(args, 16, 32)
+			if e != nil {
+				return "E01", false, nil
+			}
+			s.processor.SetRegister(15, uint32(address))
+		}
+		reply, e := s.resume(packet[0] == 's')
+		return reply, false, e
+	case 'Z':
+		return s.changeBreakpoint(args, true), false, nil
+	case 'z':
+		return s.changeBreakpoint(args, false), false, nil
+	case 'H', 'T':
+		return "OK", false, nil
+	case 'q', 'Q':
+		return s.handleQuery(packet), false, nil
+	case 'D':
+		return "OK", true, nil
+	case 'k':
+		return "", true, nil
+	}
+	// An empty reply indicates an unsupported packet.
+	return "", false, nil
+}
+
+// Serves GDB over the given connection, which may be a network connection or
+// a pair of pipes. This returns when GDB detaches or kills the target, or when
+// the connection fails. The connection isn't closed, but must be closed by the
+// caller afterwards, which also stops the goroutine reading from it.
+func (s *GDBStub) Serve(connection io.ReadWriter) error {
+	s.connection = connection
+	s.input = make(chan gdbInput, 16)
+	s.noAck = false
+	done := make(chan struct{})
+	defer close(done)
+	go readGDBInput(bufio.NewReader(connection), s.input, done)
+	for {
+		input := <-s.input
+		if input.e != nil {
+			if input.e == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("Failed reading from GDB: %s", input.e)
+		}
+		if input.interrupt {
+			// We're already stopped, but GDB expects a reply.
+			e := s.sendPacket(fmt.Sprintf("S%02x", gdbSignalInterrupt))
+			if e != nil {
+				return e
+			}
+			continue
+		}
+		if input.retransmit {
+			if !s.noAck {
+				e := s.sendPacket(s.lastPacket)
+				if e != nil {
+					return e
+				}
+			}
+			continue
+		}
+		if input.badChecksum {
+			if !s.noAck {
+				_, e := s.connection.Write([]byte("-"))
+				if e != nil {
+					return e
+				}
+			}
+			continue
+		}
+		if !s.noAck {
+			_, e := s.connection.Write([]byte("+"))
+			if e != nil {
+				return e
+			}
+		}
+		reply, done, e := s.handlePacket(input.packet)
+		if e != nil {
+			return e
+		}
+		// GDB doesn't expect a reply to a kill request.
+		if done && (input.packet == "k") {
+			return nil
+		}
+		e = s.sendPacket(reply)
+		if e != nil {
+			return e
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// Listens for a single connection from GDB on the given TCP address (for
+// example, "localhost:1234"), and serves it until GDB detaches.
+func (s *GDBStub) ListenAndServe(address string) error {
+	listener, e := net.Listen("tcp", address)
+	if e != nil {
+		return fmt.Errorf("Failed listening for GDB: %s", e)
+	}
+	connection, e := listener.Accept()
+	listener.Close()
+	if e != nil {
+		return fmt.Errorf("Failed accepting GDB connection: %s", e)
+	}
+	defer connection.Close()
+	return s.Serve(connection)
+}
@@ -0,0 +1,244 @@
+package arm_emulate
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A scripted GDB client, for testing the stub.
+type testGDBClient struct {
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+// Sends a packet and returns the stub's reply.
+func (c *testGDBClient) command(packet string) (string, error) {
+	_, e := fmt.Fprintf(c.connection, "$%s#%02x", packet, gdbChecksum(packet))
+	if e != nil {
+		return "", e
+	}
+	ack, e := c.reader.ReadByte()
+	if e != nil {
+		return "", e
+	}
+	if ack != '+' {
+		return "", fmt.Errorf("Expected an acknowledgement, got %q", ack)
+	}
+	return c.readReply()
+}
+
+func (c *testGDBClient) readReply() (string, error) {
+	_, e := c.reader.ReadString('$')
+	if e != nil {
+		return "", e
+	}
+	reply, e := c.reader.ReadString('#')
+	if e != nil {
+		return "", e
+	}
+	reply = reply[:len(reply)-1]
+	checksum := make([]byte, 2)
+	_, e = c.reader.Read(checksum)
+	if e != nil {
+		return "", e
+	}
+	if string(checksum) != fmt.Sprintf("%02x", gdbChecksum(reply)) {
+		return "", fmt.Errorf("Bad checksum for reply %q", reply)
+	}
+	_, e = c.connection.Write([]byte("+"))
+	return reply, e
+}
+
+func TestGDBStub(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	program := []uint32{
+		// mov r0, 1; add r0, r0, 1
+		0xe3a00001, 0xe2800001,
+		// str r0, [r1]; ldr r2, [r1]; b .
+		0xe5810000, 0xe5912000, 0xeafffffe,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	stubConnection, clientConnection := net.Pipe()
+	defer clientConnection.Close()
+	memory := p.GetMemoryInterface()
+	stub := NewGDBStub(p)
+	serveResult := make(chan error)
+	go func() {
+		serveResult <- stub.Serve(stubConnection)
+		stubConnection.Close()
+	}()
+	client := &testGDBClient{clientConnection,
+		bufio.NewReader(clientConnection)}
+	script := []struct {
+		packet   string
+		expected string
+	}{
+		{"Pf=00100000", "OK"},
+		{"P1=00180000", "OK"},
+		{"pf", "00100000"},
+		{"Z0,1008,4", "OK"},
+		{"c", "S05"},
+		{"pf", "08100000"},
+		{"p0", "02000000"},
+		{"z0,1008,4", "OK"},
+		{"Z2,1800,4", "OK"},
+		{"c", "T05watch:1800;"},
+		{"pf", "0c100000"},
+		{"z2,1800,4", "OK"},
+		{"Z3,1800,4", "OK"},
+		{"c", "T05rwatch:1800;"},
+		{"z3,1800,4", "OK"},
+		{"p2", "02000000"},
+		{"s", "S05"},
+		{"pf", "10100000"},
+		{"m1800,4", "02000000"},
+		{"M1804,2:abcd", "OK"},
+		{"m1804,2", "abcd"},
+		{"p19", "10000000"},
+		{"Z9,1000,4", ""},
+	}
+	for _, step := range script {
+		reply, e := client.command(step.packet)
+		if e != nil {
+			t.Logf("Failed sending %q: %s\n", step.packet, e)
+			t.FailNow()
+		}
+		if reply != step.expected {
+			t.Logf("Expected %q in response to %q, got %q\n", step.expected,
+				step.packet, reply)
+			t.Fail()
+		}
+	}
+	reply, _ := client.command("qSupported:multiprocess+")
+	if !strings.Contains(reply, "qXfer:features:read+") {
+		t.Logf("Incorrect qSupported reply: %q\n", reply)
+		t.Fail()
+	}
+	reply, _ = client.command("qXfer:features:read:target.xml:0,ffff")
+	if !strings.HasPrefix(reply, "l<?xml") ||
+		!strings.Contains(reply, "regnum=\"25\"") {
+		t.Logf("Incorrect target.xml reply: %q\n", reply)
+		t.Fail()
+	}
+	reply, _ = client.command("g")
+	if len(reply) != (17 * 8) {
+		t.Logf("Incorrect g reply length: %q\n", reply)
+		t.Fail()
+	}
+	// Continue into the infinite loop and interrupt it.
+	_, e = fmt.Fprintf(clientConnection, "$c#63")
+	if e != nil {
+		t.FailNow()
+	}
+	ack, _ := client.reader.ReadByte()
+	clientConnection.Write([]byte{0x03})
+	reply, e = client.readReply()
+	if (ack != '+') || (e != nil) || (reply != "S02") {
+		t.Logf("Expected S02 after interrupting, got %q (%v)\n", reply, e)
+		t.Fail()
+	}
+	reply, _ = client.command("D")
+	if reply != "OK" {
+		t.Logf("Expected OK in response to detaching, got %q\n", reply)
+		t.Fail()
+	}
+	e = <-serveResult
+	if e != nil {
+		t.Logf("Serving GDB failed: %s\n", e)
+		t.Fail()
+	}
+	if p.GetMemoryInterface() != memory {
+		t.Logf("The processor's memory wasn't restored after detaching.\n")
+		t.Fail()
+	}
+}
+
+func TestGDBReadMemoryLimit(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	e = p.GetMemoryInterface().SetMemoryRegion(0x10000, make([]byte, 0x10000))
+	if e != nil {
+		t.FailNow()
+	}
+	stub := NewGDBStub(p)
+	// Huge lengths mustn't be allocated up front, and the reply must fit in a
+	// packet.
+	reply := stub.readMemory("10000,ffffffff")
+	if len(reply) != gdbPacketSize {
+		t.Logf("Got a %d-byte reply to a huge read, expected %d\n",
+			len(reply), gdbPacketSize)
+		t.Fail()
+	}
+	reply = stub.readMemory("1000,4")
+	if reply != "00000000" {
+		t.Logf("Incorrect reply to a small read: %q\n", reply)
+		t.Fail()
+	}
+}
+
+func TestGDBInputStops(t *testing.T) {
+	// More packets than the channel can hold, so the reader blocks sending.
+	packets := strings.Repeat(fmt.Sprintf("$g#%02x", gdbChecksum("g")), 64)
+	input := make(chan gdbInput)
+	done := make(chan struct{})
+	finished := make(chan bool)
+	go func() {
+		readGDBInput(bufio.NewReader(strings.NewReader(packets)), input, done)
+		finished <- true
+	}()
+	received := <-input
+	if received.packet != "g" {
+		t.Logf("Expected the g packet, got %+v\n", received)
+		t.Fail()
+	}
+	close(done)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Logf("The input goroutine didn't stop after the stub finished\n")
+		t.Fail()
+	}
+}
+
+func TestGDBRegisterByteOrder(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	e = p.SetArchitecture(ARMv6)
+	if e != nil {
+		t.FailNow()
+	}
+	stub := NewGDBStub(p)
+	// Setting the E bit, as setend be does, mustn't change how registers are
+	// sent to GDB.
+	cpsr, _ := p.GetCPSR()
+	p.SetCPSR(cpsr | 0x200)
+	if !p.GetMemoryInterface().IsBigEndian() {
+		t.Logf("Setting the E bit didn't make data accesses big endian\n")
+		t.FailNow()
+	}
+	text := stub.encodeRegister(0x12345678)
+	if text != "78563412" {
+		t.Logf("Register encoded as %s after setting the E bit\n", text)
+		t.Fail()
+	}
+	value, e := stub.decodeRegister("78563412")
+	if (e != nil) || (value != 0x12345678) {
+		t.Logf("Register decoded as 0x%08x (%v) after setting the E bit\n",
+			value, e)
+		t.Fail()
+	}
+}
@@ -10,11 +10,19 @@ type ARMInstruction interface {
 	Raw() uint32
 	Condition() ARMCondition
 	Emulate(p ARMProcessor) error
+	// Returns the raw encoding of the instruction's fields, or an error if
+	// they can't be encoded.
+	Encode() (uint32, error)
 }
 
 type basicARMInstruction struct {
-	raw       uint32
-	condition ARMCondition
+	raw uint32
+	// The condition, exclusive-ored with 14, so instructions which weren't
+	// parsed always execute.
+	conditionField ARMCondition
+	// Set for instructions parsed from Thumb-2 encodings, which Encode then
+	// produces.
+	thumb2 bool
 }
 
 func (n *basicARMInstruction) Raw() uint32 {
@@ -22,7 +30,7 @@ func (n *basicARMInstruction) Raw() uint32 {
 }
 
 func (n *basicARMInstruction) Condition() ARMCondition {
-	return n.condition
+	return n.conditionField ^ 14
 }
 
 func (n *basicARMInstruction) Emulate(p ARMProcessor) error {
@@ -37,6 +45,100 @@ func (n *basicARMInstruction) ReCache() {
 	return
 }
 
+// Sets the condition under which the instruction is executed. Instructions
+// created without parsing start out using the al condition.
+func (n *basicARMInstruction) SetCondition(condition ARMCondition) {
+	n.conditionField = condition ^ 14
+}
+
+// Used by the Encode methods to build a raw instruction from its fields. The
+// first field which doesn't fit is recorded as an error.
+type instructionEncoder struct {
+	raw uint32
+	e   error
+}
+
+// Records an error, unless an earlier one was already recorded.
+func (c *instructionEncoder) fail(format string, args ...interface{}) {
+	if c.e == nil {
+		c.e = fmt.Errorf(format, args...)
+	}
+}
+
+// Adds a field with the given number of bits at the given position.
+func (c *instructionEncoder) field(name string, value uint32, position,
+	bits uint8) {
+	if (value >> bits) != 0 {
+		c.fail("%s (%d) doesn't fit in %d bits", name, value, bits)
+	}
+	c.raw |= (value & ((1 << bits) - 1)) << position
+}
+
+// Adds a 4-bit register field.
+func (c *instructionEncoder) register(name string, r ARMRegister,
+	position uint8) {
+	c.field(name, uint32(r), position, 4)
+}
+
+// Adds a 3-bit THUMB register field, which can only hold r0-r7.
+func (c *instructionEncoder) lowRegister(name string, r ARMRegister,
+	position uint8) {
+	if r > 7 {
+		c.fail("%s must be a low register, got %s", name, r)
+	}
+	c.raw |= uint32(r&7) << position
+}
+
+// Sets the given bits if the flag is true.
+func (c *instructionEncoder) flag(set bool, bits uint32) {
+	if set {
+		c.raw |= bits
+	}
+}
+
+func (c *instructionEncoder) condition(condition ARMCondition) {
+	c.field("Condition", uint32(condition), 28, 4)
+}
+
+// Adds the 8-bit shift field used by data processing and single data
+// transfer instructions. A nil shift is encoded as lsl 0.
+func (c *instructionEncoder) shift(s ARMShift) {
+	if s == nil {
+		return
+	}
+	c.field("Shift type", uint32(s.ShiftType()), 5, 2)
+	if s.UseRegister() {
+		c.register("Shift register", s.Register(), 8)
+		c.raw |= 0x10
+		return
+	}
+	c.field("Shift amount", uint32(s.Amount()), 7, 5)
+}
+
+func (c *instructionEncoder) result() (uint32, error) {
+	if c.e != nil {
+		return 0, c.e
+	}
+	return c.raw, nil
+}
+
+// Returns an encoder for a Thumb-2 instruction sharing an ARM instruction
+// type. These instructions can't be conditional.
+func (n *basicARMInstruction) thumb2Encoder(raw uint32) instructionEncoder {
+	c := instructionEncoder{raw: raw}
+	if n.Condition() != 14 {
+		c.fail("Thumb-2 instructions can't be conditional")
+	}
+	return c
+}
+
+func (c *instructionEncoder) resultTHUMB() (uint16, error) {
+	if c.e != nil {
+		return 0, c.e
+	}
+	return uint16(c.raw), nil
+}
+
 type DataProcessingInstruction struct {
 	basicARMInstruction
 	Opcode        ARMDataProcessingOpcode
@@ -57,16 +159,19 @@ func (n *DataProcessingInstruction) secondOperand() string {
 		value = (value >> r) | (value << (32 - r))
 		return fmt.Sprintf("%d", value)
 	}
-	toReturn := n.Rm.String()
-	if n.Shift.UseRegister() || (n.Shift.Amount() != 0) {
-		toReturn += " "
+	if n.Shift == nil {
+		return n.Rm.String()
 	}
-	return fmt.Sprintf("%s%s", toReturn, n.Shift)
+	shift := n.Shift.String()
+	if shift == "" {
+		return n.Rm.String()
+	}
+	return fmt.Sprintf("%s %s", n.Rm, shift)
 }
 
 func (n *DataProcessingInstruction) String() string {
 	prefix := n.Opcode.String()
-	prefix += n.condition.String()
+	prefix += n.Condition().String()
 	opcodeValue := n.Opcode
 	switch opcodeValue {
 	case movARMOpcode, mvnARMOpcode:
@@ -83,6 +188,24 @@ func (n *DataProcessingInstruction) String() string {
 	return fmt.Sprintf("%s %s, %s, %s", prefix, n.Rd, n.Rn, n.secondOperand())
 }
 
+func (n *DataProcessingInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{}
+	c.condition(n.Condition())
+	c.field("Opcode", uint32(n.Opcode), 21, 4)
+	c.flag(n.SetConditions, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	if n.IsImmediate {
+		c.raw |= 0x2000000
+		c.field("Rotate", uint32(n.Rotate), 8, 4)
+		c.raw |= uint32(n.Immediate)
+	} else {
+		c.shift(n.Shift)
+		c.register("Rm", n.Rm, 0)
+	}
+	return c.result()
+}
+
 type PSRTransferInstruction struct {
 	basicARMInstruction
 	Rm          ARMRegister
@@ -90,9 +213,37 @@ type PSRTransferInstruction struct {
 	IsImmediate bool
 	WritePSR    bool
 	UseCPSR     bool
-	FlagsOnly   bool
-	Immediate   uint8
-	Rotate      uint8
+	// Set if msr only writes the condition flags. Ignored if Mask is set.
+	FlagsOnly bool
+	// The fields written by msr, with the flags in bit 3, followed by the
+	// s, x and c fields. If this is 0, msr writes the flags, along with the
+	// control field unless FlagsOnly is set.
+	Mask      uint8
+	Immediate uint8
+	Rotate    uint8
+}
+
+// Returns the msr field mask, taking FlagsOnly into account if Mask is 0.
+func (n *PSRTransferInstruction) fields() uint8 {
+	if n.Mask != 0 {
+		return n.Mask
+	}
+	if n.FlagsOnly {
+		return 8
+	}
+	return 9
+}
+
+// Returns the name of a PSR followed by the msr fields in the mask, such as
+// cpsr_fc.
+func psrFieldsString(psr string, mask uint8) string {
+	toReturn := psr + "_"
+	for i, field := range "fsxc" {
+		if (mask & (8 >> uint(i))) != 0 {
+			toReturn += string(field)
+		}
+	}
+	return toReturn
 }
 
 func (n *PSRTransferInstruction) String() string {
@@ -103,19 +254,37 @@ func (n *PSRTransferInstruction) String() string {
 		usedPSR = "spsr"
 	}
 	if !n.WritePSR {
-		return fmt.Sprintf("mrs%s %s, %s", n.condition, n.Rd, usedPSR)
+		return fmt.Sprintf("mrs%s %s, %s", n.Condition(), n.Rd, usedPSR)
 	}
-	if !n.FlagsOnly {
-		return fmt.Sprintf("msr%s %s, %s", n.condition, n.Rm, usedPSR)
-	}
-	usedPSR += "_flags"
+	usedPSR = psrFieldsString(usedPSR, n.fields())
 	if n.IsImmediate {
 		r := n.Rotate << 1
 		value := uint32(n.Immediate)
 		value = (value >> r) | (value << (32 - r))
-		return fmt.Sprintf("msr%s %s, %d", n.condition, usedPSR, value)
+		return fmt.Sprintf("msr%s %s, %d", n.Condition(), usedPSR, value)
 	}
-	return fmt.Sprintf("msr%s %s, %s", n.condition, usedPSR, n.Rm)
+	return fmt.Sprintf("msr%s %s, %s", n.Condition(), usedPSR, n.Rm)
+}
+
+func (n *PSRTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x01000000}
+	c.condition(n.Condition())
+	c.flag(!n.UseCPSR, 0x400000)
+	if !n.WritePSR {
+		c.raw |= 0xf0000
+		c.register("Rd", n.Rd, 12)
+		return c.result()
+	}
+	c.raw |= 0x20f000
+	c.field("Mask", uint32(n.fields()), 16, 4)
+	if n.IsImmediate {
+		c.raw |= 0x2000000
+		c.field("Rotate", uint32(n.Rotate), 8, 4)
+		c.raw |= uint32(n.Immediate)
+		return c.result()
+	}
+	c.register("Rm", n.Rm, 0)
+	return c.result()
 }
 
 // This includes both multiply and long multiply instructions
@@ -131,11 +300,16 @@ type MultiplyInstruction struct {
 	SetConditions  bool
 	Accumulate     bool
 	Signed         bool
+	// Set for the Thumb-2 mls instruction, which subtracts the product from
+	// Rn.
+	Subtract bool
 }
 
 func (n *MultiplyInstruction) String() string {
 	var start string
-	if n.Accumulate {
+	if n.Subtract {
+		start = "mls"
+	} else if n.Accumulate {
 		start = "mla"
 	} else {
 		start = "mul"
@@ -147,7 +321,7 @@ func (n *MultiplyInstruction) String() string {
 			start = "u" + start + "l"
 		}
 	}
-	start += n.condition.String()
+	start += n.Condition().String()
 	if n.SetConditions {
 		start += "s"
 	}
@@ -161,6 +335,34 @@ func (n *MultiplyInstruction) String() string {
 	return fmt.Sprintf("%s %s, %s, %s, %s", start, n.Rd, n.Rm, n.Rs, n.Rn)
 }
 
+func (n *MultiplyInstruction) Encode() (uint32, error) {
+	if n.thumb2 {
+		return n.encodeTHUMB2()
+	}
+	c := instructionEncoder{raw: 0x90}
+	c.condition(n.Condition())
+	if n.Subtract {
+		c.fail("mls can only be encoded as a Thumb-2 instruction")
+	}
+	c.flag(n.SetConditions, 0x100000)
+	c.flag(n.Accumulate, 0x200000)
+	c.register("Rs", n.Rs, 8)
+	c.register("Rm", n.Rm, 0)
+	if n.IsLongMultiply {
+		c.raw |= 0x800000
+		c.flag(n.Signed, 0x400000)
+		c.register("RdHigh", n.RdHigh, 16)
+		c.register("RdLow", n.RdLow, 12)
+		return c.result()
+	}
+	if n.Signed {
+		c.fail("Only long multiplies can be signed")
+	}
+	c.register("Rd", n.Rd, 16)
+	c.register("Rn", n.Rn, 12)
+	return c.result()
+}
+
 type SingleDataSwapInstruction struct {
 	basicARMInstruction
 	Rm           ARMRegister
@@ -171,20 +373,43 @@ type SingleDataSwapInstruction struct {
 
 func (n *SingleDataSwapInstruction) String() string {
 	start := "swp"
-	start += n.condition.String()
+	start += n.Condition().String()
 	if n.ByteQuantity {
 		start += "b"
 	}
 	return fmt.Sprintf("%s %s, %s, [%s]", start, n.Rd, n.Rm, n.Rn)
 }
 
+func (n *SingleDataSwapInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x01000090}
+	c.condition(n.Condition())
+	c.flag(n.ByteQuantity, 0x400000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
 type BranchExchangeInstruction struct {
 	basicARMInstruction
 	Rn ARMRegister
+	// This is set for the ARMv5TE blx instruction.
+	Link bool
 }
 
 func (n *BranchExchangeInstruction) String() string {
-	return fmt.Sprintf("bx%s %s", n.condition, n.Rn)
+	if n.Link {
+		return fmt.Sprintf("blx%s %s", n.Condition(), n.Rn)
+	}
+	return fmt.Sprintf("bx%s %s", n.Condition(), n.Rn)
+}
+
+func (n *BranchExchangeInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x012fff10}
+	c.condition(n.Condition())
+	c.flag(n.Link, 0x20)
+	c.register("Rn", n.Rn, 0)
+	return c.result()
 }
 
 type HalfwordDataTransferInstruction struct {
@@ -200,36 +425,44 @@ type HalfwordDataTransferInstruction struct {
 	WriteBack   bool
 	Up          bool
 	Preindex    bool
+	// This is set for the ARMv5TE ldrd and strd instructions, which transfer
+	// Rd and the following register.
+	Doubleword bool
 }
 
-func (n *HalfwordDataTransferInstruction) String() string {
+// Returns the mnemonic and destination register, ending with a comma.
+func (n *HalfwordDataTransferInstruction) prefix() string {
 	var start string
 	if n.Load {
 		start = "ldr"
 	} else {
 		start = "str"
 	}
-	start += n.condition.String()
+	start += n.Condition().String()
 	if n.Signed {
 		start += "s"
 	}
-	if n.Halfword {
+	if n.Doubleword {
+		start += "d"
+	} else if n.Halfword {
 		start += "h"
 	} else {
 		start += "b"
 	}
-	start += " " + n.Rd.String() + ","
+	return start + " " + n.Rd.String() + ","
+}
+
+func (n *HalfwordDataTransferInstruction) String() string {
+	start := n.prefix()
 	offset := int(n.Offset)
 	offsetReg := n.Rm.String()
-	if n.Rn == 15 {
-		offset += 8
-	}
 	if !n.Up {
 		offset = -offset
 		offsetReg = "-" + offsetReg
 	}
 	if n.IsImmediate && n.Preindex && !n.WriteBack && (n.Rn == 15) {
-		return fmt.Sprintf("%s %d", start, offset)
+		// PC-relative offsets are printed relative to the instruction.
+		return n.pcRelativeString(fmt.Sprintf("%d", offset+8))
 	}
 	if n.Preindex {
 		postfix := ""
@@ -250,6 +483,54 @@ func (n *HalfwordDataTransferInstruction) String() string {
 	return fmt.Sprintf("%s [%s], %s", start, n.Rn, offsetReg)
 }
 
+func (n *HalfwordDataTransferInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	if !n.IsImmediate || !n.Preindex || n.WriteBack || (n.Rn != 15) {
+		return 0, false
+	}
+	return addOffset(pc, uint32(n.Offset), n.Up), true
+}
+
+func (n *HalfwordDataTransferInstruction) pcRelativeString(
+	target string) string {
+	return n.prefix() + " " + target
+}
+
+func (n *HalfwordDataTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x90}
+	c.condition(n.Condition())
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.WriteBack, 0x200000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	if n.IsImmediate {
+		c.raw |= 0x400000
+		c.raw |= ((uint32(n.Offset) & 0xf0) << 4) | (uint32(n.Offset) & 0xf)
+	} else {
+		c.register("Rm", n.Rm, 0)
+	}
+	if n.Doubleword {
+		// ldrd and strd use the encoding of a signed store.
+		if n.Signed || n.Halfword {
+			c.fail("ldrd and strd can't be signed or use halfwords")
+		}
+		if (n.Rd & 1) != 0 {
+			c.fail("ldrd and strd require an even register")
+		}
+		c.raw |= 0x40
+		c.flag(!n.Load, 0x20)
+		return c.result()
+	}
+	if n.Signed && !n.Load {
+		c.fail("Signed halfword and byte transfers must be loads")
+	}
+	c.flag(n.Load, 0x100000)
+	c.flag(n.Signed, 0x40)
+	c.flag(n.Halfword, 0x20)
+	return c.result()
+}
+
 type SingleDataTransferInstruction struct {
 	basicARMInstruction
 	Rn              ARMRegister
@@ -265,41 +546,48 @@ type SingleDataTransferInstruction struct {
 	ImmediateOffset bool
 }
 
-func (n *SingleDataTransferInstruction) String() string {
+// Returns the mnemonic and destination register, ending with a comma.
+func (n *SingleDataTransferInstruction) prefix() string {
 	var start string
 	if n.Load {
 		start = "ldr"
 	} else {
 		start = "str"
 	}
-	start += n.condition.String()
+	start += n.Condition().String()
 	if n.ByteQuantity {
 		start += "b"
 	}
 	if !n.Preindex && n.WriteBack {
 		start += "t"
 	}
-	start += " " + n.Rd.String() + ","
+	return start + " " + n.Rd.String() + ","
+}
+
+func (n *SingleDataTransferInstruction) String() string {
+	start := n.prefix()
 	upString := ""
 	if !n.Up {
 		upString = "-"
 	}
 	shiftString := ""
-	if !n.ImmediateOffset && (n.Shift.Amount() != 0) {
+	if !n.ImmediateOffset && (n.Shift != nil) && (n.Shift.String() != "") {
 		shiftString = ", " + n.Shift.String()
 	}
 	offset := int(n.Offset)
-	if n.Rn == 15 {
-		offset += 8
-	}
 	if n.Preindex {
 		postfix := ""
 		if n.WriteBack {
 			postfix = "!"
 		}
 		if n.ImmediateOffset {
-			if (n.Rn == 15) && (offset != 0) {
-				return fmt.Sprintf("%s %s%d", start, upString, offset)
+			if (n.Rn == 15) && !n.WriteBack {
+				// PC-relative offsets are printed relative to the
+				// instruction.
+				if !n.Up {
+					offset = -offset
+				}
+				return n.pcRelativeString(fmt.Sprintf("%d", offset+8))
 			}
 			if offset == 0 {
 				return fmt.Sprintf("%s [%s]%s", start, n.Rn, postfix)
@@ -317,10 +605,52 @@ func (n *SingleDataTransferInstruction) String() string {
 		shiftString)
 }
 
+func (n *SingleDataTransferInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	if !n.ImmediateOffset || !n.Preindex || n.WriteBack || (n.Rn != 15) {
+		return 0, false
+	}
+	return addOffset(pc, uint32(n.Offset), n.Up), true
+}
+
+func (n *SingleDataTransferInstruction) pcRelativeString(
+	target string) string {
+	return n.prefix() + " " + target
+}
+
+func (n *SingleDataTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x04000000}
+	c.condition(n.Condition())
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.ByteQuantity, 0x400000)
+	c.flag(n.WriteBack, 0x200000)
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	if n.ImmediateOffset {
+		c.field("Offset", uint32(n.Offset), 0, 12)
+		return c.result()
+	}
+	if (n.Shift != nil) && n.Shift.UseRegister() {
+		c.fail("Single data transfers can't shift by a register")
+	}
+	c.raw |= 0x2000000
+	c.shift(n.Shift)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
 type UndefinedInstruction struct {
 	basicARMInstruction
 }
 
+// Undefined instructions have no fields, so this returns the raw value they
+// were parsed from.
+func (n *UndefinedInstruction) Encode() (uint32, error) {
+	return n.raw, nil
+}
+
 type BlockDataTransferInstruction struct {
 	basicARMInstruction
 	RegisterList uint16
@@ -370,16 +700,23 @@ func (n *BlockDataTransferInstruction) String() string {
 	} else {
 		start = "stm"
 	}
-	// The mnemonic postfix depends on the u and p bits and stack usage
+	// The mnemonic postfix depends on the u and p bits and stack usage. The
+	// stack names for stores are the reverse of those for loads.
 	if n.Rn == 13 {
-		if n.Up {
-			if n.Preindex {
+		up := n.Up
+		preindex := n.Preindex
+		if !n.Load {
+			up = !up
+			preindex = !preindex
+		}
+		if up {
+			if preindex {
 				start += "ed"
 			} else {
 				start += "fd"
 			}
 		} else {
-			if n.Preindex {
+			if preindex {
 				start += "ea"
 			} else {
 				start += "fa"
@@ -411,22 +748,84 @@ func (n *BlockDataTransferInstruction) String() string {
 	return start
 }
 
+func (n *BlockDataTransferInstruction) Encode() (uint32, error) {
+	if n.thumb2 {
+		return n.encodeTHUMB2()
+	}
+	c := instructionEncoder{raw: 0x08000000}
+	c.condition(n.Condition())
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.ForceUser, 0x400000)
+	c.flag(n.WriteBack, 0x200000)
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.raw |= uint32(n.RegisterList)
+	return c.result()
+}
+
 type BranchInstruction struct {
 	basicARMInstruction
 	Offset int32
 	Link   bool
+	// This is set for the ARMv5TE blx instruction, which always links and
+	// switches to THUMB mode. Its target may be halfword-aligned.
+	Exchange       bool
+	HalfwordOffset bool
+}
+
+// Returns the branch's offset from the address of the instruction + 8.
+func (n *BranchInstruction) offset() int32 {
+	// Sign extend and shift right by 2 bits...
+	offset := n.Offset << 8
+	offset = offset >> 6
+	if n.HalfwordOffset {
+		offset += 2
+	}
+	return offset
 }
 
 func (n *BranchInstruction) String() string {
+	return n.pcRelativeString(fmt.Sprintf("%d", n.offset()))
+}
+
+func (n *BranchInstruction) pcRelativeTarget(pc uint32) (uint32, bool) {
+	return pc + uint32(n.offset()), true
+}
+
+func (n *BranchInstruction) pcRelativeString(target string) string {
 	start := "b"
 	if n.Link {
 		start += "l"
 	}
-	start += n.condition.String()
-	// Sign extend and shift right by 2 bits...
-	offset := n.Offset << 8
-	offset = offset >> 6
-	return fmt.Sprintf("%s %d", start, offset)
+	if n.Exchange {
+		start += "x"
+	}
+	start += n.Condition().String()
+	return start + " " + target
+}
+
+// The 24-bit offset may either be given as it's stored in the instruction,
+// or as a negative number.
+func (n *BranchInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0a000000}
+	if (n.Offset < -0x800000) || (n.Offset > 0xffffff) {
+		c.fail("Branch offset 0x%x doesn't fit in 24 bits", n.Offset)
+	}
+	c.raw |= uint32(n.Offset) & 0xffffff
+	if n.Exchange {
+		// blx is always unconditional, and uses the link bit to hold the
+		// halfword of the target.
+		c.raw |= 0xf0000000
+		c.flag(n.HalfwordOffset, 0x1000000)
+		return c.result()
+	}
+	if n.HalfwordOffset {
+		c.fail("Only blx can branch to a halfword offset")
+	}
+	c.condition(n.Condition())
+	c.flag(n.Link, 0x1000000)
+	return c.result()
 }
 
 type CoprocDataTransferInstruction struct {
@@ -440,46 +839,90 @@ type CoprocDataTransferInstruction struct {
 	LongTransfer bool
 	Up           bool
 	Preindex     bool
+	// This is set for the unconditional ARMv5TE ldc2 and stc2 instructions.
+	Unconditional bool
 }
 
-func (n *CoprocDataTransferInstruction) String() string {
+// Returns the mnemonic, coprocessor and register, ending with a comma.
+func (n *CoprocDataTransferInstruction) prefix() string {
 	var start string
 	if n.Load {
 		start = "ldc"
 	} else {
 		start = "stc"
 	}
-	start += n.condition.String()
+	if n.Unconditional {
+		start += "2"
+	}
+	start += n.Condition().String()
 	if n.LongTransfer {
 		start += "l"
 	}
-	start += fmt.Sprintf(" p%d, c%d,", n.CoprocNumber, n.CoprocRd)
+	return start + fmt.Sprintf(" p%d, c%d,", n.CoprocNumber, n.CoprocRd)
+}
+
+func (n *CoprocDataTransferInstruction) String() string {
+	start := n.prefix()
 	offset := int(n.Offset) << 2
 	if !n.Up {
 		offset = -offset
 	}
-	if n.Rn == 15 {
-		offset += 8
-	}
 	if n.Preindex {
 		postfix := ""
 		if n.WriteBack {
 			postfix = "!"
 		}
 		if !n.WriteBack && (n.Rn == 15) {
-			return fmt.Sprintf("%s %d", start, offset)
+			return n.pcRelativeString(fmt.Sprintf("%d", offset+8))
 		}
 		if n.Offset == 0 {
 			return fmt.Sprintf("%s [%s]%s", start, n.Rn, postfix)
 		}
 		return fmt.Sprintf("%s [%s, %d]%s", start, n.Rn, offset, postfix)
 	}
-	if n.Offset == 0 {
-		return fmt.Sprintf("%s %s", start, n.Rn)
+	if !n.WriteBack {
+		// The unindexed form passes the offset field to the coprocessor.
+		return fmt.Sprintf("%s [%s], {%d}", start, n.Rn, n.Offset)
 	}
 	return fmt.Sprintf("%s [%s], %d", start, n.Rn, offset)
 }
 
+func (n *CoprocDataTransferInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	if !n.Preindex || n.WriteBack || (n.Rn != 15) {
+		return 0, false
+	}
+	return addOffset(pc, uint32(n.Offset)<<2, n.Up), true
+}
+
+func (n *CoprocDataTransferInstruction) pcRelativeString(
+	target string) string {
+	return n.prefix() + " " + target
+}
+
+func (n *CoprocDataTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0c000000}
+	if n.Unconditional {
+		c.raw |= 0xf0000000
+	} else {
+		c.condition(n.Condition())
+	}
+	if !n.Preindex && !n.Up && !n.WriteBack && n.LongTransfer {
+		// This is the encoding used by mcrr and mrrc.
+		c.fail("Invalid coprocessor data transfer addressing mode")
+	}
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.LongTransfer, 0x400000)
+	c.flag(n.WriteBack, 0x200000)
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.field("CoprocRd", uint32(n.CoprocRd), 12, 4)
+	c.field("CoprocNumber", uint32(n.CoprocNumber), 8, 4)
+	c.raw |= uint32(n.Offset)
+	return c.result()
+}
+
 type CoprocDataOperationInstruction struct {
 	basicARMInstruction
 	CoprocNumber uint8
@@ -488,14 +931,36 @@ type CoprocDataOperationInstruction struct {
 	CoprocRn     uint8
 	CoprocRd     uint8
 	CoprocRm     uint8
+	// This is set for the unconditional ARMv5TE cdp2 instruction.
+	Unconditional bool
 }
 
 func (n *CoprocDataOperationInstruction) String() string {
-	return fmt.Sprintf("cdp%s p%d, %d, c%d, c%d, c%d, %d", n.condition,
+	start := "cdp"
+	if n.Unconditional {
+		start += "2"
+	}
+	return fmt.Sprintf("%s%s p%d, %d, c%d, c%d, c%d, %d", start, n.Condition(),
 		n.CoprocNumber, n.CoprocOpcode, n.CoprocRd, n.CoprocRn, n.CoprocRm,
 		n.CoprocInfo)
 }
 
+func (n *CoprocDataOperationInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0e000000}
+	if n.Unconditional {
+		c.raw |= 0xf0000000
+	} else {
+		c.condition(n.Condition())
+	}
+	c.field("CoprocOpcode", uint32(n.CoprocOpcode), 20, 4)
+	c.field("CoprocRn", uint32(n.CoprocRn), 16, 4)
+	c.field("CoprocRd", uint32(n.CoprocRd), 12, 4)
+	c.field("CoprocNumber", uint32(n.CoprocNumber), 8, 4)
+	c.field("CoprocInfo", uint32(n.CoprocInfo), 5, 3)
+	c.field("CoprocRm", uint32(n.CoprocRm), 0, 4)
+	return c.result()
+}
+
 type CoprocRegisterTransferInstruction struct {
 	basicARMInstruction
 	Rd            ARMRegister
@@ -505,6 +970,8 @@ type CoprocRegisterTransferInstruction struct {
 	CoprocOperand uint8
 	CoprocRn      uint8
 	CoprocRm      uint8
+	// This is set for the unconditional ARMv5TE mcr2 and mrc2 instructions.
+	Unconditional bool
 }
 
 func (n *CoprocRegisterTransferInstruction) String() string {
@@ -514,18 +981,45 @@ func (n *CoprocRegisterTransferInstruction) String() string {
 	} else {
 		start = "mcr"
 	}
-	start += n.condition.String()
+	if n.Unconditional {
+		start += "2"
+	}
+	start += n.Condition().String()
 	return fmt.Sprintf("%s p%d, %d, %s, c%d, c%d, %d", start, n.CoprocNumber,
 		n.CoprocOpcode, n.Rd, n.CoprocRn, n.CoprocRm, n.CoprocOperand)
 }
 
+func (n *CoprocRegisterTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0e000010}
+	if n.Unconditional {
+		c.raw |= 0xf0000000
+	} else {
+		c.condition(n.Condition())
+	}
+	c.field("CoprocOpcode", uint32(n.CoprocOpcode), 21, 3)
+	c.flag(n.Load, 0x100000)
+	c.field("CoprocRn", uint32(n.CoprocRn), 16, 4)
+	c.register("Rd", n.Rd, 12)
+	c.field("CoprocNumber", uint32(n.CoprocNumber), 8, 4)
+	c.field("CoprocOperand", uint32(n.CoprocOperand), 5, 3)
+	c.field("CoprocRm", uint32(n.CoprocRm), 0, 4)
+	return c.result()
+}
+
 type SoftwareInterruptInstruction struct {
 	basicARMInstruction
 	Comment uint32
 }
 
 func (n *SoftwareInterruptInstruction) String() string {
-	return fmt.Sprintf("swi%s %08x", n.condition, n.Comment)
+	return fmt.Sprintf("swi%s %08x", n.Condition(), n.Comment)
+}
+
+func (n *SoftwareInterruptInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0f000000}
+	c.condition(n.Condition())
+	c.field("Comment", n.Comment, 0, 24)
+	return c.result()
 }
 
 func getCondition(raw uint32) ARMCondition {
@@ -535,7 +1029,7 @@ func getCondition(raw uint32) ARMCondition {
 func parseSoftwareInterruptInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn SoftwareInterruptInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.Comment = raw & 0x00ffffff
 	return &toReturn, nil
 }
@@ -544,7 +1038,7 @@ func parseCoprocRegisterTransferInstruction(raw uint32) (ARMInstruction,
 	error) {
 	var toReturn CoprocRegisterTransferInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
 	toReturn.Load = (raw & 0x100000) != 0
 	toReturn.CoprocNumber = uint8((raw >> 8) & 0xf)
@@ -558,7 +1052,7 @@ func parseCoprocRegisterTransferInstruction(raw uint32) (ARMInstruction,
 func parseCoprocDataOperationInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn CoprocDataOperationInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.CoprocNumber = uint8((raw >> 8) & 0xf)
 	toReturn.CoprocRm = uint8(raw & 0xf)
 	toReturn.CoprocRd = uint8((raw >> 12) & 0xf)
@@ -571,7 +1065,7 @@ func parseCoprocDataOperationInstruction(raw uint32) (ARMInstruction, error) {
 func parseCoprocDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn CoprocDataTransferInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
 	toReturn.Offset = uint8(raw & 0xff)
 	toReturn.CoprocNumber = uint8((raw >> 8) & 0xf)
@@ -587,7 +1081,7 @@ func parseCoprocDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 func parseBranchInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn BranchInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.Offset = int32(raw) & int32(0x00ffffff)
 	toReturn.Link = (raw & 0x1000000) != 0
 	return &toReturn, nil
@@ -596,7 +1090,7 @@ func parseBranchInstruction(raw uint32) (ARMInstruction, error) {
 func parseBlockDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn BlockDataTransferInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.RegisterList = uint16(raw & 0xffff)
 	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
 	toReturn.Load = (raw & 0x100000) != 0
@@ -610,14 +1104,14 @@ func parseBlockDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 func parseUndefinedInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn UndefinedInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	return &toReturn, fmt.Errorf("Undefined instruction")
 }
 
 func parseSingleDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn SingleDataTransferInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.ImmediateOffset = (raw & 0x2000000) == 0
 	if !toReturn.ImmediateOffset {
 		toReturn.Shift = NewARMShift(uint8((raw >> 4) & 0xff))
@@ -626,7 +1120,7 @@ func parseSingleDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 		if toReturn.Shift.UseRegister() {
 			var errorInstruction UndefinedInstruction
 			errorInstruction.raw = raw
-			errorInstruction.condition = toReturn.condition
+			errorInstruction.SetCondition(toReturn.Condition())
 			return &errorInstruction, fmt.Errorf("Illegal shift")
 		}
 		toReturn.Rm = ARMRegister(uint8(raw & 0xf))
@@ -646,7 +1140,7 @@ func parseSingleDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 func parseHalfwordDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn HalfwordDataTransferInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.IsImmediate = (raw & 0x400000) != 0
 	if toReturn.IsImmediate {
 		toReturn.Offset = uint8((raw & 0xf) | ((raw >> 4) & 0xf0))
@@ -667,7 +1161,7 @@ func parseHalfwordDataTransferInstruction(raw uint32) (ARMInstruction, error) {
 func parseBranchExchangeInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn BranchExchangeInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.Rn = ARMRegister(uint8(raw & 0xf))
 	return &toReturn, nil
 }
@@ -675,7 +1169,7 @@ func parseBranchExchangeInstruction(raw uint32) (ARMInstruction, error) {
 func parseSingleDataSwapInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn SingleDataSwapInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
 	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
 	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
@@ -686,7 +1180,7 @@ func parseSingleDataSwapInstruction(raw uint32) (ARMInstruction, error) {
 func parseMultiplyInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn MultiplyInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.IsLongMultiply = (raw & 0x800000) != 0
 	rm := uint8(raw & 0xf)
 	rs := uint8((raw >> 8) & 0xf)
@@ -726,18 +1220,22 @@ func parseMultiplyInstruction(raw uint32) (ARMInstruction, error) {
 func parsePSRTransferInstruction(raw uint32) (ARMInstruction, error) {
 	var toReturn PSRTransferInstruction
 	toReturn.raw = raw
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.UseCPSR = (raw & 0x400000) == 0
 	toReturn.WritePSR = (raw & 0x200000) != 0
 	if toReturn.WritePSR {
-		toReturn.Rm = ARMRegister(uint8(raw & 0xf))
-		toReturn.FlagsOnly = (raw & 0x10000) == 0
-		if toReturn.FlagsOnly {
-			toReturn.IsImmediate = (raw & 0x2000000) != 0
-			if toReturn.IsImmediate {
-				toReturn.Immediate = uint8(raw & 0xff)
-				toReturn.Rotate = uint8((raw >> 8) & 0xf)
-			}
+		toReturn.Mask = uint8((raw >> 16) & 0xf)
+		// msr with an empty mask is unpredictable, or a hint in ARMv6K.
+		if toReturn.Mask == 0 {
+			return parseUndefinedInstruction(raw)
+		}
+		toReturn.FlagsOnly = toReturn.Mask == 8
+		toReturn.IsImmediate = (raw & 0x2000000) != 0
+		if toReturn.IsImmediate {
+			toReturn.Immediate = uint8(raw & 0xff)
+			toReturn.Rotate = uint8((raw >> 8) & 0xf)
+		} else {
+			toReturn.Rm = ARMRegister(uint8(raw & 0xf))
 		}
 	} else {
 		toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
@@ -750,11 +1248,18 @@ func parseDataProcessingInstruction(raw uint32) (ARMInstruction, error) {
 	toReturn.raw = raw
 	toReturn.SetConditions = (raw & 0x100000) != 0
 	if !toReturn.SetConditions {
-		if (raw & 0x0d980000) == 0x01080000 {
-			return parsePSRTransferInstruction(raw)
+		// tst, teq, cmp and cmn without the S bit encode mrs and msr, or
+		// are undefined.
+		if (raw & 0x0d900000) == 0x01000000 {
+			if ((raw & 0x0fbf0fff) == 0x010f0000) ||
+				((raw & 0x0fb0fff0) == 0x0120f000) ||
+				((raw & 0x0fb0f000) == 0x0320f000) {
+				return parsePSRTransferInstruction(raw)
+			}
+			return parseUndefinedInstruction(raw)
 		}
 	}
-	toReturn.condition = getCondition(raw)
+	toReturn.SetCondition(getCondition(raw))
 	toReturn.IsImmediate = (raw & 0x2000000) != 0
 	if toReturn.IsImmediate {
 		toReturn.Immediate = uint8(raw & 0xff)
@@ -769,17 +1274,48 @@ func parseDataProcessingInstruction(raw uint32) (ARMInstruction, error) {
 	return &toReturn, nil
 }
 
+// Parses an instruction for the default architecture, ARMv6.
 func ParseInstruction(raw uint32) (ARMInstruction, error) {
+	return ParseInstructionForArchitecture(raw, defaultArchitecture)
+}
+
+// Parses an instruction for the given version of the architecture.
+func ParseInstructionForArchitecture(raw uint32,
+	architecture ARMArchitecture) (ARMInstruction, error) {
+	switch architecture {
+	case ARMv4T:
+		return parseARMv4TInstruction(raw)
+	case ARMv5TE:
+		return parseARMv5TEInstruction(raw)
+	case ARMv6, ARMv7:
+		return parseARMv6Instruction(raw)
+	case ARMv7M:
+		return nil, fmt.Errorf("ARMv7-M doesn't support ARM instructions")
+	}
+	return nil, fmt.Errorf("Unsupported architecture: %s", architecture)
+}
+
+func parseARMv4TInstruction(raw uint32) (ARMInstruction, error) {
 	if (raw & 0x08000000) != 0 {
 		if (raw & 0x04000000) != 0 {
+			vfp := (raw & 0xe00) == 0xa00
 			if (raw & 0x02000000) != 0 {
 				if (raw & 0x01000000) != 0 {
 					return parseSoftwareInterruptInstruction(raw)
 				} else if (raw & 0x10) != 0 {
+					if vfp {
+						return parseVFPRegisterTransferInstruction(raw)
+					}
 					return parseCoprocRegisterTransferInstruction(raw)
 				}
+				if vfp {
+					return parseVFPDataOperationInstruction(raw)
+				}
 				return parseCoprocDataOperationInstruction(raw)
 			}
+			if vfp {
+				return parseVFPDataTransferInstruction(raw)
+			}
 			return parseCoprocDataTransferInstruction(raw)
 		}
 		if (raw & 0x02000000) != 0 {
@@ -0,0 +1,1535 @@
+package arm_emulate
+
+// This file contains the decoder for the A64 instruction set, used by ARMv8
+// processors in the 64-bit AArch64 state. Instructions are printed using the
+// standard A64 assembly syntax, with branch targets given relative to the
+// instruction's address.
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+var a64ConditionStrings = [...]string{"eq", "ne", "hs", "lo", "mi", "pl", "vs",
+	"vc", "hi", "ls", "ge", "lt", "gt", "le", "al", "nv"}
+
+// An A64 instruction. Every A64 instruction is 32 bits long.
+type A64Instruction interface {
+	fmt.Stringer
+	Raw() uint32
+	Emulate(p A64Processor) error
+}
+
+type basicA64Instruction struct {
+	raw uint32
+}
+
+func (n *basicA64Instruction) Raw() uint32 {
+	return n.raw
+}
+
+func (n *basicA64Instruction) Emulate(p A64Processor) error {
+	return fmt.Errorf("Emulation not implemented for 0x%08x", n.raw)
+}
+
+func (n *basicA64Instruction) String() string {
+	return fmt.Sprintf("data: 0x%08x", n.raw)
+}
+
+// The number of an A64 general-purpose register. Depending on the instruction,
+// register 31 is either the stack pointer or the zero register.
+type A64Register uint8
+
+// Returns the register's name, as a 64-bit X register or a 32-bit W register.
+// If sp is false, register 31 is the zero register.
+func (r A64Register) name(is64, sp bool) string {
+	if r == 31 {
+		if sp {
+			if is64 {
+				return "sp"
+			}
+			return "wsp"
+		}
+		if is64 {
+			return "xzr"
+		}
+		return "wzr"
+	}
+	if is64 {
+		return fmt.Sprintf("x%d", r)
+	}
+	return fmt.Sprintf("w%d", r)
+}
+
+func (r A64Register) x() string {
+	return r.name(true, false)
+}
+
+func a64ConditionString(c ARMCondition) string {
+	return a64ConditionStrings[c&0xf]
+}
+
+func a64UndefinedError(raw uint32) error {
+	return fmt.Errorf("Undefined A64 instruction 0x%08x: %w", raw,
+		errUndefinedInstruction)
+}
+
+// Formats an immediate which the standard syntax prints in hexadecimal.
+func a64HexImmediate(v uint64) string {
+	if v == 0 {
+		return "#0"
+	}
+	return fmt.Sprintf("#0x%x", v)
+}
+
+var a64ShiftStrings = [...]string{"lsl", "lsr", "asr", "ror"}
+
+// Returns the ", <shift> #<amount>" suffix for a shifted register operand, or
+// an empty string if the register isn't shifted.
+func a64ShiftString(shiftType, amount uint8) string {
+	if (shiftType == 0) && (amount == 0) {
+		return ""
+	}
+	return fmt.Sprintf(", %s #%d", a64ShiftStrings[shiftType&3], amount)
+}
+
+// Decodes the N, immr and imms fields of a logical immediate into the value
+// they encode. Returns false if the fields don't encode a valid immediate.
+func decodeA64BitMask(n, immr, imms uint8, is64 bool) (uint64, bool) {
+	combined := (uint32(n&1) << 6) | uint32(^imms&0x3f)
+	length := bits.Len32(combined) - 1
+	if length < 1 {
+		return 0, false
+	}
+	if !is64 && (n != 0) {
+		return 0, false
+	}
+	size := uint(1) << uint(length)
+	levels := uint8(size - 1)
+	s := imms & levels
+	r := uint(immr & levels)
+	if s == levels {
+		return 0, false
+	}
+	element := (uint64(1) << (s + 1)) - 1
+	if r != 0 {
+		mask := uint64(0xffffffffffffffff)
+		if size < 64 {
+			mask = (uint64(1) << size) - 1
+		}
+		element = ((element >> r) | (element << (size - r))) & mask
+	}
+	for ; size < 64; size *= 2 {
+		element |= element << size
+	}
+	if !is64 {
+		element &= 0xffffffff
+	}
+	return element, true
+}
+
+// The adr and adrp instructions.
+type PCRelativeA64Instruction struct {
+	basicA64Instruction
+	Rd A64Register
+	// Set for adrp, which computes the address of a 4KB page.
+	Page bool
+	// The 21-bit immhi:immlo field.
+	Immediate uint32
+}
+
+// Returns the signed offset from the instruction's address, or from the start
+// of its page for adrp.
+func (n *PCRelativeA64Instruction) offset() int64 {
+	offset := int64(int32(n.Immediate<<11) >> 11)
+	if n.Page {
+		offset <<= 12
+	}
+	return offset
+}
+
+func (n *PCRelativeA64Instruction) String() string {
+	name := "adr"
+	if n.Page {
+		name = "adrp"
+	}
+	return fmt.Sprintf("%s %s, #%d", name, n.Rd.x(), n.offset())
+}
+
+// Add and subtract instructions with a 12-bit immediate.
+type AddSubtractImmediateA64Instruction struct {
+	basicA64Instruction
+	Is64      bool
+	Subtract  bool
+	SetFlags  bool
+	Rd        A64Register
+	Rn        A64Register
+	Immediate uint16
+	// If set, the immediate is shifted left by 12 bits.
+	Shift bool
+}
+
+func (n *AddSubtractImmediateA64Instruction) String() string {
+	rn := n.Rn.name(n.Is64, true)
+	immediate := fmt.Sprintf("#%d", n.Immediate)
+	if n.Shift {
+		immediate += ", lsl #12"
+	}
+	if n.SetFlags && (n.Rd == 31) {
+		name := "cmn"
+		if n.Subtract {
+			name = "cmp"
+		}
+		return fmt.Sprintf("%s %s, %s", name, rn, immediate)
+	}
+	rd := n.Rd.name(n.Is64, !n.SetFlags)
+	if !n.Subtract && !n.SetFlags && (n.Immediate == 0) && !n.Shift &&
+		((n.Rd == 31) || (n.Rn == 31)) {
+		return fmt.Sprintf("mov %s, %s", rd, rn)
+	}
+	name := "add"
+	if n.Subtract {
+		name = "sub"
+	}
+	if n.SetFlags {
+		name += "s"
+	}
+	return fmt.Sprintf("%s %s, %s, %s", name, rd, rn, immediate)
+}
+
+var a64LogicalStrings = [...]string{"and", "orr", "eor", "ands"}
+
+// The and, orr, eor and ands instructions with a bitmask immediate.
+type LogicalImmediateA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// 0 = and, 1 = orr, 2 = eor, 3 = ands
+	Opcode uint8
+	Rd     A64Register
+	Rn     A64Register
+	N      uint8
+	Immr   uint8
+	Imms   uint8
+}
+
+// Returns the value of the instruction's bitmask immediate.
+func (n *LogicalImmediateA64Instruction) Value() uint64 {
+	value, _ := decodeA64BitMask(n.N, n.Immr, n.Imms, n.Is64)
+	return value
+}
+
+// Returns true if the value could be loaded using a single movz or movn, in
+// which case an orr from the zero register isn't printed as mov.
+func a64MoveWidePossible(value uint64, is64 bool) bool {
+	width := uint(32)
+	if is64 {
+		width = 64
+	}
+	inverse := ^value
+	if !is64 {
+		inverse &= 0xffffffff
+	}
+	for shift := uint(0); shift < width; shift += 16 {
+		mask := ^(uint64(0xffff) << shift)
+		if ((value & mask) == 0) || ((inverse & mask) == 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *LogicalImmediateA64Instruction) String() string {
+	value := n.Value()
+	rn := n.Rn.name(n.Is64, false)
+	if (n.Opcode == 3) && (n.Rd == 31) {
+		return fmt.Sprintf("tst %s, %s", rn, a64HexImmediate(value))
+	}
+	rd := n.Rd.name(n.Is64, n.Opcode != 3)
+	if (n.Opcode == 1) && (n.Rn == 31) &&
+		!a64MoveWidePossible(value, n.Is64) {
+		if !n.Is64 {
+			return fmt.Sprintf("mov %s, #%d", rd, int32(value))
+		}
+		return fmt.Sprintf("mov %s, #%d", rd, int64(value))
+	}
+	return fmt.Sprintf("%s %s, %s, %s", a64LogicalStrings[n.Opcode&3], rd, rn,
+		a64HexImmediate(value))
+}
+
+// The movn, movz and movk instructions.
+type MoveWideA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// 0 = movn, 2 = movz, 3 = movk
+	Opcode    uint8
+	Rd        A64Register
+	Immediate uint16
+	// The hw field, which shifts the immediate left by 16 times this amount.
+	Halfword uint8
+}
+
+func (n *MoveWideA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, false)
+	shift := n.Halfword * 16
+	value := uint64(n.Immediate) << shift
+	alias := (n.Immediate != 0) || (shift == 0)
+	name := "movk"
+	switch n.Opcode {
+	case 0:
+		name = "movn"
+		value = ^value
+		if !n.Is64 && (n.Immediate == 0xffff) {
+			alias = false
+		}
+	case 2:
+		name = "movz"
+	default:
+		alias = false
+	}
+	if alias {
+		if !n.Is64 {
+			return fmt.Sprintf("mov %s, #%d", rd, int32(value))
+		}
+		return fmt.Sprintf("mov %s, #%d", rd, int64(value))
+	}
+	if shift == 0 {
+		return fmt.Sprintf("%s %s, #%d", name, rd, n.Immediate)
+	}
+	return fmt.Sprintf("%s %s, #%d, lsl #%d", name, rd, n.Immediate, shift)
+}
+
+// The sbfm, bfm and ubfm instructions, which implement shifts, extensions and
+// bitfield moves.
+type BitfieldA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// 0 = sbfm, 1 = bfm, 2 = ubfm
+	Opcode uint8
+	Rd     A64Register
+	Rn     A64Register
+	Immr   uint8
+	Imms   uint8
+}
+
+func (n *BitfieldA64Instruction) String() string {
+	size := uint8(32)
+	if n.Is64 {
+		size = 64
+	}
+	rd := n.Rd.name(n.Is64, false)
+	rn := n.Rn.name(n.Is64, false)
+	r, s := n.Immr, n.Imms
+	switch n.Opcode {
+	case 0:
+		if s == (size - 1) {
+			return fmt.Sprintf("asr %s, %s, #%d", rd, rn, r)
+		}
+		if r == 0 {
+			switch s {
+			case 7:
+				return fmt.Sprintf("sxtb %s, %s", rd, n.Rn.name(false, false))
+			case 15:
+				return fmt.Sprintf("sxth %s, %s", rd, n.Rn.name(false, false))
+			case 31:
+				return fmt.Sprintf("sxtw %s, %s", rd, n.Rn.name(false, false))
+			}
+		}
+	case 2:
+		if (s != (size - 1)) && ((s + 1) == r) {
+			return fmt.Sprintf("lsl %s, %s, #%d", rd, rn, size-1-s)
+		}
+		if s == (size - 1) {
+			return fmt.Sprintf("lsr %s, %s, #%d", rd, rn, r)
+		}
+		if !n.Is64 && (r == 0) && ((s == 7) || (s == 15)) {
+			name := "uxtb"
+			if s == 15 {
+				name = "uxth"
+			}
+			return fmt.Sprintf("%s %s, %s", name, rd, rn)
+		}
+	}
+	prefix := [...]string{"s", "", "u", ""}[n.Opcode&3]
+	if s < r {
+		name := prefix + "bfiz"
+		if n.Opcode == 1 {
+			name = "bfi"
+		}
+		return fmt.Sprintf("%s %s, %s, #%d, #%d", name, rd, rn, size-r, s+1)
+	}
+	name := prefix + "bfx"
+	if n.Opcode == 1 {
+		name = "bfxil"
+	}
+	return fmt.Sprintf("%s %s, %s, #%d, #%d", name, rd, rn, r, s-r+1)
+}
+
+// The extr instruction, which extracts a register from a pair of registers.
+type ExtractA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	Rd   A64Register
+	Rn   A64Register
+	Rm   A64Register
+	// The imms field, giving the lowest bit of Rn:Rm to extract.
+	LSB uint8
+}
+
+func (n *ExtractA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, false)
+	rn := n.Rn.name(n.Is64, false)
+	if n.Rn == n.Rm {
+		return fmt.Sprintf("ror %s, %s, #%d", rd, rn, n.LSB)
+	}
+	return fmt.Sprintf("extr %s, %s, %s, #%d", rd, rn,
+		n.Rm.name(n.Is64, false), n.LSB)
+}
+
+// The b and bl instructions.
+type BranchA64Instruction struct {
+	basicA64Instruction
+	Link bool
+	// The 26-bit offset, in words.
+	Offset uint32
+}
+
+// Returns the signed offset from the instruction's address, in bytes.
+func (n *BranchA64Instruction) offset() int64 {
+	return int64(int32(n.Offset<<6) >> 4)
+}
+
+func (n *BranchA64Instruction) String() string {
+	name := "b"
+	if n.Link {
+		name = "bl"
+	}
+	return fmt.Sprintf("%s #%d", name, n.offset())
+}
+
+// The b.cond instruction.
+type ConditionalBranchA64Instruction struct {
+	basicA64Instruction
+	Condition ARMCondition
+	// The 19-bit offset, in words.
+	Offset uint32
+}
+
+func (n *ConditionalBranchA64Instruction) offset() int64 {
+	return int64(int32(n.Offset<<13) >> 11)
+}
+
+func (n *ConditionalBranchA64Instruction) String() string {
+	return fmt.Sprintf("b.%s #%d", a64ConditionString(n.Condition),
+		n.offset())
+}
+
+// The cbz and cbnz instructions.
+type CompareBranchA64Instruction struct {
+	basicA64Instruction
+	Is64    bool
+	NonZero bool
+	Rt      A64Register
+	// The 19-bit offset, in words.
+	Offset uint32
+}
+
+func (n *CompareBranchA64Instruction) offset() int64 {
+	return int64(int32(n.Offset<<13) >> 11)
+}
+
+func (n *CompareBranchA64Instruction) String() string {
+	name := "cbz"
+	if n.NonZero {
+		name = "cbnz"
+	}
+	return fmt.Sprintf("%s %s, #%d", name, n.Rt.name(n.Is64, false),
+		n.offset())
+}
+
+// The tbz and tbnz instructions.
+type TestBranchA64Instruction struct {
+	basicA64Instruction
+	NonZero bool
+	Rt      A64Register
+	// The number of the bit to test, from the b5:b40 fields.
+	Bit uint8
+	// The 14-bit offset, in words.
+	Offset uint16
+}
+
+func (n *TestBranchA64Instruction) offset() int64 {
+	return int64(int16(n.Offset << 2))
+}
+
+func (n *TestBranchA64Instruction) String() string {
+	name := "tbz"
+	if n.NonZero {
+		name = "tbnz"
+	}
+	return fmt.Sprintf("%s %s, #%d, #%d", name, n.Rt.name(n.Bit >= 32, false),
+		n.Bit, n.offset())
+}
+
+// The br, blr, ret, eret and drps instructions.
+type BranchRegisterA64Instruction struct {
+	basicA64Instruction
+	// 0 = br, 1 = blr, 2 = ret, 4 = eret, 5 = drps
+	Opcode uint8
+	Rn     A64Register
+}
+
+func (n *BranchRegisterA64Instruction) String() string {
+	switch n.Opcode {
+	case 0:
+		return "br " + n.Rn.x()
+	case 1:
+		return "blr " + n.Rn.x()
+	case 2:
+		if n.Rn == 30 {
+			return "ret"
+		}
+		return "ret " + n.Rn.x()
+	case 4:
+		return "eret"
+	}
+	return "drps"
+}
+
+// Instructions which generate exceptions, such as svc and brk.
+type ExceptionA64Instruction struct {
+	basicA64Instruction
+	// The opc field, from bits 21-23.
+	Opcode uint8
+	// The LL field, from bits 0-1.
+	Level     uint8
+	Immediate uint16
+}
+
+func (n *ExceptionA64Instruction) String() string {
+	immediate := a64HexImmediate(uint64(n.Immediate))
+	switch n.Opcode {
+	case 0:
+		name := [...]string{"", "svc", "hvc", "smc"}[n.Level&3]
+		return fmt.Sprintf("%s %s", name, immediate)
+	case 1:
+		return "brk " + immediate
+	case 2:
+		return "hlt " + immediate
+	}
+	name := fmt.Sprintf("dcps%d", n.Level)
+	if n.Immediate == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s %s", name, immediate)
+}
+
+var a64HintStrings = [...]string{"nop", "yield", "wfe", "wfi", "sev", "sevl"}
+
+// The hint instructions, including nop, wfi and yield.
+type HintA64Instruction struct {
+	basicA64Instruction
+	// The CRm:op2 field.
+	Hint uint8
+}
+
+func (n *HintA64Instruction) String() string {
+	if int(n.Hint) < len(a64HintStrings) {
+		return a64HintStrings[n.Hint]
+	}
+	return fmt.Sprintf("hint #%d", n.Hint)
+}
+
+var a64BarrierOptions = [...]string{"", "oshld", "oshst", "osh", "", "nshld",
+	"nshst", "nsh", "", "ishld", "ishst", "ish", "", "ld", "st", "sy"}
+
+// The clrex, dsb, dmb and isb instructions.
+type BarrierA64Instruction struct {
+	basicA64Instruction
+	// 2 = clrex, 4 = dsb, 5 = dmb, 6 = isb
+	Opcode uint8
+	// The CRm field, which holds the barrier's option.
+	Option uint8
+}
+
+func (n *BarrierA64Instruction) String() string {
+	name := [...]string{"", "", "clrex", "", "dsb", "dmb", "isb",
+		""}[n.Opcode&7]
+	if (n.Opcode == 4) || (n.Opcode == 5) {
+		option := a64BarrierOptions[n.Option&15]
+		if option != "" {
+			return fmt.Sprintf("%s %s", name, option)
+		}
+	} else if n.Option == 15 {
+		return name
+	}
+	return fmt.Sprintf("%s #%d", name, n.Option)
+}
+
+// The msr instruction which writes an immediate to a PSTATE field, such as
+// DAIFSet.
+type ProcessorStateA64Instruction struct {
+	basicA64Instruction
+	Op1       uint8
+	Op2       uint8
+	Immediate uint8
+}
+
+func (n *ProcessorStateA64Instruction) String() string {
+	var field string
+	switch (n.Op1 << 3) | n.Op2 {
+	case 0x05:
+		field = "SPSel"
+	case 0x1e:
+		field = "DAIFSet"
+	case 0x1f:
+		field = "DAIFClr"
+	default:
+		field = fmt.Sprintf("S0_%d_C4_C%d_%d", n.Op1, n.Immediate, n.Op2)
+		return fmt.Sprintf("msr %s, xzr", field)
+	}
+	return fmt.Sprintf("msr %s, #%d", field, n.Immediate)
+}
+
+// A system register, in the op0:op1:CRn:CRm:op2 form used by mrs and msr.
+type A64SystemRegister uint16
+
+type a64SystemRegisterInfo struct {
+	name     string
+	readOnly bool
+}
+
+var a64SystemRegisters = map[A64SystemRegister]a64SystemRegisterInfo{
+	0xc000: {"MIDR_EL1", true},
+	0xc005: {"MPIDR_EL1", true},
+	0xc020: {"ID_AA64PFR0_EL1", true},
+	0xc030: {"ID_AA64ISAR0_EL1", true},
+	0xc038: {"ID_AA64MMFR0_EL1", true},
+	0xc080: {"SCTLR_EL1", false},
+	0xc082: {"CPACR_EL1", false},
+	0xc100: {"TTBR0_EL1", false},
+	0xc101: {"TTBR1_EL1", false},
+	0xc102: {"TCR_EL1", false},
+	0xc200: {"SPSR_EL1", false},
+	0xc201: {"ELR_EL1", false},
+	0xc208: {"SP_EL0", false},
+	0xc210: {"SPSel", false},
+	0xc212: {"CurrentEL", true},
+	0xc290: {"ESR_EL1", false},
+	0xc300: {"FAR_EL1", false},
+	0xc510: {"MAIR_EL1", false},
+	0xc600: {"VBAR_EL1", false},
+	0xc681: {"CONTEXTIDR_EL1", false},
+	0xc684: {"TPIDR_EL1", false},
+	0xc708: {"CNTKCTL_EL1", false},
+	0xd801: {"CTR_EL0", true},
+	0xd807: {"DCZID_EL0", true},
+	0xda10: {"NZCV", false},
+	0xda11: {"DAIF", false},
+	0xda20: {"FPCR", false},
+	0xda21: {"FPSR", false},
+	0xdce8: {"PMCCNTR_EL0", false},
+	0xde82: {"TPIDR_EL0", false},
+	0xde83: {"TPIDRRO_EL0", false},
+	0xdf00: {"CNTFRQ_EL0", false},
+	0xdf01: {"CNTPCT_EL0", true},
+	0xdf02: {"CNTVCT_EL0", true},
+	0xdf19: {"CNTV_CTL_EL0", false},
+	0xdf1a: {"CNTV_CVAL_EL0", false},
+}
+
+// Returns the register's name when accessed using mrs, or using msr if write
+// is set. Registers without a name use the generic S<op0>_<op1>_C<n>_C<m>_<op2>
+// form.
+func (r A64SystemRegister) name(write bool) string {
+	info, ok := a64SystemRegisters[r]
+	if ok && !(write && info.readOnly) {
+		return info.name
+	}
+	return fmt.Sprintf("S%d_%d_C%d_C%d_%d", 2|((r>>14)&1), (r>>11)&7,
+		(r>>7)&15, (r>>3)&15, r&7)
+}
+
+func (r A64SystemRegister) String() string {
+	return r.name(false)
+}
+
+// The mrs and msr instructions, which read or write system registers.
+type SystemRegisterA64Instruction struct {
+	basicA64Instruction
+	Read     bool
+	Register A64SystemRegister
+	Rt       A64Register
+}
+
+func (n *SystemRegisterA64Instruction) String() string {
+	if n.Read {
+		return fmt.Sprintf("mrs %s, %s", n.Rt.x(), n.Register.name(false))
+	}
+	return fmt.Sprintf("msr %s, %s", n.Register.name(true), n.Rt.x())
+}
+
+type a64SystemOperation struct {
+	name string
+	// Set if the operation takes a register operand.
+	register bool
+}
+
+// The aliases of the sys instruction for cache, TLB and address translation
+// operations, indexed by op1:CRn:CRm:op2.
+var a64SystemOperations = map[uint16]a64SystemOperation{
+	0x0388: {"ic ialluis", false},
+	0x03a8: {"ic iallu", false},
+	0x03b1: {"dc ivac", true},
+	0x03b2: {"dc isw", true},
+	0x03c0: {"at s1e1r", true},
+	0x03c1: {"at s1e1w", true},
+	0x03c2: {"at s1e0r", true},
+	0x03c3: {"at s1e0w", true},
+	0x03d2: {"dc csw", true},
+	0x03f2: {"dc cisw", true},
+	0x0418: {"tlbi vmalle1is", false},
+	0x0419: {"tlbi vae1is", true},
+	0x041a: {"tlbi aside1is", true},
+	0x041b: {"tlbi vaae1is", true},
+	0x041d: {"tlbi vale1is", true},
+	0x041f: {"tlbi vaale1is", true},
+	0x0438: {"tlbi vmalle1", false},
+	0x0439: {"tlbi vae1", true},
+	0x043a: {"tlbi aside1", true},
+	0x043b: {"tlbi vaae1", true},
+	0x043d: {"tlbi vale1", true},
+	0x043f: {"tlbi vaale1", true},
+	0x1ba1: {"dc zva", true},
+	0x1ba9: {"ic ivau", true},
+	0x1bd1: {"dc cvac", true},
+	0x1bd9: {"dc cvau", true},
+	0x1bf1: {"dc civac", true},
+}
+
+// The sys and sysl instructions, including the dc, ic, tlbi and at aliases.
+type SystemA64Instruction struct {
+	basicA64Instruction
+	Read bool
+	Op1  uint8
+	CRn  uint8
+	CRm  uint8
+	Op2  uint8
+	Rt   A64Register
+}
+
+func (n *SystemA64Instruction) String() string {
+	if n.Read {
+		return fmt.Sprintf("sysl %s, #%d, c%d, c%d, #%d", n.Rt.x(), n.Op1,
+			n.CRn, n.CRm, n.Op2)
+	}
+	index := (uint16(n.Op1) << 11) | (uint16(n.CRn) << 7) |
+		(uint16(n.CRm) << 3) | uint16(n.Op2)
+	operation, ok := a64SystemOperations[index]
+	if ok && operation.register {
+		return fmt.Sprintf("%s, %s", operation.name, n.Rt.x())
+	}
+	if ok && (n.Rt == 31) {
+		return operation.name
+	}
+	s := fmt.Sprintf("sys #%d, c%d, c%d, #%d", n.Op1, n.CRn, n.CRm, n.Op2)
+	if n.Rt != 31 {
+		s += ", " + n.Rt.x()
+	}
+	return s
+}
+
+// Logical instructions with a shifted register operand.
+type LogicalRegisterA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// 0 = and, 1 = orr, 2 = eor, 3 = ands
+	Opcode uint8
+	// If set, Rm is inverted, making these bic, orn, eon and bics.
+	Invert      bool
+	Rd          A64Register
+	Rn          A64Register
+	Rm          A64Register
+	ShiftType   uint8
+	ShiftAmount uint8
+}
+
+func (n *LogicalRegisterA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, false)
+	rn := n.Rn.name(n.Is64, false)
+	rm := n.Rm.name(n.Is64, false) + a64ShiftString(n.ShiftType,
+		n.ShiftAmount)
+	switch {
+	case (n.Opcode == 1) && (n.Rn == 31):
+		if n.Invert {
+			return fmt.Sprintf("mvn %s, %s", rd, rm)
+		}
+		if (n.ShiftType == 0) && (n.ShiftAmount == 0) {
+			return fmt.Sprintf("mov %s, %s", rd, rm)
+		}
+	case (n.Opcode == 3) && (n.Rd == 31) && !n.Invert:
+		return fmt.Sprintf("tst %s, %s", rn, rm)
+	}
+	name := a64LogicalStrings[n.Opcode&3]
+	if n.Invert {
+		name = [...]string{"bic", "orn", "eon", "bics"}[n.Opcode&3]
+	}
+	return fmt.Sprintf("%s %s, %s, %s", name, rd, rn, rm)
+}
+
+func a64AddSubtractName(subtract, setFlags bool) string {
+	name := "add"
+	if subtract {
+		name = "sub"
+	}
+	if setFlags {
+		name += "s"
+	}
+	return name
+}
+
+// Add and subtract instructions with a shifted register operand.
+type AddSubtractRegisterA64Instruction struct {
+	basicA64Instruction
+	Is64        bool
+	Subtract    bool
+	SetFlags    bool
+	Rd          A64Register
+	Rn          A64Register
+	Rm          A64Register
+	ShiftType   uint8
+	ShiftAmount uint8
+}
+
+func (n *AddSubtractRegisterA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, false)
+	rn := n.Rn.name(n.Is64, false)
+	rm := n.Rm.name(n.Is64, false) + a64ShiftString(n.ShiftType,
+		n.ShiftAmount)
+	if n.SetFlags && (n.Rd == 31) {
+		name := "cmn"
+		if n.Subtract {
+			name = "cmp"
+		}
+		return fmt.Sprintf("%s %s, %s", name, rn, rm)
+	}
+	if n.Subtract && (n.Rn == 31) {
+		name := "neg"
+		if n.SetFlags {
+			name = "negs"
+		}
+		return fmt.Sprintf("%s %s, %s", name, rd, rm)
+	}
+	return fmt.Sprintf("%s %s, %s, %s", a64AddSubtractName(n.Subtract,
+		n.SetFlags), rd, rn, rm)
+}
+
+var a64ExtendStrings = [...]string{"uxtb", "uxth", "uxtw", "uxtx", "sxtb",
+	"sxth", "sxtw", "sxtx"}
+
+// Add and subtract instructions with an extended register operand.
+type AddSubtractExtendedA64Instruction struct {
+	basicA64Instruction
+	Is64     bool
+	Subtract bool
+	SetFlags bool
+	Rd       A64Register
+	Rn       A64Register
+	Rm       A64Register
+	// The option field, selecting the extension applied to Rm.
+	Extend uint8
+	// The amount Rm is shifted left after extension, from 0 to 4.
+	Shift uint8
+}
+
+func (n *AddSubtractExtendedA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, !n.SetFlags)
+	rn := n.Rn.name(n.Is64, true)
+	rm := n.Rm.name(n.Is64 && ((n.Extend&3) == 3), false)
+	extend := a64ExtendStrings[n.Extend&7]
+	// When used with the stack pointer, extending by the register's own width
+	// is written as lsl.
+	usesSP := (!n.SetFlags && (n.Rd == 31)) || (n.Rn == 31)
+	lslExtend := uint8(2)
+	if n.Is64 {
+		lslExtend = 3
+	}
+	if usesSP && (n.Extend == lslExtend) {
+		extend = ""
+		if n.Shift != 0 {
+			extend = "lsl"
+		}
+	}
+	if extend != "" {
+		rm += ", " + extend
+		if n.Shift != 0 {
+			rm += fmt.Sprintf(" #%d", n.Shift)
+		}
+	}
+	if n.SetFlags && (n.Rd == 31) {
+		name := "cmn"
+		if n.Subtract {
+			name = "cmp"
+		}
+		return fmt.Sprintf("%s %s, %s", name, rn, rm)
+	}
+	return fmt.Sprintf("%s %s, %s, %s", a64AddSubtractName(n.Subtract,
+		n.SetFlags), rd, rn, rm)
+}
+
+// The adc, adcs, sbc and sbcs instructions.
+type AddSubtractCarryA64Instruction struct {
+	basicA64Instruction
+	Is64     bool
+	Subtract bool
+	SetFlags bool
+	Rd       A64Register
+	Rn       A64Register
+	Rm       A64Register
+}
+
+func (n *AddSubtractCarryA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, false)
+	rm := n.Rm.name(n.Is64, false)
+	suffix := ""
+	if n.SetFlags {
+		suffix = "s"
+	}
+	if n.Subtract && (n.Rn == 31) {
+		return fmt.Sprintf("ngc%s %s, %s", suffix, rd, rm)
+	}
+	name := "adc"
+	if n.Subtract {
+		name = "sbc"
+	}
+	return fmt.Sprintf("%s%s %s, %s, %s", name, suffix, rd,
+		n.Rn.name(n.Is64, false), rm)
+}
+
+// The ccmp and ccmn instructions.
+type ConditionalCompareA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// Set for ccmn, which compares Rn with the negated operand.
+	Negative    bool
+	IsImmediate bool
+	Rn          A64Register
+	// Either the number of Rm, or a 5-bit immediate.
+	Operand   uint8
+	Condition ARMCondition
+	// The flags set if the condition isn't met.
+	Flags uint8
+}
+
+func (n *ConditionalCompareA64Instruction) String() string {
+	name := "ccmp"
+	if n.Negative {
+		name = "ccmn"
+	}
+	operand := fmt.Sprintf("#%d", n.Operand)
+	if !n.IsImmediate {
+		operand = A64Register(n.Operand).name(n.Is64, false)
+	}
+	return fmt.Sprintf("%s %s, %s, #%d, %s", name, n.Rn.name(n.Is64, false),
+		operand, n.Flags, a64ConditionString(n.Condition))
+}
+
+// The csel, csinc, csinv and csneg instructions.
+type ConditionalSelectA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// 0 = csel, 1 = csinc, 2 = csinv, 3 = csneg
+	Opcode    uint8
+	Rd        A64Register
+	Rn        A64Register
+	Rm        A64Register
+	Condition ARMCondition
+}
+
+func (n *ConditionalSelectA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, false)
+	rn := n.Rn.name(n.Is64, false)
+	if (n.Opcode != 0) && (n.Rn == n.Rm) && ((n.Condition & 0xe) != 0xe) {
+		inverse := a64ConditionString(n.Condition ^ 1)
+		if (n.Rn == 31) && (n.Opcode != 3) {
+			name := "cset"
+			if n.Opcode == 2 {
+				name = "csetm"
+			}
+			return fmt.Sprintf("%s %s, %s", name, rd, inverse)
+		}
+		name := [...]string{"", "cinc", "cinv", "cneg"}[n.Opcode&3]
+		return fmt.Sprintf("%s %s, %s, %s", name, rd, rn, inverse)
+	}
+	name := [...]string{"csel", "csinc", "csinv", "csneg"}[n.Opcode&3]
+	return fmt.Sprintf("%s %s, %s, %s, %s", name, rd, rn,
+		n.Rm.name(n.Is64, false), a64ConditionString(n.Condition))
+}
+
+// Data processing instructions with one source register, such as clz.
+type DataProcessing1SourceA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// 0 = rbit, 1 = rev16, 2 = rev32 (rev for 32-bit registers), 3 = rev,
+	// 4 = clz, 5 = cls
+	Opcode uint8
+	Rd     A64Register
+	Rn     A64Register
+}
+
+func (n *DataProcessing1SourceA64Instruction) String() string {
+	name := [...]string{"rbit", "rev16", "rev32", "rev", "clz", "cls", "",
+		""}[n.Opcode&7]
+	if !n.Is64 && (n.Opcode == 2) {
+		name = "rev"
+	}
+	return fmt.Sprintf("%s %s, %s", name, n.Rd.name(n.Is64, false),
+		n.Rn.name(n.Is64, false))
+}
+
+// Data processing instructions with two source registers, such as udiv and
+// the variable shifts.
+type DataProcessing2SourceA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// The opcode field, from bits 10-15.
+	Opcode uint8
+	Rd     A64Register
+	Rn     A64Register
+	Rm     A64Register
+}
+
+func (n *DataProcessing2SourceA64Instruction) String() string {
+	if n.Opcode >= 16 {
+		name := "crc32"
+		if (n.Opcode & 4) != 0 {
+			name += "c"
+		}
+		name += [...]string{"b", "h", "w", "x"}[n.Opcode&3]
+		return fmt.Sprintf("%s %s, %s, %s", name, n.Rd.name(false, false),
+			n.Rn.name(false, false), n.Rm.name(n.Is64, false))
+	}
+	name := [...]string{"", "", "udiv", "sdiv", "", "", "", "", "lsl", "lsr",
+		"asr", "ror", "", "", "", ""}[n.Opcode&15]
+	return fmt.Sprintf("%s %s, %s, %s", name, n.Rd.name(n.Is64, false),
+		n.Rn.name(n.Is64, false), n.Rm.name(n.Is64, false))
+}
+
+// Multiply instructions with three source registers, such as madd and umulh.
+type DataProcessing3SourceA64Instruction struct {
+	basicA64Instruction
+	Is64 bool
+	// The op31 field, from bits 21-23.
+	Opcode uint8
+	// The o0 bit, which is set for the subtracting forms.
+	Subtract bool
+	Rd       A64Register
+	Rn       A64Register
+	Rm       A64Register
+	Ra       A64Register
+}
+
+func (n *DataProcessing3SourceA64Instruction) String() string {
+	rd := n.Rd.name(n.Is64, false)
+	switch n.Opcode {
+	case 2, 6:
+		name := "smulh"
+		if n.Opcode == 6 {
+			name = "umulh"
+		}
+		return fmt.Sprintf("%s %s, %s, %s", name, rd, n.Rn.x(), n.Rm.x())
+	}
+	// The widening multiplies take 32-bit sources.
+	wide := n.Opcode == 0
+	rn := n.Rn.name(n.Is64 && wide, false)
+	rm := n.Rm.name(n.Is64 && wide, false)
+	prefix := ""
+	if n.Opcode == 1 {
+		prefix = "s"
+	} else if n.Opcode == 5 {
+		prefix = "u"
+	}
+	suffix := ""
+	if !wide {
+		suffix = "l"
+	}
+	if n.Ra == 31 {
+		name := "mul"
+		if n.Subtract {
+			name = "mneg"
+		}
+		return fmt.Sprintf("%s%s%s %s, %s, %s", prefix, name, suffix, rd, rn,
+			rm)
+	}
+	name := "madd"
+	if n.Subtract {
+		name = "msub"
+	}
+	return fmt.Sprintf("%s%s%s %s, %s, %s, %s", prefix, name, suffix, rd, rn,
+		rm, n.Ra.name(n.Is64, false))
+}
+
+func parsePCRelativeA64Instruction(raw uint32) (A64Instruction, error) {
+	var n PCRelativeA64Instruction
+	n.raw = raw
+	n.Rd = A64Register(raw & 0x1f)
+	n.Page = (raw & 0x80000000) != 0
+	n.Immediate = (((raw >> 5) & 0x7ffff) << 2) | ((raw >> 29) & 3)
+	return &n, nil
+}
+
+func parseAddSubtractImmediateA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	if (raw & 0x00800000) != 0 {
+		return nil, a64UndefinedError(raw)
+	}
+	var n AddSubtractImmediateA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Subtract = (raw & 0x40000000) != 0
+	n.SetFlags = (raw & 0x20000000) != 0
+	n.Shift = (raw & 0x00400000) != 0
+	n.Immediate = uint16((raw >> 10) & 0xfff)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	return &n, nil
+}
+
+func parseLogicalImmediateA64Instruction(raw uint32) (A64Instruction, error) {
+	var n LogicalImmediateA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Opcode = uint8((raw >> 29) & 3)
+	n.N = uint8((raw >> 22) & 1)
+	n.Immr = uint8((raw >> 16) & 0x3f)
+	n.Imms = uint8((raw >> 10) & 0x3f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	_, valid := decodeA64BitMask(n.N, n.Immr, n.Imms, n.Is64)
+	if !valid {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseMoveWideA64Instruction(raw uint32) (A64Instruction, error) {
+	var n MoveWideA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Opcode = uint8((raw >> 29) & 3)
+	n.Halfword = uint8((raw >> 21) & 3)
+	if (n.Opcode == 1) || (!n.Is64 && (n.Halfword >= 2)) {
+		return nil, a64UndefinedError(raw)
+	}
+	n.Immediate = uint16(raw >> 5)
+	n.Rd = A64Register(raw & 0x1f)
+	return &n, nil
+}
+
+func parseBitfieldA64Instruction(raw uint32) (A64Instruction, error) {
+	var n BitfieldA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Opcode = uint8((raw >> 29) & 3)
+	n.Immr = uint8((raw >> 16) & 0x3f)
+	n.Imms = uint8((raw >> 10) & 0x3f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	// The N bit must match sf, and 32-bit forms can't use bit 5 of immr or
+	// imms.
+	if (n.Opcode == 3) || (n.Is64 != ((raw & 0x00400000) != 0)) ||
+		(!n.Is64 && (((n.Immr | n.Imms) & 0x20) != 0)) {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseExtractA64Instruction(raw uint32) (A64Instruction, error) {
+	var n ExtractA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.LSB = uint8((raw >> 10) & 0x3f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	if ((raw & 0x60200000) != 0) || (n.Is64 != ((raw & 0x00400000) != 0)) ||
+		(!n.Is64 && (n.LSB >= 32)) {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+// Parses the data processing instructions with immediate operands.
+func parseDataProcessingImmediateA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	switch (raw >> 23) & 7 {
+	case 0, 1:
+		return parsePCRelativeA64Instruction(raw)
+	case 2:
+		return parseAddSubtractImmediateA64Instruction(raw)
+	case 4:
+		return parseLogicalImmediateA64Instruction(raw)
+	case 5:
+		return parseMoveWideA64Instruction(raw)
+	case 6:
+		return parseBitfieldA64Instruction(raw)
+	case 7:
+		return parseExtractA64Instruction(raw)
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+func parseExceptionA64Instruction(raw uint32) (A64Instruction, error) {
+	var n ExceptionA64Instruction
+	n.raw = raw
+	n.Opcode = uint8((raw >> 21) & 7)
+	n.Level = uint8(raw & 3)
+	n.Immediate = uint16(raw >> 5)
+	if (raw & 0x1c) != 0 {
+		return nil, a64UndefinedError(raw)
+	}
+	switch n.Opcode {
+	case 0:
+		if n.Level != 0 {
+			return &n, nil
+		}
+	case 1, 2:
+		if n.Level == 0 {
+			return &n, nil
+		}
+	case 5:
+		if n.Level != 0 {
+			return &n, nil
+		}
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+func parseSystemA64Instruction(raw uint32) (A64Instruction, error) {
+	read := (raw & 0x00200000) != 0
+	op0 := uint8((raw >> 19) & 3)
+	op1 := uint8((raw >> 16) & 7)
+	crn := uint8((raw >> 12) & 15)
+	crm := uint8((raw >> 8) & 15)
+	op2 := uint8((raw >> 5) & 7)
+	rt := A64Register(raw & 0x1f)
+	switch op0 {
+	case 0:
+		if read || (rt != 31) {
+			break
+		}
+		if crn == 4 {
+			if ((op1 == 0) && (op2 == 5)) || ((op1 == 3) && (op2 >= 6)) {
+				var n ProcessorStateA64Instruction
+				n.raw = raw
+				n.Op1 = op1
+				n.Op2 = op2
+				n.Immediate = crm
+				return &n, nil
+			}
+			break
+		}
+		if op1 != 3 {
+			break
+		}
+		if crn == 2 {
+			var n HintA64Instruction
+			n.raw = raw
+			n.Hint = (crm << 3) | op2
+			return &n, nil
+		}
+		if (crn == 3) && ((op2 == 2) || ((op2 >= 4) && (op2 <= 6))) {
+			var n BarrierA64Instruction
+			n.raw = raw
+			n.Opcode = op2
+			n.Option = crm
+			return &n, nil
+		}
+	case 1:
+		var n SystemA64Instruction
+		n.raw = raw
+		n.Read = read
+		n.Op1 = op1
+		n.CRn = crn
+		n.CRm = crm
+		n.Op2 = op2
+		n.Rt = rt
+		return &n, nil
+	default:
+		var n SystemRegisterA64Instruction
+		n.raw = raw
+		n.Read = read
+		n.Register = A64SystemRegister((raw >> 5) & 0xffff)
+		n.Rt = rt
+		return &n, nil
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+func parseBranchRegisterA64Instruction(raw uint32) (A64Instruction, error) {
+	var n BranchRegisterA64Instruction
+	n.raw = raw
+	n.Opcode = uint8((raw >> 21) & 15)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	if (raw & 0x001ffc1f) != 0x001f0000 {
+		return nil, a64UndefinedError(raw)
+	}
+	switch n.Opcode {
+	case 0, 1, 2:
+		return &n, nil
+	case 4, 5:
+		if n.Rn == 31 {
+			return &n, nil
+		}
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+// Parses the branch, exception-generating and system instructions.
+func parseBranchSystemA64Instruction(raw uint32) (A64Instruction, error) {
+	switch {
+	case (raw & 0x7c000000) == 0x14000000:
+		var n BranchA64Instruction
+		n.raw = raw
+		n.Link = (raw & 0x80000000) != 0
+		n.Offset = raw & 0x3ffffff
+		return &n, nil
+	case (raw & 0x7e000000) == 0x34000000:
+		var n CompareBranchA64Instruction
+		n.raw = raw
+		n.Is64 = (raw & 0x80000000) != 0
+		n.NonZero = (raw & 0x01000000) != 0
+		n.Offset = (raw >> 5) & 0x7ffff
+		n.Rt = A64Register(raw & 0x1f)
+		return &n, nil
+	case (raw & 0x7e000000) == 0x36000000:
+		var n TestBranchA64Instruction
+		n.raw = raw
+		n.NonZero = (raw & 0x01000000) != 0
+		n.Bit = uint8(((raw >> 26) & 0x20) | ((raw >> 19) & 0x1f))
+		n.Offset = uint16((raw >> 5) & 0x3fff)
+		n.Rt = A64Register(raw & 0x1f)
+		return &n, nil
+	case (raw & 0xff000010) == 0x54000000:
+		var n ConditionalBranchA64Instruction
+		n.raw = raw
+		n.Condition = ARMCondition(raw & 0xf)
+		n.Offset = (raw >> 5) & 0x7ffff
+		return &n, nil
+	case (raw & 0xff000000) == 0xd4000000:
+		return parseExceptionA64Instruction(raw)
+	case (raw & 0xffc00000) == 0xd5000000:
+		return parseSystemA64Instruction(raw)
+	case (raw & 0xfe000000) == 0xd6000000:
+		return parseBranchRegisterA64Instruction(raw)
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+func parseLogicalRegisterA64Instruction(raw uint32) (A64Instruction, error) {
+	var n LogicalRegisterA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Opcode = uint8((raw >> 29) & 3)
+	n.ShiftType = uint8((raw >> 22) & 3)
+	n.Invert = (raw & 0x00200000) != 0
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.ShiftAmount = uint8((raw >> 10) & 0x3f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	if !n.Is64 && (n.ShiftAmount >= 32) {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseAddSubtractRegisterA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	if (raw & 0x00200000) != 0 {
+		var n AddSubtractExtendedA64Instruction
+		n.raw = raw
+		n.Is64 = (raw & 0x80000000) != 0
+		n.Subtract = (raw & 0x40000000) != 0
+		n.SetFlags = (raw & 0x20000000) != 0
+		n.Rm = A64Register((raw >> 16) & 0x1f)
+		n.Extend = uint8((raw >> 13) & 7)
+		n.Shift = uint8((raw >> 10) & 7)
+		n.Rn = A64Register((raw >> 5) & 0x1f)
+		n.Rd = A64Register(raw & 0x1f)
+		if ((raw & 0x00c00000) != 0) || (n.Shift > 4) {
+			return nil, a64UndefinedError(raw)
+		}
+		return &n, nil
+	}
+	var n AddSubtractRegisterA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Subtract = (raw & 0x40000000) != 0
+	n.SetFlags = (raw & 0x20000000) != 0
+	n.ShiftType = uint8((raw >> 22) & 3)
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.ShiftAmount = uint8((raw >> 10) & 0x3f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	if (n.ShiftType == 3) || (!n.Is64 && (n.ShiftAmount >= 32)) {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseConditionalCompareA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	if (raw & 0x20000410) != 0x20000000 {
+		return nil, a64UndefinedError(raw)
+	}
+	var n ConditionalCompareA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Negative = (raw & 0x40000000) == 0
+	n.Operand = uint8((raw >> 16) & 0x1f)
+	n.Condition = ARMCondition((raw >> 12) & 0xf)
+	n.IsImmediate = (raw & 0x800) != 0
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Flags = uint8(raw & 0xf)
+	return &n, nil
+}
+
+func parseConditionalSelectA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	if (raw & 0x20000800) != 0 {
+		return nil, a64UndefinedError(raw)
+	}
+	var n ConditionalSelectA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Opcode = uint8(((raw >> 29) & 2) | ((raw >> 10) & 1))
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.Condition = ARMCondition((raw >> 12) & 0xf)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	return &n, nil
+}
+
+func parseDataProcessingSourceA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	is64 := (raw & 0x80000000) != 0
+	opcode := uint8((raw >> 10) & 0x3f)
+	rm := A64Register((raw >> 16) & 0x1f)
+	rn := A64Register((raw >> 5) & 0x1f)
+	rd := A64Register(raw & 0x1f)
+	if (raw & 0x20000000) != 0 {
+		return nil, a64UndefinedError(raw)
+	}
+	if (raw & 0x40000000) != 0 {
+		if (rm != 0) || (opcode > 5) || ((opcode == 3) && !is64) {
+			return nil, a64UndefinedError(raw)
+		}
+		var n DataProcessing1SourceA64Instruction
+		n.raw = raw
+		n.Is64 = is64
+		n.Opcode = opcode
+		n.Rd = rd
+		n.Rn = rn
+		return &n, nil
+	}
+	switch {
+	case (opcode == 2) || (opcode == 3) || ((opcode >= 8) && (opcode <= 11)):
+	case (opcode >= 16) && (opcode <= 23):
+		// Only crc32x and crc32cx use a 64-bit register.
+		if is64 != ((opcode & 3) == 3) {
+			return nil, a64UndefinedError(raw)
+		}
+	default:
+		return nil, a64UndefinedError(raw)
+	}
+	var n DataProcessing2SourceA64Instruction
+	n.raw = raw
+	n.Is64 = is64
+	n.Opcode = opcode
+	n.Rd = rd
+	n.Rn = rn
+	n.Rm = rm
+	return &n, nil
+}
+
+func parseDataProcessing3SourceA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n DataProcessing3SourceA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	n.Opcode = uint8((raw >> 21) & 7)
+	n.Subtract = (raw & 0x8000) != 0
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.Ra = A64Register((raw >> 10) & 0x1f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	if (raw & 0x60000000) != 0 {
+		return nil, a64UndefinedError(raw)
+	}
+	switch n.Opcode {
+	case 0:
+		return &n, nil
+	case 1, 5:
+		if n.Is64 {
+			return &n, nil
+		}
+	case 2, 6:
+		if n.Is64 && !n.Subtract {
+			return &n, nil
+		}
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+// Parses the data processing instructions with register operands.
+func parseDataProcessingRegisterA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	if (raw & 0x10000000) == 0 {
+		if (raw & 0x01000000) == 0 {
+			return parseLogicalRegisterA64Instruction(raw)
+		}
+		return parseAddSubtractRegisterA64Instruction(raw)
+	}
+	if (raw & 0x01000000) != 0 {
+		return parseDataProcessing3SourceA64Instruction(raw)
+	}
+	switch (raw >> 21) & 7 {
+	case 0:
+		if (raw & 0xfc00) != 0 {
+			break
+		}
+		var n AddSubtractCarryA64Instruction
+		n.raw = raw
+		n.Is64 = (raw & 0x80000000) != 0
+		n.Subtract = (raw & 0x40000000) != 0
+		n.SetFlags = (raw & 0x20000000) != 0
+		n.Rm = A64Register((raw >> 16) & 0x1f)
+		n.Rn = A64Register((raw >> 5) & 0x1f)
+		n.Rd = A64Register(raw & 0x1f)
+		return &n, nil
+	case 2:
+		return parseConditionalCompareA64Instruction(raw)
+	case 4:
+		return parseConditionalSelectA64Instruction(raw)
+	case 6:
+		return parseDataProcessingSourceA64Instruction(raw)
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+// Parses a 32-bit A64 instruction. Advanced SIMD data processing instructions
+// aren't supported, though the SIMD registers may be loaded and stored.
+func ParseA64Instruction(raw uint32) (A64Instruction, error) {
+	switch (raw >> 25) & 0xf {
+	case 8, 9:
+		return parseDataProcessingImmediateA64Instruction(raw)
+	case 10, 11:
+		return parseBranchSystemA64Instruction(raw)
+	case 4, 6, 12, 14:
+		return parseLoadStoreA64Instruction(raw)
+	case 5, 13:
+		return parseDataProcessingRegisterA64Instruction(raw)
+	case 15:
+		return parseFPA64Instruction(raw)
+	}
+	return nil, a64UndefinedError(raw)
+}
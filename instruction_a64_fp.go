@@ -0,0 +1,466 @@
+package arm_emulate
+
+// This file contains the A64 scalar floating-point instructions. Only single
+// and double precision are supported, so the half-precision forms are treated
+// as undefined.
+
+import (
+	"fmt"
+	"math"
+)
+
+// Returns the name of a single or double-precision register.
+func a64FPRegisterName(r A64Register, double bool) string {
+	if double {
+		return a64VectorRegisterName(r, 8)
+	}
+	return a64VectorRegisterName(r, 4)
+}
+
+// Returns the single or double-precision value encoded by the 8-bit immediate
+// used by fmov.
+func a64ExpandFPImmediate(imm8 uint8, double bool) uint64 {
+	sign := uint64(imm8 >> 7)
+	b := uint64((imm8 >> 6) & 1)
+	cd := uint64((imm8 >> 4) & 3)
+	efgh := uint64(imm8 & 15)
+	if double {
+		exponent := ((b ^ 1) << 10) | cd
+		if b != 0 {
+			exponent |= 0xff << 2
+		}
+		return (sign << 63) | (exponent << 52) | (efgh << 48)
+	}
+	exponent := ((b ^ 1) << 7) | cd
+	if b != 0 {
+		exponent |= 0x1f << 2
+	}
+	return (sign << 31) | (exponent << 23) | (efgh << 19)
+}
+
+var a64FPRoundingNames = [...]string{"n", "p", "m", "z", "a", "", "x", "i"}
+
+// Floating-point instructions with one source register, such as fabs, fcvt
+// and frintz.
+type FPDataProcessing1SourceA64Instruction struct {
+	basicA64Instruction
+	Double bool
+	// The opcode field, from bits 15-20. 0 = fmov, 1 = fabs, 2 = fneg,
+	// 3 = fsqrt, 4 = fcvt to single, 5 = fcvt to double, and 8-15 are frintn,
+	// frintp, frintm, frintz, frinta, (unused), frintx and frinti.
+	Opcode uint8
+	Rd     A64Register
+	Rn     A64Register
+}
+
+func (n *FPDataProcessing1SourceA64Instruction) String() string {
+	rd := a64FPRegisterName(n.Rd, n.Double)
+	rn := a64FPRegisterName(n.Rn, n.Double)
+	switch n.Opcode {
+	case 4, 5:
+		rd = a64FPRegisterName(n.Rd, n.Opcode == 5)
+		return fmt.Sprintf("fcvt %s, %s", rd, rn)
+	}
+	name := "frint" + a64FPRoundingNames[n.Opcode&7]
+	if n.Opcode < 8 {
+		name = [...]string{"fmov", "fabs", "fneg", "fsqrt"}[n.Opcode&3]
+	}
+	return fmt.Sprintf("%s %s, %s", name, rd, rn)
+}
+
+var a64FP2SourceStrings = [...]string{"fmul", "fdiv", "fadd", "fsub", "fmax",
+	"fmin", "fmaxnm", "fminnm", "fnmul"}
+
+// Floating-point instructions with two source registers, such as fadd.
+type FPDataProcessing2SourceA64Instruction struct {
+	basicA64Instruction
+	Double bool
+	// 0 = fmul, 1 = fdiv, 2 = fadd, 3 = fsub, 4 = fmax, 5 = fmin,
+	// 6 = fmaxnm, 7 = fminnm, 8 = fnmul
+	Opcode uint8
+	Rd     A64Register
+	Rn     A64Register
+	Rm     A64Register
+}
+
+func (n *FPDataProcessing2SourceA64Instruction) String() string {
+	return fmt.Sprintf("%s %s, %s, %s", a64FP2SourceStrings[n.Opcode],
+		a64FPRegisterName(n.Rd, n.Double), a64FPRegisterName(n.Rn, n.Double),
+		a64FPRegisterName(n.Rm, n.Double))
+}
+
+// The fused multiply-add instructions: fmadd, fmsub, fnmadd and fnmsub.
+type FPDataProcessing3SourceA64Instruction struct {
+	basicA64Instruction
+	Double bool
+	// The o1 bit, which negates the addend and the product.
+	Negate bool
+	// The o0 bit, which subtracts the product instead of adding it.
+	Subtract bool
+	Rd       A64Register
+	Rn       A64Register
+	Rm       A64Register
+	Ra       A64Register
+}
+
+func (n *FPDataProcessing3SourceA64Instruction) String() string {
+	name := "fmadd"
+	if n.Subtract {
+		name = "fmsub"
+	}
+	if n.Negate {
+		name = "fn" + name[1:]
+	}
+	return fmt.Sprintf("%s %s, %s, %s, %s", name,
+		a64FPRegisterName(n.Rd, n.Double), a64FPRegisterName(n.Rn, n.Double),
+		a64FPRegisterName(n.Rm, n.Double), a64FPRegisterName(n.Ra, n.Double))
+}
+
+// The fcmp and fcmpe instructions.
+type FPCompareA64Instruction struct {
+	basicA64Instruction
+	Double bool
+	// Set for fcmpe, which signals an exception for quiet NaNs.
+	Signaling bool
+	// If set, Rn is compared with zero rather than Rm.
+	Zero bool
+	Rn   A64Register
+	Rm   A64Register
+}
+
+func (n *FPCompareA64Instruction) String() string {
+	name := "fcmp"
+	if n.Signaling {
+		name = "fcmpe"
+	}
+	operand := "#0.0"
+	if !n.Zero {
+		operand = a64FPRegisterName(n.Rm, n.Double)
+	}
+	return fmt.Sprintf("%s %s, %s", name, a64FPRegisterName(n.Rn, n.Double),
+		operand)
+}
+
+// The fccmp and fccmpe instructions.
+type FPConditionalCompareA64Instruction struct {
+	basicA64Instruction
+	Double    bool
+	Signaling bool
+	Rn        A64Register
+	Rm        A64Register
+	Condition ARMCondition
+	// The flags set if the condition isn't met.
+	Flags uint8
+}
+
+func (n *FPConditionalCompareA64Instruction) String() string {
+	name := "fccmp"
+	if n.Signaling {
+		name = "fccmpe"
+	}
+	return fmt.Sprintf("%s %s, %s, #%d, %s", name,
+		a64FPRegisterName(n.Rn, n.Double), a64FPRegisterName(n.Rm, n.Double),
+		n.Flags, a64ConditionString(n.Condition))
+}
+
+// The fcsel instruction.
+type FPConditionalSelectA64Instruction struct {
+	basicA64Instruction
+	Double    bool
+	Rd        A64Register
+	Rn        A64Register
+	Rm        A64Register
+	Condition ARMCondition
+}
+
+func (n *FPConditionalSelectA64Instruction) String() string {
+	return fmt.Sprintf("fcsel %s, %s, %s, %s",
+		a64FPRegisterName(n.Rd, n.Double), a64FPRegisterName(n.Rn, n.Double),
+		a64FPRegisterName(n.Rm, n.Double), a64ConditionString(n.Condition))
+}
+
+// The fmov instruction which loads an 8-bit floating-point immediate.
+type FPImmediateA64Instruction struct {
+	basicA64Instruction
+	Double    bool
+	Rd        A64Register
+	Immediate uint8
+}
+
+// Returns the bits of the single or double-precision value loaded.
+func (n *FPImmediateA64Instruction) Value() uint64 {
+	return a64ExpandFPImmediate(n.Immediate, n.Double)
+}
+
+func (n *FPImmediateA64Instruction) String() string {
+	value := math.Float64frombits(n.Value())
+	if !n.Double {
+		value = float64(math.Float32frombits(uint32(n.Value())))
+	}
+	return fmt.Sprintf("fmov %s, #%.8f", a64FPRegisterName(n.Rd, n.Double),
+		value)
+}
+
+// Conversions between floating-point values and integers in general-purpose
+// registers, and fmov between general-purpose and floating-point registers.
+type FPIntegerConversionA64Instruction struct {
+	basicA64Instruction
+	// Set if the general-purpose register is 64 bits.
+	Is64   bool
+	Double bool
+	// Set for the fmov instructions which access the upper 64 bits of a
+	// 128-bit vector register.
+	Upper bool
+	// The rmode field, which selects the rounding mode used by fcvt*.
+	RoundingMode uint8
+	// The opcode field, from bits 16-18. 0 and 1 = fcvt*s and fcvt*u, 2 =
+	// scvtf, 3 = ucvtf, 4 = fcvtas, 5 = fcvtau, 6 = fmov to a general-purpose
+	// register and 7 = fmov to a floating-point register.
+	Opcode uint8
+	Rd     A64Register
+	Rn     A64Register
+}
+
+func (n *FPIntegerConversionA64Instruction) String() string {
+	general := func(r A64Register) string {
+		return r.name(n.Is64, false)
+	}
+	fp := func(r A64Register) string {
+		if n.Upper {
+			return fmt.Sprintf("v%d.d[1]", r)
+		}
+		return a64FPRegisterName(r, n.Double)
+	}
+	switch n.Opcode {
+	case 2, 3:
+		name := [...]string{"scvtf", "ucvtf"}[n.Opcode&1]
+		return fmt.Sprintf("%s %s, %s", name, fp(n.Rd), general(n.Rn))
+	case 6:
+		return fmt.Sprintf("fmov %s, %s", general(n.Rd), fp(n.Rn))
+	case 7:
+		return fmt.Sprintf("fmov %s, %s", fp(n.Rd), general(n.Rn))
+	}
+	name := "fcvt" + a64FPRoundingNames[n.RoundingMode&3]
+	if n.Opcode >= 4 {
+		name = "fcvta"
+	}
+	name += [...]string{"s", "u"}[n.Opcode&1]
+	return fmt.Sprintf("%s %s, %s", name, general(n.Rd), fp(n.Rn))
+}
+
+// Conversions between floating-point and fixed-point values: scvtf, ucvtf,
+// fcvtzs and fcvtzu with a number of fractional bits.
+type FPFixedPointConversionA64Instruction struct {
+	basicA64Instruction
+	Is64   bool
+	Double bool
+	// 0 = fcvtzs, 1 = fcvtzu, 2 = scvtf, 3 = ucvtf
+	Opcode uint8
+	// The scale field, which holds 64 minus the number of fractional bits.
+	Scale uint8
+	Rd    A64Register
+	Rn    A64Register
+}
+
+// Returns the number of fractional bits.
+func (n *FPFixedPointConversionA64Instruction) fractionBits() uint8 {
+	return 64 - n.Scale
+}
+
+func (n *FPFixedPointConversionA64Instruction) String() string {
+	name := [...]string{"fcvtzs", "fcvtzu", "scvtf", "ucvtf"}[n.Opcode&3]
+	general := n.Rn.name(n.Is64, false)
+	fp := a64FPRegisterName(n.Rd, n.Double)
+	if n.Opcode < 2 {
+		general = n.Rd.name(n.Is64, false)
+		fp = a64FPRegisterName(n.Rn, n.Double)
+		return fmt.Sprintf("%s %s, %s, #%d", name, general, fp,
+			n.fractionBits())
+	}
+	return fmt.Sprintf("%s %s, %s, #%d", name, fp, general, n.fractionBits())
+}
+
+func parseFPDataProcessing1SourceA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n FPDataProcessing1SourceA64Instruction
+	n.raw = raw
+	n.Double = (raw & 0x00400000) != 0
+	n.Opcode = uint8((raw >> 15) & 0x3f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	switch n.Opcode {
+	case 0, 1, 2, 3, 8, 9, 10, 11, 12, 14, 15:
+		return &n, nil
+	case 4, 5:
+		// fcvt must convert to the other precision.
+		if n.Double == (n.Opcode == 4) {
+			return &n, nil
+		}
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+func parseFPIntegerConversionA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n FPIntegerConversionA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	fpType := (raw >> 22) & 3
+	n.Double = fpType == 1
+	n.RoundingMode = uint8((raw >> 19) & 3)
+	n.Opcode = uint8((raw >> 16) & 7)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	if (n.Opcode >= 6) && (fpType == 2) && (n.RoundingMode == 1) && n.Is64 {
+		n.Upper = true
+		n.Double = true
+		return &n, nil
+	}
+	if fpType >= 2 {
+		return nil, a64UndefinedError(raw)
+	}
+	switch n.Opcode {
+	case 0, 1:
+		return &n, nil
+	case 2, 3, 4, 5:
+		if n.RoundingMode == 0 {
+			return &n, nil
+		}
+	case 6, 7:
+		if (n.RoundingMode == 0) && (n.Is64 == n.Double) {
+			return &n, nil
+		}
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+func parseFPFixedPointConversionA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n FPFixedPointConversionA64Instruction
+	n.raw = raw
+	n.Is64 = (raw & 0x80000000) != 0
+	fpType := (raw >> 22) & 3
+	n.Double = fpType == 1
+	n.Scale = uint8((raw >> 10) & 0x3f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	if (fpType >= 2) || (!n.Is64 && (n.Scale < 32)) {
+		return nil, a64UndefinedError(raw)
+	}
+	switch (raw >> 16) & 0x1f {
+	case 0x18:
+		n.Opcode = 0
+	case 0x19:
+		n.Opcode = 1
+	case 0x02:
+		n.Opcode = 2
+	case 0x03:
+		n.Opcode = 3
+	default:
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseFPDataProcessing3SourceA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n FPDataProcessing3SourceA64Instruction
+	n.raw = raw
+	n.Double = (raw & 0x00400000) != 0
+	n.Negate = (raw & 0x00200000) != 0
+	n.Subtract = (raw & 0x8000) != 0
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.Ra = A64Register((raw >> 10) & 0x1f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rd = A64Register(raw & 0x1f)
+	if (raw & 0x00800000) != 0 {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+// Parses the scalar floating-point data processing instructions.
+func parseFPA64Instruction(raw uint32) (A64Instruction, error) {
+	if (raw & 0xff000000) == 0x1f000000 {
+		return parseFPDataProcessing3SourceA64Instruction(raw)
+	}
+	if (raw & 0x7f000000) != 0x1e000000 {
+		return nil, a64UndefinedError(raw)
+	}
+	if (raw & 0x00200000) == 0 {
+		return parseFPFixedPointConversionA64Instruction(raw)
+	}
+	if (raw & 0xfc00) == 0 {
+		return parseFPIntegerConversionA64Instruction(raw)
+	}
+	// The remaining instructions only use floating-point registers, and don't
+	// support half precision.
+	double := (raw & 0x00400000) != 0
+	rm := A64Register((raw >> 16) & 0x1f)
+	rn := A64Register((raw >> 5) & 0x1f)
+	rd := A64Register(raw & 0x1f)
+	condition := ARMCondition((raw >> 12) & 0xf)
+	if (raw & 0x80800000) != 0 {
+		return nil, a64UndefinedError(raw)
+	}
+	switch (raw >> 10) & 3 {
+	case 1:
+		var n FPConditionalCompareA64Instruction
+		n.raw = raw
+		n.Double = double
+		n.Signaling = (raw & 0x10) != 0
+		n.Rn = rn
+		n.Rm = rm
+		n.Condition = condition
+		n.Flags = uint8(raw & 0xf)
+		return &n, nil
+	case 2:
+		var n FPDataProcessing2SourceA64Instruction
+		n.raw = raw
+		n.Double = double
+		n.Opcode = uint8((raw >> 12) & 0xf)
+		n.Rd = rd
+		n.Rn = rn
+		n.Rm = rm
+		if n.Opcode > 8 {
+			return nil, a64UndefinedError(raw)
+		}
+		return &n, nil
+	case 3:
+		var n FPConditionalSelectA64Instruction
+		n.raw = raw
+		n.Double = double
+		n.Rd = rd
+		n.Rn = rn
+		n.Rm = rm
+		n.Condition = condition
+		return &n, nil
+	}
+	switch {
+	case ((raw >> 10) & 0x1f) == 0x10:
+		return parseFPDataProcessing1SourceA64Instruction(raw)
+	case ((raw >> 10) & 0xf) == 0x8:
+		if (raw & 0xc007) != 0 {
+			break
+		}
+		var n FPCompareA64Instruction
+		n.raw = raw
+		n.Double = double
+		n.Signaling = (raw & 0x10) != 0
+		n.Zero = (raw & 0x8) != 0
+		n.Rn = rn
+		n.Rm = rm
+		return &n, nil
+	case ((raw >> 10) & 7) == 4:
+		if (raw & 0x3e0) != 0 {
+			break
+		}
+		var n FPImmediateA64Instruction
+		n.raw = raw
+		n.Double = double
+		n.Rd = rd
+		n.Immediate = uint8((raw >> 13) & 0xff)
+		return &n, nil
+	}
+	return nil, a64UndefinedError(raw)
+}
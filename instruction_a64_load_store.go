@@ -0,0 +1,656 @@
+package arm_emulate
+
+// This file contains the A64 load and store instructions, including the forms
+// which load and store SIMD and floating-point registers.
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Returns the name of a SIMD and floating-point register holding the given
+// number of bytes, such as "d0" for an 8-byte register.
+func a64VectorRegisterName(r A64Register, size uint8) string {
+	prefix := "b"
+	switch size {
+	case 2:
+		prefix = "h"
+	case 4:
+		prefix = "s"
+	case 8:
+		prefix = "d"
+	case 16:
+		prefix = "q"
+	}
+	return fmt.Sprintf("%s%d", prefix, r)
+}
+
+// Returns the name of a prfm instruction's prefetch operation, such as
+// "pldl1keep".
+func a64PrefetchOperation(operation A64Register) string {
+	kind := (operation >> 3) & 3
+	target := (operation >> 1) & 3
+	if (kind == 3) || (target == 3) {
+		return fmt.Sprintf("#%d", operation)
+	}
+	policy := "keep"
+	if (operation & 1) != 0 {
+		policy = "strm"
+	}
+	return fmt.Sprintf("%sl%d%s", [...]string{"pld", "pli", "pst"}[kind],
+		target+1, policy)
+}
+
+// Returns the address operand for a base register plus a signed offset.
+func a64OffsetAddress(rn A64Register, offset int64) string {
+	if offset == 0 {
+		return fmt.Sprintf("[%s]", rn.name(true, true))
+	}
+	return fmt.Sprintf("[%s, #%d]", rn.name(true, true), offset)
+}
+
+// The exclusive and acquire-release loads and stores, such as ldxr, stlxp and
+// ldar.
+type LoadStoreExclusiveA64Instruction struct {
+	basicA64Instruction
+	// The log2 of the size of each register transferred.
+	Size uint8
+	Load bool
+	Pair bool
+	// Set for the non-exclusive ldar and stlr instructions.
+	Ordered bool
+	// Set for instructions with acquire or release semantics.
+	AcquireRelease bool
+	// Receives the status of an exclusive store.
+	Rs  A64Register
+	Rt  A64Register
+	Rt2 A64Register
+	Rn  A64Register
+}
+
+func (n *LoadStoreExclusiveA64Instruction) String() string {
+	name := "st"
+	if n.Load {
+		name = "ld"
+	}
+	if n.AcquireRelease {
+		if n.Load {
+			name += "a"
+		} else {
+			name += "l"
+		}
+	}
+	if !n.Ordered {
+		name += "x"
+	}
+	is64 := n.Size == 3
+	if n.Pair {
+		name += "p"
+	} else {
+		name += "r" + [...]string{"b", "h", "", ""}[n.Size&3]
+	}
+	s := name + " "
+	if !n.Load && !n.Ordered {
+		s += n.Rs.name(false, false) + ", "
+	}
+	s += n.Rt.name(is64, false) + ", "
+	if n.Pair {
+		s += n.Rt2.name(is64, false) + ", "
+	}
+	return s + fmt.Sprintf("[%s]", n.Rn.name(true, true))
+}
+
+// Loads from a PC-relative address, including the prfm instruction.
+type LoadLiteralA64Instruction struct {
+	basicA64Instruction
+	// For general-purpose registers: 0 = 32-bit, 1 = 64-bit, 2 = ldrsw,
+	// 3 = prfm. For vector registers, the log2 of the size minus 2.
+	Opcode uint8
+	Vector bool
+	Rt     A64Register
+	// The 19-bit offset, in words.
+	Offset uint32
+}
+
+func (n *LoadLiteralA64Instruction) offset() int64 {
+	return int64(int32(n.Offset<<13) >> 11)
+}
+
+func (n *LoadLiteralA64Instruction) String() string {
+	var name, rt string
+	name = "ldr"
+	if n.Vector {
+		rt = a64VectorRegisterName(n.Rt, 4<<n.Opcode)
+	} else {
+		switch n.Opcode {
+		case 0, 1:
+			rt = n.Rt.name(n.Opcode == 1, false)
+		case 2:
+			name = "ldrsw"
+			rt = n.Rt.x()
+		case 3:
+			name = "prfm"
+			rt = a64PrefetchOperation(n.Rt)
+		}
+	}
+	return fmt.Sprintf("%s %s, #%d", name, rt, n.offset())
+}
+
+// The addressing modes used by A64 loads and stores.
+const (
+	a64OffsetAddressing       = 0
+	a64PostIndexAddressing    = 1
+	a64PreIndexAddressing     = 2
+	a64UnscaledAddressing     = 3
+	a64UnprivilegedAddressing = 4
+	a64RegisterAddressing     = 5
+	// The ldnp and stnp instructions, which use offset addressing.
+	a64NonTemporalAddressing = 6
+)
+
+// The ldp, stp, ldpsw, ldnp and stnp instructions.
+type LoadStorePairA64Instruction struct {
+	basicA64Instruction
+	// For general-purpose registers: 0 = 32-bit, 1 = ldpsw, 2 = 64-bit. For
+	// vector registers, the log2 of the size minus 2.
+	Opcode     uint8
+	Vector     bool
+	Load       bool
+	Addressing uint8
+	Rt         A64Register
+	Rt2        A64Register
+	Rn         A64Register
+	// The 7-bit signed offset, scaled by the size of a register.
+	Offset uint8
+}
+
+// Returns the size of each register transferred, in bytes.
+func (n *LoadStorePairA64Instruction) size() uint8 {
+	if n.Vector {
+		return 4 << n.Opcode
+	}
+	if n.Opcode == 2 {
+		return 8
+	}
+	return 4
+}
+
+func (n *LoadStorePairA64Instruction) offset() int64 {
+	return int64(int8(n.Offset<<1)>>1) * int64(n.size())
+}
+
+func (n *LoadStorePairA64Instruction) String() string {
+	name := "st"
+	if n.Load {
+		name = "ld"
+	}
+	if n.Addressing == a64NonTemporalAddressing {
+		name += "n"
+	}
+	name += "p"
+	if !n.Vector && (n.Opcode == 1) {
+		name += "sw"
+	}
+	var rt, rt2 string
+	if n.Vector {
+		rt = a64VectorRegisterName(n.Rt, n.size())
+		rt2 = a64VectorRegisterName(n.Rt2, n.size())
+	} else {
+		rt = n.Rt.name(n.Opcode != 0, false)
+		rt2 = n.Rt2.name(n.Opcode != 0, false)
+	}
+	offset := n.offset()
+	rn := n.Rn.name(true, true)
+	var address string
+	switch n.Addressing {
+	case a64PostIndexAddressing:
+		address = fmt.Sprintf("[%s], #%d", rn, offset)
+	case a64PreIndexAddressing:
+		address = fmt.Sprintf("[%s, #%d]!", rn, offset)
+	default:
+		address = a64OffsetAddress(n.Rn, offset)
+	}
+	return fmt.Sprintf("%s %s, %s, %s", name, rt, rt2, address)
+}
+
+// Loads and stores of a single register, using an immediate or register
+// offset.
+type LoadStoreRegisterA64Instruction struct {
+	basicA64Instruction
+	// The log2 of the size of the access, except for 16-byte vector registers,
+	// which use a size of 0.
+	Size   uint8
+	Vector bool
+	// Bit 0 is set for loads. For general-purpose registers, bit 1 is set for
+	// sign-extending loads (and prfm), with bit 0 clear if they extend to 64
+	// bits. Bit 1 is set for 16-byte vector registers.
+	Opcode     uint8
+	Addressing uint8
+	Rt         A64Register
+	Rn         A64Register
+	// Either the 12-bit unsigned offset, scaled by the size of the access, or
+	// the 9-bit signed unscaled offset, depending on the addressing mode.
+	Immediate uint16
+	// The remaining fields are used for register offsets.
+	Rm A64Register
+	// The option field, selecting the extension applied to Rm.
+	Extend uint8
+	// If set, Rm is shifted left by the log2 of the size of the access.
+	Shift bool
+}
+
+// Returns true for the prfm and prfum instructions.
+func (n *LoadStoreRegisterA64Instruction) isPrefetch() bool {
+	return !n.Vector && (n.Size == 3) && (n.Opcode == 2)
+}
+
+// Returns the size of the access, in bytes.
+func (n *LoadStoreRegisterA64Instruction) size() uint8 {
+	if n.Vector && (n.Opcode >= 2) {
+		return 16
+	}
+	return 1 << n.Size
+}
+
+// Returns the offset used by the immediate addressing modes.
+func (n *LoadStoreRegisterA64Instruction) offset() int64 {
+	if n.Addressing == a64OffsetAddressing {
+		return int64(n.Immediate) * int64(n.size())
+	}
+	return int64(int16(n.Immediate<<7) >> 7)
+}
+
+func (n *LoadStoreRegisterA64Instruction) name() string {
+	name := "st"
+	if n.isPrefetch() {
+		name = "prf"
+	} else if ((n.Opcode & 1) != 0) || (!n.Vector && (n.Opcode >= 2)) {
+		name = "ld"
+	}
+	switch n.Addressing {
+	case a64UnscaledAddressing:
+		name += "u"
+	case a64UnprivilegedAddressing:
+		name += "t"
+	}
+	if n.isPrefetch() {
+		return name + "m"
+	}
+	name += "r"
+	if n.Vector {
+		return name
+	}
+	if n.Opcode >= 2 {
+		return name + [...]string{"sb", "sh", "sw", ""}[n.Size&3]
+	}
+	return name + [...]string{"b", "h", "", ""}[n.Size&3]
+}
+
+func (n *LoadStoreRegisterA64Instruction) String() string {
+	var rt string
+	switch {
+	case n.isPrefetch():
+		rt = a64PrefetchOperation(n.Rt)
+	case n.Vector:
+		rt = a64VectorRegisterName(n.Rt, n.size())
+	default:
+		rt = n.Rt.name((n.Size == 3) || (n.Opcode == 2), false)
+	}
+	rn := n.Rn.name(true, true)
+	var address string
+	switch n.Addressing {
+	case a64PostIndexAddressing:
+		address = fmt.Sprintf("[%s], #%d", rn, n.offset())
+	case a64PreIndexAddressing:
+		address = fmt.Sprintf("[%s, #%d]!", rn, n.offset())
+	case a64RegisterAddressing:
+		rm := n.Rm.name((n.Extend&1) != 0, false)
+		amount := bits.TrailingZeros8(n.size())
+		if n.Extend == 3 {
+			if n.Shift {
+				rm += fmt.Sprintf(", lsl #%d", amount)
+			}
+		} else {
+			rm += ", " + a64ExtendStrings[n.Extend&7]
+			if n.Shift {
+				rm += fmt.Sprintf(" #%d", amount)
+			}
+		}
+		address = fmt.Sprintf("[%s, %s]", rn, rm)
+	default:
+		address = a64OffsetAddress(n.Rn, n.offset())
+	}
+	return fmt.Sprintf("%s %s, %s", n.name(), rt, address)
+}
+
+var a64ArrangementStrings = [...]string{"8b", "16b", "4h", "8h", "2s", "4s",
+	"1d", "2d"}
+
+// Returns a list of consecutive vector registers, such as "{ v0.4s, v1.4s }".
+// Register numbers wrap around from 31 to 0.
+func a64VectorList(first A64Register, count uint8, suffix string) string {
+	s := "{ "
+	for i := uint8(0); i < count; i++ {
+		if i != 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("v%d.%s", (uint8(first)+i)&31, suffix)
+	}
+	return s + " }"
+}
+
+// Returns the address operand for a SIMD structure load or store, which may
+// post-index the base register by Rm, or by the number of bytes transferred if
+// Rm is 31.
+func a64StructureAddress(rn, rm A64Register, postIndex bool,
+	bytes uint8) string {
+	address := fmt.Sprintf("[%s]", rn.name(true, true))
+	if !postIndex {
+		return address
+	}
+	if rm == 31 {
+		return fmt.Sprintf("%s, #%d", address, bytes)
+	}
+	return fmt.Sprintf("%s, %s", address, rm.x())
+}
+
+// The ld1-ld4 and st1-st4 instructions which transfer whole vector registers.
+type LoadStoreMultipleA64Instruction struct {
+	basicA64Instruction
+	Load bool
+	// Set if the base register is post-indexed.
+	PostIndex bool
+	// Set if 128-bit registers are used, rather than 64-bit registers.
+	Q bool
+	// The opcode field, from bits 12-15, which gives the number of registers
+	// and structure elements.
+	Opcode uint8
+	// The log2 of the size of each element.
+	Size uint8
+	Rt   A64Register
+	Rn   A64Register
+	Rm   A64Register
+}
+
+// Returns the number of elements in each structure, and the number of
+// registers transferred.
+func (n *LoadStoreMultipleA64Instruction) layout() (uint8, uint8) {
+	switch n.Opcode {
+	case 0:
+		return 4, 4
+	case 2:
+		return 1, 4
+	case 4:
+		return 3, 3
+	case 6:
+		return 1, 3
+	case 7:
+		return 1, 1
+	case 8:
+		return 2, 2
+	}
+	return 1, 2
+}
+
+func (n *LoadStoreMultipleA64Instruction) String() string {
+	name := "st"
+	if n.Load {
+		name = "ld"
+	}
+	elements, count := n.layout()
+	arrangement := n.Size << 1
+	bytes := count * 8
+	if n.Q {
+		arrangement |= 1
+		bytes *= 2
+	}
+	return fmt.Sprintf("%s%d %s, %s", name, elements, a64VectorList(n.Rt,
+		count, a64ArrangementStrings[arrangement]), a64StructureAddress(n.Rn,
+		n.Rm, n.PostIndex, bytes))
+}
+
+// The ld1-ld4 and st1-st4 instructions which transfer a single element of
+// each register, and the ld1r-ld4r instructions, which load an element into
+// every lane of each register.
+type LoadStoreSingleA64Instruction struct {
+	basicA64Instruction
+	Load      bool
+	PostIndex bool
+	// The number of registers transferred, from 1 to 4.
+	Count uint8
+	// Set for ld1r-ld4r.
+	Replicate bool
+	// The log2 of the size of each element.
+	Size uint8
+	// The index of the element in each register. Not used by ld1r-ld4r.
+	Index uint8
+	// Set if ld1r-ld4r write all 128 bits of the registers.
+	Q  bool
+	Rt A64Register
+	Rn A64Register
+	Rm A64Register
+}
+
+func (n *LoadStoreSingleA64Instruction) String() string {
+	name := "st"
+	if n.Load {
+		name = "ld"
+	}
+	name += fmt.Sprintf("%d", n.Count)
+	bytes := n.Count << n.Size
+	address := a64StructureAddress(n.Rn, n.Rm, n.PostIndex, bytes)
+	if n.Replicate {
+		arrangement := n.Size << 1
+		if n.Q {
+			arrangement |= 1
+		}
+		return fmt.Sprintf("%sr %s, %s", name, a64VectorList(n.Rt, n.Count,
+			a64ArrangementStrings[arrangement]), address)
+	}
+	suffix := [...]string{"b", "h", "s", "d"}[n.Size&3]
+	return fmt.Sprintf("%s %s[%d], %s", name, a64VectorList(n.Rt, n.Count,
+		suffix), n.Index, address)
+}
+
+func parseLoadStoreExclusiveA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n LoadStoreExclusiveA64Instruction
+	n.raw = raw
+	n.Size = uint8(raw >> 30)
+	n.Load = (raw & 0x00400000) != 0
+	n.Pair = (raw & 0x00200000) != 0
+	n.Ordered = (raw & 0x00800000) != 0
+	n.AcquireRelease = (raw & 0x8000) != 0
+	n.Rs = A64Register((raw >> 16) & 0x1f)
+	n.Rt2 = A64Register((raw >> 10) & 0x1f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rt = A64Register(raw & 0x1f)
+	if n.Ordered && (n.Pair || !n.AcquireRelease) {
+		// These are the compare-and-swap and limited ordering instructions
+		// added in ARMv8.1.
+		return nil, a64UndefinedError(raw)
+	}
+	if n.Pair && (n.Size < 2) {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseLoadLiteralA64Instruction(raw uint32) (A64Instruction, error) {
+	var n LoadLiteralA64Instruction
+	n.raw = raw
+	n.Opcode = uint8(raw >> 30)
+	n.Vector = (raw & 0x04000000) != 0
+	n.Offset = (raw >> 5) & 0x7ffff
+	n.Rt = A64Register(raw & 0x1f)
+	if n.Vector && (n.Opcode == 3) {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseLoadStorePairA64Instruction(raw uint32) (A64Instruction, error) {
+	var n LoadStorePairA64Instruction
+	n.raw = raw
+	n.Opcode = uint8(raw >> 30)
+	n.Vector = (raw & 0x04000000) != 0
+	n.Load = (raw & 0x00400000) != 0
+	n.Addressing = [...]uint8{a64NonTemporalAddressing,
+		a64PostIndexAddressing, a64OffsetAddressing,
+		a64PreIndexAddressing}[(raw>>23)&3]
+	n.Offset = uint8((raw >> 15) & 0x7f)
+	n.Rt2 = A64Register((raw >> 10) & 0x1f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rt = A64Register(raw & 0x1f)
+	if n.Opcode == 3 {
+		return nil, a64UndefinedError(raw)
+	}
+	// ldpsw doesn't have a store or non-temporal form.
+	if !n.Vector && (n.Opcode == 1) && (!n.Load ||
+		(n.Addressing == a64NonTemporalAddressing)) {
+		return nil, a64UndefinedError(raw)
+	}
+	return &n, nil
+}
+
+func parseLoadStoreRegisterA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n LoadStoreRegisterA64Instruction
+	n.raw = raw
+	n.Size = uint8(raw >> 30)
+	n.Vector = (raw & 0x04000000) != 0
+	n.Opcode = uint8((raw >> 22) & 3)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rt = A64Register(raw & 0x1f)
+	if (raw & 0x01000000) != 0 {
+		n.Addressing = a64OffsetAddressing
+		n.Immediate = uint16((raw >> 10) & 0xfff)
+	} else if (raw & 0x00200000) == 0 {
+		n.Addressing = [...]uint8{a64UnscaledAddressing,
+			a64PostIndexAddressing, a64UnprivilegedAddressing,
+			a64PreIndexAddressing}[(raw>>10)&3]
+		n.Immediate = uint16((raw >> 12) & 0x1ff)
+	} else if ((raw >> 10) & 3) == 2 {
+		n.Addressing = a64RegisterAddressing
+		n.Rm = A64Register((raw >> 16) & 0x1f)
+		n.Extend = uint8((raw >> 13) & 7)
+		n.Shift = (raw & 0x1000) != 0
+		if (n.Extend & 2) == 0 {
+			return nil, a64UndefinedError(raw)
+		}
+	} else {
+		// These are the atomic memory operations added in ARMv8.1.
+		return nil, a64UndefinedError(raw)
+	}
+	if n.Vector {
+		if (n.Opcode >= 2) && (n.Size != 0) {
+			return nil, a64UndefinedError(raw)
+		}
+		if n.Addressing == a64UnprivilegedAddressing {
+			return nil, a64UndefinedError(raw)
+		}
+		return &n, nil
+	}
+	if n.Opcode == 3 && (n.Size >= 2) {
+		return nil, a64UndefinedError(raw)
+	}
+	if n.isPrefetch() {
+		switch n.Addressing {
+		case a64PostIndexAddressing, a64PreIndexAddressing,
+			a64UnprivilegedAddressing:
+			return nil, a64UndefinedError(raw)
+		}
+	}
+	return &n, nil
+}
+
+func parseLoadStoreMultipleA64Instruction(raw uint32) (A64Instruction,
+	error) {
+	var n LoadStoreMultipleA64Instruction
+	n.raw = raw
+	n.Q = (raw & 0x40000000) != 0
+	n.PostIndex = (raw & 0x00800000) != 0
+	n.Load = (raw & 0x00400000) != 0
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.Opcode = uint8((raw >> 12) & 15)
+	n.Size = uint8((raw >> 10) & 3)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rt = A64Register(raw & 0x1f)
+	switch n.Opcode {
+	case 2, 6, 7, 10:
+		return &n, nil
+	case 0, 4, 8:
+		// Only ld1 and st1 can use the 1d arrangement.
+		if n.Q || (n.Size != 3) {
+			return &n, nil
+		}
+	}
+	return nil, a64UndefinedError(raw)
+}
+
+func parseLoadStoreSingleA64Instruction(raw uint32) (A64Instruction, error) {
+	var n LoadStoreSingleA64Instruction
+	n.raw = raw
+	q := uint8((raw >> 30) & 1)
+	n.Q = q != 0
+	n.PostIndex = (raw & 0x00800000) != 0
+	n.Load = (raw & 0x00400000) != 0
+	n.Rm = A64Register((raw >> 16) & 0x1f)
+	n.Rn = A64Register((raw >> 5) & 0x1f)
+	n.Rt = A64Register(raw & 0x1f)
+	opcode := (raw >> 13) & 7
+	n.Count = uint8((((opcode & 1) << 1) | ((raw >> 21) & 1)) + 1)
+	s := uint8((raw >> 12) & 1)
+	size := uint8((raw >> 10) & 3)
+	switch opcode >> 1 {
+	case 0:
+		n.Size = 0
+		n.Index = (q << 3) | (s << 2) | size
+	case 1:
+		if (size & 1) != 0 {
+			return nil, a64UndefinedError(raw)
+		}
+		n.Size = 1
+		n.Index = (q << 2) | (s << 1) | (size >> 1)
+	case 2:
+		if size == 0 {
+			n.Size = 2
+			n.Index = (q << 1) | s
+		} else if (size == 1) && (s == 0) {
+			n.Size = 3
+			n.Index = q
+		} else {
+			return nil, a64UndefinedError(raw)
+		}
+	case 3:
+		if !n.Load || (s != 0) {
+			return nil, a64UndefinedError(raw)
+		}
+		n.Replicate = true
+		n.Size = size
+	}
+	return &n, nil
+}
+
+// Parses the load and store instructions.
+func parseLoadStoreA64Instruction(raw uint32) (A64Instruction, error) {
+	switch {
+	case (raw & 0x3f000000) == 0x08000000:
+		return parseLoadStoreExclusiveA64Instruction(raw)
+	case (raw & 0x3b000000) == 0x18000000:
+		return parseLoadLiteralA64Instruction(raw)
+	case (raw & 0x3a000000) == 0x28000000:
+		return parseLoadStorePairA64Instruction(raw)
+	case (raw & 0x3a000000) == 0x38000000:
+		return parseLoadStoreRegisterA64Instruction(raw)
+	case (raw & 0xbfbf0000) == 0x0c000000:
+		return parseLoadStoreMultipleA64Instruction(raw)
+	case (raw & 0xbfa00000) == 0x0c800000:
+		return parseLoadStoreMultipleA64Instruction(raw)
+	case (raw & 0xbf9f0000) == 0x0d000000:
+		return parseLoadStoreSingleA64Instruction(raw)
+	case (raw & 0xbf800000) == 0x0d800000:
+		return parseLoadStoreSingleA64Instruction(raw)
+	}
+	return nil, a64UndefinedError(raw)
+}
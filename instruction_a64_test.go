@@ -0,0 +1,293 @@
+package arm_emulate
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestA64InstructionStrings(t *testing.T) {
+	expected := map[uint32]string{
+		0x10000080: "adr x0, #16",
+		0xb0000000: "adrp x0, #4096",
+		0x91004020: "add x0, x1, #16",
+		0x91400420: "add x0, x1, #1, lsl #12",
+		0xd10083ff: "sub sp, sp, #32",
+		0x9100003f: "mov sp, x1",
+		0x910003e1: "mov x1, sp",
+		0x1100005f: "mov wsp, w2",
+		0xf100041f: "cmp x0, #1",
+		0x3100147f: "cmn w3, #5",
+		0x92401c20: "and x0, x1, #0xff",
+		0xd200f062: "eor x2, x3, #0x5555555555555555",
+		0x7200003f: "tst w1, #0x1",
+		0xb2089fe0: "mov x0, #-71777214294589696",
+		0x320083e0: "mov w0, #65537",
+		0xd2824680: "mov x0, #4660",
+		0xd2a24680: "mov x0, #305397760",
+		0xf2a24680: "movk x0, #4660, lsl #16",
+		0x92800000: "mov x0, #-1",
+		0x12800020: "mov w0, #-2",
+		0x129fffe0: "movn w0, #65535",
+		0x92c00240: "mov x0, #-77309411329",
+		0xd37df020: "lsl x0, x1, #3",
+		0x937ffc20: "asr x0, x1, #63",
+		0x13010c20: "sbfx w0, w1, #1, #3",
+		0x937e2420: "sbfiz x0, x1, #2, #10",
+		0x33031c20: "bfxil w0, w1, #3, #5",
+		0x13003c20: "sxth w0, w1",
+		0x53001c20: "uxtb w0, w1",
+		0xb3400020: "bfxil x0, x1, #0, #1",
+		0x13811420: "ror w0, w1, #5",
+		0x54ffffe1: "b.ne #-4",
+		0x5400006e: "b.al #12",
+		0xd4000001: "svc #0",
+		0xd4000022: "hvc #0x1",
+		0xd4207d00: "brk #0x3e8",
+		0xd503201f: "nop",
+		0xd503205f: "wfe",
+		0xd503209f: "sev",
+		0xd503245f: "hint #34",
+		0xd5033f9f: "dsb sy",
+		0xd5033f5f: "clrex",
+		0xd5033c9f: "dsb #12",
+		0xd50342df: "msr DAIFSet, #2",
+		0xd5034fff: "msr DAIFClr, #15",
+		0xd50041bf: "msr SPSel, #1",
+		0xd53bd040: "mrs x0, TPIDR_EL0",
+		0xd51bd041: "msr TPIDR_EL0, x1",
+		0xd53b4202: "mrs x2, NZCV",
+		0xd51b4203: "msr NZCV, x3",
+		0xd53b4400: "mrs x0, FPCR",
+		0xd51b4420: "msr FPSR, x0",
+		0xd53be044: "mrs x4, CNTVCT_EL0",
+		0xd53b0025: "mrs x5, CTR_EL0",
+		0xd53b00e6: "mrs x6, DCZID_EL0",
+		0xd5380007: "mrs x7, MIDR_EL1",
+		0xd53bf208: "mrs x8, S3_3_C15_C2_0",
+		0xd50b7420: "dc zva, x0",
+		0xd50b7e21: "dc civac, x1",
+		0xd50b7522: "ic ivau, x2",
+		0xd508751f: "ic iallu",
+		0xd50b7523: "ic ivau, x3",
+		0xd5292380: "sysl x0, #1, c2, c3, #4",
+		0xd63f0020: "blr x1",
+		0xd65f0040: "ret x2",
+		0xd6bf03e0: "drps",
+		0x16000000: "b #-134217728",
+		0x97fffffe: "bl #-8",
+		0x35ffffa1: "cbnz w1, #-12",
+		0xb7ffffe1: "tbnz x1, #63, #-4",
+		0x885f7c20: "ldxr w0, [x1]",
+		0x485f7fe0: "ldxrh w0, [sp]",
+		0xc8027c20: "stxr w2, x0, [x1]",
+		0x08037ca4: "stxrb w3, w4, [x5]",
+		0x887f8440: "ldaxp w0, w1, [x2]",
+		0x88238440: "stlxp w3, w0, w1, [x2]",
+		0x08dffc20: "ldarb w0, [x1]",
+		0x489ffc20: "stlrh w0, [x1]",
+		0x58000040: "ldr x0, #8",
+		0x18ffffe1: "ldr w1, #-4",
+		0x1c000040: "ldr s0, #8",
+		0x5c000041: "ldr d1, #8",
+		0x9c000042: "ldr q2, #8",
+		0xd8000040: "prfm pldl1keep, #8",
+		0xa9ff7bfd: "ldp x29, x30, [sp, #-16]!",
+		0xa9017bfd: "stp x29, x30, [sp, #16]",
+		0xa8c20440: "ldp x0, x1, [x2], #32",
+		0x297f0440: "ldp w0, w1, [x2, #-8]",
+		0x69410440: "ldpsw x0, x1, [x2, #8]",
+		0x28008440: "stnp w0, w1, [x2, #4]",
+		0x2d4107e0: "ldp s0, s1, [sp, #8]",
+		0x6dbf07e0: "stp d0, d1, [sp, #-16]!",
+		0xad410400: "ldp q0, q1, [x0, #32]",
+		0xf9400020: "ldr x0, [x1]",
+		0xf9400420: "ldr x0, [x1, #8]",
+		0xb9400420: "ldr w0, [x1, #4]",
+		0x79400420: "ldrh w0, [x1, #2]",
+		0x39c00020: "ldrsb w0, [x1]",
+		0xb9800820: "ldrsw x0, [x1, #8]",
+		0x39000020: "strb w0, [x1]",
+		0xf8408420: "ldr x0, [x1], #8",
+		0xf85f8c20: "ldr x0, [x1, #-8]!",
+		0xb81fcfe0: "str w0, [sp, #-4]!",
+		0xf85fd020: "ldur x0, [x1, #-3]",
+		0xb89fc020: "ldursw x0, [x1, #-4]",
+		0xf8408820: "ldtr x0, [x1, #8]",
+		0xf8626820: "ldr x0, [x1, x2]",
+		0xf8627820: "ldr x0, [x1, x2, lsl #3]",
+		0xb862c820: "ldr w0, [x1, w2, sxtw]",
+		0xb8625820: "ldr w0, [x1, w2, uxtw #2]",
+		0x38626820: "ldrb w0, [x1, x2]",
+		0x7862f820: "ldrh w0, [x1, x2, sxtx #1]",
+		0x3d400020: "ldr b0, [x1]",
+		0x7d400420: "ldr h0, [x1, #2]",
+		0xbd400420: "ldr s0, [x1, #4]",
+		0xfd400420: "ldr d0, [x1, #8]",
+		0x3dc00420: "ldr q0, [x1, #16]",
+		0xfc5f8022: "ldur d2, [x1, #-8]",
+		0xbc627823: "ldr s3, [x1, x2, lsl #2]",
+		0xfc008424: "str d4, [x1], #8",
+		0xf9800000: "prfm pldl1keep, [x0]",
+		0xf9800433: "prfm pstl2strm, [x1, #8]",
+		0xf9800016: "prfm #22, [x0]",
+		0xf8a16800: "prfm pldl1keep, [x0, x1]",
+		0x8a020020: "and x0, x1, x2",
+		0x8a621020: "bic x0, x1, x2, lsr #4",
+		0x2ae21820: "orn w0, w1, w2, ror #6",
+		0xca220020: "eon x0, x1, x2",
+		0x6a220020: "bics w0, w1, w2",
+		0xaa0103e0: "mov x0, x1",
+		0x2a0103e0: "mov w0, w1",
+		0x2a210be0: "mvn w0, w1, lsl #2",
+		0x6a41041f: "tst w0, w1, lsr #1",
+		0x8b020020: "add x0, x1, x2",
+		0xcb820c20: "sub x0, x1, x2, asr #3",
+		0x6b427c20: "subs w0, w1, w2, lsr #31",
+		0xeb01001f: "cmp x0, x1",
+		0x6b01081f: "cmp w0, w1, lsl #2",
+		0xcb0103e0: "neg x0, x1",
+		0xeb0103e0: "negs x0, x1",
+		0x8b22c820: "add x0, x1, w2, sxtw #2",
+		0x8b2163e0: "add x0, sp, x1",
+		0x0b220020: "add w0, w1, w2, uxtb",
+		0xab2163e0: "adds x0, sp, x1",
+		0xeb2163ff: "cmp sp, x1",
+		0xeb22403f: "cmp x1, w2, uxtw",
+		0x9a020020: "adc x0, x1, x2",
+		0xda020020: "sbc x0, x1, x2",
+		0xda0103e0: "ngc x0, x1",
+		0xfa431804: "ccmp x0, #3, #4, ne",
+		0xba5fe80f: "ccmn x0, #31, #15, al",
+		0x9a820020: "csel x0, x1, x2, eq",
+		0x9a82a420: "csinc x0, x1, x2, ge",
+		0xda82c420: "csneg x0, x1, x2, gt",
+		0x9a9f17e0: "cset x0, eq",
+		0x1a9f27e0: "cset w0, lo",
+		0x9a811420: "cinc x0, x1, eq",
+		0xda817420: "cneg x0, x1, vs",
+		0xdac00020: "rbit x0, x1",
+		0xdac00820: "rev32 x0, x1",
+		0x5ac00820: "rev w0, w1",
+		0x5ac01420: "cls w0, w1",
+		0x1ac20c20: "sdiv w0, w1, w2",
+		0x1ac22420: "lsr w0, w1, w2",
+		0x1ac22c20: "ror w0, w1, w2",
+		0x9ac24c20: "crc32x w0, w1, x2",
+		0x9b020c20: "madd x0, x1, x2, x3",
+		0x9b027c20: "mul x0, x1, x2",
+		0x9b220c20: "smaddl x0, w1, w2, x3",
+		0x9b227c20: "smull x0, w1, w2",
+		0x9ba20c20: "umaddl x0, w1, w2, x3",
+		0x9ba2fc20: "umnegl x0, w1, w2",
+		0x9bc27c20: "umulh x0, x1, x2",
+		0x4c407000: "ld1 { v0.16b }, [x0]",
+		0x4cdfa820: "ld1 { v0.4s, v1.4s }, [x1], #32",
+		0x4c830440: "st4 { v0.8h, v1.8h, v2.8h, v3.8h }, [x2], x3",
+		0x4ddb52c7: "ld1 { v7.h }[6], [x22], x27",
+		0x4d008462: "st1 { v2.d }[1], [x3]",
+		0x4ddfebe1: "ld3r { v1.4s, v2.4s, v3.4s }, [sp], #12",
+		0xd508831f: "tlbi vmalle1is",
+		0xd5087800: "at s1e1r, x0",
+		0x92e7ffd3: "mov x19, #-4611123068473966593",
+		0x321f7bff: "orr wsp, wzr, #0xfffffffe",
+		0x1e222820: "fadd s0, s1, s2",
+		0x1e621820: "fdiv d0, d1, d2",
+		0x1e228820: "fnmul s0, s1, s2",
+		0x1e224820: "fmax s0, s1, s2",
+		0x1e20c020: "fabs s0, s1",
+		0x1e674020: "frintx d0, d1",
+		0x1e264020: "frinta s0, s1",
+		0x1e221c20: "fcsel s0, s1, s2, ne",
+		0x1e212010: "fcmpe s0, s1",
+		0x1e602008: "fcmp d0, #0.0",
+		0x1e61241f: "fccmpe d0, d1, #15, hs",
+		0x1e281001: "fmov s1, #0.12500000",
+		0x1e67f001: "fmov d1, #31.00000000",
+		0x1e270001: "fmov s1, w0",
+		0x9eaf0001: "fmov v1.d[1], x0",
+		0x1e630020: "ucvtf d0, w1",
+		0x1e300020: "fcvtms w0, s1",
+		0x9e650020: "fcvtau x0, d1",
+		0x9e598020: "fcvtzu x0, d1, #32",
+		0x1e02f420: "scvtf s0, w1, #3",
+		0x1e22c020: "fcvt d0, s1",
+		0x1f020c20: "fmadd s0, s1, s2, s3",
+	}
+	for raw, s := range expected {
+		n, e := ParseA64Instruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != s {
+			t.Logf("Expected 0x%08x to be %s, got %s\n", raw, s, n)
+			t.Fail()
+		}
+	}
+}
+
+func TestA64UndefinedInstructions(t *testing.T) {
+	// These are udf, a vector add (Advanced SIMD isn't supported), a
+	// half-precision fadd, csel with the S bit set, move wide with opc set to
+	// 1, extr with N clear, a 32-bit add with a shift of 32, ldnp with ldpsw's
+	// opcode and a system register with op0 set to 0.
+	undefined := []uint32{0x00000000, 0x4ea28420, 0x1ee22820, 0xba820020,
+		0xb2800000, 0x93823020, 0x0b028020, 0x68400440, 0xd5002d8d}
+	for _, raw := range undefined {
+		n, e := ParseA64Instruction(raw)
+		if e == nil {
+			t.Logf("Didn't get an error for 0x%08x (parsed as %s).\n", raw, n)
+			t.Fail()
+			continue
+		}
+		if !errors.Is(e, errUndefinedInstruction) {
+			t.Logf("Got an unexpected error for 0x%08x: %s\n", raw, e)
+			t.Fail()
+		}
+	}
+}
+
+func TestA64InstructionFields(t *testing.T) {
+	// ldp x29, x30, [sp, #-16]!
+	n, e := ParseA64Instruction(0xa9ff7bfd)
+	if e != nil {
+		t.Logf("Failed parsing ldp: %s\n", e)
+		t.FailNow()
+	}
+	pair, ok := n.(*LoadStorePairA64Instruction)
+	if !ok {
+		t.Logf("Expected a LoadStorePairA64Instruction, got %T\n", n)
+		t.FailNow()
+	}
+	if !pair.Load || (pair.Rt != 29) || (pair.Rt2 != 30) || (pair.Rn != 31) {
+		t.Logf("Got incorrect ldp registers: %+v\n", pair)
+		t.Fail()
+	}
+	if pair.offset() != -16 {
+		t.Logf("Expected an ldp offset of -16, got %d\n", pair.offset())
+		t.Fail()
+	}
+	// mov x0, #0xff00ff00ff00ff00
+	n, e = ParseA64Instruction(0xb2089fe0)
+	if e != nil {
+		t.Logf("Failed parsing orr: %s\n", e)
+		t.FailNow()
+	}
+	value := n.(*LogicalImmediateA64Instruction).Value()
+	if value != 0xff00ff00ff00ff00 {
+		t.Logf("Expected a bitmask of 0xff00ff00ff00ff00, got 0x%x\n", value)
+		t.Fail()
+	}
+	// bl #-8
+	n, e = ParseA64Instruction(0x97fffffe)
+	if e != nil {
+		t.Logf("Failed parsing bl: %s\n", e)
+		t.FailNow()
+	}
+	if n.(*BranchA64Instruction).offset() != -8 {
+		t.Logf("Got incorrect bl offset: %d\n",
+			n.(*BranchA64Instruction).offset())
+		t.Fail()
+	}
+}
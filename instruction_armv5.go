@@ -0,0 +1,416 @@
+package arm_emulate
+
+// This file contains the instructions added to the ARM instruction set in
+// ARMv5TE.
+
+import (
+	"fmt"
+	"strings"
+)
+
+type CountLeadingZerosInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	Rm ARMRegister
+}
+
+func (n *CountLeadingZerosInstruction) String() string {
+	return fmt.Sprintf("clz%s %s, %s", n.Condition(), n.Rd, n.Rm)
+}
+
+func (n *CountLeadingZerosInstruction) Encode() (uint32, error) {
+	if n.thumb2 {
+		return n.encodeTHUMB2()
+	}
+	c := instructionEncoder{raw: 0x016f0f10}
+	c.condition(n.Condition())
+	c.register("Rd", n.Rd, 12)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+type BreakpointInstruction struct {
+	basicARMInstruction
+	Comment uint16
+}
+
+func (n *BreakpointInstruction) String() string {
+	return fmt.Sprintf("bkpt %04x", n.Comment)
+}
+
+// bkpt is always unconditional.
+func (n *BreakpointInstruction) Encode() (uint32, error) {
+	comment := uint32(n.Comment)
+	return 0xe1200070 | ((comment & 0xfff0) << 4) | (comment & 0xf), nil
+}
+
+var saturatingOpcodeStrings = [...]string{"qadd", "qsub", "qdadd", "qdsub"}
+
+// The qadd, qsub, qdadd and qdsub instructions.
+type SaturatingArithmeticInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	Rm ARMRegister
+	Rn ARMRegister
+	// Set for qsub and qdsub.
+	Subtract bool
+	// Set for qdadd and qdsub, which saturate twice Rn before using it.
+	Double bool
+}
+
+func (n *SaturatingArithmeticInstruction) String() string {
+	opcode := 0
+	if n.Subtract {
+		opcode |= 1
+	}
+	if n.Double {
+		opcode |= 2
+	}
+	return fmt.Sprintf("%s%s %s, %s, %s", saturatingOpcodeStrings[opcode],
+		n.Condition(), n.Rd, n.Rm, n.Rn)
+}
+
+func (n *SaturatingArithmeticInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x01000050}
+	c.condition(n.Condition())
+	c.flag(n.Double, 0x400000)
+	c.flag(n.Subtract, 0x200000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The smla<x><y>, smlaw<y>, smulw<y>, smlal<x><y> and smul<x><y>
+// instructions, which multiply signed halfwords.
+type SignedHalfwordMultiplyInstruction struct {
+	basicARMInstruction
+	Rm     ARMRegister
+	Rs     ARMRegister
+	Rn     ARMRegister
+	Rd     ARMRegister
+	RdLow  ARMRegister
+	RdHigh ARMRegister
+	// These are set if the top halfword of Rm or Rs is used.
+	RmTop bool
+	RsTop bool
+	// This is set for smlaw and smulw, which multiply all of Rm by a halfword
+	// of Rs and keep the top 32 bits of the 48-bit product.
+	Word           bool
+	Accumulate     bool
+	IsLongMultiply bool
+}
+
+func halfwordSelectorString(top bool) string {
+	if top {
+		return "t"
+	}
+	return "b"
+}
+
+func (n *SignedHalfwordMultiplyInstruction) String() string {
+	var start string
+	if n.Accumulate {
+		start = "smla"
+	} else {
+		start = "smul"
+	}
+	if n.IsLongMultiply {
+		start += "l"
+	}
+	if n.Word {
+		start += "w"
+	} else {
+		start += halfwordSelectorString(n.RmTop)
+	}
+	start += halfwordSelectorString(n.RsTop)
+	start += n.Condition().String()
+	if n.IsLongMultiply {
+		return fmt.Sprintf("%s %s, %s, %s, %s", start, n.RdLow, n.RdHigh, n.Rm,
+			n.Rs)
+	}
+	if !n.Accumulate {
+		return fmt.Sprintf("%s %s, %s, %s", start, n.Rd, n.Rm, n.Rs)
+	}
+	return fmt.Sprintf("%s %s, %s, %s, %s", start, n.Rd, n.Rm, n.Rs, n.Rn)
+}
+
+func (n *SignedHalfwordMultiplyInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x01000080}
+	c.condition(n.Condition())
+	c.register("Rs", n.Rs, 8)
+	c.register("Rm", n.Rm, 0)
+	c.flag(n.RsTop, 0x40)
+	if n.Word {
+		if n.IsLongMultiply || n.RmTop {
+			c.fail("smlaw and smulw can't be long or use the top of Rm")
+		}
+		// The bit which selects the halfword of Rm instead selects smulw.
+		c.raw |= 0x200000
+		c.flag(!n.Accumulate, 0x20)
+	} else {
+		c.flag(n.RmTop, 0x20)
+	}
+	if n.IsLongMultiply {
+		if !n.Accumulate {
+			c.fail("Long halfword multiplies must accumulate")
+		}
+		c.raw |= 0x400000
+		c.register("RdHigh", n.RdHigh, 16)
+		c.register("RdLow", n.RdLow, 12)
+		return c.result()
+	}
+	c.flag(!n.Word && !n.Accumulate, 0x600000)
+	c.register("Rd", n.Rd, 16)
+	c.register("Rn", n.Rn, 12)
+	return c.result()
+}
+
+// The pld instruction, which uses the same addressing modes as ldr.
+type PreloadInstruction struct {
+	SingleDataTransferInstruction
+}
+
+func (n *PreloadInstruction) String() string {
+	s := n.SingleDataTransferInstruction.String()
+	return "pld" + s[strings.Index(s, ",")+1:]
+}
+
+func (n *PreloadInstruction) pcRelativeString(target string) string {
+	return "pld " + target
+}
+
+// pld always uses a preindexed address without writeback, so the other
+// fields of the single data transfer are ignored.
+func (n *PreloadInstruction) Encode() (uint32, error) {
+	transfer := n.SingleDataTransferInstruction
+	transfer.SetCondition(15)
+	transfer.Rd = 15
+	transfer.Load = true
+	transfer.ByteQuantity = true
+	transfer.Preindex = true
+	transfer.WriteBack = false
+	return transfer.Encode()
+}
+
+// The mcrr and mrrc instructions, which transfer two ARM registers to or from
+// a coprocessor.
+type CoprocDoubleRegisterTransferInstruction struct {
+	basicARMInstruction
+	Rd           ARMRegister
+	Rn           ARMRegister
+	Load         bool
+	CoprocNumber uint8
+	CoprocOpcode uint8
+	CoprocRm     uint8
+}
+
+func (n *CoprocDoubleRegisterTransferInstruction) String() string {
+	var start string
+	if n.Load {
+		start = "mrrc"
+	} else {
+		start = "mcrr"
+	}
+	start += n.Condition().String()
+	return fmt.Sprintf("%s p%d, %d, %s, %s, c%d", start, n.CoprocNumber,
+		n.CoprocOpcode, n.Rd, n.Rn, n.CoprocRm)
+}
+
+func (n *CoprocDoubleRegisterTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0c400000}
+	c.condition(n.Condition())
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	c.field("CoprocNumber", uint32(n.CoprocNumber), 8, 4)
+	c.field("CoprocOpcode", uint32(n.CoprocOpcode), 4, 4)
+	c.field("CoprocRm", uint32(n.CoprocRm), 0, 4)
+	return c.result()
+}
+
+func parseCountLeadingZerosInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn CountLeadingZerosInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	if (toReturn.Rd == 15) || (toReturn.Rm == 15) {
+		return nil, fmt.Errorf("clz can't use r15")
+	}
+	return &toReturn, nil
+}
+
+func parseBreakpointInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn BreakpointInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Comment = uint16(((raw >> 4) & 0xfff0) | (raw & 0xf))
+	return &toReturn, nil
+}
+
+func parseSaturatingArithmeticInstruction(raw uint32) (ARMInstruction,
+	error) {
+	var toReturn SaturatingArithmeticInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Subtract = (raw & 0x200000) != 0
+	toReturn.Double = (raw & 0x400000) != 0
+	if (toReturn.Rd == 15) || (toReturn.Rm == 15) || (toReturn.Rn == 15) {
+		return nil, fmt.Errorf("Saturating arithmetic can't use r15")
+	}
+	return &toReturn, nil
+}
+
+func parseSignedHalfwordMultiplyInstruction(raw uint32) (ARMInstruction,
+	error) {
+	var toReturn SignedHalfwordMultiplyInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rs = ARMRegister(uint8((raw >> 8) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.RmTop = (raw & 0x20) != 0
+	toReturn.RsTop = (raw & 0x40) != 0
+	switch (raw >> 21) & 3 {
+	case 0:
+		toReturn.Accumulate = true
+	case 1:
+		toReturn.Word = true
+		toReturn.Accumulate = !toReturn.RmTop
+		toReturn.RmTop = false
+	case 2:
+		toReturn.Accumulate = true
+		toReturn.IsLongMultiply = true
+		toReturn.RdLow = toReturn.Rn
+		toReturn.RdHigh = toReturn.Rd
+	}
+	if (toReturn.Rd == 15) || (toReturn.Rm == 15) || (toReturn.Rs == 15) ||
+		(toReturn.Accumulate && (toReturn.Rn == 15)) {
+		return nil, fmt.Errorf("Multiply can't use r15")
+	}
+	if toReturn.IsLongMultiply && (toReturn.RdLow == toReturn.RdHigh) {
+		return nil, fmt.Errorf("Multiply rdlo and rdhi must differ.")
+	}
+	return &toReturn, nil
+}
+
+func parseDoublewordDataTransferInstruction(raw uint32) (ARMInstruction,
+	error) {
+	generic, _ := parseHalfwordDataTransferInstruction(raw)
+	toReturn := generic.(*HalfwordDataTransferInstruction)
+	toReturn.Doubleword = true
+	toReturn.Load = (raw & 0x20) == 0
+	toReturn.Signed = false
+	toReturn.Halfword = false
+	if (toReturn.Rd & 1) != 0 {
+		return nil, fmt.Errorf("ldrd and strd require an even register")
+	}
+	return toReturn, nil
+}
+
+func parsePreloadInstruction(raw uint32) (ARMInstruction, error) {
+	generic, e := parseSingleDataTransferInstruction(raw)
+	if e != nil {
+		return generic, e
+	}
+	var toReturn PreloadInstruction
+	toReturn.SingleDataTransferInstruction =
+		*(generic.(*SingleDataTransferInstruction))
+	toReturn.SetCondition(14)
+	return &toReturn, nil
+}
+
+func parseCoprocDoubleRegisterTransferInstruction(raw uint32) (
+	ARMInstruction, error) {
+	var toReturn CoprocDoubleRegisterTransferInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.CoprocRm = uint8(raw & 0xf)
+	toReturn.CoprocOpcode = uint8((raw >> 4) & 0xf)
+	toReturn.CoprocNumber = uint8((raw >> 8) & 0xf)
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Load = (raw & 0x100000) != 0
+	if (toReturn.Rd == 15) || (toReturn.Rn == 15) {
+		return nil, fmt.Errorf("mcrr and mrrc can't use r15")
+	}
+	return &toReturn, nil
+}
+
+// Parses the ARMv5TE instructions with the "never" condition, which are
+// executed unconditionally.
+func parseUnconditionalInstruction(raw uint32) (ARMInstruction, error) {
+	if (raw & 0xfe000000) == 0xfa000000 {
+		generic, _ := parseBranchInstruction(raw)
+		toReturn := generic.(*BranchInstruction)
+		toReturn.SetCondition(14)
+		toReturn.Link = true
+		toReturn.Exchange = true
+		toReturn.HalfwordOffset = (raw & 0x1000000) != 0
+		return toReturn, nil
+	}
+	if (raw & 0xfd70f000) == 0xf550f000 {
+		return parsePreloadInstruction(raw)
+	}
+	// The coprocessor instructions, aside from mcrr and mrrc.
+	if ((raw & 0x0e000000) == 0x0c000000) &&
+		((raw & 0x0fe00000) != 0x0c400000) {
+		generic, _ := parseCoprocDataTransferInstruction(raw)
+		toReturn := generic.(*CoprocDataTransferInstruction)
+		toReturn.SetCondition(14)
+		toReturn.Unconditional = true
+		return toReturn, nil
+	}
+	if (raw & 0x0f000010) == 0x0e000000 {
+		generic, _ := parseCoprocDataOperationInstruction(raw)
+		toReturn := generic.(*CoprocDataOperationInstruction)
+		toReturn.SetCondition(14)
+		toReturn.Unconditional = true
+		return toReturn, nil
+	}
+	if (raw & 0x0f000010) == 0x0e000010 {
+		generic, _ := parseCoprocRegisterTransferInstruction(raw)
+		toReturn := generic.(*CoprocRegisterTransferInstruction)
+		toReturn.SetCondition(14)
+		toReturn.Unconditional = true
+		return toReturn, nil
+	}
+	return parseUndefinedInstruction(raw)
+}
+
+func parseARMv5TEInstruction(raw uint32) (ARMInstruction, error) {
+	if (raw >> 28) == 0xf {
+		return parseUnconditionalInstruction(raw)
+	}
+	if (raw & 0x0fe00000) == 0x0c400000 {
+		return parseCoprocDoubleRegisterTransferInstruction(raw)
+	}
+	if (raw & 0x0e000000) == 0 {
+		if (raw & 0x0fff0ff0) == 0x016f0f10 {
+			return parseCountLeadingZerosInstruction(raw)
+		}
+		if (raw & 0xfff000f0) == 0xe1200070 {
+			return parseBreakpointInstruction(raw)
+		}
+		if (raw & 0x0ffffff0) == 0x012fff30 {
+			generic, _ := parseBranchExchangeInstruction(raw)
+			generic.(*BranchExchangeInstruction).Link = true
+			return generic, nil
+		}
+		if (raw & 0x0f900ff0) == 0x01000050 {
+			return parseSaturatingArithmeticInstruction(raw)
+		}
+		if (raw & 0x0f900090) == 0x01000080 {
+			return parseSignedHalfwordMultiplyInstruction(raw)
+		}
+		if (raw & 0x0e1000d0) == 0x000000d0 {
+			return parseDoublewordDataTransferInstruction(raw)
+		}
+	}
+	return parseARMv4TInstruction(raw)
+}
@@ -0,0 +1,95 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func TestARMv5TEInstructionStrings(t *testing.T) {
+	expected := map[uint32]string{
+		0xe16f0f11: "clz r0, r1",
+		0x116f2f13: "clzne r2, r3",
+		0xe1212374: "bkpt 1234",
+		0xe12fff33: "blx r3",
+		0xe1020051: "qadd r0, r1, r2",
+		0xe1620051: "qdsub r0, r1, r2",
+		0xe1003281: "smlabb r0, r1, r2, r3",
+		0xe10032a1: "smlatb r0, r1, r2, r3",
+		0xe1203281: "smlawb r0, r1, r2, r3",
+		0xe12002e1: "smulwt r0, r1, r2",
+		0xe14103c2: "smlalbt r0, r1, r2, r3",
+		0xe16002e1: "smultt r0, r1, r2",
+		0xe1c020d8: "ldrd r2, [r0, 8]",
+		0xe16020f8: "strd r2, [r0, -8]!",
+		0xec410f02: "mcrr p15, 0, r0, r1, c2",
+		0xec532534: "mrrc p5, 3, r2, r3, c4",
+		0xf5d1f004: "pld [r1, 4]",
+		0xfa000001: "blx 4",
+		0xfb000001: "blx 6",
+		0xfe000000: "cdp2 p0, 0, c0, c0, c0, 0",
+		0xfe100010: "mrc2 p0, 0, r0, c0, c0, 0",
+		0xfd900000: "ldc2 p0, c0, [r0]",
+	}
+	for raw, s := range expected {
+		n, e := ParseInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != s {
+			t.Logf("Expected 0x%08x to be %s, got %s\n", raw, s, n)
+			t.Fail()
+		}
+	}
+	// ldrd and strd require an even register.
+	_, e := ParseInstruction(0xe1c030d0)
+	if e == nil {
+		t.Logf("Didn't get an error for ldrd with an odd register.\n")
+		t.Fail()
+	}
+	thumbExpected := map[uint16]string{
+		0xbe12: "bkpt 18",
+		0x4790: "blx r2",
+		0xe802: "blx lr + 4 (long branch and link)",
+	}
+	for raw, s := range thumbExpected {
+		n, e := ParseTHUMBInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%04x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != s {
+			t.Logf("Expected 0x%04x to be %s, got %s\n", raw, s, n)
+			t.Fail()
+		}
+	}
+	_, e = ParseTHUMBInstruction(0xe801)
+	if e == nil {
+		t.Logf("Didn't get an error for blx with an odd offset.\n")
+		t.Fail()
+	}
+}
+
+func TestARMv4TInstructions(t *testing.T) {
+	n, e := ParseInstructionForArchitecture(0xe16f0f11, ARMv4T)
+	if (e == nil) && (n.String() == "clz r0, r1") {
+		t.Logf("Parsed clz for ARMv4T.\n")
+		t.Fail()
+	}
+	n, e = ParseInstructionForArchitecture(0xe12fff33, ARMv4T)
+	if (e == nil) && (n.String() == "blx r3") {
+		t.Logf("Parsed blx for ARMv4T.\n")
+		t.Fail()
+	}
+	thumb, e := ParseTHUMBInstructionForArchitecture(0x4790, ARMv4T)
+	if (e != nil) || (thumb.String() != "bx r2") {
+		t.Logf("Expected bx r2 for ARMv4T, got %v (%v)\n", thumb, e)
+		t.Fail()
+	}
+	_, e = ParseInstructionForArchitecture(0xe1a00000, ARMArchitecture(100))
+	if e == nil {
+		t.Logf("Didn't get an error for an invalid architecture.\n")
+		t.Fail()
+	}
+}
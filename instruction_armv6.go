@@ -0,0 +1,886 @@
+package arm_emulate
+
+// This file contains the instructions added to the ARM instruction set in
+// ARMv6.
+
+import (
+	"fmt"
+)
+
+// The ldrex and strex instructions.
+type ExclusiveLoadStoreInstruction struct {
+	basicARMInstruction
+	// For strex, this receives 0 if the store succeeded and 1 otherwise.
+	Rd ARMRegister
+	Rn ARMRegister
+	// The register stored by strex.
+	Rm   ARMRegister
+	Load bool
+	// The offset from Rn, in words. This is only nonzero in Thumb-2.
+	Offset uint8
+}
+
+func (n *ExclusiveLoadStoreInstruction) addressString() string {
+	if n.Offset == 0 {
+		return fmt.Sprintf("[%s]", n.Rn)
+	}
+	return fmt.Sprintf("[%s, %d]", n.Rn, uint16(n.Offset)<<2)
+}
+
+func (n *ExclusiveLoadStoreInstruction) String() string {
+	if n.Load {
+		return fmt.Sprintf("ldrex%s %s, %s", n.Condition(), n.Rd,
+			n.addressString())
+	}
+	return fmt.Sprintf("strex%s %s, %s, %s", n.Condition(), n.Rd, n.Rm,
+		n.addressString())
+}
+
+func (n *ExclusiveLoadStoreInstruction) Encode() (uint32, error) {
+	if n.thumb2 {
+		return n.encodeTHUMB2()
+	}
+	c := instructionEncoder{raw: 0x01800f90}
+	c.condition(n.Condition())
+	if n.Offset != 0 {
+		c.fail("ldrex and strex can only use an offset in Thumb-2")
+	}
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	if n.Load {
+		c.raw |= 0x10000f
+	} else {
+		c.register("Rm", n.Rm, 0)
+	}
+	return c.result()
+}
+
+// The rev, rev16 and revsh instructions.
+type ReverseBytesInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	Rm ARMRegister
+	// Set for rev16 and revsh, which reverse the bytes in each halfword.
+	Halfwords bool
+	// Set for revsh, which sign-extends the bottom halfword.
+	Signed bool
+}
+
+func (n *ReverseBytesInstruction) String() string {
+	start := "rev"
+	if n.Signed {
+		start += "sh"
+	} else if n.Halfwords {
+		start += "16"
+	}
+	return fmt.Sprintf("%s%s %s, %s", start, n.Condition(), n.Rd, n.Rm)
+}
+
+func (n *ReverseBytesInstruction) Encode() (uint32, error) {
+	if n.thumb2 {
+		return n.encodeTHUMB2()
+	}
+	c := instructionEncoder{raw: 0x06bf0f30}
+	c.condition(n.Condition())
+	if n.Signed && !n.Halfwords {
+		c.fail("revsh must reverse halfwords")
+	}
+	c.flag(n.Signed, 0x400000)
+	c.flag(n.Halfwords, 0x80)
+	c.register("Rd", n.Rd, 12)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The sxtb, sxth, sxtb16, uxtb, uxth and uxtb16 instructions, and their
+// accumulating forms such as sxtab.
+type ExtendInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	// Rn is added to the extended value, unless it's r15.
+	Rn ARMRegister
+	Rm ARMRegister
+	// Rm is rotated right by this number of bytes before being extended.
+	Rotate   uint8
+	Unsigned bool
+	Halfword bool
+	// Set for sxtb16 and uxtb16, which extend two bytes into two halfwords.
+	Dual bool
+}
+
+func (n *ExtendInstruction) String() string {
+	var start string
+	if n.Unsigned {
+		start = "uxt"
+	} else {
+		start = "sxt"
+	}
+	if n.Rn != 15 {
+		start += "a"
+	}
+	if n.Halfword {
+		start += "h"
+	} else {
+		start += "b"
+	}
+	if n.Dual {
+		start += "16"
+	}
+	start += n.Condition().String()
+	var rotate string
+	if n.Rotate != 0 {
+		rotate = fmt.Sprintf(", ror %d", n.Rotate*8)
+	}
+	if n.Rn == 15 {
+		return fmt.Sprintf("%s %s, %s%s", start, n.Rd, n.Rm, rotate)
+	}
+	return fmt.Sprintf("%s %s, %s, %s%s", start, n.Rd, n.Rn, n.Rm, rotate)
+}
+
+func (n *ExtendInstruction) Encode() (uint32, error) {
+	if n.thumb2 {
+		return n.encodeTHUMB2()
+	}
+	c := instructionEncoder{raw: 0x06800070}
+	c.condition(n.Condition())
+	if n.Dual && n.Halfword {
+		c.fail("sxtb16 and uxtb16 can't extend halfwords")
+	}
+	c.flag(n.Unsigned, 0x400000)
+	c.flag(!n.Dual, 0x200000)
+	c.flag(n.Halfword, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	c.field("Rotate", uint32(n.Rotate), 10, 2)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+var parallelPrefixStrings = [...]string{"", "s", "q", "sh", "", "u", "uq",
+	"uh"}
+
+var parallelOperationStrings = [...]string{"add16", "addsubx", "subaddx",
+	"sub16", "add8", "", "", "sub8"}
+
+// The parallel add and subtract instructions, such as sadd16 and uqsub8.
+type ParallelArithmeticInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	Rn ARMRegister
+	Rm ARMRegister
+	// Selects signed (1, 2, 3) or unsigned (5, 6, 7) arithmetic, which is
+	// modular (1, 5), saturating (2, 6) or halving (3, 7).
+	Prefix uint8
+	// Selects the operation, in the order of parallelOperationStrings.
+	Operation uint8
+}
+
+func (n *ParallelArithmeticInstruction) String() string {
+	return fmt.Sprintf("%s%s%s %s, %s, %s", parallelPrefixStrings[n.Prefix],
+		parallelOperationStrings[n.Operation], n.Condition(), n.Rd, n.Rn, n.Rm)
+}
+
+func (n *ParallelArithmeticInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x06000f10}
+	c.condition(n.Condition())
+	c.field("Prefix", uint32(n.Prefix), 20, 3)
+	c.field("Operation", uint32(n.Operation), 5, 3)
+	if (c.e == nil) && ((parallelPrefixStrings[n.Prefix] == "") ||
+		(parallelOperationStrings[n.Operation] == "")) {
+		c.fail("Invalid parallel arithmetic prefix %d or operation %d",
+			n.Prefix, n.Operation)
+	}
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The sel instruction, which selects each byte from Rn or Rm using the GE
+// flags.
+type SelectBytesInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	Rn ARMRegister
+	Rm ARMRegister
+}
+
+func (n *SelectBytesInstruction) String() string {
+	return fmt.Sprintf("sel%s %s, %s, %s", n.Condition(), n.Rd, n.Rn, n.Rm)
+}
+
+func (n *SelectBytesInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x06800fb0}
+	c.condition(n.Condition())
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The usad8 and usada8 instructions.
+type SumAbsoluteDifferencesInstruction struct {
+	basicARMInstruction
+	Rd         ARMRegister
+	Rn         ARMRegister
+	Rs         ARMRegister
+	Rm         ARMRegister
+	Accumulate bool
+}
+
+func (n *SumAbsoluteDifferencesInstruction) String() string {
+	if n.Accumulate {
+		return fmt.Sprintf("usada8%s %s, %s, %s, %s", n.Condition(), n.Rd, n.Rm,
+			n.Rs, n.Rn)
+	}
+	return fmt.Sprintf("usad8%s %s, %s, %s", n.Condition(), n.Rd, n.Rm, n.Rs)
+}
+
+// Rn is ignored by usad8, which is encoded with Rn set to r15.
+func (n *SumAbsoluteDifferencesInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x07800010}
+	c.condition(n.Condition())
+	c.register("Rd", n.Rd, 16)
+	if !n.Accumulate {
+		c.raw |= 0xf000
+	} else if n.Rn == 15 {
+		c.fail("usada8 can't accumulate r15")
+	} else {
+		c.register("Rn", n.Rn, 12)
+	}
+	c.register("Rs", n.Rs, 8)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The ssat, usat, ssat16 and usat16 instructions.
+type SaturateInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	Rn ARMRegister
+	// The saturation position field. For signed saturation, the value is
+	// saturated to this number of bits + 1.
+	SaturatePosition uint8
+	ShiftAmount      uint8
+	// Rn is shifted left unless this is set, in which case it is shifted
+	// right arithmetically. A right shift of 0 means a shift of 32.
+	ShiftRight bool
+	Unsigned   bool
+	// Set for ssat16 and usat16, which saturate each halfword.
+	Dual bool
+}
+
+// Returns the number of bits to saturate to.
+func (n *SaturateInstruction) saturateBits() uint8 {
+	if n.Unsigned {
+		return n.SaturatePosition
+	}
+	return n.SaturatePosition + 1
+}
+
+func (n *SaturateInstruction) String() string {
+	var start string
+	if n.Unsigned {
+		start = "usat"
+	} else {
+		start = "ssat"
+	}
+	if n.Dual {
+		start += "16"
+	}
+	start += n.Condition().String()
+	s := fmt.Sprintf("%s %s, %d, %s", start, n.Rd, n.saturateBits(), n.Rn)
+	if n.ShiftRight {
+		amount := n.ShiftAmount
+		if amount == 0 {
+			amount = 32
+		}
+		s += fmt.Sprintf(", asr %d", amount)
+	} else if n.ShiftAmount != 0 {
+		s += fmt.Sprintf(", lsl %d", n.ShiftAmount)
+	}
+	return s
+}
+
+func (n *SaturateInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x06a00010}
+	c.condition(n.Condition())
+	c.flag(n.Unsigned, 0x400000)
+	c.register("Rd", n.Rd, 12)
+	c.register("Rn", n.Rn, 0)
+	if n.Dual {
+		if (n.ShiftAmount != 0) || n.ShiftRight {
+			c.fail("ssat16 and usat16 can't shift Rn")
+		}
+		c.raw |= 0xf20
+		c.field("SaturatePosition", uint32(n.SaturatePosition), 16, 4)
+		return c.result()
+	}
+	c.field("SaturatePosition", uint32(n.SaturatePosition), 16, 5)
+	c.field("ShiftAmount", uint32(n.ShiftAmount), 7, 5)
+	c.flag(n.ShiftRight, 0x40)
+	return c.result()
+}
+
+// The pkhbt and pkhtb instructions.
+type PackHalfwordInstruction struct {
+	basicARMInstruction
+	Rd ARMRegister
+	Rn ARMRegister
+	Rm ARMRegister
+	// For pkhbt, Rm is shifted left by this amount. For pkhtb, it's shifted
+	// right arithmetically, with 0 meaning 32.
+	ShiftAmount uint8
+	// Set for pkhtb, which takes the top halfword from Rn and the bottom
+	// halfword from Rm.
+	TopBottom bool
+}
+
+func (n *PackHalfwordInstruction) String() string {
+	if n.TopBottom {
+		amount := n.ShiftAmount
+		if amount == 0 {
+			amount = 32
+		}
+		return fmt.Sprintf("pkhtb%s %s, %s, %s, asr %d", n.Condition(), n.Rd,
+			n.Rn, n.Rm, amount)
+	}
+	s := fmt.Sprintf("pkhbt%s %s, %s, %s", n.Condition(), n.Rd, n.Rn, n.Rm)
+	if n.ShiftAmount != 0 {
+		s += fmt.Sprintf(", lsl %d", n.ShiftAmount)
+	}
+	return s
+}
+
+func (n *PackHalfwordInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x06800010}
+	c.condition(n.Condition())
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 12)
+	c.field("ShiftAmount", uint32(n.ShiftAmount), 7, 5)
+	c.flag(n.TopBottom, 0x40)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The umaal instruction, which adds both RdLow and RdHigh to the unsigned
+// 64-bit product of Rm and Rs.
+type MultiplyAccumulateAccumulateInstruction struct {
+	basicARMInstruction
+	RdLow  ARMRegister
+	RdHigh ARMRegister
+	Rm     ARMRegister
+	Rs     ARMRegister
+}
+
+func (n *MultiplyAccumulateAccumulateInstruction) String() string {
+	return fmt.Sprintf("umaal%s %s, %s, %s, %s", n.Condition(), n.RdLow,
+		n.RdHigh, n.Rm, n.Rs)
+}
+
+func (n *MultiplyAccumulateAccumulateInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x00400090}
+	c.condition(n.Condition())
+	c.register("RdHigh", n.RdHigh, 16)
+	c.register("RdLow", n.RdLow, 12)
+	c.register("Rs", n.Rs, 8)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The smlad, smlsd, smuad, smusd, smlald and smlsld instructions, which add
+// or subtract the products of the signed halfwords in Rm and Rs.
+type DualMultiplyInstruction struct {
+	basicARMInstruction
+	Rd     ARMRegister
+	Rn     ARMRegister
+	Rs     ARMRegister
+	Rm     ARMRegister
+	RdLow  ARMRegister
+	RdHigh ARMRegister
+	// Set if the product of the top halfwords is subtracted.
+	Subtract bool
+	// Set if the halfwords of Rs are swapped before multiplying.
+	Exchange       bool
+	Accumulate     bool
+	IsLongMultiply bool
+}
+
+func (n *DualMultiplyInstruction) String() string {
+	var start string
+	if n.Accumulate {
+		start = "sml"
+	} else {
+		start = "smu"
+	}
+	if n.Subtract {
+		start += "s"
+	} else {
+		start += "a"
+	}
+	if n.IsLongMultiply {
+		start += "l"
+	}
+	start += "d"
+	if n.Exchange {
+		start += "x"
+	}
+	start += n.Condition().String()
+	if n.IsLongMultiply {
+		return fmt.Sprintf("%s %s, %s, %s, %s", start, n.RdLow, n.RdHigh, n.Rm,
+			n.Rs)
+	}
+	if !n.Accumulate {
+		return fmt.Sprintf("%s %s, %s, %s", start, n.Rd, n.Rm, n.Rs)
+	}
+	return fmt.Sprintf("%s %s, %s, %s, %s", start, n.Rd, n.Rm, n.Rs, n.Rn)
+}
+
+func (n *DualMultiplyInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x07000010}
+	c.condition(n.Condition())
+	c.register("Rs", n.Rs, 8)
+	c.flag(n.Subtract, 0x40)
+	c.flag(n.Exchange, 0x20)
+	c.register("Rm", n.Rm, 0)
+	if n.IsLongMultiply {
+		if !n.Accumulate {
+			c.fail("Long dual multiplies must accumulate")
+		}
+		c.raw |= 0x400000
+		c.register("RdHigh", n.RdHigh, 16)
+		c.register("RdLow", n.RdLow, 12)
+		return c.result()
+	}
+	c.register("Rd", n.Rd, 16)
+	// smuad and smusd are encoded with Rn set to r15.
+	if !n.Accumulate {
+		c.raw |= 0xf000
+	} else if n.Rn == 15 {
+		c.fail("Dual multiplies can't accumulate r15")
+	} else {
+		c.register("Rn", n.Rn, 12)
+	}
+	return c.result()
+}
+
+// The cps instruction, which changes the interrupt masks or the mode.
+type ChangeProcessorStateInstruction struct {
+	basicARMInstruction
+	// 2 to enable (clear) the selected masks, 3 to disable (set) them, and 0
+	// to leave them unchanged.
+	InterruptMode uint8
+	ChangeMode    bool
+	Mode          uint8
+	AbortFlag     bool
+	IRQFlag       bool
+	FIQFlag       bool
+}
+
+func (n *ChangeProcessorStateInstruction) String() string {
+	start := "cps"
+	if n.InterruptMode == 2 {
+		start += "ie"
+	} else if n.InterruptMode == 3 {
+		start += "id"
+	}
+	flags := ""
+	if n.AbortFlag {
+		flags += "a"
+	}
+	if n.IRQFlag {
+		flags += "i"
+	}
+	if n.FIQFlag {
+		flags += "f"
+	}
+	if n.InterruptMode == 0 {
+		return fmt.Sprintf("%s %d", start, n.Mode)
+	}
+	if n.ChangeMode {
+		return fmt.Sprintf("%s %s, %d", start, flags, n.Mode)
+	}
+	return fmt.Sprintf("%s %s", start, flags)
+}
+
+// cps is always unconditional.
+func (n *ChangeProcessorStateInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf1000000}
+	c.field("InterruptMode", uint32(n.InterruptMode), 18, 2)
+	if n.InterruptMode == 1 {
+		c.fail("Invalid cps interrupt mode 1")
+	}
+	if (n.InterruptMode == 0) && !n.ChangeMode {
+		c.fail("cps must change the interrupt masks or the mode")
+	}
+	c.flag(n.ChangeMode, 0x20000)
+	c.flag(n.AbortFlag, 0x100)
+	c.flag(n.IRQFlag, 0x80)
+	c.flag(n.FIQFlag, 0x40)
+	c.field("Mode", uint32(n.Mode), 0, 5)
+	return c.result()
+}
+
+// The setend instruction, which sets or clears the E bit in the CPSR.
+type SetEndiannessInstruction struct {
+	basicARMInstruction
+	BigEndian bool
+}
+
+func (n *SetEndiannessInstruction) String() string {
+	if n.BigEndian {
+		return "setend be"
+	}
+	return "setend le"
+}
+
+// setend is always unconditional.
+func (n *SetEndiannessInstruction) Encode() (uint32, error) {
+	if n.BigEndian {
+		return 0xf1010200, nil
+	}
+	return 0xf1010000, nil
+}
+
+// Returns the addressing mode suffix for srs and rfe.
+func returnStateModeString(preindex, up bool) string {
+	if up {
+		if preindex {
+			return "ib"
+		}
+		return "ia"
+	}
+	if preindex {
+		return "db"
+	}
+	return "da"
+}
+
+// The srs instruction, which stores lr and the SPSR to the stack of the given
+// mode.
+type StoreReturnStateInstruction struct {
+	basicARMInstruction
+	Mode      uint8
+	Preindex  bool
+	Up        bool
+	WriteBack bool
+}
+
+func (n *StoreReturnStateInstruction) String() string {
+	writeBack := ""
+	if n.WriteBack {
+		writeBack = "!"
+	}
+	return fmt.Sprintf("srs%s sp%s, %d", returnStateModeString(n.Preindex,
+		n.Up), writeBack, n.Mode)
+}
+
+// srs is always unconditional.
+func (n *StoreReturnStateInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf84d0500}
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.WriteBack, 0x200000)
+	c.field("Mode", uint32(n.Mode), 0, 5)
+	return c.result()
+}
+
+// The rfe instruction, which loads the PC and CPSR from memory.
+type ReturnFromExceptionInstruction struct {
+	basicARMInstruction
+	Rn        ARMRegister
+	Preindex  bool
+	Up        bool
+	WriteBack bool
+}
+
+func (n *ReturnFromExceptionInstruction) String() string {
+	writeBack := ""
+	if n.WriteBack {
+		writeBack = "!"
+	}
+	return fmt.Sprintf("rfe%s %s%s", returnStateModeString(n.Preindex, n.Up),
+		n.Rn, writeBack)
+}
+
+// rfe is always unconditional.
+func (n *ReturnFromExceptionInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf8100a00}
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.WriteBack, 0x200000)
+	c.register("Rn", n.Rn, 16)
+	return c.result()
+}
+
+func parseExclusiveLoadStoreInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn ExclusiveLoadStoreInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Load = (raw & 0x100000) != 0
+	if (toReturn.Rd == 15) || (toReturn.Rn == 15) ||
+		(!toReturn.Load && (toReturn.Rm == 15)) {
+		return nil, fmt.Errorf("ldrex and strex can't use r15")
+	}
+	if !toReturn.Load && ((toReturn.Rd == toReturn.Rn) ||
+		(toReturn.Rd == toReturn.Rm)) {
+		return nil, fmt.Errorf("The strex status register must differ")
+	}
+	return &toReturn, nil
+}
+
+func parseReverseBytesInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn ReverseBytesInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Halfwords = (raw & 0x80) != 0
+	toReturn.Signed = (raw & 0x400000) != 0
+	return &toReturn, nil
+}
+
+func parseExtendInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn ExtendInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rotate = uint8((raw >> 10) & 3)
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Unsigned = (raw & 0x400000) != 0
+	toReturn.Dual = (raw & 0x200000) == 0
+	toReturn.Halfword = (raw & 0x100000) != 0
+	if toReturn.Dual && toReturn.Halfword {
+		return parseUndefinedInstruction(raw)
+	}
+	return &toReturn, nil
+}
+
+func parseParallelArithmeticInstruction(raw uint32) (ARMInstruction,
+	error) {
+	var toReturn ParallelArithmeticInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Operation = uint8((raw >> 5) & 7)
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Prefix = uint8((raw >> 20) & 7)
+	if (parallelPrefixStrings[toReturn.Prefix] == "") ||
+		(parallelOperationStrings[toReturn.Operation] == "") {
+		return parseUndefinedInstruction(raw)
+	}
+	return &toReturn, nil
+}
+
+func parseSelectBytesInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn SelectBytesInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	return &toReturn, nil
+}
+
+func parseSumAbsoluteDifferencesInstruction(raw uint32) (ARMInstruction,
+	error) {
+	var toReturn SumAbsoluteDifferencesInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rs = ARMRegister(uint8((raw >> 8) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Accumulate = toReturn.Rn != 15
+	return &toReturn, nil
+}
+
+func parseSaturateInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn SaturateInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rn = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Unsigned = (raw & 0x400000) != 0
+	toReturn.Dual = (raw & 0x0fb00ff0) == 0x06a00f30
+	if toReturn.Dual {
+		toReturn.SaturatePosition = uint8((raw >> 16) & 0xf)
+	} else {
+		toReturn.SaturatePosition = uint8((raw >> 16) & 0x1f)
+		toReturn.ShiftAmount = uint8((raw >> 7) & 0x1f)
+		toReturn.ShiftRight = (raw & 0x40) != 0
+	}
+	return &toReturn, nil
+}
+
+func parsePackHalfwordInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn PackHalfwordInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.TopBottom = (raw & 0x40) != 0
+	toReturn.ShiftAmount = uint8((raw >> 7) & 0x1f)
+	toReturn.Rd = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	return &toReturn, nil
+}
+
+func parseMultiplyAccumulateAccumulateInstruction(raw uint32) (
+	ARMInstruction, error) {
+	var toReturn MultiplyAccumulateAccumulateInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Rs = ARMRegister(uint8((raw >> 8) & 0xf))
+	toReturn.RdLow = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.RdHigh = ARMRegister(uint8((raw >> 16) & 0xf))
+	if toReturn.RdLow == toReturn.RdHigh {
+		return nil, fmt.Errorf("Multiply rdlo and rdhi must differ.")
+	}
+	return &toReturn, nil
+}
+
+func parseDualMultiplyInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn DualMultiplyInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(getCondition(raw))
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	toReturn.Exchange = (raw & 0x20) != 0
+	toReturn.Subtract = (raw & 0x40) != 0
+	toReturn.Rs = ARMRegister(uint8((raw >> 8) & 0xf))
+	toReturn.Rn = ARMRegister(uint8((raw >> 12) & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.IsLongMultiply = (raw & 0x400000) != 0
+	if toReturn.IsLongMultiply {
+		toReturn.Accumulate = true
+		toReturn.RdLow = toReturn.Rn
+		toReturn.RdHigh = toReturn.Rd
+		if toReturn.RdLow == toReturn.RdHigh {
+			return nil, fmt.Errorf("Multiply rdlo and rdhi must differ.")
+		}
+	} else {
+		toReturn.Accumulate = toReturn.Rn != 15
+	}
+	return &toReturn, nil
+}
+
+func parseChangeProcessorStateInstruction(raw uint32) (ARMInstruction,
+	error) {
+	var toReturn ChangeProcessorStateInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(14)
+	toReturn.Mode = uint8(raw & 0x1f)
+	toReturn.FIQFlag = (raw & 0x40) != 0
+	toReturn.IRQFlag = (raw & 0x80) != 0
+	toReturn.AbortFlag = (raw & 0x100) != 0
+	toReturn.ChangeMode = (raw & 0x20000) != 0
+	toReturn.InterruptMode = uint8((raw >> 18) & 3)
+	if (toReturn.InterruptMode == 1) ||
+		((toReturn.InterruptMode == 0) && !toReturn.ChangeMode) {
+		return parseUndefinedInstruction(raw)
+	}
+	return &toReturn, nil
+}
+
+func parseSetEndiannessInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn SetEndiannessInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(14)
+	toReturn.BigEndian = (raw & 0x200) != 0
+	return &toReturn, nil
+}
+
+func parseStoreReturnStateInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn StoreReturnStateInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(14)
+	toReturn.Mode = uint8(raw & 0x1f)
+	toReturn.WriteBack = (raw & 0x200000) != 0
+	toReturn.Up = (raw & 0x800000) != 0
+	toReturn.Preindex = (raw & 0x1000000) != 0
+	return &toReturn, nil
+}
+
+func parseReturnFromExceptionInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn ReturnFromExceptionInstruction
+	toReturn.raw = raw
+	toReturn.SetCondition(14)
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.WriteBack = (raw & 0x200000) != 0
+	toReturn.Up = (raw & 0x800000) != 0
+	toReturn.Preindex = (raw & 0x1000000) != 0
+	if toReturn.Rn == 15 {
+		return nil, fmt.Errorf("rfe can't use r15")
+	}
+	return &toReturn, nil
+}
+
+// Parses the media instructions, which have bits 27:25 set to 011 and bit 4
+// set. These were undefined before ARMv6.
+func parseMediaInstruction(raw uint32) (ARMInstruction, error) {
+	if (raw & 0x0f800f10) == 0x06000f10 {
+		return parseParallelArithmeticInstruction(raw)
+	}
+	if (raw & 0x0ff00ff0) == 0x06800fb0 {
+		return parseSelectBytesInstruction(raw)
+	}
+	if (raw & 0x0ff00030) == 0x06800010 {
+		return parsePackHalfwordInstruction(raw)
+	}
+	if (raw & 0x0fff0f70) == 0x06bf0f30 {
+		return parseReverseBytesInstruction(raw)
+	}
+	if (raw & 0x0fff0ff0) == 0x06ff0fb0 {
+		return parseReverseBytesInstruction(raw)
+	}
+	if (raw & 0x0f8003f0) == 0x06800070 {
+		return parseExtendInstruction(raw)
+	}
+	if (raw & 0x0fb00ff0) == 0x06a00f30 {
+		return parseSaturateInstruction(raw)
+	}
+	if (raw & 0x0fa00030) == 0x06a00010 {
+		return parseSaturateInstruction(raw)
+	}
+	if (raw & 0x0fb00090) == 0x07000010 {
+		return parseDualMultiplyInstruction(raw)
+	}
+	if (raw & 0x0ff000f0) == 0x07800010 {
+		return parseSumAbsoluteDifferencesInstruction(raw)
+	}
+	return parseUndefinedInstruction(raw)
+}
+
+func parseARMv6Instruction(raw uint32) (ARMInstruction, error) {
+	if (raw >> 28) == 0xf {
+		if (raw & 0xfff1fe20) == 0xf1000000 {
+			return parseChangeProcessorStateInstruction(raw)
+		}
+		if (raw & 0xfffffdff) == 0xf1010000 {
+			return parseSetEndiannessInstruction(raw)
+		}
+		if (raw & 0xfe5fffe0) == 0xf84d0500 {
+			return parseStoreReturnStateInstruction(raw)
+		}
+		if (raw & 0xfe50ffff) == 0xf8100a00 {
+			return parseReturnFromExceptionInstruction(raw)
+		}
+		return parseARMv5TEInstruction(raw)
+	}
+	if (raw & 0x0e000010) == 0x06000010 {
+		return parseMediaInstruction(raw)
+	}
+	if ((raw & 0x0ff00fff) == 0x01900f9f) ||
+		((raw & 0x0ff00ff0) == 0x01800f90) {
+		return parseExclusiveLoadStoreInstruction(raw)
+	}
+	if (raw & 0x0ff000f0) == 0x00400090 {
+		return parseMultiplyAccumulateAccumulateInstruction(raw)
+	}
+	return parseARMv5TEInstruction(raw)
+}
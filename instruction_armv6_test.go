@@ -0,0 +1,72 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func TestARMv6InstructionStrings(t *testing.T) {
+	expected := map[uint32]string{
+		0xe1910f9f: "ldrex r0, [r1]",
+		0xe1812f90: "strex r2, r0, [r1]",
+		0xe6bf0f31: "rev r0, r1",
+		0xe6bf0fb1: "rev16 r0, r1",
+		0x16ff0fb1: "revshne r0, r1",
+		0xe6af0071: "sxtb r0, r1",
+		0xe6a20471: "sxtab r0, r2, r1, ror 8",
+		0xe6ff0071: "uxth r0, r1",
+		0xe68f0071: "sxtb16 r0, r1",
+		0xe6c20071: "uxtab16 r0, r2, r1",
+		0xe6110f12: "sadd16 r0, r1, r2",
+		0xe6610ff2: "uqsub8 r0, r1, r2",
+		0xe6310f32: "shaddsubx r0, r1, r2",
+		0xe6810fb2: "sel r0, r1, r2",
+		0xe780f211: "usad8 r0, r1, r2",
+		0xe7803211: "usada8 r0, r1, r2, r3",
+		0xe6af0211: "ssat r0, 16, r1, lsl 4",
+		0xe6e80151: "usat r0, 8, r1, asr 2",
+		0xe6a70f31: "ssat16 r0, 8, r1",
+		0xe6e80f31: "usat16 r0, 8, r1",
+		0xe6810412: "pkhbt r0, r1, r2, lsl 8",
+		0xe6810852: "pkhtb r0, r1, r2, asr 16",
+		0xe0410392: "umaal r0, r1, r2, r3",
+		0xe7003211: "smlad r0, r1, r2, r3",
+		0xe700f231: "smuadx r0, r1, r2",
+		0xe7003251: "smlsd r0, r1, r2, r3",
+		0xe700f251: "smusd r0, r1, r2",
+		0xe7410312: "smlald r0, r1, r2, r3",
+		0xe7410372: "smlsldx r0, r1, r2, r3",
+		0xf10800c0: "cpsie if",
+		0xf10e01d3: "cpsid aif, 19",
+		0xf1020013: "cps 19",
+		0xf1010200: "setend be",
+		0xf1010000: "setend le",
+		0xf96d0513: "srsdb sp!, 19",
+		0xf8b00a00: "rfeia r0!",
+	}
+	for raw, s := range expected {
+		n, e := ParseInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != s {
+			t.Logf("Expected 0x%08x to be %s, got %s\n", raw, s, n)
+			t.Fail()
+		}
+	}
+	// These are undefined in ARMv5TE.
+	for _, raw := range []uint32{0xe6110f12, 0xe6bf0f31} {
+		_, e := ParseInstructionForArchitecture(raw, ARMv5TE)
+		if e == nil {
+			t.Logf("Didn't get an error for 0x%08x in ARMv5TE.\n", raw)
+			t.Fail()
+		}
+	}
+	// strex can't use the same register for its status and address.
+	_, e := ParseInstruction(0xe1811f90)
+	if e == nil {
+		t.Logf("Didn't get an error for an invalid strex.\n")
+		t.Fail()
+	}
+}
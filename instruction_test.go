@@ -1,6 +1,8 @@
 package arm_emulate
 
 import (
+	"fmt"
+	"math/rand"
 	"strings"
 	"testing"
 )
@@ -18,6 +20,44 @@ func TestUndefinedInstruction(t *testing.T) {
 	}
 }
 
+func TestPSRTransferParse(t *testing.T) {
+	// ARMv7's movw and movt, msr with an empty field mask, and encodings
+	// with the wrong should-be-zero or one bits must not be decoded as mrs or
+	// msr.
+	for _, raw := range []uint32{0xe3001234, 0xe3401234, 0xe3081234,
+		0xe320f000, 0xe120f001, 0xe10f0001, 0xe3290000} {
+		n, e := ParseInstructionForArchitecture(raw, ARMv7)
+		if e == nil {
+			t.Logf("Parsing 0x%08x didn't fail, got %s\n", raw, n)
+			t.Fail()
+		}
+	}
+	// ARMv4T has no clz, and it isn't an msr either.
+	n, e := ParseInstructionForArchitecture(0xe16f0f11, ARMv4T)
+	if e == nil {
+		t.Logf("Parsing clz for ARMv4T didn't fail, got %s\n", n)
+		t.Fail()
+	}
+	tests := map[uint32]string{
+		0xe10f1000: "mrs r1, cpsr",
+		0xe14f1000: "mrs r1, spsr",
+		0xe321f0d3: "msr cpsr_c, 211",
+		0xe168f003: "msr spsr_f, r3",
+	}
+	for raw, expected := range tests {
+		n, e := ParseInstructionForArchitecture(raw, ARMv7)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != expected {
+			t.Logf("Parsed 0x%08x as %s, expected %s\n", raw, n, expected)
+			t.Fail()
+		}
+	}
+}
+
 func TestSoftwareInterruptParse(t *testing.T) {
 	raw := uint32(0x1f000000)
 	n, e := ParseInstruction(raw)
@@ -105,3 +145,187 @@ func TestBlockDataTransferInstruction(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestInstructionStrings(t *testing.T) {
+	expected := map[uint32]string{
+		// PC-relative offsets are relative to the instruction, including
+		// negative ones.
+		0xe15f00b4: "ldrh r0, 4",
+		0xe51f0004: "ldr r0, 4",
+		0xe59f0004: "ldr r0, 12",
+		0xed1f1101: "ldc p1, c1, 4",
+		// Stores use the opposite stack names to loads.
+		0xe92d4010: "stmfd sp!, {r4, lr}",
+		0xe8bd8010: "ldmfd sp!, {r4, pc}",
+		0xe88d0003: "stmea sp, {r0-r1}",
+		// The unindexed form passes an option to the coprocessor.
+		0xec900105: "ldc p1, c0, [r0], {5}",
+	}
+	for raw, expectedString := range expected {
+		n, e := ParseInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != expectedString {
+			t.Logf("Expected \"%s\" for 0x%08x, got \"%s\"\n", expectedString,
+				raw, n)
+			t.Fail()
+		}
+	}
+}
+
+// Returns the bits of an instruction's encoding which the parser ignores, such
+// as should-be-zero fields, so encoding it may not reproduce them.
+func armIgnoredBits(n ARMInstruction) uint32 {
+	switch n := n.(type) {
+	case *DataProcessingInstruction:
+		// Halfword transfers with a nonzero should-be-zero field are parsed
+		// as register shifts, in which bit 7 is ignored.
+		if !n.IsImmediate && (n.Shift != nil) && n.Shift.UseRegister() {
+			return 0x80
+		}
+	case *HalfwordDataTransferInstruction:
+		if !n.IsImmediate {
+			return 0xf00
+		}
+	}
+	return 0
+}
+
+// Checks that an instruction parsed from raw can be encoded, and that parsing
+// the encoding produces the same instruction.
+func checkARMRoundTrip(t *testing.T, raw uint32) {
+	n, e := ParseInstruction(raw)
+	if e != nil {
+		return
+	}
+	encoded, e := n.Encode()
+	if e != nil {
+		t.Logf("Failed encoding 0x%08x (%s): %s\n", raw, n, e)
+		t.FailNow()
+	}
+	if ((encoded ^ raw) &^ armIgnoredBits(n)) != 0 {
+		t.Logf("0x%08x (%s) was encoded as 0x%08x\n", raw, n, encoded)
+		t.FailNow()
+	}
+	parsed, e := ParseInstruction(encoded)
+	if e != nil {
+		t.Logf("Failed parsing 0x%08x, encoded from 0x%08x (%s): %s\n",
+			encoded, raw, n, e)
+		t.FailNow()
+	}
+	reencoded, e := parsed.Encode()
+	if (e != nil) || (reencoded != encoded) ||
+		(fmt.Sprintf("%T", parsed) != fmt.Sprintf("%T", n)) ||
+		(parsed.String() != n.String()) {
+		t.Logf("0x%08x (%s) was encoded as 0x%08x (%s)\n", raw, n, encoded,
+			parsed)
+		t.FailNow()
+	}
+}
+
+func TestARMInstructionRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	// Try every combination of the condition and the bits used to decode
+	// instructions, filling in the remaining bits randomly.
+	for i := uint32(0); i < 0x10000; i++ {
+		decodeBits := ((i & 0xfff0) << 16) | ((i & 0xf) << 4)
+		for j := 0; j < 8; j++ {
+			raw := (random.Uint32() & 0x000fff0f) | decodeBits
+			checkARMRoundTrip(t, raw)
+		}
+	}
+	// These instructions have too many fixed bits to be found randomly.
+	fixed := []uint32{0xe12fff1e, 0xe12fff33, 0xf10c0080, 0xf1020013,
+		0xf10e01d3, 0xf1010200, 0xf1010000, 0xf96d0513, 0xf8bd0a00,
+		0xe1910f9f, 0xe1810f92, 0xe16f0f11, 0xe6ff1fb2, 0xfa000010}
+	for _, raw := range fixed {
+		_, e := ParseInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.FailNow()
+		}
+		checkARMRoundTrip(t, raw)
+	}
+}
+
+func TestARMInstructionEncode(t *testing.T) {
+	var tests = map[uint32]ARMInstruction{
+		0xe0810002: &DataProcessingInstruction{Opcode: addARMOpcode, Rd: 0,
+			Rn: 1, Rm: 2},
+		0xe3a004ff: &DataProcessingInstruction{Opcode: movARMOpcode,
+			IsImmediate: true, Immediate: 0xff, Rotate: 4},
+		0xe1a00200: &DataProcessingInstruction{Opcode: movARMOpcode,
+			Shift: NewARMShift(0x20)},
+		0xe8bd8008: &BlockDataTransferInstruction{RegisterList: 0x8008,
+			Rn: 13, Load: true, WriteBack: true, Up: true},
+		0xebfffffe: &BranchInstruction{Offset: -2, Link: true},
+		0xfb000000: &BranchInstruction{Link: true, Exchange: true,
+			HalfwordOffset: true},
+		0xe12fff1e: &BranchExchangeInstruction{Rn: 14},
+		0xe5912004: &SingleDataTransferInstruction{Rd: 2, Rn: 1, Offset: 4,
+			Load: true, Up: true, Preindex: true, ImmediateOffset: true},
+		0xe1c320d8: &HalfwordDataTransferInstruction{Rd: 2, Rn: 3,
+			Offset: 8, IsImmediate: true, Up: true, Preindex: true,
+			Load: true, Doubleword: true},
+		0xe0c10392: &MultiplyInstruction{IsLongMultiply: true, RdLow: 0,
+			RdHigh: 1, Rm: 2, Rs: 3, Signed: true},
+		0xe10f0000: &PSRTransferInstruction{UseCPSR: true},
+		0xe128f001: &PSRTransferInstruction{UseCPSR: true, WritePSR: true,
+			FlagsOnly: true, Rm: 1},
+		0xe129f001: &PSRTransferInstruction{UseCPSR: true, WritePSR: true,
+			Rm: 1},
+		0xe322f010: &PSRTransferInstruction{UseCPSR: true, WritePSR: true,
+			Mask: 2, IsImmediate: true, Immediate: 0x10},
+		0xf5d1f020: &PreloadInstruction{SingleDataTransferInstruction{
+			Rn: 1, Offset: 32, Up: true, ImmediateOffset: true}},
+		0xe6bf1f32: &ReverseBytesInstruction{Rd: 1, Rm: 2},
+		0xf1080080: &ChangeProcessorStateInstruction{InterruptMode: 2,
+			IRQFlag: true},
+		0xee300a01: &VFPDataOperationInstruction{Opcode: faddVFPOpcode,
+			Fd: 0, Fn: 0, Fm: 2},
+		0xed9f1b02: &VFPDataTransferInstruction{
+			CoprocDataTransferInstruction: CoprocDataTransferInstruction{
+				Rn: 15, Offset: 2, Up: true, Load: true},
+			Double: true, Fd: 1},
+		0xeef1fa10: &VFPRegisterTransferInstruction{
+			CoprocRegisterTransferInstruction{Rd: 15, Load: true}, 1, true},
+	}
+	for expected, n := range tests {
+		raw, e := n.Encode()
+		if e != nil {
+			t.Logf("Failed encoding %s: %s\n", n, e)
+			t.Fail()
+			continue
+		}
+		if raw != expected {
+			t.Logf("Encoded %s as 0x%08x, expected 0x%08x\n", n, raw,
+				expected)
+			t.Fail()
+		}
+	}
+	invalid := []ARMInstruction{
+		&DataProcessingInstruction{Opcode: addARMOpcode, Rd: 16},
+		&MultiplyInstruction{Subtract: true},
+		&BranchInstruction{Offset: 0x1000000},
+		&SingleDataTransferInstruction{Shift: NewARMShift(0x11)},
+		&HalfwordDataTransferInstruction{Doubleword: true, Rd: 1},
+		&PSRTransferInstruction{WritePSR: true, Mask: 16},
+		&SignedHalfwordMultiplyInstruction{Word: true, IsLongMultiply: true},
+		&ExclusiveLoadStoreInstruction{Load: true, Offset: 1},
+		&ParallelArithmeticInstruction{Prefix: 4},
+		&SaturateInstruction{Dual: true, ShiftAmount: 1},
+		&ChangeProcessorStateInstruction{InterruptMode: 1},
+		&VFPDataOperationInstruction{Opcode: fcpyVFPOpcode, Double: true,
+			Fd: 16},
+	}
+	for _, n := range invalid {
+		raw, e := n.Encode()
+		if e == nil {
+			t.Logf("Didn't get an error encoding %s (got 0x%08x)\n", n, raw)
+			t.Fail()
+		}
+	}
+}
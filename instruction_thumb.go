@@ -8,6 +8,9 @@ type THUMBInstruction interface {
 	fmt.Stringer
 	Raw() uint16
 	Emulate(p ARMProcessor) error
+	// Returns the raw encoding of the instruction's fields, or an error if
+	// they can't be encoded.
+	Encode() (uint16, error)
 }
 
 type basicTHUMBInstruction struct {
@@ -43,7 +46,24 @@ func (n *MoveShiftedRegisterInstruction) String() string {
 	} else {
 		start = "asr"
 	}
-	return fmt.Sprintf("%s %s, %s, %d", start, n.Rd, n.Rs, n.Offset)
+	offset := int(n.Offset)
+	// An offset of 0 means 32 for the right shifts.
+	if (offset == 0) && (n.Operation != 0) {
+		offset = 32
+	}
+	return fmt.Sprintf("%s %s, %s, %d", start, n.Rd, n.Rs, offset)
+}
+
+func (n *MoveShiftedRegisterInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{}
+	if n.Operation > 2 {
+		c.fail("Invalid shift operation %d", n.Operation)
+	}
+	c.raw |= uint32(n.Operation&3) << 11
+	c.field("Offset", uint32(n.Offset), 6, 5)
+	c.lowRegister("Rs", n.Rs, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
 }
 
 type AddSubtractInstruction struct {
@@ -72,6 +92,20 @@ func (n *AddSubtractInstruction) String() string {
 	return start
 }
 
+func (n *AddSubtractInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x1800}
+	c.flag(n.Subtract, 0x200)
+	if n.IsImmediate {
+		c.raw |= 0x400
+		c.field("Immediate", uint32(n.Immediate), 6, 3)
+	} else {
+		c.lowRegister("Rn", n.Rn, 6)
+	}
+	c.lowRegister("Rs", n.Rs, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
 type MoveCompareAddSubtractImmediateInstruction struct {
 	basicTHUMBInstruction
 	Rd        ARMRegister
@@ -93,6 +127,15 @@ func (n *MoveCompareAddSubtractImmediateInstruction) String() string {
 	return fmt.Sprintf("%s %s, %d", start, n.Rd, n.Immediate)
 }
 
+func (n *MoveCompareAddSubtractImmediateInstruction) Encode() (uint16,
+	error) {
+	c := instructionEncoder{raw: 0x2000}
+	c.field("Operation", uint32(n.Operation), 11, 2)
+	c.lowRegister("Rd", n.Rd, 8)
+	c.raw |= uint32(n.Immediate)
+	return c.resultTHUMB()
+}
+
 type ALUOperationInstruction struct {
 	basicTHUMBInstruction
 	Opcode ALUOpcodeTHUMB
@@ -104,6 +147,18 @@ func (n *ALUOperationInstruction) String() string {
 	return fmt.Sprintf("%s %s, %s", n.Opcode, n.Rd, n.Rs)
 }
 
+func (n *ALUOperationInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x4000}
+	if n.Opcode == nil {
+		c.fail("The ALU operation's opcode isn't set")
+	} else {
+		c.field("Opcode", uint32(n.Opcode.Value()), 6, 4)
+	}
+	c.lowRegister("Rs", n.Rs, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
 type HighRegisterOperationInstruction struct {
 	basicTHUMBInstruction
 	Rd        ARMRegister
@@ -111,6 +166,8 @@ type HighRegisterOperationInstruction struct {
 	HighFlag1 bool
 	HighFlag2 bool
 	Operation uint8
+	// This is set for the ARMv5TE blx instruction.
+	Link bool
 }
 
 func (n *HighRegisterOperationInstruction) String() string {
@@ -121,12 +178,39 @@ func (n *HighRegisterOperationInstruction) String() string {
 		start = "cmp"
 	} else if n.Operation == 2 {
 		start = "mov"
+	} else if n.Link {
+		return fmt.Sprintf("blx %s", n.Rs)
 	} else {
 		return fmt.Sprintf("bx %s", n.Rs)
 	}
 	return fmt.Sprintf("%s %s, %s", start, n.Rd, n.Rs)
 }
 
+// The high register flags are set based on Rd and Rs, rather than using the
+// HighFlag fields.
+func (n *HighRegisterOperationInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x4400}
+	c.field("Operation", uint32(n.Operation), 8, 2)
+	// The top bit of Rs lands in its high register flag.
+	c.register("Rs", n.Rs, 3)
+	if n.Link {
+		if n.Operation != 3 {
+			c.fail("Only bx can link")
+		}
+		// blx is encoded as bx with the high register flag for Rd set.
+		c.raw |= 0x80
+		return c.resultTHUMB()
+	}
+	if (n.Operation == 3) && (n.Rd == 8) {
+		c.fail("bx can't set Rd to r8, which is the encoding of blx")
+	}
+	if n.Rd > 15 {
+		c.fail("Rd (%d) doesn't fit in 4 bits", n.Rd)
+	}
+	c.raw |= uint32(n.Rd&7) | (uint32(n.Rd&8) << 4)
+	return c.resultTHUMB()
+}
+
 type PcRelativeLoadInstruction struct {
 	basicTHUMBInstruction
 	Offset uint8
@@ -137,6 +221,22 @@ func (n *PcRelativeLoadInstruction) String() string {
 	return fmt.Sprintf("ldr %s, [pc, %d]", n.Rd, uint16(n.Offset)<<2)
 }
 
+func (n *PcRelativeLoadInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	return (pc &^ 3) + (uint32(n.Offset) << 2), true
+}
+
+func (n *PcRelativeLoadInstruction) pcRelativeString(target string) string {
+	return fmt.Sprintf("ldr %s, %s", n.Rd, target)
+}
+
+func (n *PcRelativeLoadInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x4800}
+	c.lowRegister("Rd", n.Rd, 8)
+	c.raw |= uint32(n.Offset)
+	return c.resultTHUMB()
+}
+
 type LoadStoreRegisterOffsetInstruction struct {
 	basicTHUMBInstruction
 	Rd           ARMRegister
@@ -159,6 +259,16 @@ func (n *LoadStoreRegisterOffsetInstruction) String() string {
 	return fmt.Sprintf("%s %s, [%s, %s]", start, n.Rd, n.Rb, n.Ro)
 }
 
+func (n *LoadStoreRegisterOffsetInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x5000}
+	c.flag(n.Load, 0x800)
+	c.flag(n.ByteQuantity, 0x400)
+	c.lowRegister("Ro", n.Ro, 6)
+	c.lowRegister("Rb", n.Rb, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
 type LoadStoreSignExtendedHalfwordInstruction struct {
 	basicTHUMBInstruction
 	Rd         ARMRegister
@@ -186,6 +296,16 @@ func (n *LoadStoreSignExtendedHalfwordInstruction) String() string {
 	return fmt.Sprintf("%s %s, [%s, %s]", start, n.Rd, n.Rb, n.Ro)
 }
 
+func (n *LoadStoreSignExtendedHalfwordInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x5200}
+	c.flag(n.HBit, 0x800)
+	c.flag(n.SignExtend, 0x400)
+	c.lowRegister("Ro", n.Ro, 6)
+	c.lowRegister("Rb", n.Rb, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
 type LoadStoreImmediateOffsetInstruction struct {
 	basicTHUMBInstruction
 	Rd           ARMRegister
@@ -211,6 +331,16 @@ func (n *LoadStoreImmediateOffsetInstruction) String() string {
 	return fmt.Sprintf("%s %s, [%s, %d]", start, n.Rd, n.Rb, offset)
 }
 
+func (n *LoadStoreImmediateOffsetInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x6000}
+	c.flag(n.ByteQuantity, 0x1000)
+	c.flag(n.Load, 0x800)
+	c.field("Offset", uint32(n.Offset), 6, 5)
+	c.lowRegister("Rb", n.Rb, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
 type LoadStoreHalfwordInstruction struct {
 	basicTHUMBInstruction
 	Rd     ARMRegister
@@ -229,6 +359,15 @@ func (n *LoadStoreHalfwordInstruction) String() string {
 	return fmt.Sprintf("%s %s, [%s, %d]", start, n.Rd, n.Rb, n.Offset<<1)
 }
 
+func (n *LoadStoreHalfwordInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x8000}
+	c.flag(n.Load, 0x800)
+	c.field("Offset", uint32(n.Offset), 6, 5)
+	c.lowRegister("Rb", n.Rb, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
 type SPRelativeLoadStoreInstruction struct {
 	basicTHUMBInstruction
 	Offset uint8
@@ -243,7 +382,15 @@ func (n *SPRelativeLoadStoreInstruction) String() string {
 	} else {
 		start = "str"
 	}
-	return fmt.Sprintf("%s %s, [sp, %d]", start, n.Rd, uint16(n.Offset)<<1)
+	return fmt.Sprintf("%s %s, [sp, %d]", start, n.Rd, uint16(n.Offset)<<2)
+}
+
+func (n *SPRelativeLoadStoreInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0x9000}
+	c.flag(n.Load, 0x800)
+	c.lowRegister("Rd", n.Rd, 8)
+	c.raw |= uint32(n.Offset)
+	return c.resultTHUMB()
 }
 
 type LoadAddressInstruction struct {
@@ -263,6 +410,26 @@ func (n *LoadAddressInstruction) String() string {
 	return fmt.Sprintf("add %s, %s, %d", n.Rd, source, uint16(n.Offset)<<2)
 }
 
+func (n *LoadAddressInstruction) pcRelativeTarget(pc uint32) (uint32, bool) {
+	if n.LoadSP {
+		return 0, false
+	}
+	return (pc &^ 3) + (uint32(n.Offset) << 2), true
+}
+
+// Adding to the PC is printed as adr when the target is known.
+func (n *LoadAddressInstruction) pcRelativeString(target string) string {
+	return fmt.Sprintf("adr %s, %s", n.Rd, target)
+}
+
+func (n *LoadAddressInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xa000}
+	c.flag(n.LoadSP, 0x800)
+	c.lowRegister("Rd", n.Rd, 8)
+	c.raw |= uint32(n.Offset)
+	return c.resultTHUMB()
+}
+
 type AddToStackPointerInstruction struct {
 	basicTHUMBInstruction
 	Offset   uint8
@@ -277,6 +444,13 @@ func (n *AddToStackPointerInstruction) String() string {
 	return fmt.Sprintf("add sp, %d", offset)
 }
 
+func (n *AddToStackPointerInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xb000}
+	c.flag(n.Negative, 0x80)
+	c.field("Offset", uint32(n.Offset), 0, 7)
+	return c.resultTHUMB()
+}
+
 type PushPopRegistersInstruction struct {
 	basicTHUMBInstruction
 	RegisterList  uint8
@@ -314,23 +488,31 @@ func registerListStringTHUMB(bits uint8) string {
 }
 
 func (n *PushPopRegistersInstruction) String() string {
-	var start string
 	registerList := registerListStringTHUMB(n.RegisterList)
+	start := "push"
+	extra := "lr"
 	if n.Load {
 		start = "pop"
-		if n.StoreLRLoadPC {
-			registerList += ", pc"
-		}
-	} else {
-		start = "push"
-		if n.StoreLRLoadPC {
-			registerList += ", lr"
+		extra = "pc"
+	}
+	if n.StoreLRLoadPC {
+		if registerList != "" {
+			registerList += ", "
 		}
+		registerList += extra
 	}
 	return fmt.Sprintf("%s {%s}", start, registerList)
 
 }
 
+func (n *PushPopRegistersInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xb400}
+	c.flag(n.Load, 0x800)
+	c.flag(n.StoreLRLoadPC, 0x100)
+	c.raw |= uint32(n.RegisterList)
+	return c.resultTHUMB()
+}
+
 type MultipleLoadStoreInstruction struct {
 	basicTHUMBInstruction
 	RegisterList uint8
@@ -349,16 +531,47 @@ func (n *MultipleLoadStoreInstruction) String() string {
 	return fmt.Sprintf("%s %s!, {%s}", start, n.Rb, registers)
 }
 
+func (n *MultipleLoadStoreInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xc000}
+	c.flag(n.Load, 0x800)
+	c.lowRegister("Rb", n.Rb, 8)
+	c.raw |= uint32(n.RegisterList)
+	return c.resultTHUMB()
+}
+
 type ConditionalBranchInstruction struct {
 	basicTHUMBInstruction
 	Offset    uint8
 	Condition ARMCondition
 }
 
-func (n *ConditionalBranchInstruction) String() string {
+// Returns the signed offset from the PC, in bytes.
+func (n *ConditionalBranchInstruction) offset() int16 {
 	// Offset must be a signed type before it is converted to 16-bits
-	offset := int16(int8(n.Offset)) << 1
-	return fmt.Sprintf("b%s %d", n.Condition, offset)
+	return int16(int8(n.Offset)) << 1
+}
+
+func (n *ConditionalBranchInstruction) String() string {
+	return n.pcRelativeString(fmt.Sprintf("%d", n.offset()))
+}
+
+func (n *ConditionalBranchInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	return pc + uint32(int32(n.offset())), true
+}
+
+func (n *ConditionalBranchInstruction) pcRelativeString(
+	target string) string {
+	return fmt.Sprintf("b%s %s", n.Condition, target)
+}
+
+func (n *ConditionalBranchInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xd000}
+	if n.Condition >= 14 {
+		c.fail("Illegal condition in conditional branch")
+	}
+	c.raw |= (uint32(n.Condition&0xf) << 8) | uint32(n.Offset)
+	return c.resultTHUMB()
 }
 
 type SoftwareInterruptTHUMBInstruction struct {
@@ -370,24 +583,54 @@ func (n *SoftwareInterruptTHUMBInstruction) String() string {
 	return fmt.Sprintf("swi %d", n.Comment)
 }
 
+func (n *SoftwareInterruptTHUMBInstruction) Encode() (uint16, error) {
+	return 0xdf00 | uint16(n.Comment), nil
+}
+
 type UnconditionalBranchInstruction struct {
 	basicTHUMBInstruction
 	Offset uint16
 }
 
-func (n *UnconditionalBranchInstruction) String() string {
+// Returns the signed offset from the PC, in bytes.
+func (n *UnconditionalBranchInstruction) offset() int16 {
 	// Take care of sign extending and left-shifting by 1
-	offset := int16(n.Offset<<5) >> 4
-	return fmt.Sprintf("b %d", offset)
+	return int16(n.Offset<<5) >> 4
+}
+
+func (n *UnconditionalBranchInstruction) String() string {
+	return n.pcRelativeString(fmt.Sprintf("%d", n.offset()))
+}
+
+func (n *UnconditionalBranchInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	return pc + uint32(int32(n.offset())), true
+}
+
+func (n *UnconditionalBranchInstruction) pcRelativeString(
+	target string) string {
+	return "b " + target
+}
+
+func (n *UnconditionalBranchInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xe000}
+	c.field("Offset", uint32(n.Offset), 0, 11)
+	return c.resultTHUMB()
 }
 
 type LongBranchAndLinkInstruction struct {
 	basicTHUMBInstruction
 	Offset    uint16
 	OffsetLow bool
+	// This is set for the second half of the ARMv5TE blx instruction, which
+	// switches to ARM mode.
+	Exchange bool
 }
 
 func (n *LongBranchAndLinkInstruction) String() string {
+	if n.Exchange {
+		return fmt.Sprintf("blx lr + %d (long branch and link)", n.Offset<<1)
+	}
 	if n.OffsetLow {
 		return fmt.Sprintf("bl lr + %d (long branch and link)", n.Offset<<1)
 	}
@@ -395,6 +638,123 @@ func (n *LongBranchAndLinkInstruction) String() string {
 		(int32(n.Offset)<<21)>>9)
 }
 
+func (n *LongBranchAndLinkInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xf000}
+	c.field("Offset", uint32(n.Offset), 0, 11)
+	if !n.Exchange {
+		c.flag(n.OffsetLow, 0x800)
+		return c.resultTHUMB()
+	}
+	if !n.OffsetLow || ((n.Offset & 1) != 0) {
+		c.fail("blx must be the second half, with an even offset")
+	}
+	c.raw = (c.raw &^ 0xf000) | 0xe800
+	return c.resultTHUMB()
+}
+
+type BreakpointTHUMBInstruction struct {
+	basicTHUMBInstruction
+	Comment uint8
+}
+
+func (n *BreakpointTHUMBInstruction) String() string {
+	return fmt.Sprintf("bkpt %d", n.Comment)
+}
+
+func (n *BreakpointTHUMBInstruction) Encode() (uint16, error) {
+	return 0xbe00 | uint16(n.Comment), nil
+}
+
+// The 16-bit sxth, sxtb, uxth and uxtb instructions, added in ARMv6.
+type ExtendTHUMBInstruction struct {
+	basicTHUMBInstruction
+	Rd       ARMRegister
+	Rm       ARMRegister
+	Unsigned bool
+	Halfword bool
+}
+
+func (n *ExtendTHUMBInstruction) mnemonic() string {
+	start := "sxt"
+	if n.Unsigned {
+		start = "uxt"
+	}
+	if n.Halfword {
+		return start + "h"
+	}
+	return start + "b"
+}
+
+func (n *ExtendTHUMBInstruction) String() string {
+	return fmt.Sprintf("%s %s, %s", n.mnemonic(), n.Rd, n.Rm)
+}
+
+func (n *ExtendTHUMBInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xb200}
+	c.flag(n.Unsigned, 0x80)
+	c.flag(!n.Halfword, 0x40)
+	c.lowRegister("Rm", n.Rm, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
+// The 16-bit rev, rev16 and revsh instructions, added in ARMv6.
+type ReverseBytesTHUMBInstruction struct {
+	basicTHUMBInstruction
+	Rd ARMRegister
+	Rm ARMRegister
+	// Set for rev16 and revsh, which reverse the bytes in each halfword.
+	Halfwords bool
+	// Set for revsh, which sign-extends the bottom halfword.
+	Signed bool
+}
+
+func (n *ReverseBytesTHUMBInstruction) mnemonic() string {
+	if n.Signed {
+		return "revsh"
+	}
+	if n.Halfwords {
+		return "rev16"
+	}
+	return "rev"
+}
+
+func (n *ReverseBytesTHUMBInstruction) String() string {
+	return fmt.Sprintf("%s %s, %s", n.mnemonic(), n.Rd, n.Rm)
+}
+
+func (n *ReverseBytesTHUMBInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xba00}
+	if n.Signed && !n.Halfwords {
+		c.fail("revsh must reverse halfwords")
+	}
+	c.flag(n.Signed, 0x80)
+	c.flag(n.Halfwords, 0x40)
+	c.lowRegister("Rm", n.Rm, 3)
+	c.lowRegister("Rd", n.Rd, 0)
+	return c.resultTHUMB()
+}
+
+// The 16-bit setend instruction, added in ARMv6.
+type SetEndiannessTHUMBInstruction struct {
+	basicTHUMBInstruction
+	BigEndian bool
+}
+
+func (n *SetEndiannessTHUMBInstruction) String() string {
+	if n.BigEndian {
+		return "setend be"
+	}
+	return "setend le"
+}
+
+func (n *SetEndiannessTHUMBInstruction) Encode() (uint16, error) {
+	if n.BigEndian {
+		return 0xb658, nil
+	}
+	return 0xb650, nil
+}
+
 func parseMoveShiftedRegisterInstruction(r uint16) (THUMBInstruction, error) {
 	var toReturn MoveShiftedRegisterInstruction
 	toReturn.raw = r
@@ -596,7 +956,120 @@ func parseLongBranchAndLinkInstruction(raw uint16) (THUMBInstruction, error) {
 	return &toReturn, nil
 }
 
+func parseBreakpointTHUMBInstruction(raw uint16) (THUMBInstruction, error) {
+	var toReturn BreakpointTHUMBInstruction
+	toReturn.raw = raw
+	toReturn.Comment = uint8(raw)
+	return &toReturn, nil
+}
+
+func parseExtendTHUMBInstruction(raw uint16) (THUMBInstruction, error) {
+	var toReturn ExtendTHUMBInstruction
+	toReturn.raw = raw
+	toReturn.Rd = ARMRegister(raw & 7)
+	toReturn.Rm = ARMRegister((raw >> 3) & 7)
+	toReturn.Unsigned = (raw & 0x80) != 0
+	toReturn.Halfword = (raw & 0x40) == 0
+	return &toReturn, nil
+}
+
+func parseReverseBytesTHUMBInstruction(raw uint16) (THUMBInstruction,
+	error) {
+	if (raw & 0xc0) == 0x80 {
+		return nil, thumbUndefinedError(raw)
+	}
+	var toReturn ReverseBytesTHUMBInstruction
+	toReturn.raw = raw
+	toReturn.Rd = ARMRegister(raw & 7)
+	toReturn.Rm = ARMRegister((raw >> 3) & 7)
+	toReturn.Halfwords = (raw & 0x40) != 0
+	toReturn.Signed = (raw & 0x80) != 0
+	return &toReturn, nil
+}
+
+func parseSetEndiannessTHUMBInstruction(raw uint16) (THUMBInstruction,
+	error) {
+	var toReturn SetEndiannessTHUMBInstruction
+	toReturn.raw = raw
+	toReturn.BigEndian = (raw & 8) != 0
+	return &toReturn, nil
+}
+
+// Parses the second half of the two-instruction ARMv5TE blx sequence.
+func parseLongBranchAndExchangeInstruction(raw uint16) (THUMBInstruction,
+	error) {
+	if (raw & 1) != 0 {
+		return nil, fmt.Errorf("Invalid blx offset: %w",
+			errUndefinedInstruction)
+	}
+	var toReturn LongBranchAndLinkInstruction
+	toReturn.raw = raw
+	toReturn.Offset = raw & 0x7ff
+	toReturn.OffsetLow = true
+	toReturn.Exchange = true
+	return &toReturn, nil
+}
+
+// Parses a THUMB instruction for the default architecture, ARMv6.
 func ParseTHUMBInstruction(raw uint16) (THUMBInstruction, error) {
+	return ParseTHUMBInstructionForArchitecture(raw, defaultArchitecture)
+}
+
+// Parses a THUMB instruction for the given version of the architecture.
+func ParseTHUMBInstructionForArchitecture(raw uint16,
+	architecture ARMArchitecture) (THUMBInstruction, error) {
+	switch architecture {
+	case ARMv4T:
+		return parseTHUMBv4TInstruction(raw)
+	case ARMv5TE:
+		return parseTHUMBv5TEInstruction(raw)
+	case ARMv6:
+		return parseTHUMBv6Instruction(raw)
+	case ARMv7, ARMv7M:
+		return parseTHUMBv7Instruction(raw)
+	}
+	return nil, fmt.Errorf("Unsupported architecture: %s", architecture)
+}
+
+func thumbUndefinedError(raw uint16) error {
+	return fmt.Errorf("Undefined THUMB instruction 0x%04x: %w", raw,
+		errUndefinedInstruction)
+}
+
+// Parses the 16-bit THUMB instructions in ARMv6, which adds the extend, rev,
+// setend and cps instructions.
+func parseTHUMBv6Instruction(raw uint16) (THUMBInstruction, error) {
+	if (raw & 0xff00) == 0xb200 {
+		return parseExtendTHUMBInstruction(raw)
+	}
+	if (raw & 0xff00) == 0xba00 {
+		return parseReverseBytesTHUMBInstruction(raw)
+	}
+	if (raw & 0xfff7) == 0xb650 {
+		return parseSetEndiannessTHUMBInstruction(raw)
+	}
+	if (raw & 0xffe8) == 0xb660 {
+		return parseChangeProcessorStateTHUMBInstruction(raw)
+	}
+	return parseTHUMBv5TEInstruction(raw)
+}
+
+func parseTHUMBv5TEInstruction(raw uint16) (THUMBInstruction, error) {
+	if (raw & 0xff00) == 0xbe00 {
+		return parseBreakpointTHUMBInstruction(raw)
+	}
+	if (raw & 0xf800) == 0xe800 {
+		return parseLongBranchAndExchangeInstruction(raw)
+	}
+	if (raw & 0xff87) == 0x4780 {
+		generic, _ := parseHighRegisterOperationInstruction(raw)
+		generic.(*HighRegisterOperationInstruction).Link = true
+		return generic, nil
+	}
+	return parseTHUMBv4TInstruction(raw)
+}
+
+func parseTHUMBv4TInstruction(raw uint16) (THUMBInstruction, error) {
 	if (raw & 0x8000) != 0 {
 		if (raw & 0x4000) != 0 {
 			if (raw & 0x2000) != 0 {
@@ -622,10 +1095,13 @@ func ParseTHUMBInstruction(raw uint16) (THUMBInstruction, error) {
 			}
 			return parseSPRelativeLoadStoreInstruction(raw)
 		}
-		if (raw & 0x0f00) != 0 {
+		if (raw & 0x0600) == 0x0400 {
 			return parsePushPopRegistersInstruction(raw)
 		}
-		return parseAddToStackPointerInstruction(raw)
+		if (raw & 0x0f00) == 0 {
+			return parseAddToStackPointerInstruction(raw)
+		}
+		return nil, thumbUndefinedError(raw)
 	}
 	if (raw & 0x4000) == 0 {
 		if (raw & 0x2000) == 0 {
@@ -0,0 +1,1450 @@
+package arm_emulate
+
+// This file contains the 32-bit Thumb-2 instructions added in ARMv7, along
+// with the 16-bit THUMB instructions which were added with them.
+
+import (
+	"fmt"
+)
+
+// A 32-bit Thumb-2 instruction. The first halfword of the instruction is held
+// in the upper 16 bits of the raw value.
+type THUMB2Instruction interface {
+	fmt.Stringer
+	Raw() uint32
+	Emulate(p ARMProcessor) error
+	// Returns the raw encoding of the instruction's fields, or an error if
+	// they can't be encoded.
+	Encode() (uint32, error)
+}
+
+type basicTHUMB2Instruction struct {
+	raw uint32
+}
+
+func (n *basicTHUMB2Instruction) Raw() uint32 {
+	return n.raw
+}
+
+func (n *basicTHUMB2Instruction) String() string {
+	return fmt.Sprintf("data: 0x%08x", n.raw)
+}
+
+func (n *basicTHUMB2Instruction) Emulate(p ARMProcessor) error {
+	return fmt.Errorf("Emulation not implemented for 0x%08x", n.raw)
+}
+
+// Adds the 12-bit i:imm3:imm8 immediate field used by the data processing
+// instructions.
+func (c *instructionEncoder) thumb2Immediate(value uint16) {
+	if value > 0xfff {
+		c.fail("Immediate (%d) doesn't fit in 12 bits", value)
+	}
+	v := uint32(value)
+	c.raw |= ((v & 0x800) << 15) | ((v & 0x700) << 4) | (v & 0xff)
+}
+
+// Adds a 5-bit shift amount or bit position, which is split into the imm3 and
+// imm2 fields.
+func (c *instructionEncoder) thumb2ShiftAmount(name string, value uint8) {
+	if value > 31 {
+		c.fail("%s (%d) doesn't fit in 5 bits", name, value)
+	}
+	v := uint32(value)
+	c.raw |= ((v & 0x1c) << 10) | ((v & 3) << 6)
+}
+
+// Data processing instructions with either a modified immediate or a shifted
+// register as the second operand.
+type DataProcessingTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	// This isn't the same as the ARM opcode. For example, 3 is orn.
+	Opcode        uint8
+	SetConditions bool
+	Rd            ARMRegister
+	Rn            ARMRegister
+	Rm            ARMRegister
+	IsImmediate   bool
+	// The 12-bit i:imm3:imm8 field, which encodes a 32-bit constant.
+	Immediate uint16
+	Shift     ARMShift
+}
+
+// Returns the ARM data processing opcode which carries out the instruction,
+// taking aliases such as mov and cmp into account. orn is returned as orr.
+func (n *DataProcessingTHUMB2Instruction) armOpcode() ARMDataProcessingOpcode {
+	compare := (n.Rd == 15) && n.SetConditions
+	switch n.Opcode {
+	case 0:
+		if compare {
+			return tstARMOpcode
+		}
+		return andARMOpcode
+	case 1:
+		return bicARMOpcode
+	case 2:
+		if n.Rn == 15 {
+			return movARMOpcode
+		}
+		return orrARMOpcode
+	case 3:
+		if n.Rn == 15 {
+			return mvnARMOpcode
+		}
+		return orrARMOpcode
+	case 4:
+		if compare {
+			return teqARMOpcode
+		}
+		return eorARMOpcode
+	case 8:
+		if compare {
+			return cmnARMOpcode
+		}
+		return addARMOpcode
+	case 10:
+		return adcARMOpcode
+	case 11:
+		return sbcARMOpcode
+	case 13:
+		if compare {
+			return cmpARMOpcode
+		}
+		return subARMOpcode
+	}
+	return rsbARMOpcode
+}
+
+func (n *DataProcessingTHUMB2Instruction) secondOperand() string {
+	if n.IsImmediate {
+		value, _ := expandTHUMB2Immediate(n.Immediate, false)
+		return fmt.Sprintf("%d", value)
+	}
+	shift := n.Shift.String()
+	if shift == "" {
+		return n.Rm.String()
+	}
+	return fmt.Sprintf("%s %s", n.Rm, shift)
+}
+
+func (n *DataProcessingTHUMB2Instruction) String() string {
+	opcode := n.armOpcode()
+	prefix := opcode.String()
+	if (n.Opcode == 3) && (n.Rn != 15) {
+		prefix = "orn"
+	}
+	switch opcode {
+	case tstARMOpcode, teqARMOpcode, cmnARMOpcode, cmpARMOpcode:
+		return fmt.Sprintf("%s %s, %s", prefix, n.Rn, n.secondOperand())
+	}
+	if n.SetConditions {
+		prefix += "s"
+	}
+	if (opcode == movARMOpcode) || (opcode == mvnARMOpcode) {
+		return fmt.Sprintf("%s %s, %s", prefix, n.Rd, n.secondOperand())
+	}
+	return fmt.Sprintf("%s %s, %s, %s", prefix, n.Rd, n.Rn, n.secondOperand())
+}
+
+func (n *DataProcessingTHUMB2Instruction) Encode() (uint32, error) {
+	if !n.IsImmediate && (n.Shift != nil) && n.Shift.UseRegister() {
+		// Register-specified shifts are only available as a mov.
+		c := instructionEncoder{raw: 0xfa00f000}
+		if (n.Opcode != 2) || (n.Rn != 15) {
+			c.fail("Only mov can shift by a register")
+		}
+		c.field("Shift type", uint32(n.Shift.ShiftType()), 21, 2)
+		c.flag(n.SetConditions, 0x100000)
+		c.register("Rm", n.Rm, 16)
+		c.register("Rd", n.Rd, 8)
+		c.register("Shift register", n.Shift.Register(), 0)
+		return c.result()
+	}
+	c := instructionEncoder{raw: 0xea000000}
+	if n.IsImmediate {
+		c.raw = 0xf0000000
+		c.thumb2Immediate(n.Immediate)
+	} else {
+		c.register("Rm", n.Rm, 0)
+		if n.Shift != nil {
+			c.field("Shift type", uint32(n.Shift.ShiftType()), 4, 2)
+			c.thumb2ShiftAmount("Shift amount", n.Shift.Amount())
+		}
+	}
+	c.field("Opcode", uint32(n.Opcode), 21, 4)
+	c.flag(n.SetConditions, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 8)
+	return c.result()
+}
+
+// The addw, subw, movw and movt instructions, which take a plain 12 or 16-bit
+// immediate.
+type WideImmediateTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	Rd        ARMRegister
+	Rn        ARMRegister
+	Immediate uint16
+	Subtract  bool
+	// Set for movw and movt, which don't use Rn.
+	Move bool
+	// Set for movt, which writes the top halfword of Rd.
+	Top bool
+}
+
+func (n *WideImmediateTHUMB2Instruction) String() string {
+	if n.Top {
+		return fmt.Sprintf("movt %s, %d", n.Rd, n.Immediate)
+	}
+	if n.Move {
+		return fmt.Sprintf("movw %s, %d", n.Rd, n.Immediate)
+	}
+	start := "addw"
+	if n.Subtract {
+		start = "subw"
+	}
+	return fmt.Sprintf("%s %s, %s, %d", start, n.Rd, n.Rn, n.Immediate)
+}
+
+func (n *WideImmediateTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf2000000}
+	c.register("Rd", n.Rd, 8)
+	if n.Move {
+		if n.Subtract {
+			c.fail("movw and movt can't subtract")
+		}
+		c.flag(n.Top, 0x800000)
+		c.raw |= 0x400000 | (uint32(n.Immediate>>12) << 16)
+		c.thumb2Immediate(n.Immediate & 0xfff)
+		return c.result()
+	}
+	if n.Top {
+		c.fail("movt must be a move")
+	}
+	c.flag(n.Subtract, 0xa00000)
+	c.register("Rn", n.Rn, 16)
+	c.thumb2Immediate(n.Immediate)
+	return c.result()
+}
+
+// The sbfx, ubfx, bfi and bfc instructions.
+type BitfieldTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	Rd ARMRegister
+	// This is r15 for bfc, which clears the field.
+	Rn  ARMRegister
+	LSB uint8
+	// The width minus one for sbfx and ubfx, or the most significant bit of
+	// the field for bfi and bfc.
+	WidthField uint8
+	// Set for bfi and bfc, which write the field in Rd rather than extracting
+	// it from Rn.
+	Insert   bool
+	Unsigned bool
+}
+
+func (n *BitfieldTHUMB2Instruction) width() uint8 {
+	if n.Insert {
+		return n.WidthField - n.LSB + 1
+	}
+	return n.WidthField + 1
+}
+
+func (n *BitfieldTHUMB2Instruction) String() string {
+	if n.Insert {
+		if n.Rn == 15 {
+			return fmt.Sprintf("bfc %s, %d, %d", n.Rd, n.LSB, n.width())
+		}
+		return fmt.Sprintf("bfi %s, %s, %d, %d", n.Rd, n.Rn, n.LSB, n.width())
+	}
+	start := "sbfx"
+	if n.Unsigned {
+		start = "ubfx"
+	}
+	return fmt.Sprintf("%s %s, %s, %d, %d", start, n.Rd, n.Rn, n.LSB,
+		n.width())
+}
+
+func (n *BitfieldTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf3400000}
+	if n.Insert {
+		if n.Unsigned {
+			c.fail("bfi and bfc can't be unsigned")
+		}
+		c.raw = 0xf3600000
+	} else if n.Unsigned {
+		c.raw = 0xf3c00000
+	}
+	c.register("Rd", n.Rd, 8)
+	c.register("Rn", n.Rn, 16)
+	c.thumb2ShiftAmount("LSB", n.LSB)
+	c.field("WidthField", uint32(n.WidthField), 0, 5)
+	return c.result()
+}
+
+// Returns the address operand of a Thumb-2 load or store with an immediate
+// offset.
+func thumb2AddressString(rn ARMRegister, offset uint32, preindex, up,
+	writeBack bool) string {
+	upString := ""
+	if !up {
+		upString = "-"
+	}
+	if !preindex {
+		return fmt.Sprintf("[%s], %s%d", rn, upString, offset)
+	}
+	postfix := ""
+	if writeBack {
+		postfix = "!"
+	}
+	if (offset == 0) && up {
+		return fmt.Sprintf("[%s]%s", rn, postfix)
+	}
+	return fmt.Sprintf("[%s, %s%d]%s", rn, upString, offset, postfix)
+}
+
+// Loads and stores of a single byte, halfword or word. Byte and halfword
+// loads to r15 are the pld and pli preload hints.
+type LoadStoreTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	Rt ARMRegister
+	Rn ARMRegister
+	Rm ARMRegister
+	// 0 for bytes, 1 for halfwords and 2 for words.
+	Size           uint8
+	Load           bool
+	Signed         bool
+	RegisterOffset bool
+	// Rm is shifted left by this amount, from 0 to 3.
+	Shift     uint8
+	Offset    uint16
+	Preindex  bool
+	Up        bool
+	WriteBack bool
+}
+
+func (n *LoadStoreTHUMB2Instruction) isPreload() bool {
+	return n.Load && (n.Rt == 15) && (n.Size < 2)
+}
+
+// Returns the mnemonic and register, followed by a space.
+func (n *LoadStoreTHUMB2Instruction) prefix() string {
+	if n.isPreload() {
+		if n.Signed {
+			return "pli "
+		}
+		return "pld "
+	}
+	start := "str"
+	if n.Load {
+		start = "ldr"
+	}
+	if n.Signed {
+		start += "s"
+	}
+	start += [...]string{"b", "h", ""}[n.Size]
+	return start + " " + n.Rt.String() + ", "
+}
+
+func (n *LoadStoreTHUMB2Instruction) String() string {
+	start := n.prefix()
+	if !n.RegisterOffset {
+		return start + thumb2AddressString(n.Rn, uint32(n.Offset), n.Preindex,
+			n.Up, n.WriteBack)
+	}
+	if n.Shift == 0 {
+		return fmt.Sprintf("%s[%s, %s]", start, n.Rn, n.Rm)
+	}
+	return fmt.Sprintf("%s[%s, %s, lsl %d]", start, n.Rn, n.Rm, n.Shift)
+}
+
+// Uses the 12-bit offset form if possible, and the 8-bit form otherwise.
+func (n *LoadStoreTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf8000000}
+	c.flag(n.Signed, 0x1000000)
+	c.field("Size", uint32(n.Size), 21, 2)
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rt", n.Rt, 12)
+	if n.RegisterOffset {
+		if !n.Preindex || !n.Up || n.WriteBack {
+			c.fail("Register offsets must be added without write back")
+		}
+		c.field("Shift", uint32(n.Shift), 4, 2)
+		c.register("Rm", n.Rm, 0)
+		return c.result()
+	}
+	if n.Rn == 15 {
+		// Literal loads always use the 12-bit form, which may subtract.
+		if !n.Preindex || n.WriteBack {
+			c.fail("Literal loads can't use write back")
+		}
+		c.flag(n.Up, 0x800000)
+		c.field("Offset", uint32(n.Offset), 0, 12)
+		return c.result()
+	}
+	if n.Preindex && n.Up && !n.WriteBack {
+		c.raw |= 0x800000
+		c.field("Offset", uint32(n.Offset), 0, 12)
+		return c.result()
+	}
+	if !n.Preindex && !n.WriteBack {
+		c.fail("Post-indexed addresses must use write back")
+	}
+	c.raw |= 0x800
+	c.flag(n.Preindex, 0x400)
+	c.flag(n.Up, 0x200)
+	c.flag(n.WriteBack, 0x100)
+	c.field("Offset", uint32(n.Offset), 0, 8)
+	return c.result()
+}
+
+// Literal loads use an offset from the PC aligned to a word.
+func (n *LoadStoreTHUMB2Instruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	if n.RegisterOffset || (n.Rn != 15) {
+		return 0, false
+	}
+	return addOffset(pc&^3, uint32(n.Offset), n.Up), true
+}
+
+func (n *LoadStoreTHUMB2Instruction) pcRelativeString(target string) string {
+	return n.prefix() + target
+}
+
+// The ldrd and strd instructions.
+type LoadStoreDoubleTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	Rt  ARMRegister
+	Rt2 ARMRegister
+	Rn  ARMRegister
+	// The offset, in words.
+	Offset    uint8
+	Load      bool
+	Preindex  bool
+	Up        bool
+	WriteBack bool
+}
+
+func (n *LoadStoreDoubleTHUMB2Instruction) String() string {
+	start := "strd"
+	if n.Load {
+		start = "ldrd"
+	}
+	return fmt.Sprintf("%s %s, %s, %s", start, n.Rt, n.Rt2,
+		thumb2AddressString(n.Rn, uint32(n.Offset)<<2, n.Preindex, n.Up,
+			n.WriteBack))
+}
+
+func (n *LoadStoreDoubleTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xe8400000}
+	if !n.Preindex && !n.WriteBack {
+		c.fail("Post-indexed addresses must use write back")
+	}
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.WriteBack, 0x200000)
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rt", n.Rt, 12)
+	c.register("Rt2", n.Rt2, 8)
+	c.raw |= uint32(n.Offset)
+	return c.result()
+}
+
+// The tbb and tbh table branch instructions.
+type TableBranchTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	Rn       ARMRegister
+	Rm       ARMRegister
+	Halfword bool
+}
+
+func (n *TableBranchTHUMB2Instruction) String() string {
+	if n.Halfword {
+		return fmt.Sprintf("tbh [%s, %s, lsl 1]", n.Rn, n.Rm)
+	}
+	return fmt.Sprintf("tbb [%s, %s]", n.Rn, n.Rm)
+}
+
+func (n *TableBranchTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xe8d0f000}
+	c.flag(n.Halfword, 0x10)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The sdiv and udiv instructions.
+type DivideTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	Rd       ARMRegister
+	Rn       ARMRegister
+	Rm       ARMRegister
+	Unsigned bool
+}
+
+func (n *DivideTHUMB2Instruction) String() string {
+	start := "sdiv"
+	if n.Unsigned {
+		start = "udiv"
+	}
+	return fmt.Sprintf("%s %s, %s, %s", start, n.Rd, n.Rn, n.Rm)
+}
+
+func (n *DivideTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xfb90f0f0}
+	c.flag(n.Unsigned, 0x200000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 8)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// The 32-bit b, bl and blx instructions.
+type BranchTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	// The offset in halfwords, combined from the instruction's fields. This
+	// is 24 bits long, or 20 bits for conditional branches.
+	Offset uint32
+	// This is 14 (always) unless this is a conditional branch.
+	Condition ARMCondition
+	Link      bool
+	// Set for blx, which switches to ARM state.
+	Exchange bool
+}
+
+// Returns the signed offset from the PC, in bytes.
+func (n *BranchTHUMB2Instruction) offset() int32 {
+	if n.Condition != 14 {
+		return int32(n.Offset<<12) >> 11
+	}
+	return int32(n.Offset<<8) >> 7
+}
+
+func (n *BranchTHUMB2Instruction) String() string {
+	return n.pcRelativeString(fmt.Sprintf("%d", n.offset()))
+}
+
+// blx targets are relative to the PC aligned to a word.
+func (n *BranchTHUMB2Instruction) pcRelativeTarget(pc uint32) (uint32, bool) {
+	if n.Exchange {
+		pc &^= 3
+	}
+	return pc + uint32(n.offset()), true
+}
+
+func (n *BranchTHUMB2Instruction) pcRelativeString(target string) string {
+	if n.Exchange {
+		return "blx " + target
+	}
+	if n.Link {
+		return "bl " + target
+	}
+	return fmt.Sprintf("b%s %s", n.Condition, target)
+}
+
+func (n *BranchTHUMB2Instruction) Encode() (uint32, error) {
+	if n.Condition != 14 {
+		c := instructionEncoder{raw: 0xf0008000}
+		if n.Condition > 14 {
+			c.fail("Invalid branch condition")
+		}
+		if n.Link || n.Exchange {
+			c.fail("bl and blx can't be conditional")
+		}
+		if n.Offset > 0xfffff {
+			c.fail("Offset (%d) doesn't fit in 20 bits", n.Offset)
+		}
+		offset := n.Offset & 0xfffff
+		c.raw |= (uint32(n.Condition&0xf) << 22) | ((offset >> 19) << 26) |
+			(((offset >> 18) & 1) << 11) | (((offset >> 17) & 1) << 13) |
+			((offset & 0x1f800) << 5) | (offset & 0x7ff)
+		return c.result()
+	}
+	c := instructionEncoder{raw: 0xf0009000}
+	if n.Exchange {
+		if !n.Link {
+			c.fail("blx must link")
+		}
+		if (n.Offset & 1) != 0 {
+			c.fail("blx offsets must be a multiple of 4")
+		}
+		c.raw &^= 0x1000
+	}
+	c.flag(n.Link, 0x4000)
+	if n.Offset > 0xffffff {
+		c.fail("Offset (%d) doesn't fit in 24 bits", n.Offset)
+	}
+	offset := n.Offset & 0xffffff
+	s := offset >> 23
+	j1 := ^((offset >> 22) ^ s) & 1
+	j2 := ^((offset >> 21) ^ s) & 1
+	c.raw |= (s << 26) | (j1 << 13) | (j2 << 11) |
+		((offset & 0x1ff800) << 5) | (offset & 0x7ff)
+	return c.result()
+}
+
+var barrierOptionStrings = map[uint8]string{2: "oshst", 3: "osh", 6: "nshst",
+	7: "nsh", 10: "ishst", 11: "ish", 14: "st", 15: "sy"}
+
+// The dsb, dmb and isb memory barriers, which have no effect when emulated.
+type BarrierTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	// 4 for dsb, 5 for dmb and 6 for isb.
+	Operation uint8
+	Option    uint8
+}
+
+func (n *BarrierTHUMB2Instruction) String() string {
+	start := [...]string{"dsb", "dmb", "isb"}[n.Operation-4]
+	option, ok := barrierOptionStrings[n.Option]
+	if !ok {
+		return fmt.Sprintf("%s %d", start, n.Option)
+	}
+	return fmt.Sprintf("%s %s", start, option)
+}
+
+func (n *BarrierTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf3bf8f00}
+	if (n.Operation < 4) || (n.Operation > 6) {
+		c.fail("Invalid barrier operation: %d", n.Operation)
+	}
+	c.field("Operation", uint32(n.Operation), 4, 4)
+	c.field("Option", uint32(n.Option), 0, 4)
+	return c.result()
+}
+
+// The mrs and msr instructions. On ARMv7-M processors, these access the
+// special register selected by SYSm. Otherwise they access the CPSR or SPSR,
+// like their ARM equivalents, and SYSm is 0.
+type StatusRegisterTHUMB2Instruction struct {
+	basicTHUMB2Instruction
+	WritePSR bool
+	UseSPSR  bool
+	// The destination register of mrs, or the source register of msr.
+	Rd ARMRegister
+	// The fields written by msr, with the flags in bit 3, followed by the
+	// s, x and c fields. In ARMv7-M, only bits 3 (the nzcvq flags) and 2
+	// (the GE flags) are used, and only when writing the APSR.
+	Mask uint8
+	SYSm SpecialRegister
+}
+
+func (n *StatusRegisterTHUMB2Instruction) psrString() string {
+	if !n.WritePSR {
+		if n.UseSPSR {
+			return "spsr"
+		}
+		return n.SYSm.String()
+	}
+	if !n.UseSPSR && (n.SYSm > XPSR) {
+		return n.SYSm.String()
+	}
+	if !n.UseSPSR && ((n.Mask & 3) == 0) {
+		switch n.Mask {
+		case 8:
+			return n.SYSm.String() + "_nzcvq"
+		case 4:
+			return n.SYSm.String() + "_g"
+		case 12:
+			return n.SYSm.String() + "_nzcvqg"
+		}
+	}
+	if n.UseSPSR {
+		return psrFieldsString("spsr", n.Mask)
+	}
+	return psrFieldsString("cpsr", n.Mask)
+}
+
+func (n *StatusRegisterTHUMB2Instruction) String() string {
+	if n.WritePSR {
+		return fmt.Sprintf("msr %s, %s", n.psrString(), n.Rd)
+	}
+	return fmt.Sprintf("mrs %s, %s", n.Rd, n.psrString())
+}
+
+func (n *StatusRegisterTHUMB2Instruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0xf3ef8000}
+	if n.WritePSR {
+		c.raw = 0xf3808000
+		c.register("Rd", n.Rd, 16)
+		c.field("Mask", uint32(n.Mask), 8, 4)
+	} else {
+		c.register("Rd", n.Rd, 8)
+	}
+	c.flag(n.UseSPSR, 0x100000)
+	c.field("SYSm", uint32(n.SYSm), 0, 8)
+	return c.result()
+}
+
+// Encodes the Thumb-2 ldrex and strex instructions.
+func (n *ExclusiveLoadStoreInstruction) encodeTHUMB2() (uint32, error) {
+	c := n.thumb2Encoder(0xe8400000)
+	c.register("Rn", n.Rn, 16)
+	c.raw |= uint32(n.Offset)
+	if n.Load {
+		c.raw |= 0x100f00
+		c.register("Rd", n.Rd, 12)
+		return c.result()
+	}
+	c.register("Rm", n.Rm, 12)
+	c.register("Rd", n.Rd, 8)
+	return c.result()
+}
+
+// Encodes the Thumb-2 ldm and stm instructions, which can only increment
+// after or decrement before.
+func (n *BlockDataTransferInstruction) encodeTHUMB2() (uint32, error) {
+	c := n.thumb2Encoder(0xe8000000)
+	if n.Preindex == n.Up {
+		c.fail("Thumb-2 ldm and stm must increment after or decrement " +
+			"before")
+	}
+	if n.ForceUser {
+		c.fail("Thumb-2 ldm and stm can't access user registers")
+	}
+	c.flag(n.Preindex, 0x1000000)
+	c.flag(n.Up, 0x800000)
+	c.flag(n.WriteBack, 0x200000)
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.raw |= uint32(n.RegisterList)
+	return c.result()
+}
+
+func (n *ExtendInstruction) encodeTHUMB2() (uint32, error) {
+	c := n.thumb2Encoder(0xfa40f080)
+	if n.Dual && n.Halfword {
+		c.fail("sxtb16 and uxtb16 can't extend halfwords")
+	}
+	if n.Halfword {
+		c.raw = 0xfa00f080
+	} else if n.Dual {
+		c.raw = 0xfa20f080
+	}
+	c.flag(n.Unsigned, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.register("Rd", n.Rd, 8)
+	c.field("Rotate", uint32(n.Rotate), 4, 2)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// Rm is repeated in the first halfword of the Thumb-2 encodings.
+func (n *ReverseBytesInstruction) encodeTHUMB2() (uint32, error) {
+	c := n.thumb2Encoder(0xfa90f080)
+	if n.Signed && !n.Halfwords {
+		c.fail("revsh must reverse halfwords")
+	}
+	c.flag(n.Halfwords, 0x10)
+	c.flag(n.Signed, 0x20)
+	c.register("Rm", n.Rm, 16)
+	c.register("Rd", n.Rd, 8)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+func (n *CountLeadingZerosInstruction) encodeTHUMB2() (uint32, error) {
+	c := n.thumb2Encoder(0xfab0f080)
+	c.register("Rm", n.Rm, 16)
+	c.register("Rd", n.Rd, 8)
+	c.register("Rm", n.Rm, 0)
+	return c.result()
+}
+
+// Encodes mul, mla, mls and the long multiplies, none of which set the
+// condition flags in Thumb-2.
+func (n *MultiplyInstruction) encodeTHUMB2() (uint32, error) {
+	c := n.thumb2Encoder(0xfb000000)
+	if n.SetConditions {
+		c.fail("Thumb-2 multiplies can't set the condition flags")
+	}
+	c.register("Rm", n.Rm, 16)
+	c.register("Rs", n.Rs, 0)
+	if n.IsLongMultiply {
+		if n.Subtract {
+			c.fail("Long multiplies can't subtract")
+		}
+		c.raw |= 0x800000
+		c.flag(!n.Signed, 0x200000)
+		c.flag(n.Accumulate, 0x400000)
+		c.register("RdLow", n.RdLow, 12)
+		c.register("RdHigh", n.RdHigh, 8)
+		return c.result()
+	}
+	if n.Signed {
+		c.fail("Only long multiplies can be signed")
+	}
+	if n.Subtract && !n.Accumulate {
+		c.fail("mls must accumulate")
+	}
+	c.flag(n.Subtract, 0x10)
+	c.register("Rd", n.Rd, 8)
+	if !n.Accumulate {
+		// Using r15 in place of Rn selects mul.
+		c.raw |= 0xf000
+		return c.result()
+	}
+	if (n.Rn == 15) && !n.Subtract {
+		c.fail("mla can't accumulate r15")
+	}
+	c.register("Rn", n.Rn, 12)
+	return c.result()
+}
+
+// The 16-bit cbz and cbnz instructions.
+type CompareBranchTHUMBInstruction struct {
+	basicTHUMBInstruction
+	Rn ARMRegister
+	// The 6-bit offset, in halfwords.
+	Offset  uint8
+	NonZero bool
+}
+
+func (n *CompareBranchTHUMBInstruction) String() string {
+	return n.pcRelativeString(fmt.Sprintf("%d", uint16(n.Offset)<<1))
+}
+
+func (n *CompareBranchTHUMBInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	return pc + (uint32(n.Offset) << 1), true
+}
+
+func (n *CompareBranchTHUMBInstruction) pcRelativeString(
+	target string) string {
+	start := "cbz"
+	if n.NonZero {
+		start = "cbnz"
+	}
+	return fmt.Sprintf("%s %s, %s", start, n.Rn, target)
+}
+
+func (n *CompareBranchTHUMBInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xb100}
+	c.flag(n.NonZero, 0x800)
+	// The top bit of the offset is kept apart from the other five.
+	offset := uint32(n.Offset)
+	if offset > 0x3f {
+		c.fail("Offset (%d) doesn't fit in 6 bits", offset)
+	}
+	c.raw |= ((offset & 0x20) << 4) | ((offset & 0x1f) << 3)
+	c.lowRegister("Rn", n.Rn, 0)
+	return c.resultTHUMB()
+}
+
+// The it instruction, which makes up to four following instructions
+// conditional.
+type IfThenTHUMBInstruction struct {
+	basicTHUMBInstruction
+	FirstCondition ARMCondition
+	// The low bits of the mask determine whether each of the following
+	// instructions uses the condition or its inverse. The last 1 bit marks
+	// the end of the block.
+	Mask uint8
+}
+
+// Returns "it" followed by a t or e for each of the following instructions.
+func (n *IfThenTHUMBInstruction) mnemonic() string {
+	start := "it"
+	for i := 3; (n.Mask & ((1 << uint(i)) - 1)) != 0; i-- {
+		if ((n.Mask >> uint(i)) & 1) == uint8(n.FirstCondition&1) {
+			start += "t"
+		} else {
+			start += "e"
+		}
+	}
+	return start
+}
+
+func (n *IfThenTHUMBInstruction) String() string {
+	return fmt.Sprintf("%s %s", n.mnemonic(),
+		conditionStrings[n.FirstCondition])
+}
+
+func (n *IfThenTHUMBInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xbf00}
+	if n.FirstCondition >= 15 {
+		c.fail("Invalid it condition")
+	}
+	if n.Mask == 0 {
+		c.fail("The it mask can't be 0")
+	}
+	c.raw |= uint32(n.FirstCondition&0xf) << 4
+	c.field("Mask", uint32(n.Mask), 0, 4)
+	return c.resultTHUMB()
+}
+
+var hintStrings = [...]string{"nop", "yield", "wfe", "wfi", "sev"}
+
+// The 16-bit nop, yield, wfe, wfi and sev hints, which have no effect when
+// emulated.
+type HintTHUMBInstruction struct {
+	basicTHUMBInstruction
+	Hint uint8
+}
+
+func (n *HintTHUMBInstruction) String() string {
+	if int(n.Hint) >= len(hintStrings) {
+		return fmt.Sprintf("hint %d", n.Hint)
+	}
+	return hintStrings[n.Hint]
+}
+
+func (n *HintTHUMBInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xbf00}
+	c.field("Hint", uint32(n.Hint), 4, 4)
+	return c.resultTHUMB()
+}
+
+// The 16-bit cps instruction, which sets or clears the interrupt masks.
+type ChangeProcessorStateTHUMBInstruction struct {
+	basicTHUMBInstruction
+	Disable bool
+	// The A, I and F bits, from the most significant bit to the least.
+	Flags uint8
+}
+
+func (n *ChangeProcessorStateTHUMBInstruction) String() string {
+	start := "cpsie "
+	if n.Disable {
+		start = "cpsid "
+	}
+	for i, flag := range "aif" {
+		if (n.Flags & (4 >> uint(i))) != 0 {
+			start += string(flag)
+		}
+	}
+	return start
+}
+
+func (n *ChangeProcessorStateTHUMBInstruction) Encode() (uint16, error) {
+	c := instructionEncoder{raw: 0xb660}
+	c.flag(n.Disable, 0x10)
+	c.field("Flags", uint32(n.Flags), 0, 3)
+	return c.resultTHUMB()
+}
+
+func thumb2UndefinedError(raw uint32) error {
+	return fmt.Errorf("Undefined Thumb-2 instruction 0x%08x: %w", raw,
+		errUndefinedInstruction)
+}
+
+// Returns true if the given halfword is the first half of a 32-bit Thumb-2
+// instruction.
+func IsTHUMB2Prefix(raw uint16) bool {
+	return ((raw & 0xe000) == 0xe000) && ((raw & 0x1800) != 0)
+}
+
+// Returns true if the given Thumb-2 opcode may use r15 as its destination to
+// only set the condition flags.
+func thumb2CompareOpcode(opcode uint8) bool {
+	return (opcode == 0) || (opcode == 4) || (opcode == 8) || (opcode == 13)
+}
+
+func parseDataProcessingTHUMB2Instruction(raw uint32) (THUMB2Instruction,
+	error) {
+	var toReturn DataProcessingTHUMB2Instruction
+	toReturn.raw = raw
+	toReturn.Opcode = uint8((raw >> 21) & 0xf)
+	toReturn.SetConditions = (raw & 0x100000) != 0
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Rd = ARMRegister(uint8((raw >> 8) & 0xf))
+	toReturn.IsImmediate = (raw & 0x08000000) == 0
+	if toReturn.IsImmediate {
+		toReturn.Immediate = uint16(((raw >> 15) & 0x800) |
+			((raw >> 4) & 0x700) | (raw & 0xff))
+	} else {
+		toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+		amount := ((raw >> 10) & 0x1c) | ((raw >> 6) & 3)
+		toReturn.Shift = NewARMShift(uint8((amount << 3) |
+			((raw >> 3) & 6)))
+	}
+	switch toReturn.Opcode {
+	case 0, 1, 2, 3, 4, 8, 10, 11, 13, 14:
+	default:
+		return nil, thumb2UndefinedError(raw)
+	}
+	if (toReturn.Rd == 15) && !(toReturn.SetConditions &&
+		thumb2CompareOpcode(toReturn.Opcode)) {
+		return nil, thumb2UndefinedError(raw)
+	}
+	if (toReturn.Rn == 15) && (toReturn.Opcode != 2) &&
+		(toReturn.Opcode != 3) {
+		return nil, thumb2UndefinedError(raw)
+	}
+	return &toReturn, nil
+}
+
+// Parses the data processing instructions with plain binary immediates.
+func parsePlainImmediateTHUMB2Instruction(raw uint32) (THUMB2Instruction,
+	error) {
+	rn := ARMRegister(uint8((raw >> 16) & 0xf))
+	rd := ARMRegister(uint8((raw >> 8) & 0xf))
+	immediate := uint16(((raw >> 15) & 0x800) | ((raw >> 4) & 0x700) |
+		(raw & 0xff))
+	operation := (raw >> 20) & 0x1f
+	switch operation {
+	case 0x00, 0x04, 0x0a, 0x0c:
+		var toReturn WideImmediateTHUMB2Instruction
+		toReturn.raw = raw
+		toReturn.Rd = rd
+		toReturn.Rn = rn
+		toReturn.Immediate = immediate
+		toReturn.Subtract = operation == 0x0a
+		toReturn.Move = (operation & 4) != 0
+		toReturn.Top = operation == 0x0c
+		if toReturn.Move {
+			toReturn.Immediate |= uint16(rn) << 12
+		}
+		return &toReturn, nil
+	case 0x14, 0x16, 0x1c:
+		var toReturn BitfieldTHUMB2Instruction
+		toReturn.raw = raw
+		toReturn.Rd = rd
+		toReturn.Rn = rn
+		toReturn.LSB = uint8(((raw >> 10) & 0x1c) | ((raw >> 6) & 3))
+		toReturn.WidthField = uint8(raw & 0x1f)
+		toReturn.Insert = operation == 0x16
+		toReturn.Unsigned = operation == 0x1c
+		if toReturn.Insert {
+			if toReturn.WidthField < toReturn.LSB {
+				return nil, fmt.Errorf("Invalid bitfield in 0x%08x", raw)
+			}
+		} else if (toReturn.LSB + toReturn.WidthField) > 31 {
+			return nil, fmt.Errorf("Invalid bitfield in 0x%08x", raw)
+		}
+		return &toReturn, nil
+	}
+	return nil, thumb2UndefinedError(raw)
+}
+
+func parseLoadStoreTHUMB2Instruction(raw uint32) (THUMB2Instruction, error) {
+	var toReturn LoadStoreTHUMB2Instruction
+	toReturn.raw = raw
+	toReturn.Signed = (raw & 0x1000000) != 0
+	toReturn.Size = uint8((raw >> 21) & 3)
+	toReturn.Load = (raw & 0x100000) != 0
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Rt = ARMRegister(uint8((raw >> 12) & 0xf))
+	if (toReturn.Size == 3) || (toReturn.Signed &&
+		((toReturn.Size == 2) || !toReturn.Load)) {
+		return nil, thumb2UndefinedError(raw)
+	}
+	if toReturn.Rn == 15 {
+		// Literal loads always use a 12-bit offset from the aligned PC.
+		if !toReturn.Load {
+			return nil, thumb2UndefinedError(raw)
+		}
+		toReturn.Offset = uint16(raw & 0xfff)
+		toReturn.Preindex = true
+		toReturn.Up = (raw & 0x800000) != 0
+		return &toReturn, nil
+	}
+	if (raw & 0x800000) != 0 {
+		toReturn.Offset = uint16(raw & 0xfff)
+		toReturn.Preindex = true
+		toReturn.Up = true
+		return &toReturn, nil
+	}
+	if (raw & 0x800) != 0 {
+		toReturn.Offset = uint16(raw & 0xff)
+		toReturn.Preindex = (raw & 0x400) != 0
+		toReturn.Up = (raw & 0x200) != 0
+		toReturn.WriteBack = (raw & 0x100) != 0
+		if !toReturn.Preindex && !toReturn.WriteBack {
+			return nil, thumb2UndefinedError(raw)
+		}
+		return &toReturn, nil
+	}
+	if (raw & 0xfc0) != 0 {
+		return nil, thumb2UndefinedError(raw)
+	}
+	toReturn.RegisterOffset = true
+	toReturn.Preindex = true
+	toReturn.Up = true
+	toReturn.Shift = uint8((raw >> 4) & 3)
+	toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+	if toReturn.Rm >= 13 {
+		return nil, fmt.Errorf("Invalid offset register in 0x%08x", raw)
+	}
+	return &toReturn, nil
+}
+
+// Parses ldrd, strd, ldrex, strex, tbb and tbh.
+func parseLoadStoreDualTHUMB2Instruction(raw uint32) (THUMB2Instruction,
+	error) {
+	rn := ARMRegister(uint8((raw >> 16) & 0xf))
+	rt := ARMRegister(uint8((raw >> 12) & 0xf))
+	load := (raw & 0x100000) != 0
+	if (raw & 0x1200000) != 0 {
+		var toReturn LoadStoreDoubleTHUMB2Instruction
+		toReturn.raw = raw
+		toReturn.Rt = rt
+		toReturn.Rt2 = ARMRegister(uint8((raw >> 8) & 0xf))
+		toReturn.Rn = rn
+		toReturn.Offset = uint8(raw)
+		toReturn.Load = load
+		toReturn.Preindex = (raw & 0x1000000) != 0
+		toReturn.Up = (raw & 0x800000) != 0
+		toReturn.WriteBack = (raw & 0x200000) != 0
+		if (toReturn.Rt == 15) || (toReturn.Rt2 == 15) {
+			return nil, fmt.Errorf("ldrd and strd can't use r15")
+		}
+		return &toReturn, nil
+	}
+	if (raw & 0x800000) != 0 {
+		if !load || ((raw & 0xffe0) != 0xf000) {
+			return nil, thumb2UndefinedError(raw)
+		}
+		var toReturn TableBranchTHUMB2Instruction
+		toReturn.raw = raw
+		toReturn.Rn = rn
+		toReturn.Rm = ARMRegister(uint8(raw & 0xf))
+		toReturn.Halfword = (raw & 0x10) != 0
+		return &toReturn, nil
+	}
+	var toReturn ExclusiveLoadStoreInstruction
+	toReturn.raw = raw
+	toReturn.thumb2 = true
+	toReturn.Rn = rn
+	toReturn.Offset = uint8(raw)
+	toReturn.Load = load
+	if load {
+		if (raw & 0xf00) != 0xf00 {
+			return nil, thumb2UndefinedError(raw)
+		}
+		toReturn.Rd = rt
+	} else {
+		toReturn.Rd = ARMRegister(uint8((raw >> 8) & 0xf))
+		toReturn.Rm = rt
+	}
+	if (toReturn.Rd == 15) || (toReturn.Rn == 15) ||
+		(!toReturn.Load && (toReturn.Rm == 15)) {
+		return nil, fmt.Errorf("ldrex and strex can't use r15")
+	}
+	if !toReturn.Load && ((toReturn.Rd == toReturn.Rn) ||
+		(toReturn.Rd == toReturn.Rm)) {
+		return nil, fmt.Errorf("The strex status register must differ")
+	}
+	return &toReturn, nil
+}
+
+// Parses ldm and stm, which use the same instruction type as in ARM mode.
+func parseLoadStoreMultipleTHUMB2Instruction(raw uint32) (THUMB2Instruction,
+	error) {
+	var toReturn BlockDataTransferInstruction
+	toReturn.raw = raw
+	toReturn.thumb2 = true
+	toReturn.RegisterList = uint16(raw)
+	toReturn.Rn = ARMRegister(uint8((raw >> 16) & 0xf))
+	toReturn.Load = (raw & 0x100000) != 0
+	toReturn.WriteBack = (raw & 0x200000) != 0
+	switch (raw >> 23) & 3 {
+	case 1:
+		toReturn.Up = true
+	case 2:
+		toReturn.Preindex = true
+	default:
+		return nil, thumb2UndefinedError(raw)
+	}
+	if (toReturn.Rn == 15) || ((raw & 0x2000) != 0) ||
+		(!toReturn.Load && ((raw & 0x8000) != 0)) {
+		return nil, fmt.Errorf("Invalid register list in 0x%08x", raw)
+	}
+	return &toReturn, nil
+}
+
+// Parses the shifts, extends, byte reversal and clz, which only use
+// registers.
+func parseRegisterTHUMB2Instruction(raw uint32) (THUMB2Instruction, error) {
+	if (raw & 0xf000) != 0xf000 {
+		return nil, thumb2UndefinedError(raw)
+	}
+	rn := ARMRegister(uint8((raw >> 16) & 0xf))
+	rd := ARMRegister(uint8((raw >> 8) & 0xf))
+	rm := ARMRegister(uint8(raw & 0xf))
+	operation := (raw >> 20) & 0xf
+	if ((raw & 0x800000) == 0) && ((raw & 0xf0) == 0) {
+		// Register-specified shifts are equivalent to mov with a shift.
+		var toReturn DataProcessingTHUMB2Instruction
+		toReturn.raw = raw
+		toReturn.Opcode = 2
+		toReturn.SetConditions = (raw & 0x100000) != 0
+		toReturn.Rd = rd
+		toReturn.Rn = 15
+		toReturn.Rm = rn
+		toReturn.Shift = NewARMShift(uint8((uint32(rm) << 4) |
+			((raw >> 20) & 6) | 1))
+		return &toReturn, nil
+	}
+	if ((raw & 0x800000) == 0) && ((raw & 0x80) != 0) {
+		if (operation >= 6) || ((raw & 0x40) != 0) {
+			return nil, thumb2UndefinedError(raw)
+		}
+		var toReturn ExtendInstruction
+		toReturn.raw = raw
+		toReturn.thumb2 = true
+		toReturn.Rd = rd
+		toReturn.Rn = rn
+		toReturn.Rm = rm
+		toReturn.Rotate = uint8((raw >> 4) & 3)
+		toReturn.Unsigned = (raw & 0x100000) != 0
+		toReturn.Halfword = operation < 2
+		toReturn.Dual = (operation >> 1) == 1
+		return &toReturn, nil
+	}
+	if (operation == 0x9) && ((raw & 0xf0) != 0xa0) {
+		var toReturn ReverseBytesInstruction
+		toReturn.raw = raw
+		toReturn.thumb2 = true
+		toReturn.Rd = rd
+		toReturn.Rm = rm
+		toReturn.Halfwords = (raw & 0x10) != 0
+		toReturn.Signed = (raw & 0x30) == 0x30
+		if (raw & 0xc0) != 0x80 {
+			return nil, thumb2UndefinedError(raw)
+		}
+		return &toReturn, nil
+	}
+	if (operation == 0xb) && ((raw & 0xf0) == 0x80) {
+		var toReturn CountLeadingZerosInstruction
+		toReturn.raw = raw
+		toReturn.thumb2 = true
+		toReturn.Rd = rd
+		toReturn.Rm = rm
+		return &toReturn, nil
+	}
+	return nil, thumb2UndefinedError(raw)
+}
+
+// Parses mul, mla, mls, the long multiplies and the divides.
+func parseMultiplyTHUMB2Instruction(raw uint32) (THUMB2Instruction, error) {
+	rn := ARMRegister(uint8((raw >> 16) & 0xf))
+	ra := ARMRegister(uint8((raw >> 12) & 0xf))
+	rd := ARMRegister(uint8((raw >> 8) & 0xf))
+	rm := ARMRegister(uint8(raw & 0xf))
+	operation := (raw >> 20) & 7
+	if (raw & 0x800000) == 0 {
+		if (operation != 0) || ((raw & 0xe0) != 0) {
+			return nil, thumb2UndefinedError(raw)
+		}
+		var toReturn MultiplyInstruction
+		toReturn.raw = raw
+		toReturn.thumb2 = true
+		toReturn.Rd = rd
+		toReturn.Rm = rn
+		toReturn.Rs = rm
+		toReturn.Rn = ra
+		toReturn.Subtract = (raw & 0x10) != 0
+		toReturn.Accumulate = (ra != 15) || toReturn.Subtract
+		return &toReturn, nil
+	}
+	if ((operation & 1) != 0) && (operation < 4) {
+		if (raw & 0xf0f0) != 0xf0f0 {
+			return nil, thumb2UndefinedError(raw)
+		}
+		var toReturn DivideTHUMB2Instruction
+		toReturn.raw = raw
+		toReturn.Rd = rd
+		toReturn.Rn = rn
+		toReturn.Rm = rm
+		toReturn.Unsigned = operation == 3
+		return &toReturn, nil
+	}
+	if ((operation & 1) != 0) || ((raw & 0xf0) != 0) {
+		return nil, thumb2UndefinedError(raw)
+	}
+	var toReturn MultiplyInstruction
+	toReturn.raw = raw
+	toReturn.thumb2 = true
+	toReturn.IsLongMultiply = true
+	toReturn.RdLow = ra
+	toReturn.RdHigh = rd
+	toReturn.Rm = rn
+	toReturn.Rs = rm
+	toReturn.Signed = (operation & 2) == 0
+	toReturn.Accumulate = (operation & 4) != 0
+	return &toReturn, nil
+}
+
+// Parses the branches, and the barriers among the miscellaneous control
+// instructions.
+func parseBranchTHUMB2Instruction(raw uint32) (THUMB2Instruction, error) {
+	var toReturn BranchTHUMB2Instruction
+	toReturn.raw = raw
+	s := (raw >> 26) & 1
+	j1 := (raw >> 13) & 1
+	j2 := (raw >> 11) & 1
+	if (raw & 0x5000) == 0 {
+		condition := ARMCondition((raw >> 22) & 0xf)
+		if condition >= 14 {
+			return parseMiscControlTHUMB2Instruction(raw)
+		}
+		toReturn.Condition = condition
+		toReturn.Offset = (s << 19) | (j2 << 18) | (j1 << 17) |
+			((raw >> 5) & 0x1f800) | (raw & 0x7ff)
+		return &toReturn, nil
+	}
+	toReturn.Condition = 14
+	i1 := ^(j1 ^ s) & 1
+	i2 := ^(j2 ^ s) & 1
+	toReturn.Offset = (s << 23) | (i1 << 22) | (i2 << 21) |
+		((raw >> 5) & 0x1ff800) | (raw & 0x7ff)
+	toReturn.Link = (raw & 0x4000) != 0
+	toReturn.Exchange = toReturn.Link && ((raw & 0x1000) == 0)
+	if toReturn.Exchange && ((raw & 1) != 0) {
+		return nil, fmt.Errorf("Invalid blx offset: %w",
+			errUndefinedInstruction)
+	}
+	return &toReturn, nil
+}
+
+// Parses mrs, msr and the barriers, which are encoded in place of conditional
+// branches using conditions 14 and 15.
+func parseMiscControlTHUMB2Instruction(raw uint32) (THUMB2Instruction,
+	error) {
+	switch (raw >> 21) & 0x1f {
+	case 0x1c, 0x1f:
+		return parseStatusRegisterTHUMB2Instruction(raw)
+	}
+	return parseBarrierTHUMB2Instruction(raw)
+}
+
+func parseStatusRegisterTHUMB2Instruction(raw uint32) (THUMB2Instruction,
+	error) {
+	if (raw & 0xd000) != 0x8000 {
+		return nil, thumb2UndefinedError(raw)
+	}
+	var toReturn StatusRegisterTHUMB2Instruction
+	toReturn.raw = raw
+	toReturn.WritePSR = (raw & 0x200000) == 0
+	toReturn.UseSPSR = (raw & 0x100000) != 0
+	toReturn.SYSm = SpecialRegister(raw & 0xff)
+	if toReturn.WritePSR {
+		toReturn.Rd = ARMRegister(uint8((raw >> 16) & 0xf))
+		toReturn.Mask = uint8((raw >> 8) & 0xf)
+		if toReturn.Mask == 0 {
+			return nil, thumb2UndefinedError(raw)
+		}
+	} else {
+		if (raw & 0xf0000) != 0xf0000 {
+			return nil, thumb2UndefinedError(raw)
+		}
+		toReturn.Rd = ARMRegister(uint8((raw >> 8) & 0xf))
+	}
+	if (toReturn.Rd >= 13) || !toReturn.SYSm.isValid() ||
+		(toReturn.UseSPSR && (toReturn.SYSm != 0)) {
+		return nil, thumb2UndefinedError(raw)
+	}
+	return &toReturn, nil
+}
+
+func parseBarrierTHUMB2Instruction(raw uint32) (THUMB2Instruction, error) {
+	operation := uint8((raw >> 4) & 0xf)
+	if ((raw & 0xffffff00) != 0xf3bf8f00) || (operation < 4) ||
+		(operation > 6) {
+		return nil, thumb2UndefinedError(raw)
+	}
+	var toReturn BarrierTHUMB2Instruction
+	toReturn.raw = raw
+	toReturn.Operation = operation
+	toReturn.Option = uint8(raw & 0xf)
+	return &toReturn, nil
+}
+
+// Parses a 32-bit Thumb-2 instruction. The first halfword must be in the
+// upper 16 bits of raw.
+func ParseTHUMB2Instruction(raw uint32) (THUMB2Instruction, error) {
+	if !IsTHUMB2Prefix(uint16(raw >> 16)) {
+		return nil, fmt.Errorf("0x%08x isn't a Thumb-2 instruction", raw)
+	}
+	switch (raw >> 27) & 3 {
+	case 1:
+		if (raw & 0x04000000) != 0 {
+			// Coprocessor instructions aren't supported in Thumb-2.
+			return nil, thumb2UndefinedError(raw)
+		}
+		if (raw & 0x02000000) != 0 {
+			return parseDataProcessingTHUMB2Instruction(raw)
+		}
+		if (raw & 0x00400000) != 0 {
+			return parseLoadStoreDualTHUMB2Instruction(raw)
+		}
+		return parseLoadStoreMultipleTHUMB2Instruction(raw)
+	case 2:
+		if (raw & 0x8000) != 0 {
+			return parseBranchTHUMB2Instruction(raw)
+		}
+		if (raw & 0x02000000) != 0 {
+			return parsePlainImmediateTHUMB2Instruction(raw)
+		}
+		return parseDataProcessingTHUMB2Instruction(raw)
+	}
+	switch (raw >> 24) & 7 {
+	case 0:
+		return parseLoadStoreTHUMB2Instruction(raw)
+	case 1:
+		if (raw & 0x100000) != 0 {
+			return parseLoadStoreTHUMB2Instruction(raw)
+		}
+	case 2:
+		return parseRegisterTHUMB2Instruction(raw)
+	case 3:
+		return parseMultiplyTHUMB2Instruction(raw)
+	}
+	return nil, thumb2UndefinedError(raw)
+}
+
+func parseCompareBranchTHUMBInstruction(raw uint16) (THUMBInstruction,
+	error) {
+	var toReturn CompareBranchTHUMBInstruction
+	toReturn.raw = raw
+	toReturn.Rn = ARMRegister(uint8(raw & 7))
+	toReturn.Offset = uint8(((raw >> 4) & 0x20) | ((raw >> 3) & 0x1f))
+	toReturn.NonZero = (raw & 0x800) != 0
+	return &toReturn, nil
+}
+
+func parseIfThenTHUMBInstruction(raw uint16) (THUMBInstruction, error) {
+	if (raw & 0xf) == 0 {
+		var toReturn HintTHUMBInstruction
+		toReturn.raw = raw
+		toReturn.Hint = uint8(raw>>4) & 0xf
+		return &toReturn, nil
+	}
+	var toReturn IfThenTHUMBInstruction
+	toReturn.raw = raw
+	toReturn.FirstCondition = ARMCondition((raw >> 4) & 0xf)
+	toReturn.Mask = uint8(raw & 0xf)
+	if toReturn.FirstCondition == 15 {
+		return nil, fmt.Errorf("Invalid it condition: %w",
+			errUndefinedInstruction)
+	}
+	return &toReturn, nil
+}
+
+func parseChangeProcessorStateTHUMBInstruction(raw uint16) (THUMBInstruction,
+	error) {
+	var toReturn ChangeProcessorStateTHUMBInstruction
+	toReturn.raw = raw
+	toReturn.Disable = (raw & 0x10) != 0
+	toReturn.Flags = uint8(raw & 7)
+	return &toReturn, nil
+}
+
+// Parses the 16-bit THUMB instructions in ARMv7. Halfwords starting 32-bit
+// instructions must be parsed using ParseTHUMB2Instruction instead.
+func parseTHUMBv7Instruction(raw uint16) (THUMBInstruction, error) {
+	if IsTHUMB2Prefix(raw) {
+		return nil, fmt.Errorf("0x%04x begins a 32-bit instruction: %w", raw,
+			errUndefinedInstruction)
+	}
+	if (raw & 0xf500) == 0xb100 {
+		return parseCompareBranchTHUMBInstruction(raw)
+	}
+	if (raw & 0xff00) == 0xbf00 {
+		return parseIfThenTHUMBInstruction(raw)
+	}
+	return parseTHUMBv6Instruction(raw)
+}
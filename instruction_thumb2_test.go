@@ -0,0 +1,233 @@
+package arm_emulate
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestTHUMB2InstructionStrings(t *testing.T) {
+	expected := map[uint32]string{
+		0xf1010001: "add r0, r1, 1",
+		0xf04f10ff: "mov r0, 16711935",
+		0xf0214000: "bic r0, r1, 2147483648",
+		0xf06100ff: "orn r0, r1, 255",
+		0xf1b00f01: "cmp r0, 1",
+		0xeb110082: "adds r0, r1, r2 lsl 2",
+		0xfa01f002: "mov r0, r1 lsl r2",
+		0xf2412034: "movw r0, 4660",
+		0xf2c56078: "movt r0, 22136",
+		0xf20f0004: "addw r0, pc, 4",
+		0xf3c11007: "ubfx r0, r1, 4, 8",
+		0xf3411007: "sbfx r0, r1, 4, 8",
+		0xf361100b: "bfi r0, r1, 4, 8",
+		0xf36f100b: "bfc r0, 4, 8",
+		0xf8d10004: "ldr r0, [r1, 4]",
+		0xf8510c04: "ldr r0, [r1, -4]",
+		0xf8510b04: "ldr r0, [r1], 4",
+		0xf8510f04: "ldr r0, [r1, 4]!",
+		0xf8510022: "ldr r0, [r1, r2, lsl 2]",
+		0xf9b10002: "ldrsh r0, [r1, 2]",
+		0xf8010001: "strb r0, [r1, r1]",
+		0xf8df0008: "ldr r0, [pc, 8]",
+		0xf891f000: "pld [r1]",
+		0xe9c20102: "strd r0, r1, [r2, 8]",
+		0xe9f20102: "ldrd r0, r1, [r2, 8]!",
+		0xe8d0f001: "tbb [r0, r1]",
+		0xe8d0f011: "tbh [r0, r1, lsl 1]",
+		0xe8510f00: "ldrex r0, [r1]",
+		0xe8410201: "strex r2, r0, [r1, 4]",
+		0xe8bd8010: "ldmfd sp!, {r4, pc}",
+		0xfb91f0f2: "sdiv r0, r1, r2",
+		0xfbb1f0f2: "udiv r0, r1, r2",
+		0xfb01f002: "mul r0, r1, r2",
+		0xfb013002: "mla r0, r1, r2, r3",
+		0xfb013012: "mls r0, r1, r2, r3",
+		0xfba20103: "umull r0, r1, r2, r3",
+		0xfa5ff081: "uxtb r0, r1",
+		0xfa91f081: "rev r0, r1",
+		0xfab1f081: "clz r0, r1",
+		0xf000f880: "bl 256",
+		0xf000e880: "blx 256",
+		0xf7ffbffe: "b -4",
+		0xf0008004: "beq 8",
+		0xf3bf8f5b: "dmb ish",
+		0xf3ef8009: "mrs r0, psp",
+		0xf3ff8000: "mrs r0, spsr",
+		0xf3808811: "msr basepri, r0",
+		0xf3808c00: "msr apsr_nzcvqg, r0",
+		0xf3818f00: "msr cpsr_fsxc, r1",
+	}
+	for raw, s := range expected {
+		n, e := ParseTHUMB2Instruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != s {
+			t.Logf("Expected 0x%08x to be %s, got %s\n", raw, s, n)
+			t.Fail()
+		}
+	}
+	// Coprocessor instructions and ssat aren't supported.
+	for _, raw := range []uint32{0xee000a10, 0xf3010010} {
+		_, e := ParseTHUMB2Instruction(raw)
+		if e == nil {
+			t.Logf("Didn't get an error for 0x%08x.\n", raw)
+			t.Fail()
+		}
+	}
+}
+
+func TestTHUMBv7InstructionStrings(t *testing.T) {
+	expected := map[uint16]string{
+		0xb110: "cbz r0, 4",
+		0xbbf9: "cbnz r1, 126",
+		0xbf08: "it eq",
+		0xbf0c: "ite eq",
+		0xbf1a: "itte ne",
+		0xbf00: "nop",
+		0xbf30: "wfi",
+		0xb672: "cpsid i",
+		0xb663: "cpsie if",
+	}
+	for raw, s := range expected {
+		n, e := ParseTHUMBInstructionForArchitecture(raw, ARMv7)
+		if e != nil {
+			t.Logf("Failed parsing 0x%04x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != s {
+			t.Logf("Expected 0x%04x to be %s, got %s\n", raw, s, n)
+			t.Fail()
+		}
+	}
+	_, e := ParseTHUMBInstructionForArchitecture(0xf000, ARMv7)
+	if e == nil {
+		t.Logf("Didn't get an error for a 32-bit instruction prefix.\n")
+		t.Fail()
+	}
+}
+
+// Returns the bits of a Thumb-2 encoding which the parser ignores, so encoding
+// the instruction may not reproduce them.
+func thumb2IgnoredBits(n THUMB2Instruction) uint32 {
+	switch n := n.(type) {
+	case *DataProcessingTHUMB2Instruction:
+		return 0x8000
+	case *BitfieldTHUMB2Instruction:
+		return 0x04000020
+	case *StatusRegisterTHUMB2Instruction:
+		return 0x04002000
+	case *ReverseBytesInstruction, *CountLeadingZerosInstruction:
+		// Rm is repeated in the first halfword.
+		return 0xf0000
+	case *LoadStoreTHUMB2Instruction:
+		// ldrt and strt are parsed as ordinary loads and stores, which use
+		// the 12-bit offset form.
+		if n.Preindex && n.Up && !n.WriteBack && !n.RegisterOffset {
+			return 0x800e00
+		}
+	}
+	return 0
+}
+
+func TestTHUMB2InstructionRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 0x100000; i++ {
+		raw := random.Uint32() | 0xe0000000
+		n, e := ParseTHUMB2Instruction(raw)
+		if e != nil {
+			continue
+		}
+		encoded, e := n.Encode()
+		if e != nil {
+			t.Logf("Failed encoding 0x%08x (%s): %s\n", raw, n, e)
+			t.FailNow()
+		}
+		parsed, e := ParseTHUMB2Instruction(encoded)
+		if (((encoded ^ raw) &^ thumb2IgnoredBits(n)) != 0) || (e != nil) ||
+			(fmt.Sprintf("%T", parsed) != fmt.Sprintf("%T", n)) ||
+			(parsed.String() != n.String()) {
+			t.Logf("0x%08x (%s) was encoded as 0x%08x (%s)\n", raw, n,
+				encoded, parsed)
+			t.FailNow()
+		}
+	}
+}
+
+func TestTHUMB2InstructionEncode(t *testing.T) {
+	var tests = map[uint32]THUMB2Instruction{
+		0xf1010001: &DataProcessingTHUMB2Instruction{Opcode: 8, Rd: 0,
+			Rn: 1, IsImmediate: true, Immediate: 1},
+		0xeb110082: &DataProcessingTHUMB2Instruction{Opcode: 8,
+			SetConditions: true, Rn: 1, Rm: 2, Shift: NewARMShift(0x10)},
+		0xfa01f002: &DataProcessingTHUMB2Instruction{Opcode: 2, Rn: 15,
+			Rm: 1, Shift: NewARMShift(0x21)},
+		0xf2c56078: &WideImmediateTHUMB2Instruction{Immediate: 0x5678,
+			Move: true, Top: true},
+		0xf36f100b: &BitfieldTHUMB2Instruction{Rn: 15, LSB: 4,
+			WidthField: 11, Insert: true},
+		0xf8510c04: &LoadStoreTHUMB2Instruction{Rn: 1, Size: 2, Load: true,
+			Offset: 4, Preindex: true},
+		0xf8d10004: &LoadStoreTHUMB2Instruction{Rn: 1, Size: 2, Load: true,
+			Offset: 4, Preindex: true, Up: true},
+		0xe9f20102: &LoadStoreDoubleTHUMB2Instruction{Rt2: 1, Rn: 2,
+			Offset: 2, Load: true, Preindex: true, Up: true,
+			WriteBack: true},
+		0xe8d0f011: &TableBranchTHUMB2Instruction{Rm: 1, Halfword: true},
+		0xfbb1f0f2: &DivideTHUMB2Instruction{Rn: 1, Rm: 2, Unsigned: true},
+		0xf7ffffff: &BranchTHUMB2Instruction{Offset: 0xffffff,
+			Condition: 14, Link: true},
+		0xf43fafff: &BranchTHUMB2Instruction{Offset: 0xfffff},
+		0xf3bf8f4f: &BarrierTHUMB2Instruction{Operation: 4, Option: 15},
+		0xf3ef8009: &StatusRegisterTHUMB2Instruction{SYSm: 9},
+	}
+	for expected, n := range tests {
+		raw, e := n.Encode()
+		if e != nil {
+			t.Logf("Failed encoding %s: %s\n", n, e)
+			t.Fail()
+			continue
+		}
+		if raw != expected {
+			t.Logf("Encoded %s as 0x%08x, expected 0x%08x\n", n, raw,
+				expected)
+			t.Fail()
+		}
+	}
+	// Instructions shared with ARM keep their Thumb-2 encodings.
+	for _, raw := range []uint32{0xe8bd8010, 0xe8410201, 0xfa1ff081,
+		0xfab2f082, 0xfb010302, 0xfba10203} {
+		n, e := ParseTHUMB2Instruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.FailNow()
+		}
+		encoded, e := n.Encode()
+		if (e != nil) || (encoded != raw) {
+			t.Logf("0x%08x (%s) was encoded as 0x%08x (%v)\n", raw, n,
+				encoded, e)
+			t.Fail()
+		}
+	}
+	invalid := []THUMB2Instruction{
+		&DataProcessingTHUMB2Instruction{Opcode: 8, Rm: 1,
+			Shift: NewARMShift(0x21)},
+		&WideImmediateTHUMB2Instruction{Immediate: 0x1000},
+		&LoadStoreTHUMB2Instruction{Offset: 0x100, Preindex: true,
+			WriteBack: true},
+		&BranchTHUMB2Instruction{Offset: 1, Condition: 14, Link: true,
+			Exchange: true},
+		&BarrierTHUMB2Instruction{Operation: 7},
+	}
+	for _, n := range invalid {
+		raw, e := n.Encode()
+		if e == nil {
+			t.Logf("Didn't get an error encoding %s (got 0x%08x)\n", n, raw)
+			t.Fail()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package arm_emulate
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -62,3 +63,158 @@ func TestAddToStackPointerInstruction(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTHUMBInstructionStrings(t *testing.T) {
+	expected := map[uint16]string{
+		// The offset is in words.
+		0x9802: "ldr r0, [sp, 8]",
+		0x9001: "str r0, [sp, 4]",
+		// Right shifts by 0 are encoded as shifts by 32.
+		0x0808: "lsr r0, r1, 32",
+		0x1008: "asr r0, r1, 32",
+		0x0008: "lsl r0, r1, 0",
+		0xb500: "push {lr}",
+		0xbd00: "pop {pc}",
+		// The ARMv6 instructions share the push and pop opcode space.
+		0xb2c0: "uxtb r0, r0",
+		0xb208: "sxth r0, r1",
+		0xb251: "sxtb r1, r2",
+		0xb29a: "uxth r2, r3",
+		0xba00: "rev r0, r0",
+		0xba48: "rev16 r0, r1",
+		0xbada: "revsh r2, r3",
+		0xb650: "setend le",
+		0xb658: "setend be",
+		0xb672: "cpsid i",
+	}
+	for raw, expectedString := range expected {
+		n, e := ParseTHUMBInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%04x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != expectedString {
+			t.Logf("Expected \"%s\" for 0x%04x, got \"%s\"\n", expectedString,
+				raw, n)
+			t.Fail()
+		}
+	}
+	undefined := []struct {
+		raw          uint16
+		architecture ARMArchitecture
+	}{
+		{0xba80, ARMv6},
+		{0xb600, ARMv6},
+		{0xb2c0, ARMv5TE},
+		{0xba00, ARMv5TE},
+		{0xb650, ARMv5TE},
+		{0xb100, ARMv6},
+	}
+	for _, u := range undefined {
+		n, e := ParseTHUMBInstructionForArchitecture(u.raw, u.architecture)
+		if e == nil {
+			t.Logf("Expected 0x%04x to be undefined in %s, got %s\n", u.raw,
+				u.architecture, n)
+			t.Fail()
+		}
+	}
+}
+
+func TestTHUMBInstructionRoundTrip(t *testing.T) {
+	for _, architecture := range []ARMArchitecture{ARMv6, ARMv7} {
+		for i := 0; i < 0x10000; i++ {
+			raw := uint16(i)
+			n, e := ParseTHUMBInstructionForArchitecture(raw, architecture)
+			if e != nil {
+				continue
+			}
+			encoded, e := n.Encode()
+			if e != nil {
+				t.Logf("Failed encoding 0x%04x (%s): %s\n", raw, n, e)
+				t.FailNow()
+			}
+			if encoded != raw {
+				t.Logf("0x%04x (%s) was encoded as 0x%04x\n", raw, n,
+					encoded)
+				t.FailNow()
+			}
+			parsed, e := ParseTHUMBInstructionForArchitecture(encoded,
+				architecture)
+			if e != nil {
+				t.Logf("Failed parsing 0x%04x, encoded from 0x%04x (%s): "+
+					"%s\n", encoded, raw, n, e)
+				t.FailNow()
+			}
+			reencoded, e := parsed.Encode()
+			if (e != nil) || (reencoded != encoded) ||
+				(fmt.Sprintf("%T", parsed) != fmt.Sprintf("%T", n)) ||
+				(parsed.String() != n.String()) {
+				t.Logf("0x%04x (%s) was encoded as 0x%04x (%s)\n", raw, n,
+					encoded, parsed)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestTHUMBInstructionEncode(t *testing.T) {
+	var tests = map[uint16]THUMBInstruction{
+		0xf7ff: &LongBranchAndLinkInstruction{Offset: 0x7ff},
+		0xfffe: &LongBranchAndLinkInstruction{Offset: 0x7fe,
+			OffsetLow: true},
+		0xe802: &LongBranchAndLinkInstruction{Offset: 2, OffsetLow: true,
+			Exchange: true},
+		0xb580: &PushPopRegistersInstruction{RegisterList: 0x80,
+			StoreLRLoadPC: true},
+		0x4680: &HighRegisterOperationInstruction{Operation: 2, Rd: 8},
+		0x4770: &HighRegisterOperationInstruction{Operation: 3, Rs: 14},
+		0x4798: &HighRegisterOperationInstruction{Operation: 3, Rs: 3,
+			Link: true},
+		0x4348: &ALUOperationInstruction{Opcode: NewALUOpcodeTHUMB(13),
+			Rs: 1},
+		0x6848: &LoadStoreImmediateOffsetInstruction{Rb: 1, Offset: 1,
+			Load: true},
+		0xd1fe: &ConditionalBranchInstruction{Condition: 1, Offset: 0xfe},
+		0xb110: &CompareBranchTHUMBInstruction{Offset: 2},
+		0xbf08: &IfThenTHUMBInstruction{Mask: 8},
+		0xb2f7: &ExtendTHUMBInstruction{Rd: 7, Rm: 6, Unsigned: true},
+		0xbac8: &ReverseBytesTHUMBInstruction{Rm: 1, Halfwords: true,
+			Signed: true},
+		0xb658: &SetEndiannessTHUMBInstruction{BigEndian: true},
+	}
+	for expected, n := range tests {
+		raw, e := n.Encode()
+		if e != nil {
+			t.Logf("Failed encoding %s: %s\n", n, e)
+			t.Fail()
+			continue
+		}
+		if raw != expected {
+			t.Logf("Encoded %s as 0x%04x, expected 0x%04x\n", n, raw,
+				expected)
+			t.Fail()
+		}
+	}
+	invalid := []THUMBInstruction{
+		&LoadStoreImmediateOffsetInstruction{Rd: 8},
+		&LoadStoreHalfwordInstruction{Offset: 32},
+		&MoveShiftedRegisterInstruction{Operation: 3},
+		&ConditionalBranchInstruction{Condition: 14},
+		&LongBranchAndLinkInstruction{Offset: 1, OffsetLow: true,
+			Exchange: true},
+		&HighRegisterOperationInstruction{Operation: 3, Rd: 8},
+		&AddToStackPointerInstruction{Offset: 0x80},
+		&ALUOperationInstruction{},
+		&IfThenTHUMBInstruction{},
+		&ExtendTHUMBInstruction{Rd: 8},
+		&ReverseBytesTHUMBInstruction{Signed: true},
+	}
+	for _, n := range invalid {
+		raw, e := n.Encode()
+		if e == nil {
+			t.Logf("Didn't get an error encoding %s (got 0x%04x)\n", n, raw)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package arm_emulate
+
+// This file contains the types for VFP instructions, which are coprocessor
+// instructions using coprocessors 10 (single precision) and 11 (double
+// precision). They embed the generic coprocessor instruction types, so they
+// are emulated by passing them to the processor's coprocessors.
+
+import (
+	"fmt"
+)
+
+// The data processing operations carried out by a VFP coprocessor. The first
+// nine values match the p, q, r and s bits of the instruction.
+type VFPOpcode uint8
+
+const (
+	fmacVFPOpcode VFPOpcode = iota
+	fnmacVFPOpcode
+	fmscVFPOpcode
+	fnmscVFPOpcode
+	fmulVFPOpcode
+	fnmulVFPOpcode
+	faddVFPOpcode
+	fsubVFPOpcode
+	fdivVFPOpcode
+	fcpyVFPOpcode
+	fabsVFPOpcode
+	fnegVFPOpcode
+	fsqrtVFPOpcode
+	fcmpVFPOpcode
+	fcmpeVFPOpcode
+	fcmpzVFPOpcode
+	fcmpezVFPOpcode
+	fcvtVFPOpcode
+	fuitoVFPOpcode
+	fsitoVFPOpcode
+	ftouiVFPOpcode
+	ftouizVFPOpcode
+	ftosiVFPOpcode
+	ftosizVFPOpcode
+)
+
+var vfpOpcodeStrings = [...]string{"fmac", "fnmac", "fmsc", "fnmsc", "fmul",
+	"fnmul", "fadd", "fsub", "fdiv", "fcpy", "fabs", "fneg", "fsqrt", "fcmp",
+	"fcmpe", "fcmpz", "fcmpez", "fcvt", "fuito", "fsito", "ftoui", "ftouiz",
+	"ftosi", "ftosiz"}
+
+// Maps the extension opcode (the Fn and N fields) of instructions with p, q,
+// r and s all set to the operation.
+var vfpExtensionOpcodes = map[uint8]VFPOpcode{
+	0x00: fcpyVFPOpcode,
+	0x01: fabsVFPOpcode,
+	0x02: fnegVFPOpcode,
+	0x03: fsqrtVFPOpcode,
+	0x08: fcmpVFPOpcode,
+	0x09: fcmpeVFPOpcode,
+	0x0a: fcmpzVFPOpcode,
+	0x0b: fcmpezVFPOpcode,
+	0x0f: fcvtVFPOpcode,
+	0x10: fuitoVFPOpcode,
+	0x11: fsitoVFPOpcode,
+	0x18: ftouiVFPOpcode,
+	0x19: ftouizVFPOpcode,
+	0x1a: ftosiVFPOpcode,
+	0x1b: ftosizVFPOpcode,
+}
+
+func (o VFPOpcode) String() string {
+	if int(o) >= len(vfpOpcodeStrings) {
+		return fmt.Sprintf("<invalid VFP opcode %d>", uint8(o))
+	}
+	return vfpOpcodeStrings[o]
+}
+
+// Returns true if the operation has a single source operand.
+func (o VFPOpcode) isUnary() bool {
+	return o >= fcpyVFPOpcode
+}
+
+// Returns true if the operation is carried out on each element of a short
+// vector. Comparisons and conversions are always scalar.
+func (o VFPOpcode) isVectorizable() bool {
+	return o <= fsqrtVFPOpcode
+}
+
+// Returns true if the operation converts a floating-point value to an
+// integer, which is always held in a single precision register.
+func (o VFPOpcode) isToInteger() bool {
+	return o >= ftouiVFPOpcode
+}
+
+// Returns true if the operation converts an integer, held in a single
+// precision register, to a floating-point value.
+func (o VFPOpcode) isFromInteger() bool {
+	return (o == fuitoVFPOpcode) || (o == fsitoVFPOpcode)
+}
+
+// Returns the name of a single or double precision register.
+func vfpRegisterString(register uint8, double bool) string {
+	if double {
+		return fmt.Sprintf("d%d", register)
+	}
+	return fmt.Sprintf("s%d", register)
+}
+
+// Returns the name of a VFP system register, or an empty string if the
+// register doesn't exist.
+func vfpSystemRegisterString(register uint8) string {
+	switch register {
+	case 0:
+		return "fpsid"
+	case 1:
+		return "fpscr"
+	case 8:
+		return "fpexc"
+	}
+	return ""
+}
+
+// Returns a register number made up of a 4-bit field and an extra bit. For
+// single precision registers, the extra bit is the lowest bit. Double
+// precision registers don't use the extra bit in VFPv2, so an error is
+// returned if it's set.
+func vfpRegisterNumber(field uint8, extraBit bool, double bool) (uint8,
+	error) {
+	if !double {
+		toReturn := field << 1
+		if extraBit {
+			toReturn |= 1
+		}
+		return toReturn, nil
+	}
+	if extraBit {
+		return 0, fmt.Errorf("Invalid double precision register")
+	}
+	return field, nil
+}
+
+// Adds a VFP register, which is split into a 4-bit field and an extra bit
+// holding the lowest bit of single precision register numbers.
+func (c *instructionEncoder) vfpRegister(name string, register uint8,
+	double bool, position uint8, extraBit uint32) {
+	if double {
+		if register > 15 {
+			c.fail("%s must be from d0 to d15, got %d", name, register)
+		}
+		c.raw |= uint32(register&0xf) << position
+		return
+	}
+	if register > 31 {
+		c.fail("%s must be from s0 to s31, got %d", name, register)
+	}
+	c.raw |= uint32((register>>1)&0xf) << position
+	c.flag((register&1) != 0, extraBit)
+}
+
+type VFPDataOperationInstruction struct {
+	CoprocDataOperationInstruction
+	Opcode VFPOpcode
+	// This is set for instructions using coprocessor 11.
+	Double bool
+	Fd     uint8
+	Fn     uint8
+	Fm     uint8
+}
+
+// Returns true if the destination register is a double precision register.
+func (n *VFPDataOperationInstruction) DoubleDestination() bool {
+	if n.Opcode == fcvtVFPOpcode {
+		return !n.Double
+	}
+	return n.Double && !n.Opcode.isToInteger()
+}
+
+// Returns true if the source register (Fm) is a double precision register.
+func (n *VFPDataOperationInstruction) DoubleSource() bool {
+	return n.Double && !n.Opcode.isFromInteger()
+}
+
+func (n *VFPDataOperationInstruction) String() string {
+	start := n.Opcode.String()
+	if n.Opcode == fcvtVFPOpcode {
+		if n.Double {
+			start += "sd"
+		} else {
+			start += "ds"
+		}
+	} else if n.Double {
+		start += "d"
+	} else {
+		start += "s"
+	}
+	start += n.Condition().String()
+	fd := vfpRegisterString(n.Fd, n.DoubleDestination())
+	if (n.Opcode == fcmpzVFPOpcode) || (n.Opcode == fcmpezVFPOpcode) {
+		return fmt.Sprintf("%s %s", start, fd)
+	}
+	fm := vfpRegisterString(n.Fm, n.DoubleSource())
+	if n.Opcode.isUnary() {
+		return fmt.Sprintf("%s %s, %s", start, fd, fm)
+	}
+	return fmt.Sprintf("%s %s, %s, %s", start, fd,
+		vfpRegisterString(n.Fn, n.Double), fm)
+}
+
+func (n *VFPDataOperationInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0e000000 | vfpPrecisionBits(n.Double)}
+	c.condition(n.Condition())
+	c.vfpRegister("Fd", n.Fd, n.DoubleDestination(), 12, 0x400000)
+	c.vfpRegister("Fm", n.Fm, n.DoubleSource(), 0, 0x20)
+	if n.Opcode <= fdivVFPOpcode {
+		pqrs := uint32(n.Opcode)
+		c.raw |= ((pqrs & 8) << 20) | ((pqrs & 6) << 19) | ((pqrs & 1) << 6)
+		c.vfpRegister("Fn", n.Fn, n.Double, 16, 0x80)
+		return c.result()
+	}
+	for extension, opcode := range vfpExtensionOpcodes {
+		if opcode == n.Opcode {
+			c.raw |= 0xb00040 | (uint32(extension>>1) << 16) |
+				(uint32(extension&1) << 7)
+			return c.result()
+		}
+	}
+	c.fail("Invalid VFP opcode %d", n.Opcode)
+	return c.result()
+}
+
+type VFPDataTransferInstruction struct {
+	CoprocDataTransferInstruction
+	Double bool
+	// The first register transferred.
+	Fd uint8
+	// This is set for fldm and fstm, which transfer Count registers.
+	Multiple bool
+	Count    uint8
+}
+
+// Returns the mnemonic and register of fld or fst, ending with a comma.
+func (n *VFPDataTransferInstruction) prefix() string {
+	start := "fst"
+	if n.Load {
+		start = "fld"
+	}
+	if n.Double {
+		start += "d"
+	} else {
+		start += "s"
+	}
+	start += n.Condition().String()
+	return start + " " + vfpRegisterString(n.Fd, n.Double) + ","
+}
+
+func (n *VFPDataTransferInstruction) String() string {
+	if !n.Multiple {
+		start := n.prefix()
+		offset := int(n.Offset) << 2
+		if !n.Up {
+			offset = -offset
+		}
+		if n.Rn == 15 {
+			return n.pcRelativeString(fmt.Sprintf("%d", offset+8))
+		}
+		if offset == 0 {
+			return fmt.Sprintf("%s [%s]", start, n.Rn)
+		}
+		return fmt.Sprintf("%s [%s, %d]", start, n.Rn, offset)
+	}
+	start := "fstm"
+	if n.Load {
+		start = "fldm"
+	}
+	if n.Up {
+		start += "ia"
+	} else {
+		start += "db"
+	}
+	if !n.Double {
+		start += "s"
+	} else if (n.Offset & 1) != 0 {
+		start += "x"
+	} else {
+		start += "d"
+	}
+	start += n.Condition().String()
+	start += " " + n.Rn.String()
+	if n.WriteBack {
+		start += "!"
+	}
+	first := vfpRegisterString(n.Fd, n.Double)
+	if n.Count == 1 {
+		return fmt.Sprintf("%s, {%s}", start, first)
+	}
+	return fmt.Sprintf("%s, {%s-%s}", start, first,
+		vfpRegisterString(n.Fd+n.Count-1, n.Double))
+}
+
+func (n *VFPDataTransferInstruction) pcRelativeTarget(pc uint32) (uint32,
+	bool) {
+	if n.Multiple {
+		return 0, false
+	}
+	return n.CoprocDataTransferInstruction.pcRelativeTarget(pc)
+}
+
+func (n *VFPDataTransferInstruction) pcRelativeString(target string) string {
+	return n.prefix() + " " + target
+}
+
+// For double precision fldm and fstm, the lowest bit of Offset selects the
+// "x" form of the instruction.
+func (n *VFPDataTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0c000000 | vfpPrecisionBits(n.Double)}
+	c.condition(n.Condition())
+	c.flag(n.Up, 0x800000)
+	c.flag(n.Load, 0x100000)
+	c.register("Rn", n.Rn, 16)
+	c.vfpRegister("Fd", n.Fd, n.Double, 12, 0x400000)
+	if !n.Multiple {
+		c.raw |= 0x1000000 | uint32(n.Offset)
+		return c.result()
+	}
+	// fldm and fstm either increment after, or decrement before with
+	// writeback.
+	if !n.Up {
+		if !n.WriteBack {
+			c.fail("Decrementing fldm and fstm require writeback")
+		}
+		c.raw |= 0x1000000
+	}
+	c.flag(n.WriteBack, 0x200000)
+	limit := 32
+	count := uint32(n.Count)
+	if n.Double {
+		limit = 16
+		count = (count << 1) | uint32(n.Offset&1)
+	}
+	if (n.Count == 0) || ((int(n.Fd) + int(n.Count)) > limit) {
+		c.fail("Invalid VFP register list")
+	}
+	c.field("Count", count, 0, 8)
+	return c.result()
+}
+
+type VFPRegisterTransferInstruction struct {
+	CoprocRegisterTransferInstruction
+	// This is a single or double precision register, or a system register
+	// for fmxr and fmrx.
+	Fn uint8
+	// This is set for instructions transferring to or from a system
+	// register.
+	SystemRegister bool
+}
+
+func (n *VFPRegisterTransferInstruction) String() string {
+	cond := n.Condition().String()
+	if n.SystemRegister {
+		name := vfpSystemRegisterString(n.Fn)
+		if !n.Load {
+			return fmt.Sprintf("fmxr%s %s, %s", cond, name, n.Rd)
+		}
+		if (n.Rd == 15) && (n.Fn == 1) {
+			return "fmstat" + cond
+		}
+		return fmt.Sprintf("fmrx%s %s, %s", cond, n.Rd, name)
+	}
+	double := n.CoprocNumber == 11
+	var name string
+	if !double {
+		name = "s"
+	} else if n.CoprocOpcode == 0 {
+		name = "dl"
+	} else {
+		name = "dh"
+	}
+	fn := vfpRegisterString(n.Fn, double)
+	if n.Load {
+		return fmt.Sprintf("fmr%s%s %s, %s", name, cond, n.Rd, fn)
+	}
+	return fmt.Sprintf("fm%sr%s %s, %s", name, cond, fn, n.Rd)
+}
+
+// For double precision registers, CoprocNumber must be 11, and CoprocOpcode
+// selects the low (0) or high (1) half of the register.
+func (n *VFPRegisterTransferInstruction) Encode() (uint32, error) {
+	c := instructionEncoder{raw: 0x0e000a10}
+	c.condition(n.Condition())
+	c.flag(n.Load, 0x100000)
+	c.register("Rd", n.Rd, 12)
+	if n.SystemRegister {
+		if vfpSystemRegisterString(n.Fn) == "" {
+			c.fail("Invalid VFP system register %d", n.Fn)
+		}
+		c.raw |= 0xe00000 | (uint32(n.Fn&0xf) << 16)
+		return c.result()
+	}
+	if n.CoprocNumber == 11 {
+		c.raw |= 0x100
+		c.field("CoprocOpcode", uint32(n.CoprocOpcode), 21, 1)
+		c.vfpRegister("Fn", n.Fn, true, 16, 0)
+		return c.result()
+	}
+	c.vfpRegister("Fn", n.Fn, false, 16, 0x80)
+	return c.result()
+}
+
+func parseVFPDataOperationInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn VFPDataOperationInstruction
+	generic, _ := parseCoprocDataOperationInstruction(raw)
+	toReturn.CoprocDataOperationInstruction =
+		*(generic.(*CoprocDataOperationInstruction))
+	toReturn.Double = toReturn.CoprocNumber == 11
+	if (raw & 0x10) != 0 {
+		return nil, fmt.Errorf("Invalid VFP data processing instruction")
+	}
+	d := (raw & 0x400000) != 0
+	nBit := (raw & 0x80) != 0
+	m := (raw & 0x20) != 0
+	pqrs := uint8(((raw >> 20) & 0x8) | ((raw >> 19) & 0x4) |
+		((raw >> 19) & 0x2) | ((raw >> 6) & 0x1))
+	if pqrs <= uint8(fdivVFPOpcode) {
+		toReturn.Opcode = VFPOpcode(pqrs)
+	} else if pqrs == 0xf {
+		extension := (toReturn.CoprocRn << 1) | uint8((raw>>7)&1)
+		opcode, ok := vfpExtensionOpcodes[extension]
+		if !ok {
+			return nil, fmt.Errorf("Invalid VFP extension opcode 0x%02x",
+				extension)
+		}
+		toReturn.Opcode = opcode
+		nBit = false
+	} else {
+		return nil, fmt.Errorf("Invalid VFP data processing opcode")
+	}
+	var e error
+	toReturn.Fd, e = vfpRegisterNumber(toReturn.CoprocRd, d,
+		toReturn.DoubleDestination())
+	if e != nil {
+		return nil, e
+	}
+	toReturn.Fm, e = vfpRegisterNumber(toReturn.CoprocRm, m,
+		toReturn.DoubleSource())
+	if e != nil {
+		return nil, e
+	}
+	if !toReturn.Opcode.isUnary() {
+		toReturn.Fn, e = vfpRegisterNumber(toReturn.CoprocRn, nBit,
+			toReturn.Double)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return &toReturn, nil
+}
+
+func parseVFPDataTransferInstruction(raw uint32) (ARMInstruction, error) {
+	var toReturn VFPDataTransferInstruction
+	generic, _ := parseCoprocDataTransferInstruction(raw)
+	toReturn.CoprocDataTransferInstruction =
+		*(generic.(*CoprocDataTransferInstruction))
+	toReturn.Double = toReturn.CoprocNumber == 11
+	var e error
+	// The D bit is the same as the "long transfer" bit.
+	toReturn.Fd, e = vfpRegisterNumber(toReturn.CoprocRd,
+		toReturn.LongTransfer, toReturn.Double)
+	if e != nil {
+		return nil, e
+	}
+	if toReturn.Preindex && !toReturn.WriteBack {
+		return &toReturn, nil
+	}
+	// fldm and fstm either increment after, or decrement before with
+	// writeback.
+	if toReturn.Preindex == toReturn.Up {
+		return nil, fmt.Errorf("Invalid VFP data transfer addressing mode")
+	}
+	toReturn.Multiple = true
+	toReturn.Count = toReturn.Offset
+	if toReturn.Double {
+		toReturn.Count = toReturn.Offset >> 1
+	}
+	if (toReturn.Count == 0) ||
+		((int(toReturn.Fd) + int(toReturn.Count)) > 32) {
+		return nil, fmt.Errorf("Invalid VFP register list")
+	}
+	if toReturn.Double && ((toReturn.Fd + toReturn.Count) > 16) {
+		return nil, fmt.Errorf("Invalid VFP register list")
+	}
+	return &toReturn, nil
+}
+
+func parseVFPRegisterTransferInstruction(raw uint32) (ARMInstruction,
+	error) {
+	var toReturn VFPRegisterTransferInstruction
+	generic, _ := parseCoprocRegisterTransferInstruction(raw)
+	toReturn.CoprocRegisterTransferInstruction =
+		*(generic.(*CoprocRegisterTransferInstruction))
+	if (raw & 0x6f) != 0 {
+		return nil, fmt.Errorf("Invalid VFP register transfer")
+	}
+	nBit := (raw & 0x80) != 0
+	if toReturn.CoprocNumber == 10 {
+		switch toReturn.CoprocOpcode {
+		case 0:
+			toReturn.Fn, _ = vfpRegisterNumber(toReturn.CoprocRn, nBit, false)
+			return &toReturn, nil
+		case 7:
+			toReturn.SystemRegister = true
+			toReturn.Fn = toReturn.CoprocRn
+			if nBit || (vfpSystemRegisterString(toReturn.Fn) == "") {
+				return nil, fmt.Errorf("Invalid VFP system register")
+			}
+			return &toReturn, nil
+		}
+		return nil, fmt.Errorf("Invalid VFP register transfer")
+	}
+	if (toReturn.CoprocOpcode > 1) || nBit {
+		return nil, fmt.Errorf("Invalid VFP register transfer")
+	}
+	toReturn.Fn = toReturn.CoprocRn
+	return &toReturn, nil
+}
@@ -0,0 +1,62 @@
+package arm_emulate
+
+import (
+	"testing"
+)
+
+func TestVFPInstructionStrings(t *testing.T) {
+	expected := map[uint32]string{
+		0xee300a81: "fadds s0, s1, s2",
+		0x0e300a81: "faddseq s0, s1, s2",
+		0xee310b02: "faddd d0, d1, d2",
+		0xee300ac1: "fsubs s0, s1, s2",
+		0xee800a81: "fdivs s0, s1, s2",
+		0xee000a81: "fmacs s0, s1, s2",
+		0xee100ac1: "fnmscs s0, s1, s2",
+		0xee200ac1: "fnmuls s0, s1, s2",
+		0xeeb00a60: "fcpys s0, s1",
+		0xeeb00bc1: "fabsd d0, d1",
+		0xeeb10ae0: "fsqrts s0, s1",
+		0xeeb40ae0: "fcmpes s0, s1",
+		0xeeb50a40: "fcmpzs s0",
+		0xeeb70ae0: "fcvtds d0, s1",
+		0xeeb70bc1: "fcvtsd s0, d1",
+		0xeeb80bc1: "fsitod d0, s2",
+		0xeebd0ae0: "ftosizs s0, s1",
+		0xed910a01: "flds s0, [r1, 4]",
+		0xed810a00: "fsts s0, [r1]",
+		0xed110b02: "fldd d0, [r1, -8]",
+		0xed9f0a01: "flds s0, 12",
+		0xecb00a04: "fldmias r0!, {s0-s3}",
+		0xed200b04: "fstmdbd r0!, {d0-d1}",
+		0xec900b03: "fldmiax r0, {d0}",
+		0xee000a10: "fmsr s0, r0",
+		0xee100a90: "fmrs r0, s1",
+		0xee001b10: "fmdlr d0, r1",
+		0xee304b10: "fmrdh r4, d0",
+		0xeee80a10: "fmxr fpexc, r0",
+		0xeef00a10: "fmrx r0, fpsid",
+		0xeef1fa10: "fmstat",
+	}
+	for raw, s := range expected {
+		n, e := ParseInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.Fail()
+			continue
+		}
+		if n.String() != s {
+			t.Logf("Expected 0x%08x to be \"%s\", got \"%s\"\n", raw, s,
+				n.String())
+			t.Fail()
+		}
+	}
+	// Invalid extension opcodes, register lists and system registers.
+	for _, raw := range []uint32{0xeeb20a40, 0xecb00a00, 0xeef20a10} {
+		_, e := ParseInstruction(raw)
+		if e == nil {
+			t.Logf("Didn't get an error parsing 0x%08x\n", raw)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package arm_emulate
+
+// This file contains the host side of the Linux system call emulation, which
+// is shared by the 32-bit ARM and AArch64 processes: the file descriptor
+// table, opening sandboxed paths, and copying data between host streams and
+// guest memory. Descriptors, counts and results use 64 bits, which the 32-bit
+// process converts to and from its own word size.
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Converts a host error to the closest Linux error number.
+func linuxErrnoFromHost(e error) uint32 {
+	if os.IsNotExist(e) {
+		return linuxENOENT
+	}
+	if os.IsPermission(e) {
+		return linuxEACCES
+	}
+	if os.IsExist(e) {
+		return linuxEEXIST
+	}
+	return linuxEIO
+}
+
+// Converts the access mode and flags passed to open() or openat() to the
+// host's flags. Returns false if the access mode is invalid.
+func linuxOpenFlags(flags uint32) (int, bool) {
+	var hostFlags int
+	switch flags & linuxOpenAccessMask {
+	case 0:
+		hostFlags = os.O_RDONLY
+	case 1:
+		hostFlags = os.O_WRONLY
+	case 2:
+		hostFlags = os.O_RDWR
+	default:
+		return 0, false
+	}
+	if (flags & linuxOpenCreate) != 0 {
+		hostFlags |= os.O_CREATE
+	}
+	if (flags & linuxOpenExclusive) != 0 {
+		hostFlags |= os.O_EXCL
+	}
+	if (flags & linuxOpenTruncate) != 0 {
+		hostFlags |= os.O_TRUNC
+	}
+	if (flags & linuxOpenAppend) != 0 {
+		hostFlags |= os.O_APPEND
+	}
+	return hostFlags, true
+}
+
+// Maps an emulated process's file descriptors to host files. Descriptors 0, 1
+// and 2 refer to the process's standard streams until they're closed.
+type linuxFileTable struct {
+	files       map[uint64]*os.File
+	stdioClosed [3]bool
+}
+
+func newLinuxFileTable() linuxFileTable {
+	return linuxFileTable{files: make(map[uint64]*os.File)}
+}
+
+// Returns the host file opened using the given descriptor, or nil if it isn't
+// a host file.
+func (t *linuxFileTable) file(fd uint64) *os.File {
+	return t.files[fd]
+}
+
+// Returns true if the descriptor is one of the standard streams, and hasn't
+// been closed or replaced by a file.
+func (t *linuxFileTable) isStdio(fd uint64) bool {
+	return (fd < 3) && !t.stdioClosed[fd] && (t.files[fd] == nil)
+}
+
+// Returns the stream to read from for the given descriptor, or nil if the
+// descriptor isn't open for reading.
+func (t *linuxFileTable) reader(fd uint64, stdin io.Reader) io.Reader {
+	if (fd == 0) && t.isStdio(fd) {
+		return stdin
+	}
+	if f := t.files[fd]; f != nil {
+		return f
+	}
+	return nil
+}
+
+// Returns the stream to write to for the given descriptor, or nil if the
+// descriptor isn't open for writing.
+func (t *linuxFileTable) writer(fd uint64, stdout, stderr io.Writer) io.Writer {
+	if (fd == 1) && t.isStdio(fd) {
+		return stdout
+	}
+	if (fd == 2) && t.isStdio(fd) {
+		return stderr
+	}
+	if f := t.files[fd]; f != nil {
+		return f
+	}
+	return nil
+}
+
+// Opens the path, relative to the root directory if it isn't empty, using the
+// lowest available descriptor. Returns the descriptor, or a Linux error
+// number.
+func (t *linuxFileTable) open(root, path string, flags, mode uint32) (uint64,
+	uint32) {
+	hostFlags, ok := linuxOpenFlags(flags)
+	if !ok {
+		return 0, linuxEINVAL
+	}
+	f, e := os.OpenFile(sandboxedPath(root, path), hostFlags,
+		os.FileMode(mode&0777))
+	if e != nil {
+		return 0, linuxErrnoFromHost(e)
+	}
+	fd := uint64(0)
+	for {
+		if (fd < 3) && !t.stdioClosed[fd] {
+			fd++
+			continue
+		}
+		if t.files[fd] == nil {
+			break
+		}
+		fd++
+	}
+	if fd < 3 {
+		t.stdioClosed[fd] = false
+	}
+	t.files[fd] = f
+	return fd, 0
+}
+
+// Closes the descriptor, returning 0 or a Linux error number.
+func (t *linuxFileTable) close(fd uint64) uint32 {
+	if f := t.files[fd]; f != nil {
+		delete(t.files, fd)
+		if fd < 3 {
+			t.stdioClosed[fd] = true
+		}
+		e := f.Close()
+		if e != nil {
+			return linuxErrnoFromHost(e)
+		}
+		return 0
+	}
+	if (fd < 3) && !t.stdioClosed[fd] {
+		t.stdioClosed[fd] = true
+		return 0
+	}
+	return linuxEBADF
+}
+
+// Closes all of the host files.
+func (t *linuxFileTable) closeAll() {
+	for fd, f := range t.files {
+		f.Close()
+		delete(t.files, fd)
+	}
+}
+
+// Reads up to count bytes from the stream, passing them to store to copy them
+// into guest memory. Before reading, probe is called with the number of bytes
+// which may be stored, so that a bad buffer doesn't consume any input.
+// Returns the number of bytes read, or a Linux error number.
+func linuxRead(r io.Reader, count uint64, probe func(count uint64) error,
+	store func(data []byte) error) (uint64, uint32) {
+	if count > uint64(linuxMaxTransfer) {
+		count = uint64(linuxMaxTransfer)
+	}
+	e := probe(count)
+	if e != nil {
+		return 0, linuxEFAULT
+	}
+	buffer := make([]byte, count)
+	n, e := r.Read(buffer)
+	if (e != nil) && (e != io.EOF) && (n == 0) {
+		return 0, linuxErrnoFromHost(e)
+	}
+	e = store(buffer[:n])
+	if e != nil {
+		return 0, linuxEFAULT
+	}
+	return uint64(n), 0
+}
+
+// Writes up to count bytes, obtained from guest memory using load, to the
+// stream. Like a pipe, this may write fewer bytes than requested. Returns the
+// number of bytes written, or a Linux error number.
+func linuxWrite(w io.Writer, count uint64,
+	load func(count uint64) ([]byte, error)) (uint64, uint32) {
+	if count > uint64(linuxMaxTransfer) {
+		count = uint64(linuxMaxTransfer)
+	}
+	data, e := load(count)
+	if e != nil {
+		return 0, linuxEFAULT
+	}
+	n, e := w.Write(data)
+	if (e != nil) && (n == 0) {
+		return 0, linuxErrnoFromHost(e)
+	}
+	return uint64(n), 0
+}
+
+// Returns the struct utsname reported by uname(), which consists of six
+// 65-byte strings.
+func linuxUnameData(machine string) []byte {
+	fields := []string{"Linux", "arm_emulate", "5.10.0", "#1", machine,
+		"(none)"}
+	data := make([]byte, 65*len(fields))
+	for i, field := range fields {
+		copy(data[i*65:], field)
+	}
+	return data
+}
+
+// Runs instructions using step until the process exits, returning its exit
+// status. If any other error stops emulation, it's returned instead.
+func runLinuxProcess(step func() error) (int, error) {
+	for {
+		e := step()
+		if e == nil {
+			continue
+		}
+		var exitError *ProcessExitError
+		if errors.As(e, &exitError) {
+			return exitError.Status, nil
+		}
+		return -1, e
+	}
+}
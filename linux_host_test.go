@@ -0,0 +1,73 @@
+package arm_emulate
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinuxFileTable(t *testing.T) {
+	root := t.TempDir()
+	e := os.WriteFile(filepath.Join(root, "input.txt"), []byte("file"), 0644)
+	if e != nil {
+		t.FailNow()
+	}
+	table := newLinuxFileTable()
+	defer table.closeAll()
+	stdin := strings.NewReader("stdin")
+	var stdout, stderr bytes.Buffer
+	if (table.reader(0, stdin) != stdin) ||
+		(table.writer(2, &stdout, &stderr) != &stderr) ||
+		(table.writer(0, &stdout, &stderr) != nil) {
+		t.Logf("The standard streams weren't used for descriptors 0-2\n")
+		t.Fail()
+	}
+	// Closing stdin makes descriptor 0 the lowest available one, and reads
+	// must then use the file rather than the old stream.
+	if table.close(0) != 0 {
+		t.Logf("Failed closing stdin\n")
+		t.FailNow()
+	}
+	fd, errno := table.open(root, "/input.txt", 0, 0)
+	if (errno != 0) || (fd != 0) {
+		t.Logf("Opening a file returned fd %d, errno %d\n", fd, errno)
+		t.FailNow()
+	}
+	data := make([]byte, 8)
+	n, errno := linuxRead(table.reader(0, stdin), 8, func(uint64) error {
+		return nil
+	}, func(b []byte) error {
+		copy(data, b)
+		return nil
+	})
+	if (errno != 0) || (string(data[:n]) != "file") {
+		t.Logf("Read %q from the reopened descriptor (errno %d)\n",
+			data[:n], errno)
+		t.Fail()
+	}
+	fd, errno = table.open(root, "../missing.txt", 0, 0)
+	if errno != linuxENOENT {
+		t.Logf("Opening a missing file returned fd %d, errno %d\n", fd,
+			errno)
+		t.Fail()
+	}
+	if (table.close(0) != 0) || (table.close(0) != linuxEBADF) {
+		t.Logf("Closing descriptor 0 twice didn't fail the second time\n")
+		t.Fail()
+	}
+	// Writes are limited to a single transfer's worth of guest memory.
+	requested := uint64(0)
+	n, errno = linuxWrite(&stdout, 0xffffffff, func(count uint64) ([]byte,
+		error) {
+		requested = count
+		return make([]byte, count), nil
+	})
+	if (errno != 0) || (n != uint64(linuxMaxTransfer)) ||
+		(requested != uint64(linuxMaxTransfer)) {
+		t.Logf("A huge write requested %d bytes and wrote %d\n", requested,
+			n)
+		t.Fail()
+	}
+}
@@ -0,0 +1,581 @@
+package arm_emulate
+
+// This file implements enough of the ARM Linux system call interface to run
+// simple statically-linked programs in user mode.
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	linuxPageSize  uint32 = 4096
+	linuxStackTop  uint32 = 0xbf000000
+	linuxStackSize uint32 = 0x800000
+	// Anonymous memory mappings are placed starting at this address.
+	linuxMmapBase uint32 = 0x40000000
+	// The kernel maps helper functions into the last 4k of the vector page.
+	linuxKuserPage uint32 = 0xffff0000
+	// The address at which __kuser_get_tls finds the TLS value.
+	linuxKuserTLS uint32 = 0xffff0ff0
+	// Maximum length of a path passed to open().
+	linuxPathMax uint32 = 4096
+	// The most bytes transferred by a single read() or write(), so that the
+	// guest can't make the host allocate an arbitrarily large buffer.
+	linuxMaxTransfer uint32 = 0x100000
+)
+
+// System call numbers. These are the same for EABI (where the number is in r7)
+// and OABI (where the number is in the swi comment, plus 0x900000).
+const (
+	linuxSysExit         uint32 = 1
+	linuxSysRead         uint32 = 3
+	linuxSysWrite        uint32 = 4
+	linuxSysOpen         uint32 = 5
+	linuxSysClose        uint32 = 6
+	linuxSysBrk          uint32 = 45
+	linuxSysGettimeofday uint32 = 78
+	linuxSysMunmap       uint32 = 91
+	linuxSysUname        uint32 = 122
+	linuxSysMmap2        uint32 = 192
+	linuxSysExitGroup    uint32 = 248
+	// This is an ARM-private system call.
+	linuxSysSetTLS uint32 = 0xf0005
+)
+
+// Error numbers returned (negated) by system calls.
+const (
+	linuxENOENT uint32 = 2
+	linuxEIO    uint32 = 5
+	linuxEBADF  uint32 = 9
+	linuxENOMEM uint32 = 12
+	linuxEACCES uint32 = 13
+	linuxEFAULT uint32 = 14
+	linuxEEXIST uint32 = 17
+	linuxEINVAL uint32 = 22
+	linuxENOSYS uint32 = 38
+)
+
+// Flags for open(). Note that these are the ARM values, which differ from
+// x86 for some of the less common flags.
+const (
+	linuxOpenAccessMask uint32 = 3
+	linuxOpenCreate     uint32 = 0100
+	linuxOpenExclusive  uint32 = 0200
+	linuxOpenTruncate   uint32 = 01000
+	linuxOpenAppend     uint32 = 02000
+)
+
+// Flags for mmap2().
+const (
+	linuxMapFixed     uint32 = 0x10
+	linuxMapAnonymous uint32 = 0x20
+)
+
+// Auxiliary vector entry types.
+const (
+	linuxAuxNull   uint32 = 0
+	linuxAuxPHDR   uint32 = 3
+	linuxAuxPHEnt  uint32 = 4
+	linuxAuxPHNum  uint32 = 5
+	linuxAuxPageSz uint32 = 6
+	linuxAuxBase   uint32 = 7
+	linuxAuxFlags  uint32 = 8
+	linuxAuxEntry  uint32 = 9
+	linuxAuxUID    uint32 = 11
+	linuxAuxEUID   uint32 = 12
+	linuxAuxGID    uint32 = 13
+	linuxAuxEGID   uint32 = 14
+	linuxAuxHWCap  uint32 = 16
+	linuxAuxClkTck uint32 = 17
+	linuxAuxSecure uint32 = 23
+	linuxAuxRandom uint32 = 25
+)
+
+// HWCAP_SWP | HWCAP_HALF | HWCAP_THUMB | HWCAP_FAST_MULT | HWCAP_TLS
+const linuxHWCaps uint32 = 0x8017
+
+// The words making up the kernel's user helpers, keyed by address. These are
+// the same instructions the kernel uses on uniprocessor systems.
+var linuxKuserHelpers = []struct {
+	address uint32
+	words   []uint32
+}{
+	// __kuser_memory_barrier: bx lr
+	{0xffff0fa0, []uint32{0xe12fff1e}},
+	// __kuser_cmpxchg: ldr r3, [r2]; subs r3, r3, r0; streq r1, [r2];
+	// rsbs r0, r3, 0; bx lr
+	{0xffff0fc0, []uint32{0xe5923000, 0xe0533000, 0x05821000, 0xe2730000,
+		0xe12fff1e}},
+	// __kuser_get_tls: ldr r0, [pc, 8]; bx lr
+	{0xffff0fe0, []uint32{0xe59f0008, 0xe12fff1e}},
+	// __kuser_helper_version
+	{0xffff0ffc, []uint32{3}},
+}
+
+// This error is returned (possibly wrapped) by RunNextInstruction when the
+// program being emulated requests to exit.
+type ProcessExitError struct {
+	Status int
+}
+
+func (e *ProcessExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.Status)
+}
+
+// Holds the state of an emulated Linux process. This implements the
+// SoftwareInterruptHandler interface to carry out system calls. Unsupported
+// system calls return -ENOSYS.
+type LinuxProcess struct {
+	// The streams used by file descriptors 0, 1 and 2. These default to the
+	// host's standard streams, but may be changed before running.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// If this isn't empty, paths passed to open() are resolved relative to
+	// this host directory rather than the host's root directory.
+	RootDirectory string
+	processor     ARMProcessor
+	linuxFileTable
+	brkStart uint32
+	brk      uint32
+	mmapNext uint32
+}
+
+// Returns a negated error number, as a system call would.
+func linuxError(errno uint32) uint32 {
+	return -errno
+}
+
+// Converts a host error to the closest negated Linux error number.
+func linuxErrorFromHost(e error) uint32 {
+	return linuxError(linuxErrnoFromHost(e))
+}
+
+func roundUpToPage(value uint32) uint32 {
+	return (value + linuxPageSize - 1) &^ (linuxPageSize - 1)
+}
+
+func (l *LinuxProcess) sysRead(fd, address, count uint32) uint32 {
+	reader := l.reader(uint64(fd), l.Stdin)
+	if reader == nil {
+		return linuxError(linuxEBADF)
+	}
+	m := l.processor.GetMemoryInterface()
+	n, errno := linuxRead(reader, uint64(count), func(count uint64) error {
+		return probeMemoryBytes(m, address, uint32(count))
+	}, func(data []byte) error {
+		return writeMemoryBytes(m, address, data)
+	})
+	if errno != 0 {
+		return linuxError(errno)
+	}
+	return uint32(n)
+}
+
+func (l *LinuxProcess) sysWrite(fd, address, count uint32) uint32 {
+	writer := l.writer(uint64(fd), l.Stdout, l.Stderr)
+	if writer == nil {
+		return linuxError(linuxEBADF)
+	}
+	n, errno := linuxWrite(writer, uint64(count), func(n uint64) ([]byte,
+		error) {
+		return readMemoryBytes(l.processor.GetMemoryInterface(), address,
+			uint32(n))
+	})
+	if errno != 0 {
+		return linuxError(errno)
+	}
+	return uint32(n)
+}
+
+func (l *LinuxProcess) sysOpen(pathAddress, flags, mode uint32) uint32 {
+	path, e := readMemoryString(l.processor.GetMemoryInterface(), pathAddress,
+		linuxPathMax)
+	if e != nil {
+		return linuxError(linuxEFAULT)
+	}
+	fd, errno := l.open(l.RootDirectory, path, flags, mode)
+	if errno != 0 {
+		return linuxError(errno)
+	}
+	return uint32(fd)
+}
+
+func (l *LinuxProcess) sysClose(fd uint32) uint32 {
+	return linuxError(l.close(uint64(fd)))
+}
+
+func (l *LinuxProcess) sysBrk(address uint32) uint32 {
+	if address < l.brkStart {
+		return l.brk
+	}
+	if (address >= linuxMmapBase) || (address >= l.mmapNext) {
+		return l.brk
+	}
+	// Only map pages that aren't already part of the heap.
+	currentEnd := roundUpToPage(l.brk)
+	newEnd := roundUpToPage(address)
+	if newEnd > currentEnd {
+		e := l.processor.GetMemoryInterface().SetMemoryRegion(currentEnd,
+			make([]byte, newEnd-currentEnd))
+		if e != nil {
+			return l.brk
+		}
+	}
+	l.brk = address
+	return l.brk
+}
+
+func (l *LinuxProcess) sysMmap2(address, length, protection, flags, fd,
+	pageOffset uint32) uint32 {
+	length = roundUpToPage(length)
+	if length == 0 {
+		return linuxError(linuxEINVAL)
+	}
+	if (flags & linuxMapFixed) != 0 {
+		if (address % linuxPageSize) != 0 {
+			return linuxError(linuxEINVAL)
+		}
+	} else {
+		address = l.mmapNext
+		if (uint64(address) + uint64(length)) >
+			uint64(linuxStackTop-linuxStackSize) {
+			return linuxError(linuxENOMEM)
+		}
+		l.mmapNext += length
+	}
+	data := make([]byte, length)
+	if (flags & linuxMapAnonymous) == 0 {
+		f := l.file(uint64(fd))
+		if f == nil {
+			return linuxError(linuxEBADF)
+		}
+		_, e := f.ReadAt(data, int64(pageOffset)*int64(linuxPageSize))
+		if (e != nil) && (e != io.EOF) {
+			return linuxErrorFromHost(e)
+		}
+	}
+	e := l.processor.GetMemoryInterface().SetMemoryRegion(address, data)
+	if e != nil {
+		return linuxError(linuxENOMEM)
+	}
+	return address
+}
+
+func (l *LinuxProcess) sysMunmap(address, length uint32) uint32 {
+	if (address % linuxPageSize) != 0 {
+		return linuxError(linuxEINVAL)
+	}
+	e := l.processor.GetMemoryInterface().ClearMemoryRegion(address,
+		roundUpToPage(length))
+	if e != nil {
+		return linuxError(linuxEINVAL)
+	}
+	return 0
+}
+
+func (l *LinuxProcess) sysUname(address uint32) uint32 {
+	e := writeMemoryBytes(l.processor.GetMemoryInterface(), address,
+		linuxUnameData("armv5tel"))
+	if e != nil {
+		return linuxError(linuxEFAULT)
+	}
+	return 0
+}
+
+func (l *LinuxProcess) sysGettimeofday(timeAddress, zoneAddress uint32) uint32 {
+	m := l.processor.GetMemoryInterface()
+	if timeAddress != 0 {
+		now := time.Now()
+		e := m.WriteMemoryWord(timeAddress, uint32(now.Unix()))
+		if e != nil {
+			return linuxError(linuxEFAULT)
+		}
+		e = m.WriteMemoryWord(timeAddress+4, uint32(now.Nanosecond()/1000))
+		if e != nil {
+			return linuxError(linuxEFAULT)
+		}
+	}
+	if zoneAddress != 0 {
+		e := writeMemoryBytes(m, zoneAddress, make([]byte, 8))
+		if e != nil {
+			return linuxError(linuxEFAULT)
+		}
+	}
+	return 0
+}
+
+func (l *LinuxProcess) sysSetTLS(value uint32) uint32 {
+	e := l.processor.GetMemoryInterface().WriteMemoryWord(linuxKuserTLS, value)
+	if e != nil {
+		return linuxError(linuxEFAULT)
+	}
+	return 0
+}
+
+// Carries out a single system call, returning the value to place in r0. An
+// error is only returned if emulation should stop.
+func (l *LinuxProcess) syscall(number uint32, args [6]uint32) (uint32,
+	error) {
+	switch number {
+	case linuxSysExit, linuxSysExitGroup:
+		var toReturn ProcessExitError
+		toReturn.Status = int(args[0] & 0xff)
+		return 0, &toReturn
+	case linuxSysRead:
+		return l.sysRead(args[0], args[1], args[2]), nil
+	case linuxSysWrite:
+		return l.sysWrite(args[0], args[1], args[2]), nil
+	case linuxSysOpen:
+		return l.sysOpen(args[0], args[1], args[2]), nil
+	case linuxSysClose:
+		return l.sysClose(args[0]), nil
+	case linuxSysBrk:
+		return l.sysBrk(args[0]), nil
+	case linuxSysGettimeofday:
+		return l.sysGettimeofday(args[0], args[1]), nil
+	case linuxSysMunmap:
+		return l.sysMunmap(args[0], args[1]), nil
+	case linuxSysUname:
+		return l.sysUname(args[0]), nil
+	case linuxSysMmap2:
+		return l.sysMmap2(args[0], args[1], args[2], args[3], args[4],
+			args[5]), nil
+	case linuxSysSetTLS:
+		return l.sysSetTLS(args[0]), nil
+	}
+	return linuxError(linuxENOSYS), nil
+}
+
+// Handles EABI system calls (swi 0, with the number in r7) and OABI system
+// calls (with the number in the comment field). Other software interrupts are
+// left to other handlers.
+func (l *LinuxProcess) HandleSoftwareInterrupt(p ARMProcessor,
+	comment uint32) (bool, error) {
+	var number uint32
+	if comment == 0 {
+		number, _ = p.GetRegister(7)
+	} else if !p.THUMBMode() && (comment >= 0x900000) &&
+		(comment < 0xa00000) {
+		number = comment - 0x900000
+	} else {
+		return false, nil
+	}
+	var args [6]uint32
+	for i := range args {
+		args[i], _ = p.GetRegister(ARMRegister(i))
+	}
+	result, e := l.syscall(number, args)
+	if e != nil {
+		return true, e
+	}
+	return true, p.SetRegister(0, result)
+}
+
+// Returns the address at which the program headers are mapped, so that it can
+// be passed to the program in the auxiliary vector.
+func findProgramHeaders(f *elf.File, offset uint64) uint64 {
+	for _, segment := range f.Progs {
+		if segment.Type == elf.PT_PHDR {
+			return segment.Vaddr
+		}
+	}
+	for _, segment := range f.Progs {
+		if segment.Type != elf.PT_LOAD {
+			continue
+		}
+		if (offset >= segment.Off) &&
+			(offset < (segment.Off + segment.Filesz)) {
+			return segment.Vaddr + (offset - segment.Off)
+		}
+	}
+	return 0
+}
+
+// Maps the stack and copies the arguments, environment and auxiliary vector to
+// it, in the layout expected by the C runtime. Sets the stack pointer.
+func (l *LinuxProcess) setupStack(argv, envp []string,
+	auxv []uint32) error {
+	m := l.processor.GetMemoryInterface()
+	stackBase := linuxStackTop - linuxStackSize
+	e := m.SetMemoryRegion(stackBase, make([]byte, linuxStackSize))
+	if e != nil {
+		return fmt.Errorf("Failed mapping the stack: %s", e)
+	}
+	sp := linuxStackTop
+	// Copies data to the top of the stack, returning its address.
+	push := func(data []byte) (uint32, error) {
+		sp -= uint32(len(data))
+		return sp, writeMemoryBytes(m, sp, data)
+	}
+	// These bytes are pointed to by AT_RANDOM. They're fixed, so that runs
+	// are repeatable.
+	randomAddress, e := push([]byte{0x8c, 0x2a, 0x51, 0x07, 0xe3, 0x96, 0x4d,
+		0x1b, 0x70, 0xf5, 0x38, 0xc4, 0x19, 0x62, 0xab, 0xde})
+	if e != nil {
+		return e
+	}
+	auxv = append(auxv, linuxAuxRandom, randomAddress, linuxAuxNull, 0)
+	pushStrings := func(strings []string) ([]uint32, error) {
+		addresses := make([]uint32, len(strings))
+		for i, s := range strings {
+			address, e := push(append([]byte(s), 0))
+			if e != nil {
+				return nil, e
+			}
+			addresses[i] = address
+		}
+		return addresses, nil
+	}
+	envpAddresses, e := pushStrings(envp)
+	if e != nil {
+		return e
+	}
+	argvAddresses, e := pushStrings(argv)
+	if e != nil {
+		return e
+	}
+	// argc, argv, NULL, envp, NULL, auxv
+	words := make([]uint32, 0, len(argv)+len(envp)+len(auxv)+3)
+	words = append(words, uint32(len(argv)))
+	words = append(words, argvAddresses...)
+	words = append(words, 0)
+	words = append(words, envpAddresses...)
+	words = append(words, 0)
+	words = append(words, auxv...)
+	sp -= uint32(len(words)) * 4
+	sp &= 0xfffffff0
+	for i, word := range words {
+		e = m.WriteMemoryWord(sp+uint32(i)*4, word)
+		if e != nil {
+			return fmt.Errorf("Failed writing to the stack: %s", e)
+		}
+	}
+	return l.processor.SetRegister(13, sp)
+}
+
+// Maps the kernel's user helper functions, which are used by some C libraries
+// on older ARM versions for atomic operations and thread-local storage.
+func (l *LinuxProcess) setupKuserHelpers() error {
+	m := l.processor.GetMemoryInterface()
+	e := m.SetMemoryRegion(linuxKuserPage, make([]byte, linuxPageSize))
+	if e != nil {
+		return fmt.Errorf("Failed mapping kernel helper page: %s", e)
+	}
+	for _, helper := range linuxKuserHelpers {
+		for i, word := range helper.words {
+			e = m.WriteMemoryWord(helper.address+uint32(i)*4, word)
+			if e != nil {
+				return fmt.Errorf("Failed writing kernel helpers: %s", e)
+			}
+		}
+	}
+	return nil
+}
+
+// Loads the given statically-linked ELF executable into the processor, sets up
+// the initial stack containing argv, envp and the auxiliary vector, and
+// registers the returned process as a software interrupt handler on the
+// processor. The processor is put into user mode.
+func NewLinuxProcess(p ARMProcessor, r io.ReaderAt, argv,
+	envp []string) (*LinuxProcess, error) {
+	var toReturn LinuxProcess
+	toReturn.processor = p
+	toReturn.Stdin = os.Stdin
+	toReturn.Stdout = os.Stdout
+	toReturn.Stderr = os.Stderr
+	toReturn.linuxFileTable = newLinuxFileTable()
+	toReturn.mmapNext = linuxMmapBase
+	_, e := LoadELF(p, r)
+	if e != nil {
+		return nil, e
+	}
+	f, e := elf.NewFile(r)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing ELF: %s", e)
+	}
+	defer f.Close()
+	// The initial program break follows the highest loaded segment.
+	for _, segment := range f.Progs {
+		if segment.Type != elf.PT_LOAD {
+			continue
+		}
+		end := uint32(segment.Vaddr + segment.Memsz)
+		if end > toReturn.brkStart {
+			toReturn.brkStart = end
+		}
+	}
+	toReturn.brkStart = roundUpToPage(toReturn.brkStart)
+	toReturn.brk = toReturn.brkStart
+	// e_phoff is at offset 28 and e_phentsize is at offset 42 in the header.
+	headerOffset, e := readELFHeaderWord(f, r, 28)
+	if e != nil {
+		return nil, e
+	}
+	entry := uint32(f.Entry)
+	auxv := []uint32{
+		linuxAuxPHDR, uint32(findProgramHeaders(f, uint64(headerOffset))),
+		linuxAuxPHEnt, 32,
+		linuxAuxPHNum, uint32(len(f.Progs)),
+		linuxAuxPageSz, linuxPageSize,
+		linuxAuxBase, 0,
+		linuxAuxFlags, 0,
+		linuxAuxEntry, entry,
+		linuxAuxUID, 0,
+		linuxAuxEUID, 0,
+		linuxAuxGID, 0,
+		linuxAuxEGID, 0,
+		linuxAuxHWCap, linuxHWCaps,
+		linuxAuxClkTck, 100,
+		linuxAuxSecure, 0,
+	}
+	e = p.SetMode(userMode)
+	if e != nil {
+		return nil, e
+	}
+	e = toReturn.setupStack(argv, envp, auxv)
+	if e != nil {
+		return nil, e
+	}
+	e = toReturn.setupKuserHelpers()
+	if e != nil {
+		return nil, e
+	}
+	// The ELF ABI says r0 may contain a function to register with atexit.
+	e = p.SetRegister(0, 0)
+	if e != nil {
+		return nil, e
+	}
+	e = p.AddSoftwareInterruptHandler(&toReturn)
+	if e != nil {
+		return nil, fmt.Errorf("Failed adding system call handler: %s", e)
+	}
+	return &toReturn, nil
+}
+
+// Like NewLinuxProcess, but loads the executable from the given path.
+func NewLinuxProcessFromFile(p ARMProcessor, path string, argv,
+	envp []string) (*LinuxProcess, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return NewLinuxProcess(p, f, argv, envp)
+}
+
+// Runs the process until it exits, returning its exit status. If any other
+// error stops emulation, it's returned instead.
+func (l *LinuxProcess) Run() (int, error) {
+	return runLinuxProcess(l.processor.RunNextInstruction)
+}
+
+// Closes any host files left open by the process.
+func (l *LinuxProcess) Close() error {
+	l.closeAll()
+	return nil
+}
@@ -0,0 +1,554 @@
+package arm_emulate
+
+// This file implements enough of the AArch64 Linux system call interface to
+// run simple statically-linked arm64 programs in user mode.
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	linuxA64StackTop  uint64 = 0x7ffffffff000
+	linuxA64StackSize uint64 = 0x800000
+	// Anonymous memory mappings are placed starting at this address.
+	linuxA64MmapBase uint64 = 0x7f0000000000
+)
+
+// System call numbers. AArch64 uses the generic system call table, so these
+// differ from the 32-bit ARM numbers.
+const (
+	linuxA64SysIoctl         uint64 = 29
+	linuxA64SysOpenat        uint64 = 56
+	linuxA64SysClose         uint64 = 57
+	linuxA64SysLseek         uint64 = 62
+	linuxA64SysRead          uint64 = 63
+	linuxA64SysWrite         uint64 = 64
+	linuxA64SysWritev        uint64 = 66
+	linuxA64SysExit          uint64 = 93
+	linuxA64SysExitGroup     uint64 = 94
+	linuxA64SysSetTidAddress uint64 = 96
+	linuxA64SysClockGettime  uint64 = 113
+	linuxA64SysRtSigaction   uint64 = 134
+	linuxA64SysRtSigprocmask uint64 = 135
+	linuxA64SysUname         uint64 = 160
+	linuxA64SysGettimeofday  uint64 = 169
+	linuxA64SysGetpid        uint64 = 172
+	linuxA64SysGetuid        uint64 = 174
+	linuxA64SysGeteuid       uint64 = 175
+	linuxA64SysGetgid        uint64 = 176
+	linuxA64SysGetegid       uint64 = 177
+	linuxA64SysGettid        uint64 = 178
+	linuxA64SysBrk           uint64 = 214
+	linuxA64SysMunmap        uint64 = 215
+	linuxA64SysMmap          uint64 = 222
+	linuxA64SysMprotect      uint64 = 226
+)
+
+// Additional error numbers used by the AArch64 system calls.
+const (
+	linuxENOTTY uint32 = 25
+	linuxESPIPE uint32 = 29
+)
+
+const (
+	// The process and thread ID reported to the program.
+	linuxA64ProcessID uint64 = 1
+	// The maximum number of buffers passed to writev().
+	linuxA64MaxIOVectors uint64 = 1024
+	// Passed to openat() in place of a directory's file descriptor to open
+	// paths relative to the current directory.
+	linuxA64DirectoryFDCWD int64 = -100
+	// SEEK_SET, SEEK_CUR and SEEK_END are the only lseek() modes supported.
+	linuxA64SeekEnd uint64 = 2
+)
+
+// HWCAP_FP | HWCAP_CRC32
+const linuxA64HWCaps uint64 = 0x81
+
+// Holds the state of an emulated AArch64 Linux process. This implements the
+// A64SupervisorCallHandler interface to carry out system calls. Unsupported
+// system calls return -ENOSYS.
+type LinuxA64Process struct {
+	// The streams used by file descriptors 0, 1 and 2. These default to the
+	// host's standard streams, but may be changed before running.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// If this isn't empty, paths passed to openat() are resolved relative to
+	// this host directory rather than the host's root directory.
+	RootDirectory string
+	processor     A64Processor
+	linuxFileTable
+	brkStart uint64
+	brk      uint64
+	mmapNext uint64
+}
+
+// Returns a negated error number, sign-extended to 64 bits.
+func linuxA64Error(errno uint32) uint64 {
+	return uint64(-int64(errno))
+}
+
+// Converts a host error to a negated Linux error number.
+func linuxA64ErrorFromHost(e error) uint64 {
+	return linuxA64Error(linuxErrnoFromHost(e))
+}
+
+func roundUpToA64Page(value uint64) uint64 {
+	pageSize := uint64(linuxPageSize)
+	return (value + pageSize - 1) &^ (pageSize - 1)
+}
+
+func (l *LinuxA64Process) sysRead(fd, address, count uint64) uint64 {
+	reader := l.reader(fd, l.Stdin)
+	if reader == nil {
+		return linuxA64Error(linuxEBADF)
+	}
+	m := l.processor.GetMemoryInterface()
+	n, errno := linuxRead(reader, count, func(count uint64) error {
+		return probeA64MemoryBytes(m, address, count)
+	}, func(data []byte) error {
+		return writeA64MemoryBytes(m, address, data)
+	})
+	if errno != 0 {
+		return linuxA64Error(errno)
+	}
+	return n
+}
+
+func (l *LinuxA64Process) sysWrite(fd, address, count uint64) uint64 {
+	writer := l.writer(fd, l.Stdout, l.Stderr)
+	if writer == nil {
+		return linuxA64Error(linuxEBADF)
+	}
+	n, errno := linuxWrite(writer, count, func(n uint64) ([]byte, error) {
+		return readA64MemoryBytes(l.processor.GetMemoryInterface(), address,
+			n)
+	})
+	if errno != 0 {
+		return linuxA64Error(errno)
+	}
+	return n
+}
+
+func (l *LinuxA64Process) sysWritev(fd, address, count uint64) uint64 {
+	if count > linuxA64MaxIOVectors {
+		return linuxA64Error(linuxEINVAL)
+	}
+	m := l.processor.GetMemoryInterface()
+	total := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		// Each struct iovec holds a base address and a length.
+		base, e := m.ReadMemoryDoubleword(address + i*16)
+		if e != nil {
+			return linuxA64Error(linuxEFAULT)
+		}
+		length, e := m.ReadMemoryDoubleword(address + i*16 + 8)
+		if e != nil {
+			return linuxA64Error(linuxEFAULT)
+		}
+		if length == 0 {
+			continue
+		}
+		result := l.sysWrite(fd, base, length)
+		if int64(result) < 0 {
+			if total != 0 {
+				return total
+			}
+			return result
+		}
+		total += result
+		if result < length {
+			break
+		}
+	}
+	return total
+}
+
+func (l *LinuxA64Process) sysOpenat(directory, pathAddress, flags,
+	mode uint64) uint64 {
+	path, e := readA64MemoryString(l.processor.GetMemoryInterface(),
+		pathAddress, uint64(linuxPathMax))
+	if e != nil {
+		return linuxA64Error(linuxEFAULT)
+	}
+	// Paths relative to an open directory aren't supported.
+	if (int64(directory) != linuxA64DirectoryFDCWD) &&
+		((len(path) == 0) || (path[0] != '/')) {
+		return linuxA64Error(linuxEBADF)
+	}
+	fd, errno := l.open(l.RootDirectory, path, uint32(flags), uint32(mode))
+	if errno != 0 {
+		return linuxA64Error(errno)
+	}
+	return fd
+}
+
+func (l *LinuxA64Process) sysClose(fd uint64) uint64 {
+	return linuxA64Error(l.close(fd))
+}
+
+func (l *LinuxA64Process) sysLseek(fd, offset, whence uint64) uint64 {
+	f := l.file(fd)
+	if f == nil {
+		if l.isStdio(fd) {
+			// The standard streams aren't seekable.
+			return linuxA64Error(linuxESPIPE)
+		}
+		return linuxA64Error(linuxEBADF)
+	}
+	if whence > linuxA64SeekEnd {
+		return linuxA64Error(linuxEINVAL)
+	}
+	position, e := f.Seek(int64(offset), int(whence))
+	if e != nil {
+		return linuxA64Error(linuxEINVAL)
+	}
+	return uint64(position)
+}
+
+func (l *LinuxA64Process) sysBrk(address uint64) uint64 {
+	if (address < l.brkStart) || (address >= l.mmapNext) {
+		return l.brk
+	}
+	// Only map pages that aren't already part of the heap.
+	currentEnd := roundUpToA64Page(l.brk)
+	newEnd := roundUpToA64Page(address)
+	if newEnd > currentEnd {
+		e := l.processor.GetMemoryInterface().SetMemoryRegion(currentEnd,
+			make([]byte, newEnd-currentEnd))
+		if e != nil {
+			return l.brk
+		}
+	}
+	l.brk = address
+	return l.brk
+}
+
+func (l *LinuxA64Process) sysMmap(address, length, protection, flags, fd,
+	offset uint64) uint64 {
+	pageSize := uint64(linuxPageSize)
+	length = roundUpToA64Page(length)
+	if (length == 0) || ((offset % pageSize) != 0) {
+		return linuxA64Error(linuxEINVAL)
+	}
+	if (uint32(flags) & linuxMapFixed) != 0 {
+		if (address % pageSize) != 0 {
+			return linuxA64Error(linuxEINVAL)
+		}
+	} else {
+		address = l.mmapNext
+		if (address + length) > (linuxA64StackTop - linuxA64StackSize) {
+			return linuxA64Error(linuxENOMEM)
+		}
+		l.mmapNext += length
+	}
+	data := make([]byte, length)
+	if (uint32(flags) & linuxMapAnonymous) == 0 {
+		f := l.file(fd)
+		if f == nil {
+			return linuxA64Error(linuxEBADF)
+		}
+		_, e := f.ReadAt(data, int64(offset))
+		if (e != nil) && (e != io.EOF) {
+			return linuxA64ErrorFromHost(e)
+		}
+	}
+	e := l.processor.GetMemoryInterface().SetMemoryRegion(address, data)
+	if e != nil {
+		return linuxA64Error(linuxENOMEM)
+	}
+	return address
+}
+
+func (l *LinuxA64Process) sysMunmap(address, length uint64) uint64 {
+	if (address % uint64(linuxPageSize)) != 0 {
+		return linuxA64Error(linuxEINVAL)
+	}
+	e := l.processor.GetMemoryInterface().ClearMemoryRegion(address,
+		roundUpToA64Page(length))
+	if e != nil {
+		return linuxA64Error(linuxEINVAL)
+	}
+	return 0
+}
+
+func (l *LinuxA64Process) sysUname(address uint64) uint64 {
+	e := writeA64MemoryBytes(l.processor.GetMemoryInterface(), address,
+		linuxUnameData("aarch64"))
+	if e != nil {
+		return linuxA64Error(linuxEFAULT)
+	}
+	return 0
+}
+
+// Writes a struct timeval or struct timespec, which both consist of a 64-bit
+// number of seconds followed by a 64-bit fraction of a second.
+func (l *LinuxA64Process) writeTime(address, seconds,
+	fraction uint64) uint64 {
+	m := l.processor.GetMemoryInterface()
+	e := m.WriteMemoryDoubleword(address, seconds)
+	if e != nil {
+		return linuxA64Error(linuxEFAULT)
+	}
+	e = m.WriteMemoryDoubleword(address+8, fraction)
+	if e != nil {
+		return linuxA64Error(linuxEFAULT)
+	}
+	return 0
+}
+
+func (l *LinuxA64Process) sysGettimeofday(timeAddress,
+	zoneAddress uint64) uint64 {
+	if timeAddress != 0 {
+		now := time.Now()
+		result := l.writeTime(timeAddress, uint64(now.Unix()),
+			uint64(now.Nanosecond()/1000))
+		if result != 0 {
+			return result
+		}
+	}
+	if zoneAddress != 0 {
+		e := writeA64MemoryBytes(l.processor.GetMemoryInterface(),
+			zoneAddress, make([]byte, 8))
+		if e != nil {
+			return linuxA64Error(linuxEFAULT)
+		}
+	}
+	return 0
+}
+
+func (l *LinuxA64Process) sysClockGettime(clock, address uint64) uint64 {
+	// Every clock is treated as the realtime clock.
+	now := time.Now()
+	return l.writeTime(address, uint64(now.Unix()),
+		uint64(now.Nanosecond()))
+}
+
+// Carries out a single system call, returning the value to place in x0. An
+// error is only returned if emulation should stop.
+func (l *LinuxA64Process) syscall(number uint64, args [6]uint64) (uint64,
+	error) {
+	switch number {
+	case linuxA64SysExit, linuxA64SysExitGroup:
+		var toReturn ProcessExitError
+		toReturn.Status = int(args[0] & 0xff)
+		return 0, &toReturn
+	case linuxA64SysRead:
+		return l.sysRead(args[0], args[1], args[2]), nil
+	case linuxA64SysWrite:
+		return l.sysWrite(args[0], args[1], args[2]), nil
+	case linuxA64SysWritev:
+		return l.sysWritev(args[0], args[1], args[2]), nil
+	case linuxA64SysOpenat:
+		return l.sysOpenat(args[0], args[1], args[2], args[3]), nil
+	case linuxA64SysClose:
+		return l.sysClose(args[0]), nil
+	case linuxA64SysLseek:
+		return l.sysLseek(args[0], args[1], args[2]), nil
+	case linuxA64SysIoctl:
+		// None of the files are terminals.
+		return linuxA64Error(linuxENOTTY), nil
+	case linuxA64SysBrk:
+		return l.sysBrk(args[0]), nil
+	case linuxA64SysMmap:
+		return l.sysMmap(args[0], args[1], args[2], args[3], args[4],
+			args[5]), nil
+	case linuxA64SysMunmap:
+		return l.sysMunmap(args[0], args[1]), nil
+	case linuxA64SysUname:
+		return l.sysUname(args[0]), nil
+	case linuxA64SysGettimeofday:
+		return l.sysGettimeofday(args[0], args[1]), nil
+	case linuxA64SysClockGettime:
+		return l.sysClockGettime(args[0], args[1]), nil
+	case linuxA64SysSetTidAddress, linuxA64SysGetpid, linuxA64SysGettid:
+		return linuxA64ProcessID, nil
+	case linuxA64SysGetuid, linuxA64SysGeteuid, linuxA64SysGetgid,
+		linuxA64SysGetegid:
+		return 0, nil
+	case linuxA64SysMprotect, linuxA64SysRtSigaction,
+		linuxA64SysRtSigprocmask:
+		// Memory protection and signals aren't emulated.
+		return 0, nil
+	}
+	return linuxA64Error(linuxENOSYS), nil
+}
+
+// Handles system calls made using svc #0, with the system call number in x8.
+// Other supervisor calls are left to other handlers.
+func (l *LinuxA64Process) HandleSupervisorCall(p A64Processor,
+	immediate uint16) (bool, error) {
+	if immediate != 0 {
+		return false, nil
+	}
+	var args [6]uint64
+	for i := range args {
+		args[i] = p.GetRegister(A64Register(i))
+	}
+	result, e := l.syscall(p.GetRegister(8), args)
+	if e != nil {
+		return true, e
+	}
+	p.SetRegister(0, result)
+	return true, nil
+}
+
+// Maps the stack and copies the arguments, environment and auxiliary vector to
+// it, in the layout expected by the C runtime. Sets the stack pointer.
+func (l *LinuxA64Process) setupStack(argv, envp []string,
+	auxv []uint64) error {
+	m := l.processor.GetMemoryInterface()
+	stackBase := linuxA64StackTop - linuxA64StackSize
+	e := m.SetMemoryRegion(stackBase, make([]byte, linuxA64StackSize))
+	if e != nil {
+		return fmt.Errorf("Failed mapping the stack: %s", e)
+	}
+	sp := linuxA64StackTop
+	// Copies data to the top of the stack, returning its address.
+	push := func(data []byte) (uint64, error) {
+		sp -= uint64(len(data))
+		return sp, writeA64MemoryBytes(m, sp, data)
+	}
+	// These bytes are pointed to by AT_RANDOM. They're fixed, so that runs
+	// are repeatable.
+	randomAddress, e := push([]byte{0x8c, 0x2a, 0x51, 0x07, 0xe3, 0x96, 0x4d,
+		0x1b, 0x70, 0xf5, 0x38, 0xc4, 0x19, 0x62, 0xab, 0xde})
+	if e != nil {
+		return e
+	}
+	auxv = append(auxv, uint64(linuxAuxRandom), randomAddress,
+		uint64(linuxAuxNull), 0)
+	pushStrings := func(strings []string) ([]uint64, error) {
+		addresses := make([]uint64, len(strings))
+		for i, s := range strings {
+			address, e := push(append([]byte(s), 0))
+			if e != nil {
+				return nil, e
+			}
+			addresses[i] = address
+		}
+		return addresses, nil
+	}
+	envpAddresses, e := pushStrings(envp)
+	if e != nil {
+		return e
+	}
+	argvAddresses, e := pushStrings(argv)
+	if e != nil {
+		return e
+	}
+	// argc, argv, NULL, envp, NULL, auxv
+	words := make([]uint64, 0, len(argv)+len(envp)+len(auxv)+3)
+	words = append(words, uint64(len(argv)))
+	words = append(words, argvAddresses...)
+	words = append(words, 0)
+	words = append(words, envpAddresses...)
+	words = append(words, 0)
+	words = append(words, auxv...)
+	sp -= uint64(len(words)) * 8
+	sp &^= 0xf
+	for i, word := range words {
+		e = m.WriteMemoryDoubleword(sp+uint64(i)*8, word)
+		if e != nil {
+			return fmt.Errorf("Failed writing to the stack: %s", e)
+		}
+	}
+	l.processor.SetSP(sp)
+	return nil
+}
+
+// Loads the given statically-linked ELF64 executable into the processor, sets
+// up the initial stack containing argv, envp and the auxiliary vector, and
+// registers the returned process as a supervisor call handler on the
+// processor.
+func NewLinuxA64Process(p A64Processor, r io.ReaderAt, argv,
+	envp []string) (*LinuxA64Process, error) {
+	var toReturn LinuxA64Process
+	toReturn.processor = p
+	toReturn.Stdin = os.Stdin
+	toReturn.Stdout = os.Stdout
+	toReturn.Stderr = os.Stderr
+	toReturn.linuxFileTable = newLinuxFileTable()
+	toReturn.mmapNext = linuxA64MmapBase
+	e := LoadA64ELF(p, r)
+	if e != nil {
+		return nil, e
+	}
+	f, e := elf.NewFile(r)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing ELF: %s", e)
+	}
+	defer f.Close()
+	// The initial program break follows the highest loaded segment.
+	for _, segment := range f.Progs {
+		if segment.Type != elf.PT_LOAD {
+			continue
+		}
+		end := segment.Vaddr + segment.Memsz
+		if end > toReturn.brkStart {
+			toReturn.brkStart = end
+		}
+	}
+	toReturn.brkStart = roundUpToA64Page(toReturn.brkStart)
+	toReturn.brk = toReturn.brkStart
+	// e_phoff is at offset 32 in the ELF64 header.
+	headerOffset, e := readELFHeaderDoubleword(f, r, 32)
+	if e != nil {
+		return nil, e
+	}
+	auxv := []uint64{
+		uint64(linuxAuxPHDR), findProgramHeaders(f, headerOffset),
+		uint64(linuxAuxPHEnt), 56,
+		uint64(linuxAuxPHNum), uint64(len(f.Progs)),
+		uint64(linuxAuxPageSz), uint64(linuxPageSize),
+		uint64(linuxAuxBase), 0,
+		uint64(linuxAuxFlags), 0,
+		uint64(linuxAuxEntry), f.Entry,
+		uint64(linuxAuxUID), 0,
+		uint64(linuxAuxEUID), 0,
+		uint64(linuxAuxGID), 0,
+		uint64(linuxAuxEGID), 0,
+		uint64(linuxAuxHWCap), linuxA64HWCaps,
+		uint64(linuxAuxClkTck), 100,
+		uint64(linuxAuxSecure), 0,
+	}
+	e = toReturn.setupStack(argv, envp, auxv)
+	if e != nil {
+		return nil, e
+	}
+	// The ELF ABI says x0 may contain a function to register with atexit.
+	p.SetRegister(0, 0)
+	e = p.AddSupervisorCallHandler(&toReturn)
+	if e != nil {
+		return nil, fmt.Errorf("Failed adding system call handler: %s", e)
+	}
+	return &toReturn, nil
+}
+
+// Like NewLinuxA64Process, but loads the executable from the given path.
+func NewLinuxA64ProcessFromFile(p A64Processor, path string, argv,
+	envp []string) (*LinuxA64Process, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return NewLinuxA64Process(p, f, argv, envp)
+}
+
+// Runs the process until it exits, returning its exit status. If any other
+// error stops emulation, it's returned instead.
+func (l *LinuxA64Process) Run() (int, error) {
+	return runLinuxProcess(l.processor.RunNextInstruction)
+}
+
+// Closes any host files left open by the process.
+func (l *LinuxA64Process) Close() error {
+	l.closeAll()
+	return nil
+}
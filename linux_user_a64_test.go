@@ -0,0 +1,75 @@
+package arm_emulate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLinuxA64Process(t *testing.T) {
+	program := []uint32{
+		// ldr x4, [sp]; ldr x5, [sp, #8]
+		0xf94003e4, 0xf94007e5,
+		// write(1, msg, 6)
+		0xd2800808, 0xd2800020, 0x10000221, 0xd28000c2, 0xd4000001,
+		// mov x6, x0
+		0xaa0003e6,
+		// brk(0); mov x9, x0
+		0xd2801ac8, 0xd2800000, 0xd4000001, 0xaa0003e9,
+		// brk(x0 + 0x2000); str x4, [x9]
+		0x91400800, 0xd4000001, 0xf9000124,
+		// An unsupported system call (500); mov x10, x0
+		0xd2803e88, 0xd4000001, 0xaa0003ea,
+		// exit_group(argc)
+		0xaa0403e0, 0xd2800bc8, 0xd4000001,
+	}
+	code := make([]byte, len(program)*4)
+	for i, word := range program {
+		binary.LittleEndian.PutUint32(code[i*4:], word)
+	}
+	code = append(code, []byte("Hello\n")...)
+	data := buildTestA64ELF(0x400000, 0x400000, code, uint64(len(code)))
+	p := NewA64Processor()
+	process, e := NewLinuxA64Process(p, bytes.NewReader(data),
+		[]string{"test", "argument"}, []string{"HOME=/"})
+	if e != nil {
+		t.Logf("Failed creating Linux process: %s\n", e)
+		t.FailNow()
+	}
+	defer process.Close()
+	var output bytes.Buffer
+	process.Stdout = &output
+	status, e := process.Run()
+	if e != nil {
+		t.Logf("Failed running Linux process: %s\n", e)
+		t.FailNow()
+	}
+	if status != 2 {
+		t.Logf("Expected exit status 2 (argc), got %d\n", status)
+		t.Fail()
+	}
+	if output.String() != "Hello\n" {
+		t.Logf("Incorrect output: %q\n", output.String())
+		t.Fail()
+	}
+	if p.GetRegister(6) != 6 {
+		t.Logf("Expected write() to return 6, got %d\n", p.GetRegister(6))
+		t.Fail()
+	}
+	if p.GetRegister(10) != 0xffffffffffffffda {
+		t.Logf("Expected -ENOSYS from syscall 500, got 0x%x\n",
+			p.GetRegister(10))
+		t.Fail()
+	}
+	m := p.GetMemoryInterface()
+	value, e := m.ReadMemoryDoubleword(p.GetRegister(9))
+	if (e != nil) || (value != 2) {
+		t.Logf("Incorrect value in heap: %d (%v)\n", value, e)
+		t.Fail()
+	}
+	s, e := readA64MemoryString(m, p.GetRegister(5), 100)
+	if (e != nil) || (s != "test") {
+		t.Logf("Incorrect argv[0]: %q (%v)\n", s, e)
+		t.Fail()
+	}
+}
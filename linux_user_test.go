@@ -0,0 +1,324 @@
+package arm_emulate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLinuxProcess(t *testing.T) {
+	program := []uint32{
+		// ldr r4, [sp]; ldr r5, [sp, 4]
+		0xe59d4000, 0xe59d5004,
+		// write(1, msg, 6)
+		0xe3a07004, 0xe3a00001, 0xe28f103c, 0xe3a02006, 0xef000000,
+		// mov r6, r0
+		0xe1a06000,
+		// brk(0); mov r8, r0
+		0xe3a0702d, 0xe3a00000, 0xef000000, 0xe1a08000,
+		// brk(r0 + 0x2000); str r4, [r8]
+		0xe2800a02, 0xef000000, 0xe5884000,
+		// An unsupported system call (200); mov r9, r0
+		0xe3a070c8, 0xef000000, 0xe1a09000,
+		// exit_group(argc)
+		0xe1a00004, 0xe3a070f8, 0xef000000,
+	}
+	code := make([]byte, len(program)*4)
+	for i, word := range program {
+		binary.LittleEndian.PutUint32(code[i*4:], word)
+	}
+	code = append(code, []byte("Hello\n")...)
+	segments := []testELFSegment{
+		testELFSegment{0x8000, code, uint32(len(code))},
+	}
+	data := buildTestELF(false, 0x05000000, 0x8000, segments, nil)
+	p := NewARMProcessor()
+	process, e := NewLinuxProcess(p, bytes.NewReader(data),
+		[]string{"test", "argument"}, []string{"HOME=/"})
+	if e != nil {
+		t.Logf("Failed creating Linux process: %s\n", e)
+		t.FailNow()
+	}
+	defer process.Close()
+	var output bytes.Buffer
+	process.Stdout = &output
+	status, e := process.Run()
+	if e != nil {
+		t.Logf("Failed running Linux process: %s\n", e)
+		t.FailNow()
+	}
+	if status != 2 {
+		t.Logf("Expected exit status 2 (argc), got %d\n", status)
+		t.Fail()
+	}
+	if output.String() != "Hello\n" {
+		t.Logf("Incorrect output: %q\n", output.String())
+		t.Fail()
+	}
+	value, _ := p.GetRegister(6)
+	if value != 6 {
+		t.Logf("Expected write() to return 6, got %d\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(9)
+	if value != 0xffffffda {
+		t.Logf("Expected -ENOSYS from syscall 200, got 0x%08x\n", value)
+		t.Fail()
+	}
+	heap, _ := p.GetRegister(8)
+	value, e = p.GetMemoryInterface().ReadMemoryWord(heap)
+	if (e != nil) || (value != 2) {
+		t.Logf("Incorrect value in heap: %d (%v)\n", value, e)
+		t.Fail()
+	}
+	argv, _ := p.GetRegister(5)
+	s, e := readMemoryString(p.GetMemoryInterface(), argv, 100)
+	if (e != nil) || (s != "test") {
+		t.Logf("Incorrect argv[0]: %q (%v)\n", s, e)
+		t.Fail()
+	}
+}
+
+func TestLinuxOABISystemCall(t *testing.T) {
+	p := NewARMProcessor()
+	process, e := NewLinuxProcess(p, bytes.NewReader(buildTestELF(false,
+		0, 0x8000, []testELFSegment{testELFSegment{0x8000,
+			// mov r0, 0; swi 0x900001 (exit)
+			[]byte{0x00, 0x00, 0xa0, 0xe3, 0x01, 0x00, 0x90, 0xef}, 8}},
+		nil)), nil, nil)
+	if e != nil {
+		t.Logf("Failed creating Linux process: %s\n", e)
+		t.FailNow()
+	}
+	status, e := process.Run()
+	if (e != nil) || (status != 0) {
+		t.Logf("Expected OABI exit with status 0, got %d (%v)\n", status, e)
+		t.Fail()
+	}
+}
+
+// Returns a process for a program containing the given code at 0x8000.
+func newTestLinuxProcess(t *testing.T, code []byte) (*LinuxProcess,
+	ARMProcessor) {
+	p := NewARMProcessor()
+	data := buildTestELF(false, 0, 0x8000, []testELFSegment{
+		testELFSegment{0x8000, code, uint32(len(code))}}, nil)
+	process, e := NewLinuxProcess(p, bytes.NewReader(data), nil, nil)
+	if e != nil {
+		t.Logf("Failed creating Linux process: %s\n", e)
+		t.FailNow()
+	}
+	return process, p
+}
+
+func TestLinuxFileSystemCalls(t *testing.T) {
+	process, p := newTestLinuxProcess(t, make([]byte, 4))
+	defer process.Close()
+	m := p.GetMemoryInterface()
+	sandbox := t.TempDir()
+	e := os.WriteFile(filepath.Join(sandbox, "input.txt"), []byte("Contents"),
+		0644)
+	if e != nil {
+		t.Logf("Failed creating input file: %s\n", e)
+		t.FailNow()
+	}
+	process.RootDirectory = sandbox
+	buffer, _ := process.syscall(linuxSysMmap2, [6]uint32{0, 0x1000, 3,
+		linuxMapAnonymous, 0xffffffff, 0})
+	if buffer != linuxMmapBase {
+		t.Logf("Expected mmap2 to return 0x%08x, got 0x%08x\n", linuxMmapBase,
+			buffer)
+		t.FailNow()
+	}
+	writeMemoryBytes(m, buffer, []byte("../input.txt\x00out.txt\x00none\x00"))
+	fd, _ := process.syscall(linuxSysOpen, [6]uint32{buffer, 0, 0})
+	if fd != 3 {
+		t.Logf("Expected open to return fd 3, got 0x%08x\n", fd)
+		t.FailNow()
+	}
+	// A bad buffer fails without consuming any of the file.
+	value, _ := process.syscall(linuxSysRead, [6]uint32{fd, 0xf0000000, 100})
+	if value != linuxError(linuxEFAULT) {
+		t.Logf("Expected -EFAULT reading to a bad buffer, got 0x%08x\n",
+			value)
+		t.Fail()
+	}
+	results := [][2]uint32{
+		// Reads stop at the end of the file.
+		{linuxSysRead, 8},
+		{linuxSysRead, 0},
+		{linuxSysClose, 0},
+		{linuxSysClose, linuxError(linuxEBADF)},
+		{linuxSysRead, linuxError(linuxEBADF)},
+	}
+	for i, r := range results {
+		value, _ := process.syscall(r[0], [6]uint32{fd, buffer + 0x100, 100})
+		if value != r[1] {
+			t.Logf("Expected 0x%08x from call %d, got 0x%08x\n", r[1], i,
+				value)
+			t.Fail()
+		}
+	}
+	data, _ := readMemoryBytes(m, buffer+0x100, 8)
+	if string(data) != "Contents" {
+		t.Logf("Incorrect data read from file: %q\n", data)
+		t.Fail()
+	}
+	value, _ = process.syscall(linuxSysOpen, [6]uint32{buffer + 18, 0, 0})
+	if value != linuxError(linuxENOENT) {
+		t.Logf("Expected -ENOENT opening a missing file, got 0x%08x\n", value)
+		t.Fail()
+	}
+	// O_WRONLY | O_CREAT
+	fd, _ = process.syscall(linuxSysOpen, [6]uint32{buffer + 13,
+		1 | linuxOpenCreate, 0644})
+	value, _ = process.syscall(linuxSysWrite, [6]uint32{fd, buffer + 0x100,
+		8})
+	if value != 8 {
+		t.Logf("Expected to write 8 bytes, got 0x%08x\n", value)
+		t.Fail()
+	}
+	// A huge count fails when it reaches unmapped memory, rather than
+	// allocating the entire buffer.
+	value, _ = process.syscall(linuxSysWrite, [6]uint32{fd, buffer,
+		0xffffffff})
+	if value != linuxError(linuxEFAULT) {
+		t.Logf("Expected -EFAULT for a huge write, got 0x%08x\n", value)
+		t.Fail()
+	}
+	process.syscall(linuxSysClose, [6]uint32{fd})
+	data, e = os.ReadFile(filepath.Join(sandbox, "out.txt"))
+	if (e != nil) || (string(data) != "Contents") {
+		t.Logf("Incorrect output file contents: %q (%v)\n", data, e)
+		t.Fail()
+	}
+}
+
+func TestLinuxMemorySystemCalls(t *testing.T) {
+	process, p := newTestLinuxProcess(t, make([]byte, 4))
+	m := p.GetMemoryInterface()
+	first, _ := process.syscall(linuxSysMmap2, [6]uint32{0, 0x1800, 3,
+		linuxMapAnonymous, 0xffffffff, 0})
+	second, _ := process.syscall(linuxSysMmap2, [6]uint32{0, 0x1000, 3,
+		linuxMapAnonymous, 0xffffffff, 0})
+	if (first != linuxMmapBase) || (second != (first + 0x2000)) {
+		t.Logf("Incorrect mmap2 addresses: 0x%08x, 0x%08x\n", first, second)
+		t.FailNow()
+	}
+	e := m.WriteMemoryWord(first+0x1ffc, 1234)
+	if e != nil {
+		t.Logf("Failed writing to the end of a mapping: %s\n", e)
+		t.Fail()
+	}
+	value, _ := process.syscall(linuxSysMunmap, [6]uint32{first, 0x1800})
+	if value != 0 {
+		t.Logf("Expected munmap to return 0, got 0x%08x\n", value)
+		t.Fail()
+	}
+	_, e = m.ReadMemoryWord(first + 0x1ffc)
+	if e == nil {
+		t.Logf("Memory was still mapped after munmap.\n")
+		t.Fail()
+	}
+	value, _ = process.syscall(linuxSysMunmap, [6]uint32{first + 1, 0x1000})
+	if value != linuxError(linuxEINVAL) {
+		t.Logf("Expected -EINVAL for an unaligned munmap, got 0x%08x\n",
+			value)
+		t.Fail()
+	}
+	value, _ = process.syscall(linuxSysMmap2, [6]uint32{0x50000800, 0x1000,
+		3, linuxMapFixed | linuxMapAnonymous, 0xffffffff, 0})
+	if value != linuxError(linuxEINVAL) {
+		t.Logf("Expected -EINVAL for an unaligned mapping, got 0x%08x\n",
+			value)
+		t.Fail()
+	}
+}
+
+func TestLinuxInformationSystemCalls(t *testing.T) {
+	process, p := newTestLinuxProcess(t, make([]byte, 0x100))
+	m := p.GetMemoryInterface()
+	value, _ := process.syscall(linuxSysUname, [6]uint32{0x8000})
+	name, _ := readMemoryString(m, 0x8000, 65)
+	machine, _ := readMemoryString(m, 0x8000+65*4, 65)
+	if (value != 0) || (name != "Linux") || (machine != "armv5tel") {
+		t.Logf("Incorrect uname result: %d, %q, %q\n", value, name, machine)
+		t.Fail()
+	}
+	before := time.Now().Unix()
+	value, _ = process.syscall(linuxSysGettimeofday, [6]uint32{0x8000,
+		0x8008})
+	after := time.Now().Unix()
+	seconds, _ := m.ReadMemoryWord(0x8000)
+	microseconds, _ := m.ReadMemoryWord(0x8004)
+	if (value != 0) || (int64(seconds) < before) ||
+		(int64(seconds) > after) || (microseconds >= 1000000) {
+		t.Logf("Incorrect gettimeofday result: %d, %d.%06d\n", value,
+			seconds, microseconds)
+		t.Fail()
+	}
+	value, _ = process.syscall(linuxSysGettimeofday, [6]uint32{0x10000000})
+	if value != linuxError(linuxEFAULT) {
+		t.Logf("Expected -EFAULT for an unmapped timeval, got 0x%08x\n",
+			value)
+		t.Fail()
+	}
+	value, _ = process.syscall(linuxSysSetTLS, [6]uint32{0x12345678})
+	if value != 0 {
+		t.Logf("Expected set_tls to return 0, got 0x%08x\n", value)
+		t.Fail()
+	}
+	// Calls a kernel helper with lr pointing at 0x8000, and returns r0 after
+	// the helper returns.
+	callHelper := func(address uint32, args ...uint32) uint32 {
+		for i, arg := range args {
+			p.SetRegister(ARMRegister(i), arg)
+		}
+		p.SetRegister(14, 0x8000)
+		p.SetRegister(15, address)
+		for i := 0; i < 10; i++ {
+			pc, _ := p.GetRegister(15)
+			if pc == 0x8000 {
+				result, _ := p.GetRegister(0)
+				return result
+			}
+			e := p.RunNextInstruction()
+			if e != nil {
+				t.Logf("Failed running helper 0x%08x: %s\n", address, e)
+				t.FailNow()
+			}
+		}
+		t.Logf("Helper 0x%08x didn't return.\n", address)
+		t.FailNow()
+		return 0
+	}
+	value = callHelper(0xffff0fe0)
+	if value != 0x12345678 {
+		t.Logf("Expected __kuser_get_tls to return 0x12345678, got "+
+			"0x%08x\n", value)
+		t.Fail()
+	}
+	version, _ := m.ReadMemoryWord(0xffff0ffc)
+	if version != 3 {
+		t.Logf("Expected kernel helper version 3, got %d\n", version)
+		t.Fail()
+	}
+	// __kuser_cmpxchg only stores the new value if the old one matches.
+	m.WriteMemoryWord(0x8080, 5)
+	value = callHelper(0xffff0fc0, 4, 6, 0x8080)
+	stored, _ := m.ReadMemoryWord(0x8080)
+	if (value == 0) || (stored != 5) {
+		t.Logf("Failing cmpxchg returned %d and stored %d\n", value, stored)
+		t.Fail()
+	}
+	value = callHelper(0xffff0fc0, 5, 6, 0x8080)
+	stored, _ = m.ReadMemoryWord(0x8080)
+	if (value != 0) || (stored != 6) {
+		t.Logf("Successful cmpxchg returned %d and stored %d\n", value,
+			stored)
+		t.Fail()
+	}
+}
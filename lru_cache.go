@@ -21,10 +21,26 @@ type thumbInstructionCacheSet struct {
 	firstUsedLast bool
 }
 
-// The top-level instruction cache for ARM and THUMB.
+// Holds 2 cache ways for 32-bit Thumb-2 instructions.
+type thumb2InstructionCacheSet struct {
+	first         THUMB2Instruction
+	second        THUMB2Instruction
+	firstUsedLast bool
+}
+
+// Holds 2 cache ways for A64 instructions.
+type a64InstructionCacheSet struct {
+	first         A64Instruction
+	second        A64Instruction
+	firstUsedLast bool
+}
+
+// The top-level instruction cache for ARM, THUMB, Thumb-2 and A64.
 type instructionCache struct {
-	armInstructions   []armInstructionCacheSet
-	thumbInstructions []thumbInstructionCacheSet
+	armInstructions    []armInstructionCacheSet
+	thumbInstructions  []thumbInstructionCacheSet
+	thumb2Instructions []thumb2InstructionCacheSet
+	a64Instructions    []a64InstructionCacheSet
 }
 
 func hashARMInstruction(raw uint32) uint32 {
@@ -35,6 +51,14 @@ func hashTHUMBInstruction(raw uint16) uint16 {
 	return (raw ^ (raw >> 8)) % cacheSets
 }
 
+func hashTHUMB2Instruction(raw uint32) uint32 {
+	return (raw ^ (raw >> 16)) % cacheSets
+}
+
+func hashA64Instruction(raw uint32) uint32 {
+	return (raw ^ (raw >> 21)) % cacheSets
+}
+
 // Gets the ARM instruction at the given cache. Returns nil if the instruction
 // cached.
 func (c *instructionCache) getARMInstruction(raw uint32) ARMInstruction {
@@ -75,6 +99,44 @@ func (c *instructionCache) getTHUMBInstruction(raw uint16) THUMBInstruction {
 	return set.second
 }
 
+func (c *instructionCache) getTHUMB2Instruction(raw uint32) THUMB2Instruction {
+	set := &(c.thumb2Instructions[hashTHUMB2Instruction(raw)])
+	if set.first == nil {
+		return nil
+	}
+	if set.first.Raw() == raw {
+		set.firstUsedLast = true
+		return set.first
+	}
+	if set.second == nil {
+		return nil
+	}
+	if set.second.Raw() != raw {
+		return nil
+	}
+	set.firstUsedLast = false
+	return set.second
+}
+
+func (c *instructionCache) getA64Instruction(raw uint32) A64Instruction {
+	set := &(c.a64Instructions[hashA64Instruction(raw)])
+	if set.first == nil {
+		return nil
+	}
+	if set.first.Raw() == raw {
+		set.firstUsedLast = true
+		return set.first
+	}
+	if set.second == nil {
+		return nil
+	}
+	if set.second.Raw() != raw {
+		return nil
+	}
+	set.firstUsedLast = false
+	return set.second
+}
+
 func (c *instructionCache) storeARMInstruction(n ARMInstruction) {
 	set := &(c.armInstructions[hashARMInstruction(n.Raw())])
 	if set.first == nil {
@@ -115,9 +177,52 @@ func (c *instructionCache) storeTHUMBInstruction(n THUMBInstruction) {
 	set.firstUsedLast = !set.firstUsedLast
 }
 
+func (c *instructionCache) storeTHUMB2Instruction(n THUMB2Instruction) {
+	set := &(c.thumb2Instructions[hashTHUMB2Instruction(n.Raw())])
+	if set.first == nil {
+		set.first = n
+		set.firstUsedLast = true
+		return
+	}
+	if set.second == nil {
+		set.second = n
+		set.firstUsedLast = false
+		return
+	}
+	if set.firstUsedLast {
+		set.second = n
+	} else {
+		set.first = n
+	}
+	set.firstUsedLast = !set.firstUsedLast
+}
+
+func (c *instructionCache) storeA64Instruction(n A64Instruction) {
+	set := &(c.a64Instructions[hashA64Instruction(n.Raw())])
+	if set.first == nil {
+		set.first = n
+		set.firstUsedLast = true
+		return
+	}
+	if set.second == nil {
+		set.second = n
+		set.firstUsedLast = false
+		return
+	}
+	if set.firstUsedLast {
+		set.second = n
+	} else {
+		set.first = n
+	}
+	set.firstUsedLast = !set.firstUsedLast
+}
+
 func newInstructionCache() *instructionCache {
 	var toReturn instructionCache
 	toReturn.armInstructions = make([]armInstructionCacheSet, cacheSets)
 	toReturn.thumbInstructions = make([]thumbInstructionCacheSet, cacheSets)
+	toReturn.thumb2Instructions = make([]thumb2InstructionCacheSet,
+		cacheSets)
+	toReturn.a64Instructions = make([]a64InstructionCacheSet, cacheSets)
 	return &toReturn
 }
@@ -0,0 +1,254 @@
+package arm_emulate
+
+// This file implements the memory used by A64 processors, which is addressed
+// using 64-bit virtual addresses.
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The memory interface used by A64 processors. Accesses are always little
+// endian, and don't need to be aligned.
+type A64Memory interface {
+	// Maps the given byte array into memory, starting at the given base
+	// address. baseAddress doesn't need to be aligned with anything.
+	SetMemoryRegion(baseAddress uint64, memory []byte) error
+	// "Unmaps" the given range. Size is rounded down to the nearest 4096 bytes
+	// and baseAddress is page-aligned. This can free unused memory.
+	ClearMemoryRegion(baseAddress, size uint64) error
+	ReadMemoryDoubleword(address uint64) (uint64, error)
+	WriteMemoryDoubleword(address, data uint64) error
+	ReadMemoryWord(address uint64) (uint32, error)
+	WriteMemoryWord(address uint64, data uint32) error
+	ReadMemoryHalfword(address uint64) (uint16, error)
+	WriteMemoryHalfword(address uint64, data uint16) error
+	ReadMemoryByte(address uint64) (uint8, error)
+	WriteMemoryByte(address uint64, data uint8) error
+}
+
+// Returned when an A64 memory access fails.
+type A64MemoryAccessError struct {
+	Address uint64
+	// Describes why the access failed.
+	Reason string
+}
+
+func (e *A64MemoryAccessError) Error() string {
+	return fmt.Sprintf("%s: 0x%016x", e.Reason, e.Address)
+}
+
+// Holds sparsely-mapped 4k pages, keyed by the page's address divided by 4096.
+type basicA64Memory struct {
+	pages map[uint64][]byte
+}
+
+// Returns the page containing the given address, or an error if the page
+// doesn't exist.
+func (m *basicA64Memory) getContainingPage(address uint64) ([]byte, error) {
+	page := m.pages[address>>12]
+	if page == nil {
+		return nil, &A64MemoryAccessError{address, "Page doesn't exist"}
+	}
+	return page, nil
+}
+
+// Copies len(data) bytes starting at the given address into data.
+func (m *basicA64Memory) read(address uint64, data []byte) error {
+	offset := address & 0xfff
+	page, e := m.getContainingPage(address)
+	if e != nil {
+		return e
+	}
+	if (offset + uint64(len(data))) <= 4096 {
+		copy(data, page[offset:])
+		return nil
+	}
+	// The access crosses a page boundary.
+	for i := range data {
+		page, e = m.getContainingPage(address + uint64(i))
+		if e != nil {
+			return e
+		}
+		data[i] = page[(address+uint64(i))&0xfff]
+	}
+	return nil
+}
+
+// Copies data into memory starting at the given address. Nothing is written
+// unless every byte can be.
+func (m *basicA64Memory) write(address uint64, data []byte) error {
+	offset := address & 0xfff
+	page, e := m.getContainingPage(address)
+	if e != nil {
+		return e
+	}
+	if (offset + uint64(len(data))) <= 4096 {
+		copy(page[offset:], data)
+		return nil
+	}
+	last := address + uint64(len(data)) - 1
+	for a := (address &^ 0xfff) + 4096; ; a += 4096 {
+		_, e = m.getContainingPage(a)
+		if e != nil {
+			return e
+		}
+		if (a >> 12) == (last >> 12) {
+			break
+		}
+	}
+	for i, b := range data {
+		page, _ = m.getContainingPage(address + uint64(i))
+		page[(address+uint64(i))&0xfff] = b
+	}
+	return nil
+}
+
+func (m *basicA64Memory) ReadMemoryDoubleword(address uint64) (uint64,
+	error) {
+	var data [8]byte
+	e := m.read(address, data[:])
+	return binary.LittleEndian.Uint64(data[:]), e
+}
+
+func (m *basicA64Memory) WriteMemoryDoubleword(address, value uint64) error {
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], value)
+	return m.write(address, data[:])
+}
+
+func (m *basicA64Memory) ReadMemoryWord(address uint64) (uint32, error) {
+	var data [4]byte
+	e := m.read(address, data[:])
+	return binary.LittleEndian.Uint32(data[:]), e
+}
+
+func (m *basicA64Memory) WriteMemoryWord(address uint64, value uint32) error {
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], value)
+	return m.write(address, data[:])
+}
+
+func (m *basicA64Memory) ReadMemoryHalfword(address uint64) (uint16, error) {
+	var data [2]byte
+	e := m.read(address, data[:])
+	return binary.LittleEndian.Uint16(data[:]), e
+}
+
+func (m *basicA64Memory) WriteMemoryHalfword(address uint64,
+	value uint16) error {
+	var data [2]byte
+	binary.LittleEndian.PutUint16(data[:], value)
+	return m.write(address, data[:])
+}
+
+func (m *basicA64Memory) ReadMemoryByte(address uint64) (uint8, error) {
+	var data [1]byte
+	e := m.read(address, data[:])
+	return data[0], e
+}
+
+func (m *basicA64Memory) WriteMemoryByte(address uint64, value uint8) error {
+	return m.write(address, []byte{value})
+}
+
+func (m *basicA64Memory) SetMemoryRegion(baseAddress uint64,
+	memory []byte) error {
+	if len(memory) == 0 {
+		return nil
+	}
+	last := baseAddress + uint64(len(memory)) - 1
+	if last < baseAddress {
+		return fmt.Errorf("Not enough space to map %d bytes at 0x%016x",
+			len(memory), baseAddress)
+	}
+	for index := baseAddress >> 12; ; index++ {
+		if m.pages[index] == nil {
+			m.pages[index] = make([]byte, 4096)
+		}
+		if index == (last >> 12) {
+			break
+		}
+	}
+	return m.write(baseAddress, memory)
+}
+
+func (m *basicA64Memory) ClearMemoryRegion(baseAddress, size uint64) error {
+	address := baseAddress
+	if (address % 4096) != 0 {
+		address += 4096 - (address % 4096)
+	}
+	limitAddress := (baseAddress + size) &^ 0xfff
+	if limitAddress < baseAddress {
+		return fmt.Errorf("Invalid region size: 0x%x", size)
+	}
+	for ; address < limitAddress; address += 4096 {
+		delete(m.pages, address>>12)
+	}
+	return nil
+}
+
+// Reads count bytes from memory starting at the given address.
+func readA64MemoryBytes(m A64Memory, address, count uint64) ([]byte, error) {
+	toReturn := make([]byte, count)
+	for i := uint64(0); i < count; i++ {
+		b, e := m.ReadMemoryByte(address + i)
+		if e != nil {
+			return nil, e
+		}
+		toReturn[i] = b
+	}
+	return toReturn, nil
+}
+
+// Writes the given bytes to memory starting at the given address.
+func writeA64MemoryBytes(m A64Memory, address uint64, data []byte) error {
+	for i, b := range data {
+		e := m.WriteMemoryByte(address+uint64(i), b)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Like probeMemoryBytes, but for A64 memory.
+func probeA64MemoryBytes(m A64Memory, address, count uint64) error {
+	for i := uint64(0); i < count; i++ {
+		b, e := m.ReadMemoryByte(address + i)
+		if e != nil {
+			return e
+		}
+		e = m.WriteMemoryByte(address+i, b)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Reads a null-terminated string from memory. Returns an error if the string
+// is longer than maxLength bytes.
+func readA64MemoryString(m A64Memory, address, maxLength uint64) (string,
+	error) {
+	toReturn := make([]byte, 0, 64)
+	for i := uint64(0); i < maxLength; i++ {
+		b, e := m.ReadMemoryByte(address + i)
+		if e != nil {
+			return "", e
+		}
+		if b == 0 {
+			return string(toReturn), nil
+		}
+		toReturn = append(toReturn, b)
+	}
+	return "", fmt.Errorf("String at 0x%016x is longer than %d bytes",
+		address, maxLength)
+}
+
+// Returns a new, empty A64Memory object.
+func NewA64Memory() A64Memory {
+	var toReturn basicA64Memory
+	toReturn.pages = make(map[uint64][]byte)
+	return &toReturn
+}
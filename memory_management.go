@@ -2,8 +2,15 @@ package arm_emulate
 
 import (
 	"fmt"
+	"math/bits"
 )
 
+// A function called after each successful read or write through an ARMMemory
+// interface. The address is aligned to the size of the access, which is 1, 2
+// or 4 bytes. The value is the one that was read or written.
+type MemoryAccessHook func(address uint32, size uint8, value uint32,
+	write bool)
+
 // This defines the interface to memory to be used during emulation.
 type ARMMemory interface {
 	// Maps the given byte array into memory, starting at the given base
@@ -23,12 +30,104 @@ type ARMMemory interface {
 	// the "native" endianness of the machine running the emulator.
 	SetBigEndian(bigEndian bool) error
 	IsBigEndian() bool
+	// Sets a function to call after every read or write of a word, halfword
+	// or byte. Only one hook may be set at a time; a nil hook removes it.
+	SetAccessHook(hook MemoryAccessHook)
+	// Causes accesses to the given range to be handled by the device rather
+	// than by memory. Device ranges may not overlap each other, but take
+	// priority over any memory mapped using SetMemoryRegion.
+	MapDevice(baseAddress, size uint32, device MemoryMappedDevice) error
+	// Removes the device mapped at the given base address.
+	UnmapDevice(baseAddress uint32) error
+}
+
+// ARMMemory implementations which treat instruction fetches differently from
+// data reads, for example to check execute permissions or to record the
+// status of prefetch aborts, may implement this. The processor fetches
+// instructions using these functions if they're available.
+type InstructionFetcher interface {
+	FetchInstructionWord(address uint32) (uint32, error)
+	FetchInstructionHalfword(address uint32) (uint16, error)
+}
+
+// Reads an instruction word, using the InstructionFetcher interface if the
+// memory implements it.
+func fetchInstructionWord(m ARMMemory, address uint32) (uint32, error) {
+	if f, ok := m.(InstructionFetcher); ok {
+		return f.FetchInstructionWord(address)
+	}
+	return m.ReadMemoryWord(address)
+}
+
+// Like fetchInstructionWord, but for THUMB instructions.
+func fetchInstructionHalfword(m ARMMemory, address uint32) (uint16, error) {
+	if f, ok := m.(InstructionFetcher); ok {
+		return f.FetchInstructionHalfword(address)
+	}
+	return m.ReadMemoryHalfword(address)
+}
+
+// This is implemented by ARMMemory implementations whose reads can change the
+// state of the emulated system, for example by recording faults in CP15.
+type debugMemoryProvider interface {
+	// Returns a view of the memory which can be read without side effects.
+	debugMemory() ARMMemory
+}
+
+// Returns a view of the given memory for debugging tools such as the
+// disassembler, which can be read without changing the emulated system.
+func debugMemory(m ARMMemory) ARMMemory {
+	if d, ok := m.(debugMemoryProvider); ok {
+		return d.debugMemory()
+	}
+	return m
+}
+
+// Wraps an ARMMemory, reversing the byte order of words and halfwords. This is
+// used for data accesses when the E bit in the CPSR is set.
+type byteSwappingMemory struct {
+	ARMMemory
+}
+
+func (m *byteSwappingMemory) ReadMemoryWord(address uint32) (uint32, error) {
+	value, e := m.ARMMemory.ReadMemoryWord(address)
+	return bits.ReverseBytes32(value), e
+}
+
+func (m *byteSwappingMemory) WriteMemoryWord(address, data uint32) error {
+	return m.ARMMemory.WriteMemoryWord(address, bits.ReverseBytes32(data))
+}
+
+func (m *byteSwappingMemory) ReadMemoryHalfword(address uint32) (uint16,
+	error) {
+	value, e := m.ARMMemory.ReadMemoryHalfword(address)
+	return bits.ReverseBytes16(value), e
+}
+
+func (m *byteSwappingMemory) WriteMemoryHalfword(address uint32,
+	data uint16) error {
+	return m.ARMMemory.WriteMemoryHalfword(address,
+		bits.ReverseBytes16(data))
+}
+
+func (m *byteSwappingMemory) debugMemory() ARMMemory {
+	return &byteSwappingMemory{debugMemory(m.ARMMemory)}
+}
+
+func (m *byteSwappingMemory) IsBigEndian() bool {
+	return !m.ARMMemory.IsBigEndian()
+}
+
+func (m *byteSwappingMemory) SetBigEndian(bigEndian bool) error {
+	return m.ARMMemory.SetBigEndian(!bigEndian)
 }
 
 // Uses 2-level page tables and 4k pages.
 type basicARMMemory struct {
 	pages       [][][]byte
 	isBigEndian bool
+	accessHook  MemoryAccessHook
+	devices     []deviceRegion
 }
 
 // Returns the 2nd-level index, page table index, and offset, respectively.
@@ -42,11 +141,11 @@ func (m *basicARMMemory) getContainingPage(address uint32) ([]byte, error) {
 	level2Index, level1Index, _ := getAddressPageIndices(address)
 	level1Table := m.pages[level2Index]
 	if level1Table == nil {
-		return nil, fmt.Errorf("Page doesn't exist: 0x%08x", address)
+		return nil, &MemoryAccessError{address, "Page doesn't exist"}
 	}
 	page := level1Table[level1Index]
 	if page == nil {
-		return nil, fmt.Errorf("Page doesn't exist: 0x%08x", address)
+		return nil, &MemoryAccessError{address, "Page doesn't exist"}
 	}
 	return page, nil
 }
@@ -67,6 +166,11 @@ func (m *basicARMMemory) createContainingPage(address uint32) []byte {
 func (m *basicARMMemory) ReadMemoryWord(address uint32) (uint32, error) {
 	var toReturn uint32
 	address &= 0xfffffffc
+	if len(m.devices) != 0 {
+		if r := m.findDevice(address); r != nil {
+			return m.readDevice(r, address, 4)
+		}
+	}
 	page, e := m.getContainingPage(address)
 	if e != nil {
 		return 0, e
@@ -83,46 +187,75 @@ func (m *basicARMMemory) ReadMemoryWord(address uint32) (uint32, error) {
 			toReturn |= uint32(page[offset+i])
 		}
 	}
+	if m.accessHook != nil {
+		m.accessHook(address, 4, toReturn, false)
+	}
 	return toReturn, nil
 }
 
 func (m *basicARMMemory) WriteMemoryWord(address, value uint32) error {
 	address &= 0xfffffffc
+	if len(m.devices) != 0 {
+		if r := m.findDevice(address); r != nil {
+			return m.writeDevice(r, address, 4, value)
+		}
+	}
 	page, e := m.getContainingPage(address)
 	if e != nil {
 		return e
 	}
 	offset := int(address & 0xfff)
+	data := value
 	if m.isBigEndian {
 		for i := 0; i < 4; i++ {
-			page[offset+i] = byte((value & 0xff000000) >> 24)
-			value = value << 8
+			page[offset+i] = byte((data & 0xff000000) >> 24)
+			data = data << 8
 		}
 	} else {
 		for i := 0; i < 4; i++ {
-			page[offset+i] = byte(value & 0xff)
-			value = value >> 8
+			page[offset+i] = byte(data & 0xff)
+			data = data >> 8
 		}
 	}
+	if m.accessHook != nil {
+		m.accessHook(address, 4, value, true)
+	}
 	return nil
 }
 
 func (m *basicARMMemory) ReadMemoryHalfword(address uint32) (uint16, error) {
 	address &= 0xfffffffe
+	if len(m.devices) != 0 {
+		if r := m.findDevice(address); r != nil {
+			value, e := m.readDevice(r, address, 2)
+			return uint16(value), e
+		}
+	}
 	page, e := m.getContainingPage(address)
 	if e != nil {
 		return 0, e
 	}
 	offset := address & 0xfff
+	var toReturn uint16
 	if m.isBigEndian {
-		return (uint16(page[offset]) << 8) | uint16(page[offset+1]), nil
+		toReturn = (uint16(page[offset]) << 8) | uint16(page[offset+1])
+	} else {
+		toReturn = (uint16(page[offset+1]) << 8) | uint16(page[offset])
 	}
-	return (uint16(page[offset+1]) << 8) | uint16(page[offset]), nil
+	if m.accessHook != nil {
+		m.accessHook(address, 2, uint32(toReturn), false)
+	}
+	return toReturn, nil
 }
 
 func (m *basicARMMemory) WriteMemoryHalfword(address uint32,
 	data uint16) error {
 	address &= 0xfffffffe
+	if len(m.devices) != 0 {
+		if r := m.findDevice(address); r != nil {
+			return m.writeDevice(r, address, 2, uint32(data))
+		}
+	}
 	page, e := m.getContainingPage(address)
 	if e != nil {
 		return e
@@ -135,29 +268,50 @@ func (m *basicARMMemory) WriteMemoryHalfword(address uint32,
 		page[offset] = byte(data & 0xff)
 		page[offset+1] = byte((data & 0xff00) >> 8)
 	}
+	if m.accessHook != nil {
+		m.accessHook(address, 2, uint32(data), true)
+	}
 	return nil
 }
 
 func (m *basicARMMemory) ReadMemoryByte(address uint32) (uint8, error) {
+	if len(m.devices) != 0 {
+		if r := m.findDevice(address); r != nil {
+			value, e := m.readDevice(r, address, 1)
+			return uint8(value), e
+		}
+	}
 	page, e := m.getContainingPage(address)
 	if e != nil {
 		return 0, e
 	}
-	return page[address&0xfff], nil
+	toReturn := page[address&0xfff]
+	if m.accessHook != nil {
+		m.accessHook(address, 1, uint32(toReturn), false)
+	}
+	return toReturn, nil
 }
 
 func (m *basicARMMemory) WriteMemoryByte(address uint32, value uint8) error {
+	if len(m.devices) != 0 {
+		if r := m.findDevice(address); r != nil {
+			return m.writeDevice(r, address, 1, uint32(value))
+		}
+	}
 	page, e := m.getContainingPage(address)
 	if e != nil {
 		return e
 	}
 	page[address&0xfff] = value
+	if m.accessHook != nil {
+		m.accessHook(address, 1, uint32(value), true)
+	}
 	return nil
 }
 
 func (m *basicARMMemory) SetMemoryRegion(baseAddress uint32,
 	memory []byte) error {
-	if (uint64(baseAddress) + uint64(len(memory))) > uint64(0xffffffff) {
+	if (uint64(baseAddress) + uint64(len(memory))) > uint64(0x100000000) {
 		return fmt.Errorf("Not enough space to map %d bytes at 0x%08x",
 			len(memory), baseAddress)
 	}
@@ -165,13 +319,15 @@ func (m *basicARMMemory) SetMemoryRegion(baseAddress uint32,
 	offset := baseAddress & 0xfff
 	page := m.createContainingPage(address)
 	for i := 0; i < len(memory); i++ {
-		page[offset] = memory[i]
-		offset++
+		// Only create the next page if there's data to put in it, so that
+		// mapping the last page doesn't wrap around to address 0.
 		if offset >= 4096 {
 			offset = 0
 			address += 4096
 			page = m.createContainingPage(address)
 		}
+		page[offset] = memory[i]
+		offset++
 	}
 	return nil
 }
@@ -185,10 +341,12 @@ func (m *basicARMMemory) ClearMemoryRegion(baseAddress, size uint32) error {
 	// Free pages
 	for address < limitAddress {
 		level2Index, level1Index, _ := getAddressPageIndices(address)
-		m.pages[level2Index][level1Index] = nil
+		if m.pages[level2Index] != nil {
+			m.pages[level2Index][level1Index] = nil
+		}
 		address += 4096
 	}
-	address = baseAddress & 0xfff00000
+	address = baseAddress
 	if (address % 0x100000) != 0 {
 		address += 0x100000 - (address % 0x100000)
 	}
@@ -211,6 +369,72 @@ func (m *basicARMMemory) IsBigEndian() bool {
 	return m.isBigEndian
 }
 
+func (m *basicARMMemory) SetAccessHook(hook MemoryAccessHook) {
+	m.accessHook = hook
+}
+
+// Reads count bytes from memory starting at the given address.
+func readMemoryBytes(m ARMMemory, address, count uint32) ([]byte, error) {
+	// The buffer grows as bytes are read, so that a large count doesn't cause
+	// a large allocation before an unmapped address is reached.
+	toReturn := make([]byte, 0, 64)
+	for i := uint32(0); i < count; i++ {
+		b, e := m.ReadMemoryByte(address + i)
+		if e != nil {
+			return nil, e
+		}
+		toReturn = append(toReturn, b)
+	}
+	return toReturn, nil
+}
+
+// Writes the given bytes to memory starting at the given address.
+func writeMemoryBytes(m ARMMemory, address uint32, data []byte) error {
+	for i, b := range data {
+		e := m.WriteMemoryByte(address+uint32(i), b)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Checks that count bytes starting at the given address can be written, by
+// writing back their current values. This lets system calls report a bad
+// buffer before consuming any input.
+func probeMemoryBytes(m ARMMemory, address, count uint32) error {
+	for i := uint32(0); i < count; i++ {
+		b, e := m.ReadMemoryByte(address + i)
+		if e != nil {
+			return e
+		}
+		e = m.WriteMemoryByte(address+i, b)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Reads a null-terminated string from memory. Returns an error if the string
+// is longer than maxLength bytes.
+func readMemoryString(m ARMMemory, address, maxLength uint32) (string,
+	error) {
+	toReturn := make([]byte, 0, 64)
+	for i := uint32(0); i < maxLength; i++ {
+		b, e := m.ReadMemoryByte(address + i)
+		if e != nil {
+			return "", e
+		}
+		if b == 0 {
+			return string(toReturn), nil
+		}
+		toReturn = append(toReturn, b)
+	}
+	return "", fmt.Errorf("String at 0x%08x is longer than %d bytes", address,
+		maxLength)
+}
+
 // Returns a new ARMMemory object, empty and set to little endian
 func NewARMMemory() ARMMemory {
 	var toReturn basicARMMemory
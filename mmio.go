@@ -0,0 +1,96 @@
+package arm_emulate
+
+// This file implements support for memory-mapped devices in basicARMMemory.
+
+import (
+	"fmt"
+)
+
+// This interface is implemented by memory-mapped devices (peripherals). The
+// offset is relative to the start of the range the device was mapped at, and
+// is aligned to the width of the access, which is 1, 2 or 4 bytes. Values are
+// always given in the host's native byte order. A device may return an error
+// to reject an access, for example if it doesn't support the access width.
+type MemoryMappedDevice interface {
+	ReadDevice(offset uint32, width uint8) (uint32, error)
+	WriteDevice(offset uint32, width uint8, value uint32) error
+}
+
+// A range of addresses handled by a device rather than by memory pages.
+type deviceRegion struct {
+	baseAddress uint32
+	size        uint32
+	device      MemoryMappedDevice
+}
+
+func (r *deviceRegion) contains(address uint32) bool {
+	return (address >= r.baseAddress) && ((address - r.baseAddress) < r.size)
+}
+
+func (m *basicARMMemory) MapDevice(baseAddress, size uint32,
+	device MemoryMappedDevice) error {
+	if size == 0 {
+		return fmt.Errorf("Can't map a device with a size of 0")
+	}
+	if (uint64(baseAddress) + uint64(size)) > uint64(0x100000000) {
+		return fmt.Errorf("Not enough space to map 0x%x bytes at 0x%08x",
+			size, baseAddress)
+	}
+	end := baseAddress + (size - 1)
+	for _, r := range m.devices {
+		if r.contains(baseAddress) || r.contains(end) ||
+			((baseAddress <= r.baseAddress) && (end >= r.baseAddress)) {
+			return fmt.Errorf("Device at 0x%08x overlaps device at 0x%08x",
+				baseAddress, r.baseAddress)
+		}
+	}
+	m.devices = append(m.devices, deviceRegion{baseAddress, size, device})
+	return nil
+}
+
+func (m *basicARMMemory) UnmapDevice(baseAddress uint32) error {
+	for i := range m.devices {
+		if m.devices[i].baseAddress == baseAddress {
+			m.devices = append(m.devices[:i], m.devices[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No device mapped at 0x%08x", baseAddress)
+}
+
+// Returns the device region containing the given address, or nil if the
+// address isn't handled by a device.
+func (m *basicARMMemory) findDevice(address uint32) *deviceRegion {
+	for i := range m.devices {
+		if m.devices[i].contains(address) {
+			return &(m.devices[i])
+		}
+	}
+	return nil
+}
+
+func (m *basicARMMemory) readDevice(r *deviceRegion, address uint32,
+	width uint8) (uint32, error) {
+	value, e := r.device.ReadDevice(address-r.baseAddress, width)
+	if e != nil {
+		return 0, &MemoryAccessError{address,
+			fmt.Sprintf("Device read failed (%s)", e)}
+	}
+	if m.accessHook != nil {
+		m.accessHook(address, width, value, false)
+	}
+	return value, nil
+}
+
+func (m *basicARMMemory) writeDevice(r *deviceRegion, address uint32,
+	width uint8, value uint32) error {
+	e := r.device.WriteDevice(address-r.baseAddress, width, value)
+	if e != nil {
+		return &MemoryAccessError{address,
+			fmt.Sprintf("Device write failed (%s)", e)}
+	}
+	if m.accessHook != nil {
+		m.accessHook(address, width, value, true)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package arm_emulate
+
+import (
+	"fmt"
+	"testing"
+)
+
+// A device with four word-sized registers, which rejects other access widths.
+type testRegisterDevice struct {
+	registers [4]uint32
+	writes    int
+}
+
+func (d *testRegisterDevice) ReadDevice(offset uint32, width uint8) (uint32,
+	error) {
+	if width != 4 {
+		return 0, fmt.Errorf("Unsupported read width: %d", width)
+	}
+	return d.registers[offset/4], nil
+}
+
+func (d *testRegisterDevice) WriteDevice(offset uint32, width uint8,
+	value uint32) error {
+	if width != 4 {
+		return fmt.Errorf("Unsupported write width: %d", width)
+	}
+	d.registers[offset/4] = value
+	d.writes++
+	return nil
+}
+
+func TestMemoryMappedDevice(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	var device testRegisterDevice
+	m := p.GetMemoryInterface()
+	e = m.MapDevice(0x10000, 16, &device)
+	if e != nil {
+		t.Logf("Failed mapping device: %s\n", e)
+		t.FailNow()
+	}
+	e = m.MapDevice(0xfff8, 16, &device)
+	if e == nil {
+		t.Logf("Didn't get an error mapping overlapping devices.\n")
+		t.Fail()
+	}
+	program := []uint32{
+		// mov r0, 0x10000; mov r1, 5
+		0xe3a00801, 0xe3a01005,
+		// str r1, [r0, 4]; ldr r2, [r0, 4]
+		0xe5801004, 0xe5902004,
+		// stmia r0, {r1, r2}; ldrb r3, [r0]
+		0xe8800006, 0xe5d03000,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(5, p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(2)
+	if value != 5 {
+		t.Logf("Expected to read 5 from the device, got %d\n", value)
+		t.Fail()
+	}
+	if (device.writes != 3) || (device.registers[0] != 5) ||
+		(device.registers[1] != 5) {
+		t.Logf("Incorrect device state: %+v\n", device)
+		t.Fail()
+	}
+	e = p.RunNextInstruction()
+	if e == nil {
+		t.Logf("Didn't get an error for an unsupported byte read.\n")
+		t.Fail()
+	} else {
+		t.Logf("Got expected error for a byte read: %s\n", e)
+	}
+	// push {r1}, with the stack in the device.
+	p.SetTHUMBMode(true)
+	p.SetRegister(13, 0x10010)
+	p.SetRegister(1, 1337)
+	e = testSingleTHUMBInstruction(0xb402, p)
+	if (e != nil) || (device.registers[3] != 1337) {
+		t.Logf("THUMB push to device failed: %v, %+v\n", e, device)
+		t.Fail()
+	}
+	e = m.UnmapDevice(0x10000)
+	if e != nil {
+		t.Logf("Failed unmapping device: %s\n", e)
+		t.Fail()
+	}
+	_, e = m.ReadMemoryWord(0x10000)
+	if e == nil {
+		t.Logf("Device was still accessible after unmapping it.\n")
+		t.Fail()
+	}
+}
@@ -1,6 +1,7 @@
 package arm_emulate
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -20,6 +21,15 @@ func isValidMode(mode uint8) bool {
 		(mode == undefinedMode)
 }
 
+// This interface may be implemented to handle software interrupts (e.g. system
+// calls) in Go rather than in code at the SWI exception vector.
+type SoftwareInterruptHandler interface {
+	// This is called when a swi instruction is executed, before the processor
+	// changes modes. The PC will already point to the following instruction.
+	// If this returns true, the processor won't take the SWI exception.
+	HandleSoftwareInterrupt(p ARMProcessor, comment uint32) (bool, error)
+}
+
 // The generic processor interface through which emulation functions should be
 // implemented.
 type ARMProcessor interface {
@@ -44,6 +54,18 @@ type ARMProcessor interface {
 	SetZero(zero bool)
 	SetCarry(carry bool)
 	SetOverflow(overflow bool)
+	// The Q flag, which saturating ARMv5TE instructions set. It's only
+	// cleared by writing the CPSR.
+	StickyOverflow() bool
+	SetStickyOverflow(overflow bool)
+	// The four GE flags, set by the ARMv6 parallel add and subtract
+	// instructions, in the low bits of the returned value.
+	GEFlags() uint8
+	SetGEFlags(flags uint8)
+	// The state of the current Thumb-2 IT block, kept in CPSR bits 26:25
+	// and 15:10. This is 0 outside of IT blocks.
+	ITState() uint8
+	SetITState(state uint8)
 	FIQDisabled() bool
 	IRQDisabled() bool
 	THUMBMode() bool
@@ -59,21 +81,98 @@ type ARMProcessor interface {
 	// primarily needed during emulation.
 	AddCoprocessor(coprocessor ARMCoprocessor) error
 	GetCoprocessors() []ARMCoprocessor
+	// Handlers added using this function are called, in the order they were
+	// added, when a software interrupt occurs. They are only consulted until
+	// one of them returns true.
+	AddSoftwareInterruptHandler(handler SoftwareInterruptHandler) error
+	GetSoftwareInterruptHandlers() []SoftwareInterruptHandler
 	// This prints the disassembly of instruction that will be executed on the
-	// next call to RunNextInstruction()
+	// next call to RunNextInstruction(). Branch targets and PC-relative loads
+	// are printed as absolute addresses, and the values of literals are
+	// printed in a comment.
 	PendingInstructionString() string
+	// If set, PendingInstructionString prints addresses relative to the
+	// symbols returned by this. May be nil to print plain addresses.
+	SetSymbolResolver(symbols SymbolResolver)
 	// These functions, respectively, cause the processor to switch to the
-	// proper mode and jump to the respective exception handler.
+	// proper mode and jump to the respective exception handler immediately,
+	// unless the interrupt is disabled in the CPSR.
 	SendIRQ() error
 	SendFIQ() error
+	// These set the level of the processor's IRQ and FIQ input lines. The
+	// lines are sampled at the start of each call to RunNextInstruction; if
+	// one is asserted and not disabled in the CPSR, the interrupt is taken
+	// instead of emulating an instruction. FIQs have priority over IRQs. The
+	// lines stay asserted until they're cleared by the caller.
+	SetIRQLine(asserted bool)
+	SetFIQLine(asserted bool)
+	IRQLine() bool
+	FIQLine() bool
+	// Puts the processor in supervisor mode, in ARM state with IRQs and FIQs
+	// disabled, and jumps to the reset vector. Other registers are unchanged.
+	Reset() error
+	// If high vectors are enabled, the exception vectors are located at
+	// 0xffff0000 rather than 0x00000000. This is disabled by default.
+	SetHighVectors(enabled bool)
+	HighVectors() bool
+	// Selects the version of the architecture to emulate, which determines
+	// how instructions are decoded and emulated. This defaults to ARMv6.
+	SetArchitecture(architecture ARMArchitecture) error
+	Architecture() ARMArchitecture
+	// These access the registers of the given mode, regardless of the
+	// current mode.
+	GetBankedRegister(mode uint8, number ARMRegister) (uint32, error)
+	SetBankedRegister(mode uint8, number ARMRegister, value uint32) error
+	// The local exclusive monitor used by the ARMv6 ldrex and strex
+	// instructions. ldrex marks an address for exclusive access, and strex
+	// only succeeds if its address is still marked. Any strex, or a call to
+	// ClearExclusive, clears the monitor.
+	MarkExclusive(address uint32)
+	IsExclusive(address uint32) bool
+	ClearExclusive()
 	// This emulates a single instruction.
 	RunNextInstruction() error
+	// If architectural exceptions are enabled, undefined instructions (as
+	// well as coprocessor instructions with no matching coprocessor) and
+	// failed memory accesses cause the processor to take the undefined
+	// instruction, prefetch abort or data abort exceptions. Otherwise, they
+	// cause RunNextInstruction to return an error. This is disabled by
+	// default.
+	SetArchitecturalExceptions(enabled bool)
+	ArchitecturalExceptions() bool
+	// Breakpoints stop Run before the instruction at their address executes.
+	// Adding a breakpoint at an address which already has one replaces its
+	// condition.
+	AddBreakpoint(address uint32, condition BreakpointCondition) error
+	RemoveBreakpoint(address uint32) error
+	GetBreakpoints() []Breakpoint
+	// Watchpoints stop Run after an instruction accesses the memory they
+	// watch. Accesses made outside of emulating an instruction are ignored.
+	AddWatchpoint(w Watchpoint) error
+	RemoveWatchpoint(w Watchpoint) error
+	GetWatchpoints() []Watchpoint
+	// Emulates instructions until a breakpoint or watchpoint is hit, an error
+	// occurs, or maxInstructions have been run. If maxInstructions is 0, there
+	// is no limit. If the previous call stopped at a breakpoint, this will
+	// resume past it.
+	Run(maxInstructions uint64) StopReason
 }
 
 type basicARMProcessor struct {
+	debugEngine
 	memory                        ARMMemory
 	coprocessors                  []ARMCoprocessor
+	swiHandlers                   []SoftwareInterruptHandler
+	symbols                       SymbolResolver
 	cache                         *instructionCache
+	architecturalExceptions       bool
+	highVectors                   bool
+	architecture                  ARMArchitecture
+	swappedMemory                 ARMMemory
+	exclusiveAddress              uint32
+	exclusive                     bool
+	irqLine                       bool
+	fiqLine                       bool
 	currentRegisters              [16]uint32
 	currentStatusRegister         uint32
 	fiqRegisters                  [7]uint32
@@ -162,6 +261,38 @@ func (p *basicARMProcessor) SetOverflow(overflow bool) {
 	}
 }
 
+func (p *basicARMProcessor) StickyOverflow() bool {
+	return (p.currentStatusRegister & 0x08000000) != 0
+}
+
+func (p *basicARMProcessor) SetStickyOverflow(overflow bool) {
+	if overflow {
+		p.currentStatusRegister |= 0x08000000
+	} else {
+		p.currentStatusRegister &= 0xf7ffffff
+	}
+}
+
+func (p *basicARMProcessor) GEFlags() uint8 {
+	return uint8((p.currentStatusRegister >> 16) & 0xf)
+}
+
+func (p *basicARMProcessor) SetGEFlags(flags uint8) {
+	p.currentStatusRegister &= 0xfff0ffff
+	p.currentStatusRegister |= uint32(flags&0xf) << 16
+}
+
+func (p *basicARMProcessor) ITState() uint8 {
+	status := p.currentStatusRegister
+	return uint8(((status >> 8) & 0xfc) | ((status >> 25) & 3))
+}
+
+func (p *basicARMProcessor) SetITState(state uint8) {
+	p.currentStatusRegister &= 0xf9ff03ff
+	p.currentStatusRegister |= (uint32(state&0xfc) << 8) |
+		(uint32(state&3) << 25)
+}
+
 func (p *basicARMProcessor) THUMBMode() bool {
 	return (p.currentStatusRegister & 0x00000020) != 0
 }
@@ -275,12 +406,24 @@ func (p *basicARMProcessor) SetUserRegister(number ARMRegister,
 	return nil
 }
 
+// In ARMv6, setting the E bit in the CPSR reverses the byte order of data
+// accesses, but not instruction fetches, so this returns memory with the byte
+// order reversed if it's set.
 func (p *basicARMProcessor) GetMemoryInterface() ARMMemory {
+	if (p.architecture >= ARMv6) &&
+		((p.currentStatusRegister & 0x200) != 0) {
+		return p.swappedMemory
+	}
 	return p.memory
 }
 
 func (p *basicARMProcessor) SetMemoryInterface(m ARMMemory) {
+	if p.memory != nil {
+		p.memory.SetAccessHook(nil)
+	}
 	p.memory = m
+	p.swappedMemory = &byteSwappingMemory{m}
+	m.SetAccessHook(p.checkMemoryAccess)
 }
 
 func (p *basicARMProcessor) GetCPSR() (uint32, error) {
@@ -318,7 +461,8 @@ func (p *basicARMProcessor) SetCPSR(value uint32) error {
 		}
 	}
 	if oldMode == userMode {
-		value = (value & 0xf0000000) | (current & 0x0fffffff)
+		mask := p.architecture.userMask()
+		value = (value & mask) | (current & ^mask)
 	}
 	p.currentStatusRegister = value
 	return nil
@@ -355,58 +499,181 @@ func (p *basicARMProcessor) GetCoprocessors() []ARMCoprocessor {
 	return p.coprocessors
 }
 
+func (p *basicARMProcessor) AddSoftwareInterruptHandler(
+	h SoftwareInterruptHandler) error {
+	p.swiHandlers = append(p.swiHandlers, h)
+	return nil
+}
+
+func (p *basicARMProcessor) GetSoftwareInterruptHandlers() (
+	[]SoftwareInterruptHandler) {
+	return p.swiHandlers
+}
+
 // Since ARM programs expect to return from IRQs and FIQs to lr - 4, we need
 // to account for this here by adding 4 to the return address, because we
-// deliver IRQs before emulating an instruction here. This checks the IRQ
-// disable bit in the CPSR first.
-func (p *basicARMProcessor) SendIRQ() error {
-	status, e := p.GetCPSR()
-	if e != nil {
-		return fmt.Errorf("Couldn't send IRQ: %s", e)
+// deliver interrupts before emulating an instruction here. This is the same
+// in ARM and THUMB state. The disable bit in the CPSR is checked first.
+func (p *basicARMProcessor) takeInterrupt(fiq bool) error {
+	if fiq && p.FIQDisabled() {
+		return nil
 	}
-	// Check the IRQ disable bit
-	if (status & (1 << 7)) != 0 {
+	if !fiq && p.IRQDisabled() {
 		return nil
 	}
 	returnAddress, e := p.GetRegister(15)
 	if e != nil {
 		return e
 	}
-	returnAddress += 4
-	e = p.SetMode(irqMode)
-	if e != nil {
-		return e
+	if fiq {
+		return enterException(p, fiqMode, fiqVector, returnAddress+4, true)
 	}
-	e = p.SetRegister(14, returnAddress)
+	return enterException(p, irqMode, irqVector, returnAddress+4, false)
+}
+
+func (p *basicARMProcessor) SendIRQ() error {
+	e := p.takeInterrupt(false)
 	if e != nil {
-		return e
+		return fmt.Errorf("Couldn't send IRQ: %s", e)
 	}
-	e = p.SetRegister(15, 0x18)
-	return e
+	return nil
 }
 
 func (p *basicARMProcessor) SendFIQ() error {
-	status, e := p.GetCPSR()
+	e := p.takeInterrupt(true)
 	if e != nil {
 		return fmt.Errorf("Couldn't send FIQ: %s", e)
 	}
-	if (status & (1 << 6)) != 0 {
-		return nil
+	return nil
+}
+
+func (p *basicARMProcessor) SetIRQLine(asserted bool) {
+	p.irqLine = asserted
+}
+
+func (p *basicARMProcessor) SetFIQLine(asserted bool) {
+	p.fiqLine = asserted
+}
+
+func (p *basicARMProcessor) IRQLine() bool {
+	return p.irqLine
+}
+
+func (p *basicARMProcessor) FIQLine() bool {
+	return p.fiqLine
+}
+
+// Checks the interrupt lines, and takes an interrupt if one is asserted and
+// not disabled. FIQs have priority over IRQs. Returns true if an interrupt
+// was taken.
+func (p *basicARMProcessor) checkInterruptLines() (bool, error) {
+	if p.fiqLine && !p.FIQDisabled() {
+		return true, p.takeInterrupt(true)
 	}
-	returnAddress, e := p.GetRegister(15)
-	if e != nil {
-		return e
+	if p.irqLine && !p.IRQDisabled() {
+		return true, p.takeInterrupt(false)
 	}
-	returnAddress += 4
-	e = p.SetMode(fiqMode)
-	if e != nil {
-		return e
+	return false, nil
+}
+
+func (p *basicARMProcessor) Reset() error {
+	p.currentStatusRegister = uint32(supervisorMode) | 0xc0
+	p.ClearExclusive()
+	return p.SetRegister(15, vectorAddress(p, resetVector))
+}
+
+func (p *basicARMProcessor) SetHighVectors(enabled bool) {
+	p.highVectors = enabled
+}
+
+func (p *basicARMProcessor) HighVectors() bool {
+	return p.highVectors
+}
+
+func (p *basicARMProcessor) SetArchitecture(
+	architecture ARMArchitecture) error {
+	if !architecture.isValid() {
+		return fmt.Errorf("Unsupported architecture: %s", architecture)
 	}
-	e = p.SetRegister(14, returnAddress)
-	if e != nil {
+	if architecture == ARMv7M {
+		return fmt.Errorf("ARMv7-M requires a processor created by " +
+			"NewARMv7MProcessor")
+	}
+	p.architecture = architecture
+	// Cached instructions may have been decoded differently.
+	p.cache = newInstructionCache()
+	return nil
+}
+
+func (p *basicARMProcessor) Architecture() ARMArchitecture {
+	return p.architecture
+}
+
+func (p *basicARMProcessor) GetBankedRegister(mode uint8,
+	number ARMRegister) (uint32, error) {
+	if !isValidMode(mode) {
+		return 0, fmt.Errorf("Invalid mode: 0x%02x", mode)
+	}
+	// Temporarily switching the mode bits avoids touching the SPSR, unlike
+	// SetMode.
+	status := p.currentStatusRegister
+	p.currentStatusRegister = (status & 0xffffffe0) | uint32(mode)
+	value, e := p.GetRegister(number)
+	p.currentStatusRegister = status
+	return value, e
+}
+
+func (p *basicARMProcessor) SetBankedRegister(mode uint8, number ARMRegister,
+	value uint32) error {
+	if !isValidMode(mode) {
+		return fmt.Errorf("Invalid mode: 0x%02x", mode)
+	}
+	status := p.currentStatusRegister
+	p.currentStatusRegister = (status & 0xffffffe0) | uint32(mode)
+	e := p.SetRegister(number, value)
+	p.currentStatusRegister = status
+	return e
+}
+
+func (p *basicARMProcessor) MarkExclusive(address uint32) {
+	p.exclusiveAddress = address
+	p.exclusive = true
+}
+
+func (p *basicARMProcessor) IsExclusive(address uint32) bool {
+	return p.exclusive && (p.exclusiveAddress == address)
+}
+
+func (p *basicARMProcessor) ClearExclusive() {
+	p.exclusive = false
+}
+
+func (p *basicARMProcessor) SetArchitecturalExceptions(enabled bool) {
+	p.architecturalExceptions = enabled
+}
+
+func (p *basicARMProcessor) ArchitecturalExceptions() bool {
+	return p.architecturalExceptions
+}
+
+// If architectural exceptions are enabled, this converts errors from
+// emulating the instruction at the given address into an exception taken by
+// cpu, which is usually p itself. The size is the size of the instruction, 2
+// or 4 bytes.
+func (p *basicARMProcessor) handleEmulationError(cpu ARMProcessor, address,
+	size uint32, e error) error {
+	if (e == nil) || !p.architecturalExceptions {
 		return e
 	}
-	e = p.SetRegister(15, 0x1c)
+	var accessError *MemoryAccessError
+	if errors.As(e, &accessError) {
+		return enterException(cpu, abortMode, dataAbortVector, address+8,
+			false)
+	}
+	if errors.Is(e, errUndefinedInstruction) {
+		return enterException(cpu, undefinedMode, undefinedVector,
+			address+size, false)
+	}
 	return e
 }
 
@@ -418,7 +685,8 @@ func (p *basicARMProcessor) getARMInstruction(raw uint32) (ARMInstruction,
 	if instruction != nil {
 		return instruction, nil
 	}
-	instruction, e = ParseInstruction(raw)
+	instruction, e = ParseInstructionForArchitecture(raw,
+		p.architecture)
 	if e != nil {
 		return nil, e
 	}
@@ -434,7 +702,8 @@ func (p *basicARMProcessor) getTHUMBInstruction(raw uint16) (THUMBInstruction,
 	if instruction != nil {
 		return instruction, nil
 	}
-	instruction, e = ParseTHUMBInstruction(raw)
+	instruction, e = ParseTHUMBInstructionForArchitecture(raw,
+		p.architecture)
 	if e != nil {
 		return nil, e
 	}
@@ -442,23 +711,49 @@ func (p *basicARMProcessor) getTHUMBInstruction(raw uint16) (THUMBInstruction,
 	return instruction, nil
 }
 
+// Parses a 32-bit Thumb-2 instruction, checking the cache first.
+func (p *basicARMProcessor) getTHUMB2Instruction(raw uint32) (
+	THUMB2Instruction, error) {
+	instruction := p.cache.getTHUMB2Instruction(raw)
+	if instruction != nil {
+		return instruction, nil
+	}
+	instruction, e := ParseTHUMB2Instruction(raw)
+	if e != nil {
+		return nil, e
+	}
+	p.cache.storeTHUMB2Instruction(instruction)
+	return instruction, nil
+}
+
+func (p *basicARMProcessor) SetSymbolResolver(symbols SymbolResolver) {
+	p.symbols = symbols
+}
+
 func (p *basicARMProcessor) PendingInstructionString() string {
 	pc, e := p.GetRegister(15)
 	if e != nil {
 		return fmt.Sprintf("Error fetching address: %s", e)
 	}
+	// Reading the instruction mustn't record a fault if it can't be fetched.
+	m := debugMemory(p.memory)
+	d := Disassembler{Symbols: p.symbols, Memory: m}
 	if p.THUMBMode() {
-		raw, e := p.GetMemoryInterface().ReadMemoryHalfword(pc)
+		raw, e := fetchInstructionHalfword(m, pc)
 		if e != nil {
 			return fmt.Sprintf("%08x: Error: %s", pc, e)
 		}
+		if (p.architecture >= ARMv7) && IsTHUMB2Prefix(raw) {
+			return p.pendingTHUMB2InstructionString(&d, m, pc, raw)
+		}
 		instruction, e := p.getTHUMBInstruction(raw)
 		if e != nil {
 			return fmt.Sprintf("%08x: %04x Error: %s", pc, raw, e)
 		}
-		return fmt.Sprintf("%08x: %04x %s", pc, raw, instruction)
+		return fmt.Sprintf("%08x: %04x %s", pc, raw,
+			d.THUMBString(instruction, pc))
 	}
-	raw, e := p.GetMemoryInterface().ReadMemoryWord(pc)
+	raw, e := fetchInstructionWord(m, pc)
 	if e != nil {
 		return fmt.Sprintf("%08x: Error: %s", pc, e)
 	}
@@ -466,56 +761,164 @@ func (p *basicARMProcessor) PendingInstructionString() string {
 	if e != nil {
 		return fmt.Sprintf("%08x: %08x Error: %s", pc, raw, e)
 	}
-	return fmt.Sprintf("%08x: %08x %s", pc, raw, instruction)
+	return fmt.Sprintf("%08x: %08x %s", pc, raw, d.ARMString(instruction, pc))
 }
 
-// This function will fetch an instruction, *increment pc*, then emulate the
-// instruction. Therefore, pc will contain the address of the instruction + 4
-// during emulation of any instruction using this implementation.
-func (p *basicARMProcessor) RunNextInstruction() error {
-	pc, e := p.GetRegister(15)
+func (p *basicARMProcessor) pendingTHUMB2InstructionString(d *Disassembler,
+	m ARMMemory, pc uint32, high uint16) string {
+	low, e := fetchInstructionHalfword(m, pc+2)
 	if e != nil {
-		return fmt.Errorf("Failed getting PC: %s", e)
+		return fmt.Sprintf("%08x: %04x Error: %s", pc, high, e)
 	}
-	if p.THUMBMode() {
-		raw, e := p.GetMemoryInterface().ReadMemoryHalfword(pc)
+	raw := (uint32(high) << 16) | uint32(low)
+	instruction, e := p.getTHUMB2Instruction(raw)
+	if e != nil {
+		return fmt.Sprintf("%08x: %04x %04x Error: %s", pc, high, low, e)
+	}
+	return fmt.Sprintf("%08x: %04x %04x %s", pc, high, low,
+		d.THUMB2String(instruction, pc))
+}
+
+// Fetches and emulates a single THUMB instruction, which may be a 32-bit
+// Thumb-2 instruction in ARMv7. This takes care of skipping instructions in IT
+// blocks whose conditions aren't met. The instruction is emulated using cpu,
+// which differs from p if p is embedded in another processor type.
+func (p *basicARMProcessor) runTHUMBInstruction(cpu ARMProcessor,
+	pc uint32) error {
+	raw, e := fetchInstructionHalfword(p.memory, pc)
+	if e != nil {
+		if p.architecturalExceptions {
+			return enterException(cpu, abortMode, prefetchAbortVector, pc+4,
+				false)
+		}
+		return fmt.Errorf("Failed fetching instruction: %s", e)
+	}
+	var instruction THUMBInstruction
+	var wideInstruction THUMB2Instruction
+	size := uint32(2)
+	if (p.architecture >= ARMv7) && IsTHUMB2Prefix(raw) {
+		low, e := fetchInstructionHalfword(p.memory, pc+2)
 		if e != nil {
+			if p.architecturalExceptions {
+				return enterException(cpu, abortMode, prefetchAbortVector,
+					pc+4, false)
+			}
 			return fmt.Errorf("Failed fetching instruction: %s", e)
 		}
-		e = p.SetRegister(15, pc+2)
+		size = 4
+		wideRaw := (uint32(raw) << 16) | uint32(low)
+		wideInstruction, e = p.getTHUMB2Instruction(wideRaw)
 		if e != nil {
-			return fmt.Errorf("Failed incrementing PC: %s", e)
+			e = fmt.Errorf("Failed decoding 0x%08x: %s", wideRaw, e)
 		}
-		instruction, e := p.getTHUMBInstruction(raw)
+	} else {
+		instruction, e = p.getTHUMBInstruction(raw)
 		if e != nil {
-			return fmt.Errorf("Failed decoding 0x%04x: %s", raw, e)
+			e = fmt.Errorf("Failed decoding 0x%04x: %s", raw, e)
 		}
-		return instruction.Emulate(p)
 	}
-	raw, e := p.GetMemoryInterface().ReadMemoryWord(pc)
+	decodeError := e
+	e = p.SetRegister(15, pc+size)
 	if e != nil {
+		return fmt.Errorf("Failed incrementing PC: %s", e)
+	}
+	itState := uint8(0)
+	if p.architecture >= ARMv7 {
+		itState = p.ITState()
+	}
+	if (itState & 0xf) != 0 {
+		p.SetITState(advanceITState(itState))
+		if !ARMCondition(itState >> 4).IsMet(p) {
+			return nil
+		}
+	}
+	if decodeError != nil {
+		if p.architecturalExceptions {
+			return enterException(cpu, undefinedMode, undefinedVector, pc+size,
+				false)
+		}
+		return decodeError
+	}
+	if wideInstruction != nil {
+		p.watching = true
+		e = wideInstruction.Emulate(cpu)
+		p.watching = false
+		return p.handleEmulationError(cpu, pc, size, e)
+	}
+	flags := p.currentStatusRegister & 0xf0000000
+	p.watching = true
+	e = instruction.Emulate(cpu)
+	p.watching = false
+	if ((itState & 0xf) != 0) && !isTHUMBCompare(instruction) {
+		p.currentStatusRegister &= 0x0fffffff
+		p.currentStatusRegister |= flags
+	}
+	return p.handleEmulationError(cpu, pc, size, e)
+}
+
+// This function will take a pending interrupt if there is one. Otherwise, it
+// will fetch an instruction, *increment pc*, then emulate the instruction.
+// Therefore, pc will contain the address of the instruction + 4 during
+// emulation of any instruction using this implementation.
+func (p *basicARMProcessor) RunNextInstruction() error {
+	interrupted, e := p.checkInterruptLines()
+	if interrupted || (e != nil) {
+		return e
+	}
+	pc, e := p.GetRegister(15)
+	if e != nil {
+		return fmt.Errorf("Failed getting PC: %s", e)
+	}
+	if p.THUMBMode() {
+		return p.runTHUMBInstruction(p, pc)
+	}
+	raw, e := fetchInstructionWord(p.memory, pc)
+	if e != nil {
+		if p.architecturalExceptions {
+			return enterException(p, abortMode, prefetchAbortVector, pc+4,
+				false)
+		}
 		return fmt.Errorf("Failed fetching instruction: %s", e)
 	}
 	instruction, e := p.getARMInstruction(raw)
 	if e != nil {
-		return fmt.Errorf("Failed decoding 0x%08x: %s", raw, e)
+		if !p.architecturalExceptions {
+			return fmt.Errorf("Failed decoding 0x%08x: %s", raw, e)
+		}
+		// Undefined instructions are only taken if their condition passes.
+		// Condition 15 marks the unconditional instructions, so these are
+		// always taken.
+		condition := getCondition(raw)
+		if (condition < 0xe) && !condition.IsMet(p) {
+			return p.SetRegister(15, pc+4)
+		}
+		return enterException(p, undefinedMode, undefinedVector, pc+4, false)
 	}
 	e = p.SetRegister(15, pc+4)
 	if e != nil {
 		return fmt.Errorf("Failed incrementing PC: %s", e)
 	}
+	p.watching = true
 	e = instruction.Emulate(p)
+	p.watching = false
+	e = p.handleEmulationError(p, pc, 4, e)
 	if e != nil {
-		return fmt.Errorf("Failed emulating instruction: %s", e)
+		return fmt.Errorf("Failed emulating instruction: %w", e)
 	}
 	return nil
 }
 
+func (p *basicARMProcessor) Run(maxInstructions uint64) StopReason {
+	return p.run(p, maxInstructions)
+}
+
 func NewARMProcessor() ARMProcessor {
 	var toReturn basicARMProcessor
-	toReturn.memory = NewARMMemory()
+	toReturn.SetMemoryInterface(NewARMMemory())
 	toReturn.currentStatusRegister = uint32(userMode)
 	toReturn.coprocessors = make([]ARMCoprocessor, 0, 1)
+	toReturn.swiHandlers = make([]SoftwareInterruptHandler, 0, 1)
 	toReturn.cache = newInstructionCache()
+	toReturn.architecture = defaultArchitecture
 	return &toReturn
 }
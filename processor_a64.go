@@ -0,0 +1,278 @@
+package arm_emulate
+
+// This file implements a processor which runs A64 code at EL0, as used by
+// user-mode programs on 64-bit ARMv8 systems.
+
+import (
+	"fmt"
+)
+
+// Bits in the FPCR which may be written. Only the rounding mode and the
+// flush-to-zero and default NaN modes have an effect.
+const a64FPCRWritableBits uint32 = 0x07c09f00
+
+// The cumulative exception bits in the FPSR, which have the same layout as the
+// bits in the FPSCR.
+const a64FPSRExceptionBits uint32 = 0x0000009f
+
+// The log2 of the number of words zeroed by dc zva, as reported by DCZID_EL0.
+const a64ZeroBlockSize = 4
+
+// This interface may be implemented to handle supervisor calls (e.g. system
+// calls) made by A64 code.
+type A64SupervisorCallHandler interface {
+	// This is called when an svc instruction is executed. The PC will already
+	// point to the following instruction. If none of the processor's handlers
+	// return true, RunNextInstruction returns an error.
+	HandleSupervisorCall(p A64Processor, immediate uint16) (bool, error)
+}
+
+// The interface to a processor running A64 code in user mode (EL0).
+type A64Processor interface {
+	// Accesses X0-X30. Register 31 reads as zero, and writes to it are
+	// ignored; the stack pointer is accessed using GetSP and SetSP.
+	GetRegister(register A64Register) uint64
+	SetRegister(register A64Register, value uint64)
+	GetSP() uint64
+	SetSP(value uint64)
+	GetPC() uint64
+	SetPC(value uint64)
+	// The condition flags, in bits 28-31 as they appear in the NZCV register.
+	GetNZCV() uint32
+	SetNZCV(value uint32)
+	Negative() bool
+	Zero() bool
+	Carry() bool
+	Overflow() bool
+	// Accesses the 128-bit SIMD and floating-point registers V0-V31, as their
+	// lower and upper 64 bits.
+	GetVectorRegister(register A64Register) (uint64, uint64)
+	SetVectorRegister(register A64Register, low, high uint64)
+	// The floating-point control and status registers. Exception traps
+	// aren't supported, so exceptions only set the FPSR's cumulative flags.
+	GetFPCR() uint32
+	SetFPCR(value uint32)
+	GetFPSR() uint32
+	SetFPSR(value uint32)
+	// The TPIDR_EL0 register, which usually holds the thread pointer.
+	GetTPIDR() uint64
+	SetTPIDR(value uint64)
+	GetMemoryInterface() A64Memory
+	SetMemoryInterface(m A64Memory)
+	// Handlers added using this function are called, in the order they were
+	// added, when an svc instruction is executed. They are only consulted
+	// until one of them returns true.
+	AddSupervisorCallHandler(handler A64SupervisorCallHandler) error
+	GetSupervisorCallHandlers() []A64SupervisorCallHandler
+	// The local exclusive monitor used by the exclusive loads and stores. A
+	// load marks an address for exclusive access, and an exclusive store only
+	// succeeds if its address is still marked. Any exclusive store, clrex, or
+	// a call to ClearExclusive clears the monitor.
+	MarkExclusive(address uint64)
+	IsExclusive(address uint64) bool
+	ClearExclusive()
+	// This prints the disassembly of instruction that will be executed on the
+	// next call to RunNextInstruction()
+	PendingInstructionString() string
+	// This emulates a single instruction. Undefined instructions and failed
+	// memory accesses cause this to return an error.
+	RunNextInstruction() error
+}
+
+type basicA64Processor struct {
+	memory           A64Memory
+	svcHandlers      []A64SupervisorCallHandler
+	cache            *instructionCache
+	registers        [31]uint64
+	sp               uint64
+	pc               uint64
+	nzcv             uint32
+	vectorRegisters  [32][2]uint64
+	fpcr             uint32
+	fpsr             uint32
+	tpidr            uint64
+	exclusiveAddress uint64
+	exclusive        bool
+}
+
+func (p *basicA64Processor) GetRegister(register A64Register) uint64 {
+	if register >= 31 {
+		return 0
+	}
+	return p.registers[register]
+}
+
+func (p *basicA64Processor) SetRegister(register A64Register, value uint64) {
+	if register >= 31 {
+		return
+	}
+	p.registers[register] = value
+}
+
+func (p *basicA64Processor) GetSP() uint64 {
+	return p.sp
+}
+
+func (p *basicA64Processor) SetSP(value uint64) {
+	p.sp = value
+}
+
+func (p *basicA64Processor) GetPC() uint64 {
+	return p.pc
+}
+
+func (p *basicA64Processor) SetPC(value uint64) {
+	p.pc = value
+}
+
+func (p *basicA64Processor) GetNZCV() uint32 {
+	return p.nzcv
+}
+
+func (p *basicA64Processor) SetNZCV(value uint32) {
+	p.nzcv = value & 0xf0000000
+}
+
+func (p *basicA64Processor) Negative() bool {
+	return (p.nzcv & 0x80000000) != 0
+}
+
+func (p *basicA64Processor) Zero() bool {
+	return (p.nzcv & 0x40000000) != 0
+}
+
+func (p *basicA64Processor) Carry() bool {
+	return (p.nzcv & 0x20000000) != 0
+}
+
+func (p *basicA64Processor) Overflow() bool {
+	return (p.nzcv & 0x10000000) != 0
+}
+
+func (p *basicA64Processor) GetVectorRegister(register A64Register) (uint64,
+	uint64) {
+	v := p.vectorRegisters[register&31]
+	return v[0], v[1]
+}
+
+func (p *basicA64Processor) SetVectorRegister(register A64Register, low,
+	high uint64) {
+	p.vectorRegisters[register&31] = [2]uint64{low, high}
+}
+
+func (p *basicA64Processor) GetFPCR() uint32 {
+	return p.fpcr
+}
+
+func (p *basicA64Processor) SetFPCR(value uint32) {
+	p.fpcr = value & a64FPCRWritableBits
+}
+
+func (p *basicA64Processor) GetFPSR() uint32 {
+	return p.fpsr
+}
+
+func (p *basicA64Processor) SetFPSR(value uint32) {
+	p.fpsr = value & (a64FPSRExceptionBits | 0xf8000000)
+}
+
+func (p *basicA64Processor) GetTPIDR() uint64 {
+	return p.tpidr
+}
+
+func (p *basicA64Processor) SetTPIDR(value uint64) {
+	p.tpidr = value
+}
+
+func (p *basicA64Processor) GetMemoryInterface() A64Memory {
+	return p.memory
+}
+
+func (p *basicA64Processor) SetMemoryInterface(m A64Memory) {
+	p.memory = m
+}
+
+func (p *basicA64Processor) AddSupervisorCallHandler(
+	h A64SupervisorCallHandler) error {
+	p.svcHandlers = append(p.svcHandlers, h)
+	return nil
+}
+
+func (p *basicA64Processor) GetSupervisorCallHandlers() (
+	[]A64SupervisorCallHandler) {
+	return p.svcHandlers
+}
+
+func (p *basicA64Processor) MarkExclusive(address uint64) {
+	p.exclusiveAddress = address
+	p.exclusive = true
+}
+
+func (p *basicA64Processor) IsExclusive(address uint64) bool {
+	return p.exclusive && (p.exclusiveAddress == address)
+}
+
+func (p *basicA64Processor) ClearExclusive() {
+	p.exclusive = false
+}
+
+// Parses an A64 instruction, checking the cache first.
+func (p *basicA64Processor) getInstruction(raw uint32) (A64Instruction,
+	error) {
+	instruction := p.cache.getA64Instruction(raw)
+	if instruction != nil {
+		return instruction, nil
+	}
+	instruction, e := ParseA64Instruction(raw)
+	if e != nil {
+		return nil, e
+	}
+	p.cache.storeA64Instruction(instruction)
+	return instruction, nil
+}
+
+func (p *basicA64Processor) PendingInstructionString() string {
+	raw, e := p.memory.ReadMemoryWord(p.pc)
+	if e != nil {
+		return fmt.Sprintf("%016x: Error: %s", p.pc, e)
+	}
+	instruction, e := p.getInstruction(raw)
+	if e != nil {
+		return fmt.Sprintf("%016x: %08x Error: %s", p.pc, raw, e)
+	}
+	return fmt.Sprintf("%016x: %08x %s", p.pc, raw, instruction)
+}
+
+// Fetches an instruction, *increments pc*, then emulates the instruction. As
+// with the 32-bit processors, the PC will contain the address of the
+// instruction + 4 during emulation.
+func (p *basicA64Processor) RunNextInstruction() error {
+	pc := p.pc
+	if (pc & 3) != 0 {
+		return fmt.Errorf("PC alignment fault at 0x%016x", pc)
+	}
+	raw, e := p.memory.ReadMemoryWord(pc)
+	if e != nil {
+		return fmt.Errorf("Failed fetching instruction: %w", e)
+	}
+	instruction, e := p.getInstruction(raw)
+	if e != nil {
+		return fmt.Errorf("Failed decoding 0x%08x: %w", raw, e)
+	}
+	p.pc = pc + 4
+	e = instruction.Emulate(p)
+	if e != nil {
+		return fmt.Errorf("Failed emulating instruction at 0x%016x: %w", pc,
+			e)
+	}
+	return nil
+}
+
+// Returns a new A64 processor with empty memory and all registers set to 0.
+func NewA64Processor() A64Processor {
+	var toReturn basicA64Processor
+	toReturn.SetMemoryInterface(NewA64Memory())
+	toReturn.svcHandlers = make([]A64SupervisorCallHandler, 0, 1)
+	toReturn.cache = newInstructionCache()
+	return &toReturn
+}
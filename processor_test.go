@@ -103,3 +103,70 @@ func TestFIQDelivery(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestInterruptLines(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	memory := p.GetMemoryInterface()
+	// mov r0, r0 (THUMB)
+	memory.WriteMemoryHalfword(4096, 0x1c00)
+	p.SetTHUMBMode(true)
+	p.SetRegister(15, 4096)
+	p.SetIRQLine(true)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Got an error taking an IRQ: %s\n", e)
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(15)
+	if (value != 0x18) || (p.GetMode() != irqMode) {
+		t.Logf("IRQ wasn't taken: pc = 0x%08x, mode = 0x%02x\n", value,
+			p.GetMode())
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(14)
+	if value != 4100 {
+		t.Logf("IRQ has wrong return address: %d instead of 4100.\n", value)
+		t.Fail()
+	}
+	if !p.IRQDisabled() || p.FIQDisabled() || p.THUMBMode() {
+		t.Logf("IRQ entry set the wrong CPSR bits.\n")
+		t.Fail()
+	}
+	spsr, _ := p.GetSPSR()
+	if spsr != 0x30 {
+		t.Logf("Expected SPSR 0x30, got 0x%08x\n", spsr)
+		t.Fail()
+	}
+	// The IRQ line is still asserted, but masked now. FIQs take priority.
+	p.SetFIQLine(true)
+	e = p.RunNextInstruction()
+	if e != nil {
+		t.Logf("Got an error taking an FIQ: %s\n", e)
+		t.FailNow()
+	}
+	value, _ = p.GetRegister(15)
+	if (value != 0x1c) || (p.GetMode() != fiqMode) {
+		t.Logf("FIQ wasn't taken: pc = 0x%08x, mode = 0x%02x\n", value,
+			p.GetMode())
+		t.FailNow()
+	}
+	if !p.IRQDisabled() || !p.FIQDisabled() {
+		t.Logf("FIQ entry didn't disable interrupts.\n")
+		t.Fail()
+	}
+	// Returning to user mode with the lines cleared runs the instruction.
+	p.SetIRQLine(false)
+	p.SetFIQLine(false)
+	p.SetCPSR(0x30)
+	p.SetRegister(15, 4096)
+	e = p.RunNextInstruction()
+	value, _ = p.GetRegister(15)
+	if (e != nil) || (value != 4098) {
+		t.Logf("Instruction wasn't run after clearing the lines: pc = "+
+			"0x%08x (%v)\n", value, e)
+		t.Fail()
+	}
+}
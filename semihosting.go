@@ -0,0 +1,350 @@
+package arm_emulate
+
+// This file implements the ARM semihosting interface, which lets bare-metal
+// programs (such as those linked using newlib's rdimon specs) use the host for
+// console and file I/O.
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// The comment field of the swi instructions used for semihosting requests.
+const (
+	semihostingARMComment   uint32 = 0x123456
+	semihostingTHUMBComment uint32 = 0xab
+)
+
+// Semihosting operation numbers, passed in r0.
+const (
+	semihostingSysOpen         uint32 = 0x01
+	semihostingSysClose        uint32 = 0x02
+	semihostingSysWriteC       uint32 = 0x03
+	semihostingSysWrite0       uint32 = 0x04
+	semihostingSysWrite        uint32 = 0x05
+	semihostingSysRead         uint32 = 0x06
+	semihostingSysClock        uint32 = 0x10
+	semihostingSysTime         uint32 = 0x11
+	semihostingSysGetCmdline   uint32 = 0x15
+	semihostingSysExit         uint32 = 0x18
+	semihostingSysExitExtended uint32 = 0x20
+)
+
+// The SYS_EXIT reason code indicating that the program exited normally.
+const semihostingApplicationExit uint32 = 0x20026
+
+// The special file name used to open the console.
+const semihostingConsoleName = ":tt"
+
+// Limits on the sizes of file names and transfers requested by the program, so
+// a bad length can't make the host allocate an arbitrary amount of memory.
+const (
+	semihostingPathMax     uint32 = 4096
+	semihostingMaxTransfer uint32 = 0x100000
+)
+
+// A file opened using SYS_OPEN.
+type semihostingFile struct {
+	reader io.Reader
+	writer io.Writer
+	// This is nil for handles referring to the console.
+	file *os.File
+}
+
+// Implements the SoftwareInterruptHandler interface to carry out semihosting
+// requests made using swi 0x123456 (ARM) or swi 0xab (THUMB). Requests
+// exiting the program cause emulation to stop with a *ProcessExitError.
+type SemihostingHandler struct {
+	// The streams used by the console. These default to the host's standard
+	// streams.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// If this isn't empty, files opened by the program are resolved relative
+	// to this host directory and can't be outside of it.
+	SandboxDirectory string
+	// The string returned by SYS_GET_CMDLINE.
+	CommandLine string
+	files       map[uint32]*semihostingFile
+	nextHandle  uint32
+	startTime   time.Time
+}
+
+// Returns a new semihosting handler, which must be added to a processor using
+// AddSoftwareInterruptHandler.
+func NewSemihostingHandler(sandboxDirectory string) *SemihostingHandler {
+	var toReturn SemihostingHandler
+	toReturn.Stdin = os.Stdin
+	toReturn.Stdout = os.Stdout
+	toReturn.Stderr = os.Stderr
+	toReturn.SandboxDirectory = sandboxDirectory
+	toReturn.files = make(map[uint32]*semihostingFile)
+	toReturn.nextHandle = 1
+	toReturn.startTime = time.Now()
+	return &toReturn
+}
+
+// Reads the given number of words from a parameter block.
+func readParameterBlock(m ARMMemory, address uint32, count int) ([]uint32,
+	error) {
+	toReturn := make([]uint32, count)
+	var e error
+	for i := range toReturn {
+		toReturn[i], e = m.ReadMemoryWord(address + uint32(i)*4)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return toReturn, nil
+}
+
+func (h *SemihostingHandler) addFile(f *semihostingFile) uint32 {
+	handle := h.nextHandle
+	h.nextHandle++
+	h.files[handle] = f
+	return handle
+}
+
+func (h *SemihostingHandler) sysOpen(m ARMMemory, parameters uint32) uint32 {
+	block, e := readParameterBlock(m, parameters, 3)
+	if e != nil {
+		return 0xffffffff
+	}
+	if block[2] > semihostingPathMax {
+		return 0xffffffff
+	}
+	nameBytes, e := readMemoryBytes(m, block[0], block[2])
+	if e != nil {
+		return 0xffffffff
+	}
+	name := string(nameBytes)
+	mode := block[1]
+	if mode > 11 {
+		return 0xffffffff
+	}
+	if name == semihostingConsoleName {
+		var f semihostingFile
+		if mode < 4 {
+			f.reader = h.Stdin
+		} else if mode < 8 {
+			f.writer = h.Stdout
+		} else {
+			f.writer = h.Stderr
+		}
+		return h.addFile(&f)
+	}
+	// The mode corresponds to fopen's "r", "rb", "r+", "r+b", "w", "wb",
+	// "w+", "w+b", "a", "ab", "a+" and "a+b", in that order.
+	var flags int
+	switch mode >> 1 {
+	case 0:
+		flags = os.O_RDONLY
+	case 1:
+		flags = os.O_RDWR
+	case 2:
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case 3:
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	case 4:
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	case 5:
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	file, e := os.OpenFile(sandboxedPath(h.SandboxDirectory, name), flags,
+		0644)
+	if e != nil {
+		return 0xffffffff
+	}
+	var f semihostingFile
+	f.file = file
+	f.reader = file
+	f.writer = file
+	return h.addFile(&f)
+}
+
+func (h *SemihostingHandler) sysClose(m ARMMemory, parameters uint32) uint32 {
+	block, e := readParameterBlock(m, parameters, 1)
+	if e != nil {
+		return 0xffffffff
+	}
+	f := h.files[block[0]]
+	if f == nil {
+		return 0xffffffff
+	}
+	delete(h.files, block[0])
+	if f.file != nil {
+		e = f.file.Close()
+		if e != nil {
+			return 0xffffffff
+		}
+	}
+	return 0
+}
+
+// Returns the number of bytes which were *not* written.
+func (h *SemihostingHandler) sysWrite(m ARMMemory, parameters uint32) uint32 {
+	block, e := readParameterBlock(m, parameters, 3)
+	if e != nil {
+		return 0xffffffff
+	}
+	f := h.files[block[0]]
+	if (f == nil) || (f.writer == nil) {
+		return block[2]
+	}
+	// Copy the data in chunks, stopping at the first fault or short write.
+	address := block[1]
+	remaining := block[2]
+	for remaining > 0 {
+		length := remaining
+		if length > semihostingMaxTransfer {
+			length = semihostingMaxTransfer
+		}
+		data, e := readMemoryBytes(m, address, length)
+		if e != nil {
+			break
+		}
+		n, e := f.writer.Write(data)
+		address += uint32(n)
+		remaining -= uint32(n)
+		if (e != nil) || (uint32(n) != length) {
+			break
+		}
+	}
+	return remaining
+}
+
+// Returns the number of bytes which were *not* read, so a return value equal
+// to the requested length indicates the end of the file.
+func (h *SemihostingHandler) sysRead(m ARMMemory, parameters uint32) uint32 {
+	block, e := readParameterBlock(m, parameters, 3)
+	if e != nil {
+		return 0xffffffff
+	}
+	f := h.files[block[0]]
+	if (f == nil) || (f.reader == nil) {
+		return 0xffffffff
+	}
+	length := block[2]
+	if length > semihostingMaxTransfer {
+		length = semihostingMaxTransfer
+	}
+	// Check the buffer first, so that a bad one doesn't consume any input.
+	e = probeMemoryBytes(m, block[1], length)
+	if e != nil {
+		return 0xffffffff
+	}
+	buffer := make([]byte, length)
+	n, e := f.reader.Read(buffer)
+	if (e != nil) && (e != io.EOF) && (n == 0) {
+		return 0xffffffff
+	}
+	e = writeMemoryBytes(m, block[1], buffer[:n])
+	if e != nil {
+		return 0xffffffff
+	}
+	return block[2] - uint32(n)
+}
+
+func (h *SemihostingHandler) sysGetCmdline(m ARMMemory,
+	parameters uint32) uint32 {
+	block, e := readParameterBlock(m, parameters, 2)
+	if e != nil {
+		return 0xffffffff
+	}
+	// The buffer must have room for the null terminator.
+	if uint32(len(h.CommandLine)) >= block[1] {
+		return 0xffffffff
+	}
+	e = writeMemoryBytes(m, block[0], append([]byte(h.CommandLine), 0))
+	if e != nil {
+		return 0xffffffff
+	}
+	e = m.WriteMemoryWord(parameters+4, uint32(len(h.CommandLine)))
+	if e != nil {
+		return 0xffffffff
+	}
+	return 0
+}
+
+// Returns the ProcessExitError for a SYS_EXIT or SYS_EXIT_EXTENDED request.
+func (h *SemihostingHandler) exitError(m ARMMemory, operation,
+	parameter uint32) error {
+	var toReturn ProcessExitError
+	reason := parameter
+	subcode := uint32(0)
+	if operation == semihostingSysExitExtended {
+		block, e := readParameterBlock(m, parameter, 2)
+		if e != nil {
+			return e
+		}
+		reason = block[0]
+		subcode = block[1]
+	}
+	if reason == semihostingApplicationExit {
+		toReturn.Status = int(subcode)
+	} else {
+		toReturn.Status = 1
+	}
+	return &toReturn
+}
+
+func (h *SemihostingHandler) HandleSoftwareInterrupt(p ARMProcessor,
+	comment uint32) (bool, error) {
+	if p.THUMBMode() {
+		if comment != semihostingTHUMBComment {
+			return false, nil
+		}
+	} else if comment != semihostingARMComment {
+		return false, nil
+	}
+	m := p.GetMemoryInterface()
+	operation, _ := p.GetRegister(0)
+	parameter, _ := p.GetRegister(1)
+	result := uint32(0xffffffff)
+	switch operation {
+	case semihostingSysOpen:
+		result = h.sysOpen(m, parameter)
+	case semihostingSysClose:
+		result = h.sysClose(m, parameter)
+	case semihostingSysWriteC:
+		c, e := m.ReadMemoryByte(parameter)
+		if e != nil {
+			return true, e
+		}
+		h.Stdout.Write([]byte{c})
+		// SYS_WRITEC and SYS_WRITE0 leave r0 unchanged.
+		return true, nil
+	case semihostingSysWrite0:
+		s, e := readMemoryString(m, parameter, 0x100000)
+		if e != nil {
+			return true, e
+		}
+		io.WriteString(h.Stdout, s)
+		return true, nil
+	case semihostingSysWrite:
+		result = h.sysWrite(m, parameter)
+	case semihostingSysRead:
+		result = h.sysRead(m, parameter)
+	case semihostingSysClock:
+		result = uint32(time.Since(h.startTime) / (10 * time.Millisecond))
+	case semihostingSysTime:
+		result = uint32(time.Now().Unix())
+	case semihostingSysGetCmdline:
+		result = h.sysGetCmdline(m, parameter)
+	case semihostingSysExit, semihostingSysExitExtended:
+		return true, h.exitError(m, operation, parameter)
+	}
+	return true, p.SetRegister(0, result)
+}
+
+// Closes any host files left open by the emulated program.
+func (h *SemihostingHandler) Close() error {
+	for handle, f := range h.files {
+		if f.file != nil {
+			f.file.Close()
+		}
+		delete(h.files, handle)
+	}
+	return nil
+}
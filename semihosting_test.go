@@ -0,0 +1,215 @@
+package arm_emulate
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSemihostingConsole(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	h := NewSemihostingHandler("")
+	var output bytes.Buffer
+	h.Stdout = &output
+	h.CommandLine = "test -v"
+	p.AddSoftwareInterruptHandler(h)
+	program := []uint32{
+		// SYS_WRITE0 "Hi"
+		0xe3a00004, 0xe28f1028, 0xef123456,
+		// SYS_WRITEC '!'
+		0xe3a00003, 0xe28f101f, 0xef123456,
+		// SYS_GET_CMDLINE, into a buffer at 0x1800
+		0xe3a00015, 0xe28f1018, 0xef123456, 0xe1a04000,
+		// SYS_EXIT, ADP_Stopped_ApplicationExit
+		0xe3a00018, 0xe59f1004, 0xef123456,
+		// "Hi\0!", the exit reason and the SYS_GET_CMDLINE parameter block
+		0x21006948, 0x00020026, 0x00001800, 64,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	for i := 0; i < 13; i++ {
+		e = p.RunNextInstruction()
+		if e != nil {
+			break
+		}
+	}
+	var exitError *ProcessExitError
+	if !errors.As(e, &exitError) {
+		t.Logf("Expected SYS_EXIT to stop emulation, got %v\n", e)
+		t.FailNow()
+	}
+	if exitError.Status != 0 {
+		t.Logf("Expected exit status 0, got %d\n", exitError.Status)
+		t.Fail()
+	}
+	if output.String() != "Hi!" {
+		t.Logf("Incorrect console output: %q\n", output.String())
+		t.Fail()
+	}
+	value, _ := p.GetRegister(4)
+	if value != 0 {
+		t.Logf("SYS_GET_CMDLINE returned 0x%08x\n", value)
+		t.Fail()
+	}
+	m := p.GetMemoryInterface()
+	s, e := readMemoryString(m, 0x1800, 64)
+	if (e != nil) || (s != "test -v") {
+		t.Logf("Incorrect command line: %q (%v)\n", s, e)
+		t.Fail()
+	}
+	value, _ = m.ReadMemoryWord(4096 + 16*4)
+	if value != 7 {
+		t.Logf("SYS_GET_CMDLINE set the length to %d, not 7\n", value)
+		t.Fail()
+	}
+}
+
+// Writes the given words to the parameter block at 0x1800 and runs a THUMB
+// semihosting call. Returns the value of r0 afterwards.
+func runTHUMBSemihostingCall(p ARMProcessor, operation uint32,
+	block []uint32) (uint32, error) {
+	for i, word := range block {
+		e := p.GetMemoryInterface().WriteMemoryWord(0x1800+uint32(i)*4, word)
+		if e != nil {
+			return 0, e
+		}
+	}
+	p.SetRegister(0, operation)
+	p.SetRegister(1, 0x1800)
+	// swi 0xab
+	e := testSingleTHUMBInstruction(0xdfab, p)
+	value, _ := p.GetRegister(0)
+	return value, e
+}
+
+func TestSemihostingFiles(t *testing.T) {
+	p, e := setupTestTHUMBProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	sandbox := t.TempDir()
+	h := NewSemihostingHandler(sandbox)
+	defer h.Close()
+	p.AddSoftwareInterruptHandler(h)
+	m := p.GetMemoryInterface()
+	// The ".." must not allow escaping the sandbox.
+	writeMemoryBytes(m, 0x1c00, []byte("../out.txt"))
+	writeMemoryBytes(m, 0x1d00, []byte("Hello"))
+	// SYS_OPEN, mode "w"
+	handle, e := runTHUMBSemihostingCall(p, 1, []uint32{0x1c00, 4, 10})
+	if (e != nil) || (handle == 0xffffffff) {
+		t.Logf("Failed opening file for writing: %v\n", e)
+		t.FailNow()
+	}
+	// SYS_WRITE
+	value, e := runTHUMBSemihostingCall(p, 5, []uint32{handle, 0x1d00, 5})
+	if (e != nil) || (value != 0) {
+		t.Logf("SYS_WRITE returned %d (%v)\n", value, e)
+		t.Fail()
+	}
+	// SYS_CLOSE
+	value, e = runTHUMBSemihostingCall(p, 2, []uint32{handle})
+	if (e != nil) || (value != 0) {
+		t.Logf("SYS_CLOSE returned %d (%v)\n", value, e)
+		t.Fail()
+	}
+	content, e := os.ReadFile(filepath.Join(sandbox, "out.txt"))
+	if (e != nil) || (string(content) != "Hello") {
+		t.Logf("Incorrect file contents: %q (%v)\n", content, e)
+		t.Fail()
+	}
+	// SYS_OPEN, mode "rb"
+	handle, e = runTHUMBSemihostingCall(p, 1, []uint32{0x1c00, 1, 10})
+	if (e != nil) || (handle == 0xffffffff) {
+		t.Logf("Failed opening file for reading: %v\n", e)
+		t.FailNow()
+	}
+	// SYS_READ to an unmapped buffer must fail without consuming the file.
+	value, e = runTHUMBSemihostingCall(p, 6, []uint32{handle, 0x80000000, 8})
+	if (e != nil) || (value != 0xffffffff) {
+		t.Logf("SYS_READ to a bad buffer returned 0x%08x (%v)\n", value, e)
+		t.Fail()
+	}
+	// SYS_READ, asking for 8 bytes when only 5 are available.
+	value, e = runTHUMBSemihostingCall(p, 6, []uint32{handle, 0x1e00, 8})
+	if (e != nil) || (value != 3) {
+		t.Logf("SYS_READ returned %d (%v), expected 3\n", value, e)
+		t.Fail()
+	}
+	data, _ := readMemoryBytes(m, 0x1e00, 5)
+	if string(data) != "Hello" {
+		t.Logf("Read incorrect file contents: %q\n", data)
+		t.Fail()
+	}
+	// SYS_OPEN, for a file that doesn't exist
+	writeMemoryBytes(m, 0x1c00, []byte("missing"))
+	value, e = runTHUMBSemihostingCall(p, 1, []uint32{0x1c00, 0, 7})
+	if (e != nil) || (value != 0xffffffff) {
+		t.Logf("Opening a missing file returned 0x%08x (%v)\n", value, e)
+		t.Fail()
+	}
+	// A THUMB swi with a different comment shouldn't be intercepted.
+	e = testSingleTHUMBInstruction(0xdf65, p)
+	value, _ = p.GetRegister(15)
+	if (e != nil) || (value != 0x8) {
+		t.Logf("Ordinary swi wasn't taken as an exception: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestSemihostingLimits(t *testing.T) {
+	p, e := setupTestTHUMBProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	h := NewSemihostingHandler(t.TempDir())
+	defer h.Close()
+	var output bytes.Buffer
+	h.Stdout = &output
+	p.AddSoftwareInterruptHandler(h)
+	m := p.GetMemoryInterface()
+	// A name longer than the host's path limit must be rejected before
+	// anything is read.
+	value, e := runTHUMBSemihostingCall(p, 1, []uint32{0x1c00, 0, 0xffffffff})
+	if (e != nil) || (value != 0xffffffff) {
+		t.Logf("Opening a huge file name returned 0x%08x (%v)\n", value, e)
+		t.Fail()
+	}
+	writeMemoryBytes(m, 0x1c00, []byte(":tt"))
+	handle, e := runTHUMBSemihostingCall(p, 1, []uint32{0x1c00, 4, 3})
+	if (e != nil) || (handle == 0xffffffff) {
+		t.Logf("Failed opening the console: %v\n", e)
+		t.FailNow()
+	}
+	// Writes larger than a single transfer are split into several.
+	e = m.SetMemoryRegion(0x100000, make([]byte, 0x280000))
+	if e != nil {
+		t.FailNow()
+	}
+	value, e = runTHUMBSemihostingCall(p, 5, []uint32{handle, 0x100000,
+		0x280000})
+	if (e != nil) || (value != 0) || (output.Len() != 0x280000) {
+		t.Logf("Large SYS_WRITE returned %d (%v), wrote %d bytes\n", value,
+			e, output.Len())
+		t.Fail()
+	}
+	// A huge length stops at the first chunk which can't be read, reporting
+	// the bytes which weren't written.
+	output.Reset()
+	value, e = runTHUMBSemihostingCall(p, 5, []uint32{handle, 0x100000,
+		0xffffffff})
+	if (e != nil) || (value != 0xffffffff-0x200000) ||
+		(output.Len() != 0x200000) {
+		t.Logf("Huge SYS_WRITE returned 0x%08x (%v), wrote %d bytes\n", value,
+			e, output.Len())
+		t.Fail()
+	}
+}
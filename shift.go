@@ -35,6 +35,13 @@ func (s *basicARMShift) String() string {
 		return fmt.Sprintf("%s %s", shiftString, s.register)
 	}
 	if s.amount == 0 {
+		// Only lsl can shift by 0; the other shifts use 0 to mean 32 or rrx.
+		switch s.shiftType & 3 {
+		case 1, 2:
+			return shiftString + " 32"
+		case 3:
+			return "rrx"
+		}
 		return ""
 	}
 	return fmt.Sprintf("%s %d", shiftString, s.amount)
@@ -0,0 +1,237 @@
+.syntax unified
+.arm
+start:
+add r0, r1, r2
+adds r0, r1, #1
+addeq r3, r4, #0xff000000
+add r0, r1, r2, lsl #3
+add r0, r1, r2, lsr #32
+add r0, r1, r2, asr r3
+add r0, r1, r2, ror #7
+add r0, r1, r2, rrx
+sub sp, sp, #16
+subs r0, r0, #1
+rsb r0, r1, #0
+rsbs r2, r3, r4
+adc r5, r6, r7
+sbc r8, r9, r10
+rsc r11, r12, lr
+and r0, r0, #255
+orr r0, r0, #0x10000
+eor r1, r2, r3
+bic r0, r0, #3
+bics r0, r0, #0x80000000
+tst r0, #1
+teq r1, r2
+cmp r0, #100
+cmp r1, r2, lsl #2
+cmn r0, #1
+mov r0, #0
+mov r0, #-1
+mvn r0, #0
+movs r1, r2
+mov r0, r1, lsl #2
+movs r0, r1, lsr #1
+mov r0, r1, asr #32
+mov r0, r1, ror r2
+mov r0, r1, rrx
+movne pc, lr
+mov r0, r0
+mov r12, sp
+mvn r1, r2, lsl r3
+mrs r0, cpsr
+mrs r1, spsr
+msr cpsr_c, r0
+msr cpsr_fc, r1
+msr cpsr_fsxc, r2
+msr spsr_f, r3
+msr cpsr_f, #0xf0000000
+msr cpsr_s, #0x10
+mul r0, r1, r2
+muls r0, r1, r2
+mla r0, r1, r2, r3
+mlaeq r4, r5, r6, r7
+umull r0, r1, r2, r3
+smull r0, r1, r2, r3
+umlal r0, r1, r2, r3
+smlals r0, r1, r2, r3
+swp r0, r1, [r2]
+swpb r0, r1, [r2]
+bx lr
+bxne r0
+blx r3
+bkpt 0x1234
+svc 0
+svc 0x123456
+svceq 1
+ldr r0, [r1]
+ldr r0, [r1, #4]
+ldr r0, [r1, #-4]
+ldr r0, [r1, #4]!
+ldr r0, [r1], #4
+ldr r0, [r1], #-4
+ldr r0, [r1, #100]
+ldr r0, [r1, r2]
+ldr r0, [r1, -r2]
+ldr r0, [r1, r2, lsl #2]
+ldr r0, [r1, r2, lsl #2]!
+ldr r0, [r1], r2
+ldr r0, [r1], -r2, asr #3
+ldrb r0, [r1, #1]
+strb r0, [r1], #1
+str r0, [sp, #-4]!
+ldr r0, [sp], #4
+push {r4}
+pop {r5}
+str r0, [r1]
+strt r0, [r1], #4
+ldrbt r0, [r1], #1
+ldrt r0, [r1], r2
+ldreq r0, [pc, #8]
+ldr r0, [pc, #-8]
+ldrh r0, [r1]
+ldrh r0, [r1, #2]
+ldrh r0, [r1, #-2]
+strh r0, [r1, #2]!
+strh r0, [r1], #2
+ldrsh r0, [r1, r2]
+ldrsb r0, [r1, -r2]
+ldrsb r0, [r1], r2
+ldrsheq r0, [r1, #40]
+ldrd r0, r1, [r2]
+ldrd r4, r5, [r2, #8]
+strd r0, r1, [r2, #-8]!
+ldrd r2, r3, [r4], r5
+ldrh r0, [pc, #4]
+push {r4, r5, r6, lr}
+pop {r4, r5, r6, pc}
+pusheq {r0, r1}
+stmdb sp!, {r0, r1}
+ldmia r0, {r1, r2}
+ldm r0!, {r1, r2, r3}
+stmia r0!, {r1}
+stmib r0, {r1, r2}
+stmda r0, {r1, r2}
+ldmdb r0!, {r1, r2}
+ldmib r0, {r1, r2}
+ldmda r0, {r1, r2}
+ldm r0, {r1, pc}^
+stmdb sp, {r0, r1}^
+ldmia sp, {r0, r1}
+ldmfd sp!, {r0-r12, pc}
+b start
+bl start
+bne start
+blgt start
+blx start
+blx start+2
+cdp p5, 2, c1, c2, c3, 4
+cdp2 p5, 2, c1, c2, c3, 4
+mcr p15, 0, r0, c1, c0, 0
+mrc p15, 0, r0, c1, c0, 1
+mrceq p14, 1, r2, c3, c4, 5
+mcr2 p3, 1, r2, c3, c4, 5
+mrc2 p3, 1, r2, c3, c4, 5
+mcrr p5, 1, r0, r1, c2
+mrrc p5, 1, r0, r1, c2
+ldc p3, c4, [r5]
+ldc p3, c4, [r5, #8]
+ldcl p3, c4, [r5, #-8]!
+stc p3, c4, [r5], #16
+stc p3, c4, [r5], {40}
+ldc2 p3, c4, [r5, #8]
+ldc2l p3, c4, [r5, #400]
+stc p3, c4, [pc, #-16]
+clz r0, r1
+clzne r2, r3
+qadd r0, r1, r2
+qsub r0, r1, r2
+qdadd r0, r1, r2
+qdsub r0, r1, r2
+smlabb r0, r1, r2, r3
+smlatb r0, r1, r2, r3
+smlabt r0, r1, r2, r3
+smlatteq r0, r1, r2, r3
+smulbb r0, r1, r2
+smultt r0, r1, r2
+smlawb r0, r1, r2, r3
+smlawt r0, r1, r2, r3
+smulwb r0, r1, r2
+smulwt r0, r1, r2
+smlalbb r0, r1, r2, r3
+smlaltt r0, r1, r2, r3
+pld [r0]
+pld [r0, #4]
+pld [r0, #-4]
+pld [r0, r1]
+pld [r0, -r1, lsl #2]
+ldrex r0, [r1]
+strex r0, r1, [r2]
+strexne r0, r1, [r2]
+rev r0, r1
+rev16 r0, r1
+revsh r0, r1
+sxtb r0, r1
+sxth r0, r1, ror #8
+uxtb r0, r1, ror #16
+uxth r0, r1, ror #24
+sxtb16 r0, r1
+uxtb16 r0, r1, ror #8
+sxtab r0, r1, r2
+sxtah r0, r1, r2, ror #8
+uxtab r0, r1, r2
+uxtah r0, r1, r2
+sxtab16 r0, r1, r2
+uxtab16 r0, r1, r2, ror #16
+sadd16 r0, r1, r2
+sasx r0, r1, r2
+ssax r0, r1, r2
+ssub16 r0, r1, r2
+sadd8 r0, r1, r2
+ssub8 r0, r1, r2
+qadd16 r0, r1, r2
+qasx r0, r1, r2
+shadd8 r0, r1, r2
+uadd16 r0, r1, r2
+usax r0, r1, r2
+uqsub8 r0, r1, r2
+uhadd16 r0, r1, r2
+uhsub8 r0, r1, r2
+sel r0, r1, r2
+usad8 r0, r1, r2
+usada8 r0, r1, r2, r3
+ssat r0, #8, r1
+ssat r0, #32, r1, lsl #4
+ssat r0, #1, r1, asr #32
+usat r0, #7, r1, asr #2
+usat r0, #0, r1
+ssat16 r0, #8, r1
+usat16 r0, #15, r1
+pkhbt r0, r1, r2
+pkhbt r0, r1, r2, lsl #8
+pkhtb r0, r1, r2, asr #16
+pkhtb r0, r1, r2, asr #32
+umaal r0, r1, r2, r3
+smlad r0, r1, r2, r3
+smladx r0, r1, r2, r3
+smlsd r0, r1, r2, r3
+smuad r0, r1, r2
+smusdx r0, r1, r2
+smlald r0, r1, r2, r3
+smlsldx r0, r1, r2, r3
+cpsie i
+cpsid aif
+cpsie if, #16
+cpsid a, #19
+cps #17
+setend be
+setend le
+srsdb sp!, #19
+srsia sp, #31
+rfeia r0
+rfedb r1!
+rfeib sp!
+rfeda r2
+msr cpsr_c, #0xd3
+msr spsr_fc, #0x1f
+msr cpsr_x, r4
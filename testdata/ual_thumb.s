@@ -0,0 +1,122 @@
+.syntax unified
+.thumb
+tstart:
+movs r0, r1
+lsls r0, r1, #2
+lsrs r2, r3, #32
+asrs r4, r5, #1
+adds r0, r1, r2
+subs r0, r1, #7
+adds r0, r1, #0
+movs r0, #0
+movs r7, #255
+cmp r1, #33
+adds r2, #100
+subs r3, #1
+ands r0, r1
+eors r0, r1
+lsls r0, r1
+lsrs r0, r1
+asrs r0, r1
+adcs r0, r1
+sbcs r0, r1
+rors r0, r1
+tst r0, r1
+negs r0, r1
+cmp r0, r1
+cmn r0, r1
+orrs r0, r1
+muls r0, r1, r0
+bics r0, r1
+mvns r0, r1
+add r0, r8
+add sp, r1
+cmp r8, r9
+mov r8, r8
+mov r0, sp
+mov sp, r7
+bx lr
+blx r3
+ldr r0, [pc, #4]
+ldr r1, [pc, #1020]
+str r0, [r1, r2]
+strb r0, [r1, r2]
+ldr r0, [r1, r2]
+ldrb r0, [r1, r2]
+strh r0, [r1, r2]
+ldrh r0, [r1, r2]
+ldrsb r0, [r1, r2]
+ldrsh r0, [r1, r2]
+str r0, [r1]
+str r0, [r1, #4]
+ldr r0, [r1, #124]
+strb r0, [r1, #31]
+ldrb r0, [r1, #1]
+strh r0, [r1, #2]
+ldrh r0, [r1, #62]
+str r0, [sp]
+str r0, [sp, #8]
+ldr r0, [sp, #1020]
+adr r0, tdata
+add r1, sp, #4
+add r2, sp, #400
+add sp, #8
+add sp, #508
+sub sp, #16
+sub sp, #128
+push {r4, lr}
+push {r0, r1, r2, r3, r4, r5, r6, r7}
+pop {r4, pc}
+pop {r0}
+stmia r0!, {r1, r2}
+ldmia r0!, {r1, r2}
+ldmia r0, {r0, r1}
+beq tstart
+bne.n tnext
+tnext:
+b tstart
+svc 0
+svc 255
+bkpt 0x00ab
+cbz r0, tend
+cbnz r7, tend
+nop
+yield
+wfe
+wfi
+sev
+cpsie i
+cpsid if
+it eq
+moveq r0, r1
+ite ne
+addne r0, r1
+subeq r0, r1
+itt gt
+addgt r0, r1, r2
+lslgt r0, r1, #3
+itete lt
+movlt r0, #1
+movge r0, #2
+ldrlt r0, [r1]
+strge r0, [r1]
+it hi
+bhi tstart
+itt cc
+addcc.w r0, r1, #1
+bcc.w tstart
+it le
+blle tstart
+sxth r0, r1
+sxtb r2, r3
+uxth r4, r5
+uxtb r6, r7
+rev r0, r1
+rev16 r2, r3
+revsh r4, r5
+setend be
+setend le
+tend:
+.align 2
+tdata:
+.word 0
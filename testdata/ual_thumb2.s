@@ -0,0 +1,141 @@
+.syntax unified
+.thumb
+t2start:
+and.w r0, r1, #255
+ands.w r0, r1, #0x00ff00ff
+bic r0, r1, #0xff000000
+orr.w r0, r1, #0xab00ab00
+orn r0, r1, #1
+eor.w r0, r1, #0x80000000
+add.w r0, r1, #4
+adds.w r0, r1, #0x100
+adc r0, r1, #1
+sbc r0, r1, #1
+sub.w r0, r1, #0x400
+subs.w r0, r0, #1
+rsb r0, r1, #0
+mov.w r0, #0x1000
+movs.w r0, #1
+mvn r0, #1
+tst.w r0, #1
+teq r0, #1
+cmp.w r0, #0x100
+cmn.w r0, #1
+and.w r0, r1, r2
+ands.w r0, r1, r2, lsl #2
+bic.w r0, r1, r2, lsr #4
+orr.w r0, r1, r2, asr #32
+orn r0, r1, r2, ror #4
+eor.w r0, r1, r2, rrx
+add.w r0, r1, r2
+add.w r0, r1, r2, lsl #1
+adc.w r0, r1, r2
+sbc.w r0, r1, r2
+sub.w r0, r1, r2
+rsb r0, r1, r2
+mov.w r0, r1
+movs.w r0, r1
+mov.w r0, r1, lsl #2
+mvn.w r0, r1
+tst.w r0, r1
+teq r0, r1
+cmp.w r0, r1, lsl #3
+cmn.w r0, r1
+lsl.w r0, r1, r2
+lsrs.w r0, r1, r2
+asr.w r0, r1, r2
+ror.w r0, r1, r2
+addw r0, r1, #4095
+subw r0, r1, #1
+movw r0, #0x1234
+movt r0, #0xffff
+movw r1, #7
+sbfx r0, r1, #4, #8
+ubfx r0, r1, #0, #32
+bfi r0, r1, #8, #4
+bfc r0, #0, #1
+ldr.w r0, [r1]
+ldr.w r0, [r1, #4]
+ldr.w r0, [r1, #4095]
+ldr r0, [r1, #-4]
+ldr r0, [r1, #4]!
+ldr r0, [r1], #4
+ldr r0, [r1], #-255
+ldr.w r0, [r1, r2]
+ldr.w r0, [r1, r2, lsl #2]
+str.w r0, [r1, #8]
+strb.w r0, [r1, #1]
+strh.w r0, [r1, #2]
+ldrb.w r0, [r1, #100]
+ldrh r0, [r1, #-2]
+ldrsb.w r0, [r1, #1]
+ldrsh.w r0, [r1, r2, lsl #1]
+ldr.w r0, [pc, #8]
+ldr.w r0, [pc, #-8]
+ldrt r0, [r1, #4]
+strbt r0, [r1]
+pld [r0]
+pld [r0, #4]
+pld [r0, #-4]
+pld [r0, r1, lsl #2]
+pli [r0, #8]
+ldrd r0, r1, [r2]
+ldrd r0, r1, [r2, #8]
+strd r0, r1, [sp, #-8]!
+ldrd r2, r3, [r4], #16
+strd r4, r5, [r6, #40]
+ldrex r0, [r1]
+ldrex r0, [r1, #8]
+strex r0, r1, [r2]
+strex r0, r1, [r2, #4]
+tbb [r0, r1]
+tbh [pc, r1, lsl #1]
+sdiv r0, r1, r2
+udiv r0, r1, r2
+bl t2start
+b.w t2start
+beq.w t2start
+bgt.w t2next
+t2next:
+dsb sy
+dmb ish
+dmb ishst
+isb sy
+dsb #5
+mrs r0, apsr
+mrs r0, primask
+mrs r1, basepri_max
+mrs r2, psp
+msr apsr_nzcvq, r0
+msr apsr_g, r1
+msr apsr_nzcvqg, r1
+msr primask, r0
+msr basepri, r3
+msr control, r2
+ldmia.w r0, {r1, r2, r3}
+ldmia.w r0!, {r1, r2}
+stmia.w r0!, {r1, r8}
+ldmdb r0, {r1, r2}
+stmdb r0!, {r1, r2}
+push.w {r4, r5, r8, lr}
+pop.w {r4, r5, r8, pc}
+mul r0, r1, r8
+mla r0, r1, r2, r3
+mls r0, r1, r2, r3
+smull r0, r1, r2, r3
+umull r0, r1, r2, r3
+smlal r0, r1, r2, r3
+umlal r0, r1, r2, r3
+sxth.w r0, r1
+sxtb.w r0, r1, ror #8
+uxth.w r0, r1
+uxtb.w r0, r1
+sxtah r0, r1, r2
+uxtab r0, r1, r2, ror #16
+rev.w r0, r1
+rev16.w r0, r1
+revsh.w r0, r1
+clz r0, r1
+itt eq
+addeq.w r0, r1, #1
+ldreq.w r0, [r1, #4]
@@ -0,0 +1,59 @@
+.syntax unified
+.arm
+vfpstart:
+vmla.f32 s0, s1, s2
+vmls.f32 s3, s4, s5
+vnmls.f32 s6, s7, s8
+vnmla.f64 d0, d1, d2
+vmul.f64 d3, d4, d5
+vnmul.f32 s0, s1, s31
+vadd.f32 s0, s1, s2
+vaddeq.f64 d0, d1, d2
+vsub.f64 d15, d14, d13
+vdiv.f32 s10, s11, s12
+vmov.f32 s0, s1
+vmov.f64 d0, d1
+vabs.f32 s2, s3
+vneg.f64 d2, d3
+vsqrt.f32 s4, s5
+vcmp.f32 s0, s1
+vcmpe.f64 d0, d1
+vcmp.f32 s0, #0
+vcmpe.f64 d2, #0
+vcvt.f64.f32 d0, s1
+vcvt.f32.f64 s0, d1
+vcvt.f32.u32 s0, s1
+vcvt.f64.s32 d0, s1
+vcvtr.u32.f32 s0, s1
+vcvt.u32.f64 s0, d1
+vcvtr.s32.f64 s2, d3
+vcvt.s32.f32 s2, s3
+vldr s0, [r0]
+vldr s1, [r0, #4]
+vldr d0, [r1, #-8]
+vstr d15, [sp, #1020]
+vldr d1, [pc, #16]
+vstr s3, [r2, #40]
+vpush {s0-s3}
+vpush {d8-d15}
+vpop {d8}
+vpop {s16-s31}
+vldmia r0, {s0-s3}
+vldmia r0!, {d0-d3}
+vstmia r1!, {s4}
+vstmdb r1!, {d2-d3}
+vldmdb r2!, {s8-s9}
+fldmiax r0!, {d0-d1}
+fstmdbx sp!, {d8-d15}
+vmov s0, r0
+vmov r1, s31
+vmov.32 d0[0], r2
+vmov.32 d1[1], r3
+vmov.32 r4, d2[0]
+vmov.32 r5, d3[1]
+vmsr fpscr, r0
+vmsr fpexc, r1
+vmrs r0, fpscr
+vmrs r2, fpsid
+vmrs APSR_nzcv, fpscr
+vmrsne r3, fpexc
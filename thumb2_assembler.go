@@ -0,0 +1,841 @@
+package arm_emulate
+
+// This file contains the parts of the assembler which encode 32-bit Thumb-2
+// instructions. Where a Thumb-2 instruction has the same operands as an ARM
+// instruction, the ARM assembler's parsing functions are reused.
+
+import (
+	"math/bits"
+	"strings"
+)
+
+// Returns an ARM statement with the same operands, for parsing them with the
+// ARM assembler.
+func (s *thumbAssemblerStatement) armStatement(name,
+	suffix string) *armAssemblerStatement {
+	return &armAssemblerStatement{
+		a:         s.a,
+		item:      s.item,
+		mnemonic:  s.mnemonic,
+		name:      name,
+		suffix:    suffix,
+		condition: 14,
+		operands:  s.operands,
+	}
+}
+
+// Encodes a Thumb-2 instruction's fields, reporting any which don't fit at
+// the mnemonic.
+func (s *thumbAssemblerStatement) encodeFields(n interface {
+	Encode() (uint32, error)
+}) (uint32, error) {
+	raw, e := n.Encode()
+	if e != nil {
+		return 0, s.errorf("%s", e)
+	}
+	return raw, nil
+}
+
+// Assembles an instruction using one of the ARM encoders, then converts it to
+// the Thumb-2 instruction sharing its type.
+func (s *thumbAssemblerStatement) encodeUsingARM(
+	encode func(*armAssemblerStatement) (uint32, error), name,
+	suffix string) (uint32, error) {
+	raw, e := encode(s.armStatement(name, suffix))
+	if e != nil {
+		return 0, e
+	}
+	n, e := ParseInstructionForArchitecture(raw, ARMv7)
+	if e != nil {
+		return 0, s.errorf("Invalid instruction: %s", e)
+	}
+	switch v := n.(type) {
+	case *ExtendInstruction:
+		v.thumb2 = true
+	case *ReverseBytesInstruction:
+		v.thumb2 = true
+	case *BlockDataTransferInstruction:
+		v.thumb2 = true
+	default:
+		return 0, s.errorf("%s has no Thumb-2 encoding", s.mnemonic.text)
+	}
+	return s.encodeFields(n)
+}
+
+// Returns the 12-bit modified immediate field encoding the value, and false
+// if it can't be encoded. This is the inverse of expandTHUMB2Immediate.
+func encodeTHUMB2Immediate(value uint32) (uint16, bool) {
+	low := value & 0xff
+	high := (value >> 8) & 0xff
+	switch {
+	case value == low:
+		return uint16(low), true
+	case value == (low | (low << 16)):
+		return 0x100 | uint16(low), true
+	case value == ((high << 8) | (high << 24)):
+		return 0x200 | uint16(high), true
+	case value == (low * 0x01010101):
+		return 0x300 | uint16(low), true
+	}
+	// Otherwise, the value must be an 8-bit value with its top bit set,
+	// rotated right by 8 to 31 bits.
+	for rotation := 8; rotation < 32; rotation++ {
+		v := bits.RotateLeft32(value, rotation)
+		if (v & 0xffffff80) == 0x80 {
+			return uint16(rotation<<7) | uint16(v&0x7f), true
+		}
+	}
+	return 0, false
+}
+
+// The Thumb-2 data processing opcodes, which differ from the ARM ones.
+var thumb2DataProcessingOpcodes = map[string]uint8{
+	"and": 0, "tst": 0, "bic": 1, "orr": 2, "mov": 2, "orn": 3, "mvn": 3,
+	"eor": 4, "teq": 4, "add": 8, "cmn": 8, "adc": 10, "sbc": 11, "sub": 13,
+	"cmp": 13, "rsb": 14,
+}
+
+// Returns an equivalent opcode which uses the complement or negation of an
+// immediate operand, along with the adjusted immediate.
+func alternateTHUMB2Opcode(opcode uint8, value uint32) (uint8, uint32, bool) {
+	switch opcode {
+	case 0, 2, 10:
+		// and to bic, orr to orn and adc to sbc
+		return opcode + 1, ^value, true
+	case 1, 3, 11:
+		return opcode - 1, ^value, true
+	case 8:
+		return 13, -value, true
+	case 13:
+		return 8, -value, true
+	}
+	return 0, 0, false
+}
+
+// Encodes the second operand of a data processing instruction, which is
+// either an immediate or a shifted register, and then the instruction. add,
+// sub and mov fall back to addw, subw and movw for other immediates.
+func (s *thumbAssemblerStatement) encodeOperand2(
+	n *DataProcessingTHUMB2Instruction,
+	operands []assemblerToken) (uint32, error) {
+	if (len(operands) == 1) && isImmediateOperand(operands[0]) {
+		t := stripAssemblerHash(operands[0])
+		value, e := s.a.evaluate(t, s.item.index, s.item.address)
+		if e != nil {
+			return 0, e
+		}
+		n.IsImmediate = true
+		if encoded, ok := encodeTHUMB2Immediate(value); ok {
+			n.Immediate = encoded
+			return s.encodeFields(n)
+		}
+		alternate, newValue, ok := alternateTHUMB2Opcode(n.Opcode, value)
+		if ok && ((n.Rd != 15) || thumb2CompareOpcode(alternate)) {
+			if encoded, ok := encodeTHUMB2Immediate(newValue); ok {
+				n.Opcode = alternate
+				n.Immediate = encoded
+				return s.encodeFields(n)
+			}
+		}
+		if !n.SetConditions && ((n.Opcode == 8) || (n.Opcode == 13)) {
+			w := WideImmediateTHUMB2Instruction{
+				Rd:       n.Rd,
+				Rn:       n.Rn,
+				Subtract: n.Opcode == 13,
+			}
+			if value > 0xfff {
+				w.Subtract = !w.Subtract
+				value = -value
+			}
+			if value <= 0xfff {
+				w.Immediate = uint16(value)
+				return s.encodeFields(&w)
+			}
+		}
+		if !n.SetConditions && (n.Opcode == 2) && (value <= 0xffff) {
+			w := WideImmediateTHUMB2Instruction{
+				Rd:        n.Rd,
+				Immediate: uint16(value),
+				Move:      true,
+			}
+			return s.encodeFields(&w)
+		}
+		return 0, t.errorf("0x%x can't be encoded as a Thumb-2 immediate",
+			value)
+	}
+	rm, shift, e := s.armStatement(s.name, "").parseShiftedRegister(operands,
+		true)
+	if e != nil {
+		return 0, e
+	}
+	n.Rm = rm
+	if shift != 0 {
+		n.Shift = NewARMShift(uint8(shift))
+	}
+	return s.encodeFields(n)
+}
+
+func (s *thumbAssemblerStatement) encodeDataProcessingTHUMB2() (uint32,
+	error) {
+	if len(s.operands) < 2 {
+		return 0, s.errorf("%s requires at least 2 operands", s.mnemonic.text)
+	}
+	first, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	n := DataProcessingTHUMB2Instruction{
+		Opcode:        thumb2DataProcessingOpcodes[s.name],
+		SetConditions: s.setFlags,
+		Rd:            first,
+		Rn:            first,
+	}
+	operands := s.operands[1:]
+	switch s.name {
+	case "mov", "mvn":
+		n.Rn = 15
+	case "tst", "teq", "cmp", "cmn":
+		n.Rd = 15
+		n.SetConditions = true
+	default:
+		// As in ARM state, the first operand may be omitted if it's the same
+		// as the destination.
+		if (len(operands) > 1) && !isAssemblerShift(operands[1]) {
+			n.Rn, e = expectAssemblerRegister(operands[0])
+			if e != nil {
+				return 0, e
+			}
+			operands = operands[1:]
+		}
+	}
+	return s.encodeOperand2(&n, operands)
+}
+
+// Encodes lsl, lsr, asr, ror and rrx, which are aliases for mov.
+func (s *thumbAssemblerStatement) encodeShiftAliasTHUMB2() (uint32, error) {
+	e := s.maximumOperands(3)
+	if e != nil {
+		return 0, e
+	}
+	if len(s.operands) < 2 {
+		return 0, s.errorf("%s requires at least 2 operands", s.mnemonic.text)
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	n := DataProcessingTHUMB2Instruction{
+		Opcode:        2,
+		SetConditions: s.setFlags,
+		Rd:            rd,
+		Rn:            15,
+	}
+	if s.name == "rrx" {
+		e = s.expectOperands(2)
+		if e != nil {
+			return 0, e
+		}
+		shift := assemblerToken{"rrx", s.mnemonic.line, s.mnemonic.column}
+		return s.encodeOperand2(&n, []assemblerToken{s.operands[1], shift})
+	}
+	rm := s.operands[0]
+	amount := s.operands[1]
+	if len(s.operands) == 3 {
+		rm = s.operands[1]
+		amount = s.operands[2]
+	}
+	shift := assemblerToken{s.name + " " + amount.text, amount.line,
+		amount.column}
+	return s.encodeOperand2(&n, []assemblerToken{rm, shift})
+}
+
+// Encodes addw, subw, movw and movt.
+func (s *thumbAssemblerStatement) encodeWideImmediate() (uint32, error) {
+	n := WideImmediateTHUMB2Instruction{
+		Subtract: s.name == "subw",
+		Move:     strings.HasPrefix(s.name, "mov"),
+		Top:      s.name == "movt",
+	}
+	maximum := uint32(0xfff)
+	if n.Move {
+		maximum = 0xffff
+		e := s.expectOperands(2)
+		if e != nil {
+			return 0, e
+		}
+	} else {
+		e := s.maximumOperands(3)
+		if e != nil {
+			return 0, e
+		}
+		if len(s.operands) < 2 {
+			return 0, s.errorf("%s requires 2 or 3 operands",
+				s.mnemonic.text)
+		}
+	}
+	var e error
+	n.Rd, e = expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	n.Rn = n.Rd
+	if len(s.operands) == 3 {
+		n.Rn, e = expectAssemblerRegister(s.operands[1])
+		if e != nil {
+			return 0, e
+		}
+	}
+	n.Immediate, e = s.immediate(s.operands[len(s.operands)-1], maximum, 1)
+	if e != nil {
+		return 0, e
+	}
+	return s.encodeFields(&n)
+}
+
+// Encodes sbfx, ubfx, bfi and bfc, which take the lowest bit of the field and
+// its width.
+func (s *thumbAssemblerStatement) encodeBitfield() (uint32, error) {
+	n := BitfieldTHUMB2Instruction{
+		Rn:       15,
+		Insert:   strings.HasPrefix(s.name, "bf"),
+		Unsigned: s.name == "ubfx",
+	}
+	count := 4
+	if s.name == "bfc" {
+		count = 3
+	}
+	e := s.expectOperands(count)
+	if e != nil {
+		return 0, e
+	}
+	n.Rd, e = expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	if count == 4 {
+		n.Rn, e = expectAssemblerRegister(s.operands[1])
+		if e != nil {
+			return 0, e
+		}
+	}
+	lsb, e := s.immediate(s.operands[count-2], 31, 1)
+	if e != nil {
+		return 0, e
+	}
+	width, e := s.immediate(s.operands[count-1], 32-uint32(lsb), 1)
+	if e != nil {
+		return 0, e
+	}
+	if width == 0 {
+		return 0, s.operands[count-1].errorf("The width must be at least 1")
+	}
+	n.LSB = uint8(lsb)
+	n.WidthField = uint8(width - 1)
+	if n.Insert {
+		n.WidthField += n.LSB
+	}
+	return s.encodeFields(&n)
+}
+
+// Returns the offset of a PC-relative load's target from the word-aligned PC.
+// Numbers are offsets from the instruction, as in 16-bit loads.
+func (s *thumbAssemblerStatement) literalOffset(t assemblerToken,
+	maximum int32) (int32, error) {
+	pc := s.alignedPC()
+	var offset int32
+	if s.literal != nil {
+		offset = int32(s.literal.address - pc)
+	} else {
+		var e error
+		offset, e = s.a.relativeOffset(t, s.item, pc,
+			-int32(pc-s.item.address))
+		if e != nil {
+			return 0, e
+		}
+	}
+	if (offset >= -maximum) && (offset <= maximum) {
+		return offset, nil
+	}
+	if s.literal != nil {
+		return 0, t.errorf("The literal pool is out of range; add a " +
+			".ltorg directive closer to this instruction")
+	}
+	return 0, t.errorf("The PC-relative offset must be from %d to %d, got %d",
+		-maximum, maximum, offset)
+}
+
+// Encodes the loads and stores of single bytes, halfwords and words, and the
+// pld and pli preloads.
+func (s *thumbAssemblerStatement) encodeLoadStoreTHUMB2() (uint32, error) {
+	n := LoadStoreTHUMB2Instruction{
+		Load: s.name[0] != 's',
+		Size: 2,
+	}
+	operands := s.operands
+	if (s.name == "pld") || (s.name == "pli") {
+		n.Rt = 15
+		n.Size = 0
+		n.Signed = s.name == "pli"
+	} else {
+		suffix := s.name[3:]
+		if strings.HasPrefix(s.name, "lds") {
+			suffix = s.name[2:]
+		}
+		if strings.HasPrefix(suffix, "s") {
+			n.Signed = true
+			suffix = suffix[1:]
+		}
+		if suffix != "" {
+			n.Size = uint8(strings.Index("bh", suffix))
+		}
+		if len(operands) < 2 {
+			return 0, s.errorf("%s requires at least 2 operands",
+				s.mnemonic.text)
+		}
+		var e error
+		n.Rt, e = expectAssemblerRegister(operands[0])
+		if e != nil {
+			return 0, e
+		}
+		operands = operands[1:]
+	}
+	if len(operands) == 0 {
+		return 0, s.errorf("%s requires an address", s.mnemonic.text)
+	}
+	if (s.literal != nil) || !strings.HasPrefix(operands[0].text, "[") {
+		e := s.maximumOperands(len(s.operands) - len(operands) + 1)
+		if e != nil {
+			return 0, e
+		}
+		offset, e := s.literalOffset(operands[0], 4095)
+		if e != nil {
+			return 0, e
+		}
+		n.Rn = 15
+		n.Preindex = true
+		n.Up = offset >= 0
+		if offset < 0 {
+			offset = -offset
+		}
+		n.Offset = uint16(offset)
+		return s.encodeFields(&n)
+	}
+	address, e := s.armStatement(s.name, "").parseAddress(operands)
+	if e != nil {
+		return 0, e
+	}
+	n.Rn = address.rn
+	n.Preindex = address.preindex
+	n.Up = address.up
+	// Post-indexed addresses always write back.
+	n.WriteBack = address.writeBack || !address.preindex
+	if !address.immediate {
+		if !n.Preindex || !n.Up || n.WriteBack {
+			return 0, address.token.errorf("%s can only add a register "+
+				"offset, without writing back", s.mnemonic.text)
+		}
+		if ((address.shift & 7) != 0) || ((address.shift >> 3) > 3) {
+			return 0, address.token.errorf("The offset register can only " +
+				"be shifted by lsl 0 to 3")
+		}
+		n.RegisterOffset = true
+		n.Rm = address.rm
+		n.Shift = uint8(address.shift >> 3)
+		return s.encodeFields(&n)
+	}
+	maximum := uint32(255)
+	if (n.Rn == 15) || (n.Preindex && n.Up && !n.WriteBack) {
+		maximum = 4095
+	}
+	if address.offset > maximum {
+		return 0, address.token.errorf("Offset %d is out of range",
+			address.offset)
+	}
+	n.Offset = uint16(address.offset)
+	return s.encodeFields(&n)
+}
+
+// Parses the address of ldrd, strd, ldrex or strex, which must be an
+// immediate offset in words.
+func (s *thumbAssemblerStatement) wordOffsetAddress(
+	operands []assemblerToken) (*armAssemblerAddress, error) {
+	address, e := s.armStatement(s.name, "").parseAddress(operands)
+	if e != nil {
+		return nil, e
+	}
+	if !address.immediate {
+		return nil, address.token.errorf("%s can't use a register offset",
+			s.mnemonic.text)
+	}
+	if (address.offset > 1020) || ((address.offset & 3) != 0) {
+		return nil, address.token.errorf("The offset must be a multiple of "+
+			"4 up to 1020, got %d", address.offset)
+	}
+	return address, nil
+}
+
+// Encodes ldrd and strd, which require both registers to be given.
+func (s *thumbAssemblerStatement) encodeLoadStoreDouble() (uint32, error) {
+	if len(s.operands) < 3 {
+		return 0, s.errorf("%s requires two registers and an address",
+			s.mnemonic.text)
+	}
+	n := LoadStoreDoubleTHUMB2Instruction{
+		Load:     s.name == "ldrd",
+		Preindex: true,
+		Up:       true,
+	}
+	var e error
+	n.Rt, e = expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	n.Rt2, e = expectAssemblerRegister(s.operands[1])
+	if e != nil {
+		return 0, e
+	}
+	if !strings.HasPrefix(s.operands[2].text, "[") {
+		e = s.maximumOperands(3)
+		if e != nil {
+			return 0, e
+		}
+		offset, e := s.literalOffset(s.operands[2], 1020)
+		if e != nil {
+			return 0, e
+		}
+		if (offset & 3) != 0 {
+			return 0, s.operands[2].errorf("The PC-relative offset must be "+
+				"a multiple of 4, got %d", offset)
+		}
+		n.Rn = 15
+		n.Up = offset >= 0
+		if offset < 0 {
+			offset = -offset
+		}
+		n.Offset = uint8(offset >> 2)
+		return s.encodeFields(&n)
+	}
+	address, e := s.wordOffsetAddress(s.operands[2:])
+	if e != nil {
+		return 0, e
+	}
+	n.Rn = address.rn
+	n.Offset = uint8(address.offset >> 2)
+	n.Preindex = address.preindex
+	n.Up = address.up
+	n.WriteBack = address.writeBack || !address.preindex
+	return s.encodeFields(&n)
+}
+
+// Encodes ldrex and strex, which may use a positive offset in Thumb-2.
+func (s *thumbAssemblerStatement) encodeExclusiveTHUMB2() (uint32, error) {
+	var n ExclusiveLoadStoreInstruction
+	n.thumb2 = true
+	n.Load = s.name == "ldrex"
+	count := 3
+	if n.Load {
+		count = 2
+	}
+	e := s.expectOperands(count)
+	if e != nil {
+		return 0, e
+	}
+	n.Rd, e = expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	if !n.Load {
+		n.Rm, e = expectAssemblerRegister(s.operands[1])
+		if e != nil {
+			return 0, e
+		}
+	}
+	address, e := s.wordOffsetAddress(s.operands[count-1:])
+	if e != nil {
+		return 0, e
+	}
+	if !address.preindex || address.writeBack || !address.up {
+		return 0, address.token.errorf("%s requires [register] or "+
+			"[register, offset]", s.mnemonic.text)
+	}
+	n.Rn = address.rn
+	n.Offset = uint8(address.offset >> 2)
+	return s.encodeFields(&n)
+}
+
+// Encodes tbb [rn, rm] and tbh [rn, rm, lsl #1].
+func (s *thumbAssemblerStatement) encodeTableBranch() (uint32, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	address, e := s.armStatement(s.name, "").parseAddress(s.operands)
+	if e != nil {
+		return 0, e
+	}
+	n := TableBranchTHUMB2Instruction{
+		Rn:       address.rn,
+		Rm:       address.rm,
+		Halfword: s.name == "tbh",
+	}
+	shift := uint32(0)
+	if n.Halfword {
+		shift = 1 << 3
+	}
+	if address.immediate || !address.preindex || address.writeBack ||
+		!address.up || (address.shift != shift) {
+		if n.Halfword {
+			return 0, address.token.errorf("tbh requires [rn, rm, lsl #1]")
+		}
+		return 0, address.token.errorf("tbb requires [rn, rm]")
+	}
+	return s.encodeFields(&n)
+}
+
+func (s *thumbAssemblerStatement) encodeDivide() (uint32, error) {
+	r, e := s.armStatement(s.name, "").registers(3)
+	if e != nil {
+		return 0, e
+	}
+	n := DivideTHUMB2Instruction{
+		Rd:       r[0],
+		Rn:       r[1],
+		Rm:       r[2],
+		Unsigned: s.name == "udiv",
+	}
+	return s.encodeFields(&n)
+}
+
+// Encodes clz directly, since the ARM instruction can't use pc.
+func (s *thumbAssemblerStatement) encodeCountLeadingZerosTHUMB2() (uint32,
+	error) {
+	r, e := s.armStatement(s.name, "").registers(2)
+	if e != nil {
+		return 0, e
+	}
+	var n CountLeadingZerosInstruction
+	n.thumb2 = true
+	n.Rd, n.Rm = r[0], r[1]
+	return s.encodeFields(&n)
+}
+
+// Encodes mul, mla, mls and the long multiplies, none of which can set the
+// flags in Thumb-2.
+func (s *thumbAssemblerStatement) encodeMultiplyTHUMB2() (uint32, error) {
+	var n MultiplyInstruction
+	n.thumb2 = true
+	n.SetConditions = s.setFlags
+	switch s.name {
+	case "mul", "mla", "mls":
+		count := 4
+		if s.name == "mul" {
+			count = 3
+		}
+		r, e := s.armStatement(s.name, "").registers(count)
+		if e != nil {
+			return 0, e
+		}
+		n.Rd, n.Rm, n.Rs = r[0], r[1], r[2]
+		if count == 4 {
+			n.Rn = r[3]
+			n.Accumulate = true
+			n.Subtract = s.name == "mls"
+		}
+		return s.encodeFields(&n)
+	}
+	r, e := s.armStatement(s.name, "").registers(4)
+	if e != nil {
+		return 0, e
+	}
+	n.IsLongMultiply = true
+	n.RdLow, n.RdHigh, n.Rm, n.Rs = r[0], r[1], r[2], r[3]
+	n.Signed = s.name[0] == 's'
+	n.Accumulate = strings.HasSuffix(s.name, "lal")
+	return s.encodeFields(&n)
+}
+
+// Encodes the 32-bit b, which may be conditional.
+func (s *thumbAssemblerStatement) encodeBranchTHUMB2(
+	condition uint32) (uint32, error) {
+	n := BranchTHUMB2Instruction{Condition: ARMCondition(condition)}
+	if condition != 14 {
+		offset, e := s.branchOffset(-0x100000, 0xffffe)
+		if e != nil {
+			return 0, e
+		}
+		n.Offset = uint32(offset>>1) & 0xfffff
+		return s.encodeFields(&n)
+	}
+	offset, e := s.branchOffset(-0x1000000, 0xfffffe)
+	if e != nil {
+		return 0, e
+	}
+	n.Offset = uint32(offset>>1) & 0xffffff
+	return s.encodeFields(&n)
+}
+
+// Encodes dsb, dmb and isb, which take an option such as sy or a number from
+// 0 to 15. The option defaults to sy.
+func (s *thumbAssemblerStatement) encodeBarrier() (uint32, error) {
+	n := BarrierTHUMB2Instruction{
+		Operation: uint8(strings.Index("dsbdmbisb", s.name)/3 + 4),
+		Option:    15,
+	}
+	e := s.maximumOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	if len(s.operands) == 0 {
+		return s.encodeFields(&n)
+	}
+	t := s.operands[0]
+	for option, name := range barrierOptionStrings {
+		if name == t.lower() {
+			n.Option = option
+			return s.encodeFields(&n)
+		}
+	}
+	value, e := s.immediate(t, 15, 1)
+	if e != nil {
+		return 0, e
+	}
+	n.Option = uint8(value)
+	return s.encodeFields(&n)
+}
+
+// The mask fields of msr for the APSR flags in ARMv7-M.
+var thumb2APSRMasks = map[string]uint8{"nzcvq": 8, "g": 4, "nzcvqg": 12}
+
+// Parses the PSR or ARMv7-M special register used by mrs or msr, filling in
+// the fields of the instruction which select it.
+func parseTHUMB2StatusRegister(t assemblerToken,
+	n *StatusRegisterTHUMB2Instruction) bool {
+	name := t.lower()
+	for r, registerName := range specialRegisterStrings {
+		if name == registerName {
+			n.SYSm = r
+			n.Mask = 8
+			return true
+		}
+		if (r > XPSR) || !strings.HasPrefix(name, registerName+"_") {
+			continue
+		}
+		mask, ok := thumb2APSRMasks[name[len(registerName)+1:]]
+		if ok {
+			n.SYSm = r
+			n.Mask = mask
+			return true
+		}
+	}
+	r, mask, ok := parseAssemblerPSR(t)
+	n.UseSPSR = r == 1
+	n.Mask = uint8(mask)
+	return ok
+}
+
+func (s *thumbAssemblerStatement) encodeStatusRegister() (uint32, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	var n StatusRegisterTHUMB2Instruction
+	register, psr := s.operands[0], s.operands[1]
+	if s.name == "msr" {
+		n.WritePSR = true
+		register, psr = psr, register
+	}
+	n.Rd, e = expectAssemblerRegister(register)
+	if e != nil {
+		return 0, e
+	}
+	if !parseTHUMB2StatusRegister(psr, &n) {
+		return 0, psr.errorf("Expected a PSR or special register, got %q",
+			psr.text)
+	}
+	if !n.WritePSR {
+		n.Mask = 0
+	}
+	return s.encodeFields(&n)
+}
+
+// Encodes the statement as a 32-bit Thumb-2 instruction, without checking
+// that the result is valid.
+func (s *thumbAssemblerStatement) encodeTHUMB2() (uint32, error) {
+	switch s.name {
+	case "and", "bic", "orr", "orn", "eor", "add", "adc", "sbc", "sub", "rsb",
+		"mov", "mvn", "tst", "teq", "cmp", "cmn":
+		return s.encodeDataProcessingTHUMB2()
+	case "lsl", "lsr", "asr", "ror", "rrx":
+		return s.encodeShiftAliasTHUMB2()
+	case "addw", "subw", "movw", "movt":
+		return s.encodeWideImmediate()
+	case "sbfx", "ubfx", "bfi", "bfc":
+		return s.encodeBitfield()
+	case "ldr", "ldrb", "ldrh", "ldrsb", "ldrsh", "ldsb", "ldsh", "str",
+		"strb", "strh", "pld", "pli":
+		return s.encodeLoadStoreTHUMB2()
+	case "ldrd", "strd":
+		return s.encodeLoadStoreDouble()
+	case "ldrex", "strex":
+		return s.encodeExclusiveTHUMB2()
+	case "tbb", "tbh":
+		return s.encodeTableBranch()
+	case "sdiv", "udiv":
+		return s.encodeDivide()
+	case "mul", "mla", "mls", "umull", "umlal", "smull", "smlal":
+		return s.encodeMultiplyTHUMB2()
+	case "dsb", "dmb", "isb":
+		return s.encodeBarrier()
+	case "mrs", "msr":
+		return s.encodeStatusRegister()
+	case "sxtb", "sxth", "sxtb16", "uxtb", "uxth", "uxtb16", "sxtab", "sxtah",
+		"sxtab16", "uxtab", "uxtah", "uxtab16":
+		return s.encodeUsingARM((*armAssemblerStatement).encodeExtend,
+			s.name, "")
+	case "rev", "rev16", "revsh":
+		return s.encodeUsingARM((*armAssemblerStatement).encodeReverseBytes,
+			s.name, "")
+	case "clz":
+		return s.encodeCountLeadingZerosTHUMB2()
+	case "push", "pop":
+		return s.encodeUsingARM(
+			(*armAssemblerStatement).encodeBlockDataTransfer, s.name, "")
+	case "b":
+		return s.encodeBranchTHUMB2(14)
+	case "bl", "blx":
+		halfwords, e := s.encodeLongBranch()
+		if e != nil {
+			return 0, e
+		}
+		return (uint32(halfwords[0]) << 16) | uint32(halfwords[1]), nil
+	}
+	if strings.HasPrefix(s.name, "ldm") || strings.HasPrefix(s.name, "stm") {
+		mode := s.name[3:]
+		_, ok := blockTransferModes[mode]
+		if _, isStackMode := loadStackModes[mode]; ok || isStackMode {
+			return s.encodeUsingARM(
+				(*armAssemblerStatement).encodeBlockDataTransfer, s.name[:3],
+				mode)
+		}
+	}
+	if strings.HasPrefix(s.name, "b") {
+		condition, ok := assemblerConditions[s.name[1:]]
+		if ok && (condition < 14) {
+			return s.encodeBranchTHUMB2(condition)
+		}
+	}
+	return 0, s.errorf("Unknown THUMB instruction %q", s.mnemonic.text)
+}
+
+// Encodes the statement as a 32-bit Thumb-2 instruction.
+func (s *thumbAssemblerStatement) encodeWide() (uint32, error) {
+	raw, e := s.encodeTHUMB2()
+	if e != nil {
+		return 0, e
+	}
+	_, e = ParseTHUMB2Instruction(raw)
+	if e != nil {
+		return 0, s.errorf("Invalid instruction (0x%08x): %s", raw, e)
+	}
+	return raw, nil
+}
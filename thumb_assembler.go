@@ -0,0 +1,1312 @@
+package arm_emulate
+
+// This file contains the parts of the assembler which encode 16-bit THUMB
+// instructions, and chooses between them and the 32-bit Thumb-2 instructions
+// in thumb2_assembler.go. A statement only becomes a Thumb-2 instruction if no
+// 16-bit instruction has the same effect, or if its mnemonic ends in ".w".
+// Since the disassembler prints instructions which always set the flags
+// without an "s", statements such as "add r0, r1, r2" still assemble to the
+// 16-bit instructions which set the flags; "add.w r0, r1, r2" doesn't.
+
+import (
+	"strings"
+)
+
+// A THUMB instruction being assembled.
+type thumbAssemblerStatement struct {
+	a        *assembler
+	item     *assemblerItem
+	mnemonic assemblerToken
+	// The lowercase mnemonic, without an "s" suffix.
+	name string
+	// Set if the mnemonic ended in "s", which is accepted for instructions
+	// which always set the condition flags in THUMB state.
+	setFlags bool
+	operands []assemblerToken
+	literal  *assemblerLiteral
+	// Set if the statement follows an it instruction, where the 16-bit
+	// instructions don't set the condition flags.
+	inITBlock bool
+	// Set if the statement is encoded as a 32-bit Thumb-2 instruction.
+	wide bool
+}
+
+func (s *thumbAssemblerStatement) errorf(format string,
+	args ...interface{}) error {
+	return s.mnemonic.errorf(format, args...)
+}
+
+// Returns an error at the first operand beyond the given number, if there are
+// too many of them.
+func (s *thumbAssemblerStatement) maximumOperands(count int) error {
+	if len(s.operands) > count {
+		return s.operands[count].errorf("Unexpected %q",
+			s.operands[count].text)
+	}
+	return nil
+}
+
+func (s *thumbAssemblerStatement) expectOperands(count int) error {
+	e := s.maximumOperands(count)
+	if e != nil {
+		return e
+	}
+	if len(s.operands) != count {
+		return s.errorf("%s requires %d operands, got %d", s.mnemonic.text,
+			count, len(s.operands))
+	}
+	return nil
+}
+
+// Returns the register named by the token, requiring it to be r0-r7.
+func expectLowRegister(t assemblerToken) (uint16, error) {
+	r, e := expectAssemblerRegister(t)
+	if e != nil {
+		return 0, e
+	}
+	if r > 7 {
+		return 0, t.errorf("Expected a low register (r0-r7), got %s", r)
+	}
+	return uint16(r), nil
+}
+
+func (s *thumbAssemblerStatement) lowRegisters(count int) ([]uint16, error) {
+	e := s.expectOperands(count)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]uint16, count)
+	for i, t := range s.operands {
+		toReturn[i], e = expectLowRegister(t)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return toReturn, nil
+}
+
+// Evaluates an immediate operand which must be a multiple of the given scale
+// and no greater than maximum. Returns the value divided by the scale.
+func (s *thumbAssemblerStatement) immediate(t assemblerToken, maximum,
+	scale uint32) (uint16, error) {
+	t = stripAssemblerHash(t)
+	value, e := s.a.evaluate(t, s.item.index, s.item.address)
+	if e != nil {
+		return 0, e
+	}
+	if value > maximum {
+		return 0, t.errorf("%d is out of range; the maximum is %d",
+			int32(value), maximum)
+	}
+	if (value % scale) != 0 {
+		return 0, t.errorf("%d must be a multiple of %d", value, scale)
+	}
+	return uint16(value / scale), nil
+}
+
+// Returns false for registers, including those followed by a shift, as well
+// as addresses and register lists.
+func isImmediateOperand(t assemblerToken) bool {
+	if space := strings.IndexAny(t.text, " \t"); space >= 0 {
+		t = t.slice(0, space)
+	}
+	return !isRegisterOperand(t) && !strings.HasPrefix(t.text, "[") &&
+		!strings.HasPrefix(t.text, "{")
+}
+
+// Returns an error for a UAL statement without an "s" outside an IT block,
+// which must not set the flags and so has no 16-bit encoding.
+func (s *thumbAssemblerStatement) requireFlags() error {
+	if s.setFlags || s.inITBlock {
+		return nil
+	}
+	return s.errorf("%s without an \"s\" has no 16-bit encoding outside an "+
+		"IT block", s.mnemonic.text)
+}
+
+// Removes a repeated destination register from UAL forms such as
+// "ands r0, r0, r1", which the THUMB instructions only support with two
+// operands. Without the "s", the UAL form doesn't set the flags, so it's
+// left to the Thumb-2 instructions outside IT blocks.
+func (s *thumbAssemblerStatement) twoOperands() ([]assemblerToken, error) {
+	e := s.maximumOperands(3)
+	if e != nil {
+		return nil, e
+	}
+	operands := s.operands
+	if len(operands) == 3 {
+		e = s.requireFlags()
+		if e != nil {
+			return nil, e
+		}
+		rd, _ := parseAssemblerRegister(operands[0])
+		rn, ok := parseAssemblerRegister(operands[1])
+		if !ok || (rn != rd) {
+			return nil, operands[1].errorf("%s requires the first two "+
+				"registers to match", s.mnemonic.text)
+		}
+		operands = []assemblerToken{operands[0], operands[2]}
+	}
+	if len(operands) != 2 {
+		return nil, s.errorf("%s requires 2 operands", s.mnemonic.text)
+	}
+	return operands, nil
+}
+
+func (s *thumbAssemblerStatement) encodeALUOperation(opcode uint16,
+	operands []assemblerToken) (uint16, error) {
+	rd, e := expectLowRegister(operands[0])
+	if e != nil {
+		return 0, e
+	}
+	rs, e := expectLowRegister(operands[1])
+	if e != nil {
+		return 0, e
+	}
+	return 0x4000 | (opcode << 6) | (rs << 3) | rd, nil
+}
+
+func thumbALUOpcode(name string) (uint16, bool) {
+	for i, n := range opcodeStringsTHUMB {
+		if n == name {
+			return uint16(i), true
+		}
+	}
+	return 0, false
+}
+
+func (s *thumbAssemblerStatement) encodeShift() (uint16, error) {
+	e := s.maximumOperands(3)
+	if e != nil {
+		return 0, e
+	}
+	operands := s.operands
+	if len(operands) < 2 {
+		return 0, s.errorf("%s requires 2 or 3 operands", s.mnemonic.text)
+	}
+	if !isImmediateOperand(operands[len(operands)-1]) {
+		operands, e := s.twoOperands()
+		if e != nil {
+			return 0, e
+		}
+		opcode, _ := thumbALUOpcode(s.name)
+		return s.encodeALUOperation(opcode, operands)
+	}
+	if len(operands) == 2 {
+		operands = []assemblerToken{operands[0], operands[0], operands[1]}
+	}
+	if len(operands) != 3 {
+		return 0, s.errorf("%s requires 2 or 3 operands", s.mnemonic.text)
+	}
+	rd, e := expectLowRegister(operands[0])
+	if e != nil {
+		return 0, e
+	}
+	rs, e := expectLowRegister(operands[1])
+	if e != nil {
+		return 0, e
+	}
+	operation := uint16(strings.Index("lsllsrasr", s.name) / 3)
+	maximum := uint32(32)
+	if operation == 0 {
+		maximum = 31
+	}
+	amount, e := s.immediate(operands[2], maximum, 1)
+	if e != nil {
+		return 0, e
+	}
+	if (operation != 0) && (amount == 0) {
+		return 0, operands[2].errorf("%s requires a shift of 1 to 32",
+			s.name)
+	}
+	return (operation << 11) | ((amount & 0x1f) << 6) | (rs << 3) | rd, nil
+}
+
+// Encodes the high register forms of add, cmp and mov.
+func (s *thumbAssemblerStatement) encodeHighRegisterOperation(
+	operation uint16, operands []assemblerToken) (uint16, error) {
+	rd, e := expectAssemblerRegister(operands[0])
+	if e != nil {
+		return 0, e
+	}
+	rs, e := expectAssemblerRegister(operands[1])
+	if e != nil {
+		return 0, e
+	}
+	raw := 0x4400 | (operation << 8) | (uint16(rs&7) << 3) | uint16(rd&7)
+	if rd > 7 {
+		raw |= 0x80
+	}
+	if rs > 7 {
+		raw |= 0x40
+	}
+	return raw, nil
+}
+
+// Returns the value of the PC used by PC-relative loads and adr, which is
+// word-aligned.
+func (s *thumbAssemblerStatement) alignedPC() uint32 {
+	return (s.item.address + 4) &^ 3
+}
+
+// Encodes add or sub with a PC or SP source.
+func (s *thumbAssemblerStatement) encodeLoadAddress(rd uint16,
+	source ARMRegister, t assemblerToken) (uint16, error) {
+	if s.name != "add" {
+		return 0, s.errorf("Only add can use pc or sp as a source")
+	}
+	offset, e := s.immediate(t, 1020, 4)
+	if e != nil {
+		return 0, e
+	}
+	raw := 0xa000 | (rd << 8) | offset
+	if source == 13 {
+		raw |= 0x800
+	}
+	return raw, nil
+}
+
+// Encodes adding or subtracting an immediate from SP.
+func (s *thumbAssemblerStatement) encodeAdjustSP(t assemblerToken) (uint16,
+	error) {
+	t = stripAssemblerHash(t)
+	value, e := s.a.evaluate(t, s.item.index, s.item.address)
+	if e != nil {
+		return 0, e
+	}
+	offset := int32(value)
+	if s.name == "sub" {
+		offset = -offset
+	}
+	raw := uint16(0xb000)
+	if offset < 0 {
+		raw |= 0x80
+		offset = -offset
+	}
+	if (offset > 508) || ((offset & 3) != 0) {
+		return 0, t.errorf("The stack pointer adjustment must be a "+
+			"multiple of 4 up to 508, got %d", offset)
+	}
+	return raw | uint16(offset>>2), nil
+}
+
+func (s *thumbAssemblerStatement) encodeAddSubtract() (uint16, error) {
+	operands := s.operands
+	subtract := uint16(0)
+	if s.name == "sub" {
+		subtract = 1
+	}
+	e := s.maximumOperands(3)
+	if e != nil {
+		return 0, e
+	}
+	if len(operands) < 2 {
+		return 0, s.errorf("%s requires 2 or 3 operands", s.mnemonic.text)
+	}
+	rd, e := expectAssemblerRegister(operands[0])
+	if e != nil {
+		return 0, e
+	}
+	if (rd == 13) && ((len(operands) == 3) ||
+		isImmediateOperand(operands[1])) {
+		// add sp, #imm or add sp, sp, #imm
+		if len(operands) == 3 {
+			rn, _ := parseAssemblerRegister(operands[1])
+			if rn != 13 {
+				return 0, operands[1].errorf("Expected sp")
+			}
+		}
+		return s.encodeAdjustSP(operands[len(operands)-1])
+	}
+	if len(operands) == 2 {
+		if !isImmediateOperand(operands[1]) {
+			if s.name == "sub" {
+				return 0, operands[1].errorf("sub requires 3 operands")
+			}
+			return s.encodeHighRegisterOperation(0, operands)
+		}
+		low, e := expectLowRegister(operands[0])
+		if e != nil {
+			return 0, e
+		}
+		value, e := s.immediate(operands[1], 255, 1)
+		if e != nil {
+			return 0, e
+		}
+		return 0x3000 | (subtract << 11) | (low << 8) | value, nil
+	}
+	low, e := expectLowRegister(operands[0])
+	if e != nil {
+		return 0, e
+	}
+	source, e := expectAssemblerRegister(operands[1])
+	if e != nil {
+		return 0, e
+	}
+	if (source == 13) || (source == 15) {
+		return s.encodeLoadAddress(low, source, operands[2])
+	}
+	rs, e := expectLowRegister(operands[1])
+	if e != nil {
+		return 0, e
+	}
+	if !isImmediateOperand(operands[2]) {
+		rn, e := expectLowRegister(operands[2])
+		if e != nil {
+			return 0, e
+		}
+		return 0x1800 | (subtract << 9) | (rn << 6) | (rs << 3) | low, nil
+	}
+	t := stripAssemblerHash(operands[2])
+	value, e := s.a.evaluate(t, s.item.index, s.item.address)
+	if e != nil {
+		return 0, e
+	}
+	// Use the 8-bit immediate form if the 3-bit immediate is too small. Its
+	// own syntax has two operands, so the UAL rules apply to this one.
+	if (value > 7) && (rs == low) && (value <= 255) {
+		e = s.requireFlags()
+		if e != nil {
+			return 0, e
+		}
+		return 0x3000 | (subtract << 11) | (low << 8) | uint16(value), nil
+	}
+	if value > 7 {
+		return 0, t.errorf("%d is out of range; the maximum is 7",
+			int32(value))
+	}
+	return 0x1c00 | (subtract << 9) | (uint16(value) << 6) | (rs << 3) |
+		low, nil
+}
+
+func (s *thumbAssemblerStatement) encodeMoveCompare() (uint16, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	operation := uint16(0)
+	if s.name == "cmp" {
+		operation = 1
+	}
+	if isImmediateOperand(s.operands[1]) {
+		rd, e := expectLowRegister(s.operands[0])
+		if e != nil {
+			return 0, e
+		}
+		value, e := s.immediate(s.operands[1], 255, 1)
+		if e != nil {
+			return 0, e
+		}
+		return 0x2000 | (operation << 11) | (rd << 8) | value, nil
+	}
+	rd, e := expectAssemblerRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	rs, e := expectAssemblerRegister(s.operands[1])
+	if e != nil {
+		return 0, e
+	}
+	if (rd < 8) && (rs < 8) {
+		if s.name == "cmp" {
+			return s.encodeALUOperation(10, s.operands)
+		}
+		if s.setFlags {
+			// movs between low registers is lsl by 0.
+			return (uint16(rs) << 3) | uint16(rd), nil
+		}
+	}
+	if s.name == "cmp" {
+		operation = 1
+	} else {
+		operation = 2
+	}
+	return s.encodeHighRegisterOperation(operation, s.operands)
+}
+
+// Parses a THUMB address in brackets, returning the base register and the
+// offset, which is either a register or an immediate.
+func (s *thumbAssemblerStatement) parseAddress(t assemblerToken) (
+	ARMRegister, *assemblerToken, error) {
+	if !strings.HasPrefix(t.text, "[") || !strings.HasSuffix(t.text, "]") {
+		return 0, nil, t.errorf("Expected an address in brackets, got %q",
+			t.text)
+	}
+	inside := t.slice(1, len(t.text)-1).split()
+	if (len(inside) == 0) || (len(inside) > 2) {
+		return 0, nil, t.errorf("Invalid address %q", t.text)
+	}
+	rb, e := expectAssemblerRegister(inside[0])
+	if e != nil {
+		return 0, nil, e
+	}
+	if len(inside) == 1 {
+		return rb, nil, nil
+	}
+	return rb, &(inside[1]), nil
+}
+
+// Encodes a load from a literal pool or label, relative to the PC.
+func (s *thumbAssemblerStatement) encodePCRelativeLoad(rd uint16,
+	t assemblerToken) (uint16, error) {
+	pc := s.alignedPC()
+	var offset int32
+	if s.literal != nil {
+		offset = int32(s.literal.address - pc)
+	} else {
+		var e error
+		offset, e = s.a.relativeOffset(t, s.item, pc,
+			-int32(pc-s.item.address))
+		if e != nil {
+			return 0, e
+		}
+	}
+	if (offset < 0) || (offset > 1020) || ((offset & 3) != 0) {
+		if s.literal != nil {
+			return 0, t.errorf("The literal pool is out of range; add a " +
+				".ltorg directive after this instruction")
+		}
+		return 0, t.errorf("The PC-relative offset must be a multiple of 4 "+
+			"from 0 to 1020, got %d", offset)
+	}
+	return 0x4800 | (rd << 8) | uint16(offset>>2), nil
+}
+
+// The opcodes for loads and stores using a register offset.
+var thumbRegisterOffsetOpcodes = map[string]uint16{
+	"str": 0x5000, "strh": 0x5200, "strb": 0x5400, "ldrsb": 0x5600,
+	"ldsb": 0x5600, "ldr": 0x5800, "ldrh": 0x5a00, "ldrb": 0x5c00,
+	"ldrsh": 0x5e00, "ldsh": 0x5e00,
+}
+
+func (s *thumbAssemblerStatement) encodeLoadStore() (uint16, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	rd, e := expectLowRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	t := s.operands[1]
+	if !strings.HasPrefix(t.text, "[") {
+		if s.name != "ldr" {
+			return 0, t.errorf("%s requires an address in brackets",
+				s.mnemonic.text)
+		}
+		return s.encodePCRelativeLoad(rd, t)
+	}
+	rb, offset, e := s.parseAddress(t)
+	if e != nil {
+		return 0, e
+	}
+	if (offset != nil) && !isImmediateOperand(*offset) {
+		ro, e := expectLowRegister(*offset)
+		if e != nil {
+			return 0, e
+		}
+		low, e := expectLowRegister(t.slice(1, len(t.text)-1).split()[0])
+		if e != nil {
+			return 0, e
+		}
+		return thumbRegisterOffsetOpcodes[s.name] | (ro << 6) | (low << 3) |
+			rd, nil
+	}
+	zero := assemblerToken{"0", t.line, t.column}
+	if offset == nil {
+		offset = &zero
+	}
+	if (rb == 15) || (rb == 13) {
+		switch {
+		case (rb == 15) && (s.name == "ldr"):
+			value, e := s.immediate(*offset, 1020, 4)
+			if e != nil {
+				return 0, e
+			}
+			return 0x4800 | (rd << 8) | value, nil
+		case (rb == 13) && (s.name == "ldr"):
+			value, e := s.immediate(*offset, 1020, 4)
+			if e != nil {
+				return 0, e
+			}
+			return 0x9800 | (rd << 8) | value, nil
+		case (rb == 13) && (s.name == "str"):
+			value, e := s.immediate(*offset, 1020, 4)
+			if e != nil {
+				return 0, e
+			}
+			return 0x9000 | (rd << 8) | value, nil
+		}
+		return 0, t.errorf("%s can't use %s as a base register",
+			s.mnemonic.text, rb)
+	}
+	if rb > 7 {
+		return 0, t.errorf("Expected a low base register (r0-r7), got %s",
+			rb)
+	}
+	base := (uint16(rb) << 3) | rd
+	var raw uint16
+	var value uint16
+	switch s.name {
+	case "str", "ldr":
+		raw = 0x6000
+		value, e = s.immediate(*offset, 124, 4)
+	case "strb", "ldrb":
+		raw = 0x7000
+		value, e = s.immediate(*offset, 31, 1)
+	case "strh", "ldrh":
+		raw = 0x8000
+		value, e = s.immediate(*offset, 62, 2)
+	default:
+		return 0, offset.errorf("%s requires a register offset",
+			s.mnemonic.text)
+	}
+	if e != nil {
+		return 0, e
+	}
+	if strings.HasPrefix(s.name, "ldr") {
+		raw |= 0x800
+	}
+	return raw | (value << 6) | base, nil
+}
+
+// Parses a register list for push, pop, ldmia or stmia, returning the low
+// registers and whether the given extra register was included.
+func (s *thumbAssemblerStatement) registerList(t assemblerToken,
+	extra ARMRegister) (uint16, error) {
+	registers, e := parseAssemblerRegisterList(t)
+	if e != nil {
+		return 0, e
+	}
+	toReturn := registers & 0xff
+	if (extra != 0) && ((registers & (1 << extra)) != 0) {
+		registers &^= 1 << extra
+		toReturn |= 0x100
+	}
+	if (registers & 0xff00) != 0 {
+		return 0, t.errorf("%s can't use the registers in %s",
+			s.mnemonic.text, t.text)
+	}
+	return toReturn, nil
+}
+
+func (s *thumbAssemblerStatement) encodePushPop() (uint16, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	if s.name == "push" {
+		registers, e := s.registerList(s.operands[0], 14)
+		return 0xb400 | registers, e
+	}
+	registers, e := s.registerList(s.operands[0], 15)
+	return 0xbc00 | registers, e
+}
+
+func (s *thumbAssemblerStatement) encodeMultipleLoadStore() (uint16, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	base := s.operands[0]
+	if !strings.HasSuffix(base.text, "!") {
+		return 0, base.errorf("%s requires writeback (%s!)",
+			s.mnemonic.text, base.text)
+	}
+	rb, e := expectLowRegister(base.slice(0, len(base.text)-1))
+	if e != nil {
+		return 0, e
+	}
+	registers, e := s.registerList(s.operands[1], 0)
+	if e != nil {
+		return 0, e
+	}
+	raw := 0xc000 | (rb << 8) | registers
+	if strings.HasPrefix(s.name, "ldm") {
+		raw |= 0x800
+	}
+	return raw, nil
+}
+
+// Returns the offset of a branch target from the PC, which is 4 bytes after
+// the instruction.
+func (s *thumbAssemblerStatement) branchOffset(minimum,
+	maximum int32) (int32, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	t := s.operands[0]
+	offset, e := s.a.relativeOffset(t, s.item, s.item.address+4, 0)
+	if e != nil {
+		return 0, e
+	}
+	if (offset < minimum) || (offset > maximum) {
+		return 0, t.errorf("The branch target is out of range")
+	}
+	if (offset & 1) != 0 {
+		return 0, t.errorf("The branch target must be halfword-aligned")
+	}
+	return offset, nil
+}
+
+func (s *thumbAssemblerStatement) encodeConditionalBranch(
+	condition uint32) (uint16, error) {
+	offset, e := s.branchOffset(-256, 254)
+	if e != nil {
+		return 0, e
+	}
+	return 0xd000 | uint16(condition<<8) | (uint16(offset>>1) & 0xff), nil
+}
+
+func (s *thumbAssemblerStatement) encodeBranch() (uint16, error) {
+	offset, e := s.branchOffset(-2048, 2046)
+	if e != nil {
+		return 0, e
+	}
+	return 0xe000 | (uint16(offset>>1) & 0x7ff), nil
+}
+
+// Encodes the two halfwords of bl or blx with a label. Within 4MB, these are
+// the same as the pairs of 16-bit instructions used before Thumb-2, which
+// extends the range to 16MB.
+func (s *thumbAssemblerStatement) encodeLongBranch() ([]uint16, error) {
+	offset, e := s.branchOffset(-0x1000000, 0xfffffe)
+	if e != nil {
+		return nil, e
+	}
+	n := BranchTHUMB2Instruction{
+		Condition: 14,
+		Link:      true,
+		Exchange:  s.name == "blx",
+	}
+	if n.Exchange {
+		// The target of blx is word-aligned, and the lowest bit of the
+		// offset must be clear.
+		offset = (offset + 2) &^ 3
+	}
+	n.Offset = uint32(offset>>1) & 0xffffff
+	raw, e := n.Encode()
+	if e != nil {
+		return nil, s.errorf("%s", e)
+	}
+	return []uint16{uint16(raw >> 16), uint16(raw)}, nil
+}
+
+func (s *thumbAssemblerStatement) encodeCompareBranch() (uint16, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	rn, e := expectLowRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	t := s.operands[1]
+	offset, e := s.a.relativeOffset(t, s.item, s.item.address+4, 0)
+	if e != nil {
+		return 0, e
+	}
+	if (offset < 0) || (offset > 126) || ((offset & 1) != 0) {
+		return 0, t.errorf("The branch target must be an even number of "+
+			"bytes from 0 to 126 after the PC, got %d", offset)
+	}
+	n := CompareBranchTHUMBInstruction{
+		Rn:      ARMRegister(rn),
+		Offset:  uint8(offset >> 1),
+		NonZero: s.name == "cbnz",
+	}
+	return n.Encode()
+}
+
+// Removes the comment printed by the disassembler after each half of a long
+// branch.
+func stripLongBranchComment(operands assemblerToken) (assemblerToken, bool) {
+	const comment = "(long branch and link)"
+	if !strings.HasSuffix(strings.ToLower(operands.text), comment) {
+		return operands, false
+	}
+	return operands.slice(0, len(operands.text)-len(comment)), true
+}
+
+// Encodes a single half of a long branch, in the format printed by the
+// disassembler: "add lr, pc, N" for the first half, and "bl lr + N" or
+// "blx lr + N" for the second.
+func (s *thumbAssemblerStatement) encodeLongBranchHalf() (uint16, error) {
+	if s.name == "add" {
+		e := s.expectOperands(3)
+		if e != nil {
+			return 0, e
+		}
+		t := stripAssemblerHash(s.operands[2])
+		value, e := s.a.evaluate(t, s.item.index, s.item.address)
+		if e != nil {
+			return 0, e
+		}
+		offset := int32(value)
+		if (offset < -0x400000) || (offset > 0x3ff000) ||
+			((offset & 0xfff) != 0) {
+			return 0, t.errorf("Invalid long branch offset %d", offset)
+		}
+		return 0xf000 | (uint16(offset>>12) & 0x7ff), nil
+	}
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	t := s.operands[0]
+	plus := strings.IndexByte(t.text, '+')
+	if (plus < 0) || (strings.ToLower(strings.TrimSpace(
+		t.text[:plus])) != "lr") {
+		return 0, t.errorf("Expected lr + offset, got %q", t.text)
+	}
+	value, e := s.immediate(t.slice(plus+1, len(t.text)), 0xffe, 2)
+	if e != nil {
+		return 0, e
+	}
+	if s.name == "blx" {
+		return 0xe800 | value, nil
+	}
+	return 0xf800 | value, nil
+}
+
+// Encodes ldr rX, =value, which always uses a literal pool.
+func (s *thumbAssemblerStatement) encodeLiteralLoad() (uint16, error) {
+	rd, e := expectLowRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	return s.encodePCRelativeLoad(rd, s.operands[1])
+}
+
+func (s *thumbAssemblerStatement) encodeAddress() (uint16, error) {
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	rd, e := expectLowRegister(s.operands[0])
+	if e != nil {
+		return 0, e
+	}
+	pc := s.alignedPC()
+	offset, e := s.a.relativeOffset(s.operands[1], s.item, pc,
+		-int32(pc-s.item.address))
+	if e != nil {
+		return 0, e
+	}
+	if (offset < 0) || (offset > 1020) || ((offset & 3) != 0) {
+		return 0, s.operands[1].errorf("The address must be a multiple of "+
+			"4 from 0 to 1020 bytes after the PC, got %d", offset)
+	}
+	return 0xa000 | (rd << 8) | uint16(offset>>2), nil
+}
+
+// Encodes the instructions which take a single 8-bit immediate.
+func (s *thumbAssemblerStatement) encodeComment(raw uint16) (uint16, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	value, e := s.immediate(s.operands[0], 255, 1)
+	return raw | value, e
+}
+
+// Encodes the ARMv6 instructions which operate on two low registers, such as
+// sxth and rev.
+func (s *thumbAssemblerStatement) encodeTwoLowRegisters(raw uint16) (uint16,
+	error) {
+	r, e := s.lowRegisters(2)
+	if e != nil {
+		return 0, e
+	}
+	return raw | (r[1] << 3) | r[0], nil
+}
+
+func (s *thumbAssemblerStatement) encodeSetEndianness() (uint16, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	switch s.operands[0].lower() {
+	case "le":
+		return 0xb650, nil
+	case "be":
+		return 0xb658, nil
+	}
+	return 0, s.operands[0].errorf("Expected be or le, got %q",
+		s.operands[0].text)
+}
+
+func (s *thumbAssemblerStatement) encodeChangeProcessorState() (uint16,
+	error) {
+	raw := uint16(0xb660)
+	if s.name == "cpsid" {
+		raw |= 0x10
+	}
+	if len(s.operands) == 0 {
+		return raw, nil
+	}
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	for _, c := range s.operands[0].lower() {
+		bit := strings.IndexRune("aif", c)
+		if bit < 0 {
+			return 0, s.operands[0].errorf("Invalid cps flag %q", c)
+		}
+		raw |= 4 >> uint(bit)
+	}
+	return raw, nil
+}
+
+// Encodes yield, wfe, wfi, sev and "hint N" for the other hints.
+func (s *thumbAssemblerStatement) encodeHint() (uint16, error) {
+	if s.name != "hint" {
+		e := s.expectOperands(0)
+		if e != nil {
+			return 0, e
+		}
+		for i, name := range hintStrings {
+			if name == s.name {
+				return 0xbf00 | uint16(i<<4), nil
+			}
+		}
+	}
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	value, e := s.immediate(s.operands[0], 15, 1)
+	return 0xbf00 | (value << 4), e
+}
+
+// Returns true for it, followed by up to three t or e letters for the other
+// instructions in the IT block.
+func isITMnemonic(name string) bool {
+	return strings.HasPrefix(name, "it") && (len(name) <= 5) &&
+		(strings.Trim(name[2:], "te") == "")
+}
+
+// Returns the condition of each instruction in the IT block started by the
+// given it, ite, itt, etc.
+func ifThenConditions(name string, condition uint32) []uint32 {
+	toReturn := []uint32{condition}
+	for _, c := range name[2:] {
+		if c == 't' {
+			toReturn = append(toReturn, condition)
+		} else {
+			toReturn = append(toReturn, condition^1)
+		}
+	}
+	return toReturn
+}
+
+// Removes the condition suffix from the name of an instruction in an IT
+// block, which must match the block's condition for the instruction. The
+// suffix is optional if the instruction is always executed.
+func stripITCondition(mnemonic assemblerToken, name string,
+	condition uint32) (string, error) {
+	for suffix, value := range assemblerConditions {
+		if (value == condition) && (suffix != "") &&
+			(len(name) > len(suffix)) && strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), nil
+		}
+	}
+	if condition >= 14 {
+		return name, nil
+	}
+	return "", mnemonic.errorf("%s in an IT block requires the %s "+
+		"condition", mnemonic.text, ARMCondition(condition))
+}
+
+func (s *thumbAssemblerStatement) encodeIfThen() (uint16, error) {
+	e := s.expectOperands(1)
+	if e != nil {
+		return 0, e
+	}
+	t := s.operands[0]
+	condition, ok := assemblerConditions[t.lower()]
+	if !ok || (t.text == "") {
+		return 0, t.errorf("Expected a condition, got %q", t.text)
+	}
+	// Each following instruction uses the condition if its mask bit matches
+	// the condition's lowest bit, and the last 1 bit ends the mask.
+	n := IfThenTHUMBInstruction{FirstCondition: ARMCondition(condition)}
+	bit := uint8(8)
+	for _, c := range s.name[2:] {
+		if (c == 't') == ((condition & 1) != 0) {
+			n.Mask |= bit
+		}
+		bit >>= 1
+	}
+	n.Mask |= bit
+	return n.Encode()
+}
+
+// Returns true if the 16-bit instruction sets the condition flags outside an
+// IT block, apart from the comparisons which always do.
+func thumbSetsFlags(raw uint16) bool {
+	switch {
+	case raw >= 0x4400:
+		return false
+	case (raw & 0xf800) == 0x2800:
+		// cmp with an immediate
+		return false
+	case ((raw & 0xff00) == 0x4200) && ((raw & 0xc0) != 0x40):
+		// tst, cmp and cmn, but not neg
+		return false
+	}
+	return true
+}
+
+// Encodes the statement as 16-bit THUMB instructions, checking that they set
+// the flags as requested.
+func (s *thumbAssemblerStatement) encodeNarrow() ([]uint16, error) {
+	halfwords, e := s.encode()
+	if e != nil {
+		return nil, e
+	}
+	if len(halfwords) == 2 {
+		raw := (uint32(halfwords[0]) << 16) | uint32(halfwords[1])
+		_, e = ParseTHUMB2Instruction(raw)
+		if e != nil {
+			return nil, s.errorf("Invalid instruction (0x%08x): %s", raw, e)
+		}
+		return halfwords, nil
+	}
+	raw := halfwords[0]
+	if s.setFlags && (s.inITBlock || !thumbSetsFlags(raw)) {
+		return nil, s.errorf("%s has no 16-bit encoding which sets the "+
+			"flags here", s.mnemonic.text)
+	}
+	_, e = ParseTHUMBInstructionForArchitecture(raw, ARMv7)
+	if e != nil {
+		return nil, s.errorf("Invalid instruction (0x%04x): %s", raw, e)
+	}
+	return halfwords, nil
+}
+
+// Encodes a THUMB instruction, returning one halfword, or two for bl and
+// blx.
+func (s *thumbAssemblerStatement) encode() ([]uint16, error) {
+	single := func(raw uint16, e error) ([]uint16, error) {
+		if e != nil {
+			return nil, e
+		}
+		return []uint16{raw}, nil
+	}
+	if s.literal != nil {
+		return single(s.encodeLiteralLoad())
+	}
+	switch s.name {
+	case "lsl", "lsr", "asr":
+		return single(s.encodeShift())
+	case "add", "sub":
+		return single(s.encodeAddSubtract())
+	case "mov", "cmp":
+		return single(s.encodeMoveCompare())
+	case "and", "eor", "adc", "sbc", "ror", "tst", "neg", "cmn", "orr", "bic",
+		"mvn":
+		operands, e := s.twoOperands()
+		if e != nil {
+			return nil, e
+		}
+		opcode, _ := thumbALUOpcode(s.name)
+		return single(s.encodeALUOperation(opcode, operands))
+	case "mul":
+		e := s.maximumOperands(3)
+		if e != nil {
+			return nil, e
+		}
+		operands := s.operands
+		// The UAL form repeats the destination as the last operand.
+		if len(operands) == 3 {
+			e = s.requireFlags()
+			if e != nil {
+				return nil, e
+			}
+			rd, _ := parseAssemblerRegister(operands[0])
+			rm, ok := parseAssemblerRegister(operands[2])
+			if !ok || (rd != rm) {
+				return nil, operands[2].errorf("mul requires the first " +
+					"and last registers to match")
+			}
+			operands = operands[:2]
+		}
+		if len(operands) != 2 {
+			return nil, s.errorf("mul requires 2 operands")
+		}
+		return single(s.encodeALUOperation(13, operands))
+	case "bx", "blx":
+		if (s.name == "blx") && ((len(s.operands) != 1) ||
+			!isRegisterOperand(s.operands[0])) {
+			return s.encodeLongBranch()
+		}
+		e := s.expectOperands(1)
+		if e != nil {
+			return nil, e
+		}
+		rm, e := expectAssemblerRegister(s.operands[0])
+		if e != nil {
+			return nil, e
+		}
+		raw := 0x4700 | (uint16(rm) << 3)
+		if s.name == "blx" {
+			raw |= 0x80
+		}
+		return []uint16{raw}, nil
+	case "bl":
+		return s.encodeLongBranch()
+	case "cbz", "cbnz":
+		return single(s.encodeCompareBranch())
+	case "ldr", "str", "ldrb", "strb", "ldrh", "strh", "ldrsb", "ldrsh",
+		"ldsb", "ldsh":
+		return single(s.encodeLoadStore())
+	case "adr":
+		return single(s.encodeAddress())
+	case "push", "pop":
+		return single(s.encodePushPop())
+	case "ldmia", "stmia", "ldm", "stm", "ldmfd", "stmea":
+		return single(s.encodeMultipleLoadStore())
+	case "b":
+		return single(s.encodeBranch())
+	case "swi", "svc":
+		return single(s.encodeComment(0xdf00))
+	case "bkpt":
+		return single(s.encodeComment(0xbe00))
+	case "sxth":
+		return single(s.encodeTwoLowRegisters(0xb200))
+	case "sxtb":
+		return single(s.encodeTwoLowRegisters(0xb240))
+	case "uxth":
+		return single(s.encodeTwoLowRegisters(0xb280))
+	case "uxtb":
+		return single(s.encodeTwoLowRegisters(0xb2c0))
+	case "rev":
+		return single(s.encodeTwoLowRegisters(0xba00))
+	case "rev16":
+		return single(s.encodeTwoLowRegisters(0xba40))
+	case "revsh":
+		return single(s.encodeTwoLowRegisters(0xbac0))
+	case "setend":
+		return single(s.encodeSetEndianness())
+	case "cpsie", "cpsid":
+		return single(s.encodeChangeProcessorState())
+	case "nop":
+		e := s.expectOperands(0)
+		if e != nil {
+			return nil, e
+		}
+		// mov r8, r8
+		return []uint16{0x46c0}, nil
+	case "yield", "wfe", "wfi", "sev", "hint":
+		return single(s.encodeHint())
+	case "rsb":
+		// rsbs rd, rs, #0 is the UAL name for neg.
+		e := s.requireFlags()
+		if e != nil {
+			return nil, e
+		}
+		e = s.expectOperands(3)
+		if e != nil {
+			return nil, e
+		}
+		t := stripAssemblerHash(s.operands[2])
+		value, e := s.a.evaluate(t, s.item.index, s.item.address)
+		if e != nil {
+			return nil, e
+		}
+		if value != 0 {
+			return nil, t.errorf("rsb only supports an immediate of 0 in " +
+				"16-bit THUMB instructions")
+		}
+		return single(s.encodeALUOperation(9, s.operands[:2]))
+	}
+	if isITMnemonic(s.name) {
+		return single(s.encodeIfThen())
+	}
+	if strings.HasPrefix(s.name, "b") {
+		condition, ok := assemblerConditions[s.name[1:]]
+		if ok && (condition < 14) {
+			return single(s.encodeConditionalBranch(condition))
+		}
+	}
+	return nil, s.errorf("Unknown THUMB instruction %q", s.mnemonic.text)
+}
+
+// The mnemonics which accept an "s" suffix in THUMB state.
+var thumbFlagSettingMnemonics = map[string]bool{
+	"lsl": true, "lsr": true, "asr": true, "add": true, "sub": true,
+	"mov": true, "and": true, "eor": true, "adc": true, "sbc": true,
+	"ror": true, "neg": true, "rsb": true, "orr": true, "mul": true,
+	"bic": true, "mvn": true, "orn": true, "rrx": true,
+}
+
+// Returns the size, in bytes, of a THUMB instruction with the given operands.
+func thumbInstructionSize(name string, operands []assemblerToken) uint32 {
+	if name == "bl" {
+		return 4
+	}
+	if (name == "blx") && ((len(operands) != 1) ||
+		!isRegisterOperand(operands[0])) {
+		return 4
+	}
+	return 2
+}
+
+// Returns true if the error was reported at the statement's mnemonic, which
+// usually means the instruction doesn't exist in that form.
+func (s *thumbAssemblerStatement) isMnemonicError(e error) bool {
+	assemblerError, ok := e.(*AssemblerError)
+	return ok && (assemblerError.Line == s.mnemonic.line) &&
+		(assemblerError.Column == s.mnemonic.column)
+}
+
+// Decides whether to use a 32-bit Thumb-2 instruction, which is only done if
+// the statement has no 16-bit encoding. Symbols which aren't defined yet are
+// assumed to fit in the 16-bit instructions, unless they're only used by
+// them. If neither encoding works, this returns the error from the one which
+// got furthest.
+func (s *thumbAssemblerStatement) chooseWidth() (bool, error) {
+	_, narrowError := s.encodeNarrow()
+	if narrowError == nil {
+		return false, nil
+	}
+	_, wideError := s.encodeWide()
+	if wideError == nil {
+		return true, nil
+	}
+	if _, ok := narrowError.(*assemblerUndefinedSymbolError); ok {
+		return false, nil
+	}
+	if _, ok := wideError.(*assemblerUndefinedSymbolError); ok {
+		return true, nil
+	}
+	if s.isMnemonicError(wideError) && !s.isMnemonicError(narrowError) {
+		return false, narrowError
+	}
+	return false, wideError
+}
+
+func (a *assembler) addTHUMBInstruction(mnemonic,
+	operands assemblerToken) error {
+	name := mnemonic.lower()
+	s := &thumbAssemblerStatement{
+		a:        a,
+		mnemonic: mnemonic,
+	}
+	// A ".w" or ".n" suffix selects a 32-bit or 16-bit instruction.
+	width := ""
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		width = name[dot+1:]
+		name = name[:dot]
+		if (width != "w") && (width != "n") {
+			return mnemonic.errorf("Invalid width suffix %q; expected .w "+
+				"or .n", "."+width)
+		}
+	}
+	var e error
+	if len(a.itConditions) > 0 {
+		if isITMnemonic(name) {
+			return mnemonic.errorf("%s can't be used in an IT block",
+				mnemonic.text)
+		}
+		s.inITBlock = true
+		name, e = stripITCondition(mnemonic, name, a.itConditions[0])
+		if e != nil {
+			return e
+		}
+		a.itConditions = a.itConditions[1:]
+	}
+	s.name = name
+	if trimmed := strings.TrimSuffix(name, "s"); (trimmed != name) &&
+		thumbFlagSettingMnemonics[trimmed] {
+		s.name = trimmed
+		s.setFlags = true
+	}
+	operands, longBranchHalf := stripLongBranchComment(operands)
+	s.operands, e = operands.splitOperands()
+	if e != nil {
+		return e
+	}
+	if isITMnemonic(s.name) && (len(s.operands) == 1) {
+		condition, ok := assemblerConditions[s.operands[0].lower()]
+		if ok {
+			a.itConditions = ifThenConditions(s.name, condition)
+		}
+	}
+	if (s.name == "ldr") && (len(s.operands) == 2) &&
+		strings.HasPrefix(s.operands[1].text, "=") {
+		value := s.operands[1].slice(1, len(s.operands[1].text))
+		s.literal = a.addLiteral(value)
+	}
+	// The width is chosen using the address this statement will have.
+	s.item = &assemblerItem{
+		address: a.address,
+		thumb:   true,
+		index:   len(a.items),
+	}
+	switch {
+	case longBranchHalf || (width == "n"):
+	case width == "w":
+		s.wide = true
+	case s.literal != nil:
+		// Literal pools are placed later, so the 16-bit load is used unless
+		// the register can't be used with it.
+		r, ok := parseAssemblerRegister(s.operands[0])
+		s.wide = ok && (r > 7)
+	default:
+		s.wide, e = s.chooseWidth()
+		if e != nil {
+			return e
+		}
+	}
+	size := thumbInstructionSize(s.name, s.operands)
+	if longBranchHalf {
+		size = 2
+	} else if s.wide {
+		size = 4
+	}
+	item, e := a.addItem(mnemonic, size, nil)
+	if e != nil {
+		return e
+	}
+	s.item = item
+	if s.literal != nil {
+		s.literal.item = item
+	}
+	item.encode = func() ([]byte, error) {
+		var halfwords []uint16
+		var e error
+		switch {
+		case longBranchHalf:
+			var raw uint16
+			raw, e = s.encodeLongBranchHalf()
+			if e == nil {
+				// Each half is a separate instruction before Thumb-2.
+				_, e = ParseTHUMBInstruction(raw)
+				if e != nil {
+					e = mnemonic.errorf("Invalid instruction (0x%04x): %s",
+						raw, e)
+				}
+			}
+			halfwords = []uint16{raw}
+		case s.wide:
+			var raw uint32
+			raw, e = s.encodeWide()
+			halfwords = []uint16{uint16(raw >> 16), uint16(raw)}
+		default:
+			halfwords, e = s.encodeNarrow()
+		}
+		if e != nil {
+			return nil, e
+		}
+		toReturn := make([]byte, 0, 2*len(halfwords))
+		for _, raw := range halfwords {
+			toReturn = append(toReturn, a.halfwordBytes(raw)...)
+		}
+		return toReturn, nil
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package arm_emulate
+
+// This file implements the ARMMemory interface used by the CP15 memory
+// management and protection units to check accesses before passing them on to
+// the processor's original memory.
+
+// This is implemented by the CP15 variants which check memory accesses.
+type addressTranslator interface {
+	// Returns the physical address to use for the given access, or an error
+	// if the access isn't allowed. The size is the size of the access, and
+	// fetch is set for instruction fetches.
+	translate(address uint32, size uint8, write, fetch bool) (uint32, error)
+	// Like translate, but for reads made by debugging tools, which mustn't
+	// change the translator's state.
+	debugTranslate(address uint32) (uint32, error)
+	// Returns the error to use when the access to physical memory fails.
+	externalAbort(address uint32, fetch bool) error
+	// Called when the memory's endianness is changed.
+	setBigEndianBit(bigEndian bool)
+}
+
+// Returns true if the given two-bit access permissions allow the access. In an
+// MMU, the meaning of 0 also depends on the S and R bits in CP15, so it must
+// be handled separately.
+func accessPermitted(accessPermissions uint8, write, privileged bool) bool {
+	switch accessPermissions {
+	case 0:
+		return false
+	case 1:
+		return privileged
+	case 2:
+		return privileged || !write
+	}
+	return true
+}
+
+// The ARMMemory interface installed in the processor by the CP15 memory
+// management or protection units. Reads and writes are checked, and possibly
+// translated, by the translator, but the functions for mapping memory and
+// devices use physical addresses.
+type translatingMemory struct {
+	translator addressTranslator
+	physical   ARMMemory
+	accessHook MemoryAccessHook
+	// This is set while accessing physical memory on behalf of a translated
+	// access, so that page table walks aren't passed to the access hook.
+	// virtualOffset converts the physical address passed to the hook back to
+	// the virtual address.
+	accessing     bool
+	virtualOffset uint32
+}
+
+// This is the access hook installed in the physical memory.
+func (m *translatingMemory) physicalAccess(address uint32, size uint8,
+	value uint32, write bool) {
+	if !m.accessing || (m.accessHook == nil) {
+		return
+	}
+	m.accessHook(address+m.virtualOffset, size, value, write)
+}
+
+// Translates the address and prepares to access physical memory. endAccess
+// must be called after the access.
+func (m *translatingMemory) startAccess(address uint32, size uint8, write,
+	fetch bool) (uint32, error) {
+	physical, e := m.translator.translate(address, size, write, fetch)
+	if e != nil {
+		return 0, e
+	}
+	m.accessing = true
+	m.virtualOffset = address - physical
+	return physical, nil
+}
+
+// Ends an access started using startAccess, reporting an external abort if
+// the physical memory access failed.
+func (m *translatingMemory) endAccess(address uint32, fetch bool,
+	e error) error {
+	m.accessing = false
+	if e == nil {
+		return nil
+	}
+	return m.translator.externalAbort(address, fetch)
+}
+
+func (m *translatingMemory) readWord(address uint32, fetch bool) (uint32,
+	error) {
+	physical, e := m.startAccess(address, 4, false, fetch)
+	if e != nil {
+		return 0, e
+	}
+	value, e := m.physical.ReadMemoryWord(physical)
+	return value, m.endAccess(address, fetch, e)
+}
+
+func (m *translatingMemory) readHalfword(address uint32, fetch bool) (uint16,
+	error) {
+	physical, e := m.startAccess(address, 2, false, fetch)
+	if e != nil {
+		return 0, e
+	}
+	value, e := m.physical.ReadMemoryHalfword(physical)
+	return value, m.endAccess(address, fetch, e)
+}
+
+func (m *translatingMemory) ReadMemoryWord(address uint32) (uint32, error) {
+	return m.readWord(address, false)
+}
+
+func (m *translatingMemory) FetchInstructionWord(address uint32) (uint32,
+	error) {
+	return m.readWord(address, true)
+}
+
+func (m *translatingMemory) ReadMemoryHalfword(address uint32) (uint16, error) {
+	return m.readHalfword(address, false)
+}
+
+func (m *translatingMemory) FetchInstructionHalfword(address uint32) (uint16,
+	error) {
+	return m.readHalfword(address, true)
+}
+
+func (m *translatingMemory) ReadMemoryByte(address uint32) (uint8, error) {
+	physical, e := m.startAccess(address, 1, false, false)
+	if e != nil {
+		return 0, e
+	}
+	value, e := m.physical.ReadMemoryByte(physical)
+	return value, m.endAccess(address, false, e)
+}
+
+func (m *translatingMemory) WriteMemoryWord(address, data uint32) error {
+	physical, e := m.startAccess(address, 4, true, false)
+	if e != nil {
+		return e
+	}
+	e = m.physical.WriteMemoryWord(physical, data)
+	return m.endAccess(address, false, e)
+}
+
+func (m *translatingMemory) WriteMemoryHalfword(address uint32,
+	data uint16) error {
+	physical, e := m.startAccess(address, 2, true, false)
+	if e != nil {
+		return e
+	}
+	e = m.physical.WriteMemoryHalfword(physical, data)
+	return m.endAccess(address, false, e)
+}
+
+func (m *translatingMemory) WriteMemoryByte(address uint32, data uint8) error {
+	physical, e := m.startAccess(address, 1, true, false)
+	if e != nil {
+		return e
+	}
+	e = m.physical.WriteMemoryByte(physical, data)
+	return m.endAccess(address, false, e)
+}
+
+func (m *translatingMemory) SetMemoryRegion(baseAddress uint32,
+	memory []byte) error {
+	return m.physical.SetMemoryRegion(baseAddress, memory)
+}
+
+func (m *translatingMemory) ClearMemoryRegion(baseAddress, size uint32) error {
+	return m.physical.ClearMemoryRegion(baseAddress, size)
+}
+
+// Changing the endianness of the memory also updates the B bit in the CP15
+// control register.
+func (m *translatingMemory) SetBigEndian(bigEndian bool) error {
+	m.translator.setBigEndianBit(bigEndian)
+	return m.physical.SetBigEndian(bigEndian)
+}
+
+func (m *translatingMemory) IsBigEndian() bool {
+	return m.physical.IsBigEndian()
+}
+
+// The hook is called with virtual addresses.
+func (m *translatingMemory) SetAccessHook(hook MemoryAccessHook) {
+	m.accessHook = hook
+}
+
+func (m *translatingMemory) MapDevice(baseAddress, size uint32,
+	device MemoryMappedDevice) error {
+	return m.physical.MapDevice(baseAddress, size, device)
+}
+
+func (m *translatingMemory) UnmapDevice(baseAddress uint32) error {
+	return m.physical.UnmapDevice(baseAddress)
+}
+
+// Returns a read-only view of the memory for debugging tools.
+func (m *translatingMemory) debugMemory() ARMMemory {
+	return &translatingDebugMemory{m}
+}
+
+// A read-only view of translatingMemory, used by debugging tools such as the
+// disassembler. Reads don't record faults or call the access hook.
+type translatingDebugMemory struct {
+	*translatingMemory
+}
+
+func (m *translatingDebugMemory) ReadMemoryWord(address uint32) (uint32,
+	error) {
+	physical, e := m.translator.debugTranslate(address)
+	if e != nil {
+		return 0, e
+	}
+	return m.physical.ReadMemoryWord(physical)
+}
+
+func (m *translatingDebugMemory) FetchInstructionWord(address uint32) (uint32,
+	error) {
+	return m.ReadMemoryWord(address)
+}
+
+func (m *translatingDebugMemory) ReadMemoryHalfword(address uint32) (uint16,
+	error) {
+	physical, e := m.translator.debugTranslate(address)
+	if e != nil {
+		return 0, e
+	}
+	return m.physical.ReadMemoryHalfword(physical)
+}
+
+func (m *translatingDebugMemory) FetchInstructionHalfword(
+	address uint32) (uint16, error) {
+	return m.ReadMemoryHalfword(address)
+}
+
+func (m *translatingDebugMemory) ReadMemoryByte(address uint32) (uint8,
+	error) {
+	physical, e := m.translator.debugTranslate(address)
+	if e != nil {
+		return 0, e
+	}
+	return m.physical.ReadMemoryByte(physical)
+}
+
+func (m *translatingDebugMemory) WriteMemoryWord(address, data uint32) error {
+	return &MemoryAccessError{address, "Debug memory is read-only"}
+}
+
+func (m *translatingDebugMemory) WriteMemoryHalfword(address uint32,
+	data uint16) error {
+	return &MemoryAccessError{address, "Debug memory is read-only"}
+}
+
+func (m *translatingDebugMemory) WriteMemoryByte(address uint32,
+	data uint8) error {
+	return &MemoryAccessError{address, "Debug memory is read-only"}
+}
+
+// Replaces the processor's memory interface with one which checks accesses
+// using the given translator. The previous memory interface becomes the
+// physical memory.
+func installTranslatingMemory(p ARMProcessor, t addressTranslator) {
+	physical := p.GetMemoryInterface()
+	memory := &translatingMemory{
+		translator: t,
+		physical:   physical,
+	}
+	p.SetMemoryInterface(memory)
+	physical.SetAccessHook(memory.physicalAccess)
+}
@@ -0,0 +1,796 @@
+package arm_emulate
+
+// This file contains the formatting of ARM instructions using ARM's Unified
+// Assembler Language (UAL), as printed by GNU objdump. The THUMB and VFP
+// instructions are formatted in ual_thumb.go and ual_vfp.go.
+
+import (
+	"fmt"
+)
+
+// Implemented by instructions which can be printed using UAL syntax.
+type ualInstruction interface {
+	ualString(f *ualFormatter) string
+}
+
+// Holds the information needed to print an instruction using UAL syntax.
+type ualFormatter struct {
+	d *Disassembler
+	// The value read from the PC by the instruction.
+	pc uint32
+	// The IT block state for the instruction. This is 0 outside IT blocks.
+	itState uint8
+	// True if the instruction is being printed as part of THUMB code.
+	thumb bool
+}
+
+// GNU objdump uses the APCS names for r9 to r12.
+var ualRegisterStrings = [...]string{"r0", "r1", "r2", "r3", "r4", "r5", "r6",
+	"r7", "r8", "r9", "sl", "fp", "ip", "sp", "lr", "pc"}
+
+func ualRegister(r ARMRegister) string {
+	return ualRegisterStrings[r&0xf]
+}
+
+// Returns a register list containing each register, without ranges.
+func ualRegisterList(registers uint16) string {
+	s := "{"
+	for i := uint8(0); i < 16; i++ {
+		if (registers & (1 << i)) == 0 {
+			continue
+		}
+		if len(s) > 1 {
+			s += ", "
+		}
+		s += ualRegister(ARMRegister(i))
+	}
+	return s + "}"
+}
+
+// Returns a target address, followed by its symbol if it has one.
+func (f *ualFormatter) address(address uint32) string {
+	if f.d.Symbols != nil {
+		name, offset, found := f.d.Symbols.ResolveSymbol(address)
+		if found && (offset == 0) {
+			return fmt.Sprintf("%x <%s>", address, name)
+		}
+		if found {
+			return fmt.Sprintf("%x <%s+0x%x>", address, name, offset)
+		}
+	}
+	return fmt.Sprintf("0x%x", address)
+}
+
+// Returns the condition suffix for an instruction. THUMB instructions take
+// their condition from the IT block.
+func (f *ualFormatter) condition(c ARMCondition) string {
+	if (f.itState & 0xf) != 0 {
+		return conditionStrings[f.itState>>4]
+	}
+	return c.String()
+}
+
+// Returns the suffix of the 16-bit THUMB instructions which set the flags
+// outside of IT blocks. In IT blocks these don't set the flags, and take the
+// block's condition instead.
+func (f *ualFormatter) flags() string {
+	if (f.itState & 0xf) != 0 {
+		return conditionStrings[f.itState>>4]
+	}
+	return "s"
+}
+
+// Returns ".w" when printing the Thumb-2 form of an instruction shared with
+// the ARM instruction set.
+func (f *ualFormatter) wide() string {
+	if f.thumb {
+		return ".w"
+	}
+	return ""
+}
+
+// Like objdump, larger immediate values are repeated in hexadecimal in a
+// comment.
+func ualComment(value int64) string {
+	if (value > 32) || (value < -16) {
+		return fmt.Sprintf("\t; 0x%x", uint32(value))
+	}
+	return ""
+}
+
+// Returns true if the shift leaves a register unchanged.
+func ualNoShift(s ARMShift) bool {
+	return (s == nil) || (!s.UseRegister() && (s.Amount() == 0) &&
+		(s.ShiftType() == 0))
+}
+
+// Formats a register operand along with its shift.
+func ualShiftedRegister(rm ARMRegister, s ARMShift) string {
+	if ualNoShift(s) {
+		return ualRegister(rm)
+	}
+	if s.UseRegister() {
+		return fmt.Sprintf("%s, %s %s", ualRegister(rm), s.ShiftString(),
+			ualRegister(s.Register()))
+	}
+	amount := s.Amount()
+	if amount == 0 {
+		if s.ShiftType() == 3 {
+			return ualRegister(rm) + ", rrx"
+		}
+		// lsr and asr by 0 are encodings of shifts by 32.
+		amount = 32
+	}
+	return fmt.Sprintf("%s, %s #%d", ualRegister(rm), s.ShiftString(), amount)
+}
+
+// Formats a rotated 8-bit immediate, returning its value for the comment.
+// Immediates which can't be encoded using a smaller rotation are printed
+// using their fields.
+func ualRotatedImmediate(immediate, rotate uint8) (string, uint32) {
+	r := uint32(rotate) << 1
+	value := (uint32(immediate) >> r) | (uint32(immediate) << ((32 - r) & 31))
+	smallest := uint32(0)
+	for ((value << smallest) | (value >> ((32 - smallest) & 31))) > 0xff {
+		smallest += 2
+	}
+	if smallest != r {
+		return fmt.Sprintf("#%d, %d", immediate, r), value
+	}
+	return fmt.Sprintf("#%d", int32(value)), value
+}
+
+// Returns the instruction's raw value, encoding it if it wasn't parsed.
+func ualRawARM(n ARMInstruction) uint32 {
+	if n.Raw() != 0 {
+		return n.Raw()
+	}
+	raw, _ := n.Encode()
+	return raw
+}
+
+// Formats an address using an immediate offset from Rn, along with the
+// comment containing the offset. If Rn is the PC, the comment contains the
+// target instead. Offsets of 0 are omitted unless they're negative or written
+// back, if the elide argument is set.
+func (f *ualFormatter) immediateAddress(rn ARMRegister, offset uint32, up,
+	preindex, writeBack, elide bool) string {
+	sign := ""
+	value := int64(offset)
+	if !up {
+		sign = "-"
+		value = -value
+	}
+	if !preindex {
+		s := fmt.Sprintf("[%s], #%s%d", ualRegister(rn), sign, offset)
+		if rn == 15 {
+			return s + "\t; " + f.address(f.pc)
+		}
+		return s + ualComment(value)
+	}
+	s := "[" + ualRegister(rn)
+	if !elide || writeBack || !up || (offset != 0) {
+		s += fmt.Sprintf(", #%s%d", sign, offset)
+	}
+	s += "]"
+	if writeBack {
+		s += "!"
+	}
+	if rn == 15 {
+		return s + "\t; " + f.address(addOffset(f.pc, offset, up))
+	}
+	return s + ualComment(value)
+}
+
+// Formats an address using a (possibly shifted) register offset from Rn.
+func ualRegisterAddress(rn, rm ARMRegister, s ARMShift, up, preindex,
+	writeBack bool) string {
+	offset := ualShiftedRegister(rm, s)
+	if !up {
+		offset = "-" + offset
+	}
+	if !preindex {
+		return fmt.Sprintf("[%s], %s", ualRegister(rn), offset)
+	}
+	if writeBack {
+		return fmt.Sprintf("[%s, %s]!", ualRegister(rn), offset)
+	}
+	return fmt.Sprintf("[%s, %s]", ualRegister(rn), offset)
+}
+
+func (n *DataProcessingInstruction) ualOperand() (string, int64) {
+	if n.IsImmediate {
+		s, value := ualRotatedImmediate(n.Immediate, n.Rotate)
+		return s, int64(int32(value))
+	}
+	return ualShiftedRegister(n.Rm, n.Shift), 0
+}
+
+func (n *DataProcessingInstruction) ualString(f *ualFormatter) string {
+	condition := f.condition(n.Condition())
+	suffix := condition
+	if n.SetConditions {
+		suffix = "s" + condition
+	}
+	operand, value := n.ualOperand()
+	comment := ualComment(value)
+	switch n.Opcode {
+	case tstARMOpcode, teqARMOpcode, cmpARMOpcode, cmnARMOpcode:
+		return fmt.Sprintf("%s%s\t%s, %s%s", n.Opcode, condition,
+			ualRegister(n.Rn), operand, comment)
+	case movARMOpcode:
+		if n.IsImmediate {
+			break
+		}
+		s := n.Shift
+		if ualNoShift(s) {
+			if (n.Rd == 0) && (n.Rm == 0) && !n.SetConditions &&
+				(condition == "") {
+				return "nop\t\t\t; (mov r0, r0)"
+			}
+			break
+		}
+		// Shifted moves are printed as shifts.
+		if s.UseRegister() {
+			return fmt.Sprintf("%s%s\t%s, %s, %s", s.ShiftString(), suffix,
+				ualRegister(n.Rd), ualRegister(n.Rm), ualRegister(s.Register()))
+		}
+		amount := s.Amount()
+		if amount == 0 {
+			if s.ShiftType() == 3 {
+				return fmt.Sprintf("rrx%s\t%s, %s", suffix, ualRegister(n.Rd),
+					ualRegister(n.Rm))
+			}
+			amount = 32
+		}
+		return fmt.Sprintf("%s%s\t%s, %s, #%d", s.ShiftString(), suffix,
+			ualRegister(n.Rd), ualRegister(n.Rm), amount)
+	case mvnARMOpcode:
+	default:
+		return fmt.Sprintf("%s%s\t%s, %s, %s%s", n.Opcode, suffix,
+			ualRegister(n.Rd), ualRegister(n.Rn), operand, comment)
+	}
+	return fmt.Sprintf("%s%s\t%s, %s%s", n.Opcode, suffix, ualRegister(n.Rd),
+		operand, comment)
+}
+
+func (n *PSRTransferInstruction) ualString(f *ualFormatter) string {
+	condition := f.condition(n.Condition())
+	psr := "CPSR"
+	if !n.UseCPSR {
+		psr = "SPSR"
+	}
+	if !n.WritePSR {
+		return fmt.Sprintf("mrs%s\t%s, %s", condition, ualRegister(n.Rd), psr)
+	}
+	psr = psrFieldsString(psr, n.fields())
+	if !n.IsImmediate {
+		return fmt.Sprintf("msr%s\t%s, %s", condition, psr, ualRegister(n.Rm))
+	}
+	operand, value := ualRotatedImmediate(n.Immediate, n.Rotate)
+	return fmt.Sprintf("msr%s\t%s, %s%s", condition, psr, operand,
+		ualComment(int64(int32(value))))
+}
+
+func (n *MultiplyInstruction) ualString(f *ualFormatter) string {
+	start := "mul"
+	if n.Subtract {
+		start = "mls"
+	} else if n.Accumulate {
+		start = "mla"
+	}
+	if n.IsLongMultiply {
+		if n.Signed {
+			start = "s" + start + "l"
+		} else {
+			start = "u" + start + "l"
+		}
+	}
+	if n.SetConditions {
+		start += "s"
+	}
+	start += f.condition(n.Condition())
+	if n.IsLongMultiply {
+		return fmt.Sprintf("%s\t%s, %s, %s, %s", start, ualRegister(n.RdLow),
+			ualRegister(n.RdHigh), ualRegister(n.Rm), ualRegister(n.Rs))
+	}
+	if !n.Accumulate && !n.Subtract {
+		return fmt.Sprintf("%s%s\t%s, %s, %s", start, f.wide(),
+			ualRegister(n.Rd), ualRegister(n.Rm), ualRegister(n.Rs))
+	}
+	return fmt.Sprintf("%s\t%s, %s, %s, %s", start, ualRegister(n.Rd),
+		ualRegister(n.Rm), ualRegister(n.Rs), ualRegister(n.Rn))
+}
+
+func (n *SingleDataSwapInstruction) ualString(f *ualFormatter) string {
+	start := "swp"
+	if n.ByteQuantity {
+		start += "b"
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, [%s]", start, f.condition(n.Condition()),
+		ualRegister(n.Rd), ualRegister(n.Rm), ualRegister(n.Rn))
+}
+
+func (n *BranchExchangeInstruction) ualString(f *ualFormatter) string {
+	start := "bx"
+	if n.Link {
+		start = "blx"
+	}
+	return fmt.Sprintf("%s%s\t%s", start, f.condition(n.Condition()),
+		ualRegister(n.Rn))
+}
+
+func (n *HalfwordDataTransferInstruction) ualString(
+	f *ualFormatter) string {
+	start := "str"
+	if n.Load {
+		start = "ldr"
+	}
+	if n.Signed && !n.Doubleword {
+		start += "s"
+	}
+	if n.Doubleword {
+		start += "d"
+	} else if n.Halfword {
+		start += "h"
+	} else {
+		start += "b"
+	}
+	start += f.condition(n.Condition()) + "\t" + ualRegister(n.Rd) + ", "
+	if !n.IsImmediate {
+		return start + ualRegisterAddress(n.Rn, n.Rm, nil, n.Up, n.Preindex,
+			n.WriteBack)
+	}
+	if (n.Rn == 15) && !n.Preindex {
+		// objdump doesn't print targets for post-indexed PC addresses here.
+		sign := ""
+		if !n.Up {
+			sign = "-"
+		}
+		return start + fmt.Sprintf("[pc], #%s%d", sign, n.Offset)
+	}
+	return start + f.immediateAddress(n.Rn, uint32(n.Offset), n.Up,
+		n.Preindex, n.WriteBack, true)
+}
+
+func (n *SingleDataTransferInstruction) ualString(f *ualFormatter) string {
+	condition := f.condition(n.Condition())
+	if (n.Rn == 13) && n.ImmediateOffset && (n.Offset == 4) &&
+		!n.ByteQuantity {
+		// Single register pushes and pops.
+		if !n.Load && n.Preindex && !n.Up && n.WriteBack {
+			return fmt.Sprintf("push%s\t{%s}\t\t; (str%s %s, [sp, #-4]!)",
+				condition, ualRegister(n.Rd), condition, ualRegister(n.Rd))
+		}
+		if n.Load && !n.Preindex && n.Up && !n.WriteBack {
+			return fmt.Sprintf("pop%s\t{%s}\t\t; (ldr%s %s, [sp], #4)",
+				condition, ualRegister(n.Rd), condition, ualRegister(n.Rd))
+		}
+	}
+	start := "str"
+	if n.Load {
+		start = "ldr"
+	}
+	if n.ByteQuantity {
+		start += "b"
+	}
+	if !n.Preindex && n.WriteBack {
+		start += "t"
+	}
+	start += condition + "\t" + ualRegister(n.Rd) + ", "
+	return start + n.ualAddress(f)
+}
+
+func (n *SingleDataTransferInstruction) ualAddress(f *ualFormatter) string {
+	if !n.ImmediateOffset {
+		return ualRegisterAddress(n.Rn, n.Rm, n.Shift, n.Up, n.Preindex,
+			n.WriteBack && n.Preindex)
+	}
+	return f.immediateAddress(n.Rn, uint32(n.Offset), n.Up, n.Preindex,
+		n.WriteBack && n.Preindex, true)
+}
+
+func (n *BlockDataTransferInstruction) ualString(f *ualFormatter) string {
+	condition := f.condition(n.Condition())
+	list := ualRegisterList(n.RegisterList)
+	if (n.Rn == 13) && n.WriteBack && !n.ForceUser {
+		if !n.Load && n.Preindex && !n.Up {
+			return fmt.Sprintf("push%s%s\t%s", condition, f.wide(), list)
+		}
+		if n.Load && !n.Preindex && n.Up {
+			return fmt.Sprintf("pop%s%s\t%s", condition, f.wide(), list)
+		}
+	}
+	start := "stm"
+	if n.Load {
+		start = "ldm"
+	}
+	if n.Up && !n.Preindex {
+		// objdump only prints the "ia" of Thumb-2 instructions.
+		if f.thumb {
+			start += "ia" + condition + ".w"
+		} else {
+			start += condition
+		}
+	} else {
+		if n.Up {
+			start += "i"
+		} else {
+			start += "d"
+		}
+		if n.Preindex {
+			start += "b"
+		} else {
+			start += "a"
+		}
+		start += condition
+	}
+	rn := ualRegister(n.Rn)
+	if n.WriteBack {
+		rn += "!"
+	}
+	if n.ForceUser {
+		list += "^"
+	}
+	return fmt.Sprintf("%s\t%s, %s", start, rn, list)
+}
+
+func (n *BranchInstruction) ualString(f *ualFormatter) string {
+	target := f.address(f.pc + uint32(n.offset()))
+	if n.Exchange {
+		return "blx\t" + target
+	}
+	start := "b"
+	if n.Link {
+		start = "bl"
+	}
+	return start + f.condition(n.Condition()) + "\t" + target
+}
+
+// Returns the mnemonic suffix of coprocessor instructions, which is "2" for
+// the unconditional forms.
+func ualCoprocSuffix(f *ualFormatter, unconditional bool,
+	c ARMCondition) string {
+	if unconditional {
+		return "2"
+	}
+	return f.condition(c)
+}
+
+func (n *CoprocDataTransferInstruction) ualString(f *ualFormatter) string {
+	start := "stc"
+	if n.Load {
+		start = "ldc"
+	}
+	if n.Unconditional {
+		start += "2"
+	}
+	if n.LongTransfer {
+		start += "l"
+	}
+	if !n.Unconditional {
+		start += f.condition(n.Condition())
+	}
+	start += fmt.Sprintf("\t%d, cr%d, ", n.CoprocNumber, n.CoprocRd)
+	if !n.Preindex && !n.WriteBack {
+		// The unindexed form passes the offset field to the coprocessor.
+		return start + fmt.Sprintf("[%s], {%d}%s", ualRegister(n.Rn),
+			n.Offset, ualComment(int64(n.Offset)))
+	}
+	return start + f.immediateAddress(n.Rn, uint32(n.Offset)<<2, n.Up,
+		n.Preindex, n.WriteBack, true)
+}
+
+func (n *CoprocDataOperationInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("cdp%s\t%d, %d, cr%d, cr%d, cr%d, {%d}",
+		ualCoprocSuffix(f, n.Unconditional, n.Condition()), n.CoprocNumber,
+		n.CoprocOpcode, n.CoprocRd, n.CoprocRn, n.CoprocRm, n.CoprocInfo)
+}
+
+func (n *CoprocRegisterTransferInstruction) ualString(
+	f *ualFormatter) string {
+	start := "mcr"
+	if n.Load {
+		start = "mrc"
+	}
+	return fmt.Sprintf("%s%s\t%d, %d, %s, cr%d, cr%d, {%d}", start,
+		ualCoprocSuffix(f, n.Unconditional, n.Condition()), n.CoprocNumber,
+		n.CoprocOpcode, ualRegister(n.Rd), n.CoprocRn, n.CoprocRm,
+		n.CoprocOperand)
+}
+
+func (n *SoftwareInterruptInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("svc%s\t0x%08x", f.condition(n.Condition()), n.Comment)
+}
+
+func (n *CountLeadingZerosInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("clz%s\t%s, %s", f.condition(n.Condition()),
+		ualRegister(n.Rd), ualRegister(n.Rm))
+}
+
+func (n *BreakpointInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("bkpt\t0x%04x", n.Comment)
+}
+
+func (n *SaturatingArithmeticInstruction) ualString(f *ualFormatter) string {
+	start := "q"
+	if n.Double {
+		start += "d"
+	}
+	if n.Subtract {
+		start += "sub"
+	} else {
+		start += "add"
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, %s", start, f.condition(n.Condition()),
+		ualRegister(n.Rd), ualRegister(n.Rm), ualRegister(n.Rn))
+}
+
+func (n *SignedHalfwordMultiplyInstruction) ualString(
+	f *ualFormatter) string {
+	halves := "b"
+	if n.RmTop {
+		halves = "t"
+	}
+	if n.Word {
+		halves = ""
+	}
+	if n.RsTop {
+		halves += "t"
+	} else {
+		halves += "b"
+	}
+	condition := f.condition(n.Condition())
+	if n.IsLongMultiply {
+		return fmt.Sprintf("smlal%s%s\t%s, %s, %s, %s", halves, condition,
+			ualRegister(n.RdLow), ualRegister(n.RdHigh), ualRegister(n.Rm),
+			ualRegister(n.Rs))
+	}
+	start := "smul"
+	if n.Accumulate {
+		start = "smla"
+	}
+	if n.Word {
+		start += "w"
+	}
+	start += halves + condition
+	if !n.Accumulate {
+		return fmt.Sprintf("%s\t%s, %s, %s", start, ualRegister(n.Rd),
+			ualRegister(n.Rm), ualRegister(n.Rs))
+	}
+	return fmt.Sprintf("%s\t%s, %s, %s, %s", start, ualRegister(n.Rd),
+		ualRegister(n.Rm), ualRegister(n.Rs), ualRegister(n.Rn))
+}
+
+func (n *PreloadInstruction) ualString(f *ualFormatter) string {
+	return "pld\t" + n.ualAddress(f)
+}
+
+func (n *CoprocDoubleRegisterTransferInstruction) ualString(
+	f *ualFormatter) string {
+	start := "mcrr"
+	if n.Load {
+		start = "mrrc"
+	}
+	return fmt.Sprintf("%s%s\t%d, %d, %s, %s, cr%d", start,
+		f.condition(n.Condition()), n.CoprocNumber, n.CoprocOpcode,
+		ualRegister(n.Rd), ualRegister(n.Rn), n.CoprocRm)
+}
+
+func (n *ExclusiveLoadStoreInstruction) ualString(f *ualFormatter) string {
+	address := "[" + ualRegister(n.Rn)
+	if n.Offset != 0 {
+		address += fmt.Sprintf(", #%d", uint32(n.Offset)<<2)
+	}
+	address += "]"
+	condition := f.condition(n.Condition())
+	if n.Load {
+		return fmt.Sprintf("ldrex%s\t%s, %s", condition, ualRegister(n.Rd),
+			address)
+	}
+	return fmt.Sprintf("strex%s\t%s, %s, %s", condition, ualRegister(n.Rd),
+		ualRegister(n.Rm), address)
+}
+
+func (n *ReverseBytesInstruction) ualString(f *ualFormatter) string {
+	start := "rev"
+	if n.Signed {
+		start += "sh"
+	} else if n.Halfwords {
+		start += "16"
+	}
+	return fmt.Sprintf("%s%s%s\t%s, %s", start, f.condition(n.Condition()),
+		f.wide(), ualRegister(n.Rd), ualRegister(n.Rm))
+}
+
+func (n *ExtendInstruction) ualString(f *ualFormatter) string {
+	start := "s"
+	if n.Unsigned {
+		start = "u"
+	}
+	start += "xt"
+	accumulate := n.Rn != 15
+	if accumulate {
+		start += "a"
+	}
+	if n.Dual {
+		start += "b16"
+	} else if n.Halfword {
+		start += "h"
+	} else {
+		start += "b"
+	}
+	start += f.condition(n.Condition())
+	if !accumulate && !n.Dual {
+		start += f.wide()
+	}
+	operands := ualRegister(n.Rd) + ", "
+	if accumulate {
+		operands += ualRegister(n.Rn) + ", "
+	}
+	operands += ualRegister(n.Rm)
+	if n.Rotate != 0 {
+		operands += fmt.Sprintf(", ror #%d", uint32(n.Rotate)<<3)
+	}
+	return start + "\t" + operands
+}
+
+// The names of the operations which exchange halfwords changed in UAL.
+var ualParallelOperationStrings = [...]string{"add16", "asx", "sax",
+	"sub16", "add8", "", "", "sub8"}
+
+func (n *ParallelArithmeticInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("%s%s%s\t%s, %s, %s", parallelPrefixStrings[n.Prefix&7],
+		ualParallelOperationStrings[n.Operation&7], f.condition(n.Condition()),
+		ualRegister(n.Rd), ualRegister(n.Rn), ualRegister(n.Rm))
+}
+
+func (n *SelectBytesInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("sel%s\t%s, %s, %s", f.condition(n.Condition()),
+		ualRegister(n.Rd), ualRegister(n.Rn), ualRegister(n.Rm))
+}
+
+func (n *SumAbsoluteDifferencesInstruction) ualString(
+	f *ualFormatter) string {
+	if !n.Accumulate {
+		return fmt.Sprintf("usad8%s\t%s, %s, %s", f.condition(n.Condition()),
+			ualRegister(n.Rd), ualRegister(n.Rm), ualRegister(n.Rs))
+	}
+	return fmt.Sprintf("usada8%s\t%s, %s, %s, %s", f.condition(n.Condition()),
+		ualRegister(n.Rd), ualRegister(n.Rm), ualRegister(n.Rs),
+		ualRegister(n.Rn))
+}
+
+func (n *SaturateInstruction) ualString(f *ualFormatter) string {
+	start := "ssat"
+	if n.Unsigned {
+		start = "usat"
+	}
+	if n.Dual {
+		start += "16"
+	}
+	s := fmt.Sprintf("%s%s\t%s, #%d, %s", start, f.condition(n.Condition()),
+		ualRegister(n.Rd), n.saturateBits(), ualRegister(n.Rn))
+	if n.Dual {
+		return s
+	}
+	if n.ShiftRight {
+		amount := n.ShiftAmount
+		if amount == 0 {
+			amount = 32
+		}
+		return s + fmt.Sprintf(", asr #%d", amount)
+	}
+	if n.ShiftAmount != 0 {
+		return s + fmt.Sprintf(", lsl #%d", n.ShiftAmount)
+	}
+	return s
+}
+
+func (n *PackHalfwordInstruction) ualString(f *ualFormatter) string {
+	start := "pkhbt"
+	shift := ""
+	if n.TopBottom {
+		start = "pkhtb"
+		amount := n.ShiftAmount
+		if amount == 0 {
+			amount = 32
+		}
+		shift = fmt.Sprintf(", asr #%d", amount)
+	} else if n.ShiftAmount != 0 {
+		shift = fmt.Sprintf(", lsl #%d", n.ShiftAmount)
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, %s%s", start, f.condition(n.Condition()),
+		ualRegister(n.Rd), ualRegister(n.Rn), ualRegister(n.Rm), shift)
+}
+
+func (n *MultiplyAccumulateAccumulateInstruction) ualString(
+	f *ualFormatter) string {
+	return fmt.Sprintf("umaal%s\t%s, %s, %s, %s", f.condition(n.Condition()),
+		ualRegister(n.RdLow), ualRegister(n.RdHigh), ualRegister(n.Rm),
+		ualRegister(n.Rs))
+}
+
+func (n *DualMultiplyInstruction) ualString(f *ualFormatter) string {
+	start := "sm"
+	if n.Accumulate || n.IsLongMultiply {
+		start += "l"
+	} else {
+		start += "u"
+	}
+	if n.Subtract {
+		start += "s"
+	} else {
+		start += "a"
+	}
+	if n.IsLongMultiply {
+		start += "ld"
+	} else {
+		start += "d"
+	}
+	if n.Exchange {
+		start += "x"
+	}
+	start += f.condition(n.Condition())
+	if n.IsLongMultiply {
+		return fmt.Sprintf("%s\t%s, %s, %s, %s", start, ualRegister(n.RdLow),
+			ualRegister(n.RdHigh), ualRegister(n.Rm), ualRegister(n.Rs))
+	}
+	if !n.Accumulate {
+		return fmt.Sprintf("%s\t%s, %s, %s", start, ualRegister(n.Rd),
+			ualRegister(n.Rm), ualRegister(n.Rs))
+	}
+	return fmt.Sprintf("%s\t%s, %s, %s, %s", start, ualRegister(n.Rd),
+		ualRegister(n.Rm), ualRegister(n.Rs), ualRegister(n.Rn))
+}
+
+func (n *ChangeProcessorStateInstruction) ualString(f *ualFormatter) string {
+	var start string
+	switch n.InterruptMode {
+	case 2:
+		start = "cpsie"
+	case 3:
+		start = "cpsid"
+	default:
+		return fmt.Sprintf("cps\t#%d", n.Mode)
+	}
+	flags := ""
+	if n.AbortFlag {
+		flags += "a"
+	}
+	if n.IRQFlag {
+		flags += "i"
+	}
+	if n.FIQFlag {
+		flags += "f"
+	}
+	if n.ChangeMode {
+		return fmt.Sprintf("%s\t%s,#%d", start, flags, n.Mode)
+	}
+	return start + "\t" + flags
+}
+
+func (n *SetEndiannessInstruction) ualString(f *ualFormatter) string {
+	if n.BigEndian {
+		return "setend\tbe"
+	}
+	return "setend\tle"
+}
+
+func (n *StoreReturnStateInstruction) ualString(f *ualFormatter) string {
+	writeBack := ""
+	if n.WriteBack {
+		writeBack = "!"
+	}
+	return fmt.Sprintf("srs%s\tsp%s, #%d", returnStateModeString(n.Preindex,
+		n.Up), writeBack, n.Mode)
+}
+
+func (n *ReturnFromExceptionInstruction) ualString(f *ualFormatter) string {
+	writeBack := ""
+	if n.WriteBack {
+		writeBack = "!"
+	}
+	return fmt.Sprintf("rfe%s\t%s%s", returnStateModeString(n.Preindex,
+		n.Up), ualRegister(n.Rn), writeBack)
+}
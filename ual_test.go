@@ -0,0 +1,200 @@
+package arm_emulate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The testdata/ual_*.expected files hold the expected disassembly of the
+// matching ual_*.s sources, in GNU objdump -d's format. GNU binutils weren't
+// available when they were written, so the sources were assembled using
+// llvm-mc from LLVM 14, with -triple=armv7a-none-eabi -mattr=+vfp2 for the ARM
+// and VFP files, thumbv7a-none-eabi for ual_thumb.s and thumbv7em-none-eabi for
+// ual_thumb2.s. Each line was checked against llvm-objdump and then adjusted
+// by hand to GNU's conventions, such as the ip register name, ".w" suffixes
+// and hex comments, so they haven't been checked against arm-none-eabi-objdump.
+
+// A single line of a UAL expected output file, in objdump's format.
+type ualGoldenLine struct {
+	number   int
+	address  uint32
+	raw      []uint32
+	expected string
+}
+
+// Reads a golden file, where each line contains an address, one or two hex
+// values (one per word or halfword) and the expected disassembly, separated
+// by tabs. Blank lines and lines starting with '#' are ignored.
+func readUALGoldenFile(t *testing.T, path string) []ualGoldenLine {
+	file, e := os.Open(path)
+	if e != nil {
+		t.Logf("Failed opening %s: %s\n", path, e)
+		t.FailNow()
+	}
+	defer file.Close()
+	var toReturn []ualGoldenLine
+	scanner := bufio.NewScanner(file)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := scanner.Text()
+		if (strings.TrimSpace(text) == "") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, "\t", 3)
+		if len(fields) != 3 {
+			t.Logf("%s:%d: bad line: %s\n", path, number, text)
+			t.FailNow()
+		}
+		line := ualGoldenLine{number: number, expected: fields[2]}
+		address := strings.TrimSuffix(strings.TrimSpace(fields[0]), ":")
+		value, e := strconv.ParseUint(address, 16, 32)
+		if e != nil {
+			t.Logf("%s:%d: bad address: %s\n", path, number, e)
+			t.FailNow()
+		}
+		line.address = uint32(value)
+		for _, hex := range strings.Fields(fields[1]) {
+			value, e = strconv.ParseUint(hex, 16, 32)
+			if e != nil {
+				t.Logf("%s:%d: bad value: %s\n", path, number, e)
+				t.FailNow()
+			}
+			line.raw = append(line.raw, uint32(value))
+		}
+		toReturn = append(toReturn, line)
+	}
+	e = scanner.Err()
+	if e != nil {
+		t.Logf("Failed reading %s: %s\n", path, e)
+		t.FailNow()
+	}
+	return toReturn
+}
+
+func TestUALDisassembleARM(t *testing.T) {
+	d := Disassembler{Syntax: UALSyntax}
+	for _, path := range []string{"testdata/ual_arm.expected",
+		"testdata/ual_vfp.expected"} {
+		for _, line := range readUALGoldenFile(t, path) {
+			instruction, e := ParseInstruction(line.raw[0])
+			if e != nil {
+				t.Logf("%s:%d: failed parsing 0x%08x: %s\n", path, line.number,
+					line.raw[0], e)
+				t.Fail()
+				continue
+			}
+			if _, ok := instruction.(ualInstruction); !ok {
+				t.Logf("%s:%d: %T has no UAL format\n", path, line.number,
+					instruction)
+				t.Fail()
+			}
+			s := d.ARMString(instruction, line.address)
+			if s != line.expected {
+				t.Logf("%s:%d: expected \"%s\", got \"%s\"\n", path,
+					line.number, line.expected, s)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestUALDisassembleTHUMB(t *testing.T) {
+	for _, path := range []string{"testdata/ual_thumb.expected",
+		"testdata/ual_thumb2.expected"} {
+		// The same disassembler is used for each file so it can track IT
+		// blocks.
+		d := Disassembler{Syntax: UALSyntax}
+		for _, line := range readUALGoldenFile(t, path) {
+			var instruction fmt.Stringer
+			var e error
+			var s string
+			if len(line.raw) == 2 {
+				var n THUMB2Instruction
+				n, e = ParseTHUMB2Instruction((line.raw[0] << 16) |
+					line.raw[1])
+				if e == nil {
+					s = d.THUMB2String(n, line.address)
+				}
+				instruction = n
+			} else {
+				var n THUMBInstruction
+				n, e = ParseTHUMBInstructionForArchitecture(
+					uint16(line.raw[0]), ARMv7)
+				if e == nil {
+					s = d.THUMBString(n, line.address)
+				}
+				instruction = n
+			}
+			if e != nil {
+				t.Logf("%s:%d: failed parsing: %s\n", path, line.number, e)
+				t.Fail()
+				continue
+			}
+			if _, ok := instruction.(ualInstruction); !ok {
+				t.Logf("%s:%d: %T has no UAL format\n", path, line.number,
+					instruction)
+				t.Fail()
+			}
+			if s != line.expected {
+				t.Logf("%s:%d: expected \"%s\", got \"%s\"\n", path,
+					line.number, line.expected, s)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestUALSymbols(t *testing.T) {
+	m, symbols := getDisassemblerTestData(t)
+	d := Disassembler{Symbols: symbols, Memory: m, Syntax: UALSyntax}
+	expected := map[uint32]string{
+		0x8000: "bl\t8010 <main+0x10>",
+		0x8004: "b\t8004 <main+0x4>",
+		0x8008: "ldr\tr0, [pc, #8]\t; 8018 <main+0x18>",
+		0x8010: "bx\tlr",
+	}
+	for address, expectedString := range expected {
+		raw, _ := m.ReadMemoryWord(address)
+		instruction, e := ParseInstruction(raw)
+		if e != nil {
+			t.Logf("Failed parsing 0x%08x: %s\n", raw, e)
+			t.FailNow()
+		}
+		s := d.ARMString(instruction, address)
+		if s != expectedString {
+			t.Logf("Expected \"%s\" at 0x%08x, got \"%s\"\n", expectedString,
+				address, s)
+			t.Fail()
+		}
+	}
+	// With memory, both halves of a THUMB bl show the target.
+	expected = map[uint32]string{
+		0x9000: "bl\t9024 <thumb_func+0x24>",
+		0x9002: "bl\t9024 <thumb_func+0x24>\t; (second half)",
+		0x9008: "cbz\tr0, 900e <thumb_func+0xe>",
+	}
+	for address, expectedString := range expected {
+		raw, _ := m.ReadMemoryHalfword(address)
+		architecture := ARMv7
+		if IsTHUMB2Prefix(raw) {
+			architecture = ARMv6
+		}
+		instruction, e := ParseTHUMBInstructionForArchitecture(raw,
+			architecture)
+		if e != nil {
+			t.Logf("Failed parsing 0x%04x: %s\n", raw, e)
+			t.FailNow()
+		}
+		s := d.THUMBString(instruction, address)
+		if s != expectedString {
+			t.Logf("Expected \"%s\" at 0x%08x, got \"%s\"\n", expectedString,
+				address, s)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package arm_emulate
+
+// This file contains the UAL formatting of the 16-bit THUMB and 32-bit
+// Thumb-2 instructions.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Returns a THUMB register list, optionally followed by lr or pc.
+func ualRegisterListTHUMB(registers uint8, extra string) string {
+	s := ualRegisterList(uint16(registers))
+	if extra == "" {
+		return s
+	}
+	if registers == 0 {
+		return "{" + extra + "}"
+	}
+	return s[:len(s)-1] + ", " + extra + "}"
+}
+
+func (n *MoveShiftedRegisterInstruction) ualString(f *ualFormatter) string {
+	if (n.Operation == 0) && (n.Offset == 0) {
+		return fmt.Sprintf("mov%s\t%s, %s", f.flags(), ualRegister(n.Rd),
+			ualRegister(n.Rs))
+	}
+	start := [...]string{"lsl", "lsr", "asr", "asr"}[n.Operation&3]
+	offset := n.Offset
+	if offset == 0 {
+		offset = 32
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, #%d", start, f.flags(),
+		ualRegister(n.Rd), ualRegister(n.Rs), offset)
+}
+
+func (n *AddSubtractInstruction) ualString(f *ualFormatter) string {
+	start := "add"
+	if n.Subtract {
+		start = "sub"
+	}
+	operand := ualRegister(n.Rn)
+	if n.IsImmediate {
+		operand = fmt.Sprintf("#%d", n.Immediate)
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, %s", start, f.flags(),
+		ualRegister(n.Rd), ualRegister(n.Rs), operand)
+}
+
+func (n *MoveCompareAddSubtractImmediateInstruction) ualString(
+	f *ualFormatter) string {
+	start := [...]string{"mov", "cmp", "add", "sub"}[n.Operation&3]
+	if n.Operation == 1 {
+		start += f.condition(14)
+	} else {
+		start += f.flags()
+	}
+	return fmt.Sprintf("%s\t%s, #%d%s", start, ualRegister(n.Rd), n.Immediate,
+		ualComment(int64(n.Immediate)))
+}
+
+func (n *ALUOperationInstruction) ualString(f *ualFormatter) string {
+	start := n.Opcode.String()
+	switch start {
+	case "tst", "cmp", "cmn":
+		start += f.condition(14)
+	default:
+		start += f.flags()
+	}
+	return fmt.Sprintf("%s\t%s, %s", start, ualRegister(n.Rd),
+		ualRegister(n.Rs))
+}
+
+func (n *HighRegisterOperationInstruction) ualString(f *ualFormatter) string {
+	condition := f.condition(14)
+	switch n.Operation {
+	case 0:
+		return fmt.Sprintf("add%s\t%s, %s", condition, ualRegister(n.Rd),
+			ualRegister(n.Rs))
+	case 1:
+		return fmt.Sprintf("cmp%s\t%s, %s", condition, ualRegister(n.Rd),
+			ualRegister(n.Rs))
+	case 2:
+		if (n.Rd == 8) && (n.Rs == 8) && (condition == "") {
+			return "nop\t\t\t; (mov r8, r8)"
+		}
+		return fmt.Sprintf("mov%s\t%s, %s", condition, ualRegister(n.Rd),
+			ualRegister(n.Rs))
+	}
+	if n.Link {
+		return fmt.Sprintf("blx%s\t%s", condition, ualRegister(n.Rs))
+	}
+	return fmt.Sprintf("bx%s\t%s", condition, ualRegister(n.Rs))
+}
+
+func (n *PcRelativeLoadInstruction) ualString(f *ualFormatter) string {
+	target, _ := n.pcRelativeTarget(f.pc)
+	return fmt.Sprintf("ldr%s\t%s, [pc, #%d]\t; (%s)", f.condition(14),
+		ualRegister(n.Rd), uint16(n.Offset)<<2, f.address(target))
+}
+
+func (n *LoadStoreRegisterOffsetInstruction) ualString(
+	f *ualFormatter) string {
+	start := "str"
+	if n.Load {
+		start = "ldr"
+	}
+	if n.ByteQuantity {
+		start += "b"
+	}
+	return fmt.Sprintf("%s%s\t%s, [%s, %s]", start, f.condition(14),
+		ualRegister(n.Rd), ualRegister(n.Rb), ualRegister(n.Ro))
+}
+
+func (n *LoadStoreSignExtendedHalfwordInstruction) ualString(
+	f *ualFormatter) string {
+	start := "strh"
+	if n.SignExtend && n.HBit {
+		start = "ldrsh"
+	} else if n.SignExtend {
+		start = "ldrsb"
+	} else if n.HBit {
+		start = "ldrh"
+	}
+	return fmt.Sprintf("%s%s\t%s, [%s, %s]", start, f.condition(14),
+		ualRegister(n.Rd), ualRegister(n.Rb), ualRegister(n.Ro))
+}
+
+// Formats a THUMB load or store using an immediate offset from Rb.
+func ualTHUMBImmediateTransfer(f *ualFormatter, start string, rd,
+	rb ARMRegister, offset uint16) string {
+	return fmt.Sprintf("%s%s\t%s, [%s, #%d]%s", start, f.condition(14),
+		ualRegister(rd), ualRegister(rb), offset, ualComment(int64(offset)))
+}
+
+func (n *LoadStoreImmediateOffsetInstruction) ualString(
+	f *ualFormatter) string {
+	start := "str"
+	if n.Load {
+		start = "ldr"
+	}
+	offset := uint16(n.Offset)
+	if n.ByteQuantity {
+		start += "b"
+	} else {
+		offset <<= 2
+	}
+	return ualTHUMBImmediateTransfer(f, start, n.Rd, n.Rb, offset)
+}
+
+func (n *LoadStoreHalfwordInstruction) ualString(f *ualFormatter) string {
+	start := "strh"
+	if n.Load {
+		start = "ldrh"
+	}
+	return ualTHUMBImmediateTransfer(f, start, n.Rd, n.Rb,
+		uint16(n.Offset)<<1)
+}
+
+func (n *SPRelativeLoadStoreInstruction) ualString(f *ualFormatter) string {
+	start := "str"
+	if n.Load {
+		start = "ldr"
+	}
+	return ualTHUMBImmediateTransfer(f, start, n.Rd, 13, uint16(n.Offset)<<2)
+}
+
+func (n *LoadAddressInstruction) ualString(f *ualFormatter) string {
+	offset := uint16(n.Offset) << 2
+	condition := f.condition(14)
+	if n.LoadSP {
+		return fmt.Sprintf("add%s\t%s, sp, #%d%s", condition,
+			ualRegister(n.Rd), offset, ualComment(int64(offset)))
+	}
+	target, _ := n.pcRelativeTarget(f.pc)
+	return fmt.Sprintf("add%s\t%s, pc, #%d\t; (adr %s, %s)", condition,
+		ualRegister(n.Rd), offset, ualRegister(n.Rd), f.address(target))
+}
+
+func (n *AddToStackPointerInstruction) ualString(f *ualFormatter) string {
+	start := "add"
+	if n.Negative {
+		start = "sub"
+	}
+	offset := uint16(n.Offset) << 2
+	return fmt.Sprintf("%s%s\tsp, #%d%s", start, f.condition(14), offset,
+		ualComment(int64(offset)))
+}
+
+func (n *PushPopRegistersInstruction) ualString(f *ualFormatter) string {
+	start := "push"
+	extra := "lr"
+	if n.Load {
+		start = "pop"
+		extra = "pc"
+	}
+	if !n.StoreLRLoadPC {
+		extra = ""
+	}
+	return fmt.Sprintf("%s%s\t%s", start, f.condition(14),
+		ualRegisterListTHUMB(n.RegisterList, extra))
+}
+
+func (n *MultipleLoadStoreInstruction) ualString(f *ualFormatter) string {
+	start := "stmia"
+	writeBack := "!"
+	if n.Load {
+		start = "ldmia"
+		// Loads only write back the base if it isn't in the list.
+		if (n.RegisterList & (1 << (n.Rb & 7))) != 0 {
+			writeBack = ""
+		}
+	}
+	return fmt.Sprintf("%s%s\t%s%s, %s", start, f.condition(14),
+		ualRegister(n.Rb), writeBack, ualRegisterListTHUMB(n.RegisterList, ""))
+}
+
+func (n *ConditionalBranchInstruction) ualString(f *ualFormatter) string {
+	target, _ := n.pcRelativeTarget(f.pc)
+	return fmt.Sprintf("b%s.n\t%s", n.Condition, f.address(target))
+}
+
+func (n *SoftwareInterruptTHUMBInstruction) ualString(
+	f *ualFormatter) string {
+	return fmt.Sprintf("svc%s\t%d%s", f.condition(14), n.Comment,
+		ualComment(int64(n.Comment)))
+}
+
+func (n *UnconditionalBranchInstruction) ualString(f *ualFormatter) string {
+	target, _ := n.pcRelativeTarget(f.pc)
+	return fmt.Sprintf("b%s.n\t%s", f.condition(14), f.address(target))
+}
+
+func (n *BreakpointTHUMBInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("bkpt\t0x%04x", n.Comment)
+}
+
+func (n *ExtendTHUMBInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("%s%s\t%s, %s", n.mnemonic(), f.condition(14),
+		ualRegister(n.Rd), ualRegister(n.Rm))
+}
+
+func (n *ReverseBytesTHUMBInstruction) ualString(f *ualFormatter) string {
+	return fmt.Sprintf("%s%s\t%s, %s", n.mnemonic(), f.condition(14),
+		ualRegister(n.Rd), ualRegister(n.Rm))
+}
+
+func (n *SetEndiannessTHUMBInstruction) ualString(f *ualFormatter) string {
+	if n.BigEndian {
+		return "setend\tbe"
+	}
+	return "setend\tle"
+}
+
+func (n *CompareBranchTHUMBInstruction) ualString(f *ualFormatter) string {
+	target, _ := n.pcRelativeTarget(f.pc)
+	start := "cbz"
+	if n.NonZero {
+		start = "cbnz"
+	}
+	return fmt.Sprintf("%s\t%s, %s", start, ualRegister(n.Rn),
+		f.address(target))
+}
+
+func (n *IfThenTHUMBInstruction) ualString(f *ualFormatter) string {
+	return n.mnemonic() + "\t" + conditionStrings[n.FirstCondition]
+}
+
+func (n *HintTHUMBInstruction) ualString(f *ualFormatter) string {
+	if int(n.Hint) >= len(hintStrings) {
+		return fmt.Sprintf("nop%s\t{%d}", f.condition(14), n.Hint)
+	}
+	return hintStrings[n.Hint] + f.condition(14)
+}
+
+func (n *ChangeProcessorStateTHUMBInstruction) ualString(
+	f *ualFormatter) string {
+	start := "cpsie\t"
+	if n.Disable {
+		start = "cpsid\t"
+	}
+	for i, flag := range "aif" {
+		if (n.Flags & (4 >> uint(i))) != 0 {
+			start += string(flag)
+		}
+	}
+	return start
+}
+
+func (n *DataProcessingTHUMB2Instruction) ualString(f *ualFormatter) string {
+	opcode := n.armOpcode()
+	start := opcode.String()
+	if (n.Opcode == 3) && (n.Rn != 15) {
+		start = "orn"
+	}
+	condition := f.condition(14)
+	flags := ""
+	if n.SetConditions {
+		switch opcode {
+		case tstARMOpcode, teqARMOpcode, cmpARMOpcode, cmnARMOpcode:
+		default:
+			flags = "s"
+		}
+	}
+	if !n.IsImmediate && n.Shift.UseRegister() {
+		// Register-specified shifts are moves, printed as shifts.
+		return fmt.Sprintf("%s%s%s.w\t%s, %s, %s", n.Shift.ShiftString(),
+			flags, condition, ualRegister(n.Rd), ualRegister(n.Rm),
+			ualRegister(n.Shift.Register()))
+	}
+	start += flags
+	wide := ".w"
+	var operand, comment string
+	if n.IsImmediate {
+		value, _ := expandTHUMB2Immediate(n.Immediate, false)
+		operand = fmt.Sprintf("#%d", value)
+		comment = ualComment(int64(value))
+		if (opcode == adcARMOpcode) || (opcode == sbcARMOpcode) {
+			wide = ""
+		}
+	} else {
+		operand = ualShiftedRegister(n.Rm, n.Shift)
+	}
+	if (start == "orn") || (opcode == teqARMOpcode) ||
+		(opcode == rsbARMOpcode) {
+		wide = ""
+	}
+	start += condition + wide
+	switch opcode {
+	case tstARMOpcode, teqARMOpcode, cmpARMOpcode, cmnARMOpcode:
+		return fmt.Sprintf("%s\t%s, %s%s", start, ualRegister(n.Rn), operand,
+			comment)
+	case movARMOpcode, mvnARMOpcode:
+		return fmt.Sprintf("%s\t%s, %s%s", start, ualRegister(n.Rd), operand,
+			comment)
+	}
+	return fmt.Sprintf("%s\t%s, %s, %s%s", start, ualRegister(n.Rd),
+		ualRegister(n.Rn), operand, comment)
+}
+
+func (n *WideImmediateTHUMB2Instruction) ualString(f *ualFormatter) string {
+	condition := f.condition(14)
+	comment := ualComment(int64(n.Immediate))
+	if n.Move {
+		start := "movw"
+		if n.Top {
+			start = "movt"
+		}
+		return fmt.Sprintf("%s%s\t%s, #%d%s", start, condition,
+			ualRegister(n.Rd), n.Immediate, comment)
+	}
+	start := "addw"
+	if n.Subtract {
+		start = "subw"
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, #%d%s", start, condition,
+		ualRegister(n.Rd), ualRegister(n.Rn), n.Immediate, comment)
+}
+
+func (n *BitfieldTHUMB2Instruction) ualString(f *ualFormatter) string {
+	condition := f.condition(14)
+	if n.Insert && (n.Rn == 15) {
+		return fmt.Sprintf("bfc%s\t%s, #%d, #%d", condition, ualRegister(n.Rd),
+			n.LSB, n.width())
+	}
+	start := "bfi"
+	if !n.Insert {
+		start = "sbfx"
+		if n.Unsigned {
+			start = "ubfx"
+		}
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, #%d, #%d", start, condition,
+		ualRegister(n.Rd), ualRegister(n.Rn), n.LSB, n.width())
+}
+
+// Returns true if the instruction is an ldrt or strt, which use the encoding
+// of a positive 8-bit offset without write back.
+func (n *LoadStoreTHUMB2Instruction) isUnprivileged() bool {
+	return !n.RegisterOffset && (n.Rn != 15) && ((n.raw & 0x800000) == 0) &&
+		((n.raw & 0xf00) == 0xe00)
+}
+
+func (n *LoadStoreTHUMB2Instruction) ualAddress(f *ualFormatter) string {
+	if n.RegisterOffset {
+		if n.Shift == 0 {
+			return fmt.Sprintf("[%s, %s]", ualRegister(n.Rn), ualRegister(n.Rm))
+		}
+		return fmt.Sprintf("[%s, %s, lsl #%d]", ualRegister(n.Rn),
+			ualRegister(n.Rm), n.Shift)
+	}
+	offset := int32(n.Offset)
+	if !n.Up {
+		offset = -offset
+	}
+	if !n.Preindex {
+		return fmt.Sprintf("[%s], #%d", ualRegister(n.Rn), offset)
+	}
+	s := "[" + ualRegister(n.Rn)
+	if offset != 0 {
+		s += fmt.Sprintf(", #%d", offset)
+	}
+	s += "]"
+	if n.WriteBack {
+		s += "!"
+	}
+	if n.Rn == 15 {
+		target, _ := n.pcRelativeTarget(f.pc)
+		return s + "\t; " + f.address(target)
+	}
+	if (n.raw & 0x800000) != 0 {
+		// Only the 12-bit offsets are repeated in a comment.
+		s += ualComment(int64(offset))
+	}
+	return s
+}
+
+func (n *LoadStoreTHUMB2Instruction) ualString(f *ualFormatter) string {
+	condition := f.condition(14)
+	if n.isPreload() {
+		start := "pld"
+		if n.Signed {
+			start = "pli"
+		}
+		return start + condition + "\t" + n.ualAddress(f)
+	}
+	start := "str"
+	if n.Load {
+		start = "ldr"
+	}
+	if n.Signed {
+		start += "s"
+	}
+	start += [...]string{"b", "h", "", ""}[n.Size&3]
+	if n.isUnprivileged() {
+		start += "t" + condition
+	} else {
+		start += condition + ".w"
+	}
+	return start + "\t" + ualRegister(n.Rt) + ", " + n.ualAddress(f)
+}
+
+func (n *LoadStoreDoubleTHUMB2Instruction) ualString(
+	f *ualFormatter) string {
+	start := "strd"
+	if n.Load {
+		start = "ldrd"
+	}
+	offset := uint32(n.Offset) << 2
+	sign := ""
+	if !n.Up {
+		sign = "-"
+	}
+	var address string
+	if n.Preindex {
+		address = fmt.Sprintf("[%s, #%s%d]", ualRegister(n.Rn), sign, offset)
+		if n.WriteBack {
+			address += "!"
+		}
+	} else {
+		address = fmt.Sprintf("[%s], #%s%d", ualRegister(n.Rn), sign, offset)
+	}
+	if n.Rn == 15 {
+		address += "\t; " + f.address(addOffset(f.pc&^3, offset, n.Up))
+	} else {
+		address += ualComment(int64(offset))
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, %s", start, f.condition(14),
+		ualRegister(n.Rt), ualRegister(n.Rt2), address)
+}
+
+func (n *TableBranchTHUMB2Instruction) ualString(f *ualFormatter) string {
+	if n.Halfword {
+		return fmt.Sprintf("tbh%s\t[%s, %s, lsl #1]", f.condition(14),
+			ualRegister(n.Rn), ualRegister(n.Rm))
+	}
+	return fmt.Sprintf("tbb%s\t[%s, %s]", f.condition(14), ualRegister(n.Rn),
+		ualRegister(n.Rm))
+}
+
+func (n *DivideTHUMB2Instruction) ualString(f *ualFormatter) string {
+	start := "sdiv"
+	if n.Unsigned {
+		start = "udiv"
+	}
+	return fmt.Sprintf("%s%s\t%s, %s, %s", start, f.condition(14),
+		ualRegister(n.Rd), ualRegister(n.Rn), ualRegister(n.Rm))
+}
+
+func (n *BranchTHUMB2Instruction) ualString(f *ualFormatter) string {
+	target, _ := n.pcRelativeTarget(f.pc)
+	if n.Exchange {
+		return fmt.Sprintf("blx%s\t%s", f.condition(14), f.address(target))
+	}
+	if n.Link {
+		return fmt.Sprintf("bl%s\t%s", f.condition(14), f.address(target))
+	}
+	return fmt.Sprintf("b%s.w\t%s", f.condition(n.Condition),
+		f.address(target))
+}
+
+func (n *BarrierTHUMB2Instruction) ualString(f *ualFormatter) string {
+	start := [...]string{"dsb", "dmb", "isb"}[(n.Operation-4)%3]
+	option, ok := barrierOptionStrings[n.Option]
+	if !ok || ((n.Operation == 6) && (n.Option != 15)) {
+		option = fmt.Sprintf("#%d", n.Option)
+	}
+	return start + f.condition(14) + "\t" + option
+}
+
+func (n *StatusRegisterTHUMB2Instruction) ualString(f *ualFormatter) string {
+	// objdump prints the register names in upper case, but not the fields.
+	psr := strings.ToUpper(n.psrString())
+	underscore := strings.Index(psr, "_")
+	if (underscore >= 0) && (psr != "BASEPRI_MAX") {
+		psr = psr[:underscore] + strings.ToLower(psr[underscore:])
+	}
+	if n.WritePSR {
+		return fmt.Sprintf("msr%s\t%s, %s", f.condition(14), psr,
+			ualRegister(n.Rd))
+	}
+	return fmt.Sprintf("mrs%s\t%s, %s", f.condition(14), ualRegister(n.Rd),
+		psr)
+}
@@ -0,0 +1,136 @@
+package arm_emulate
+
+// This file contains the UAL formatting of the VFP instructions, which
+// renames the original VFP mnemonics (fadds, fldmiad and so on) to the "v"
+// forms used by later architectures.
+
+import (
+	"fmt"
+)
+
+var ualVFPOpcodeStrings = [...]string{"vmla", "vmls", "vnmls", "vnmla",
+	"vmul", "vnmul", "vadd", "vsub", "vdiv", "vmov", "vabs", "vneg", "vsqrt",
+	"vcmp", "vcmpe", "vcmp", "vcmpe", "vcvt", "vcvt", "vcvt", "vcvtr", "vcvt",
+	"vcvtr", "vcvt"}
+
+// Returns the data type suffix of a VFP operation, such as ".f32", or
+// ".s32.f64" for conversions.
+func (n *VFPDataOperationInstruction) ualType() string {
+	precision := ".f32"
+	if n.Double {
+		precision = ".f64"
+	}
+	switch n.Opcode {
+	case fcvtVFPOpcode:
+		if n.Double {
+			return ".f32.f64"
+		}
+		return ".f64.f32"
+	case fuitoVFPOpcode:
+		return precision + ".u32"
+	case fsitoVFPOpcode:
+		return precision + ".s32"
+	case ftouiVFPOpcode, ftouizVFPOpcode:
+		return ".u32" + precision
+	case ftosiVFPOpcode, ftosizVFPOpcode:
+		return ".s32" + precision
+	}
+	return precision
+}
+
+func (n *VFPDataOperationInstruction) ualString(f *ualFormatter) string {
+	start := "<invalid>"
+	if int(n.Opcode) < len(ualVFPOpcodeStrings) {
+		start = ualVFPOpcodeStrings[n.Opcode]
+	}
+	start += f.condition(n.Condition()) + n.ualType()
+	fd := vfpRegisterString(n.Fd, n.DoubleDestination())
+	if (n.Opcode == fcmpzVFPOpcode) || (n.Opcode == fcmpezVFPOpcode) {
+		return fmt.Sprintf("%s\t%s, #0.0", start, fd)
+	}
+	fm := vfpRegisterString(n.Fm, n.DoubleSource())
+	if n.Opcode.isUnary() {
+		return fmt.Sprintf("%s\t%s, %s", start, fd, fm)
+	}
+	return fmt.Sprintf("%s\t%s, %s, %s", start, fd,
+		vfpRegisterString(n.Fn, n.Double), fm)
+}
+
+func (n *VFPDataTransferInstruction) ualString(f *ualFormatter) string {
+	condition := f.condition(n.Condition())
+	if !n.Multiple {
+		start := "vstr"
+		if n.Load {
+			start = "vldr"
+		}
+		return fmt.Sprintf("%s%s\t%s, %s", start, condition,
+			vfpRegisterString(n.Fd, n.Double), f.immediateAddress(n.Rn,
+				uint32(n.Offset)<<2, n.Up, true, false, true))
+	}
+	list := "{" + vfpRegisterString(n.Fd, n.Double)
+	if n.Count > 1 {
+		list += "-" + vfpRegisterString(n.Fd+n.Count-1, n.Double)
+	}
+	list += "}"
+	extended := n.Double && ((n.Offset & 1) != 0)
+	if (n.Rn == 13) && n.WriteBack && !extended {
+		if !n.Load && !n.Up {
+			return fmt.Sprintf("vpush%s\t%s", condition, list)
+		}
+		if n.Load && n.Up {
+			return fmt.Sprintf("vpop%s\t%s", condition, list)
+		}
+	}
+	start := "vstm"
+	if n.Load {
+		start = "vldm"
+	}
+	if extended {
+		// The "x" forms have no UAL equivalent.
+		start = "fstm"
+		if n.Load {
+			start = "fldm"
+		}
+	}
+	if n.Up {
+		start += "ia"
+	} else {
+		start += "db"
+	}
+	if extended {
+		start += "x"
+	}
+	rn := ualRegister(n.Rn)
+	if n.WriteBack {
+		rn += "!"
+	}
+	return fmt.Sprintf("%s%s\t%s, %s", start, condition, rn, list)
+}
+
+func (n *VFPRegisterTransferInstruction) ualString(f *ualFormatter) string {
+	condition := f.condition(n.Condition())
+	rd := ualRegister(n.Rd)
+	if n.SystemRegister {
+		name := vfpSystemRegisterString(n.Fn)
+		if !n.Load {
+			return fmt.Sprintf("vmsr%s\t%s, %s", condition, name, rd)
+		}
+		if (n.Rd == 15) && (n.Fn == 1) {
+			return fmt.Sprintf("vmrs%s\tAPSR_nzcv, fpscr", condition)
+		}
+		return fmt.Sprintf("vmrs%s\t%s, %s", condition, rd, name)
+	}
+	if n.CoprocNumber != 11 {
+		fn := vfpRegisterString(n.Fn, false)
+		if n.Load {
+			return fmt.Sprintf("vmov%s\t%s, %s", condition, rd, fn)
+		}
+		return fmt.Sprintf("vmov%s\t%s, %s", condition, fn, rd)
+	}
+	fn := fmt.Sprintf("%s[%d]", vfpRegisterString(n.Fn, true),
+		n.CoprocOpcode&1)
+	if n.Load {
+		return fmt.Sprintf("vmov%s.32\t%s, %s", condition, rd, fn)
+	}
+	return fmt.Sprintf("vmov%s.32\t%s, %s", condition, fn, rd)
+}
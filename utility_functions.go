@@ -1,5 +1,9 @@
 package arm_emulate
 
+import (
+	"path/filepath"
+)
+
 // Returns the overflow flag for the two inputs
 func isOverflow(a, b uint32, sub bool) bool {
 	aSign := (a & 0x80000000) != 0
@@ -57,3 +61,22 @@ func isOverflowC(a, b uint32, carryIn, sub bool) bool {
 	resultSign := ((a + b + carryValue) & 0x80000000) != 0
 	return (aSign == bSign) && (resultSign != aSign)
 }
+
+// Returns the host path corresponding to a path used by emulated code. If root
+// isn't empty, the path is resolved relative to it and can't escape it.
+func sandboxedPath(root, path string) string {
+	if root == "" {
+		return path
+	}
+	// Cleaning the path as an absolute path removes any leading "..".
+	return filepath.Join(root, filepath.Clean("/"+path))
+}
+
+// Adds or subtracts the offset from the base, depending on the U bit used by
+// load and store instructions.
+func addOffset(base, offset uint32, up bool) uint32 {
+	if up {
+		return base + offset
+	}
+	return base - offset
+}
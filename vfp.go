@@ -0,0 +1,764 @@
+package arm_emulate
+
+// This file implements a VFPv2 floating-point coprocessor, which carries out
+// the instructions for coprocessors 10 (single precision) and 11 (double
+// precision).
+
+import (
+	"fmt"
+	"math"
+)
+
+// Bits in the FPSCR.
+const (
+	fpscrInvalidOperation uint32 = 1 << 0
+	fpscrDivideByZero     uint32 = 1 << 1
+	fpscrOverflow         uint32 = 1 << 2
+	fpscrUnderflow        uint32 = 1 << 3
+	fpscrInexact          uint32 = 1 << 4
+	fpscrInputDenormal    uint32 = 1 << 7
+	fpscrFlushToZero      uint32 = 1 << 24
+	fpscrDefaultNaN       uint32 = 1 << 25
+	fpscrWritableBits     uint32 = 0xf3f79f9f
+)
+
+// The rounding modes, in bits 23:22 of the FPSCR. The FPA uses the same
+// values in its instructions.
+const (
+	roundToNearest            uint8 = 0
+	roundTowardsPlusInfinity  uint8 = 1
+	roundTowardsMinusInfinity uint8 = 2
+	roundTowardsZero          uint8 = 3
+)
+
+// The enable bit in FPEXC. Only the EX and EN bits can be written.
+const (
+	fpexcEnable       uint32 = 1 << 30
+	fpexcWritableBits uint32 = 0xc0000000
+)
+
+// Implements a VFPv2 coprocessor with 32 single-precision registers, which
+// overlap 16 double-precision registers. Create this using AddVFP. As with
+// real hardware, the VFP must be enabled by setting the EN bit in FPEXC
+// before using it. Exception traps aren't supported, so exceptions only set
+// the cumulative flags in the FPSCR.
+type VFP struct {
+	// The value of the FPSID register. This defaults to the value of a VFP9-S.
+	ID        uint32
+	registers [32]uint32
+	fpscr     uint32
+	fpexc     uint32
+}
+
+// Returns the value of a single-precision register.
+func (v *VFP) SingleRegister(register uint8) float32 {
+	return math.Float32frombits(v.registers[register&0x1f])
+}
+
+func (v *VFP) SetSingleRegister(register uint8, value float32) {
+	v.registers[register&0x1f] = math.Float32bits(value)
+}
+
+// Returns the value of a double-precision register.
+func (v *VFP) DoubleRegister(register uint8) float64 {
+	return math.Float64frombits(v.getBits(register, true))
+}
+
+func (v *VFP) SetDoubleRegister(register uint8, value float64) {
+	v.setBits(register, true, math.Float64bits(value))
+}
+
+func (v *VFP) FPSCR() uint32 {
+	return v.fpscr
+}
+
+func (v *VFP) SetFPSCR(value uint32) {
+	v.fpscr = value & fpscrWritableBits
+}
+
+func (v *VFP) FPEXC() uint32 {
+	return v.fpexc
+}
+
+func (v *VFP) SetFPEXC(value uint32) {
+	v.fpexc = value & fpexcWritableBits
+}
+
+// Returns the raw bits of a register. Single-precision values are in the low
+// 32 bits.
+func (v *VFP) getBits(register uint8, double bool) uint64 {
+	if !double {
+		return uint64(v.registers[register&0x1f])
+	}
+	register = (register & 0xf) << 1
+	return (uint64(v.registers[register+1]) << 32) |
+		uint64(v.registers[register])
+}
+
+func (v *VFP) setBits(register uint8, double bool, value uint64) {
+	if !double {
+		v.registers[register&0x1f] = uint32(value)
+		return
+	}
+	register = (register & 0xf) << 1
+	v.registers[register] = uint32(value)
+	v.registers[register+1] = uint32(value >> 32)
+}
+
+func (v *VFP) roundingMode() uint8 {
+	return uint8((v.fpscr >> 22) & 3)
+}
+
+// Returns the sign bit of a single or double-precision value.
+func vfpSignBit(double bool) uint64 {
+	if double {
+		return 1 << 63
+	}
+	return 1 << 31
+}
+
+func vfpIsNaN(bits uint64, double bool) bool {
+	if double {
+		return ((bits & 0x7ff0000000000000) == 0x7ff0000000000000) &&
+			((bits & 0x000fffffffffffff) != 0)
+	}
+	return ((bits & 0x7f800000) == 0x7f800000) && ((bits & 0x007fffff) != 0)
+}
+
+func vfpIsSignalingNaN(bits uint64, double bool) bool {
+	if !vfpIsNaN(bits, double) {
+		return false
+	}
+	if double {
+		return (bits & 0x0008000000000000) == 0
+	}
+	return (bits & 0x00400000) == 0
+}
+
+// Returns true if the value is a nonzero denormal number.
+func vfpIsDenormal(bits uint64, double bool) bool {
+	if double {
+		return ((bits & 0x7ff0000000000000) == 0) &&
+			((bits & 0x000fffffffffffff) != 0)
+	}
+	return ((bits & 0x7f800000) == 0) && ((bits & 0x007fffff) != 0)
+}
+
+func vfpQuietNaN(bits uint64, double bool) uint64 {
+	if double {
+		return bits | 0x0008000000000000
+	}
+	return bits | 0x00400000
+}
+
+func vfpDefaultNaN(double bool) uint64 {
+	if double {
+		return 0x7ff8000000000000
+	}
+	return 0x7fc00000
+}
+
+// Returns -1, 0 or 1 depending on the sign of x. NaNs return 0.
+func floatSign(x float64) int {
+	if x < 0 {
+		return -1
+	}
+	if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Returns the value of an operand, flushing denormal values to zero if
+// flush-to-zero mode is enabled.
+func (v *VFP) operandValue(bits uint64, double bool) float64 {
+	if ((v.fpscr & fpscrFlushToZero) != 0) && vfpIsDenormal(bits, double) {
+		v.fpscr |= fpscrInputDenormal
+		bits &= vfpSignBit(double)
+	}
+	if double {
+		return math.Float64frombits(bits)
+	}
+	return float64(math.Float32frombits(uint32(bits)))
+}
+
+// If any of the operands are NaNs, this returns the result of the operation
+// and true. The first signaling NaN takes priority over quiet NaNs, and
+// causes an invalid operation exception.
+func (v *VFP) processNaNs(double bool, operands ...uint64) (uint64, bool) {
+	var result uint64
+	found := false
+	for _, operand := range operands {
+		if vfpIsSignalingNaN(operand, double) {
+			v.fpscr |= fpscrInvalidOperation
+			result = vfpQuietNaN(operand, double)
+			found = true
+			break
+		}
+	}
+	if !found {
+		for _, operand := range operands {
+			if vfpIsNaN(operand, double) {
+				result = operand
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	if (v.fpscr & fpscrDefaultNaN) != 0 {
+		result = vfpDefaultNaN(double)
+	}
+	return result, true
+}
+
+// Returns the next value after x in the given direction, at the given
+// precision.
+func nextFloat(x float64, up bool, double bool) float64 {
+	target := math.Inf(-1)
+	if up {
+		target = math.Inf(1)
+	}
+	if double {
+		return math.Nextafter(x, target)
+	}
+	return float64(math.Nextafter32(float32(x), float32(target)))
+}
+
+// Rounds x to single or double precision using the given rounding mode.
+// Double-precision values of x must already be correctly rounded to the
+// nearest value, and errorSign gives the sign of the difference between the
+// exact value and x. Returns the rounded value and the sign of the difference
+// between it and the exact value.
+func roundFloat(x float64, errorSign int, double bool, mode uint8) (float64,
+	int) {
+	result := x
+	difference := -errorSign
+	if !double {
+		result = float64(float32(x))
+		if result > x {
+			difference = 1
+		} else if result < x {
+			difference = -1
+		}
+	}
+	switch mode {
+	case roundTowardsPlusInfinity:
+		if difference < 0 {
+			result = nextFloat(result, true, double)
+			difference = 1
+		}
+	case roundTowardsMinusInfinity:
+		if difference > 0 {
+			result = nextFloat(result, false, double)
+			difference = -1
+		}
+	case roundTowardsZero:
+		if (difference > 0) && (result > 0) {
+			result = nextFloat(result, false, double)
+			difference = -1
+		} else if (difference < 0) && (result < 0) {
+			result = nextFloat(result, true, double)
+			difference = 1
+		}
+	}
+	return result, difference
+}
+
+// Returns true if rounding x to the given precision, with the given
+// difference from roundFloat, overflowed.
+func roundingOverflowed(x float64, difference int, double bool) bool {
+	if !double {
+		x = float64(float32(x))
+	}
+	return math.IsInf(x, 0) && (difference != 0)
+}
+
+// Rounds x to the destination precision using the current rounding mode, as
+// described for roundFloat. This records the inexact, overflow and underflow
+// exceptions, and flushes tiny results to zero in flush-to-zero mode.
+func (v *VFP) round(x float64, errorSign int, double bool) uint64 {
+	result, difference := roundFloat(x, errorSign, double, v.roundingMode())
+	overflow := roundingOverflowed(x, difference, double)
+	minNormal := math.Float64frombits(0x0010000000000000)
+	if !double {
+		minNormal = float64(math.Float32frombits(0x00800000))
+	}
+	tiny := (result != 0) && (math.Abs(result) < minNormal)
+	if tiny && ((v.fpscr & fpscrFlushToZero) != 0) {
+		v.fpscr |= fpscrUnderflow
+		result = math.Copysign(0, result)
+	} else if difference != 0 {
+		v.fpscr |= fpscrInexact
+		if overflow {
+			v.fpscr |= fpscrOverflow
+		}
+		if tiny || (result == 0) {
+			v.fpscr |= fpscrUnderflow
+		}
+	}
+	if double {
+		return math.Float64bits(result)
+	}
+	return uint64(math.Float32bits(float32(result)))
+}
+
+// Returns the sign of the rounding error in s = a + b.
+func additionErrorSign(a, b, s float64) int {
+	if math.IsInf(s, 0) {
+		return 0
+	}
+	bb := s - a
+	return floatSign((a - (s - bb)) + (b - bb))
+}
+
+// Carries out an addition, subtraction, multiplication or division.
+func (v *VFP) arithmetic(opcode VFPOpcode, a, b uint64, double bool) uint64 {
+	result, isNaN := v.processNaNs(double, a, b)
+	if isNaN {
+		return result
+	}
+	x := v.operandValue(a, double)
+	y := v.operandValue(b, double)
+	var value float64
+	errorSign := 0
+	divideByZero := false
+	switch opcode {
+	case faddVFPOpcode, fsubVFPOpcode:
+		if opcode == fsubVFPOpcode {
+			y = -y
+		}
+		value = x + y
+		errorSign = additionErrorSign(x, y, value)
+		// Exact zero sums are only positive if both operands were positive
+		// zeros, when rounding towards minus infinity.
+		if (value == 0) && (errorSign == 0) &&
+			(v.roundingMode() == roundTowardsMinusInfinity) &&
+			!((x == 0) && !math.Signbit(x) && (y == 0) && !math.Signbit(y)) {
+			value = math.Copysign(0, -1)
+		}
+	case fmulVFPOpcode:
+		value = x * y
+		if !math.IsInf(value, 0) {
+			errorSign = floatSign(math.FMA(x, y, -value))
+		}
+	case fdivVFPOpcode:
+		divideByZero = (y == 0) && (x != 0) && !math.IsInf(x, 0)
+		value = x / y
+		if !math.IsInf(value, 0) && (value != 0) {
+			errorSign = floatSign(math.FMA(-value, y, x)) * floatSign(y)
+		}
+	}
+	if math.IsNaN(value) {
+		v.fpscr |= fpscrInvalidOperation
+		return vfpDefaultNaN(double)
+	}
+	if divideByZero {
+		v.fpscr |= fpscrDivideByZero
+	} else if math.IsInf(value, 0) && !math.IsInf(x, 0) &&
+		!math.IsInf(y, 0) {
+		// The result overflowed.
+		errorSign = -floatSign(value)
+	}
+	return v.round(value, errorSign, double)
+}
+
+func (v *VFP) squareRoot(a uint64, double bool) uint64 {
+	result, isNaN := v.processNaNs(double, a)
+	if isNaN {
+		return result
+	}
+	x := v.operandValue(a, double)
+	if x < 0 {
+		v.fpscr |= fpscrInvalidOperation
+		return vfpDefaultNaN(double)
+	}
+	value := math.Sqrt(x)
+	errorSign := 0
+	if !math.IsInf(value, 0) {
+		errorSign = floatSign(math.FMA(-value, value, x))
+	}
+	return v.round(value, errorSign, double)
+}
+
+// Sets the FPSCR flags to the result of comparing a and b. If signalNaNs is
+// set, quiet NaNs also cause an invalid operation exception.
+func (v *VFP) compare(a, b uint64, double, signalNaNs bool) {
+	var flags uint32
+	if vfpIsNaN(a, double) || vfpIsNaN(b, double) {
+		if signalNaNs || vfpIsSignalingNaN(a, double) ||
+			vfpIsSignalingNaN(b, double) {
+			v.fpscr |= fpscrInvalidOperation
+		}
+		flags = 0x3
+	} else {
+		x := v.operandValue(a, double)
+		y := v.operandValue(b, double)
+		if x == y {
+			flags = 0x6
+		} else if x < y {
+			flags = 0x8
+		} else {
+			flags = 0x2
+		}
+	}
+	v.fpscr = (v.fpscr & 0x0fffffff) | (flags << 28)
+}
+
+// Converts a value between single and double precision.
+func (v *VFP) convertPrecision(a uint64, toDouble bool) uint64 {
+	if vfpIsNaN(a, !toDouble) {
+		if vfpIsSignalingNaN(a, !toDouble) {
+			v.fpscr |= fpscrInvalidOperation
+		}
+		if (v.fpscr & fpscrDefaultNaN) != 0 {
+			return vfpDefaultNaN(toDouble)
+		}
+		a = vfpQuietNaN(a, !toDouble)
+		if toDouble {
+			return ((a & 0x80000000) << 32) | 0x7ff0000000000000 |
+				((a & 0x007fffff) << 29)
+		}
+		return ((a >> 32) & 0x80000000) | 0x7f800000 |
+			((a >> 29) & 0x007fffff)
+	}
+	return v.round(v.operandValue(a, !toDouble), 0, toDouble)
+}
+
+// Rounds x to an integral value using the given rounding mode.
+func roundToInteger(x float64, mode uint8) float64 {
+	switch mode {
+	case roundToNearest:
+		return math.RoundToEven(x)
+	case roundTowardsPlusInfinity:
+		return math.Ceil(x)
+	case roundTowardsMinusInfinity:
+		return math.Floor(x)
+	}
+	return math.Trunc(x)
+}
+
+// Converts a floating-point value to a 32-bit integer. If roundToZero isn't
+// set, the current rounding mode is used.
+func (v *VFP) toInteger(a uint64, double, signed, roundToZero bool) uint64 {
+	if vfpIsNaN(a, double) {
+		v.fpscr |= fpscrInvalidOperation
+		return 0
+	}
+	x := v.operandValue(a, double)
+	mode := v.roundingMode()
+	if roundToZero {
+		mode = roundTowardsZero
+	}
+	rounded := roundToInteger(x, mode)
+	minimum, maximum := 0.0, float64(math.MaxUint32)
+	if signed {
+		minimum, maximum = math.MinInt32, math.MaxInt32
+	}
+	if rounded < minimum {
+		v.fpscr |= fpscrInvalidOperation
+		rounded = minimum
+	} else if rounded > maximum {
+		v.fpscr |= fpscrInvalidOperation
+		rounded = maximum
+	} else if rounded != x {
+		v.fpscr |= fpscrInexact
+	}
+	if signed {
+		return uint64(uint32(int32(rounded)))
+	}
+	return uint64(uint32(rounded))
+}
+
+// Converts a 32-bit integer to a floating-point value.
+func (v *VFP) fromInteger(a uint64, double, signed bool) uint64 {
+	x := float64(uint32(a))
+	if signed {
+		x = float64(int32(uint32(a)))
+	}
+	return v.round(x, 0, double)
+}
+
+// Carries out a single scalar operation.
+func (v *VFP) scalarOperation(n *VFPDataOperationInstruction, fd, fn,
+	fm uint8) {
+	double := n.Double
+	signBit := vfpSignBit(double)
+	a := v.getBits(fn, double)
+	b := v.getBits(fm, n.DoubleSource())
+	var result uint64
+	switch n.Opcode {
+	case fmacVFPOpcode, fnmacVFPOpcode, fmscVFPOpcode, fnmscVFPOpcode:
+		product := v.arithmetic(fmulVFPOpcode, a, b, double)
+		if (n.Opcode == fnmacVFPOpcode) || (n.Opcode == fnmscVFPOpcode) {
+			product ^= signBit
+		}
+		addend := v.getBits(fd, double)
+		if (n.Opcode == fmscVFPOpcode) || (n.Opcode == fnmscVFPOpcode) {
+			addend ^= signBit
+		}
+		result = v.arithmetic(faddVFPOpcode, addend, product, double)
+	case fmulVFPOpcode, faddVFPOpcode, fsubVFPOpcode, fdivVFPOpcode:
+		result = v.arithmetic(n.Opcode, a, b, double)
+	case fnmulVFPOpcode:
+		result = v.arithmetic(fmulVFPOpcode, a, b, double)
+		if !vfpIsNaN(result, double) {
+			result ^= signBit
+		}
+	case fcpyVFPOpcode:
+		result = b
+	case fabsVFPOpcode:
+		result = b &^ signBit
+	case fnegVFPOpcode:
+		result = b ^ signBit
+	case fsqrtVFPOpcode:
+		result = v.squareRoot(b, double)
+	case fcmpVFPOpcode, fcmpeVFPOpcode:
+		v.compare(v.getBits(fd, double), b, double,
+			n.Opcode == fcmpeVFPOpcode)
+		return
+	case fcmpzVFPOpcode, fcmpezVFPOpcode:
+		v.compare(v.getBits(fd, double), 0, double,
+			n.Opcode == fcmpezVFPOpcode)
+		return
+	case fcvtVFPOpcode:
+		result = v.convertPrecision(b, !double)
+	case fuitoVFPOpcode, fsitoVFPOpcode:
+		result = v.fromInteger(b, double, n.Opcode == fsitoVFPOpcode)
+	case ftouiVFPOpcode, ftouizVFPOpcode, ftosiVFPOpcode, ftosizVFPOpcode:
+		signed := (n.Opcode == ftosiVFPOpcode) ||
+			(n.Opcode == ftosizVFPOpcode)
+		toZero := (n.Opcode == ftouizVFPOpcode) ||
+			(n.Opcode == ftosizVFPOpcode)
+		result = v.toInteger(b, double, signed, toZero)
+	}
+	v.setBits(fd, n.DoubleDestination(), result)
+}
+
+// Returns the next register in a short vector, which wraps around within its
+// bank of 8 single or 4 double-precision registers.
+func vfpNextVectorRegister(register, stride uint8, double bool) uint8 {
+	bankMask := uint8(7)
+	if double {
+		bankMask = 3
+	}
+	return (register &^ bankMask) | ((register + stride) & bankMask)
+}
+
+// Returns an error if the VFP isn't enabled.
+func (v *VFP) checkEnabled() error {
+	if (v.fpexc & fpexcEnable) == 0 {
+		return fmt.Errorf("The VFP isn't enabled: %w", errUndefinedInstruction)
+	}
+	return nil
+}
+
+// Carries out a data processing instruction. If the FPSCR's LEN field is
+// nonzero and the destination isn't in the first register bank, vectorizable
+// operations are repeated for each element of a short vector. Fm remains
+// scalar if it's in the first register bank.
+func (v *VFP) operation(p ARMProcessor, raw uint32) error {
+	e := v.checkEnabled()
+	if e != nil {
+		return e
+	}
+	parsed, e := parseVFPDataOperationInstruction(raw)
+	if e != nil {
+		return fmt.Errorf("%s: %w", e, errUndefinedInstruction)
+	}
+	n := parsed.(*VFPDataOperationInstruction)
+	length := uint8(((v.fpscr >> 16) & 7) + 1)
+	stride := uint8(1)
+	if ((v.fpscr >> 20) & 3) == 3 {
+		stride = 2
+	}
+	bankMask := uint8(0x18)
+	if n.Double {
+		bankMask = 0xc
+	}
+	if !n.Opcode.isVectorizable() || ((n.Fd & bankMask) == 0) {
+		length = 1
+	}
+	scalarFm := (n.Fm & bankMask) == 0
+	fd, fn, fm := n.Fd, n.Fn, n.Fm
+	for i := uint8(0); i < length; i++ {
+		v.scalarOperation(n, fd, fn, fm)
+		fd = vfpNextVectorRegister(fd, stride, n.Double)
+		fn = vfpNextVectorRegister(fn, stride, n.Double)
+		if !scalarFm {
+			fm = vfpNextVectorRegister(fm, stride, n.Double)
+		}
+	}
+	return nil
+}
+
+// Loads or stores a single-precision register, or one of the halves of a
+// double-precision register.
+func (v *VFP) transferWord(m ARMMemory, address uint32, register uint8,
+	load bool) error {
+	if !load {
+		return m.WriteMemoryWord(address, v.registers[register])
+	}
+	value, e := m.ReadMemoryWord(address)
+	if e != nil {
+		return e
+	}
+	v.registers[register] = value
+	return nil
+}
+
+// Carries out fld, fst, fldm and fstm. The address has already had the
+// offset applied for fld and fst, and is the lowest address transferred.
+func (v *VFP) dataTransfer(p ARMProcessor, raw, address uint32) error {
+	e := v.checkEnabled()
+	if e != nil {
+		return e
+	}
+	parsed, e := parseVFPDataTransferInstruction(raw)
+	if e != nil {
+		return fmt.Errorf("%s: %w", e, errUndefinedInstruction)
+	}
+	n := parsed.(*VFPDataTransferInstruction)
+	count := uint8(1)
+	if n.Multiple {
+		count = n.Count
+	}
+	m := p.GetMemoryInterface()
+	if !n.Double {
+		for i := uint8(0); i < count; i++ {
+			e = v.transferWord(m, address, n.Fd+i, n.Load)
+			if e != nil {
+				return e
+			}
+			address += 4
+		}
+		return nil
+	}
+	for i := uint8(0); i < count; i++ {
+		// Double-precision registers are stored with their most significant
+		// word first in big-endian mode.
+		low := (n.Fd + i) << 1
+		high := low + 1
+		if m.IsBigEndian() {
+			low, high = high, low
+		}
+		e = v.transferWord(m, address, low, n.Load)
+		if e != nil {
+			return e
+		}
+		e = v.transferWord(m, address+4, high, n.Load)
+		if e != nil {
+			return e
+		}
+		address += 8
+	}
+	return nil
+}
+
+// Carries out fmsr, fmrs, fmdlr, fmrdl, fmdhr, fmrdh, fmxr, fmrx and fmstat.
+func (v *VFP) registerTransfer(p ARMProcessor, raw uint32, rd ARMRegister,
+	load bool) error {
+	parsed, e := parseVFPRegisterTransferInstruction(raw)
+	if e != nil {
+		return fmt.Errorf("%s: %w", e, errUndefinedInstruction)
+	}
+	n := parsed.(*VFPRegisterTransferInstruction)
+	// FPSID and FPEXC may be accessed when the VFP is disabled, but only in
+	// privileged modes.
+	if n.SystemRegister && (n.Fn != 1) {
+		if p.GetMode() == userMode {
+			return fmt.Errorf("Can't access %s in user mode: %w",
+				vfpSystemRegisterString(n.Fn), errUndefinedInstruction)
+		}
+	} else {
+		e = v.checkEnabled()
+		if e != nil {
+			return e
+		}
+	}
+	var register *uint32
+	if n.SystemRegister {
+		switch n.Fn {
+		case 0:
+			register = &(v.ID)
+		case 1:
+			register = &(v.fpscr)
+		case 8:
+			register = &(v.fpexc)
+		}
+	} else if n.CoprocNumber == 10 {
+		register = &(v.registers[n.Fn])
+	} else {
+		register = &(v.registers[(n.Fn<<1)+n.CoprocOpcode])
+	}
+	if load {
+		if rd != 15 {
+			return p.SetRegister(rd, *register)
+		}
+		if !n.SystemRegister || (n.Fn != 1) {
+			return fmt.Errorf("Invalid VFP transfer to r15")
+		}
+		// fmstat copies the FPSCR flags to the CPSR.
+		cpsr, e := p.GetCPSR()
+		if e != nil {
+			return e
+		}
+		return p.SetCPSR((cpsr & 0x0fffffff) | (v.fpscr & 0xf0000000))
+	}
+	value, e := p.GetRegister(rd)
+	if e != nil {
+		return e
+	}
+	if !n.SystemRegister {
+		*register = value
+		return nil
+	}
+	switch n.Fn {
+	case 1:
+		v.SetFPSCR(value)
+	case 8:
+		v.SetFPEXC(value)
+	}
+	return nil
+}
+
+// The ARMCoprocessor interface for one of the VFP's two coprocessor numbers.
+type vfpCoprocessor struct {
+	vfp    *VFP
+	number uint8
+}
+
+func (c *vfpCoprocessor) Number() uint8 {
+	return c.number
+}
+
+func (c *vfpCoprocessor) Operation(p ARMProcessor, raw uint32) error {
+	return c.vfp.operation(p, raw)
+}
+
+func (c *vfpCoprocessor) DataTransfer(p ARMProcessor, raw,
+	address uint32) error {
+	return c.vfp.dataTransfer(p, raw, address)
+}
+
+func (c *vfpCoprocessor) RegisterTransfer(p ARMProcessor, raw uint32,
+	rd ARMRegister, load bool) error {
+	return c.vfp.registerTransfer(p, raw, rd, load)
+}
+
+// Creates a VFP and adds it to the processor as coprocessors 10 and 11. The
+// VFP starts out disabled.
+func AddVFP(p ARMProcessor) (*VFP, error) {
+	var v VFP
+	v.ID = 0x41011090
+	for _, number := range []uint8{10, 11} {
+		e := p.AddCoprocessor(&vfpCoprocessor{&v, number})
+		if e != nil {
+			return nil, fmt.Errorf("Failed adding VFP coprocessor %d: %s",
+				number, e)
+		}
+	}
+	return &v, nil
+}
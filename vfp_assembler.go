@@ -0,0 +1,316 @@
+package arm_emulate
+
+// This file contains the parts of the assembler which encode VFP
+// instructions, using the pre-UAL names printed by the disassembler.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Parses a VFP register name, returning the 4-bit register field and the
+// extra bit which selects odd single precision registers.
+func parseVFPRegister(t assemblerToken, double bool) (uint32, uint32,
+	error) {
+	name := t.lower()
+	prefix := "s"
+	maximum := uint64(31)
+	if double {
+		prefix = "d"
+		maximum = 15
+	}
+	if strings.HasPrefix(name, prefix) {
+		value, e := strconv.ParseUint(name[1:], 10, 8)
+		if (e == nil) && (value <= maximum) {
+			if double {
+				return uint32(value), 0, nil
+			}
+			return uint32(value >> 1), uint32(value & 1), nil
+		}
+	}
+	if double {
+		return 0, 0, t.errorf("Expected a register from d0 to d15, got %q",
+			t.text)
+	}
+	return 0, 0, t.errorf("Expected a register from s0 to s31, got %q",
+		t.text)
+}
+
+// Returns an error if the mnemonic is missing its precision suffix, such as
+// the "s" in fadds.
+func (s *armAssemblerStatement) expectVFPSuffix() error {
+	if s.suffix == "" {
+		return s.errorf("%s requires a precision suffix", s.mnemonic.text)
+	}
+	return nil
+}
+
+// Returns the coprocessor number bit for single or double precision.
+func vfpPrecisionBits(double bool) uint32 {
+	if double {
+		return 0xb00
+	}
+	return 0xa00
+}
+
+func (s *armAssemblerStatement) encodeVFPDataOperation() (uint32, error) {
+	e := s.expectVFPSuffix()
+	if e != nil {
+		return 0, e
+	}
+	var opcode VFPOpcode
+	for i, name := range vfpOpcodeStrings {
+		if name == s.name {
+			opcode = VFPOpcode(i)
+		}
+	}
+	double := s.suffix == "d"
+	doubleDestination := double && !opcode.isToInteger()
+	doubleSource := double && !opcode.isFromInteger()
+	if opcode == fcvtVFPOpcode {
+		// fcvtds converts single to double precision, using cp10.
+		double = s.suffix == "sd"
+		doubleDestination = !double
+		doubleSource = double
+	}
+	count := 3
+	switch {
+	case (opcode == fcmpzVFPOpcode) || (opcode == fcmpezVFPOpcode):
+		count = 1
+	case opcode.isUnary():
+		count = 2
+	}
+	e = s.expectOperands(count)
+	if e != nil {
+		return 0, e
+	}
+	raw := (s.condition << 28) | 0x0e000000 | vfpPrecisionBits(double)
+	fd, d, e := parseVFPRegister(s.operands[0], doubleDestination)
+	if e != nil {
+		return 0, e
+	}
+	raw |= (fd << 12) | (d << 22)
+	if count == 3 {
+		fn, n, e := parseVFPRegister(s.operands[1], double)
+		if e != nil {
+			return 0, e
+		}
+		raw |= (fn << 16) | (n << 7)
+		pqrs := uint32(opcode)
+		raw |= ((pqrs & 8) << 20) | ((pqrs & 6) << 19) | ((pqrs & 1) << 6)
+	} else {
+		var extension uint32
+		for value, o := range vfpExtensionOpcodes {
+			if o == opcode {
+				extension = uint32(value)
+			}
+		}
+		raw |= 0xb00040 | ((extension >> 1) << 16) | ((extension & 1) << 7)
+	}
+	if count > 1 {
+		fm, m, e := parseVFPRegister(s.operands[count-1], doubleSource)
+		if e != nil {
+			return 0, e
+		}
+		raw |= fm | (m << 5)
+	}
+	return raw, nil
+}
+
+func (s *armAssemblerStatement) encodeVFPDataTransfer() (uint32, error) {
+	e := s.expectVFPSuffix()
+	if e != nil {
+		return 0, e
+	}
+	e = s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	double := s.suffix == "d"
+	fd, d, e := parseVFPRegister(s.operands[0], double)
+	if e != nil {
+		return 0, e
+	}
+	address, e := s.parseAddress(s.operands[1:])
+	if e != nil {
+		return 0, e
+	}
+	if !address.immediate || !address.preindex || address.writeBack {
+		return 0, address.token.errorf("%s requires an immediate offset "+
+			"without writeback", s.mnemonic.text)
+	}
+	if ((address.offset & 3) != 0) || (address.offset > 1020) {
+		return 0, address.token.errorf("Offset %d must be a multiple of 4 "+
+			"up to 1020", address.offset)
+	}
+	raw := (s.condition << 28) | 0x0d000000 | vfpPrecisionBits(double) |
+		(d << 22) | (uint32(address.rn) << 16) | (fd << 12) |
+		(address.offset >> 2)
+	if address.up {
+		raw |= 0x800000
+	}
+	if s.name == "fld" {
+		raw |= 0x100000
+	}
+	return raw, nil
+}
+
+// Encodes fldm and fstm, which have suffixes for the addressing mode
+// followed by the precision.
+func (s *armAssemblerStatement) encodeVFPMultipleTransfer() (uint32, error) {
+	e := s.expectVFPSuffix()
+	if e != nil {
+		return 0, e
+	}
+	e = s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	mode := s.suffix[:2]
+	precision := s.suffix[2:]
+	double := precision != "s"
+	base := s.operands[0]
+	writeBack := strings.HasSuffix(base.text, "!")
+	if writeBack {
+		base = base.slice(0, len(base.text)-1)
+	}
+	rn, e := expectAssemblerRegister(base)
+	if e != nil {
+		return 0, e
+	}
+	raw := (s.condition << 28) | 0x0c000000 | vfpPrecisionBits(double) |
+		(uint32(rn) << 16)
+	if mode == "db" {
+		if !writeBack {
+			return 0, base.errorf("%s requires writeback", s.mnemonic.text)
+		}
+		raw |= 0x1000000
+	} else {
+		raw |= 0x800000
+	}
+	if writeBack {
+		raw |= 0x200000
+	}
+	if strings.HasPrefix(s.name, "fld") {
+		raw |= 0x100000
+	}
+	list := s.operands[1]
+	if !strings.HasPrefix(list.text, "{") || !strings.HasSuffix(list.text,
+		"}") {
+		return 0, list.errorf("Expected a register list, got %q", list.text)
+	}
+	registers := list.slice(1, len(list.text)-1)
+	first, last := registers, registers
+	if dash := strings.IndexByte(registers.text, '-'); dash >= 0 {
+		first = registers.slice(0, dash)
+		last = registers.slice(dash+1, len(registers.text))
+	}
+	firstField, d, e := parseVFPRegister(first, double)
+	if e != nil {
+		return 0, e
+	}
+	lastField, lastBit, e := parseVFPRegister(last, double)
+	if e != nil {
+		return 0, e
+	}
+	firstNumber := (firstField << 1) | d
+	lastNumber := (lastField << 1) | lastBit
+	if double {
+		firstNumber, lastNumber = firstField, lastField
+	}
+	if lastNumber < firstNumber {
+		return 0, list.errorf("Invalid register range %s", registers.text)
+	}
+	count := lastNumber - firstNumber + 1
+	if double {
+		count *= 2
+		if precision == "x" {
+			count++
+		}
+	}
+	return raw | (d << 22) | (firstField << 12) | count, nil
+}
+
+// Encodes transfers between ARM registers and VFP registers, such as fmsr,
+// fmrdl and fmxr.
+func (s *armAssemblerStatement) encodeVFPRegisterTransfer() (uint32, error) {
+	raw := (s.condition << 28) | 0x0e000a10
+	if s.name == "fmstat" {
+		e := s.expectOperands(0)
+		if e != nil {
+			return 0, e
+		}
+		return raw | 0xf1f000, nil
+	}
+	e := s.expectOperands(2)
+	if e != nil {
+		return 0, e
+	}
+	// The mnemonics ending in "r" move to the VFP register.
+	load := !strings.HasSuffix(s.name, "r")
+	vfp, arm := s.operands[0], s.operands[1]
+	if load {
+		raw |= 0x100000
+		vfp, arm = arm, vfp
+	}
+	rd, e := expectAssemblerRegister(arm)
+	if e != nil {
+		return 0, e
+	}
+	raw |= uint32(rd) << 12
+	switch s.name {
+	case "fmxr", "fmrx":
+		for _, i := range []uint8{0, 1, 8} {
+			if vfpSystemRegisterString(i) == vfp.lower() {
+				return raw | 0xe00000 | (uint32(i) << 16), nil
+			}
+		}
+		return 0, vfp.errorf("Expected fpsid, fpscr or fpexc, got %q",
+			vfp.text)
+	case "fmsr", "fmrs":
+		fn, n, e := parseVFPRegister(vfp, false)
+		if e != nil {
+			return 0, e
+		}
+		return raw | (fn << 16) | (n << 7), nil
+	}
+	fn, _, e := parseVFPRegister(vfp, true)
+	if e != nil {
+		return 0, e
+	}
+	raw |= 0x100 | (fn << 16)
+	if strings.Contains(s.name, "dh") {
+		raw |= 0x200000
+	}
+	return raw, nil
+}
+
+// Adds the VFP mnemonics to the table of ARM mnemonics.
+func addVFPAssemblerMnemonics(add func(name string, suffixes []string,
+	unconditional bool,
+	encode func(s *armAssemblerStatement) (uint32, error))) {
+	precisions := []string{"s", "d"}
+	for _, name := range vfpOpcodeStrings {
+		if name == "fcvt" {
+			add(name, []string{"ds", "sd"}, false,
+				(*armAssemblerStatement).encodeVFPDataOperation)
+			continue
+		}
+		add(name, precisions, false,
+			(*armAssemblerStatement).encodeVFPDataOperation)
+	}
+	add("fld", precisions, false,
+		(*armAssemblerStatement).encodeVFPDataTransfer)
+	add("fst", precisions, false,
+		(*armAssemblerStatement).encodeVFPDataTransfer)
+	multipleSuffixes := []string{"ias", "iad", "iax", "dbs", "dbd", "dbx"}
+	add("fldm", multipleSuffixes, false,
+		(*armAssemblerStatement).encodeVFPMultipleTransfer)
+	add("fstm", multipleSuffixes, false,
+		(*armAssemblerStatement).encodeVFPMultipleTransfer)
+	for _, name := range []string{"fmsr", "fmrs", "fmdlr", "fmdhr", "fmrdl",
+		"fmrdh", "fmxr", "fmrx", "fmstat"} {
+		add(name, nil, false,
+			(*armAssemblerStatement).encodeVFPRegisterTransfer)
+	}
+}
@@ -0,0 +1,408 @@
+package arm_emulate
+
+import (
+	"math"
+	"testing"
+)
+
+// Returns a processor with an enabled VFP, running in supervisor mode.
+func setupVFPTestProcessor() (ARMProcessor, *VFP, error) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		return nil, nil, e
+	}
+	v, e := AddVFP(p)
+	if e != nil {
+		return nil, nil, e
+	}
+	p.SetMode(supervisorMode)
+	v.SetFPEXC(fpexcEnable)
+	return p, v, nil
+}
+
+// Runs a single-precision operation on s1 and s2, with the result in s0.
+// Clears the cumulative exception flags first.
+func runVFPSingleOperation(raw uint32, a, b uint32, p ARMProcessor,
+	v *VFP) (uint32, error) {
+	v.registers[1] = a
+	v.registers[2] = b
+	v.SetFPSCR(v.FPSCR() &^ 0x9f)
+	e := testSingleInstruction(raw, p)
+	return v.registers[0], e
+}
+
+func TestVFPEnable(t *testing.T) {
+	p, e := setupTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	v, e := AddVFP(p)
+	if e != nil {
+		t.Logf("Failed adding the VFP: %s\n", e)
+		t.FailNow()
+	}
+	p.SetArchitecturalExceptions(true)
+	// fadds s0, s1, s2 is undefined until the VFP is enabled.
+	e = testSingleInstruction(0xee300a81, p)
+	if e != nil {
+		t.Logf("Got an error running a disabled VFP instruction: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4100, t)
+	// fmrx r0, fpsid works when disabled, in privileged modes.
+	e = testSingleInstruction(0xeef00a10, p)
+	value, _ := p.GetRegister(0)
+	if (e != nil) || (value != 0x41011090) {
+		t.Logf("Failed reading FPSID: %v, 0x%08x\n", e, value)
+		t.Fail()
+	}
+	// fmxr fpexc, r0
+	p.SetRegister(0, 0xffffffff)
+	e = testSingleInstruction(0xeee80a10, p)
+	if (e != nil) || (v.FPEXC() != 0xc0000000) {
+		t.Logf("Failed enabling the VFP: %v, 0x%08x\n", e, v.FPEXC())
+		t.Fail()
+	}
+	// fmrx r0, fpscr works in user mode, but fmrx r0, fpexc doesn't.
+	v.SetFPSCR(0x12345678)
+	p.SetMode(userMode)
+	e = testSingleInstruction(0xeef10a10, p)
+	value, _ = p.GetRegister(0)
+	if (e != nil) || (value != (0x12345678 & fpscrWritableBits)) {
+		t.Logf("Failed reading FPSCR: %v, 0x%08x\n", e, value)
+		t.Fail()
+	}
+	e = testSingleInstruction(0xeef80a10, p)
+	if e != nil {
+		t.Logf("Got an error reading FPEXC in user mode: %s\n", e)
+		t.FailNow()
+	}
+	checkException(p, undefinedMode, 0x4, 4100, t)
+}
+
+func TestVFPArithmetic(t *testing.T) {
+	p, v, e := setupVFPTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	one := math.Float32bits(1.0)
+	three := math.Float32bits(3.0)
+	type arithmeticTest struct {
+		raw      uint32
+		fpscr    uint32
+		a, b     uint32
+		expected uint32
+		flags    uint32
+	}
+	tests := []arithmeticTest{
+		// fadds s0, s1, s2
+		{0xee300a81, 0, math.Float32bits(1.5), math.Float32bits(2.25),
+			math.Float32bits(3.75), 0},
+		// fdivs s0, s1, s2, with each rounding mode
+		{0xee800a81, 0x000000, one, three, 0x3eaaaaab, fpscrInexact},
+		{0xee800a81, 0x400000, one, three, 0x3eaaaaab, fpscrInexact},
+		{0xee800a81, 0x800000, one, three, 0x3eaaaaaa, fpscrInexact},
+		{0xee800a81, 0xc00000, one, three, 0x3eaaaaaa, fpscrInexact},
+		// fdivs by zero
+		{0xee800a81, 0, one, 0, 0x7f800000, fpscrDivideByZero},
+		{0xee800a81, 0, 0, 0, 0x7fc00000, fpscrInvalidOperation},
+		// fmuls overflowing, rounding to nearest and towards zero
+		{0xee200a81, 0, 0x7f7fffff, math.Float32bits(2.0), 0x7f800000,
+			fpscrOverflow | fpscrInexact},
+		{0xee200a81, 0xc00000, 0x7f7fffff, math.Float32bits(2.0),
+			0x7f7fffff, fpscrOverflow | fpscrInexact},
+		// fsubs s0, s1, s2 with an exact zero result, rounding to minus
+		// infinity.
+		{0xee300ac1, 0x800000, one, one, 0x80000000, 0},
+		// fsqrts s0, s2
+		{0xeeb10ac1, 0, 0, math.Float32bits(4.0), math.Float32bits(2.0), 0},
+		{0xeeb10ac1, 0, 0, math.Float32bits(-4.0), 0x7fc00000,
+			fpscrInvalidOperation},
+		// fadds with a denormal operand, with and without flush-to-zero
+		{0xee300a81, 0, 1, one, one, fpscrInexact},
+		{0xee300a81, fpscrFlushToZero, 1, one, one, fpscrInputDenormal},
+		// fmuls with a denormal result, with and without flush-to-zero
+		{0xee200a81, 0, 0x00800000, math.Float32bits(0.5), 0x00400000, 0},
+		{0xee200a81, 0, 0x00800001, math.Float32bits(0.5), 0x00400000,
+			fpscrInexact | fpscrUnderflow},
+		{0xee200a81, fpscrFlushToZero, 0x00800000, math.Float32bits(0.5), 0,
+			fpscrUnderflow},
+		// NaN propagation, with and without the default NaN
+		{0xee300a81, 0, 0x7fc00001, one, 0x7fc00001, 0},
+		{0xee300a81, fpscrDefaultNaN, 0x7fc00001, one, 0x7fc00000, 0},
+		{0xee300a81, 0, 0x7fc00001, 0x7f800002, 0x7fc00002,
+			fpscrInvalidOperation},
+		// fnmuls s0, s1, s2
+		{0xee200ac1, 0, three, three, math.Float32bits(-9.0), 0},
+	}
+	for i, test := range tests {
+		v.SetFPSCR(test.fpscr)
+		result, e := runVFPSingleOperation(test.raw, test.a, test.b, p, v)
+		if e != nil {
+			t.Logf("Test %d failed: %s\n", i, e)
+			t.FailNow()
+		}
+		if result != test.expected {
+			t.Logf("Test %d: expected 0x%08x, got 0x%08x\n", i,
+				test.expected, result)
+			t.Fail()
+		}
+		if (v.FPSCR() & 0x9f) != test.flags {
+			t.Logf("Test %d: expected flags 0x%02x, got 0x%02x\n", i,
+				test.flags, v.FPSCR()&0x9f)
+			t.Fail()
+		}
+	}
+	// fmacs s0, s1, s2
+	v.SetFPSCR(0)
+	v.SetSingleRegister(0, 1.0)
+	_, e = runVFPSingleOperation(0xee000a81, three, three, p, v)
+	if (e != nil) || (v.SingleRegister(0) != 10.0) {
+		t.Logf("Incorrect fmacs result: %v, %f\n", e, v.SingleRegister(0))
+		t.Fail()
+	}
+	// fmscd d0, d1, d2
+	v.SetDoubleRegister(0, 1.0)
+	v.SetDoubleRegister(1, 3.0)
+	v.SetDoubleRegister(2, 0.5)
+	e = testSingleInstruction(0xee110b02, p)
+	if (e != nil) || (v.DoubleRegister(0) != 0.5) {
+		t.Logf("Incorrect fmscd result: %v, %f\n", e, v.DoubleRegister(0))
+		t.Fail()
+	}
+	// fdivd d0, d1, d2 rounding towards zero
+	v.SetFPSCR(0xc00000)
+	v.SetDoubleRegister(1, 2.0)
+	v.SetDoubleRegister(2, 3.0)
+	e = testSingleInstruction(0xee810b02, p)
+	bits := math.Float64bits(v.DoubleRegister(0))
+	if (e != nil) || (bits != 0x3fe5555555555555) {
+		t.Logf("Incorrect fdivd result: %v, 0x%016x\n", e, bits)
+		t.Fail()
+	}
+}
+
+func TestVFPVectors(t *testing.T) {
+	p, v, e := setupVFPTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	for i := uint8(0); i < 8; i++ {
+		v.SetSingleRegister(16+i, float32(i))
+		v.SetSingleRegister(24+i, float32(10*i))
+	}
+	// A vector length of 4 and a stride of 1.
+	v.SetFPSCR(0x30000)
+	// fadds s8, s16, s24
+	e = testSingleInstruction(0xee384a0c, p)
+	if e != nil {
+		t.Logf("Failed running vector fadds: %s\n", e)
+		t.FailNow()
+	}
+	for i := uint8(0); i < 8; i++ {
+		expected := float32(11 * i)
+		if i >= 4 {
+			expected = 0
+		}
+		if v.SingleRegister(8+i) != expected {
+			t.Logf("Expected s%d to be %f, got %f\n", 8+i, expected,
+				v.SingleRegister(8+i))
+			t.Fail()
+		}
+	}
+	// fmuls s8, s16, s0, using a scalar operand.
+	v.SetSingleRegister(0, 2.0)
+	e = testSingleInstruction(0xee284a00, p)
+	if (e != nil) || (v.SingleRegister(11) != 6.0) {
+		t.Logf("Incorrect mixed vector/scalar result: %v, %f\n", e,
+			v.SingleRegister(11))
+		t.Fail()
+	}
+	// fcpys s14, s22 wraps around within the bank.
+	e = testSingleInstruction(0xeeb07a4b, p)
+	if (e != nil) || (v.SingleRegister(15) != 7.0) ||
+		(v.SingleRegister(8) != 0.0) || (v.SingleRegister(9) != 1.0) {
+		t.Logf("Incorrect wrapped vector result: %v\n", e)
+		t.Fail()
+	}
+	// fcpys s0, s16 is scalar, since the destination is in the first bank.
+	v.SetSingleRegister(1, 5.0)
+	e = testSingleInstruction(0xeeb00a48, p)
+	if (e != nil) || (v.SingleRegister(1) != 5.0) {
+		t.Logf("Scalar operation modified s1: %v\n", e)
+		t.Fail()
+	}
+	// A stride of 2 with doubles: faddd d4, d8, d12 with a length of 2.
+	v.SetFPSCR(0x310000)
+	for i := uint8(0); i < 4; i++ {
+		v.SetDoubleRegister(8+i, float64(i))
+		v.SetDoubleRegister(12+i, 100.0)
+		v.SetDoubleRegister(4+i, 0)
+	}
+	e = testSingleInstruction(0xee384b0c, p)
+	if (e != nil) || (v.DoubleRegister(4) != 100.0) ||
+		(v.DoubleRegister(5) != 0) || (v.DoubleRegister(6) != 102.0) {
+		t.Logf("Incorrect strided vector result: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestVFPCompareAndConvert(t *testing.T) {
+	p, v, e := setupVFPTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	v.SetSingleRegister(0, 1.0)
+	v.SetSingleRegister(1, 2.0)
+	program := []uint32{
+		// fcmps s0, s1
+		0xeeb40a60,
+		// fmstat
+		0xeef1fa10,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	if !p.Negative() || p.Zero() || p.Carry() || p.Overflow() {
+		t.Logf("fmstat didn't set the CPSR flags to less than.\n")
+		t.Fail()
+	}
+	// fcmpes s0, s1 with a quiet NaN is unordered and invalid.
+	v.registers[1] = 0x7fc00000
+	e = testSingleInstruction(0xeeb40ae0, p)
+	if (e != nil) || ((v.FPSCR() >> 28) != 0x3) ||
+		((v.FPSCR() & fpscrInvalidOperation) == 0) {
+		t.Logf("Incorrect unordered comparison: %v, 0x%08x\n", e, v.FPSCR())
+		t.Fail()
+	}
+	// fcmpzs s0
+	v.SetSingleRegister(0, 0.0)
+	e = testSingleInstruction(0xeeb50a40, p)
+	if (e != nil) || ((v.FPSCR() >> 28) != 0x6) {
+		t.Logf("Incorrect fcmpzs result: %v, 0x%08x\n", e, v.FPSCR())
+		t.Fail()
+	}
+	type conversionTest struct {
+		raw      uint32
+		input    float32
+		expected uint32
+	}
+	tests := []conversionTest{
+		// ftosis s0, s1 rounds to nearest even.
+		{0xeebd0a60, 2.5, 2},
+		{0xeebd0a60, -3.5, 0xfffffffc},
+		// ftosizs s0, s1 rounds towards zero.
+		{0xeebd0ae0, -2.7, 0xfffffffe},
+		// ftouis s0, s1 saturates.
+		{0xeebc0a60, -1.0, 0},
+		{0xeebc0a60, 5e9, 0xffffffff},
+	}
+	for i, test := range tests {
+		v.SetFPSCR(0)
+		v.SetSingleRegister(1, test.input)
+		e = testSingleInstruction(test.raw, p)
+		if (e != nil) || (v.registers[0] != test.expected) {
+			t.Logf("Conversion %d failed: %v, 0x%08x\n", i, e, v.registers[0])
+			t.Fail()
+		}
+	}
+	// fsitod d0, s2
+	v.registers[2] = 0xfffffffb
+	e = testSingleInstruction(0xeeb80bc1, p)
+	if (e != nil) || (v.DoubleRegister(0) != -5.0) {
+		t.Logf("Incorrect fsitod result: %v, %f\n", e, v.DoubleRegister(0))
+		t.Fail()
+	}
+	// fcvtds d1, s1 and fcvtsd s0, d1
+	v.SetSingleRegister(1, 1.5)
+	e = testSingleInstruction(0xeeb71ae0, p)
+	if (e != nil) || (v.DoubleRegister(1) != 1.5) {
+		t.Logf("Incorrect fcvtds result: %v, %f\n", e, v.DoubleRegister(1))
+		t.Fail()
+	}
+	v.SetDoubleRegister(1, 0.1)
+	e = testSingleInstruction(0xeeb70bc1, p)
+	if (e != nil) || (v.SingleRegister(0) != float32(0.1)) {
+		t.Logf("Incorrect fcvtsd result: %v, %f\n", e, v.SingleRegister(0))
+		t.Fail()
+	}
+}
+
+func TestVFPTransfers(t *testing.T) {
+	p, v, e := setupVFPTestProcessor()
+	if e != nil {
+		t.FailNow()
+	}
+	for i := uint8(0); i < 4; i++ {
+		v.SetSingleRegister(i, float32(i+1))
+	}
+	p.SetRegister(1, 0x1800)
+	p.SetRegister(2, 0xdeadbeef)
+	program := []uint32{
+		// fstmias r1!, {s0-s3}
+		0xeca10a04,
+		// fldmdbd r1!, {d2-d3}
+		0xed312b04,
+		// flds s8, [r1, 8]
+		0xed914a02,
+		// fsts s8, [r1, -4]
+		0xed014a01,
+		// fmsr s9, r2
+		0xee042a90,
+		// fmrdh r3, d2
+		0xee323b10,
+		// flds s10, 4 (pc-relative, loading the next instruction)
+		0xed1f5a01,
+		// fmrs r4, s10
+		0xee154a10,
+	}
+	e = writeInstructionsToMemory(program, p)
+	if e != nil {
+		t.FailNow()
+	}
+	p.SetRegister(15, 4096)
+	e = runMultipleInstructions(len(program), p, t)
+	if e != nil {
+		t.FailNow()
+	}
+	value, _ := p.GetRegister(1)
+	if value != 0x1800 {
+		t.Logf("Incorrect base register after writeback: 0x%08x\n", value)
+		t.Fail()
+	}
+	for i := uint8(0); i < 4; i++ {
+		if v.registers[4+i] != v.registers[i] {
+			t.Logf("s%d doesn't match s%d after fldmdbd.\n", 4+i, i)
+			t.Fail()
+		}
+	}
+	if v.SingleRegister(8) != 3.0 {
+		t.Logf("Incorrect flds result: %f\n", v.SingleRegister(8))
+		t.Fail()
+	}
+	value, _ = p.GetMemoryInterface().ReadMemoryWord(0x17fc)
+	if value != math.Float32bits(3.0) {
+		t.Logf("Incorrect fsts result: 0x%08x\n", value)
+		t.Fail()
+	}
+	if v.registers[9] != 0xdeadbeef {
+		t.Logf("Incorrect fmsr result: 0x%08x\n", v.registers[9])
+		t.Fail()
+	}
+	value, _ = p.GetRegister(3)
+	if value != math.Float32bits(2.0) {
+		t.Logf("Incorrect fmrdh result: 0x%08x\n", value)
+		t.Fail()
+	}
+	value, _ = p.GetRegister(4)
+	if value != 0xee154a10 {
+		t.Logf("Incorrect pc-relative flds result: 0x%08x\n", value)
+		t.Fail()
+	}
+}